@@ -38,11 +38,30 @@ extern void *
 udp_thread_func(
     void *thread_params);
 
+extern void *
+rtp_thread_func(
+    void *thread_params);
+
+extern int
+rtp_channel_output(
+    void *opaque,
+    uint8_t *buf,
+    int len);
+
+extern int
+udp_bind_socket(
+    const char *host,
+    const char *port,
+    const char *url,
+    socklen_t *salen);
+
 typedef struct udp_thread_params_t {
     int             fd;             /* Socket fd to read UDP datagrams */
     elv_channel_t   *udp_channel;   /* udp channel to keep incomming UDP packets */
     socklen_t       salen;
     ioctx_t         *inctx;
+    int             fec_fd[2];      /* RTP only: SMPTE 2022-1 column and row FEC sockets, -1 if not used */
+    int             pkt_num;        /* RTP only: # of packets pushed into udp channel */
 } udp_thread_params_t;
 
 static int
@@ -58,7 +77,7 @@ int64_t AVPipeSeekInput(int64_t, int64_t, int);
 int     AVPipeCloseInput(int64_t);
 int     AVPipeStatInput(int64_t, int, avp_stat_t, void *);
 int64_t AVPipeOpenOutput(int64_t, int, int, int64_t, int);
-int64_t AVPipeOpenMuxOutput(char *, int);
+int64_t AVPipeOpenMuxOutput(char *, char *, int);
 int     AVPipeWriteOutput(int64_t, int64_t, uint8_t *, int);
 int     AVPipeWriteMuxOutput(int64_t, uint8_t *, int);
 int64_t AVPipeSeekOutput(int64_t, int64_t, int64_t, int);
@@ -301,6 +320,21 @@ in_stat(
         rc = AVPipeStatInput(fd, stream_index, stat_type, c->data);
         break;
 
+    case in_stat_timed_metadata:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->timed_metadata);
+        break;
+
+    case in_stat_loudness:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->loudness);
+        break;
+    case in_stat_qc:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->qc_event);
+        break;
+
+    case in_stat_scene:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->scene_cut);
+        break;
+
     default:
         rc = -1;
     }
@@ -366,8 +400,15 @@ udp_in_opener(
     *((int *)((int64_t *)inctx->opaque+1)) = sockfd;
 
     int64_t fd = AVPipeOpenInput((char *) url, &size);
-    if (fd <= 0 )
+    if (fd <= 0 ) {
+        elv_err("Failed to open input UDP url=%s", url);
+        close(sockfd);
+        free(inctx->opaque);
+        inctx->opaque = NULL;
+        elv_channel_fini(&inctx->udp_channel);
+        inctx->udp_channel = NULL;
         return -1;
+    }
 
     if (size > 0)
         inctx->sz = size;
@@ -576,6 +617,36 @@ udp_in_stat(
             elv_dbg("IN STAT UDP SCTE35 fd=%d, stat_type=%d, url=%s", fd, stat_type, c->url);
         rc = AVPipeStatInput(fd, stream_index, stat_type, c->data);
         break;
+    case in_stat_timed_metadata:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP TIMED METADATA fd=%d, type=%d, pts=%"PRId64", size=%d, url=%s",
+                fd, c->timed_metadata->type, c->timed_metadata->pts, c->timed_metadata->size, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->timed_metadata);
+        break;
+    case in_stat_loudness:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP LOUDNESS fd=%d, stream_index=%d, I=%.1f, LRA=%.1f, TP=%.1f, url=%s",
+                fd, stream_index, c->loudness->integrated, c->loudness->range, c->loudness->true_peak, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->loudness);
+        break;
+    case in_stat_qc:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP QC fd=%d, stream_index=%d, %s start=%.3f end=%.3f, url=%s",
+                fd, stream_index, qc_event_type_name(c->qc_event->type), c->qc_event->start, c->qc_event->end, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->qc_event);
+        break;
+    case in_stat_scene:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP SCENE fd=%d, stream_index=%d, pts=%"PRId64" time=%.3f score=%.3f, url=%s",
+                fd, stream_index, c->scene_cut->pts, c->scene_cut->time, c->scene_cut->score, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, c->scene_cut);
+        break;
+    case in_stat_rtp:
+        if (debug_frame_level)
+            elv_dbg("IN STAT RTP fd=%d, received=%"PRId64", lost=%"PRId64", recovered=%"PRId64", url=%s",
+                fd, c->rtp_stats.packets_received, c->rtp_stats.packets_lost, c->rtp_stats.packets_recovered, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->rtp_stats);
+        break;
     default:
         elv_err("IN STAT UDP fd=%d, invalid input stat=%d, url=%s", stat_type, c->url);
         return 1;
@@ -585,6 +656,118 @@ udp_in_stat(
 }
 
 
+static int
+rtp_in_opener(
+    const char *url,
+    ioctx_t *inctx)
+{
+    int                 rc;
+    int                 sockfd;
+    socklen_t           salen;
+    int64_t             size;
+    udp_thread_params_t *params;
+    url_parser_t        url_parser;
+    xcparams_t          *xcparams = inctx->params;
+
+    rc = parse_url((char *)url, &url_parser);
+    if (rc) {
+        elv_err("Failed to parse input url=%s", url);
+        inctx->opaque = NULL;
+        return -1;
+    }
+
+    sockfd = udp_bind_socket(url_parser.host, url_parser.port, url, &salen);
+    if (sockfd < 0) {
+        inctx->opaque = NULL;
+        free_parsed_url(&url_parser);
+        return -1;
+    }
+
+    params = (udp_thread_params_t *) calloc(1, sizeof(udp_thread_params_t));
+    params->fd = sockfd;
+    params->salen = salen;
+    params->fec_fd[0] = -1;
+    params->fec_fd[1] = -1;
+
+    /* SMPTE 2022-1 sends column FEC on port+2 and row FEC on port+4 */
+    if (xcparams && xcparams->rtp_fec) {
+        int fec_ports[2] = { RTP_FEC_COLUMN_PORT, RTP_FEC_ROW_PORT };
+        for (int i=0; i<2; i++) {
+            char port[16];
+            socklen_t fec_salen;
+            snprintf(port, sizeof(port), "%d", atoi(url_parser.port) + fec_ports[i]);
+            params->fec_fd[i] = udp_bind_socket(url_parser.host, port, url, &fec_salen);
+            if (params->fec_fd[i] < 0)
+                elv_warn("RTP FEC disabled on port=%s, url=%s", port, url);
+        }
+    }
+    free_parsed_url(&url_parser);
+
+    elv_channel_init(&inctx->udp_channel, MAX_UDP_CHANNEL, NULL);
+    inctx->opaque = (int *) calloc(1, sizeof(int)+sizeof(int64_t));
+    *((int *)((int64_t *)inctx->opaque+1)) = sockfd;
+
+    int64_t fd = AVPipeOpenInput((char *) url, &size);
+    if (fd <= 0 ) {
+        elv_err("Failed to open input RTP url=%s", url);
+        for (int i=0; i<2; i++) {
+            if (params->fec_fd[i] >= 0)
+                close(params->fec_fd[i]);
+        }
+        close(sockfd);
+        free(params);
+        free(inctx->opaque);
+        inctx->opaque = NULL;
+        /* elv_channel_fini() doesn't reset the pointer, and xc_fini() frees a non NULL channel */
+        elv_channel_fini(&inctx->udp_channel);
+        inctx->udp_channel = NULL;
+        return -1;
+    }
+
+    if (size > 0)
+        inctx->sz = size;
+
+    *((int64_t *)(inctx->opaque)) = fd;
+    inctx->url = strdup(url);
+
+    params->udp_channel = inctx->udp_channel;
+    params->inctx = inctx;
+    inctx->rtp_ctx = rtp_ctx_new(xcparams ? xcparams->rtp_jitter_buffer : 0, rtp_channel_output, params);
+
+    /* Start a thread to de-encapsulate RTP into UDP channel */
+    pthread_create(&inctx->utid, NULL, rtp_thread_func, params);
+    elv_dbg("IN OPEN RTP fd=%d, sockfd=%d, fec_fd=%d,%d, url=%s, tid=%"PRId64,
+        fd, sockfd, params->fec_fd[0], params->fec_fd[1], url, inctx->utid);
+    return 0;
+}
+
+static int
+rtp_in_read_packet(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size)
+{
+    ioctx_t *c = (ioctx_t *)opaque;
+    rtp_stats_t stats;
+    int r;
+
+    r = udp_in_read_packet(opaque, buf, buf_size);
+    if (r <= 0 || !c->rtp_ctx)
+        return r;
+
+    /* Report periodically, and as soon as a packet is lost or recovered */
+    rtp_get_stats(c->rtp_ctx, &stats);
+    if (c->read_bytes - c->read_reported > BYTES_READ_REPORT ||
+        stats.packets_lost != c->rtp_stats.packets_lost ||
+        stats.packets_recovered != c->rtp_stats.packets_recovered) {
+        c->rtp_stats = stats;
+        udp_in_stat(opaque, 0, in_stat_rtp);
+        c->read_reported = c->read_bytes;
+    }
+
+    return r;
+}
+
 static int
 out_opener(
     const char *url,
@@ -751,6 +934,12 @@ out_stat(
             rc = AVPipeStatOutput(h, fd, stream_index, buftype, stat_type, &encoding_frame_stats);
         }
         break;
+    case out_stat_splice_point:
+        rc = AVPipeStatOutput(h, fd, stream_index, buftype, stat_type, &outctx->encoder_ctx->splice_point);
+        break;
+    case out_stat_emsg:
+        rc = AVPipeStatOutput(h, fd, stream_index, buftype, stat_type, outctx->encoder_ctx->emsg_event);
+        break;
     default:
         break;
     }
@@ -897,8 +1086,8 @@ set_handlers(
     }
 
     /*
-     * If input url is a UDP set/overwrite the default UDP input handlers.
-     * No need for the client code to set/specify the input handlers when the input is UDP.
+     * If input url is a UDP or RTP set/overwrite the default UDP input handlers.
+     * No need for the client code to set/specify the input handlers when the input is UDP or RTP.
      */
     if (!strcmp(url_parser.protocol, "udp") && p_in_handlers) {
         avpipe_io_handler_t *in_handlers = (avpipe_io_handler_t *)calloc(1, sizeof(avpipe_io_handler_t));
@@ -909,6 +1098,16 @@ set_handlers(
         in_handlers->avpipe_seeker = udp_in_seek;
         in_handlers->avpipe_stater = udp_in_stat;
         *p_in_handlers = in_handlers;
+    } else if (!strcmp(url_parser.protocol, "rtp") && p_in_handlers) {
+        /* RTP/MPEGTS is de-encapsulated by avpipe, the same as UDP after that */
+        avpipe_io_handler_t *in_handlers = (avpipe_io_handler_t *)calloc(1, sizeof(avpipe_io_handler_t));
+        in_handlers->avpipe_opener = rtp_in_opener;
+        in_handlers->avpipe_closer = udp_in_closer;
+        in_handlers->avpipe_reader = rtp_in_read_packet;
+        in_handlers->avpipe_writer = udp_in_write_packet;
+        in_handlers->avpipe_seeker = udp_in_seek;
+        in_handlers->avpipe_stater = udp_in_stat;
+        *p_in_handlers = in_handlers;
     } else if (p_in_handlers) {
         avpipe_io_handler_t *in_handlers = (avpipe_io_handler_t *)calloc(1, sizeof(avpipe_io_handler_t));
         in_handlers->avpipe_opener = in_opener;
@@ -1018,6 +1217,30 @@ xc_cancel(
     return xc_table_cancel(handle);
 }
 
+int
+xc_insert_cue(
+    int32_t handle,
+    int64_t pts,
+    uint8_t *section,
+    int size)
+{
+    int rc = eav_xc_table;
+
+    /* Hold the table lock so the transcoding can't be freed while the cue is queued */
+    pthread_mutex_lock(&tx_mutex);
+    for (int i=0; i<MAX_TX; i++) {
+        if (xc_table[i] != NULL && xc_table[i]->handle == handle) {
+            rc = avpipe_insert_cue(xc_table[i]->xctx, pts, section, size);
+            break;
+        }
+    }
+    pthread_mutex_unlock(&tx_mutex);
+
+    if (rc == eav_xc_table)
+        elv_err("xc_insert_cue invalid handle=%d", handle);
+    return rc;
+}
+
 /*
  * 1) Initializes avpipe with appropriate parameters.
  * 2) Invokes avpipe trnascoding.
@@ -1209,7 +1432,9 @@ out_mux_opener(
     outctx->bufsz = AVIO_OUT_BUF_SIZE;
     outctx->buf = (unsigned char *)av_malloc(outctx->bufsz); /* Must be malloc'd - will be realloc'd by avformat */
 
-    fd = AVPipeOpenMuxOutput((char *) url, outctx->type);
+    /* The outputs of a muxing are opened with the opener of the muxing output url */
+    char *out_url = outctx->in_mux_ctx ? outctx->in_mux_ctx->out_filename : (char *) url;
+    fd = AVPipeOpenMuxOutput(out_url, (char *) url, outctx->type);
     if (xcparams != NULL && xcparams->debug_frame_level)
         elv_dbg("OUT out_mux_opener outctx=%p, fd=%"PRId64, outctx, fd);
     if (fd < 0) {
@@ -1385,6 +1610,104 @@ get_profile_name(
     return avcodec_profile_name((enum AVCodecID) codec_id, profile);
 }
 
+int
+analyze_loudness(
+    xcparams_t *params,
+    loudness_stats_t **loudness,
+    int *n_loudness)
+{
+    avpipe_io_handler_t *in_handlers = NULL;
+    int rc;
+
+    if (!params || !params->url || params->url[0] == '\0' )
+        return eav_param;
+
+    connect_ffmpeg_log();
+    rc = set_handlers(params->url, &in_handlers, NULL);
+    if (rc != eav_success)
+        goto end_analyze_loudness;
+
+    rc = avpipe_analyze_loudness(in_handlers, params, loudness, n_loudness);
+
+end_analyze_loudness:
+    elv_dbg("Releasing loudness analysis resources, url=%s", params->url);
+    free(in_handlers);
+    return rc;
+}
+
+int
+analyze_scenes(
+    xcparams_t *params,
+    scene_cut_t **scene_cuts,
+    int *n_scene_cuts)
+{
+    avpipe_io_handler_t *in_handlers = NULL;
+    int rc;
+
+    if (!params || !params->url || params->url[0] == '\0' )
+        return eav_param;
+
+    connect_ffmpeg_log();
+    rc = set_handlers(params->url, &in_handlers, NULL);
+    if (rc != eav_success)
+        goto end_analyze_scenes;
+
+    rc = avpipe_analyze_scenes(in_handlers, params, scene_cuts, n_scene_cuts);
+
+end_analyze_scenes:
+    elv_dbg("Releasing scene analysis resources, url=%s", params->url);
+    free(in_handlers);
+    return rc;
+}
+
+int
+analyze_crop(
+    xcparams_t *params,
+    crop_rect_t *crop)
+{
+    avpipe_io_handler_t *in_handlers = NULL;
+    int rc;
+
+    if (!params || !params->url || params->url[0] == '\0' )
+        return eav_param;
+
+    connect_ffmpeg_log();
+    rc = set_handlers(params->url, &in_handlers, NULL);
+    if (rc != eav_success)
+        goto end_analyze_crop;
+
+    rc = avpipe_analyze_crop(in_handlers, params, crop);
+
+end_analyze_crop:
+    elv_dbg("Releasing crop analysis resources, url=%s", params->url);
+    free(in_handlers);
+    return rc;
+}
+
+int
+compare(
+    compare_params_t *params,
+    char **report)
+{
+    avpipe_io_handler_t *in_handlers = NULL;
+    int rc;
+
+    if (!params || !params->distorted_url || params->distorted_url[0] == '\0' )
+        return eav_param;
+
+    connect_ffmpeg_log();
+    rc = set_handlers(params->distorted_url, &in_handlers, NULL);
+    if (rc != eav_success)
+        goto end_compare;
+
+    rc = avpipe_compare(in_handlers, params, report);
+
+end_compare:
+    elv_dbg("Releasing compare resources, url=%s", params->distorted_url);
+    free(in_handlers);
+    return rc;
+}
+
 int
 probe(
     xcparams_t *params,
@@ -40,6 +40,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"math/rand"
 	"sync"
@@ -88,6 +89,22 @@ const (
 	FrameImage
 	// MpegtsSegment 17
 	MpegtsSegment
+	// CaptionWebVTTSegment 18 (HLS captions, the stream index is the caption track)
+	CaptionWebVTTSegment
+	// CaptionTTMLSegment 19 (DASH captions, the stream index is the caption track)
+	CaptionTTMLSegment
+	// SubtitleInitSegment 20 (init segment of a muxed subtitle track, the stream index is the subtitle track)
+	SubtitleInitSegment
+	// SubtitleSegment 21 (segment of a muxed subtitle track, the stream index is the subtitle track)
+	SubtitleSegment
+	// SubtitleManifest 22 (subtitle MPD, media playlist or master playlist tags of a muxing)
+	SubtitleManifest
+	// QCReport 23 (JSON QcReport of the silence, black and frozen frame intervals of a transcoding)
+	QCReport
+	// ShotList 24 (JSON Shots of the scene cuts of the video of a transcoding)
+	ShotList
+	// AudioRenditionManifest 25 (DASH AdaptationSets or HLS EXT-X-MEDIA tags of the AudioRenditions of a transcoding)
+	AudioRenditionManifest
 )
 
 func (a AVType) Name() string {
@@ -126,11 +143,40 @@ func (a AVType) Name() string {
 		return "FrameImage"
 	case MpegtsSegment:
 		return "MpegtsSegment"
+	case CaptionWebVTTSegment:
+		return "CaptionWebVTTSegment"
+	case CaptionTTMLSegment:
+		return "CaptionTTMLSegment"
+	case SubtitleInitSegment:
+		return "SubtitleInitSegment"
+	case SubtitleSegment:
+		return "SubtitleSegment"
+	case SubtitleManifest:
+		return "SubtitleManifest"
+	case QCReport:
+		return "QCReport"
+	case ShotList:
+		return "ShotList"
+	case AudioRenditionManifest:
+		return "AudioRenditionManifest"
 	default:
 		return fmt.Sprintf("Unknown(%d)", a)
 	}
 }
 
+// CaptionTrackName returns the name of the caption track of a CaptionWebVTTSegment or CaptionTTMLSegment
+// output, given its stream index: CC1-CC4 for CEA-608 and SERVICE1-SERVICE6 for CEA-708.
+func CaptionTrackName(streamIndex int) string {
+	switch {
+	case streamIndex >= 0 && streamIndex < 4:
+		return fmt.Sprintf("CC%d", streamIndex+1)
+	case streamIndex >= 4 && streamIndex < 10:
+		return fmt.Sprintf("SERVICE%d", streamIndex-3)
+	default:
+		return ""
+	}
+}
+
 type AVClass = string
 
 var AVClassE = struct {
@@ -153,9 +199,10 @@ func (a AVType) AVClass() AVClass {
 	switch a {
 	case FMP4AudioSegment, FMP4VideoSegment, MP4Segment:
 		return AVClassE.Mez
-	case DASHAudioInit, DASHAudioSegment, DASHVideoInit, DASHVideoSegment:
+	case DASHAudioInit, DASHAudioSegment, DASHVideoInit, DASHVideoSegment,
+		CaptionWebVTTSegment, CaptionTTMLSegment, SubtitleInitSegment, SubtitleSegment:
 		return AVClassE.Abr
-	case HLSAudioM3U, HLSMasterM3U, HLSVideoM3U, DASHManifest:
+	case HLSAudioM3U, HLSMasterM3U, HLSVideoM3U, DASHManifest, SubtitleManifest:
 		return AVClassE.Manifest
 	case FrameImage:
 		return AVClassE.Frame
@@ -183,6 +230,7 @@ const (
 	XcExtractImages           = 65  // XcVideo | 2^6
 	XcExtractAllImages        = 129 // XcVideo | 2^7
 	Xcprobe                   = 256
+	XcExtractCaptions         = 513 // XcVideo | 2^9
 )
 
 type XcProfile int
@@ -222,6 +270,8 @@ func XcTypeFromString(xcTypeStr string) XcType {
 		xcType = XcExtractImages
 	case "extract-all-images":
 		xcType = XcExtractAllImages
+	case "extract-captions":
+		xcType = XcExtractCaptions
 	default:
 		xcType = XcNone
 	}
@@ -256,7 +306,64 @@ const (
 	CryptCBCS
 )
 
+// ColorTarget is the color space of the video outputs
+type ColorTarget int
+
+const (
+	// ColorTargetNone - keep the color space of the input
+	ColorTargetNone ColorTarget = iota
+	// ColorTargetSDR - SDR BT.709, HDR inputs are tone mapped
+	ColorTargetSDR
+	// ColorTargetPQ - HDR10, BT.2020 with the PQ transfer
+	ColorTargetPQ
+	// ColorTargetHLG - HDR, BT.2020 with the HLG transfer
+	ColorTargetHLG
+)
+
+// FpsMode is the frame rate conversion of the video
+type FpsMode int
+
+const (
+	// FpsModeNone - no frame rate conversion
+	FpsModeNone FpsMode = iota
+	// FpsModeDropDup - drop or duplicate frames to FrameRate
+	FpsModeDropDup
+	// FpsModeBlend - blend the neighbour frames to FrameRate
+	FpsModeBlend
+	// FpsModeTelecine - 3:2 pulldown, 23.976 progressive to 29.97 interlaced
+	FpsModeTelecine
+	// FpsModeIVTC - inverse telecine, 29.97 telecined to 23.976 progressive
+	FpsModeIVTC
+)
+
+// RcMode is the rate control of the video encoder
+type RcMode int
+
+const (
+	// RcModeDefault - CRF (CrfStr) or ABR (VideoBitrate) with RcMaxRate/RcBufferSize
+	RcModeDefault RcMode = iota
+	// RcModeCrfCapped - CRF (CrfStr) capped by RcMaxRate/RcBufferSize, libx264 and libx265 only
+	RcModeCrfCapped
+	// RcModeTwoPass - two-pass VBR to VideoBitrate, peaks capped by RcMaxRate if set, libx264 and libx265 only
+	RcModeTwoPass
+	// RcModeCbr - strict CBR at VideoBitrate with filler data, libx264, libx265 and h264_nvenc
+	RcModeCbr
+)
+
+// AudioRendition is an audio output of a dash, hls or fmp4-segment XcAudio transcoding, see XcParams.AudioRenditions
+type AudioRendition struct {
+	AudioIndex    int32  `json:"audio_index"`              // Input audio stream
+	Ecodec        string `json:"ecodec"`                   // Audio encoder: "aac", "ac3", "eac3" or "libopus"
+	Passthrough   bool   `json:"passthrough,omitempty"`    // Copy the packets without decoding if the input stream is already Ecodec
+	ChannelLayout int    `json:"channel_layout,omitempty"` // 0 keeps the channel layout of the input if the encoder supports it
+	Bitrate       int32  `json:"bitrate,omitempty"`        // 0 means AudioBitrate
+	SampleRate    int32  `json:"sample_rate,omitempty"`    // 0 keeps the sample rate of the input if the encoder supports it
+	Name          string `json:"name,omitempty"`           // NAME (HLS) or Label (DASH) of the rendition in the manifest
+	Lang          string `json:"lang,omitempty"`           // Language (RFC 5646) of the rendition in the manifest
+}
+
 const MaxAudioMux = C.MAX_STREAMS
+const MaxMuxParts = C.MAX_MUX_IN_STREAM
 
 // XcParams should match with txparams_t in avpipe_xc.h
 type XcParams struct {
@@ -318,6 +425,7 @@ type XcParams struct {
 	Listen                 bool        `json:"listen"`
 	ConnectionTimeout      int         `json:"connection_timeout"`
 	FilterDescriptor       string      `json:"filter_descriptor"`
+	ChannelMap             *ChannelMap `json:"channel_map,omitempty"` // Generates xc_type, audio_index, channel_layout and filter_descriptor
 	SkipDecoding           bool        `json:"skip_decoding"`
 	DebugFrameLevel        bool        `json:"debug_frame_level"`
 	ExtractImageIntervalTs int64       `json:"extract_image_interval_ts,omitempty"`
@@ -328,6 +436,38 @@ type XcParams struct {
 	Profile                string      `json:"profile,omitempty"`
 	Level                  int         `json:"level,omitempty"`
 	Deinterlace            int         `json:"deinterlace,omitempty"`
+	RtpFec                 bool        `json:"rtp_fec,omitempty"`           // Receive SMPTE 2022-1 FEC on port+2 (column) and port+4 (row)
+	RtpJitterBuffer        int         `json:"rtp_jitter_buffer,omitempty"` // RTP reorder window in packets, 0 means auto
+	Scte35PID              int         `json:"scte35_pid,omitempty"`        // Copy MPEGTS only: PID of the cues inserted by XcInsertCue, 0 means no cue insertion
+	SpliceSegment          bool        `json:"splice_segment,omitempty"`    // dash/hls/fmp4-segment only: force an IDR frame and a new segment at SCTE-35 splice points
+	EmitEmsg               bool        `json:"emit_emsg,omitempty"`         // dash/hls/fmp4-segment only: write input SCTE-35 and ID3 events as emsg boxes in the video segments
+	ExtractCaptions        bool        `json:"extract_captions,omitempty"`  // dash/hls only: write the CEA-608/708 captions as WebVTT (hls) or TTML (dash) segments
+	StripCaptions          bool        `json:"strip_captions,omitempty"`    // Do not pass the A/53 captions of the input through to the encoded video
+	Blank                  bool        `json:"blank,omitempty"`             // Replace the decoded video by black frames and the audio by silence
+	RebasePts              bool        `json:"rebase_pts,omitempty"`        // Start the output timestamps at StartPts (in the output time base)
+	SmartCut               bool        `json:"smart_cut,omitempty"`         // Only re-encode the GOPs at StartTimeTs and the end (h264/libx264), copy the others
+	MeasureLoudness        bool        `json:"measure_loudness,omitempty"`  // Measure the loudness of the audio outputs and report it with AV_IN_STAT_LOUDNESS
+	LoudnessTarget         float32     `json:"loudness_target,omitempty"`   // Two-pass loudness normalization to this integrated loudness (LUFS), 0 means no normalization
+	LoudnessTruePeak       float32     `json:"loudness_true_peak"`          // True peak ceiling (dBTP) of the loudness normalization
+	DetectSilence          bool        `json:"detect_silence,omitempty"`    // Report the silences of the audio outputs with AV_IN_STAT_QC and in the QC report
+	DetectBlack            bool        `json:"detect_black,omitempty"`      // Report the black video frames with AV_IN_STAT_QC and in the QC report
+	DetectFreeze           bool        `json:"detect_freeze,omitempty"`     // Report the frozen video frames with AV_IN_STAT_QC and in the QC report
+	QcMinDuration          float32     `json:"qc_min_duration,omitempty"`   // Minimum duration (sec) of a reported interval, 0 means 2 sec
+	SilenceThreshold       float32     `json:"silence_threshold,omitempty"` // Silence threshold (dB), 0 means -60dB
+	DetectScenes           bool        `json:"detect_scenes,omitempty"`     // Report the scene cuts of the video with AV_IN_STAT_SCENE and in the shot list
+	SceneThreshold         float32     `json:"scene_threshold,omitempty"`   // Scene change score (0 to 1) of a scene cut, 0 means 0.4
+	SceneKeyframes         bool        `json:"scene_keyframes,omitempty"`   // Place IDR frames and segment boundaries on the scene cuts found by a first pass
+	SceneTolerance         float32     `json:"scene_tolerance,omitempty"`   // Seconds a segment boundary can move to a scene cut, 0 means 1 sec
+	Crop                   string      `json:"crop,omitempty"`              // Crop rectangle "w:h:x:y" of the decoded video before scaling, or "auto" to detect it with a first pass
+	ColorTarget            ColorTarget `json:"color_target,omitempty"`      // Color space of the video outputs, the decoded video is converted and tone mapped to it
+	FpsMode                FpsMode     `json:"fps_mode,omitempty"`          // Frame rate conversion of the video, the frames keep the timeline of the input
+	FrameRate              string      `json:"frame_rate,omitempty"`        // Output frame rate ("24000/1001", "25", ...) of FpsModeDropDup and FpsModeBlend
+	ProbeCadence           bool        `json:"probe_cadence,omitempty"`     // Probe() decodes the first frames of the video to find its cadence
+	RcMode                 RcMode      `json:"rc_mode,omitempty"`           // Rate control of the video encoder, validated per encoder
+
+	// Audio outputs of a dash, hls or fmp4-segment XcAudio transcoding, each one encoded (or copied) from an
+	// input audio stream. Ecodec2 is not used and AudioIndex defaults to the input streams of the renditions.
+	AudioRenditions []AudioRendition `json:"audio_renditions,omitempty"`
 }
 
 // NewXcParams initializes a XcParams struct with unset/default values
@@ -344,6 +484,7 @@ func NewXcParams() *XcParams {
 		EncWidth:               -1,
 		ExtractImageIntervalTs: -1,
 		GPUIndex:               -1,
+		LoudnessTruePeak:       -1,
 		SampleRate:             -1,
 		SegDuration:            "30",
 		StartFragmentIndex:     1,
@@ -444,6 +585,25 @@ var AVFieldOrderNames = map[AVFieldOrder]string{
 	AV_FIELD_BT:          "bt",
 }
 
+// Cadence of the video found by Probe() if XcParams.ProbeCadence is set, it matches with cadence_t in avpipe_xc.h
+type Cadence int
+
+const (
+	CadenceUnknown Cadence = iota
+	CadenceProgressive
+	CadenceInterlacedTFF
+	CadenceInterlacedBFF
+	CadenceTelecine
+)
+
+var CadenceNames = map[Cadence]string{
+	CadenceUnknown:       "",
+	CadenceProgressive:   "progressive",
+	CadenceInterlacedTFF: "interlaced_tff",
+	CadenceInterlacedBFF: "interlaced_bff",
+	CadenceTelecine:      "telecine",
+}
+
 type AVStatType int
 
 const (
@@ -459,6 +619,13 @@ const (
 	AV_OUT_STAT_START_FILE              = 10
 	AV_OUT_STAT_END_FILE                = 11
 	AV_IN_STAT_DATA_SCTE35              = 12
+	AV_IN_STAT_RTP                      = 13
+	AV_OUT_STAT_SPLICE_POINT            = 14
+	AV_OUT_STAT_EMSG                    = 15
+	AV_IN_STAT_TIMED_METADATA           = 16
+	AV_IN_STAT_LOUDNESS                 = 17
+	AV_IN_STAT_QC                       = 18
+	AV_IN_STAT_SCENE                    = 19
 )
 
 func (a AVStatType) Name() string {
@@ -487,6 +654,20 @@ func (a AVStatType) Name() string {
 		return "AV_OUT_STAT_END_FILE"
 	case AV_IN_STAT_DATA_SCTE35:
 		return "AV_IN_STAT_DATA_SCTE35"
+	case AV_IN_STAT_RTP:
+		return "AV_IN_STAT_RTP"
+	case AV_OUT_STAT_SPLICE_POINT:
+		return "AV_OUT_STAT_SPLICE_POINT"
+	case AV_OUT_STAT_EMSG:
+		return "AV_OUT_STAT_EMSG"
+	case AV_IN_STAT_TIMED_METADATA:
+		return "AV_IN_STAT_TIMED_METADATA"
+	case AV_IN_STAT_LOUDNESS:
+		return "AV_IN_STAT_LOUDNESS"
+	case AV_IN_STAT_QC:
+		return "AV_IN_STAT_QC"
+	case AV_IN_STAT_SCENE:
+		return "AV_IN_STAT_SCENE"
 	default:
 		return fmt.Sprintf("Unknown(%d)", a)
 	}
@@ -505,6 +686,7 @@ type StreamInfo struct {
 	CodecType          string            `json:"codec_type"`
 	CodecID            int               `json:"codec_id,omitempty"`
 	CodecName          string            `json:"codec_name,omitempty"`
+	CodecString        string            `json:"codec_string,omitempty"` // RFC 6381 codec string of the manifests, e.g. "av01.0.08M.10"
 	DurationTs         int64             `json:"duration_ts,omitempty"`
 	TimeBase           *big.Rat          `json:"time_base,omitempty"`
 	NBFrames           int64             `json:"nb_frames,omitempty"`
@@ -523,6 +705,11 @@ type StreamInfo struct {
 	SampleAspectRatio  *big.Rat          `json:"sample_aspect_ratio,omitempty"`
 	DisplayAspectRatio *big.Rat          `json:"display_aspect_ratio,omitempty"`
 	FieldOrder         string            `json:"field_order,omitempty"`
+	ColorPrimaries     string            `json:"color_primaries,omitempty"` // Video only, e.g. "bt709", "bt2020"
+	ColorTransfer      string            `json:"color_transfer,omitempty"`  // Video only, e.g. "bt709", "smpte2084", "arib-std-b67"
+	ColorSpace         string            `json:"color_space,omitempty"`     // Video only, e.g. "bt709", "bt2020nc"
+	ColorRange         string            `json:"color_range,omitempty"`     // Video only, "tv" or "pc"
+	Cadence            string            `json:"cadence,omitempty"`         // Video only, set if XcParams.ProbeCadence is set
 	Profile            int               `json:"profile,omitempty"`
 	Level              int               `json:"level,omitempty"`
 	SideData           []interface{}     `json:"side_data,omitempty"`
@@ -896,6 +1083,183 @@ func AVPipeStatInput(fd C.int64_t, stream_index C.int, avp_stat C.avp_stat_t, st
 	return C.int(0)
 }
 
+// RtpStats is reported with AV_IN_STAT_RTP for RTP inputs, periodically and whenever
+// a packet is lost or recovered by FEC.
+type RtpStats struct {
+	PacketsReceived    int64  `json:"packets_received"`
+	PacketsLost        int64  `json:"packets_lost"`
+	PacketsRecovered   int64  `json:"packets_recovered"` // Recovered by SMPTE 2022-1 FEC
+	PacketsReordered   int64  `json:"packets_reordered"`
+	PacketsDuplicated  int64  `json:"packets_duplicated"`
+	PacketsLate        int64  `json:"packets_late"` // Arrived after being delivered or declared lost
+	FecPacketsReceived int64  `json:"fec_packets_received"`
+	BytesReceived      int64  `json:"bytes_received"`
+	SSRC               uint32 `json:"ssrc"`
+	FecColumns         int    `json:"fec_columns"` // FEC matrix L
+	FecRows            int    `json:"fec_rows"`    // FEC matrix D
+}
+
+type TimedMetadataType int
+
+const (
+	TimedMetadataID3 TimedMetadataType = 1 // ID3v2 tag, see ts.ParseID3()
+	TimedMetadataKLV TimedMetadataType = 2 // SMPTE 336M KLV, see ts.ParseKLV()
+)
+
+// TimedMetadata is reported with AV_IN_STAT_TIMED_METADATA for each timed ID3 or KLV PES packet
+// of a MPEG-TS input.
+type TimedMetadata struct {
+	Type TimedMetadataType `json:"type"`
+	PTS  int64             `json:"pts"` // 90kHz, -1 if the packet has no PTS
+	Data []byte            `json:"data"`
+}
+
+// LoudnessStats is the EBU R128 loudness of an audio output, reported with AV_IN_STAT_LOUDNESS at the end of
+// a transcoding if MeasureLoudness is set, and returned by AnalyzeLoudness().
+type LoudnessStats struct {
+	StreamIndex int     `json:"stream_index"` // Input stream index of the audio output (the first input for merge/join)
+	Integrated  float64 `json:"integrated"`   // Integrated loudness (LUFS), -70 if the audio is silent
+	Range       float64 `json:"range"`        // Loudness range (LU)
+	TruePeak    float64 `json:"true_peak"`    // True peak of the loudest channel (dBTP)
+}
+
+func newLoudnessStats(l *C.loudness_stats_t) *LoudnessStats {
+	return &LoudnessStats{
+		StreamIndex: int(l.stream_index),
+		Integrated:  float64(l.integrated),
+		Range:       float64(l._range),
+		TruePeak:    float64(l.true_peak),
+	}
+}
+
+// QcInterval is an interval of silence, black or frozen frames, reported with AV_IN_STAT_QC when it ends.
+// The times are in seconds, in the time line of the input stream.
+type QcInterval struct {
+	Type        string  `json:"type"` // "silence", "black" or "freeze"
+	StreamIndex int     `json:"stream_index"`
+	Start       float64 `json:"start"`
+	End         float64 `json:"end"`
+}
+
+// QcReport is the QC report of a transcoding, written as a QCReport output at the end of the transcoding
+// if DetectSilence, DetectBlack or DetectFreeze is set.
+type QcReport struct {
+	Intervals []*QcInterval `json:"intervals"`
+}
+
+// Filter returns the intervals of the given type.
+func (r *QcReport) Filter(intervalType string) []*QcInterval {
+	intervals := []*QcInterval{}
+	for _, interval := range r.Intervals {
+		if interval.Type == intervalType {
+			intervals = append(intervals, interval)
+		}
+	}
+	return intervals
+}
+
+func newQcInterval(e *C.qc_event_t) *QcInterval {
+	return &QcInterval{
+		Type:        C.GoString(C.qc_event_type_name(e._type)),
+		StreamIndex: int(e.stream_index),
+		Start:       float64(e.start),
+		End:         float64(e.end),
+	}
+}
+
+// SceneCut is a scene cut of the video, the first frame of a shot. It is reported with AV_IN_STAT_SCENE if
+// DetectScenes is set and returned by AnalyzeScenes().
+type SceneCut struct {
+	PTS   int64   `json:"pts"`   // PTS of the frame in the video encoder time base
+	Time  float64 `json:"time"`  // Time of the frame (sec)
+	Score float64 `json:"score"` // Scene change score, from 0 to 1
+}
+
+// Shots is the shot list of a transcoding, written as a ShotList output at the end of the transcoding
+// if DetectScenes is set.
+type Shots struct {
+	SceneCuts []*SceneCut `json:"scene_cuts"`
+}
+
+func newSceneCut(c *C.scene_cut_t) *SceneCut {
+	return &SceneCut{
+		PTS:   int64(c.pts),
+		Time:  float64(c.time),
+		Score: float64(c.score),
+	}
+}
+
+// CropRect is a crop rectangle of the video, returned by AnalyzeCrop().
+type CropRect struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+}
+
+// String returns the crop rectangle as "w:h:x:y", the format of XcParams.Crop.
+func (r *CropRect) String() string {
+	return fmt.Sprintf("%d:%d:%d:%d", r.Width, r.Height, r.X, r.Y)
+}
+
+// CompareParams are the parameters of Compare(). The reference and the distorted videos are read with the IO
+// handlers of their url (InitUrlIOHandler), or the default ones (InitIOHandler).
+type CompareParams struct {
+	ReferenceUrl    string  `json:"reference_url"`
+	DistortedUrl    string  `json:"distorted_url"`
+	Width           int32   `json:"width,omitempty"`        // Common resolution of the comparison, the reference one if not set
+	Height          int32   `json:"height,omitempty"`       // Common resolution of the comparison, the reference one if not set
+	Offset          float64 `json:"offset,omitempty"`       // Seconds added to the distorted timestamps to align it on the reference
+	Vmaf            bool    `json:"vmaf,omitempty"`         // Compute VMAF, skipped if FFmpeg is built without libvmaf
+	VmafModel       string  `json:"vmaf_model,omitempty"`   // Path of the VMAF model, the libvmaf default model if not set
+	SegDuration     float64 `json:"seg_duration,omitempty"` // Duration of the worst segments (sec), 2 if not set
+	NWorst          int32   `json:"n_worst,omitempty"`      // Number of worst segments, 5 if not set
+	Seekable        bool    `json:"seekable,omitempty"`
+	DebugFrameLevel bool    `json:"debug_frame_level,omitempty"`
+}
+
+// MetricStats are the aggregate scores of a metric over all the frames, with the nearest rank percentiles.
+type MetricStats struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	P1   float64 `json:"p1"`
+	P5   float64 `json:"p5"`
+	P10  float64 `json:"p10"`
+	P50  float64 `json:"p50"`
+}
+
+// FrameScore are the scores of a frame of the distorted video. The time is in the time line of the reference.
+type FrameScore struct {
+	Time float64 `json:"time"`
+	Psnr float64 `json:"psnr"`           // Average PSNR of the planes (dB), 100 for identical frames
+	Ssim float64 `json:"ssim"`           // SSIM of all the planes, from 0 to 1
+	Vmaf float64 `json:"vmaf,omitempty"` // VMAF score from 0 to 100
+}
+
+// SegmentScore are the mean scores of the frames of a segment of the distorted video.
+type SegmentScore struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Psnr  float64 `json:"psnr"`
+	Ssim  float64 `json:"ssim"`
+	Vmaf  float64 `json:"vmaf,omitempty"`
+}
+
+// CompareReport is the result of Compare(). The worst segments are sorted from the worst by Metric, which is
+// "vmaf" if VMAF was computed and "ssim" otherwise.
+type CompareReport struct {
+	Width         int             `json:"width"`
+	Height        int             `json:"height"`
+	NFrames       int             `json:"n_frames"`
+	Metric        string          `json:"metric"`
+	Psnr          *MetricStats    `json:"psnr,omitempty"`
+	Ssim          *MetricStats    `json:"ssim,omitempty"`
+	Vmaf          *MetricStats    `json:"vmaf,omitempty"`
+	WorstSegments []*SegmentScore `json:"worst_segments"`
+	Frames        []*FrameScore   `json:"frames"`
+}
+
 func (h *ioHandler) InStat(stream_index C.int, avp_stat C.avp_stat_t, stat_args unsafe.Pointer) error {
 	var err error
 
@@ -922,6 +1286,42 @@ func (h *ioHandler) InStat(stream_index C.int, avp_stat C.avp_stat_t, stat_args
 	case C.in_stat_data_scte35:
 		statArgs := C.GoString((*C.char)(stat_args))
 		err = h.input.Stat(streamIndex, AV_IN_STAT_DATA_SCTE35, statArgs)
+	case C.in_stat_rtp:
+		rtpStats := (*C.rtp_stats_t)(stat_args)
+		statArgs := &RtpStats{
+			PacketsReceived:    int64(rtpStats.packets_received),
+			PacketsLost:        int64(rtpStats.packets_lost),
+			PacketsRecovered:   int64(rtpStats.packets_recovered),
+			PacketsReordered:   int64(rtpStats.packets_reordered),
+			PacketsDuplicated:  int64(rtpStats.packets_duplicated),
+			PacketsLate:        int64(rtpStats.packets_late),
+			FecPacketsReceived: int64(rtpStats.fec_packets_received),
+			BytesReceived:      int64(rtpStats.bytes_received),
+			SSRC:               uint32(rtpStats.ssrc),
+			FecColumns:         int(rtpStats.fec_columns),
+			FecRows:            int(rtpStats.fec_rows),
+		}
+		err = h.input.Stat(streamIndex, AV_IN_STAT_RTP, statArgs)
+	case C.in_stat_timed_metadata:
+		md := (*C.timed_metadata_t)(stat_args)
+		statArgs := &TimedMetadata{
+			Type: TimedMetadataType(md._type),
+			PTS:  int64(md.pts),
+			Data: C.GoBytes(unsafe.Pointer(md.data), md.size),
+		}
+		if statArgs.PTS == math.MinInt64 { // AV_NOPTS_VALUE
+			statArgs.PTS = -1
+		}
+		err = h.input.Stat(streamIndex, AV_IN_STAT_TIMED_METADATA, statArgs)
+	case C.in_stat_loudness:
+		statArgs := newLoudnessStats((*C.loudness_stats_t)(stat_args))
+		err = h.input.Stat(streamIndex, AV_IN_STAT_LOUDNESS, statArgs)
+	case C.in_stat_qc:
+		statArgs := newQcInterval((*C.qc_event_t)(stat_args))
+		err = h.input.Stat(streamIndex, AV_IN_STAT_QC, statArgs)
+	case C.in_stat_scene:
+		statArgs := newSceneCut((*C.scene_cut_t)(stat_args))
+		err = h.input.Stat(streamIndex, AV_IN_STAT_SCENE, statArgs)
 	}
 
 	return err
@@ -981,6 +1381,22 @@ func getAVType(av_type C.int) AVType {
 		return FrameImage
 	case C.avpipe_mpegts_segment:
 		return MpegtsSegment
+	case C.avpipe_caption_webvtt_segment:
+		return CaptionWebVTTSegment
+	case C.avpipe_caption_ttml_segment:
+		return CaptionTTMLSegment
+	case C.avpipe_subtitle_init_segment:
+		return SubtitleInitSegment
+	case C.avpipe_subtitle_segment:
+		return SubtitleSegment
+	case C.avpipe_subtitle_manifest:
+		return SubtitleManifest
+	case C.avpipe_qc_report:
+		return QCReport
+	case C.avpipe_shot_list:
+		return ShotList
+	case C.avpipe_audio_rendition_manifest:
+		return AudioRenditionManifest
 	default:
 		return Unknown
 	}
@@ -1022,27 +1438,23 @@ func AVPipeOpenOutput(handler C.int64_t, stream_index, seg_index C.int, pts C.in
 }
 
 //export AVPipeOpenMuxOutput
-func AVPipeOpenMuxOutput(url *C.char, stream_type C.int) C.int64_t {
-	var out_type AVType
-
+func AVPipeOpenMuxOutput(out_url, url *C.char, stream_type C.int) C.int64_t {
 	gMutex.Lock()
 	gFd++
 	fd := gFd
 	gMutex.Unlock()
-	switch stream_type {
-	case C.avpipe_mp4_segment:
-		out_type = MP4Segment
-	case C.avpipe_video_fmp4_segment:
-		out_type = FMP4VideoSegment
-	case C.avpipe_audio_fmp4_segment:
-		out_type = FMP4AudioSegment
+	out_type := getAVType(stream_type)
+	switch out_type {
+	case MP4Segment, FMP4VideoSegment, FMP4AudioSegment,
+		SubtitleInitSegment, SubtitleSegment, SubtitleManifest:
 	default:
 		log.Error("AVPipeOpenOutput()", "invalid stream type", stream_type)
 		return C.int64_t(-1)
 	}
 
+	out_filename := C.GoString((*C.char)(unsafe.Pointer(out_url)))
 	filename := C.GoString((*C.char)(unsafe.Pointer(url)))
-	muxOutputOpener := getMuxOutputOpener(filename)
+	muxOutputOpener := getMuxOutputOpener(out_filename)
 	if muxOutputOpener == nil {
 		log.Error("AVPipeOpenMuxOutput() nil muxOutputOpener", "url", filename)
 		return C.int64_t(-1)
@@ -1273,6 +1685,27 @@ type EncodingFrameStats struct {
 	FramesWritten      int64 `json:"segment_frames_written"` // Number of frames encoded in current segment
 }
 
+// SplicePointStats is reported with AV_OUT_STAT_SPLICE_POINT when XcParams.SpliceSegment is set and a
+// segment starts at a SCTE-35 splice point.
+type SplicePointStats struct {
+	PTS      int64 `json:"pts"`       // Splice time of the SCTE-35 cue in the input stream (90kHz)
+	FramePTS int64 `json:"frame_pts"` // PTS of the IDR frame at the splice point in the output time base
+	SegIndex int   `json:"seg_index"` // Index of the segment that starts at the splice point
+}
+
+// EmsgStats is reported with AV_OUT_STAT_EMSG when XcParams.EmitEmsg is set and an emsg box is written
+// in a video segment.
+type EmsgStats struct {
+	SchemeIdUri      string `json:"scheme_id_uri"`     // urn:scte:scte35:2013:bin or https://aomedia.org/emsg/ID3
+	Value            string `json:"value"`             // Empty for SCTE-35 and ID3
+	Timescale        uint32 `json:"timescale"`         // Timescale of the video track
+	PresentationTime uint64 `json:"presentation_time"` // Presentation time in the video track timescale
+	EventDuration    uint32 `json:"event_duration"`    // 0xFFFFFFFF if unknown
+	Id               uint32 `json:"id"`                // Id of the event
+	MessageData      []byte `json:"message_data"`      // splice_info_section or ID3v2 tag
+	SegIndex         int    `json:"seg_index"`         // Index of the segment that contains the emsg box
+}
+
 func (h *ioHandler) OutStat(fd C.int64_t,
 	stream_index C.int,
 	av_type C.avpipe_buftype_t,
@@ -1307,6 +1740,27 @@ func (h *ioHandler) OutStat(fd C.int64_t,
 			FramesWritten:      int64(encodingFramesStats.frames_written),
 		}
 		err = outHandler.Stat(streamIndex, avType, AV_OUT_STAT_FRAME_WRITTEN, statArgs)
+	case C.out_stat_splice_point:
+		splicePoint := (*C.splice_point_stats_t)(stat_args)
+		statArgs := &SplicePointStats{
+			PTS:      int64(splicePoint.pts),
+			FramePTS: int64(splicePoint.frame_pts),
+			SegIndex: int(splicePoint.seg_index),
+		}
+		err = outHandler.Stat(streamIndex, avType, AV_OUT_STAT_SPLICE_POINT, statArgs)
+	case C.out_stat_emsg:
+		event := (*C.emsg_event_t)(stat_args)
+		statArgs := &EmsgStats{
+			SchemeIdUri:      C.GoString(event.scheme_id_uri),
+			Value:            C.GoString(event.value),
+			Timescale:        uint32(event.timescale),
+			PresentationTime: uint64(event.presentation_time),
+			EventDuration:    uint32(event.event_duration),
+			Id:               uint32(event.id),
+			MessageData:      C.GoBytes(unsafe.Pointer(event.message_data), event.message_size),
+			SegIndex:         int(event.seg_index),
+		}
+		err = outHandler.Stat(streamIndex, avType, AV_OUT_STAT_EMSG, statArgs)
 	}
 
 	return err
@@ -1442,6 +1896,35 @@ func getCParams(params *XcParams) (*C.xcparams_t, error) {
 		profile:                   C.CString(params.Profile),
 		level:                     C.int(params.Level),
 		deinterlace:               C.dif_type(params.Deinterlace),
+		rtp_fec:                   C.int(0),
+		rtp_jitter_buffer:         C.int(params.RtpJitterBuffer),
+		scte35_pid:                C.int(params.Scte35PID),
+		splice_segment:            C.int(0),
+		emit_emsg:                 C.int(0),
+		extract_captions:          C.int(0),
+		strip_captions:            C.int(0),
+		blank:                     C.int(0),
+		rebase_pts:                C.int(0),
+		smart_cut:                 C.int(0),
+		measure_loudness:          C.int(0),
+		loudness_target:           C.float(params.LoudnessTarget),
+		loudness_true_peak:        C.float(params.LoudnessTruePeak),
+		detect_silence:            C.int(0),
+		detect_black:              C.int(0),
+		detect_freeze:             C.int(0),
+		qc_min_duration:           C.float(params.QcMinDuration),
+		silence_threshold:         C.float(params.SilenceThreshold),
+		detect_scenes:             C.int(0),
+		scene_threshold:           C.float(params.SceneThreshold),
+		scene_keyframes:           C.int(0),
+		scene_tolerance:           C.float(params.SceneTolerance),
+		crop:                      C.CString(params.Crop),
+		detect_crop:               C.int(0),
+		color_target:              C.color_target_t(params.ColorTarget),
+		fps_mode:                  C.fps_mode_t(params.FpsMode),
+		frame_rate:                C.CString(params.FrameRate),
+		probe_cadence:             C.int(0),
+		rc_mode:                   C.rc_mode_t(params.RcMode),
 
 		// All boolean params are handled below
 	}
@@ -1474,6 +1957,66 @@ func getCParams(params *XcParams) (*C.xcparams_t, error) {
 		cparams.listen = C.int(1)
 	}
 
+	if params.RtpFec {
+		cparams.rtp_fec = C.int(1)
+	}
+
+	if params.SpliceSegment {
+		cparams.splice_segment = C.int(1)
+	}
+
+	if params.EmitEmsg {
+		cparams.emit_emsg = C.int(1)
+	}
+
+	if params.ExtractCaptions {
+		cparams.extract_captions = C.int(1)
+	}
+
+	if params.StripCaptions {
+		cparams.strip_captions = C.int(1)
+	}
+
+	if params.Blank {
+		cparams.blank = C.int(1)
+	}
+
+	if params.RebasePts {
+		cparams.rebase_pts = C.int(1)
+	}
+
+	if params.SmartCut {
+		cparams.smart_cut = C.int(1)
+	}
+
+	if params.MeasureLoudness {
+		cparams.measure_loudness = C.int(1)
+	}
+
+	if params.DetectSilence {
+		cparams.detect_silence = C.int(1)
+	}
+
+	if params.DetectBlack {
+		cparams.detect_black = C.int(1)
+	}
+
+	if params.DetectFreeze {
+		cparams.detect_freeze = C.int(1)
+	}
+
+	if params.DetectScenes {
+		cparams.detect_scenes = C.int(1)
+	}
+
+	if params.SceneKeyframes {
+		cparams.scene_keyframes = C.int(1)
+	}
+
+	if params.ProbeCadence {
+		cparams.probe_cadence = C.int(1)
+	}
+
 	if int32(len(params.AudioIndex)) > MaxAudioMux {
 		return nil, fmt.Errorf("Invalid number of audio streams NumAudio=%d", len(params.AudioIndex))
 	}
@@ -1486,6 +2029,26 @@ func getCParams(params *XcParams) (*C.xcparams_t, error) {
 		cparams.audio_index[i] = C.int(params.AudioIndex[i])
 	}
 
+	if len(params.AudioRenditions) > MaxAudioMux {
+		return nil, fmt.Errorf("Invalid number of audio renditions %d", len(params.AudioRenditions))
+	}
+
+	for i, r := range params.AudioRenditions {
+		cparams.audio_renditions[i] = C.audio_rendition_t{
+			audio_index:    C.int(r.AudioIndex),
+			ecodec:         C.CString(r.Ecodec),
+			channel_layout: C.int(r.ChannelLayout),
+			bitrate:        C.int(r.Bitrate),
+			sample_rate:    C.int(r.SampleRate),
+			name:           C.CString(r.Name),
+			lang:           C.CString(r.Lang),
+		}
+		if r.Passthrough {
+			cparams.audio_renditions[i].passthrough = C.int(1)
+		}
+	}
+	cparams.n_audio_renditions = C.int(len(params.AudioRenditions))
+
 	if extractImagesSize > 0 {
 		C.init_extract_images((*C.xcparams_t)(unsafe.Pointer(cparams)),
 			C.int(extractImagesSize))
@@ -1511,6 +2074,19 @@ func Xc(params *XcParams) error {
 		return EAV_PARAM
 	}
 
+	if params.ChannelMap != nil {
+		p, err := applyChannelMap(params)
+		if err != nil {
+			log.Error("Transcoding failed, invalid channel map", err, "url", params.Url)
+			gMutex.Lock()
+			delete(gURLInputOpeners, params.Url)
+			delete(gURLOutputOpeners, params.Url)
+			gMutex.Unlock()
+			return err
+		}
+		params = p
+	}
+
 	// Convert XcParams to C.txparams_t
 	cparams, err := getCParams(params)
 	if err != nil {
@@ -1566,6 +2142,14 @@ func ChannelLayout(name string) int {
 	return int(channelLayout)
 }
 
+// goColorName converts a color name of FFmpeg (static string) of the probe, it is empty if the color is unknown.
+func goColorName(name *C.char) string {
+	if name == nil {
+		return ""
+	}
+	return C.GoString(name)
+}
+
 func GetPixelFormatName(pixFmt int) string {
 	pName := C.get_pix_fmt_name(C.int(pixFmt))
 	if unsafe.Pointer(pName) != C.NULL {
@@ -1587,14 +2171,29 @@ func GetProfileName(codecId int, profile int) string {
 }
 
 func Probe(params *XcParams) (*ProbeInfo, error) {
-	var cprobe *C.xcprobe_t
-	var n_streams C.int
-
 	if params == nil {
 		log.Error("Failed probing, params are not set.")
 		return nil, EAV_PARAM
 	}
 
+	probeInfo, err := probe(params)
+	if err != nil {
+		return nil, err
+	}
+
+	gMutex.Lock()
+	defer gMutex.Unlock()
+	delete(gURLInputOpeners, params.Url)
+	delete(gURLOutputOpeners, params.Url)
+
+	return probeInfo, nil
+}
+
+// probe probes the input of params, keeping the IO handlers of params.Url.
+func probe(params *XcParams) (*ProbeInfo, error) {
+	var cprobe *C.xcprobe_t
+	var n_streams C.int
+
 	cparams, err := getCParams(params)
 	if err != nil {
 		log.Error("Probing failed", err, "url", params.Url)
@@ -1614,6 +2213,7 @@ func Probe(params *XcParams) (*ProbeInfo, error) {
 		probeInfo.StreamInfo[i].CodecType = AVMediaTypeNames[AVMediaType(probeArray[i].codec_type)]
 		probeInfo.StreamInfo[i].CodecID = int(probeArray[i].codec_id)
 		probeInfo.StreamInfo[i].CodecName = C.GoString((*C.char)(unsafe.Pointer(&probeArray[i].codec_name)))
+		probeInfo.StreamInfo[i].CodecString = C.GoString((*C.char)(unsafe.Pointer(&probeArray[i].codec_string)))
 		probeInfo.StreamInfo[i].DurationTs = int64(probeArray[i].duration_ts)
 		probeInfo.StreamInfo[i].TimeBase = big.NewRat(int64(probeArray[i].time_base.num), int64(probeArray[i].time_base.den))
 		probeInfo.StreamInfo[i].NBFrames = int64(probeArray[i].nb_frames)
@@ -1652,6 +2252,13 @@ func Probe(params *XcParams) (*ProbeInfo, error) {
 			probeInfo.StreamInfo[i].DisplayAspectRatio = big.NewRat(int64(probeArray[i].display_aspect_ratio.num), int64(1))
 		}
 		probeInfo.StreamInfo[i].FieldOrder = AVFieldOrderNames[AVFieldOrder(probeArray[i].field_order)]
+		if AVMediaType(probeArray[i].codec_type) == AVMEDIA_TYPE_VIDEO {
+			probeInfo.StreamInfo[i].ColorPrimaries = goColorName(probeArray[i].color_primaries)
+			probeInfo.StreamInfo[i].ColorTransfer = goColorName(probeArray[i].color_transfer)
+			probeInfo.StreamInfo[i].ColorSpace = goColorName(probeArray[i].color_space)
+			probeInfo.StreamInfo[i].ColorRange = goColorName(probeArray[i].color_range)
+			probeInfo.StreamInfo[i].Cadence = CadenceNames[Cadence(probeArray[i].cadence)]
+		}
 		probeInfo.StreamInfo[i].Profile = int(probeArray[i].profile)
 		probeInfo.StreamInfo[i].Level = int(probeArray[i].level)
 
@@ -1687,12 +2294,193 @@ func Probe(params *XcParams) (*ProbeInfo, error) {
 	C.free(unsafe.Pointer(cprobe.stream_info))
 	C.free(unsafe.Pointer(cprobe))
 
+	return probeInfo, nil
+}
+
+// AnalyzeLoudness measures the EBU R128 loudness of the audio outputs of the transcoding defined by params,
+// without writing any output. The audio is decoded and filtered as by Xc(), the video is skipped.
+func AnalyzeLoudness(params *XcParams) ([]*LoudnessStats, error) {
+	var cloudness *C.loudness_stats_t
+	var nLoudness C.int
+
+	if params == nil {
+		log.Error("Failed analyzing loudness, params are not set.")
+		return nil, EAV_PARAM
+	}
+
+	if params.ChannelMap != nil {
+		p, err := applyChannelMap(params)
+		if err != nil {
+			log.Error("Analyzing loudness failed, invalid channel map", err, "url", params.Url)
+			gMutex.Lock()
+			delete(gURLInputOpeners, params.Url)
+			delete(gURLOutputOpeners, params.Url)
+			gMutex.Unlock()
+			return nil, err
+		}
+		params = p
+	}
+
+	cparams, err := getCParams(params)
+	if err != nil {
+		log.Error("Analyzing loudness failed", err, "url", params.Url)
+		return nil, EAV_PARAM
+	}
+
+	rc := C.analyze_loudness((*C.xcparams_t)(unsafe.Pointer(cparams)), &cloudness, &nLoudness)
+
 	gMutex.Lock()
-	defer gMutex.Unlock()
 	delete(gURLInputOpeners, params.Url)
 	delete(gURLOutputOpeners, params.Url)
+	gMutex.Unlock()
 
-	return probeInfo, nil
+	if int(rc) != 0 {
+		return nil, avpipeError(rc)
+	}
+
+	loudness := make([]*LoudnessStats, int(nLoudness))
+	loudnessArray := (*[1 << 10]C.loudness_stats_t)(unsafe.Pointer(cloudness))
+	for i := 0; i < int(nLoudness); i++ {
+		loudness[i] = newLoudnessStats(&loudnessArray[i])
+	}
+	C.free(unsafe.Pointer(cloudness))
+
+	return loudness, nil
+}
+
+// AnalyzeScenes finds the scene cuts of the video of the transcoding defined by params, without writing any output.
+// The video is decoded and filtered as by Xc(), the audio is skipped.
+func AnalyzeScenes(params *XcParams) ([]*SceneCut, error) {
+	var cscenes *C.scene_cut_t
+	var nScenes C.int
+
+	if params == nil {
+		log.Error("Failed analyzing scenes, params are not set.")
+		return nil, EAV_PARAM
+	}
+
+	cparams, err := getCParams(params)
+	if err != nil {
+		log.Error("Analyzing scenes failed", err, "url", params.Url)
+		return nil, EAV_PARAM
+	}
+
+	rc := C.analyze_scenes((*C.xcparams_t)(unsafe.Pointer(cparams)), &cscenes, &nScenes)
+
+	gMutex.Lock()
+	delete(gURLInputOpeners, params.Url)
+	delete(gURLOutputOpeners, params.Url)
+	gMutex.Unlock()
+
+	if int(rc) != 0 {
+		return nil, avpipeError(rc)
+	}
+
+	scenes := make([]*SceneCut, int(nScenes))
+	if nScenes > 0 {
+		sceneArray := (*[1 << 20]C.scene_cut_t)(unsafe.Pointer(cscenes))
+		for i := 0; i < int(nScenes); i++ {
+			scenes[i] = newSceneCut(&sceneArray[i])
+		}
+	}
+	C.free(unsafe.Pointer(cscenes))
+
+	return scenes, nil
+}
+
+// AnalyzeCrop detects the crop rectangle that removes the black bars (letterbox, pillarbox) of the video of the
+// transcoding defined by params, without writing any output. The rectangle is the whole picture if there are no black
+// bars, and can be set as XcParams.Crop with CropRect.String().
+func AnalyzeCrop(params *XcParams) (*CropRect, error) {
+	var ccrop C.crop_rect_t
+
+	if params == nil {
+		log.Error("Failed analyzing crop, params are not set.")
+		return nil, EAV_PARAM
+	}
+
+	cparams, err := getCParams(params)
+	if err != nil {
+		log.Error("Analyzing crop failed", err, "url", params.Url)
+		return nil, EAV_PARAM
+	}
+
+	rc := C.analyze_crop((*C.xcparams_t)(unsafe.Pointer(cparams)), &ccrop)
+
+	gMutex.Lock()
+	delete(gURLInputOpeners, params.Url)
+	delete(gURLOutputOpeners, params.Url)
+	gMutex.Unlock()
+
+	if int(rc) != 0 {
+		return nil, avpipeError(rc)
+	}
+
+	return &CropRect{
+		Width:  int(ccrop.width),
+		Height: int(ccrop.height),
+		X:      int(ccrop.x),
+		Y:      int(ccrop.y),
+	}, nil
+}
+
+// Compare decodes the reference and the distorted videos of params, scales them to a common resolution, pairs their
+// frames by timestamp and returns the PSNR, SSIM and VMAF (if params.Vmaf is set) of each distorted frame with their
+// aggregate statistics and the worst segments.
+func Compare(params *CompareParams) (*CompareReport, error) {
+	var cparams C.compare_params_t
+	var creport *C.char
+
+	if params == nil {
+		log.Error("Failed comparing, params are not set.")
+		return nil, EAV_PARAM
+	}
+
+	cparams.reference_url = C.CString(params.ReferenceUrl)
+	defer C.free(unsafe.Pointer(cparams.reference_url))
+	cparams.distorted_url = C.CString(params.DistortedUrl)
+	defer C.free(unsafe.Pointer(cparams.distorted_url))
+	cparams.width = C.int(params.Width)
+	cparams.height = C.int(params.Height)
+	cparams.offset = C.double(params.Offset)
+	cparams.seg_duration = C.double(params.SegDuration)
+	cparams.n_worst = C.int(params.NWorst)
+	if params.Vmaf {
+		cparams.vmaf = C.int(1)
+	}
+	if len(params.VmafModel) > 0 {
+		cparams.vmaf_model = C.CString(params.VmafModel)
+		defer C.free(unsafe.Pointer(cparams.vmaf_model))
+	}
+	if params.Seekable {
+		cparams.seekable = C.int(1)
+	}
+	if params.DebugFrameLevel {
+		cparams.debug_frame_level = C.int(1)
+	}
+
+	rc := C.compare(&cparams, &creport)
+
+	gMutex.Lock()
+	delete(gURLInputOpeners, params.ReferenceUrl)
+	delete(gURLOutputOpeners, params.ReferenceUrl)
+	delete(gURLInputOpeners, params.DistortedUrl)
+	delete(gURLOutputOpeners, params.DistortedUrl)
+	gMutex.Unlock()
+
+	if int(rc) != 0 {
+		return nil, avpipeError(rc)
+	}
+
+	report := &CompareReport{}
+	err := json.Unmarshal([]byte(C.GoString(creport)), report)
+	C.free(unsafe.Pointer(creport))
+	if err != nil {
+		log.Error("Comparing failed, invalid report", err, "url", params.DistortedUrl)
+		return nil, err
+	}
+
+	return report, nil
 }
 
 // Returns a handle and error (if there is any error)
@@ -1704,6 +2492,15 @@ func XcInit(params *XcParams) (int32, error) {
 		return -1, EAV_PARAM
 	}
 
+	if params.ChannelMap != nil {
+		p, err := applyChannelMap(params)
+		if err != nil {
+			log.Error("Initializing transcoder failed, invalid channel map", err, "url", params.Url)
+			return -1, err
+		}
+		params = p
+	}
+
 	cparams, err := getCParams(params)
 	if err != nil {
 		log.Error("Initializing transcoder failed", err, "url", params.Url)
@@ -1741,6 +2538,26 @@ func XcCancel(handle int32) error {
 	return EAV_CANCEL_FAILED
 }
 
+// XcInsertCue schedules a SCTE-35 splice_info_section (see ts/scte35 Encode) in the copy MPEGTS
+// output of a running transcoding. The section is written on XcParams.Scte35PID before the first
+// input packet with a PTS >= pts (90kHz), which is usually ahead of the splice time in the section,
+// or before the next packet if pts is math.MinInt64 (AV_NOPTS_VALUE). The section is written as is, the
+// copy MPEGTS output keeps the input timestamps.
+func XcInsertCue(handle int32, pts int64, section []byte) error {
+	if handle < 0 {
+		return EAV_BAD_HANDLE
+	}
+	if len(section) == 0 {
+		return EAV_PARAM
+	}
+	rc := C.xc_insert_cue(C.int32_t(handle), C.int64_t(pts), (*C.uint8_t)(unsafe.Pointer(&section[0])), C.int(len(section)))
+	if rc == 0 {
+		return nil
+	}
+
+	return avpipeError(rc)
+}
+
 // StreamInfoAsArray builds an array where each stream is at its corresponsing index
 // by filling in non-existing index positions with codec type "unknown"
 func StreamInfoAsArray(s []StreamInfo) []StreamInfo {
@@ -7,6 +7,7 @@
  *   - xc_init(): to initialize a transcoding and obtain a handle.
  *   - xc_run(): to start a transcoding with obtained handle.
  *   - xc_cancel(): to cancel/stop a transcoding with specified handle.
+ *   - xc_insert_cue(): to insert a SCTE-35 cue in the copy MPEGTS output of a running transcoding.
  * - APIs with no handle: these APIs are very simple to use and just need transcoding/probing params.
  *   - xc(): starts a transcoding with specified transcoding params.
  *   - mux(): starts a muxing job with specified params.
@@ -54,6 +55,23 @@ int
 xc_cancel(
     int32_t handle);
 
+/**
+ * @brief   Schedules a SCTE-35 cue in the copy MPEGTS output of the transcoding specified by handle.
+ *          The transcoding must have copy_mpegts and scte35_pid set.
+ *
+ * @param   handle      The handle of transcoding context that is obtained by xc_init().
+ * @param   pts         Input PTS (90kHz) at which the cue is inserted, AV_NOPTS_VALUE for the next packet.
+ * @param   section     splice_info_section, starting at the table_id.
+ * @param   size        Size of the section.
+ * @return  If it is successful it returns eav_success, otherwise eav_xc_table or eav_param.
+ */
+int
+xc_insert_cue(
+    int32_t handle,
+    int64_t pts,
+    uint8_t *section,
+    int size);
+
 /**
  * @brief   Starts a transcoding job.
  *
@@ -111,6 +129,61 @@ probe(
     xcprobe_t **xcprobe,
     int *n_streams);
 
+/**
+ * @brief   Measures the loudness (EBU R128) of the audio outputs of a transcoding, without writing any output.
+ *
+ * @param   params      Transcoding parameters.
+ * @param   loudness    Loudness array, one entry per audio output, will be allocated inside this API.
+ * @param   n_loudness  Number of entries in loudness array.
+ * @return  If it is successful it returns eav_success and fills loudness array and n_loudness,
+ *          otherwise returns corresponding error.
+ */
+int
+analyze_loudness(
+    xcparams_t *params,
+    loudness_stats_t **loudness,
+    int *n_loudness);
+
+/**
+ * @brief   Finds the scene cuts of the video of a transcoding, without writing any output.
+ *
+ * @param   params          Transcoding parameters.
+ * @param   scene_cuts      Scene cut array, in presentation order, will be allocated inside this API.
+ * @param   n_scene_cuts    Number of entries in scene_cuts array.
+ * @return  If it is successful it returns eav_success and fills scene_cuts array and n_scene_cuts,
+ *          otherwise returns corresponding error.
+ */
+int
+analyze_scenes(
+    xcparams_t *params,
+    scene_cut_t **scene_cuts,
+    int *n_scene_cuts);
+
+/**
+ * @brief   Detects the crop rectangle that removes the black bars of the video of a transcoding,
+ *          without writing any output.
+ *
+ * @param   params          Transcoding parameters.
+ * @param   crop            Will contain the crop rectangle (w:h:x:y) if successful.
+ * @return  If it is successful it returns eav_success and fills crop, otherwise returns corresponding error.
+ */
+int
+analyze_crop(
+    xcparams_t *params,
+    crop_rect_t *crop);
+
+/**
+ * @brief   Compares a distorted video to its reference with PSNR, SSIM and VMAF, without writing any output.
+ *
+ * @param   params          Comparison parameters, the reference and the distorted are read with the Go input handlers.
+ * @param   report          Will contain the JSON report of the comparison if successful, to be freed by the caller.
+ * @return  If it is successful it returns eav_success and sets report, otherwise returns corresponding error.
+ */
+int
+compare(
+    compare_params_t *params,
+    char **report);
+
 /**
  * @brief   Sets the Go loggers.
  *
@@ -1,7 +1,10 @@
 package avpipe_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/fs"
@@ -18,8 +21,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/mp4"
 	"github.com/eluv-io/avpipe"
 	"github.com/eluv-io/avpipe/elvxc/cmd"
+	"github.com/eluv-io/avpipe/internal/testfixture"
+	"github.com/eluv-io/avpipe/ts"
+	"github.com/eluv-io/avpipe/ts/scte35"
 	"github.com/eluv-io/log-go"
 	"github.com/stretchr/testify/assert"
 )
@@ -46,6 +54,9 @@ type testStatsInfo struct {
 	firstKeyFramePTS        uint64
 	encodingAudioFrameStats avpipe.EncodingFrameStats
 	encodingVideoFrameStats avpipe.EncodingFrameStats
+	splicePoints            []avpipe.SplicePointStats
+	emsgs                   []avpipe.EmsgStats
+	timedMetadata           []avpipe.TimedMetadata
 }
 
 var statsInfo testStatsInfo
@@ -162,6 +173,13 @@ func (i *fileInput) Stat(streamIndex int, statType avpipe.AVStatType, statArgs i
 			log.Debug("AVP TEST IN STAT", "video first keyframe PTS", *keyFramePTS, "streamIndex", streamIndex)
 		}
 		statsInfo.firstKeyFramePTS = *keyFramePTS
+	case avpipe.AV_IN_STAT_TIMED_METADATA:
+		timedMetadata := statArgs.(*avpipe.TimedMetadata)
+		if debugFrameLevel {
+			log.Debug("AVP TEST IN STAT", "timed metadata type", timedMetadata.Type, "pts", timedMetadata.PTS,
+				"streamIndex", streamIndex)
+		}
+		statsInfo.timedMetadata = append(statsInfo.timedMetadata, *timedMetadata)
 	}
 	return nil
 }
@@ -204,6 +222,18 @@ func (oo *fileOutputOpener) Open(_, _ int64, streamIndex, segIndex int,
 		filename = fmt.Sprintf("./%s/asegment%d-%d.mp4", oo.dir, streamIndex, segIndex)
 	case avpipe.FrameImage:
 		filename = fmt.Sprintf("./%s/%d.jpeg", oo.dir, pts)
+	case avpipe.MpegtsSegment:
+		filename = fmt.Sprintf("./%s/ts-segment-%05d.ts", oo.dir, segIndex)
+	case avpipe.CaptionWebVTTSegment:
+		filename = fmt.Sprintf("./%s/captions-%s-%05d.vtt", oo.dir, avpipe.CaptionTrackName(streamIndex), segIndex)
+	case avpipe.CaptionTTMLSegment:
+		filename = fmt.Sprintf("./%s/captions-%s-%05d.ttml", oo.dir, avpipe.CaptionTrackName(streamIndex), segIndex)
+	case avpipe.QCReport:
+		filename = fmt.Sprintf("./%s/qc-report.json", oo.dir)
+	case avpipe.ShotList:
+		filename = fmt.Sprintf("./%s/shot-list.json", oo.dir)
+	case avpipe.AudioRenditionManifest:
+		filename = fmt.Sprintf("./%s/audio-renditions.manifest", oo.dir)
 	}
 
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
@@ -338,6 +368,14 @@ func (o fileOutput) Stat(streamIndex int, avType avpipe.AVType, statType avpipe.
 		} else {
 			statsInfo.encodingVideoFrameStats = *encodingStats
 		}
+	case avpipe.AV_OUT_STAT_SPLICE_POINT:
+		splicePoint := statArgs.(*avpipe.SplicePointStats)
+		doLog("splicePoint", splicePoint)
+		statsInfo.splicePoints = append(statsInfo.splicePoints, *splicePoint)
+	case avpipe.AV_OUT_STAT_EMSG:
+		emsg := statArgs.(*avpipe.EmsgStats)
+		doLog("emsg", emsg)
+		statsInfo.emsgs = append(statsInfo.emsgs, *emsg)
 	}
 
 	return nil
@@ -1443,6 +1481,56 @@ func TestAudio6MonoTo5_1(t *testing.T) {
 	xcTest(t, outputDir, params, xcTestResult, true)
 }
 
+// The channel map makes the merge of TestAudio6MonoTo5_1, without changing the params of the transcoding
+func TestAudioChannelMap(t *testing.T) {
+	url := "./media/case_2_video_and_8_mono_audio.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	channelMap := avpipe.NewChannelMap("5.1")
+	for i := 3; i <= 8; i++ {
+		channelMap.AddChannel(avpipe.ChannelSource{StreamIndex: i, Channel: "c0"})
+	}
+	params := &avpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec2:             "aac",
+		XcType:              avpipe.XcAudio,
+		ChannelMap:          channelMap,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+
+	xcTestResult := &XcTestResult{
+		timeScale:         44100,
+		sampleRate:        44100,
+		channelLayoutName: "5.1",
+	}
+	for i := 1; i <= 2; i++ {
+		xcTestResult.mezFile = append(xcTestResult.mezFile, fmt.Sprintf("%s/asegment0-%d.mp4", outputDir, i))
+	}
+
+	xcTest(t, outputDir, params, xcTestResult, true)
+	assert.Equal(t, avpipe.XcType(avpipe.XcAudio), params.XcType)
+	assert.Empty(t, params.AudioIndex)
+	assert.Equal(t, 0, params.ChannelLayout)
+	assert.Empty(t, params.FilterDescriptor)
+
+	// The same params make the same transcoding again
+	xcTest(t, outputDir, params, xcTestResult, true)
+
+	// A channel map needs an audio transcoding
+	params.XcType = avpipe.XcVideo
+	assert.Error(t, avpipe.Xc(params))
+}
+
 func TestAudio6MonoUnequalChannelLayoutsTo5_1(t *testing.T) {
 	url := "./media/TOS8_Audio_51-2_60s_CCBYblendercloud.mov"
 	if fileMissing(url, fn()) {
@@ -2281,194 +2369,1554 @@ func TestABRMuxing(t *testing.T) {
 		math.Abs(videoMezProbeInfo[0].ContainerInfo.Duration+videoMezProbeInfo2[0].ContainerInfo.Duration-muxOutProbeInfo[0].ContainerInfo.Duration) < 0.05)
 }
 
-func TestMarshalParams(t *testing.T) {
+func TestMuxSubtitles(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	videoMezDir := path.Join(baseOutPath, f, "VideoMez4Muxing")
+	subtitleDir := path.Join(baseOutPath, f, "Subtitles")
+
+	// Create video mez files
+	setupOutDir(t, videoMezDir)
 	params := &avpipe.XcParams{
-		VideoBitrate:       8000000,
-		VideoSegDurationTs: 180000,
+		Format:             "fmp4-segment",
+		DurationTs:         -1,
+		StartSegmentStr:    "1",
+		VideoBitrate:       2560000,
+		VideoSegDurationTs: 720000,
+		Ecodec:             h264Codec,
 		EncHeight:          720,
 		EncWidth:           1280,
 		XcType:             avpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+		ForceKeyInt:        48,
 	}
-	bytes, err := json.Marshal(params)
-	assert.NoError(t, err)
-	_ = bytes
-	// TODO: Add asserts
-}
+	setFastEncodeParams(params, false)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoMezDir})
+	boilerXc(t, params)
 
-func TestUnmarshalParams(t *testing.T) {
-	var params avpipe.XcParams
-	bytes := []byte(`{"video_bitrate":8000000,"seg_duration_ts":180000,"seg_duration_fr":50,"enc_height":720,"enc_width":1280,"xc_type":1}`)
-	err := json.Unmarshal(bytes, &params)
-	assert.NoError(t, err)
-	assert.Equal(t, avpipe.XcVideo, int(params.XcType))
-	// TODO: More checks
+	setupOutDir(t, subtitleDir)
+	vtt := "WEBVTT\n\n00:00:01.000 --> 00:00:04.000\nHello\n\n00:00:08.000 --> 00:00:12.500 line:90%\nWorld\n"
+	ttml := `<?xml version="1.0" encoding="UTF-8"?>
+<tt xmlns="http://www.w3.org/ns/ttml" xml:lang="fr"><body><div>
+<p begin="00:00:02.000" end="00:00:05.000">Bonjour</p>
+<p begin="9s" dur="3s">Monde</p>
+</div></body></tt>
+`
+	err := os.WriteFile(subtitleDir+"/en.vtt", []byte(vtt), 0644)
+	failNowOnError(t, err)
+	err = os.WriteFile(subtitleDir+"/fr.ttml", []byte(ttml), 0644)
+	failNowOnError(t, err)
+
+	muxSpec := "mez-mux\n"
+	muxSpec += "video,1," + videoMezDir + "/vsegment-1.mp4\n"
+	muxSpec += "subtitle lang=en name=English,1," + subtitleDir + "/en.vtt\n"
+	muxSpec += "caption lang=fr,2," + subtitleDir + "/fr.ttml\n"
+
+	for _, format := range []string{"mp4", "fmp4-segment", "dash", "hls"} {
+		muxOutDir := path.Join(baseOutPath, f, "MuxingOutput-"+format)
+		setupOutDir(t, muxOutDir)
+		url = muxOutDir + "/segment-1.mp4"
+		params.MuxingSpec = muxSpec
+		params.Format = format
+		params.Url = url
+		avpipe.InitUrlMuxIOHandler(url, &cmd.AVCmdMuxInputOpener{URL: url}, &cmd.AVCmdMuxOutputOpener{Dir: muxOutDir})
+		err = avpipe.Mux(params)
+		failNowOnError(t, err)
+
+		var files []string
+		switch format {
+		case "dash":
+			files = []string{"subtitles.mpd", "subtitle1-init.mp4", "subtitle1-00001.m4s", "subtitle2-init.mp4", "subtitle2-00001.m4s"}
+
+			b, err := os.ReadFile(path.Join(muxOutDir, "subtitles.mpd"))
+			failNowOnError(t, err)
+			var mpd struct {
+				AdaptationSets []struct {
+					Lang string `xml:"lang,attr"`
+					Role struct {
+						SchemeIdUri string `xml:"schemeIdUri,attr"`
+						Value       string `xml:"value,attr"`
+					}
+					Label          string
+					Representation struct {
+						Codecs string `xml:"codecs,attr"`
+					}
+				} `xml:"Period>AdaptationSet"`
+			}
+			failNowOnError(t, xml.Unmarshal(b, &mpd))
+			if assert.Len(t, mpd.AdaptationSets, 2) {
+				en, fr := mpd.AdaptationSets[0], mpd.AdaptationSets[1]
+				assert.Equal(t, "en", en.Lang)
+				assert.Equal(t, "urn:mpeg:dash:role:2011", en.Role.SchemeIdUri)
+				assert.Equal(t, "subtitle", en.Role.Value)
+				assert.Equal(t, "English", en.Label)
+				assert.Equal(t, "wvtt", en.Representation.Codecs)
+				assert.Equal(t, "fr", fr.Lang)
+				assert.Equal(t, "urn:mpeg:dash:role:2011", fr.Role.SchemeIdUri)
+				assert.Equal(t, "caption", fr.Role.Value)
+				assert.Equal(t, "stpp", fr.Representation.Codecs)
+			}
+			assert.Equal(t, []string{"wvtt"}, textSampleEntries(t, path.Join(muxOutDir, "subtitle1-init.mp4")))
+			assert.Equal(t, []string{"stpp"}, textSampleEntries(t, path.Join(muxOutDir, "subtitle2-init.mp4")))
+		case "hls":
+			files = []string{"subtitles.m3u8", "subtitle1.m3u8", "subtitle1-00001.vtt", "subtitle2.m3u8", "subtitle2-init.mp4", "subtitle2-00001.m4s"}
+
+			b, err := os.ReadFile(path.Join(muxOutDir, "subtitles.m3u8"))
+			failNowOnError(t, err)
+			var media []string
+			for _, line := range strings.Split(string(b), "\n") {
+				if strings.HasPrefix(line, "#EXT-X-MEDIA:") {
+					media = append(media, line)
+				}
+			}
+			assert.Equal(t, []string{
+				`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,URI="subtitle1.m3u8"`,
+				`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="fr",LANGUAGE="fr",DEFAULT=NO,AUTOSELECT=YES,` +
+					`CHARACTERISTICS="public.accessibility.transcribes-spoken-dialog,public.accessibility.describes-music-and-sound",` +
+					`URI="subtitle2.m3u8"`,
+			}, media)
+			assert.Equal(t, []string{"stpp"}, textSampleEntries(t, path.Join(muxOutDir, "subtitle2-init.mp4")))
+		default:
+			// Video and the wvtt and stpp tracks, in the mux spec order
+			assert.Equal(t, []string{"wvtt", "stpp"}, textSampleEntries(t, url), format)
+			b, err := os.ReadFile(url)
+			failNowOnError(t, err)
+			assert.True(t, bytes.Contains(b, []byte("Hello")), format)
+			assert.True(t, bytes.Contains(b, []byte("Bonjour")), format)
+		}
+		for _, name := range files {
+			_, err = os.Stat(path.Join(muxOutDir, name))
+			assert.NoError(t, err, format)
+		}
+	}
 }
 
-func TestUnmarshalParamsNumAudioBackwardsCompat(t *testing.T) {
-	var params avpipe.XcParams
-	bytesWithNAudio := []byte(`{"video_bitrate":8000000,"seg_duration_ts":180000,"seg_duration_fr":50,"enc_height":720,"enc_width":1280,"xc_type":1,"audio_index":[0,0,0,0,0,0,0,0],"n_audio":1}`)
-	err := json.Unmarshal(bytesWithNAudio, &params)
-	assert.NoError(t, err)
-	assert.Equal(t, len(params.AudioIndex), 1)
+// textSampleEntries returns the sample entry types of the text tracks of a MP4 file
+func textSampleEntries(t *testing.T, filename string) []string {
+	m, err := mp4.ReadMP4File(filename)
+	failNowOnError(t, err)
 
-	bytesNoNAudio := []byte(`{"video_bitrate":8000000,"seg_duration_ts":180000,"seg_duration_fr":50,"enc_height":720,"enc_width":1280,"xc_type":1,"audio_index":[0,0,0,0,0,0,0,0]}`)
-	err = json.Unmarshal(bytesNoNAudio, &params)
-	assert.NoError(t, err)
-	assert.Equal(t, len(params.AudioIndex), 8)
+	var types []string
+	for _, trak := range m.Moov.Traks {
+		stsd := trak.Mdia.Minf.Stbl.Stsd
+		if stsd.Wvtt != nil {
+			types = append(types, "wvtt")
+			if assert.NotNil(t, stsd.Wvtt.VttC, filename) {
+				assert.True(t, strings.HasPrefix(stsd.Wvtt.VttC.Config, "WEBVTT"), filename)
+			}
+		} else if stsd.Stpp != nil {
+			types = append(types, "stpp")
+			assert.Equal(t, "http://www.w3.org/ns/ttml", stsd.Stpp.Namespace, filename)
+		}
+	}
+	return types
 }
 
-func TestProbe(t *testing.T) {
-	url := videoBigBuckBunnyPath
+func TestXcEdl(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
 	if fileMissing(url, fn()) {
 		return
 	}
 
-	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
-	xcparams := &avpipe.XcParams{
-		Url:      url,
-		Seekable: true,
-	}
-	probe, err := avpipe.Probe(xcparams)
-	failNowOnError(t, err)
-	assert.Equal(t, 3, len(probe.StreamInfo))
+	outDir := path.Join(baseOutPath, f)
+	setupOutDir(t, outDir)
 
-	assert.Equal(t, 27, probe.StreamInfo[0].CodecID)
-	assert.Equal(t, "h264", probe.StreamInfo[0].CodecName)
-	assert.Equal(t, 100, probe.StreamInfo[0].Profile) // 77 = FF_PROFILE_H264_MAIN
-	assert.Equal(t, 41, probe.StreamInfo[0].Level)
-	assert.Equal(t, int64(1800), probe.StreamInfo[0].NBFrames)
-	assert.Equal(t, int64(1980), probe.StreamInfo[0].StartTime)
-	assert.Equal(t, int64(3081772), probe.StreamInfo[0].BitRate)
-	assert.Equal(t, 1920, probe.StreamInfo[0].Width)
-	assert.Equal(t, 1080, probe.StreamInfo[0].Height)
-	assert.Equal(t, int64(30000), probe.StreamInfo[0].TimeBase.Denom().Int64())
+	edl := &avpipe.Edl{Entries: []avpipe.EdlEntry{
+		{Url: url, In: 10, Out: 14},
+		{Gap: 2},
+		{Url: url, In: 30, Out: 33},
+	}}
 
-	assert.Equal(t, 86017, probe.StreamInfo[1].CodecID)
-	assert.Equal(t, "mp3float", probe.StreamInfo[1].CodecName)
-	assert.Equal(t, -99, probe.StreamInfo[1].Profile) // 1 = FF_PROFILE_AAC_LOW
-	assert.Equal(t, -99, probe.StreamInfo[1].Level)
-	assert.Equal(t, int64(2500), probe.StreamInfo[1].NBFrames)
-	assert.Equal(t, int64(0), probe.StreamInfo[1].StartTime)
-	assert.Equal(t, int64(160000), probe.StreamInfo[1].BitRate)
-	assert.Equal(t, 0, probe.StreamInfo[1].Width)
-	assert.Equal(t, 0, probe.StreamInfo[1].Height)
-	assert.Equal(t, int64(48000), probe.StreamInfo[1].TimeBase.Denom().Int64())
+	params := avpipe.NewXcParams()
+	params.Url = outDir + "/edl.mp4"
+	params.Format = "mp4"
+	params.XcType = avpipe.XcAll
+	params.AudioIndex = []int32{1}
+	params.VideoBitrate = 2560000
+	params.Ecodec = h264Codec
+	params.EncHeight = 720
+	params.EncWidth = 1280
+	params.ForceKeyInt = 48
+	params.DebugFrameLevel = debugFrameLevel
+	setFastEncodeParams(params, false)
 
-	assert.Equal(t, 86019, probe.StreamInfo[2].CodecID)
-	assert.Equal(t, "ac3", probe.StreamInfo[2].CodecName)
-	assert.Equal(t, -99, probe.StreamInfo[2].Profile) // 1 = FF_PROFILE_AAC_LOW
-	assert.Equal(t, -99, probe.StreamInfo[2].Level)
-	assert.Equal(t, int64(1875), probe.StreamInfo[2].NBFrames)
-	assert.Equal(t, int64(0), probe.StreamInfo[2].StartTime)
-	assert.Equal(t, int64(320000), probe.StreamInfo[2].BitRate)
-	assert.Equal(t, 0, probe.StreamInfo[2].Width)
-	assert.Equal(t, 0, probe.StreamInfo[2].Height)
-	assert.Equal(t, int64(48000), probe.StreamInfo[2].TimeBase.Denom().Int64())
-	assert.Equal(t, 6, probe.StreamInfo[2].Channels)
-	assert.Equal(t, "5.1(side)", avpipe.ChannelLayoutName(probe.StreamInfo[2].Channels, probe.StreamInfo[2].ChannelLayout))
+	err := avpipe.XcEdl(params, edl, outDir, &fileInputOpener{url: url}, &cmd.AVCmdMuxOutputOpener{Dir: outDir})
+	failNowOnError(t, err)
 
-	// Test StreamInfoAsArray
-	a := avpipe.StreamInfoAsArray(probe.StreamInfo)
-	assert.Equal(t, "h264", a[0].CodecName)
-	assert.Equal(t, "mp3float", a[1].CodecName)
-	assert.Equal(t, "ac3", a[2].CodecName)
+	avpipe.InitUrlIOHandler(params.Url, &fileInputOpener{url: params.Url}, nil)
+	probe, err := avpipe.Probe(&avpipe.XcParams{Url: params.Url, Seekable: true})
+	failNowOnError(t, err)
+	assert.InDelta(t, edl.Duration(), probe.ContainerInfo.Duration, 0.2)
+
+	// Each part has the frames of its entry and starts where the previous one ends, the audio starts with the
+	// video at each join (within one aac frame)
+	frameRate, _ := probe.StreamInfo[0].AvgFrameRate.Float64()
+	var frames int64
+	for i, en := range edl.Entries {
+		duration := en.Out - en.In + en.Gap
+		dir := path.Join(outDir, fmt.Sprintf("edl-%03d", i+1))
+		video := probeFirstStream(t, dir+"/video.mp4")
+		audio := probeFirstStream(t, dir+"/audio.mp4")
+		assert.Equal(t, int64(math.Round(duration*frameRate)), video.NBFrames, i)
+		videoStart := streamStart(video)
+		assert.InDelta(t, float64(frames)/frameRate, videoStart, 0.001, i)
+		assert.InDelta(t, videoStart, streamStart(audio), 1024/float64(audio.SampleRate), i)
+		frames += video.NBFrames
+	}
+	assert.Equal(t, frames, probe.StreamInfo[0].NBFrames)
 }
 
-func TestProbeWithData(t *testing.T) {
+// The parts of a stream copy keep the B-frames of the source, their first frame (a key frame) starts where the
+// previous part ends
+func TestXcEdlStreamCopy(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
 	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
 	if fileMissing(url, fn()) {
 		return
 	}
 
-	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
-	xcparams := &avpipe.XcParams{
-		Url:      url,
-		Seekable: true,
-	}
-	probe, err := avpipe.Probe(xcparams)
+	sourceDir := path.Join(baseOutPath, f, "source")
+	outDir := path.Join(baseOutPath, f, "edl")
+
+	// The libx264 defaults of the mp4 format have B-frames, the key frames are every 2 sec
+	setupOutDir(t, sourceDir)
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "mp4"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = h264Codec
+	params.VideoBitrate = 1000000
+	params.EncHeight = 360
+	params.EncWidth = 640
+	params.ForceKeyInt = 48
+	params.DebugFrameLevel = debugFrameLevel
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: sourceDir})
+	boilerXc(t, params)
+
+	url = sourceDir + "/segment-1.mp4"
+	sourceFile, err := mp4.ReadMP4File(url)
 	failNowOnError(t, err)
-	assert.Equal(t, 9, len(probe.StreamInfo))
+	assert.NotNil(t, sourceFile.Moov.Trak.Mdia.Minf.Stbl.Ctts)
+
+	edl := &avpipe.Edl{StreamCopy: true, Entries: []avpipe.EdlEntry{
+		{Url: url, In: 2, Out: 6},
+		{Url: url, In: 10, Out: 12},
+		{Url: url, In: 20, Out: 24},
+	}}
+	params = avpipe.NewXcParams()
+	params.Url = outDir + "/edl.mp4"
+	params.Format = "mp4"
+	params.XcType = avpipe.XcVideo
+	params.DebugFrameLevel = debugFrameLevel
 
-	assert.Equal(t, 147, probe.StreamInfo[0].CodecID)
-	assert.Equal(t, "prores", probe.StreamInfo[0].CodecName)
-	assert.Equal(t, 3, probe.StreamInfo[0].Profile) // 3 = FF_PROFILE_MPEG4_MAIN
-	assert.Equal(t, -99, probe.StreamInfo[0].Level)
-	assert.Equal(t, int64(1439), probe.StreamInfo[0].NBFrames)
-	assert.Equal(t, int64(0), probe.StreamInfo[0].StartTime)
-	assert.Equal(t, int64(249054569), probe.StreamInfo[0].BitRate)
-	assert.Equal(t, 1920, probe.StreamInfo[0].Width)
-	assert.Equal(t, 1080, probe.StreamInfo[0].Height)
-	assert.Equal(t, int64(24000), probe.StreamInfo[0].TimeBase.Denom().Int64())
+	setupOutDir(t, outDir)
+	err = avpipe.XcEdl(params, edl, outDir, &fileInputOpener{url: url}, &cmd.AVCmdMuxOutputOpener{Dir: outDir})
+	failNowOnError(t, err)
 
-	assert.Equal(t, 65548, probe.StreamInfo[1].CodecID)
-	assert.Equal(t, "pcm_s24le", probe.StreamInfo[1].CodecName)
-	assert.Equal(t, -99, probe.StreamInfo[1].Profile)
-	assert.Equal(t, -99, probe.StreamInfo[1].Level)
-	assert.Equal(t, int64(2880480), probe.StreamInfo[1].NBFrames)
-	assert.Equal(t, int64(0), probe.StreamInfo[1].StartTime)
-	assert.Equal(t, int64(1152000), probe.StreamInfo[1].BitRate)
-	assert.Equal(t, 0, probe.StreamInfo[1].Width)
-	assert.Equal(t, 0, probe.StreamInfo[1].Height)
-	assert.Equal(t, int64(48000), probe.StreamInfo[1].TimeBase.Denom().Int64())
+	frameRate, _ := probeFirstStream(t, url).AvgFrameRate.Float64()
+	var frames int64
+	for i, en := range edl.Entries {
+		video := probeFirstStream(t, path.Join(outDir, fmt.Sprintf("edl-%03d", i+1), "video.mp4"))
+		assert.Equal(t, int64(math.Round((en.Out-en.In)*frameRate)), video.NBFrames, i)
+		assert.InDelta(t, float64(frames)/frameRate, streamStart(video), 0.001, i)
+		frames += video.NBFrames
+	}
 
-	assert.Equal(t, 65548, probe.StreamInfo[2].CodecID)
-	assert.Equal(t, "pcm_s24le", probe.StreamInfo[2].CodecName)
-	assert.Equal(t, -99, probe.StreamInfo[2].Profile)
-	assert.Equal(t, -99, probe.StreamInfo[2].Level)
-	assert.Equal(t, int64(2880480), probe.StreamInfo[2].NBFrames)
-	assert.Equal(t, int64(0), probe.StreamInfo[2].StartTime)
-	assert.Equal(t, int64(1152000), probe.StreamInfo[2].BitRate)
-	assert.Equal(t, 0, probe.StreamInfo[2].Width)
-	assert.Equal(t, 0, probe.StreamInfo[2].Height)
-	assert.Equal(t, int64(48000), probe.StreamInfo[2].TimeBase.Denom().Int64())
+	out := probeFirstStream(t, params.Url)
+	assert.Equal(t, frames, out.NBFrames)
+	assert.Equal(t, 0.0, streamStart(out))
+	outFile, err := mp4.ReadMP4File(params.Url)
+	failNowOnError(t, err)
+	assert.NotNil(t, outFile.Moov.Trak.Mdia.Minf.Stbl.Ctts)
 
-	assert.Equal(t, 0, probe.StreamInfo[8].CodecID)
-	assert.Equal(t, "", probe.StreamInfo[8].CodecName)
-	assert.Equal(t, -99, probe.StreamInfo[8].Profile)
-	assert.Equal(t, -99, probe.StreamInfo[8].Level)
-	assert.Equal(t, int64(1), probe.StreamInfo[8].NBFrames)
-	assert.Equal(t, int64(0), probe.StreamInfo[8].StartTime)
-	assert.Equal(t, int64(0), probe.StreamInfo[8].BitRate)
-	assert.Equal(t, 0, probe.StreamInfo[8].Width)
-	assert.Equal(t, 0, probe.StreamInfo[8].Height)
-	assert.Equal(t, int64(24000), probe.StreamInfo[8].TimeBase.Denom().Int64())
+	// The in and out points must be on key frames
+	for _, en := range []avpipe.EdlEntry{{Url: url, In: 3, Out: 6}, {Url: url, In: 2, Out: 5}} {
+		setupOutDir(t, outDir)
+		edl.Entries = []avpipe.EdlEntry{en}
+		assert.Error(t, avpipe.XcEdl(params, edl, outDir, &fileInputOpener{url: url}, &cmd.AVCmdMuxOutputOpener{Dir: outDir}))
+	}
+}
 
-	// Test StreamInfoAsArray
-	a := avpipe.StreamInfoAsArray(probe.StreamInfo)
-	assert.Equal(t, "prores", a[0].CodecName)
-	assert.Equal(t, "pcm_s24le", a[1].CodecName)
-	assert.Equal(t, "pcm_s24le", a[2].CodecName)
+// probeFirstStream returns the first stream of url
+func probeFirstStream(t *testing.T, url string) *avpipe.StreamInfo {
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, nil)
+	probe, err := avpipe.Probe(&avpipe.XcParams{Url: url, Seekable: true})
+	failNowOnError(t, err)
+	return &probe.StreamInfo[0]
 }
 
-func TestExtractImagesInterval(t *testing.T) {
-	url := videoBigBuckBunnyPath
+// streamStart returns the start time of the stream in seconds
+func streamStart(si *avpipe.StreamInfo) float64 {
+	start, _ := new(big.Rat).Mul(big.NewRat(si.StartTime, 1), si.TimeBase).Float64()
+	return start
+}
+
+func TestSmartCut(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
 	if fileMissing(url, fn()) {
 		return
 	}
 
-	outPath := path.Join(baseOutPath, fn())
+	videoMezDir := path.Join(baseOutPath, f, "VideoMez")
+	cutDir := path.Join(baseOutPath, f, "Cut")
+
+	// Create a video mez with a key frame every 2 sec
+	setupOutDir(t, videoMezDir)
 	params := &avpipe.XcParams{
-		Format:                 "image2",
-		AudioBitrate:           128000,
-		AudioSegDurationTs:     -1,
-		BitDepth:               8,
-		CrfStr:                 "23",
-		DurationTs:             -1,
-		Ecodec:                 "mjpeg",
-		Ecodec2:                "aac",
-		EncHeight:              -1,
-		EncWidth:               -1,
-		ExtractImageIntervalTs: -1,
-		GPUIndex:               -1,
-		SampleRate:             -1,
-		SegDuration:            "30",
-		StartFragmentIndex:     1,
-		StartSegmentStr:        "1",
-		StreamId:               -1,
-		SyncAudioToStreamId:    -1,
-		VideoBitrate:           -1,
-		VideoSegDurationTs:     -1,
-		XcType:                 avpipe.XcExtractImages,
+		Format:             "fmp4-segment",
+		DurationTs:         -1,
+		StartSegmentStr:    "1",
+		VideoBitrate:       2560000,
+		VideoSegDurationTs: 720000,
+		Ecodec:             "libx264",
+		EncHeight:          720,
+		EncWidth:           1280,
+		XcType:             avpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+		ForceKeyInt:        48,
+	}
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoMezDir})
+	boilerXc(t, params)
+
+	// Cut 10 sec starting in the middle of a GOP, only the first and the last GOPs are re-encoded
+	setupOutDir(t, cutDir)
+	url = videoMezDir + "/vsegment-1.mp4"
+	params = avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "mp4"
+	params.XcType = avpipe.XcVideo
+	params.Seekable = true
+	params.StartTimeTs = 132000 // 5.5 sec
+	params.DurationTs = 240000  // 10 sec
+	params.SmartCut = true
+	params.DebugFrameLevel = debugFrameLevel
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: cutDir})
+	boilerXc(t, params)
+
+	cutUrl := cutDir + "/segment-1.mp4"
+	avpipe.InitUrlIOHandler(cutUrl, &fileInputOpener{url: cutUrl}, nil)
+	probe, err := avpipe.Probe(&avpipe.XcParams{Url: cutUrl, Seekable: true})
+	failNowOnError(t, err)
+	assert.InDelta(t, 10.0, probe.ContainerInfo.Duration, 0.1)
+	assert.Equal(t, int64(240), probe.StreamInfo[0].NBFrames)
+
+	// The copied GOPs use the input SPS, that is only in-band: the sample entry must be avc3 and every key frame
+	// must have its SPS/PPS
+	cut, err := mp4.ReadMP4File(cutUrl)
+	failNowOnError(t, err)
+	cutData, err := os.ReadFile(cutUrl)
+	failNowOnError(t, err)
+	trak := cut.Moov.Trak
+	avcX := trak.Mdia.Minf.Stbl.Stsd.AvcX
+	if !assert.NotNil(t, avcX) {
+		return
+	}
+	assert.Equal(t, "avc3", avcX.Type())
+	avcCSps := map[string]bool{}
+	for _, sps := range avcX.AvcC.SPSnalus {
+		avcCSps[string(sps)] = true
+	}
+	inBandSps := map[string]bool{}
+	for nr := uint32(1); nr <= trak.GetNrSamples(); nr++ {
+		if !trak.Mdia.Minf.Stbl.Stss.IsSyncSample(nr) {
+			continue
+		}
+		ranges, err := trak.GetRangesForSampleInterval(nr, nr)
+		failNowOnError(t, err)
+		sample := cutData[ranges[0].Offset : ranges[0].Offset+ranges[0].Size]
+		spss, ppss := avc.GetParameterSets(sample)
+		assert.NotEmpty(t, spss, "sample %d", nr)
+		assert.NotEmpty(t, ppss, "sample %d", nr)
+		for _, sps := range spss {
+			parsed, err := avc.ParseSPSNALUnit(sps, false)
+			failNowOnError(t, err)
+			assert.Equal(t, uint(1280), parsed.Width)
+			assert.Equal(t, uint(720), parsed.Height)
+			inBandSps[string(sps)] = true
+		}
+	}
+	newSps := 0
+	for sps := range inBandSps {
+		if !avcCSps[sps] {
+			newSps++
+		}
+	}
+	assert.Greater(t, newSps, 0, "the copied GOPs must have an SPS that is not in the avcC")
+
+	// Every frame of the cut must decode, both the copied and the re-encoded GOPs, compare it to the same
+	// cut fully re-encoded
+	fullCutDir := path.Join(baseOutPath, f, "FullCut")
+	setupOutDir(t, fullCutDir)
+	params.SmartCut = false
+	params.VideoBitrate = 2560000
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: fullCutDir})
+	boilerXc(t, params)
+
+	fullCutUrl := fullCutDir + "/segment-1.mp4"
+	avpipe.InitUrlIOHandler(fullCutUrl, &fileInputOpener{url: fullCutUrl}, nil)
+	avpipe.InitUrlIOHandler(cutUrl, &fileInputOpener{url: cutUrl}, nil)
+	report, err := avpipe.Compare(&avpipe.CompareParams{
+		ReferenceUrl: fullCutUrl,
+		DistortedUrl: cutUrl,
+		Seekable:     true,
+	})
+	failNowOnError(t, err)
+	assert.Equal(t, 240, report.NFrames)
+	assert.Greater(t, report.Psnr.Min, 30.0)
+	assert.Greater(t, report.Ssim.Min, 0.9)
+}
+
+func TestLoudnessNormalization(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+	setupOutDir(t, outputDir)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "mp4"
+	params.XcType = avpipe.XcAudio
+	params.AudioIndex = []int32{1}
+	params.Ecodec2 = "aac"
+	params.AudioBitrate = 128000
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+
+	// Measure the source, then normalize it to -23 LUFS
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, nil)
+	loudness, err := avpipe.AnalyzeLoudness(params)
+	failNowOnError(t, err)
+	assert.Equal(t, 1, len(loudness))
+	log.Info("source loudness", "integrated", loudness[0].Integrated, "range", loudness[0].Range, "true_peak", loudness[0].TruePeak)
+
+	params.LoudnessTarget = -23
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	outUrl := outputDir + "/segment-1.mp4"
+	params = avpipe.NewXcParams()
+	params.Url = outUrl
+	params.Format = "mp4"
+	params.XcType = avpipe.XcAudio
+	params.Ecodec2 = "aac"
+	params.Seekable = true
+	avpipe.InitUrlIOHandler(outUrl, &fileInputOpener{url: outUrl}, nil)
+	loudness, err = avpipe.AnalyzeLoudness(params)
+	failNowOnError(t, err)
+	assert.Equal(t, 1, len(loudness))
+	assert.InDelta(t, -23.0, loudness[0].Integrated, 1.0)
+	assert.LessOrEqual(t, loudness[0].TruePeak, 0.0)
+}
+
+func TestQcReport(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	// The blank frames are black, frozen and silent from start to end
+	for xcName, xcType := range map[string]avpipe.XcType{"video": avpipe.XcVideo, "audio": avpipe.XcAudio} {
+		outputDir := path.Join(baseOutPath, f, xcName)
+		setupOutDir(t, outputDir)
+
+		params := avpipe.NewXcParams()
+		params.Url = url
+		params.Format = "mp4"
+		params.XcType = xcType
+		params.Ecodec = h264Codec
+		params.Ecodec2 = "aac"
+		params.AudioIndex = []int32{1}
+		params.Blank = true
+		params.DetectSilence = xcType == avpipe.XcAudio
+		params.DetectBlack = xcType == avpipe.XcVideo
+		params.DetectFreeze = xcType == avpipe.XcVideo
+		params.DebugFrameLevel = debugFrameLevel
+		setFastEncodeParams(params, true)
+		avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+		boilerXc(t, params)
+
+		buf, err := ioutil.ReadFile(outputDir + "/qc-report.json")
+		failNowOnError(t, err)
+		report := &avpipe.QcReport{}
+		failNowOnError(t, json.Unmarshal(buf, report))
+
+		types := []string{"silence"}
+		if xcType == avpipe.XcVideo {
+			types = []string{"black", "freeze"}
+		}
+		assert.Equal(t, len(types), len(report.Intervals))
+		for _, typ := range types {
+			intervals := report.Filter(typ)
+			if assert.Equal(t, 1, len(intervals), typ) {
+				assert.InDelta(t, 0.0, intervals[0].Start, 0.1, typ)
+				assert.Greater(t, intervals[0].End, intervals[0].Start+2.0, typ)
+			}
+		}
+	}
+}
+
+func TestSceneDetection(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+	setupOutDir(t, outputDir)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = h264Codec
+	params.SegDuration = "30"
+	params.ForceKeyInt = 48
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+	setFastEncodeParams(params, true)
+
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, nil)
+	sceneCuts, err := avpipe.AnalyzeScenes(params)
+	failNowOnError(t, err)
+	assert.Greater(t, len(sceneCuts), 0)
+	for i, sceneCut := range sceneCuts {
+		assert.GreaterOrEqual(t, sceneCut.Score, 0.4)
+		if i > 0 {
+			assert.Greater(t, sceneCut.PTS, sceneCuts[i-1].PTS)
+		}
+	}
+
+	// The shot list of the transcoding has the scene cuts of the first pass
+	params.DetectScenes = true
+	params.SceneKeyframes = true
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	buf, err := ioutil.ReadFile(outputDir + "/shot-list.json")
+	failNowOnError(t, err)
+	shotList := &avpipe.Shots{}
+	failNowOnError(t, json.Unmarshal(buf, shotList))
+	if assert.Equal(t, len(sceneCuts), len(shotList.SceneCuts)) {
+		for i, sceneCut := range shotList.SceneCuts {
+			assert.Equal(t, sceneCuts[i].PTS, sceneCut.PTS)
+		}
+	}
+
+	// Every scene cut is a key frame, and a segment boundary moves to the first scene cut within 1 sec (the
+	// default SceneTolerance) after it, otherwise the segment starts at the first key frame after the boundary
+	keyFrames, segmentStarts := videoSegmentKeyFrames(t, outputDir)
+	var cutTimes []float64
+	for _, sceneCut := range sceneCuts {
+		cutTimes = append(cutTimes, sceneCut.Time)
+		assert.InDelta(t, sceneCut.Time, firstAtOrAfter(keyFrames, sceneCut.Time-0.01), 0.01, sceneCut)
+	}
+	assert.Greater(t, len(segmentStarts), 1)
+	for k := 1; k < len(segmentStarts); k++ {
+		boundary := float64(k) * 30
+		expected := firstAtOrAfter(keyFrames, boundary-0.01)
+		if cut := firstAtOrAfter(cutTimes, boundary-0.01); cut-boundary <= 1 {
+			expected = cut
+		}
+		assert.InDelta(t, expected, segmentStarts[k], 0.01, k)
+	}
+}
+
+// videoSegmentKeyFrames returns the times (sec) of the key frames and the start times of the fmp4-segment video
+// segments in dir, the segments restart their timestamps
+func videoSegmentKeyFrames(t *testing.T, dir string) (keyFrames, segmentStarts []float64) {
+	start := 0.0
+	for i := 1; ; i++ {
+		filename := fmt.Sprintf("%s/vsegment-%d.mp4", dir, i)
+		if _, err := os.Stat(filename); err != nil {
+			return
+		}
+		f, err := mp4.ReadMP4File(filename)
+		failNowOnError(t, err)
+		timescale := float64(f.Moov.Trak.Mdia.Mdhd.Timescale)
+		segmentStarts = append(segmentStarts, start)
+		first := int64(-1)
+		duration := 0.0
+		for _, segment := range f.Segments {
+			for _, frag := range segment.Fragments {
+				samples, err := frag.GetFullSamples(f.Moov.Mvex.Trex)
+				failNowOnError(t, err)
+				for _, sample := range samples {
+					if first < 0 {
+						first = int64(sample.PresentationTime())
+					}
+					if sample.IsSync() {
+						keyFrames = append(keyFrames, start+float64(int64(sample.PresentationTime())-first)/timescale)
+					}
+					duration += float64(sample.Dur) / timescale
+				}
+			}
+		}
+		start += duration
+	}
+}
+
+// firstAtOrAfter returns the first of the increasing times that is at or after at, or +Inf if there is none
+func firstAtOrAfter(times []float64, at float64) float64 {
+	for _, tm := range times {
+		if tm >= at {
+			return tm
+		}
+	}
+	return math.Inf(1)
+}
+
+func TestCrop(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+	setupOutDir(t, outputDir)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = h264Codec
+	params.SegDuration = "30"
+	params.ForceKeyInt = 48
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+	setFastEncodeParams(params, true)
+
+	// The detected rectangle is inside the 1920x1080 picture
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, nil)
+	crop, err := avpipe.AnalyzeCrop(params)
+	failNowOnError(t, err)
+	assert.Greater(t, crop.Width, 0)
+	assert.Greater(t, crop.Height, 0)
+	assert.LessOrEqual(t, crop.X+crop.Width, 1920)
+	assert.LessOrEqual(t, crop.Y+crop.Height, 1080)
+
+	// The output has the size of the crop, or its aspect ratio if only the height is set
+	for _, encHeight := range []int32{-1, 270} {
+		params.Crop = "960:540:480:270"
+		params.EncHeight = encHeight
+		setupOutDir(t, outputDir)
+		avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+		boilerXc(t, params)
+
+		probeInfo := boilerProbe(t, &XcTestResult{mezFile: []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)}})
+		if encHeight == -1 {
+			assert.Equal(t, 960, probeInfo[0].StreamInfo[0].Width)
+			assert.Equal(t, 540, probeInfo[0].StreamInfo[0].Height)
+		} else {
+			assert.Equal(t, 480, probeInfo[0].StreamInfo[0].Width)
+			assert.Equal(t, 270, probeInfo[0].StreamInfo[0].Height)
+		}
+	}
+}
+
+// The crop "auto" of a letterboxed input removes its black bars: the output has the size of the picture between them
+func TestCropAuto(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	url := writeFixture(t, outputDir+".h264", testfixture.LetterboxH264())
+	params := &avpipe.XcParams{
+		Format:              "fmp4-segment",
+		StartTimeTs:         0,
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              avpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Crop:                "auto",
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, nil)
+	crop, err := avpipe.AnalyzeCrop(params)
+	failNowOnError(t, err)
+	height := testfixture.LetterboxHeight - 2*testfixture.LetterboxBar
+	assert.Equal(t, fmt.Sprintf("%d:%d:0:%d", testfixture.LetterboxWidth, height, testfixture.LetterboxBar), crop.String())
+
+	xcTest(t, outputDir, params, nil, true)
+	probeInfo := boilerProbe(t, &XcTestResult{mezFile: []string{path.Join(outputDir, "vsegment-1.mp4")}})
+	assert.Equal(t, testfixture.LetterboxWidth, probeInfo[0].StreamInfo[0].Width)
+	assert.Equal(t, height, probeInfo[0].StreamInfo[0].Height)
+}
+
+// Makes an HDR10 mez from an SDR input, then an SDR rendition of the HDR10 mez
+func TestColorTarget(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	hdrDir := path.Join(baseOutPath, f, "hdr")
+	sdrDir := path.Join(baseOutPath, f, "sdr")
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = "libx265"
+	params.BitDepth = 10
+	params.ColorTarget = avpipe.ColorTargetPQ
+	params.EncHeight = 360
+	params.EncWidth = 640
+	params.SegDuration = "30"
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+	setFastEncodeParams(params, true)
+
+	setupOutDir(t, hdrDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: hdrDir})
+	boilerXc(t, params)
+
+	probeInfo := boilerProbe(t, &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", hdrDir)},
+		pixelFmt: "yuv420p10le",
+	})
+	si := probeInfo[0].StreamInfo[0]
+	assert.Equal(t, "bt2020", si.ColorPrimaries)
+	assert.Equal(t, "smpte2084", si.ColorTransfer)
+	assert.Equal(t, "bt2020nc", si.ColorSpace)
+
+	// The HDR10 mez is tone mapped to SDR
+	url = fmt.Sprintf("%s/vsegment-1.mp4", hdrDir)
+	params.Url = url
+	params.Ecodec = h264Codec
+	params.BitDepth = 8
+	params.ColorTarget = avpipe.ColorTargetSDR
+
+	setupOutDir(t, sdrDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: sdrDir})
+	boilerXc(t, params)
+
+	probeInfo = boilerProbe(t, &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", sdrDir)},
+		pixelFmt: "yuv420p",
+	})
+	si = probeInfo[0].StreamInfo[0]
+	assert.Equal(t, "bt709", si.ColorPrimaries)
+	assert.Equal(t, "bt709", si.ColorTransfer)
+	assert.Equal(t, "bt709", si.ColorSpace)
+}
+
+func TestFrameRateConversion(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Seekable = true
+	params.ProbeCadence = true
+
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	probeInfo, err := avpipe.Probe(params)
+	failNowOnError(t, err)
+	assert.Equal(t, "progressive", probeInfo.StreamInfo[0].Cadence)
+
+	params = avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = h264Codec
+	params.FpsMode = avpipe.FpsModeDropDup
+	params.FrameRate = "25"
+	params.EncHeight = 360
+	params.EncWidth = 640
+	params.SegDuration = "30"
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+	setFastEncodeParams(params, false)
+
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	probeInfo2 := boilerProbe(t, &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	})
+	assert.Equal(t, big.NewRat(25, 1), probeInfo2[0].StreamInfo[0].AvgFrameRate)
+	assert.Equal(t, int64(750), probeInfo2[0].StreamInfo[0].NBFrames)
+	dropDupSegment, err := ioutil.ReadFile(fmt.Sprintf("%s/vsegment-1.mp4", outputDir))
+	failNowOnError(t, err)
+
+	// The blended frames have the same rate and number as the dropped/duplicated ones, but not their pixels
+	params.FpsMode = avpipe.FpsModeBlend
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	probeInfo2 = boilerProbe(t, &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	})
+	assert.Equal(t, big.NewRat(25, 1), probeInfo2[0].StreamInfo[0].AvgFrameRate)
+	assert.Equal(t, int64(750), probeInfo2[0].StreamInfo[0].NBFrames)
+	blendSegment, err := ioutil.ReadFile(fmt.Sprintf("%s/vsegment-1.mp4", outputDir))
+	failNowOnError(t, err)
+	assert.NotEqual(t, dropDupSegment, blendSegment)
+
+	// A 23.976 progressive video is telecined to 29.97, and the inverse telecine makes it progressive 23.976
+	// again. The size is kept and the quality is high so that the encoding keeps the combed frames.
+	filmDir := path.Join(baseOutPath, f, "film")
+	telecineDir := path.Join(baseOutPath, f, "telecine")
+	ivtcDir := path.Join(baseOutPath, f, "ivtc")
+
+	params.FpsMode = avpipe.FpsModeDropDup
+	params.FrameRate = "24000/1001"
+	params.EncHeight = 480
+	params.EncWidth = 720
+	params.CrfStr = "18"
+	params.Preset = "ultrafast"
+	setupOutDir(t, filmDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: filmDir})
+	boilerXc(t, params)
+
+	for _, tc := range []struct {
+		fpsMode   avpipe.FpsMode
+		inDir     string
+		outDir    string
+		frameRate float64
+		cadence   string
+	}{
+		{avpipe.FpsModeTelecine, filmDir, telecineDir, 30000.0 / 1001, "telecine"},
+		{avpipe.FpsModeIVTC, telecineDir, ivtcDir, 24000.0 / 1001, "progressive"},
+	} {
+		inUrl := tc.inDir + "/vsegment-1.mp4"
+		params.Url = inUrl
+		params.FpsMode = tc.fpsMode
+		params.FrameRate = ""
+		params.EncHeight = -1
+		params.EncWidth = -1
+		params.Seekable = true
+		setupOutDir(t, tc.outDir)
+		avpipe.InitUrlIOHandler(inUrl, &fileInputOpener{url: inUrl}, &fileOutputOpener{dir: tc.outDir})
+		boilerXc(t, params)
+
+		outUrl := tc.outDir + "/vsegment-1.mp4"
+		avpipe.InitUrlIOHandler(outUrl, &fileInputOpener{url: outUrl}, nil)
+		probe, err := avpipe.Probe(&avpipe.XcParams{Url: outUrl, Seekable: true, ProbeCadence: true})
+		failNowOnError(t, err)
+		si := probe.StreamInfo[0]
+		frameRate, _ := si.AvgFrameRate.Float64()
+		assert.InDelta(t, tc.frameRate, frameRate, 0.01, tc.fpsMode)
+		assert.Equal(t, tc.cadence, si.Cadence, tc.fpsMode)
+		assert.Equal(t, 720, si.Width, tc.fpsMode)
+		assert.Equal(t, 480, si.Height, tc.fpsMode)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = h264Codec
+	params.EncHeight = 360
+	params.EncWidth = 640
+	params.SegDuration = "30"
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+	setFastEncodeParams(params, false)
+
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	// The rendition is compared to the first 30s of the mez, at the rendition resolution
+	distorted := fmt.Sprintf("%s/vsegment-1.mp4", outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	avpipe.InitUrlIOHandler(distorted, &fileInputOpener{url: distorted}, &fileOutputOpener{dir: outputDir})
+	report, err := avpipe.Compare(&avpipe.CompareParams{
+		ReferenceUrl: url,
+		DistortedUrl: distorted,
+		Width:        640,
+		Height:       360,
+		NWorst:       3,
+		Seekable:     true,
+	})
+	failNowOnError(t, err)
+	assert.Equal(t, "ssim", report.Metric)
+	assert.InDelta(t, 900, report.NFrames, 2)
+	assert.Equal(t, report.NFrames, len(report.Frames))
+	assert.Greater(t, report.Psnr.Mean, 30.0)
+	assert.Greater(t, report.Ssim.Mean, 0.9)
+	assert.LessOrEqual(t, report.Ssim.Min, report.Ssim.P1)
+	assert.Nil(t, report.Vmaf)
+	if assert.Equal(t, 3, len(report.WorstSegments)) {
+		assert.LessOrEqual(t, report.WorstSegments[0].Ssim, report.WorstSegments[1].Ssim)
+		assert.LessOrEqual(t, report.WorstSegments[1].Ssim, report.WorstSegments[2].Ssim)
+	}
+
+	// A video compared to itself is identical
+	avpipe.InitUrlIOHandler(distorted, &fileInputOpener{url: distorted}, &fileOutputOpener{dir: outputDir})
+	report, err = avpipe.Compare(&avpipe.CompareParams{
+		ReferenceUrl: distorted,
+		DistortedUrl: distorted,
+		Seekable:     true,
+	})
+	failNowOnError(t, err)
+	assert.Equal(t, 640, report.Width)
+	assert.Equal(t, 360, report.Height)
+	assert.Equal(t, 100.0, report.Psnr.Min)
+	assert.InDelta(t, 1.0, report.Ssim.Min, 0.0001)
+}
+
+func TestAnalyzeLadder(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+	setupOutDir(t, outputDir)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Ecodec = h264Codec
+	params.Preset = "ultrafast"
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+
+	report, err := avpipe.AnalyzeLadder(params, &avpipe.LadderParams{
+		Samples:        2,
+		SampleDuration: 2,
+		Crfs:           []int{33, 23},
+		Heights:        []int{360, 720, 2160},
+	}, outputDir, &fileInputOpener{url: url})
+	failNowOnError(t, err)
+
+	assert.Contains(t, []string{"vmaf", "psnr"}, report.Metric)
+	assert.GreaterOrEqual(t, report.Crf, 23)
+	assert.LessOrEqual(t, report.Crf, 33)
+	if assert.Equal(t, 4, len(report.Points)) {
+		// 2160 is above the source, the points are sorted by height and CRF
+		assert.Equal(t, 720, report.Points[0].Height)
+		assert.Equal(t, 1280, report.Points[0].Width)
+		assert.Equal(t, 23, report.Points[0].Crf)
+		assert.Greater(t, report.Points[0].Bitrate, report.Points[1].Bitrate)
+		assert.Greater(t, report.Points[0].Quality, report.Points[1].Quality)
+		assert.Equal(t, 360, report.Points[2].Height)
+	}
+	if assert.NotEmpty(t, report.Rungs) {
+		assert.Equal(t, 720, report.Rungs[0].Height)
+	}
+
+	assert.NoError(t, report.Apply(params, 0))
+	assert.Equal(t, int32(720), params.EncHeight)
+	assert.Equal(t, fmt.Sprintf("%d", report.Crf), params.CrfStr)
+}
+
+func TestRcModes(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = h264Codec
+	params.RcMode = avpipe.RcModeTwoPass
+	params.VideoBitrate = 500000
+	params.RcMaxRate = 1000000
+	params.EncHeight = 360
+	params.EncWidth = 640
+	params.SegDuration = "30"
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+	setFastEncodeParams(params, false)
+
+	// The stats of the first pass are written in TMPDIR, and removed at the end
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	probeInfo := boilerProbe(t, &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	})
+	// The two-pass VBR hits the average bitrate of the segment
+	assert.InDelta(t, 500000, probeInfo[0].StreamInfo[0].BitRate, 100000)
+	tmpFiles, err := os.ReadDir(tmpDir)
+	failNowOnError(t, err)
+	assert.Empty(t, tmpFiles)
+
+	// The CBR of x264 is an HRD with filler data, its options are in the SEI of the first frame
+	params.RcMode = avpipe.RcModeCbr
+	params.RcMaxRate = 0
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	probeInfo = boilerProbe(t, &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	})
+	assert.InDelta(t, 500000, probeInfo[0].StreamInfo[0].BitRate, 50000)
+	segment, err := ioutil.ReadFile(fmt.Sprintf("%s/vsegment-1.mp4", outputDir))
+	failNowOnError(t, err)
+	assert.True(t, bytes.Contains(segment, []byte("nal_hrd=cbr")))
+	assert.True(t, bytes.Contains(segment, []byte("filler=1")))
+	// The peak rate and the VBV buffer (1 sec if not set) of a CBR are its bitrate, in kbps
+	assert.True(t, bytes.Contains(segment, []byte("vbv_maxrate=500 vbv_bufsize=500")))
+
+	// A capped CRF needs RcMaxRate
+	params.RcMode = avpipe.RcModeCrfCapped
+	params.VideoBitrate = -1
+	params.RcMaxRate = 0
+	params.RcBufferSize = 0
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	assert.Error(t, avpipe.Xc(params))
+
+	// The VBV of a capped CRF is 1 sec of RcMaxRate if RcBufferSize is not set
+	params.CrfStr = "23"
+	params.RcMaxRate = 800000
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	segment, err = ioutil.ReadFile(fmt.Sprintf("%s/vsegment-1.mp4", outputDir))
+	failNowOnError(t, err)
+	assert.True(t, bytes.Contains(segment, []byte("crf=23.0")))
+	assert.True(t, bytes.Contains(segment, []byte("vbv_maxrate=800 vbv_bufsize=800")))
+	assert.False(t, bytes.Contains(segment, []byte("nal_hrd=cbr")))
+
+	params.RcBufferSize = 1600000
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	segment, err = ioutil.ReadFile(fmt.Sprintf("%s/vsegment-1.mp4", outputDir))
+	failNowOnError(t, err)
+	assert.True(t, bytes.Contains(segment, []byte("vbv_maxrate=800 vbv_bufsize=1600")))
+}
+
+func TestAV1Encoding(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, f)
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Seekable = true
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	probeInfo, err := avpipe.Probe(params)
+	failNowOnError(t, err)
+	assert.Regexp(t, `^avc1\.[0-9a-f]{6}$`, probeInfo.StreamInfo[0].CodecString)
+
+	params = avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = "libsvtav1"
+	params.Preset = "ultrafast"
+	params.CrfStr = "33"
+	params.EncHeight = 360
+	params.EncWidth = 640
+	params.SegDuration = "30"
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	probeInfo2 := boilerProbe(t, &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	})
+	assert.Regexp(t, `^av01\.0\.[0-9]{2}M\.08$`, probeInfo2[0].StreamInfo[0].CodecString)
+
+	// VP9 is packaged in WebM for DASH, not for HLS
+	params.Format = "hls"
+	params.Ecodec = "libvpx-vp9"
+	assert.Error(t, avpipe.Xc(params))
+}
+
+// The codecs of the DASH and HLS manifests are the RFC 6381 codec strings, not the bare "av01"
+func TestAV1Manifests(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	for _, format := range []string{"dash", "hls"} {
+		outputDir := path.Join(baseOutPath, fn(), format)
+
+		params := avpipe.NewXcParams()
+		params.Url = url
+		params.Format = format
+		params.XcType = avpipe.XcVideo
+		params.Ecodec = "libsvtav1"
+		params.Preset = "ultrafast"
+		params.CrfStr = "33"
+		params.EncHeight = 360
+		params.EncWidth = 640
+		params.SegDuration = "2"
+		params.Seekable = true
+		params.DebugFrameLevel = debugFrameLevel
+
+		setupOutDir(t, outputDir)
+		avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+		boilerXc(t, params)
+
+		if format == "dash" {
+			assertManifestMatches(t, path.Join(outputDir, "dash.mpd"), `codecs="av01\.0\.[0-9]{2}M\.08"`)
+		} else {
+			assertManifestMatches(t, path.Join(outputDir, "master.m3u8"), `CODECS="av01\.0\.[0-9]{2}M\.08"`)
+		}
+	}
+}
+
+// VP9 DASH segments are WebM, with a vp09 codec string in the manifest
+func TestVP9WebmDash(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "dash"
+	params.XcType = avpipe.XcVideo
+	params.Ecodec = "libvpx-vp9"
+	params.Preset = "ultrafast"
+	params.CrfStr = "33"
+	params.EncHeight = 360
+	params.EncWidth = 640
+	params.SegDuration = "2"
+	params.Seekable = true
+	params.DebugFrameLevel = debugFrameLevel
+
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	assertManifestMatches(t, path.Join(outputDir, "dash.mpd"), `mimeType="video/webm"`)
+	assertManifestMatches(t, path.Join(outputDir, "dash.mpd"), `codecs="vp09\.00\.[0-9]{2}\.08"`)
+
+	// The init segment is a WebM (EBML) header
+	init, err := ioutil.ReadFile(path.Join(outputDir, "vinit-stream0.m4s"))
+	failNowOnError(t, err)
+	assert.True(t, bytes.HasPrefix(init, []byte{0x1a, 0x45, 0xdf, 0xa3}))
+}
+
+func assertManifestMatches(t *testing.T, filename string, pattern string) {
+	manifest, err := ioutil.ReadFile(filename)
+	failNowOnError(t, err)
+	assert.Regexp(t, pattern, string(manifest))
+}
+
+func TestAudioRenditions(t *testing.T) {
+	url := "./media/case_1_video_and_5.1_audio.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "dash"
+	params.XcType = avpipe.XcAudio
+	params.SegDuration = "30"
+	params.DurationTs = -1
+	params.DebugFrameLevel = debugFrameLevel
+	params.AudioRenditions = []avpipe.AudioRendition{
+		{AudioIndex: 1, Ecodec: "aac", ChannelLayout: avpipe.ChannelLayout("stereo"), Bitrate: 128000, Name: "Stereo", Lang: "en"},
+		{AudioIndex: 1, Ecodec: "eac3", ChannelLayout: avpipe.ChannelLayout("5.1"), Bitrate: 384000, Lang: "en"},
+		{AudioIndex: 1, Ecodec: "libopus", ChannelLayout: avpipe.ChannelLayout("stereo"), Bitrate: 96000, SampleRate: 48000, Lang: "en"},
+	}
+
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	buf, err := ioutil.ReadFile(outputDir + "/audio-renditions.manifest")
+	failNowOnError(t, err)
+	mpd := string(buf)
+	assert.Equal(t, 3, strings.Count(mpd, "<AdaptationSet"))
+	assert.Contains(t, mpd, `codecs="mp4a.40.2"`)
+	assert.Contains(t, mpd, `codecs="ec-3"`)
+	assert.Contains(t, mpd, `codecs="opus"`)
+	assert.Contains(t, mpd, `value="F801"`)
+
+	params.Format = "hls"
+	setupOutDir(t, outputDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	params.AudioRenditions = params.AudioRenditions[:2]
+	boilerXc(t, params)
+
+	buf, err = ioutil.ReadFile(outputDir + "/audio-renditions.manifest")
+	failNowOnError(t, err)
+	m3u8 := string(buf)
+	assert.Equal(t, 2, strings.Count(m3u8, "#EXT-X-MEDIA:TYPE=AUDIO"))
+	assert.Contains(t, m3u8, `CHANNELS="2"`)
+	assert.Contains(t, m3u8, `CHANNELS="6"`)
+
+	// The renditions are only made by an audio transcoding
+	params.XcType = avpipe.XcAll
+	assert.Error(t, avpipe.Xc(params))
+}
+
+// The passthrough renditions copy the samples of the input stream if it is already in their codec
+func TestAudioRenditionPassthrough(t *testing.T) {
+	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	mezDir := path.Join(outputDir, "mez")
+	renditionsDir := path.Join(outputDir, "renditions")
+
+	// Make an E-AC-3 mezzanine of the AC-3 input stream
+	params := avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "fmp4-segment"
+	params.XcType = avpipe.XcAudio
+	params.SegDuration = "30"
+	params.DurationTs = -1
+	params.Ecodec2 = "eac3"
+	params.AudioBitrate = 384000
+	params.SampleRate = 48000
+	params.AudioIndex = []int32{2}
+	params.DebugFrameLevel = debugFrameLevel
+	setupOutDir(t, mezDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: mezDir})
+	boilerXc(t, params)
+
+	url = mezDir + "/asegment0-1.mp4"
+
+	params = avpipe.NewXcParams()
+	params.Url = url
+	params.Format = "dash"
+	params.XcType = avpipe.XcAudio
+	params.SegDuration = "10"
+	params.StartSegmentStr = "1"
+	params.DurationTs = -1
+	params.DebugFrameLevel = debugFrameLevel
+	params.AudioRenditions = []avpipe.AudioRendition{
+		{Ecodec: "eac3", Passthrough: true, Lang: "en"},
+		// The input is not AC-3, the rendition is encoded
+		{Ecodec: "ac3", Passthrough: true, Bitrate: 384000, Lang: "en"},
+		// The input is E-AC-3 but not stereo, the rendition is encoded
+		{Ecodec: "eac3", Passthrough: true, ChannelLayout: avpipe.ChannelLayout("stereo"), Bitrate: 96000, Lang: "en"},
+	}
+	setupOutDir(t, renditionsDir)
+	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: renditionsDir})
+	boilerXc(t, params)
+
+	buf, err := ioutil.ReadFile(renditionsDir + "/audio-renditions.manifest")
+	failNowOnError(t, err)
+	mpd := string(buf)
+	assert.Equal(t, 3, strings.Count(mpd, "<AdaptationSet"))
+	assert.Equal(t, 2, strings.Count(mpd, `codecs="ec-3"`))
+	assert.Equal(t, 1, strings.Count(mpd, `codecs="ac-3"`))
+
+	// The samples of a passthrough segment are the ones of the mezzanine, bit for bit
+	mezFile, err := mp4.ReadMP4File(url)
+	failNowOnError(t, err)
+	mezSamples := fragmentSamples(t, mezFile.Moov, mezFile)
+	renditionSamples := func(rendition int) [][]byte {
+		initFile, err := mp4.ReadMP4File(fmt.Sprintf("%s/ainit-stream%d.m4s", renditionsDir, rendition))
+		failNowOnError(t, err)
+		segment, err := mp4.ReadMP4File(fmt.Sprintf("%s/achunk-stream%d-00001.m4s", renditionsDir, rendition))
+		failNowOnError(t, err)
+		return fragmentSamples(t, initFile.Moov, segment)
+	}
+	samples := renditionSamples(0)
+	if assert.NotEmpty(t, samples) && assert.Less(t, len(samples), len(mezSamples)) {
+		assert.Equal(t, mezSamples[:len(samples)], samples)
+	}
+	for _, rendition := range []int{1, 2} {
+		samples = renditionSamples(rendition)
+		if assert.NotEmpty(t, samples) {
+			assert.NotEqual(t, mezSamples[0], samples[0])
+		}
+	}
+
+	// The passthrough rendition keeps the E-AC-3 configuration of the mezzanine
+	initFile, err := mp4.ReadMP4File(renditionsDir + "/ainit-stream0.m4s")
+	failNowOnError(t, err)
+	mezEC3 := mezFile.Moov.Trak.Mdia.Minf.Stbl.Stsd.EC3
+	initEC3 := initFile.Moov.Trak.Mdia.Minf.Stbl.Stsd.EC3
+	if assert.NotNil(t, mezEC3) && assert.NotNil(t, initEC3) &&
+		assert.NotNil(t, mezEC3.Dec3) && assert.NotNil(t, initEC3.Dec3) {
+		assert.Equal(t, mezEC3.Dec3.EC3Subs, initEC3.Dec3.EC3Subs)
+	}
+}
+
+// fragmentSamples returns the data of the samples in the fragments of f, moov is the one of the init segment
+func fragmentSamples(t *testing.T, moov *mp4.MoovBox, f *mp4.File) [][]byte {
+	var samples [][]byte
+	for _, segment := range f.Segments {
+		for _, frag := range segment.Fragments {
+			fullSamples, err := frag.GetFullSamples(moov.Mvex.Trex)
+			failNowOnError(t, err)
+			for _, sample := range fullSamples {
+				samples = append(samples, sample.Data)
+			}
+		}
+	}
+	return samples
+}
+
+func TestMarshalParams(t *testing.T) {
+	params := &avpipe.XcParams{
+		VideoBitrate:       8000000,
+		VideoSegDurationTs: 180000,
+		EncHeight:          720,
+		EncWidth:           1280,
+		XcType:             avpipe.XcVideo,
+	}
+	bytes, err := json.Marshal(params)
+	assert.NoError(t, err)
+	_ = bytes
+	// TODO: Add asserts
+}
+
+func TestUnmarshalParams(t *testing.T) {
+	var params avpipe.XcParams
+	bytes := []byte(`{"video_bitrate":8000000,"seg_duration_ts":180000,"seg_duration_fr":50,"enc_height":720,"enc_width":1280,"xc_type":1}`)
+	err := json.Unmarshal(bytes, &params)
+	assert.NoError(t, err)
+	assert.Equal(t, avpipe.XcVideo, int(params.XcType))
+	// TODO: More checks
+}
+
+func TestUnmarshalParamsNumAudioBackwardsCompat(t *testing.T) {
+	var params avpipe.XcParams
+	bytesWithNAudio := []byte(`{"video_bitrate":8000000,"seg_duration_ts":180000,"seg_duration_fr":50,"enc_height":720,"enc_width":1280,"xc_type":1,"audio_index":[0,0,0,0,0,0,0,0],"n_audio":1}`)
+	err := json.Unmarshal(bytesWithNAudio, &params)
+	assert.NoError(t, err)
+	assert.Equal(t, len(params.AudioIndex), 1)
+
+	bytesNoNAudio := []byte(`{"video_bitrate":8000000,"seg_duration_ts":180000,"seg_duration_fr":50,"enc_height":720,"enc_width":1280,"xc_type":1,"audio_index":[0,0,0,0,0,0,0,0]}`)
+	err = json.Unmarshal(bytesNoNAudio, &params)
+	assert.NoError(t, err)
+	assert.Equal(t, len(params.AudioIndex), 8)
+}
+
+func TestProbe(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	xcparams := &avpipe.XcParams{
+		Url:      url,
+		Seekable: true,
+	}
+	probe, err := avpipe.Probe(xcparams)
+	failNowOnError(t, err)
+	assert.Equal(t, 3, len(probe.StreamInfo))
+
+	assert.Equal(t, 27, probe.StreamInfo[0].CodecID)
+	assert.Equal(t, "h264", probe.StreamInfo[0].CodecName)
+	assert.Equal(t, 100, probe.StreamInfo[0].Profile) // 77 = FF_PROFILE_H264_MAIN
+	assert.Equal(t, 41, probe.StreamInfo[0].Level)
+	assert.Equal(t, int64(1800), probe.StreamInfo[0].NBFrames)
+	assert.Equal(t, int64(1980), probe.StreamInfo[0].StartTime)
+	assert.Equal(t, int64(3081772), probe.StreamInfo[0].BitRate)
+	assert.Equal(t, 1920, probe.StreamInfo[0].Width)
+	assert.Equal(t, 1080, probe.StreamInfo[0].Height)
+	assert.Equal(t, int64(30000), probe.StreamInfo[0].TimeBase.Denom().Int64())
+
+	assert.Equal(t, 86017, probe.StreamInfo[1].CodecID)
+	assert.Equal(t, "mp3float", probe.StreamInfo[1].CodecName)
+	assert.Equal(t, -99, probe.StreamInfo[1].Profile) // 1 = FF_PROFILE_AAC_LOW
+	assert.Equal(t, -99, probe.StreamInfo[1].Level)
+	assert.Equal(t, int64(2500), probe.StreamInfo[1].NBFrames)
+	assert.Equal(t, int64(0), probe.StreamInfo[1].StartTime)
+	assert.Equal(t, int64(160000), probe.StreamInfo[1].BitRate)
+	assert.Equal(t, 0, probe.StreamInfo[1].Width)
+	assert.Equal(t, 0, probe.StreamInfo[1].Height)
+	assert.Equal(t, int64(48000), probe.StreamInfo[1].TimeBase.Denom().Int64())
+
+	assert.Equal(t, 86019, probe.StreamInfo[2].CodecID)
+	assert.Equal(t, "ac3", probe.StreamInfo[2].CodecName)
+	assert.Equal(t, -99, probe.StreamInfo[2].Profile) // 1 = FF_PROFILE_AAC_LOW
+	assert.Equal(t, -99, probe.StreamInfo[2].Level)
+	assert.Equal(t, int64(1875), probe.StreamInfo[2].NBFrames)
+	assert.Equal(t, int64(0), probe.StreamInfo[2].StartTime)
+	assert.Equal(t, int64(320000), probe.StreamInfo[2].BitRate)
+	assert.Equal(t, 0, probe.StreamInfo[2].Width)
+	assert.Equal(t, 0, probe.StreamInfo[2].Height)
+	assert.Equal(t, int64(48000), probe.StreamInfo[2].TimeBase.Denom().Int64())
+	assert.Equal(t, 6, probe.StreamInfo[2].Channels)
+	assert.Equal(t, "5.1(side)", avpipe.ChannelLayoutName(probe.StreamInfo[2].Channels, probe.StreamInfo[2].ChannelLayout))
+
+	// Test StreamInfoAsArray
+	a := avpipe.StreamInfoAsArray(probe.StreamInfo)
+	assert.Equal(t, "h264", a[0].CodecName)
+	assert.Equal(t, "mp3float", a[1].CodecName)
+	assert.Equal(t, "ac3", a[2].CodecName)
+}
+
+func TestProbeWithData(t *testing.T) {
+	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	xcparams := &avpipe.XcParams{
+		Url:      url,
+		Seekable: true,
+	}
+	probe, err := avpipe.Probe(xcparams)
+	failNowOnError(t, err)
+	assert.Equal(t, 9, len(probe.StreamInfo))
+
+	assert.Equal(t, 147, probe.StreamInfo[0].CodecID)
+	assert.Equal(t, "prores", probe.StreamInfo[0].CodecName)
+	assert.Equal(t, 3, probe.StreamInfo[0].Profile) // 3 = FF_PROFILE_MPEG4_MAIN
+	assert.Equal(t, -99, probe.StreamInfo[0].Level)
+	assert.Equal(t, int64(1439), probe.StreamInfo[0].NBFrames)
+	assert.Equal(t, int64(0), probe.StreamInfo[0].StartTime)
+	assert.Equal(t, int64(249054569), probe.StreamInfo[0].BitRate)
+	assert.Equal(t, 1920, probe.StreamInfo[0].Width)
+	assert.Equal(t, 1080, probe.StreamInfo[0].Height)
+	assert.Equal(t, int64(24000), probe.StreamInfo[0].TimeBase.Denom().Int64())
+
+	assert.Equal(t, 65548, probe.StreamInfo[1].CodecID)
+	assert.Equal(t, "pcm_s24le", probe.StreamInfo[1].CodecName)
+	assert.Equal(t, -99, probe.StreamInfo[1].Profile)
+	assert.Equal(t, -99, probe.StreamInfo[1].Level)
+	assert.Equal(t, int64(2880480), probe.StreamInfo[1].NBFrames)
+	assert.Equal(t, int64(0), probe.StreamInfo[1].StartTime)
+	assert.Equal(t, int64(1152000), probe.StreamInfo[1].BitRate)
+	assert.Equal(t, 0, probe.StreamInfo[1].Width)
+	assert.Equal(t, 0, probe.StreamInfo[1].Height)
+	assert.Equal(t, int64(48000), probe.StreamInfo[1].TimeBase.Denom().Int64())
+
+	assert.Equal(t, 65548, probe.StreamInfo[2].CodecID)
+	assert.Equal(t, "pcm_s24le", probe.StreamInfo[2].CodecName)
+	assert.Equal(t, -99, probe.StreamInfo[2].Profile)
+	assert.Equal(t, -99, probe.StreamInfo[2].Level)
+	assert.Equal(t, int64(2880480), probe.StreamInfo[2].NBFrames)
+	assert.Equal(t, int64(0), probe.StreamInfo[2].StartTime)
+	assert.Equal(t, int64(1152000), probe.StreamInfo[2].BitRate)
+	assert.Equal(t, 0, probe.StreamInfo[2].Width)
+	assert.Equal(t, 0, probe.StreamInfo[2].Height)
+	assert.Equal(t, int64(48000), probe.StreamInfo[2].TimeBase.Denom().Int64())
+
+	assert.Equal(t, 0, probe.StreamInfo[8].CodecID)
+	assert.Equal(t, "", probe.StreamInfo[8].CodecName)
+	assert.Equal(t, -99, probe.StreamInfo[8].Profile)
+	assert.Equal(t, -99, probe.StreamInfo[8].Level)
+	assert.Equal(t, int64(1), probe.StreamInfo[8].NBFrames)
+	assert.Equal(t, int64(0), probe.StreamInfo[8].StartTime)
+	assert.Equal(t, int64(0), probe.StreamInfo[8].BitRate)
+	assert.Equal(t, 0, probe.StreamInfo[8].Width)
+	assert.Equal(t, 0, probe.StreamInfo[8].Height)
+	assert.Equal(t, int64(24000), probe.StreamInfo[8].TimeBase.Denom().Int64())
+
+	// Test StreamInfoAsArray
+	a := avpipe.StreamInfoAsArray(probe.StreamInfo)
+	assert.Equal(t, "prores", a[0].CodecName)
+	assert.Equal(t, "pcm_s24le", a[1].CodecName)
+	assert.Equal(t, "pcm_s24le", a[2].CodecName)
+}
+
+func TestExtractImagesInterval(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outPath := path.Join(baseOutPath, fn())
+	params := &avpipe.XcParams{
+		Format:                 "image2",
+		AudioBitrate:           128000,
+		AudioSegDurationTs:     -1,
+		BitDepth:               8,
+		CrfStr:                 "23",
+		DurationTs:             -1,
+		Ecodec:                 "mjpeg",
+		Ecodec2:                "aac",
+		EncHeight:              -1,
+		EncWidth:               -1,
+		ExtractImageIntervalTs: -1,
+		GPUIndex:               -1,
+		SampleRate:             -1,
+		SegDuration:            "30",
+		StartFragmentIndex:     1,
+		StartSegmentStr:        "1",
+		StreamId:               -1,
+		SyncAudioToStreamId:    -1,
+		VideoBitrate:           -1,
+		VideoSegDurationTs:     -1,
+		XcType:                 avpipe.XcExtractImages,
 		Url:                    url,
 		DebugFrameLevel:        debugFrameLevel,
 	}
@@ -2627,6 +4075,384 @@ func TestExtractAllImages(t *testing.T) {
 	assert.Equal(t, int64(1000980), pts)
 }
 
+// The captions of the input are re-encoded with the video (scaled), the caption extracted from the
+// input and from the output must be the one of the fixture.
+func TestCaptionPassthrough(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	url := writeFixture(t, outputDir+".h264", testfixture.CaptionH264())
+	params := &avpipe.XcParams{
+		Format:              "fmp4-segment",
+		StartTimeTs:         0,
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              avpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	inCues := extractCaptionCues(t, url, path.Join(outputDir, "captions-in"))
+	outCues := extractCaptionCues(t, path.Join(outputDir, "vsegment-1.mp4"), path.Join(outputDir, "captions-out"))
+	assert.Equal(t, []string{testfixture.CaptionText}, inCues)
+	assert.Equal(t, []string{testfixture.CaptionText}, outCues)
+}
+
+// Same as TestCaptionPassthrough with a 59.94 fps output (VideoFrameDurationTs) of the 25 fps fixture,
+// the cc_data of the input frames is re-packed over more output frames.
+func TestCaptionPassthroughFrameDuration(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	url := writeFixture(t, outputDir+".h264", testfixture.CaptionH264())
+	params := &avpipe.XcParams{
+		Format:               "fmp4-segment",
+		StartTimeTs:          0,
+		DurationTs:           -1,
+		StartSegmentStr:      "1",
+		SegDuration:          "30",
+		Ecodec:               h264Codec,
+		EncHeight:            -1,
+		EncWidth:             -1,
+		XcType:               avpipe.XcVideo,
+		StreamId:             -1,
+		SyncAudioToStreamId:  -1,
+		VideoTimeBase:        60000,
+		VideoFrameDurationTs: 1001,
+		Url:                  url,
+		DebugFrameLevel:      debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	inCues := extractCaptionCues(t, url, path.Join(outputDir, "captions-in"))
+	outCues := extractCaptionCues(t, path.Join(outputDir, "vsegment-1.mp4"), path.Join(outputDir, "captions-out"))
+	assert.Equal(t, []string{testfixture.CaptionText}, inCues)
+	assert.Equal(t, []string{testfixture.CaptionText}, outCues)
+}
+
+// extractCaptionCues extracts the CC1 captions of url as WebVTT segments in outputDir and returns the
+// text of the cues, without the cue timings.
+func extractCaptionCues(t *testing.T, url, outputDir string) []string {
+	params := &avpipe.XcParams{
+		Format:              "hls",
+		StartTimeTs:         0,
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              avpipe.XcExtractCaptions,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	xcTest(t, outputDir, params, nil, true)
+
+	files, err := filepath.Glob(path.Join(outputDir, "captions-CC1-*.vtt"))
+	failNowOnError(t, err)
+	var cues []string
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		failNowOnError(t, err)
+		for _, line := range strings.Split(string(b), "\n") {
+			if len(line) == 0 || line == "WEBVTT" || strings.Contains(line, " --> ") {
+				continue
+			}
+			cues = append(cues, line)
+		}
+	}
+	return cues
+}
+
+// A splice_insert cue splices at 5.2 sec, between the mez part boundaries at 4 and 6 sec: the part that has
+// the 4 sec boundary must end at the splice point, and the next part must start with it.
+func TestSpliceSegment(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	fixture, _, spliceTime, err := testfixture.SpliceTS(5.2)
+	failNowOnError(t, err)
+	url := writeFixture(t, outputDir+".ts", fixture)
+
+	params := &avpipe.XcParams{
+		Format:              "fmp4-segment",
+		StartTimeTs:         0,
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		ForceKeyInt:         50,
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              avpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		SpliceSegment:       true,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	statsInfo.splicePoints = nil
+	xcTest(t, outputDir, params, nil, true)
+
+	if !assert.Equal(t, 1, len(statsInfo.splicePoints)) {
+		return
+	}
+	splicePoint := statsInfo.splicePoints[0]
+	assert.Equal(t, int64(spliceTime), splicePoint.PTS)
+
+	// The parts before the splice point last 5.2 sec
+	duration := 0.0
+	for i := 1; i < splicePoint.SegIndex; i++ {
+		part := fmt.Sprintf("%s/vsegment-%d.mp4", outputDir, i)
+		avpipe.InitUrlIOHandler(part, &fileInputOpener{url: part}, nil)
+		probe, err := avpipe.Probe(&avpipe.XcParams{Url: part, Seekable: true})
+		failNowOnError(t, err)
+		duration += probe.ContainerInfo.Duration
+	}
+	assert.InDelta(t, 5.2, duration, 0.01)
+
+	// dash/hls start a segment at the splice point IDR frame
+	params.Format = "dash"
+	statsInfo.splicePoints = nil
+	xcTest(t, outputDir, params, nil, true)
+	if assert.Equal(t, 1, len(statsInfo.splicePoints)) {
+		assert.Equal(t, int64(spliceTime), statsInfo.splicePoints[0].PTS)
+	}
+}
+
+// The SCTE-35 cue of the input is written as a version 1 emsg box before the moof of a video segment
+func TestEmitEmsg(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	fixture, cue, spliceTime, err := testfixture.SpliceTS(5.2)
+	failNowOnError(t, err)
+	url := writeFixture(t, outputDir+".ts", fixture)
+
+	params := &avpipe.XcParams{
+		Format:              "dash",
+		StartTimeTs:         0,
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		ForceKeyInt:         50,
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              avpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		EmitEmsg:            true,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	statsInfo.emsgs = nil
+	xcTest(t, outputDir, params, nil, true)
+
+	if !assert.Equal(t, 1, len(statsInfo.emsgs)) {
+		return
+	}
+	stat := statsInfo.emsgs[0]
+
+	segment, err := ioutil.ReadFile(fmt.Sprintf("%s/vchunk-stream0-%05d.m4s", outputDir, stat.SegIndex))
+	failNowOnError(t, err)
+
+	// The top level boxes cover the segment exactly, the emsg box is the one before the moof
+	var emsg []byte
+	for pos := 0; pos < len(segment); {
+		if !assert.True(t, pos+8 <= len(segment)) {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(segment[pos:]))
+		if !assert.True(t, size >= 8 && pos+size <= len(segment), "box size %d at %d", size, pos) {
+			return
+		}
+		if string(segment[pos+4:pos+8]) == "emsg" {
+			emsg = segment[pos : pos+size]
+			if assert.True(t, pos+size+8 <= len(segment)) {
+				assert.Equal(t, "moof", string(segment[pos+size+4:pos+size+8]))
+			}
+		}
+		pos += size
+	}
+	if !assert.NotNil(t, emsg) {
+		return
+	}
+
+	scheme := "urn:scte:scte35:2013:bin"
+	assert.Equal(t, 32+len(scheme)+1+1+len(cue), len(emsg))
+	assert.Equal(t, byte(1), emsg[8]) // version
+	timescale := binary.BigEndian.Uint32(emsg[12:])
+	presentationTime := binary.BigEndian.Uint64(emsg[16:])
+	assert.Equal(t, stat.Timescale, timescale)
+	assert.Equal(t, stat.PresentationTime, presentationTime)
+	assert.InDelta(t, float64(spliceTime)/90000, float64(presentationTime)/float64(timescale), 0.04)
+	assert.Equal(t, uint32(0xffffffff), binary.BigEndian.Uint32(emsg[24:])) // event_duration
+	assert.Equal(t, stat.Id, binary.BigEndian.Uint32(emsg[28:]))
+	fields := bytes.SplitN(emsg[32:], []byte{0}, 3)
+	assert.Equal(t, scheme, string(fields[0]))
+	assert.Equal(t, "", string(fields[1])) // value
+	assert.Equal(t, cue, fields[2])        // message_data
+	assert.Equal(t, cue, stat.MessageData)
+}
+
+// Cues scheduled with XcInsertCue are written as is on Scte35PID in the copy MPEGTS segments, merged with the
+// SCTE-35 stream of the input, before the first packet at their PTS or before the next packet without PTS
+func TestInsertCue(t *testing.T) {
+	const scte35PID = 0x1f0
+	outputDir := path.Join(baseOutPath, fn())
+	fixture, inputCue, _, err := testfixture.SpliceTS(5.2)
+	failNowOnError(t, err)
+	url := writeFixture(t, outputDir+".ts", fixture)
+
+	params := &avpipe.XcParams{
+		Format:              "fmp4-segment",
+		StartTimeTs:         0,
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		ForceKeyInt:         50,
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              avpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		CopyMpegts:          true,
+		Scte35PID:           scte35PID,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	boilerplate(t, outputDir, url)
+
+	handle, err := avpipe.XcInit(params)
+	failNowOnError(t, err)
+
+	// A 30 sec break at 8 sec with a 2 sec preroll, and a break end written right away
+	splicePTS := uint64(900000 + 8*90000)
+	cuePTS := int64(splicePTS - 2*90000)
+	outInfo := ts.SpliceInsertOut(1, splicePTS, 30*90000)
+	out, err := outInfo.Encode()
+	failNowOnError(t, err)
+	inInfo := ts.SpliceInsertIn(2, 900000)
+	in, err := inInfo.Encode()
+	failNowOnError(t, err)
+	failNowOnError(t, avpipe.XcInsertCue(handle, cuePTS, out))
+	failNowOnError(t, avpipe.XcInsertCue(handle, math.MinInt64, in))
+
+	bad := append([]byte(nil), out...)
+	bad[len(bad)-1] ^= 0xff
+	assert.Error(t, avpipe.XcInsertCue(handle, cuePTS, bad))
+	assert.Error(t, avpipe.XcInsertCue(handle, cuePTS, out[:len(out)-4]))
+
+	failNowOnError(t, avpipe.XcRun(handle))
+
+	segments, err := filepath.Glob(outputDir + "/ts-segment-*.ts")
+	failNowOnError(t, err)
+	if !assert.NotEmpty(t, segments) {
+		return
+	}
+	var data []byte
+	for _, segment := range segments {
+		b, err := os.ReadFile(segment)
+		failNowOnError(t, err)
+		data = append(data, b...)
+	}
+
+	// The output keeps the input timestamps, the sections are not changed
+	var sections [][]byte
+	var sectionVideoPTS []int64 // PTS of the video PES before each section
+	videoPTS := int64(-1)
+	firstVideoPTS := int64(-1)
+	for pos := 0; pos+188 <= len(data); pos += 188 {
+		pkt := data[pos : pos+188]
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		if pkt[1]&0x40 == 0 || pkt[3]&0x10 == 0 {
+			continue
+		}
+		payload := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			payload = pkt[5+int(pkt[4]):]
+		}
+		switch pid {
+		case testfixture.VideoPID:
+			if len(payload) >= 14 && payload[7]&0x80 != 0 {
+				p := payload[9:]
+				videoPTS = int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+				if firstVideoPTS < 0 {
+					firstVideoPTS = videoPTS
+				}
+			}
+		case scte35PID:
+			section := payload[1+int(payload[0]):]
+			section = section[:3+(int(section[1]&0x0f)<<8|int(section[2]))]
+			_, err := scte35.Parse(section)
+			assert.NoError(t, err)
+			sections = append(sections, section)
+			sectionVideoPTS = append(sectionVideoPTS, videoPTS)
+		}
+	}
+	assert.Equal(t, int64(900000), firstVideoPTS)
+	if !assert.Equal(t, 3, len(sections)) {
+		return
+	}
+	assert.Equal(t, in, sections[0])
+	assert.InDelta(t, firstVideoPTS, sectionVideoPTS[0], 3600)
+	assert.Equal(t, inputCue, sections[1])
+	assert.Equal(t, out, sections[2])
+	assert.InDelta(t, cuePTS, sectionVideoPTS[2], 3600)
+}
+
+// Each ID3 and KLV PES packet of the input is reported with AV_IN_STAT_TIMED_METADATA, with its payload and PTS
+func TestTimedMetadata(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	fixture, id3, klv, pts := testfixture.TimedMetadataTS()
+	url := writeFixture(t, outputDir+".ts", fixture)
+
+	params := &avpipe.XcParams{
+		Format:              "fmp4-segment",
+		StartTimeTs:         0,
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              avpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	statsInfo.timedMetadata = nil
+	xcTest(t, outputDir, params, nil, true)
+
+	payloads := map[avpipe.TimedMetadataType][][]byte{}
+	for _, md := range statsInfo.timedMetadata {
+		n := len(payloads[md.Type])
+		if assert.Less(t, n, len(pts), md.Type) {
+			assert.Equal(t, pts[n], md.PTS, md.Type)
+		}
+		payloads[md.Type] = append(payloads[md.Type], md.Data)
+	}
+	assert.Equal(t, id3, payloads[avpipe.TimedMetadataID3])
+	assert.Equal(t, klv, payloads[avpipe.TimedMetadataKLV])
+}
+
+// writeFixture writes a fixture of the testfixture package to filename and returns filename
+func writeFixture(t *testing.T, filename string, data []byte) string {
+	failNowOnError(t, os.MkdirAll(path.Dir(filename), 0755))
+	failNowOnError(t, ioutil.WriteFile(filename, data, 0644))
+	return filename
+}
+
 type LevelParams struct {
 	profile       int
 	bitrate       int64
@@ -0,0 +1,277 @@
+/*
+ * Declarative audio channel mapping. A ChannelMap describes every channel of
+ * one output audio stream in terms of input channels, and avpipe generates
+ * the pan/amerge filter graph (XcParams.FilterDescriptor) from it.
+ */
+package avpipe
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxChannelMapStreams is the number of inputs of the audio merge filter graph
+const maxChannelMapStreams = 8
+
+// ChannelSource is one input channel that contributes to an output channel.
+type ChannelSource struct {
+	// StreamIndex is the index of the input audio stream
+	StreamIndex int `json:"stream_index"`
+	// Channel is a channel name of the input stream layout (i.e "FL", "FR", "FC", "LFE", "BL", "SL")
+	// or the position of the channel in the stream ("c0", "c1", ...) for discrete or unknown layouts.
+	Channel string `json:"channel"`
+	// Gain applied to the input channel, 0 means 1 (unity gain).
+	Gain float64 `json:"gain,omitempty"`
+}
+
+// OutputChannel is one channel of the output stream, the sum of its sources.
+type OutputChannel struct {
+	Sources []ChannelSource `json:"sources"`
+}
+
+// ChannelMap describes the output audio stream of a transcoding: its channel
+// layout and, in layout order, the input channels that make each output channel.
+type ChannelMap struct {
+	// Layout is the output channel layout (i.e "mono", "stereo", "5.1")
+	Layout   string          `json:"layout"`
+	Channels []OutputChannel `json:"channels"`
+}
+
+// NewChannelMap returns an empty channel map with the given output layout.
+func NewChannelMap(layout string) *ChannelMap {
+	return &ChannelMap{Layout: layout}
+}
+
+// AddChannel appends the next output channel, made of the given sources.
+func (m *ChannelMap) AddChannel(sources ...ChannelSource) *ChannelMap {
+	m.Channels = append(m.Channels, OutputChannel{Sources: sources})
+	return m
+}
+
+// Validate checks the channel map against the probed input streams.
+func (m *ChannelMap) Validate(probe *ProbeInfo) error {
+	_, err := m.resolve(probe)
+	return err
+}
+
+// FilterDescriptor returns the transcoding type, the audio indexes and the
+// filter descriptor that implement the channel map for the probed input.
+// A channel map that reads from one stream is a pan (XcAudioPan), a channel
+// map that reads from several streams is a merge (XcAudioMerge).
+func (m *ChannelMap) FilterDescriptor(probe *ProbeInfo) (XcType, []int32, string, error) {
+	r, err := m.resolve(probe)
+	if err != nil {
+		return XcNone, nil, "", err
+	}
+
+	b := strings.Builder{}
+	audioIndex := make([]int32, len(r.streams))
+	for i, s := range r.streams {
+		audioIndex[i] = int32(s)
+		fmt.Fprintf(&b, "[0:%d]", s)
+	}
+
+	xcType := XcType(XcAudioPan)
+	if len(r.streams) > 1 {
+		xcType = XcAudioMerge
+		fmt.Fprintf(&b, "amerge=inputs=%d,", len(r.streams))
+	}
+
+	b.WriteString("pan=" + m.Layout)
+	for i, ch := range m.Channels {
+		fmt.Fprintf(&b, "|c%d=", i)
+		for j, src := range ch.Sources {
+			gain := src.Gain
+			if gain == 0 {
+				gain = 1
+			}
+			if j > 0 {
+				if gain < 0 {
+					b.WriteString("-")
+					gain = -gain
+				} else {
+					b.WriteString("+")
+				}
+			}
+			if gain != 1 {
+				b.WriteString(strconv.FormatFloat(gain, 'f', -1, 64) + "*")
+			}
+			fmt.Fprintf(&b, "c%d", r.index[i][j])
+		}
+	}
+	b.WriteString("[aout]")
+
+	return xcType, audioIndex, b.String(), nil
+}
+
+type resolvedChannelMap struct {
+	streams []int   // input streams, in the order the decoder opens them
+	index   [][]int // input channel index (after merge) of each source
+}
+
+func (m *ChannelMap) resolve(probe *ProbeInfo) (*resolvedChannelMap, error) {
+	if probe == nil {
+		return nil, fmt.Errorf("channel map needs the probe info of the input")
+	}
+
+	layout := uint64(ChannelLayout(m.Layout))
+	if layout == 0 {
+		return nil, fmt.Errorf("invalid channel map layout %q", m.Layout)
+	}
+	if len(m.Channels) != bits.OnesCount64(layout) {
+		return nil, fmt.Errorf("channel map has %d channels, layout %s has %d",
+			len(m.Channels), m.Layout, bits.OnesCount64(layout))
+	}
+
+	streamInfo := map[int]*StreamInfo{}
+	for i := range probe.StreamInfo {
+		streamInfo[probe.StreamInfo[i].StreamIndex] = &probe.StreamInfo[i]
+	}
+
+	// Collect the input streams
+	r := &resolvedChannelMap{}
+	for i, ch := range m.Channels {
+		if len(ch.Sources) == 0 {
+			return nil, fmt.Errorf("channel map output channel %d has no source", i)
+		}
+		for _, src := range ch.Sources {
+			si, ok := streamInfo[src.StreamIndex]
+			if !ok {
+				return nil, fmt.Errorf("channel map output channel %d, invalid stream index %d", i, src.StreamIndex)
+			}
+			if si.CodecType != AVMediaTypeNames[AVMEDIA_TYPE_AUDIO] {
+				return nil, fmt.Errorf("channel map output channel %d, stream %d is not audio", i, src.StreamIndex)
+			}
+			if math.IsNaN(src.Gain) || math.IsInf(src.Gain, 0) {
+				return nil, fmt.Errorf("channel map output channel %d, invalid gain %v", i, src.Gain)
+			}
+			found := false
+			for _, s := range r.streams {
+				found = found || s == src.StreamIndex
+			}
+			if !found {
+				r.streams = append(r.streams, src.StreamIndex)
+			}
+		}
+	}
+	if len(r.streams) > maxChannelMapStreams {
+		return nil, fmt.Errorf("channel map has too many input streams, n=%d, max=%d", len(r.streams), maxChannelMapStreams)
+	}
+	sort.Ints(r.streams)
+
+	/*
+	 * amerge reorders the channels in the native order of the merged layout if the
+	 * input layouts are disjoint, otherwise it appends the channels of each input.
+	 */
+	disjoint := len(r.streams) > 1
+	merged := uint64(0)
+	offset := map[int]int{}
+	for _, s := range r.streams {
+		si := streamInfo[s]
+		l := streamLayout(si)
+		if l == 0 || merged&l != 0 {
+			disjoint = false
+		}
+		merged |= l
+	}
+	n := 0
+	for _, s := range r.streams {
+		offset[s] = n
+		n += streamInfo[s].Channels
+	}
+
+	r.index = make([][]int, len(m.Channels))
+	for i, ch := range m.Channels {
+		r.index[i] = make([]int, len(ch.Sources))
+		for j, src := range ch.Sources {
+			si := streamInfo[src.StreamIndex]
+			c, err := channelIndex(si, src.Channel)
+			if err != nil {
+				return nil, fmt.Errorf("channel map output channel %d: %w", i, err)
+			}
+			if disjoint {
+				bit := channelBit(streamLayout(si), c)
+				r.index[i][j] = bits.OnesCount64(merged & (bit - 1))
+			} else {
+				r.index[i][j] = offset[src.StreamIndex] + c
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// streamLayout returns the channel layout of the stream, or the default layout
+// for its number of channels if the layout is unknown.
+func streamLayout(si *StreamInfo) uint64 {
+	if si.ChannelLayout != 0 {
+		return uint64(si.ChannelLayout)
+	}
+	return uint64(ChannelLayout(fmt.Sprintf("%dc", si.Channels)))
+}
+
+// channelIndex returns the position of the named channel in the stream.
+func channelIndex(si *StreamInfo, channel string) (int, error) {
+	if strings.HasPrefix(channel, "c") {
+		if c, err := strconv.Atoi(channel[1:]); err == nil {
+			if c < 0 || c >= si.Channels {
+				return 0, fmt.Errorf("invalid channel %s, stream %d has %d channels", channel, si.StreamIndex, si.Channels)
+			}
+			return c, nil
+		}
+	}
+
+	bit := uint64(ChannelLayout(channel))
+	if si.ChannelLayout == 0 || bits.OnesCount64(bit) != 1 || uint64(si.ChannelLayout)&bit == 0 {
+		return 0, fmt.Errorf("invalid channel %s for stream %d, layout %s", channel, si.StreamIndex,
+			ChannelLayoutName(si.Channels, si.ChannelLayout))
+	}
+	return bits.OnesCount64(uint64(si.ChannelLayout) & (bit - 1)), nil
+}
+
+// channelBit returns the channel of the layout at the given position.
+func channelBit(layout uint64, index int) uint64 {
+	for ; layout != 0; layout &= layout - 1 {
+		if index == 0 {
+			return layout & -layout
+		}
+		index--
+	}
+	return 0
+}
+
+// applyChannelMap returns a copy of params with the transcoding type, audio indexes,
+// channel layout and filter descriptor of params.ChannelMap, params is not changed. The
+// input is probed to validate the map, so the input opener of params.Url must support
+// being opened twice.
+func applyChannelMap(params *XcParams) (*XcParams, error) {
+	if params.XcType&^XcType(XcAudioPan|XcAudioMerge) != 0 || params.XcType&XcAudio == 0 {
+		return nil, fmt.Errorf("channel map requires an audio transcoding, xc_type=%d", params.XcType)
+	}
+	if params.BypassTranscoding {
+		return nil, fmt.Errorf("channel map is not supported with bypass transcoding")
+	}
+
+	probe, err := probe(&XcParams{Url: params.Url, Seekable: params.Seekable})
+	if err != nil {
+		return nil, err
+	}
+
+	xcType, audioIndex, filterDescriptor, err := params.ChannelMap.FilterDescriptor(probe)
+	if err != nil {
+		return nil, err
+	}
+	p := *params
+	p.XcType = xcType
+	p.AudioIndex = audioIndex
+	p.ChannelLayout = ChannelLayout(params.ChannelMap.Layout)
+	p.FilterDescriptor = filterDescriptor
+	log.Info("channel map", "url", params.Url, "xc_type", xcType, "audio_index", audioIndex,
+		"filter_descriptor", filterDescriptor)
+
+	return &p, nil
+}
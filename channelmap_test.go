@@ -0,0 +1,119 @@
+package avpipe
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func channelMapProbe(streams ...StreamInfo) *ProbeInfo {
+	probe := &ProbeInfo{}
+	for i, si := range streams {
+		si.StreamIndex = i
+		probe.StreamInfo = append(probe.StreamInfo, si)
+	}
+	return probe
+}
+
+var (
+	videoStream      = StreamInfo{CodecType: "video"}
+	monoStream       = StreamInfo{CodecType: "audio", Channels: 1, ChannelLayout: 0x4}
+	stereoStream     = StreamInfo{CodecType: "audio", Channels: 2, ChannelLayout: 0x3}
+	surroundStream   = StreamInfo{CodecType: "audio", Channels: 6, ChannelLayout: 0x60f}
+	discrete16Stream = StreamInfo{CodecType: "audio", Channels: 16}
+)
+
+func TestChannelMapPanDiscrete(t *testing.T) {
+	// Stereo from channels 7-8 of a discrete 16 channel stream
+	probe := channelMapProbe(videoStream, discrete16Stream)
+	m := NewChannelMap("stereo").
+		AddChannel(ChannelSource{StreamIndex: 1, Channel: "c6"}).
+		AddChannel(ChannelSource{StreamIndex: 1, Channel: "c7"})
+
+	xcType, audioIndex, descriptor, err := m.FilterDescriptor(probe)
+	require.NoError(t, err)
+	require.Equal(t, XcType(XcAudioPan), xcType)
+	require.Equal(t, []int32{1}, audioIndex)
+	require.Equal(t, "[0:1]pan=stereo|c0=c6|c1=c7[aout]", descriptor)
+}
+
+func TestChannelMapPanDownmix(t *testing.T) {
+	probe := channelMapProbe(videoStream, surroundStream)
+	m := NewChannelMap("stereo").
+		AddChannel(
+			ChannelSource{StreamIndex: 1, Channel: "FL"},
+			ChannelSource{StreamIndex: 1, Channel: "FC", Gain: 0.707},
+			ChannelSource{StreamIndex: 1, Channel: "SL", Gain: -0.5}).
+		AddChannel(
+			ChannelSource{StreamIndex: 1, Channel: "FR"},
+			ChannelSource{StreamIndex: 1, Channel: "FC", Gain: 0.707},
+			ChannelSource{StreamIndex: 1, Channel: "SR", Gain: -0.5})
+
+	_, _, descriptor, err := m.FilterDescriptor(probe)
+	require.NoError(t, err)
+	require.Equal(t, "[0:1]pan=stereo|c0=c0+0.707*c2-0.5*c4|c1=c1+0.707*c2-0.5*c5[aout]", descriptor)
+}
+
+func TestChannelMapMergeMono(t *testing.T) {
+	// 5.1 from six mono streams, the streams are merged in stream index order
+	probe := channelMapProbe(videoStream, monoStream, monoStream, monoStream, monoStream, monoStream, monoStream)
+	m := NewChannelMap("5.1")
+	for _, s := range []int{2, 1, 3, 6, 4, 5} {
+		m.AddChannel(ChannelSource{StreamIndex: s, Channel: "c0"})
+	}
+
+	xcType, audioIndex, descriptor, err := m.FilterDescriptor(probe)
+	require.NoError(t, err)
+	require.Equal(t, XcType(XcAudioMerge), xcType)
+	require.Equal(t, []int32{1, 2, 3, 4, 5, 6}, audioIndex)
+	require.Equal(t, "[0:1][0:2][0:3][0:4][0:5][0:6]amerge=inputs=6,pan=5.1|c0=c1|c1=c0|c2=c2|c3=c5|c4=c3|c5=c4[aout]",
+		descriptor)
+}
+
+func TestChannelMapMergeDisjoint(t *testing.T) {
+	// amerge puts the channels of disjoint layouts in native order: FL, FR, FC
+	probe := channelMapProbe(monoStream, stereoStream)
+	m := NewChannelMap("3.0").
+		AddChannel(ChannelSource{StreamIndex: 1, Channel: "FL"}).
+		AddChannel(ChannelSource{StreamIndex: 1, Channel: "FR"}).
+		AddChannel(ChannelSource{StreamIndex: 0, Channel: "FC"})
+
+	_, audioIndex, descriptor, err := m.FilterDescriptor(probe)
+	require.NoError(t, err)
+	require.Equal(t, []int32{0, 1}, audioIndex)
+	require.Equal(t, "[0:0][0:1]amerge=inputs=2,pan=3.0|c0=c0|c1=c1|c2=c2[aout]", descriptor)
+}
+
+func TestChannelMapValidate(t *testing.T) {
+	probe := channelMapProbe(videoStream, surroundStream, discrete16Stream)
+	for _, tc := range []struct {
+		name string
+		m    *ChannelMap
+	}{
+		{"invalid layout", NewChannelMap("foo").AddChannel(ChannelSource{StreamIndex: 1, Channel: "FL"})},
+		{"channel count", NewChannelMap("stereo").AddChannel(ChannelSource{StreamIndex: 1, Channel: "FL"})},
+		{"no source", NewChannelMap("mono").AddChannel()},
+		{"missing stream", NewChannelMap("mono").AddChannel(ChannelSource{StreamIndex: 5, Channel: "c0"})},
+		{"video stream", NewChannelMap("mono").AddChannel(ChannelSource{StreamIndex: 0, Channel: "c0"})},
+		{"channel not in layout", NewChannelMap("mono").AddChannel(ChannelSource{StreamIndex: 1, Channel: "BL"})},
+		{"channel out of range", NewChannelMap("mono").AddChannel(ChannelSource{StreamIndex: 2, Channel: "c16"})},
+		{"name on discrete layout", NewChannelMap("mono").AddChannel(ChannelSource{StreamIndex: 2, Channel: "FL"})},
+	} {
+		require.Error(t, tc.m.Validate(probe), tc.name)
+	}
+	require.Error(t, NewChannelMap("mono").Validate(nil))
+	require.NoError(t, NewChannelMap("mono").AddChannel(ChannelSource{StreamIndex: 1, Channel: "LFE"}).Validate(probe))
+}
+
+func TestChannelMapJSON(t *testing.T) {
+	m := NewChannelMap("stereo").
+		AddChannel(ChannelSource{StreamIndex: 1, Channel: "c6", Gain: 0.5}).
+		AddChannel(ChannelSource{StreamIndex: 1, Channel: "c7"})
+	bytes, err := json.Marshal(&XcParams{ChannelMap: m})
+	require.NoError(t, err)
+
+	var params XcParams
+	require.NoError(t, json.Unmarshal(bytes, &params))
+	require.Equal(t, m, params.ChannelMap)
+}
@@ -0,0 +1,395 @@
+/*
+ * Edit decision list (EDL) transcoding: trims a list of source ranges, fills the gaps
+ * with black video and silence, and concatenates the result in one output. The ranges
+ * can also be copied without transcoding if they start and end on key frames.
+ */
+package avpipe
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// EdlEntry is one event of an edit decision list. It is either the range [In, Out) of
+// the source Url, or a gap of Gap seconds of black video and silence if Url is empty.
+type EdlEntry struct {
+	Url string  `json:"url,omitempty"`
+	In  float64 `json:"in,omitempty"`  // In-point in seconds from the start of the source
+	Out float64 `json:"out,omitempty"` // Out-point in seconds from the start of the source (exclusive)
+	Gap float64 `json:"gap,omitempty"` // Duration of the gap in seconds
+}
+
+// Edl is an ordered list of source ranges and gaps. If StreamCopy is set, the packets of
+// the ranges are copied instead of transcoded: the in and out points must be on video key
+// frames (or the end of the source), the EDL can't have gaps, and all the sources must have
+// the same video codec, size and frame rate, and aac audio.
+type Edl struct {
+	Entries    []EdlEntry `json:"entries"`
+	StreamCopy bool       `json:"stream_copy,omitempty"`
+}
+
+// Validate checks that the EDL has at least one source range and that the in/out points
+// and gap durations are valid.
+func (e *Edl) Validate() error {
+	hasRange := false
+	for i, en := range e.Entries {
+		if en.Url == "" {
+			if e.StreamCopy {
+				return fmt.Errorf("edl entry %d: gap=%v can't be copied", i, en.Gap)
+			}
+			if en.Gap <= 0 || en.In != 0 || en.Out != 0 {
+				return fmt.Errorf("edl entry %d: invalid gap=%v in=%v out=%v", i, en.Gap, en.In, en.Out)
+			}
+			continue
+		}
+		if en.Gap != 0 || en.In < 0 || en.Out <= en.In {
+			return fmt.Errorf("edl entry %d: invalid range in=%v out=%v gap=%v, url=%s", i, en.In, en.Out, en.Gap, en.Url)
+		}
+		hasRange = true
+	}
+
+	if !hasRange {
+		return fmt.Errorf("edl has no source range")
+	}
+	return nil
+}
+
+// Duration returns the duration of the EDL output in seconds.
+func (e *Edl) Duration() float64 {
+	d := 0.0
+	for _, en := range e.Entries {
+		d += en.duration()
+	}
+	return d
+}
+
+func (en *EdlEntry) duration() float64 {
+	if en.Url == "" {
+		return en.Gap
+	}
+	return en.Out - en.In
+}
+
+// source returns the source range used to make entry i. A gap is made by blanking the
+// frames of the previous source range (or the next one if the EDL starts with a gap).
+func (e *Edl) source(i int) (url string, in, out float64) {
+	en := e.Entries[i]
+	if en.Url != "" {
+		return en.Url, en.In, en.Out
+	}
+
+	for j := i - 1; j >= 0; j-- {
+		if e.Entries[j].Url != "" {
+			return e.Entries[j].Url, e.Entries[j].In, e.Entries[j].In + en.Gap
+		}
+	}
+	for j := i + 1; j < len(e.Entries); j++ {
+		if e.Entries[j].Url != "" {
+			return e.Entries[j].Url, e.Entries[j].In, e.Entries[j].In + en.Gap
+		}
+	}
+	return "", 0, 0
+}
+
+// XcEdl transcodes the ranges and gaps of the EDL with frame accuracy and muxes them in
+// one "mp4" or "fmp4-segment" output (params.Format) written with muxOutputOpener to
+// params.Url. The sources are opened with inputOpener, and each EDL entry is transcoded
+// (or copied if edl.StreamCopy is set) to a video and an audio mez part in its own
+// directory under workDir.
+//
+// params holds the encoding parameters (XcVideo, XcAudio or XcAll). The output frame
+// rate, time base and size are taken from the first source range unless VideoTimeBase,
+// VideoFrameDurationTs, EncWidth and EncHeight are set. The audio is encoded with aac,
+// and all the sources must have the same audio sample rate.
+func XcEdl(params *XcParams, edl *Edl, workDir string, inputOpener InputOpener, muxOutputOpener MuxOutputOpener) error {
+	if params == nil || edl == nil {
+		log.Error("Failed EDL transcoding, params are not set")
+		return EAV_PARAM
+	}
+
+	if err := edl.Validate(); err != nil {
+		return err
+	}
+
+	xcType := params.XcType
+	if xcType == XcNone {
+		xcType = XcAll
+	}
+	if xcType != XcVideo && xcType != XcAudio && xcType != XcAll {
+		return fmt.Errorf("invalid EDL xc_type=%d, must be video, audio or all", xcType)
+	}
+	if params.Format != "mp4" && params.Format != "fmp4-segment" {
+		return fmt.Errorf("invalid EDL format=%s, must be mp4 or fmp4-segment", params.Format)
+	}
+	if len(params.AudioIndex) > 1 {
+		return fmt.Errorf("invalid EDL audio_index=%v, only one audio can be transcoded", params.AudioIndex)
+	}
+	if xcType&XcAudio != 0 && !edl.StreamCopy && params.Ecodec2 != "" && params.Ecodec2 != "aac" {
+		return fmt.Errorf("invalid EDL audio encoder=%s, must be aac", params.Ecodec2)
+	}
+
+	probes := map[string]*ProbeInfo{}
+	for _, en := range edl.Entries {
+		if en.Url == "" || probes[en.Url] != nil {
+			continue
+		}
+		InitUrlIOHandler(en.Url, inputOpener, nil)
+		probe, err := Probe(&XcParams{Url: en.Url, Seekable: params.Seekable})
+		if err != nil {
+			return fmt.Errorf("failed to probe EDL source %s: %w", en.Url, err)
+		}
+		probes[en.Url] = probe
+	}
+
+	edlXc := &edlXc{params: params, edl: edl, xcType: xcType, probes: probes, inputOpener: inputOpener}
+	if err := edlXc.init(); err != nil {
+		return err
+	}
+
+	spec := NewMuxSpec(MuxTypeMez)
+	var videoParts, audioParts []string
+	for i := range edl.Entries {
+		dir := filepath.Join(workDir, fmt.Sprintf("edl-%03d", i+1))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		if xcType&XcVideo != 0 {
+			part, err := edlXc.xcEntry(i, dir, XcVideo)
+			if err != nil {
+				return err
+			}
+			videoParts = append(videoParts, part)
+		}
+		if xcType&XcAudio != 0 {
+			part, err := edlXc.xcEntry(i, dir, XcAudio)
+			if err != nil {
+				return err
+			}
+			audioParts = append(audioParts, part)
+		}
+		edlXc.seconds += edl.Entries[i].duration()
+	}
+
+	if len(videoParts) > 0 {
+		spec.SetVideo(videoParts...)
+	}
+	if len(audioParts) > 0 {
+		spec.AddAudio("", audioParts...)
+	}
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	muxParams := &XcParams{
+		Url:             params.Url,
+		Format:          params.Format,
+		MuxingSpec:      spec.String(),
+		DebugFrameLevel: params.DebugFrameLevel,
+	}
+	InitUrlMuxIOHandler(params.Url, &localInputOpener{}, muxOutputOpener)
+	return Mux(muxParams)
+}
+
+// edlXc keeps the output timeline of an EDL transcoding
+type edlXc struct {
+	params      *XcParams
+	edl         *Edl
+	xcType      XcType
+	probes      map[string]*ProbeInfo
+	inputOpener InputOpener
+
+	videoTimeBase  int     // Output video time base (1/videoTimeBase)
+	frameDuration  int     // Output video frame duration in videoTimeBase
+	sampleRate     int     // Output audio sample rate
+	videoFrames    int64   // Video frames written so far
+	audioEndPts    int64   // End of the audio written so far in 1/sampleRate
+	seconds        float64 // Duration of the EDL entries transcoded so far
+	encWidth       int32
+	encHeight      int32
+	audioStreamIdx int
+}
+
+func (x *edlXc) init() error {
+	url, _, _ := x.edl.source(0)
+	probe := x.probes[url]
+
+	if x.xcType&XcVideo != 0 {
+		vs := probeStream(probe, "video", -1)
+		if vs == nil {
+			return fmt.Errorf("EDL source %s has no video", url)
+		}
+		x.videoTimeBase = x.params.VideoTimeBase
+		x.frameDuration = x.params.VideoFrameDurationTs
+		if x.videoTimeBase <= 0 || x.frameDuration <= 0 {
+			frameRate := vs.AvgFrameRate
+			if frameRate == nil || frameRate.Sign() <= 0 {
+				frameRate = vs.FrameRate
+			}
+			if frameRate == nil || frameRate.Sign() <= 0 {
+				return fmt.Errorf("EDL source %s has no video frame rate", url)
+			}
+			x.videoTimeBase, x.frameDuration = edlVideoTimeBase(frameRate)
+		}
+		x.encWidth, x.encHeight = x.params.EncWidth, x.params.EncHeight
+		if x.encWidth <= 0 || x.encHeight <= 0 || x.edl.StreamCopy {
+			x.encWidth, x.encHeight = int32(vs.Width), int32(vs.Height)
+		}
+		if x.edl.StreamCopy {
+			if err := x.checkCopiedVideo(vs); err != nil {
+				return err
+			}
+		}
+	}
+
+	if x.xcType&XcAudio != 0 {
+		x.audioStreamIdx = -1
+		if len(x.params.AudioIndex) > 0 {
+			x.audioStreamIdx = int(x.params.AudioIndex[0])
+		}
+		for _, en := range x.edl.Entries {
+			if en.Url == "" {
+				continue
+			}
+			as := probeStream(x.probes[en.Url], "audio", x.audioStreamIdx)
+			if as == nil {
+				return fmt.Errorf("EDL source %s has no audio", en.Url)
+			}
+			if x.sampleRate == 0 {
+				x.sampleRate = as.SampleRate
+			} else if as.SampleRate != x.sampleRate {
+				return fmt.Errorf("EDL source %s has sample_rate=%d, expected %d", en.Url, as.SampleRate, x.sampleRate)
+			}
+			// The copied audio parts are placed on the timeline by their number of aac frames
+			if x.edl.StreamCopy && as.CodecName != "aac" {
+				return fmt.Errorf("EDL source %s has audio codec=%s, only aac can be copied", en.Url, as.CodecName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkCopiedVideo checks that the video of all the sources can be copied in one output like the first one, vs
+func (x *edlXc) checkCopiedVideo(vs *StreamInfo) error {
+	for url, probe := range x.probes {
+		s := probeStream(probe, "video", -1)
+		if s == nil {
+			return fmt.Errorf("EDL source %s has no video", url)
+		}
+		frameRate := s.AvgFrameRate
+		if frameRate == nil || frameRate.Sign() <= 0 {
+			frameRate = s.FrameRate
+		}
+		if s.CodecName != vs.CodecName || s.Width != vs.Width || s.Height != vs.Height ||
+			frameRate == nil || frameRate.Cmp(big.NewRat(int64(x.videoTimeBase), int64(x.frameDuration))) != 0 {
+			return fmt.Errorf("EDL source %s can't be copied, codec=%s %dx%d frame_rate=%v, expected codec=%s %dx%d frame_rate=%d/%d",
+				url, s.CodecName, s.Width, s.Height, frameRate, vs.CodecName, vs.Width, vs.Height, x.videoTimeBase, x.frameDuration)
+		}
+	}
+	return nil
+}
+
+// xcEntry transcodes the video or the audio of EDL entry i into dir, and returns the path of the part.
+func (x *edlXc) xcEntry(i int, dir string, xcType XcType) (string, error) {
+	url, in, out := x.edl.source(i)
+	probe := x.probes[url]
+	if out > probe.ContainerInfo.Duration && x.edl.Entries[i].Url == "" {
+		return "", fmt.Errorf("edl entry %d: gap=%v is longer than source %s", i, x.edl.Entries[i].Gap, url)
+	}
+
+	xp := *x.params
+	xp.Url = url
+	xp.Format = "fmp4-segment"
+	xp.XcType = xcType
+	xp.StreamId = -1
+	xp.StartSegmentStr = "1"
+	xp.MuxingSpec = ""
+	xp.RebasePts = true
+	xp.BypassTranscoding = x.edl.StreamCopy
+	xp.Blank = x.edl.Entries[i].Url == ""
+	xp.StripCaptions = xp.StripCaptions || xp.Blank
+
+	opener := &dirOutputOpener{dir: dir}
+	if xcType == XcVideo {
+		vs := probeStream(probe, "video", -1)
+		if vs == nil {
+			return "", fmt.Errorf("EDL source %s has no video", url)
+		}
+		xp.StartTimeTs = secondsToTs(in, vs.TimeBase)
+		xp.DurationTs = secondsToTs(out-in, vs.TimeBase)
+		xp.VideoTimeBase = x.videoTimeBase
+		xp.VideoFrameDurationTs = x.frameDuration
+		xp.StartPts = x.videoFrames * int64(x.frameDuration)
+		xp.EncWidth, xp.EncHeight = x.encWidth, x.encHeight
+		// Keep each range in one segment, one second longer than the range in the output time base
+		xp.VideoSegDurationTs = int64(math.Ceil((out - in + 1) * float64(x.videoTimeBase)))
+	} else {
+		as := probeStream(probe, "audio", x.audioStreamIdx)
+		if as == nil {
+			return "", fmt.Errorf("EDL source %s has no audio", url)
+		}
+		xp.StartTimeTs = secondsToTs(in, as.TimeBase)
+		xp.DurationTs = secondsToTs(out-in, as.TimeBase)
+		xp.Ecodec2 = "aac"
+		if xp.ChannelLayout == 0 && !x.edl.StreamCopy {
+			xp.ChannelLayout = ChannelLayout("stereo")
+		}
+		// Follow the video timeline, without overlapping the previous audio part
+		seconds := x.seconds
+		if x.xcType&XcVideo != 0 {
+			seconds = float64(x.videoFrames) * float64(x.frameDuration) / float64(x.videoTimeBase)
+		}
+		xp.StartPts = int64(math.Round(seconds * float64(x.sampleRate)))
+		if xp.StartPts < x.audioEndPts {
+			xp.StartPts = x.audioEndPts
+		}
+		// The output time base of the audio is the sample rate
+		xp.AudioSegDurationTs = int64(math.Ceil((out - in + 1) * float64(x.sampleRate)))
+	}
+
+	log.Info("XcEdl", "entry", i, "url", url, "in", in, "out", out, "blank", xp.Blank,
+		"xc_type", xcType, "start_time_ts", xp.StartTimeTs, "duration_ts", xp.DurationTs, "start_pts", xp.StartPts)
+
+	InitUrlIOHandler(url, x.inputOpener, opener)
+	if err := Xc(&xp); err != nil {
+		return "", fmt.Errorf("edl entry %d: failed to transcode %s: %w", i, url, err)
+	}
+	if opener.err != nil {
+		return "", fmt.Errorf("edl entry %d: %w", i, opener.err)
+	}
+	if opener.path == "" || opener.frames == 0 {
+		return "", fmt.Errorf("edl entry %d: no frames in range in=%v out=%v, url=%s", i, in, out, url)
+	}
+
+	// The copy stops at the first packet past the out point, the frames after it in decoding order are lost
+	// if the out point is not on a key frame
+	if xcType == XcVideo && x.edl.StreamCopy {
+		frames := int64(math.Round((out - in) * float64(x.videoTimeBase) / float64(x.frameDuration)))
+		if out < probe.ContainerInfo.Duration && opener.frames != frames {
+			return "", fmt.Errorf("edl entry %d: copied %d frames instead of %d, out=%v is not on a key frame, url=%s",
+				i, opener.frames, frames, out, url)
+		}
+	}
+
+	if xcType == XcVideo {
+		x.videoFrames += opener.frames
+	} else {
+		// aac frames have 1024 samples
+		x.audioEndPts = xp.StartPts + opener.frames*1024
+	}
+
+	return opener.path, nil
+}
+
+// edlVideoTimeBase returns a time base and a frame duration that represent frameRate exactly,
+// with a time base of at least 10000.
+func edlVideoTimeBase(frameRate *big.Rat) (timeBase, frameDuration int) {
+	num := frameRate.Num().Int64()
+	den := frameRate.Denom().Int64()
+	m := (10000 + num - 1) / num
+	return int(num * m), int(den * m)
+}
@@ -0,0 +1,70 @@
+package avpipe
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEdlValidate(t *testing.T) {
+	edl := &Edl{}
+	require.NoError(t, json.Unmarshal([]byte(`{"entries":[
+		{"gap":1.5},
+		{"url":"a.mp4","in":10,"out":12.5},
+		{"gap":0.5},
+		{"url":"b.mp4","out":4}]}`), edl))
+	require.NoError(t, edl.Validate())
+	require.Equal(t, 8.5, edl.Duration())
+
+	url, in, out := edl.source(0)
+	require.Equal(t, "a.mp4", url)
+	require.Equal(t, 10.0, in)
+	require.Equal(t, 11.5, out)
+
+	url, in, out = edl.source(2)
+	require.Equal(t, "a.mp4", url)
+	require.Equal(t, 10.0, in)
+	require.Equal(t, 10.5, out)
+
+	url, in, out = edl.source(3)
+	require.Equal(t, "b.mp4", url)
+	require.Equal(t, 0.0, in)
+	require.Equal(t, 4.0, out)
+
+	for _, entries := range [][]EdlEntry{
+		nil,
+		{{Gap: 1}},
+		{{Url: "a.mp4", In: 2, Out: 1}},
+		{{Url: "a.mp4", In: -1, Out: 1}},
+		{{Url: "a.mp4", Out: 1, Gap: 1}},
+		{{Url: "a.mp4", Out: 1}, {Gap: 0}},
+		{{Url: "a.mp4", Out: 1}, {Gap: 1, Out: 2}},
+	} {
+		require.Error(t, (&Edl{Entries: entries}).Validate(), entries)
+	}
+
+	// The gaps are rendered, they can't be copied
+	edl.StreamCopy = true
+	require.Error(t, edl.Validate())
+	require.NoError(t, (&Edl{Entries: []EdlEntry{{Url: "a.mp4", Out: 1}, {Url: "b.mp4", In: 2, Out: 4}}, StreamCopy: true}).Validate())
+}
+
+func TestEdlTimeBase(t *testing.T) {
+	for _, tc := range []struct {
+		frameRate     *big.Rat
+		timeBase      int
+		frameDuration int
+	}{
+		{big.NewRat(24000, 1001), 24000, 1001},
+		{big.NewRat(30000, 1001), 30000, 1001},
+		{big.NewRat(25, 1), 10000, 400},
+		{big.NewRat(60, 1), 10020, 167},
+		{big.NewRat(50, 1), 10000, 200},
+	} {
+		timeBase, frameDuration := edlVideoTimeBase(tc.frameRate)
+		require.Equal(t, tc.timeBase, timeBase, tc.frameRate)
+		require.Equal(t, tc.frameDuration, frameDuration, tc.frameRate)
+	}
+}
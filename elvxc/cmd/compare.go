@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/eluv-io/avpipe"
+	"github.com/spf13/cobra"
+)
+
+func InitCompare(cmdRoot *cobra.Command) error {
+	cmdCompare := &cobra.Command{
+		Use:   "compare",
+		Short: "Compare a distorted video to its reference",
+		Long:  "Compute the per frame and aggregate PSNR, SSIM and VMAF of a distorted video (an ABR rendition) compared to its reference (the mez), and print the JSON report",
+		RunE:  doCompare,
+	}
+
+	cmdRoot.AddCommand(cmdCompare)
+
+	cmdCompare.PersistentFlags().StringP("reference", "r", "", "(mandatory) reference filename.")
+	cmdCompare.PersistentFlags().StringP("distorted", "d", "", "(mandatory) distorted filename.")
+	cmdCompare.PersistentFlags().StringP("output", "o", "", "(optional) report filename, the report is printed if not set.")
+	cmdCompare.PersistentFlags().Int32("width", 0, "(optional) width of the comparison, default is the reference width.")
+	cmdCompare.PersistentFlags().Int32("height", 0, "(optional) height of the comparison, default is the reference height.")
+	cmdCompare.PersistentFlags().Float64("offset", 0, "(optional) seconds added to the distorted timestamps to align it on the reference.")
+	cmdCompare.PersistentFlags().Bool("vmaf", false, "(optional) compute VMAF, needs FFmpeg built with libvmaf.")
+	cmdCompare.PersistentFlags().String("vmaf-model", "", "(optional) path of the VMAF model, default is the libvmaf model.")
+	cmdCompare.PersistentFlags().Float64("seg-duration", 2, "(optional) duration of the worst segments in seconds.")
+	cmdCompare.PersistentFlags().Int32("n-worst", 5, "(optional) number of worst segments in the report.")
+	cmdCompare.PersistentFlags().BoolP("seekable", "", false, "(optional) seekable stream")
+	cmdCompare.PersistentFlags().Bool("frames", true, "(optional) include the per frame scores in the report.")
+	cmdCompare.PersistentFlags().Float64("min-psnr", 0, "(optional) fail if the mean PSNR is below this value.")
+	cmdCompare.PersistentFlags().Float64("min-ssim", 0, "(optional) fail if the mean SSIM is below this value.")
+	cmdCompare.PersistentFlags().Float64("min-vmaf", 0, "(optional) fail if the mean VMAF is below this value.")
+
+	return nil
+}
+
+func doCompare(cmd *cobra.Command, args []string) error {
+
+	reference := cmd.Flag("reference").Value.String()
+	if len(reference) == 0 {
+		return fmt.Errorf("Reference filename is needed after -r")
+	}
+
+	distorted := cmd.Flag("distorted").Value.String()
+	if len(distorted) == 0 {
+		return fmt.Errorf("Distorted filename is needed after -d")
+	}
+
+	width, err := cmd.Flags().GetInt32("width")
+	if err != nil {
+		return fmt.Errorf("Invalid width flag")
+	}
+
+	height, err := cmd.Flags().GetInt32("height")
+	if err != nil {
+		return fmt.Errorf("Invalid height flag")
+	}
+
+	offset, err := cmd.Flags().GetFloat64("offset")
+	if err != nil {
+		return fmt.Errorf("Invalid offset flag")
+	}
+
+	vmaf, err := cmd.Flags().GetBool("vmaf")
+	if err != nil {
+		return fmt.Errorf("Invalid vmaf flag")
+	}
+
+	segDuration, err := cmd.Flags().GetFloat64("seg-duration")
+	if err != nil {
+		return fmt.Errorf("Invalid seg-duration flag")
+	}
+
+	nWorst, err := cmd.Flags().GetInt32("n-worst")
+	if err != nil {
+		return fmt.Errorf("Invalid n-worst flag")
+	}
+
+	seekable, err := cmd.Flags().GetBool("seekable")
+	if err != nil {
+		return fmt.Errorf("Invalid seekable flag")
+	}
+
+	frames, err := cmd.Flags().GetBool("frames")
+	if err != nil {
+		return fmt.Errorf("Invalid frames flag")
+	}
+
+	params := &avpipe.CompareParams{
+		ReferenceUrl: reference,
+		DistortedUrl: distorted,
+		Width:        width,
+		Height:       height,
+		Offset:       offset,
+		Vmaf:         vmaf,
+		VmafModel:    cmd.Flag("vmaf-model").Value.String(),
+		SegDuration:  segDuration,
+		NWorst:       nWorst,
+		Seekable:     seekable,
+	}
+
+	avpipe.InitIOHandler(&elvxcInputOpener{}, &elvxcOutputOpener{dir: ""})
+
+	report, err := avpipe.Compare(params)
+	if err != nil {
+		return fmt.Errorf("Comparing failed. reference=%s, distorted=%s", reference, distorted)
+	}
+
+	if !frames {
+		report.Frames = nil
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	output := cmd.Flag("output").Value.String()
+	if len(output) > 0 {
+		if err = os.WriteFile(output, buf, 0644); err != nil {
+			return fmt.Errorf("Could not write report %s", output)
+		}
+	} else {
+		fmt.Println(string(buf))
+	}
+
+	return checkCompareReport(cmd, report)
+}
+
+// checkCompareReport fails if a mean score of the report is below its --min-* flag, for regression gates.
+func checkCompareReport(cmd *cobra.Command, report *avpipe.CompareReport) error {
+	metrics := []struct {
+		flag  string
+		name  string
+		stats *avpipe.MetricStats
+	}{
+		{"min-psnr", "psnr", report.Psnr},
+		{"min-ssim", "ssim", report.Ssim},
+		{"min-vmaf", "vmaf", report.Vmaf},
+	}
+
+	for _, m := range metrics {
+		min, err := cmd.Flags().GetFloat64(m.flag)
+		if err != nil {
+			return fmt.Errorf("Invalid %s flag", m.flag)
+		}
+		if min <= 0 {
+			continue
+		}
+		if m.stats == nil {
+			return fmt.Errorf("No %s score to check against %s", m.name, m.flag)
+		}
+		if m.stats.Mean < min {
+			return fmt.Errorf("Mean %s %.4f is below %.4f", m.name, m.stats.Mean, min)
+		}
+	}
+
+	return nil
+}
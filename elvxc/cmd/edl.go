@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eluv-io/avpipe"
+	"github.com/spf13/cobra"
+)
+
+func InitEdl(cmdRoot *cobra.Command) error {
+	cmdEdl := &cobra.Command{
+		Use:   "edl",
+		Short: "Render an edit decision list",
+		Long:  "Trim and concatenate the source ranges of an edit decision list (JSON), fill its gaps with black and silence, and produce one output file",
+		RunE:  doEdl,
+	}
+
+	cmdRoot.AddCommand(cmdEdl)
+
+	cmdEdl.PersistentFlags().StringP("filename", "f", "", "(mandatory) output filename.")
+	cmdEdl.PersistentFlags().String("edl", "", "(mandatory) EDL file, for example {\"entries\":[{\"url\":\"a.mp4\",\"in\":10,\"out\":20},{\"gap\":2}]}.")
+	cmdEdl.PersistentFlags().String("format", "mp4", "package format, can be 'mp4' or 'fmp4-segment'.")
+	cmdEdl.PersistentFlags().String("xc-type", "all", "transcoding type, can be 'video', 'audio' or 'all'.")
+	cmdEdl.PersistentFlags().String("work-dir", "", "directory of the intermediate parts, default is the directory of the output.")
+	cmdEdl.PersistentFlags().StringP("encoder", "e", "libx264", "encoder codec, default is 'libx264', can be: 'libx264', 'libx265', 'h264_nvenc', 'h264_videotoolbox'.")
+	cmdEdl.PersistentFlags().Int32("video-bitrate", -1, "output video bitrate, mutually exclusive with crf.")
+	cmdEdl.PersistentFlags().String("crf", "23", "mutually exclusive with video-bitrate.")
+	cmdEdl.PersistentFlags().String("preset", "medium", "Preset string to determine compression speed, can be: 'ultrafast', 'superfast', 'veryfast', 'faster', 'fast', 'medium', 'slow', 'slower', 'veryslow'")
+	cmdEdl.PersistentFlags().Int32("audio-bitrate", 128000, "output audio bitrate.")
+	cmdEdl.PersistentFlags().Int32("enc-height", -1, "default -1 means use the height of the first source.")
+	cmdEdl.PersistentFlags().Int32("enc-width", -1, "default -1 means use the width of the first source.")
+	cmdEdl.PersistentFlags().Int32("force-keyint", 0, "force IDR key frame in this interval.")
+	cmdEdl.PersistentFlags().Bool("stream-copy", false, "copy the source ranges without transcoding, the in/out points must be on key frames.")
+
+	return nil
+}
+
+func doEdl(cmd *cobra.Command, args []string) error {
+
+	filename := cmd.Flag("filename").Value.String()
+	if len(filename) == 0 {
+		return fmt.Errorf("Filename is needed after -f")
+	}
+
+	edlFile := cmd.Flag("edl").Value.String()
+	if len(edlFile) == 0 {
+		return fmt.Errorf("edl is needed to render an EDL")
+	}
+
+	buf, err := os.ReadFile(edlFile)
+	if err != nil {
+		return fmt.Errorf("Could not read edl file %s", edlFile)
+	}
+	edl := &avpipe.Edl{}
+	if err = json.Unmarshal(buf, edl); err != nil {
+		return fmt.Errorf("Invalid edl file %s: %v", edlFile, err)
+	}
+
+	xcType := avpipe.XcTypeFromString(cmd.Flag("xc-type").Value.String())
+	if xcType != avpipe.XcVideo && xcType != avpipe.XcAudio && xcType != avpipe.XcAll {
+		return fmt.Errorf("Transcoding type is not valid, can be 'video', 'audio' or 'all'")
+	}
+
+	workDir := cmd.Flag("work-dir").Value.String()
+	if len(workDir) == 0 {
+		workDir = filepath.Dir(filename)
+	}
+
+	videoBitrate, err := cmd.Flags().GetInt32("video-bitrate")
+	if err != nil {
+		return fmt.Errorf("Invalid video-bitrate value")
+	}
+
+	audioBitrate, err := cmd.Flags().GetInt32("audio-bitrate")
+	if err != nil {
+		return fmt.Errorf("Invalid audio-bitrate value")
+	}
+
+	encHeight, err := cmd.Flags().GetInt32("enc-height")
+	if err != nil {
+		return fmt.Errorf("Invalid enc-height value")
+	}
+
+	encWidth, err := cmd.Flags().GetInt32("enc-width")
+	if err != nil {
+		return fmt.Errorf("Invalid enc-width value")
+	}
+
+	forceKeyInt, err := cmd.Flags().GetInt32("force-keyint")
+	if err != nil {
+		return fmt.Errorf("Invalid force-keyint value")
+	}
+
+	streamCopy, err := cmd.Flags().GetBool("stream-copy")
+	if err != nil {
+		return fmt.Errorf("Invalid stream-copy flag")
+	}
+	if streamCopy {
+		edl.StreamCopy = true
+	}
+
+	params := avpipe.NewXcParams()
+	params.Url = filename
+	params.Format = cmd.Flag("format").Value.String()
+	params.XcType = xcType
+	params.Ecodec = cmd.Flag("encoder").Value.String()
+	params.VideoBitrate = videoBitrate
+	params.AudioBitrate = audioBitrate
+	params.CrfStr = cmd.Flag("crf").Value.String()
+	params.Preset = cmd.Flag("preset").Value.String()
+	params.EncHeight = encHeight
+	params.EncWidth = encWidth
+	params.ForceKeyInt = forceKeyInt
+
+	return avpipe.XcEdl(params, edl, workDir, &elvxcInputOpener{}, &AVCmdMuxOutputOpener{Dir: filepath.Dir(filename)})
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/eluv-io/avpipe"
+	"github.com/spf13/cobra"
+)
+
+func InitLadder(cmdRoot *cobra.Command) error {
+	cmdLadder := &cobra.Command{
+		Use:   "ladder",
+		Short: "Recommend a per-title CRF and bitrate ladder",
+		Long:  "Encode sampled segments of a title at several resolutions and CRFs, and print the recommended CRF and bitrate ladder (JSON)",
+		RunE:  doLadder,
+	}
+
+	cmdRoot.AddCommand(cmdLadder)
+
+	cmdLadder.PersistentFlags().StringP("filename", "f", "", "(mandatory) filename to be analyzed.")
+	cmdLadder.PersistentFlags().StringP("output", "o", "", "(optional) report filename, the report is printed if not set.")
+	cmdLadder.PersistentFlags().String("work-dir", "", "(mandatory) directory of the sampled encodes.")
+	cmdLadder.PersistentFlags().StringP("encoder", "e", "libx264", "encoder codec, default is 'libx264', can be: 'libx264', 'libx265', 'h264_nvenc', 'h264_videotoolbox'.")
+	cmdLadder.PersistentFlags().String("preset", "medium", "Preset string to determine compression speed, can be: 'ultrafast', 'superfast', 'veryfast', 'faster', 'fast', 'medium', 'slow', 'slower', 'veryslow'")
+	cmdLadder.PersistentFlags().Int("samples", 0, "(optional) number of sampled segments, default is 3.")
+	cmdLadder.PersistentFlags().Float64("sample-duration", 0, "(optional) duration of a sampled segment in seconds, default is 4.")
+	cmdLadder.PersistentFlags().IntSlice("crfs", nil, "(optional) CRFs encoded at each resolution, default is 18,23,28,33.")
+	cmdLadder.PersistentFlags().IntSlice("heights", nil, "(optional) heights of the rungs, default is 1080,720,540,360,270.")
+	cmdLadder.PersistentFlags().Float64("target-vmaf", 0, "(optional) VMAF of the top rung, default is 93.")
+	cmdLadder.PersistentFlags().Float64("target-psnr", 0, "(optional) PSNR of the top rung when VMAF is not available, default is 42.")
+	cmdLadder.PersistentFlags().BoolP("seekable", "", false, "(optional) seekable stream")
+
+	return nil
+}
+
+func doLadder(cmd *cobra.Command, args []string) error {
+
+	filename := cmd.Flag("filename").Value.String()
+	if len(filename) == 0 {
+		return fmt.Errorf("Filename is needed after -f")
+	}
+
+	workDir := cmd.Flag("work-dir").Value.String()
+	if len(workDir) == 0 {
+		return fmt.Errorf("work-dir is needed for the sampled encodes")
+	}
+
+	samples, err := cmd.Flags().GetInt("samples")
+	if err != nil {
+		return fmt.Errorf("Invalid samples flag")
+	}
+
+	sampleDuration, err := cmd.Flags().GetFloat64("sample-duration")
+	if err != nil {
+		return fmt.Errorf("Invalid sample-duration flag")
+	}
+
+	crfs, err := cmd.Flags().GetIntSlice("crfs")
+	if err != nil {
+		return fmt.Errorf("Invalid crfs flag")
+	}
+
+	heights, err := cmd.Flags().GetIntSlice("heights")
+	if err != nil {
+		return fmt.Errorf("Invalid heights flag")
+	}
+
+	targetVmaf, err := cmd.Flags().GetFloat64("target-vmaf")
+	if err != nil {
+		return fmt.Errorf("Invalid target-vmaf flag")
+	}
+
+	targetPsnr, err := cmd.Flags().GetFloat64("target-psnr")
+	if err != nil {
+		return fmt.Errorf("Invalid target-psnr flag")
+	}
+
+	seekable, err := cmd.Flags().GetBool("seekable")
+	if err != nil {
+		return fmt.Errorf("Invalid seekable flag")
+	}
+
+	params := avpipe.NewXcParams()
+	params.Url = filename
+	params.Ecodec = cmd.Flag("encoder").Value.String()
+	params.Preset = cmd.Flag("preset").Value.String()
+	params.Seekable = seekable
+
+	lp := &avpipe.LadderParams{
+		Samples:        samples,
+		SampleDuration: sampleDuration,
+		Crfs:           crfs,
+		Heights:        heights,
+		TargetVmaf:     targetVmaf,
+		TargetPsnr:     targetPsnr,
+	}
+
+	report, err := avpipe.AnalyzeLadder(params, lp, workDir, &elvxcInputOpener{})
+	if err != nil {
+		return fmt.Errorf("Ladder analysis failed. file=%s, err=%v", filename, err)
+	}
+
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	output := cmd.Flag("output").Value.String()
+	if len(output) > 0 {
+		if err = os.WriteFile(output, buf, 0644); err != nil {
+			return fmt.Errorf("Could not write report %s", output)
+		}
+	} else {
+		fmt.Println(string(buf))
+	}
+
+	return nil
+}
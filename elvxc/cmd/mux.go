@@ -2,6 +2,7 @@ package cmd
 
 import "C"
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/eluv-io/avpipe"
 	"github.com/spf13/cobra"
@@ -9,6 +10,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type AVCmdMuxInputOpener struct {
@@ -119,13 +122,16 @@ func (muxInput *elvxcMuxInput) Stat(streamIndex int, statType avpipe.AVStatType,
 
 // Implement AVPipeOutputOpener
 type AVCmdMuxOutputOpener struct {
+	Dir string // Directory of the subtitle outputs of a dash/hls muxing
 }
 
 func (outputOpener *AVCmdMuxOutputOpener) Open(filename string, fd int64, outType avpipe.AVType) (avpipe.OutputHandler, error) {
 
-	if outType != avpipe.MP4Segment &&
-		outType != avpipe.FMP4AudioSegment &&
-		outType != avpipe.FMP4VideoSegment {
+	switch outType {
+	case avpipe.MP4Segment, avpipe.FMP4AudioSegment, avpipe.FMP4VideoSegment:
+	case avpipe.SubtitleInitSegment, avpipe.SubtitleSegment, avpipe.SubtitleManifest:
+		filename = filepath.Join(outputOpener.Dir, filename)
+	default:
 		return nil, fmt.Errorf("Invalid outType=%d", outType)
 	}
 
@@ -217,16 +223,30 @@ func doMux(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("Could not read mux-spec file %s", muxSpecFile)
 	}
-	log.Debug("doMux", "mux_spec", string(muxSpec))
+
+	// The mux spec can be either in JSON or in the legacy text format
+	spec := &avpipe.MuxSpec{}
+	if strings.HasPrefix(strings.TrimSpace(string(muxSpec)), "{") {
+		err = json.Unmarshal(muxSpec, spec)
+	} else {
+		spec, err = avpipe.ParseMuxSpec(string(muxSpec))
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid mux-spec file %s: %v", muxSpecFile, err)
+	}
+	if err = spec.Validate(); err != nil {
+		return fmt.Errorf("Invalid mux-spec file %s: %v", muxSpecFile, err)
+	}
+	log.Debug("doMux", "mux_spec", spec.String())
 
 	params := &avpipe.XcParams{
-		MuxingSpec:      string(muxSpec),
+		MuxingSpec:      spec.String(),
 		Url:             filename,
 		DebugFrameLevel: true,
 		Format:          format,
 	}
 
-	avpipe.InitUrlMuxIOHandler(filename, &AVCmdMuxInputOpener{URL: filename}, &AVCmdMuxOutputOpener{})
+	avpipe.InitUrlMuxIOHandler(filename, &AVCmdMuxInputOpener{URL: filename}, &AVCmdMuxOutputOpener{Dir: filepath.Dir(filename)})
 
 	return avpipe.Mux(params)
 }
@@ -20,6 +20,7 @@ func Probe(cmdRoot *cobra.Command) error {
 	cmdProbe.PersistentFlags().StringP("filename", "f", "", "(mandatory) filename to be probed")
 	cmdProbe.PersistentFlags().BoolP("seekable", "", false, "(optional) seekable stream")
 	cmdProbe.PersistentFlags().BoolP("listen", "", false, "listen mode for RTMP.")
+	cmdProbe.PersistentFlags().Bool("cadence", false, "(optional) decode the first frames of the video to find its cadence")
 	cmdProbe.PersistentFlags().Int32("connection-timeout", 0, "connection timeout for RTMP when listening on a port or MPEGTS to receive first UDP datagram.")
 
 	return nil
@@ -47,11 +48,17 @@ func doProbe(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Invalid listen flag")
 	}
 
+	cadence, err := cmd.Flags().GetBool("cadence")
+	if err != nil {
+		return fmt.Errorf("Invalid cadence flag")
+	}
+
 	params := &avpipe.XcParams{
 		Url:               filename,
 		Seekable:          seekable,
 		Listen:            listen,
 		ConnectionTimeout: int(connectionTimeout),
+		ProbeCadence:      cadence,
 	}
 
 	avpipe.InitIOHandler(&elvxcInputOpener{url: filename}, &elvxcOutputOpener{dir: ""})
@@ -72,6 +79,9 @@ func doProbe(cmd *cobra.Command, args []string) error {
 		fmt.Printf("\tcodec_type: %s\n", info.CodecType)
 		fmt.Printf("\tcodec_id: %d\n", info.CodecID)
 		fmt.Printf("\tcodec_name: %s\n", info.CodecName)
+		if len(info.CodecString) > 0 {
+			fmt.Printf("\tcodec_string: %s\n", info.CodecString)
+		}
 		fmt.Printf("\tprofile: %s\n", avpipe.GetProfileName(info.CodecID, info.Profile))
 		fmt.Printf("\tlevel: %d\n", info.Level)
 		if uint64(info.DurationTs) != avpipe.AvNoPtsValue {
@@ -98,6 +108,9 @@ func doProbe(cmd *cobra.Command, args []string) error {
 		fmt.Printf("\tsample_aspect_ratio: %d:%d\n", info.SampleAspectRatio.Num(), info.SampleAspectRatio.Denom())
 		fmt.Printf("\tdisplay_aspect_ratio: %d:%d\n", info.DisplayAspectRatio.Num(), info.DisplayAspectRatio.Denom())
 		fmt.Printf("\tfield_order: %s\n", info.FieldOrder)
+		if len(info.Cadence) > 0 {
+			fmt.Printf("\tcadence: %s\n", info.Cadence)
+		}
 		/* TODO: Make this a switch based on different SideData */
 		if info.SideData != nil && len(info.SideData) > 0 {
 			displayMatrix, ok := info.SideData[0].(avpipe.SideDataDisplayMatrix)
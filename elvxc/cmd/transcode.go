@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -64,6 +65,21 @@ func (i *noopElvxcInput) Stat(streamIndex int, statType avpipe.AVStatType, statA
 		log.Info("AVCMD InputHandler.Stat", "video start PTS", *startPTS, "streamIndex", streamIndex)
 	case avpipe.AV_IN_STAT_DATA_SCTE35:
 		log.Info("AVCMD InputHandler.Stat", "scte35", statArgs, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_RTP:
+		rtpStats := statArgs.(*avpipe.RtpStats)
+		log.Info("AVCMD InputHandler.Stat", "rtp", *rtpStats)
+	case avpipe.AV_IN_STAT_TIMED_METADATA:
+		md := statArgs.(*avpipe.TimedMetadata)
+		log.Info("AVCMD InputHandler.Stat", "timed metadata type", md.Type, "pts", md.PTS, "size", len(md.Data), "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_LOUDNESS:
+		loudness := statArgs.(*avpipe.LoudnessStats)
+		log.Info("AVCMD InputHandler.Stat", "loudness", *loudness, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_QC:
+		interval := statArgs.(*avpipe.QcInterval)
+		log.Info("AVCMD InputHandler.Stat", "qc", *interval, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_SCENE:
+		sceneCut := statArgs.(*avpipe.SceneCut)
+		log.Info("AVCMD InputHandler.Stat", "scene_cut", *sceneCut, "streamIndex", streamIndex)
 	}
 
 	return nil
@@ -131,6 +147,21 @@ func (i *elvxcInput) Stat(streamIndex int, statType avpipe.AVStatType, statArgs
 		log.Info("AVCMD InputHandler.Stat", "video start PTS", *startPTS, "streamIndex", streamIndex)
 	case avpipe.AV_IN_STAT_DATA_SCTE35:
 		log.Info("AVCMD InputHandler.Stat", "scte35", statArgs, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_RTP:
+		rtpStats := statArgs.(*avpipe.RtpStats)
+		log.Info("AVCMD InputHandler.Stat", "rtp", *rtpStats)
+	case avpipe.AV_IN_STAT_TIMED_METADATA:
+		md := statArgs.(*avpipe.TimedMetadata)
+		log.Info("AVCMD InputHandler.Stat", "timed metadata type", md.Type, "pts", md.PTS, "size", len(md.Data), "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_LOUDNESS:
+		loudness := statArgs.(*avpipe.LoudnessStats)
+		log.Info("AVCMD InputHandler.Stat", "loudness", *loudness, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_QC:
+		interval := statArgs.(*avpipe.QcInterval)
+		log.Info("AVCMD InputHandler.Stat", "qc", *interval, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_SCENE:
+		sceneCut := statArgs.(*avpipe.SceneCut)
+		log.Info("AVCMD InputHandler.Stat", "scene_cut", *sceneCut, "streamIndex", streamIndex)
 	}
 
 	return nil
@@ -138,7 +169,16 @@ func (i *elvxcInput) Stat(streamIndex int, statType avpipe.AVStatType, statArgs
 
 // elvxcOutputOpener implements avpipe.OutputOpener
 type elvxcOutputOpener struct {
-	dir string
+	dir    string
+	format string
+}
+
+// manifestExt returns the extension of the manifests written by avpipe for the package format
+func (oo *elvxcOutputOpener) manifestExt() string {
+	if oo.format == "hls" {
+		return "m3u8"
+	}
+	return "mpd"
 }
 
 func (oo *elvxcOutputOpener) Open(h, fd int64, stream_index, seg_index int,
@@ -189,6 +229,16 @@ func (oo *elvxcOutputOpener) Open(h, fd int64, stream_index, seg_index int,
 		filename = fmt.Sprintf("%s/%d.jpeg", dir, pts)
 	case avpipe.MpegtsSegment:
 		filename = fmt.Sprintf("%s/ts-segment-%05d.ts", dir, seg_index)
+	case avpipe.CaptionWebVTTSegment:
+		filename = fmt.Sprintf("%s/captions-%s-%05d.vtt", dir, avpipe.CaptionTrackName(stream_index), seg_index)
+	case avpipe.CaptionTTMLSegment:
+		filename = fmt.Sprintf("%s/captions-%s-%05d.ttml", dir, avpipe.CaptionTrackName(stream_index), seg_index)
+	case avpipe.QCReport:
+		filename = fmt.Sprintf("%s/qc-report.json", dir)
+	case avpipe.ShotList:
+		filename = fmt.Sprintf("%s/shot-list.json", dir)
+	case avpipe.AudioRenditionManifest:
+		filename = fmt.Sprintf("%s/audio-renditions.%s", dir, oo.manifestExt())
 	}
 
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
@@ -251,6 +301,13 @@ func (o *elvxcOutput) Stat(streamIndex int, avType avpipe.AVType, statType avpip
 	case avpipe.AV_OUT_STAT_FRAME_WRITTEN:
 		encodingStats := statArgs.(*avpipe.EncodingFrameStats)
 		doLog("encodingStats", encodingStats)
+	case avpipe.AV_OUT_STAT_SPLICE_POINT:
+		splicePoint := statArgs.(*avpipe.SplicePointStats)
+		doLog("splicePoint", splicePoint)
+	case avpipe.AV_OUT_STAT_EMSG:
+		emsg := statArgs.(*avpipe.EmsgStats)
+		doLog("scheme", emsg.SchemeIdUri, "id", emsg.Id, "presentationTime", emsg.PresentationTime,
+			"timescale", emsg.Timescale, "segIdx", emsg.SegIndex)
 	}
 	return nil
 }
@@ -312,15 +369,16 @@ func InitTranscode(cmdRoot *cobra.Command) error {
 	cmdTranscode.PersistentFlags().StringP("channel-layout", "", "", "audio channel layout.")
 	cmdTranscode.PersistentFlags().Int32P("gpu-index", "", -1, "Use the GPU with specified index for transcoding (export CUDA_DEVICE_ORDER=PCI_BUS_ID would use smi index).")
 	cmdTranscode.PersistentFlags().Int32P("sync-audio-to-stream-id", "", -1, "sync audio to video iframe of specific stream-id when input stream is mpegts")
-	cmdTranscode.PersistentFlags().StringP("encoder", "e", "libx264", "encoder codec, default is 'libx264', can be: 'libx264', 'libx265', 'h264_nvenc', 'h264_videotoolbox', or 'mjpeg'.")
-	cmdTranscode.PersistentFlags().StringP("audio-encoder", "", "aac", "audio encoder, default is 'aac', can be: 'aac', 'ac3', 'mp2', 'mp3'.")
+	cmdTranscode.PersistentFlags().StringP("encoder", "e", "libx264", "encoder codec, default is 'libx264', can be: 'libx264', 'libx265', 'h264_nvenc', 'h264_videotoolbox', 'libsvtav1', 'libaom-av1', 'libvpx-vp9', or 'mjpeg'.")
+	cmdTranscode.PersistentFlags().StringP("audio-encoder", "", "aac", "audio encoder, default is 'aac', can be: 'aac', 'ac3', 'mp2', 'mp3', 'libopus'.")
 	cmdTranscode.PersistentFlags().StringP("decoder", "d", "", "video decoder, default is 'h264', can be: 'h264', 'h264_cuvid', 'jpeg2000', 'hevc'.")
 	cmdTranscode.PersistentFlags().StringP("audio-decoder", "", "", "audio decoder, default is '' and will be automatically chosen.")
 	cmdTranscode.PersistentFlags().StringP("format", "", "dash", "package format, can be 'dash', 'hls', 'mp4', 'fmp4', 'segment', 'fmp4-segment', or 'image2'.")
 	cmdTranscode.PersistentFlags().StringP("filter-descriptor", "", "", " Audio filter descriptor the same as ffmpeg format")
+	cmdTranscode.PersistentFlags().StringP("channel-map", "", "", "JSON file with the audio channel map, generates the audio pan/merge filter descriptor (xc-type must be 'audio').")
 	cmdTranscode.PersistentFlags().Int32P("force-keyint", "", 0, "force IDR key frame in this interval.")
 	cmdTranscode.PersistentFlags().BoolP("equal-fduration", "", false, "force equal frame duration. Must be 0 or 1 and only valid for 'fmp4-segment' format.")
-	cmdTranscode.PersistentFlags().StringP("xc-type", "", "", "transcoding type, can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', 'extract-images' or 'extract-all-images'.")
+	cmdTranscode.PersistentFlags().StringP("xc-type", "", "", "transcoding type, can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', 'extract-images', 'extract-all-images' or 'extract-captions'.")
 	cmdTranscode.PersistentFlags().Int32P("crf", "", 23, "mutually exclusive with video-bitrate.")
 	cmdTranscode.PersistentFlags().StringP("preset", "", "medium", "Preset string to determine compression speed, can be: 'ultrafast', 'superfast', 'veryfast', 'faster', 'fast', 'medium', 'slow', 'slower', 'veryslow'")
 	cmdTranscode.PersistentFlags().Int64P("start-time-ts", "", 0, "offset to start transcoding")
@@ -369,6 +427,34 @@ func InitTranscode(cmdRoot *cobra.Command) error {
 	cmdTranscode.PersistentFlags().Int32("level", 0, "Encoding level for video. If it is not determined, it will be set automatically.")
 	cmdTranscode.PersistentFlags().Int32("deinterlace", 0, "Deinterlace filter (values 0 - none, 1 - bwdif_field, 2 - bwdif_frame send_frame).")
 	cmdTranscode.PersistentFlags().Bool("copy-mpegts", false, "Create a copy of the MPEGTS input (for MPEGTS, SRT, RTP)")
+	cmdTranscode.PersistentFlags().Bool("rtp-fec", false, "Receive SMPTE 2022-1 column and row FEC on port+2 and port+4 for RTP input.")
+	cmdTranscode.PersistentFlags().Int32("rtp-jitter-buffer", 0, "RTP reorder window in packets, default 0 means auto.")
+	cmdTranscode.PersistentFlags().Int32("scte35-pid", 0, "PID of the SCTE-35 cues inserted in the copy-mpegts output, default 0 means no cue insertion.")
+	cmdTranscode.PersistentFlags().Bool("splice-segment", false, "Force an IDR frame and start a new dash/hls segment or mez part at SCTE-35 splice points.")
+	cmdTranscode.PersistentFlags().Bool("emit-emsg", false, "Write input SCTE-35 and ID3 events as emsg boxes in the video segments (dash/hls/fmp4-segment).")
+	cmdTranscode.PersistentFlags().Bool("extract-captions", false, "Write the CEA-608/708 captions as WebVTT (hls) or TTML (dash) segments.")
+	cmdTranscode.PersistentFlags().Bool("strip-captions", false, "Do not pass the A/53 captions of the input through to the encoded video.")
+	cmdTranscode.PersistentFlags().Bool("blank", false, "Replace the decoded video by black frames and the audio by silence.")
+	cmdTranscode.PersistentFlags().Bool("rebase-pts", false, "Start the output timestamps at start-pts (in the output time base) instead of following the input.")
+	cmdTranscode.PersistentFlags().Bool("smart-cut", false, "Only re-encode the GOPs at start-time-ts and the end of duration-ts with libx264, copy the others (mp4/fmp4/fmp4-segment).")
+	cmdTranscode.PersistentFlags().Bool("measure-loudness", false, "Measure the EBU R128 loudness (integrated, LRA, true peak) of the audio outputs.")
+	cmdTranscode.PersistentFlags().Float32("loudness-target", 0, "Normalize the audio to this integrated loudness (LUFS, -70 to -5) with a two-pass loudnorm, default 0 means no normalization.")
+	cmdTranscode.PersistentFlags().Float32("loudness-true-peak", -1, "True peak ceiling (dBTP, -9 to 0) of the loudness normalization.")
+	cmdTranscode.PersistentFlags().Bool("detect-silence", false, "Report the silences of the audio outputs (AV_IN_STAT_QC and qc-report.json).")
+	cmdTranscode.PersistentFlags().Bool("detect-black", false, "Report the black video frames (AV_IN_STAT_QC and qc-report.json).")
+	cmdTranscode.PersistentFlags().Bool("detect-freeze", false, "Report the frozen video frames (AV_IN_STAT_QC and qc-report.json).")
+	cmdTranscode.PersistentFlags().Float32("qc-min-duration", 0, "Minimum duration (sec) of a reported silence, black or frozen interval, default is 2 sec.")
+	cmdTranscode.PersistentFlags().Float32("silence-threshold", 0, "Silence threshold (dB), default is -60dB.")
+	cmdTranscode.PersistentFlags().Bool("detect-scenes", false, "Report the scene cuts of the video (AV_IN_STAT_SCENE and shot-list.json).")
+	cmdTranscode.PersistentFlags().Float32("scene-threshold", 0, "Scene change score (0 to 1) of a scene cut, default is 0.4.")
+	cmdTranscode.PersistentFlags().Bool("scene-keyframes", false, "Place IDR frames and segment boundaries on the scene cuts (two passes).")
+	cmdTranscode.PersistentFlags().Float32("scene-tolerance", 0, "Seconds a segment boundary can move to a scene cut, default is 1 sec.")
+	cmdTranscode.PersistentFlags().String("crop", "", "Crop rectangle w:h:x:y of the video before scaling, or \"auto\" to remove the black bars (two passes).")
+	cmdTranscode.PersistentFlags().String("color-target", "none", "Color space of the video, default is 'none' (input one), can be: 'sdr', 'pq', 'hlg'.")
+	cmdTranscode.PersistentFlags().String("fps-mode", "none", "Frame rate conversion of the video, default is 'none', can be: 'drop-dup', 'blend', 'telecine', 'ivtc'.")
+	cmdTranscode.PersistentFlags().String("frame-rate", "", "Output frame rate (i.e. 24000/1001) of fps-mode 'drop-dup' and 'blend'.")
+	cmdTranscode.PersistentFlags().String("rc-mode", "default", "Rate control of the video encoder, default is 'default' (crf or video-bitrate), can be: 'crf-capped', 'two-pass', 'cbr'.")
+	cmdTranscode.PersistentFlags().String("audio-renditions", "", "JSON file with the audio renditions (aac, ac3, eac3 or libopus, passthrough), xc-type must be 'audio' and format 'dash', 'hls' or 'fmp4-segment'.")
 
 	return nil
 }
@@ -461,6 +547,34 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 
 	filterDescriptor := cmd.Flag("filter-descriptor").Value.String()
 
+	var channelMap *avpipe.ChannelMap
+	channelMapFile := cmd.Flag("channel-map").Value.String()
+	if len(channelMapFile) > 0 {
+		if len(filterDescriptor) > 0 {
+			return fmt.Errorf("channel-map and filter-descriptor can not be used together")
+		}
+		buf, err := ioutil.ReadFile(channelMapFile)
+		if err != nil {
+			return fmt.Errorf("Could not read channel-map file %s", channelMapFile)
+		}
+		channelMap = &avpipe.ChannelMap{}
+		if err = json.Unmarshal(buf, channelMap); err != nil {
+			return fmt.Errorf("Invalid channel-map file %s: %v", channelMapFile, err)
+		}
+	}
+
+	var audioRenditions []avpipe.AudioRendition
+	audioRenditionsFile := cmd.Flag("audio-renditions").Value.String()
+	if len(audioRenditionsFile) > 0 {
+		buf, err := ioutil.ReadFile(audioRenditionsFile)
+		if err != nil {
+			return fmt.Errorf("Could not read audio-renditions file %s", audioRenditionsFile)
+		}
+		if err = json.Unmarshal(buf, &audioRenditions); err != nil {
+			return fmt.Errorf("Invalid audio-renditions file %s: %v", audioRenditionsFile, err)
+		}
+	}
+
 	watermarkTimecode := cmd.Flag("wm-timecode").Value.String()
 	watermarkTimecodeRate, _ := cmd.Flags().GetFloat32("wm-timecode-rate")
 	if len(watermarkTimecode) > 0 && watermarkTimecodeRate <= 0 {
@@ -518,8 +632,9 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		xcTypeStr != "audio-pan" &&
 		xcTypeStr != "audio-merge" &&
 		xcTypeStr != "extract-images" &&
-		xcTypeStr != "extract-all-images" {
-		return fmt.Errorf("Transcoding type is not valid, with no stream-id can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', or 'extract-images'")
+		xcTypeStr != "extract-all-images" &&
+		xcTypeStr != "extract-captions" {
+		return fmt.Errorf("Transcoding type is not valid, with no stream-id can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', 'extract-images' or 'extract-captions'")
 	}
 	xcType := avpipe.XcTypeFromString(xcTypeStr)
 	if xcType == avpipe.XcAudio && len(encoder) == 0 {
@@ -664,8 +779,177 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Invalid copy-mpegts value")
 	}
 
+	rtpFec, err := cmd.Flags().GetBool("rtp-fec")
+	if err != nil {
+		return fmt.Errorf("Invalid rtp-fec value")
+	}
+
+	rtpJitterBuffer, err := cmd.Flags().GetInt32("rtp-jitter-buffer")
+	if err != nil || rtpJitterBuffer < 0 {
+		return fmt.Errorf("Invalid rtp-jitter-buffer value")
+	}
+
+	scte35PID, err := cmd.Flags().GetInt32("scte35-pid")
+	if err != nil || scte35PID < 0 || scte35PID >= 0x1fff {
+		return fmt.Errorf("Invalid scte35-pid value")
+	}
+
+	spliceSegment, err := cmd.Flags().GetBool("splice-segment")
+	if err != nil {
+		return fmt.Errorf("Invalid splice-segment value")
+	}
+
+	emitEmsg, err := cmd.Flags().GetBool("emit-emsg")
+	if err != nil {
+		return fmt.Errorf("Invalid emit-emsg value")
+	}
+
+	extractCaptions, err := cmd.Flags().GetBool("extract-captions")
+	if err != nil {
+		return fmt.Errorf("Invalid extract-captions value")
+	}
+
+	stripCaptions, err := cmd.Flags().GetBool("strip-captions")
+	if err != nil {
+		return fmt.Errorf("Invalid strip-captions value")
+	}
+
+	blank, err := cmd.Flags().GetBool("blank")
+	if err != nil {
+		return fmt.Errorf("Invalid blank value")
+	}
+
+	rebasePts, err := cmd.Flags().GetBool("rebase-pts")
+	if err != nil {
+		return fmt.Errorf("Invalid rebase-pts value")
+	}
+
+	smartCut, err := cmd.Flags().GetBool("smart-cut")
+	if err != nil {
+		return fmt.Errorf("Invalid smart-cut value")
+	}
+
+	measureLoudness, err := cmd.Flags().GetBool("measure-loudness")
+	if err != nil {
+		return fmt.Errorf("Invalid measure-loudness value")
+	}
+
+	loudnessTarget, err := cmd.Flags().GetFloat32("loudness-target")
+	if err != nil {
+		return fmt.Errorf("Invalid loudness-target value")
+	}
+
+	loudnessTruePeak, err := cmd.Flags().GetFloat32("loudness-true-peak")
+	if err != nil {
+		return fmt.Errorf("Invalid loudness-true-peak value")
+	}
+
+	detectSilence, err := cmd.Flags().GetBool("detect-silence")
+	if err != nil {
+		return fmt.Errorf("Invalid detect-silence value")
+	}
+
+	detectBlack, err := cmd.Flags().GetBool("detect-black")
+	if err != nil {
+		return fmt.Errorf("Invalid detect-black value")
+	}
+
+	detectFreeze, err := cmd.Flags().GetBool("detect-freeze")
+	if err != nil {
+		return fmt.Errorf("Invalid detect-freeze value")
+	}
+
+	qcMinDuration, err := cmd.Flags().GetFloat32("qc-min-duration")
+	if err != nil {
+		return fmt.Errorf("Invalid qc-min-duration value")
+	}
+
+	silenceThreshold, err := cmd.Flags().GetFloat32("silence-threshold")
+	if err != nil {
+		return fmt.Errorf("Invalid silence-threshold value")
+	}
+
+	detectScenes, err := cmd.Flags().GetBool("detect-scenes")
+	if err != nil {
+		return fmt.Errorf("Invalid detect-scenes value")
+	}
+
+	sceneThreshold, err := cmd.Flags().GetFloat32("scene-threshold")
+	if err != nil {
+		return fmt.Errorf("Invalid scene-threshold value")
+	}
+
+	sceneKeyframes, err := cmd.Flags().GetBool("scene-keyframes")
+	if err != nil {
+		return fmt.Errorf("Invalid scene-keyframes value")
+	}
+
+	sceneTolerance, err := cmd.Flags().GetFloat32("scene-tolerance")
+	if err != nil {
+		return fmt.Errorf("Invalid scene-tolerance value")
+	}
+
+	crop, err := cmd.Flags().GetString("crop")
+	if err != nil {
+		return fmt.Errorf("Invalid crop value")
+	}
+
+	colorTarget := avpipe.ColorTargetNone
+	val := cmd.Flag("color-target").Value.String()
+	if len(val) > 0 {
+		switch val {
+		case "sdr":
+			colorTarget = avpipe.ColorTargetSDR
+		case "pq":
+			colorTarget = avpipe.ColorTargetPQ
+		case "hlg":
+			colorTarget = avpipe.ColorTargetHLG
+		case "none":
+			break
+		default:
+			return fmt.Errorf("Invalid color-target: %s", val)
+		}
+	}
+
+	fpsMode := avpipe.FpsModeNone
+	val = cmd.Flag("fps-mode").Value.String()
+	if len(val) > 0 {
+		switch val {
+		case "drop-dup":
+			fpsMode = avpipe.FpsModeDropDup
+		case "blend":
+			fpsMode = avpipe.FpsModeBlend
+		case "telecine":
+			fpsMode = avpipe.FpsModeTelecine
+		case "ivtc":
+			fpsMode = avpipe.FpsModeIVTC
+		case "none":
+			break
+		default:
+			return fmt.Errorf("Invalid fps-mode: %s", val)
+		}
+	}
+	frameRate := cmd.Flag("frame-rate").Value.String()
+
+	rcMode := avpipe.RcModeDefault
+	val = cmd.Flag("rc-mode").Value.String()
+	if len(val) > 0 {
+		switch val {
+		case "crf-capped":
+			rcMode = avpipe.RcModeCrfCapped
+		case "two-pass":
+			rcMode = avpipe.RcModeTwoPass
+		case "cbr":
+			rcMode = avpipe.RcModeCbr
+		case "default":
+			break
+		default:
+			return fmt.Errorf("Invalid rc-mode: %s", val)
+		}
+	}
+
 	cryptScheme := avpipe.CryptNone
-	val := cmd.Flag("crypt-scheme").Value.String()
+	val = cmd.Flag("crypt-scheme").Value.String()
 	if len(val) > 0 {
 		switch val {
 		case "aes-128":
@@ -753,6 +1037,7 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		Listen:                 listen,
 		ConnectionTimeout:      int(connectionTimeout),
 		FilterDescriptor:       filterDescriptor,
+		ChannelMap:             channelMap,
 		SkipDecoding:           skipDecoding,
 		ExtractImageIntervalTs: extractImageIntervalTs,
 		ChannelLayout:          channelLayout,
@@ -764,6 +1049,34 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		Profile:                profile,
 		Level:                  int(level),
 		Deinterlace:            int(deinterlace),
+		RtpFec:                 rtpFec,
+		RtpJitterBuffer:        int(rtpJitterBuffer),
+		Scte35PID:              int(scte35PID),
+		SpliceSegment:          spliceSegment,
+		EmitEmsg:               emitEmsg,
+		ExtractCaptions:        extractCaptions,
+		StripCaptions:          stripCaptions,
+		Blank:                  blank,
+		RebasePts:              rebasePts,
+		SmartCut:               smartCut,
+		MeasureLoudness:        measureLoudness,
+		LoudnessTarget:         loudnessTarget,
+		LoudnessTruePeak:       loudnessTruePeak,
+		DetectSilence:          detectSilence,
+		DetectBlack:            detectBlack,
+		DetectFreeze:           detectFreeze,
+		QcMinDuration:          qcMinDuration,
+		SilenceThreshold:       silenceThreshold,
+		DetectScenes:           detectScenes,
+		SceneThreshold:         sceneThreshold,
+		SceneKeyframes:         sceneKeyframes,
+		SceneTolerance:         sceneTolerance,
+		Crop:                   crop,
+		ColorTarget:            colorTarget,
+		FpsMode:                fpsMode,
+		FrameRate:              frameRate,
+		RcMode:                 rcMode,
+		AudioRenditions:        audioRenditions,
 	}
 
 	err = getAudioIndexes(params, audioIndex)
@@ -778,7 +1091,7 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	avpipe.InitIOHandler(&elvxcInputOpener{url: filename}, &elvxcOutputOpener{dir: dir})
+	avpipe.InitIOHandler(&elvxcInputOpener{url: filename}, &elvxcOutputOpener{dir: dir, format: format})
 
 	done := make(chan interface{})
 
@@ -43,6 +43,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = cmd.InitEdl(cmdRoot)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	err = cmd.WarmupStress(cmdRoot)
 	if err != nil {
 		fmt.Println(err)
@@ -61,6 +67,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = cmd.InitCompare(cmdRoot)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = cmd.InitLadder(cmdRoot)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	err = cmdRoot.Execute()
 	if err != nil {
 		fmt.Printf("Command failed\n")
@@ -36,6 +36,23 @@ extern void *
 udp_thread_func(
     void *thread_params);
 
+extern void *
+rtp_thread_func(
+    void *thread_params);
+
+extern int
+rtp_channel_output(
+    void *opaque,
+    uint8_t *buf,
+    int len);
+
+extern int
+udp_bind_socket(
+    const char *host,
+    const char *port,
+    const char *url,
+    socklen_t *salen);
+
 int
 in_stat(
     void *opaque,
@@ -53,6 +70,8 @@ typedef struct udp_thread_params_t {
     elv_channel_t   *udp_channel;   /* udp channel to keep incomming UDP packets */
     socklen_t       salen;
     ioctx_t         *inctx;
+    int             fec_fd[2];      /* RTP only: SMPTE 2022-1 column and row FEC sockets, -1 if not used */
+    int             pkt_num;        /* RTP only: # of packets pushed into udp channel */
 } udp_thread_params_t;
 
 int
@@ -134,7 +153,54 @@ in_opener(
         return 0;
     }
 
-    if (!strcmp(url_parser.protocol, "rtmp") || !strcmp(url_parser.protocol, "srt") || !strcmp(url_parser.protocol, "rtp")) {
+    /* If input url is a RTP, de-encapsulate it into the UDP channel */
+    if (!strcmp(url_parser.protocol, "rtp")) {
+        socklen_t           salen;
+        udp_thread_params_t *params;
+        xcparams_t          *xcparams = inctx->params;
+
+        fd = udp_bind_socket(url_parser.host, url_parser.port, url, &salen);
+        if (fd < 0) {
+            inctx->opaque = NULL;
+            return -1;
+        }
+
+        params = (udp_thread_params_t *) calloc(1, sizeof(udp_thread_params_t));
+        params->fd = fd;
+        params->salen = salen;
+        params->fec_fd[0] = -1;
+        params->fec_fd[1] = -1;
+        if (xcparams && xcparams->rtp_fec) {
+            int fec_ports[2] = { RTP_FEC_COLUMN_PORT, RTP_FEC_ROW_PORT };
+            for (int i=0; i<2; i++) {
+                char port[16];
+                socklen_t fec_salen;
+                snprintf(port, sizeof(port), "%d", atoi(url_parser.port) + fec_ports[i]);
+                params->fec_fd[i] = udp_bind_socket(url_parser.host, port, url, &fec_salen);
+            }
+        }
+
+        elv_channel_init(&inctx->udp_channel, MAX_UDP_CHANNEL, NULL);
+        inctx->opaque = (int *) calloc(1, 2*sizeof(int));
+        *((int *)(inctx->opaque)) = fd;
+        inctx->url = strdup(url);
+
+        pthread_mutex_lock(&lock);
+        opened_inputs++;
+        *((int *)(inctx->opaque)+1) = opened_inputs;
+        pthread_mutex_unlock(&lock);
+
+        params->udp_channel = inctx->udp_channel;
+        params->inctx = inctx;
+        inctx->rtp_ctx = rtp_ctx_new(xcparams ? xcparams->rtp_jitter_buffer : 0, rtp_channel_output, params);
+
+        pthread_create(&inctx->utid, NULL, rtp_thread_func, params);
+
+        elv_dbg("IN OPEN RTP fd=%d, fec_fd=%d,%d, url=%s", fd, params->fec_fd[0], params->fec_fd[1], url);
+        return 0;
+    }
+
+    if (!strcmp(url_parser.protocol, "rtmp") || !strcmp(url_parser.protocol, "srt")) {
         inctx->opaque = (int *) calloc(2, sizeof(int));
         inctx->url = strdup(url);
         pthread_mutex_lock(&lock);
@@ -142,7 +208,7 @@ in_opener(
         *((int *)(inctx->opaque)+1) = opened_inputs;
         pthread_mutex_unlock(&lock);
 
-        elv_dbg("IN OPEN RTMP/SRT/RTP url=%s", url);
+        elv_dbg("IN OPEN RTMP/SRT url=%s", url);
         return 0;
     }
 
@@ -264,6 +330,15 @@ read_channel_again:
 #ifdef DEBUG_UDP_PACKET
         elv_dbg("IN READ UDP read=%d pos=%"PRId64" total=%"PRId64, r, c->read_pos, c->read_bytes);
 #endif
+        if (c->rtp_ctx) {
+            rtp_stats_t stats;
+            rtp_get_stats(c->rtp_ctx, &stats);
+            if (stats.packets_lost != c->rtp_stats.packets_lost ||
+                stats.packets_recovered != c->rtp_stats.packets_recovered) {
+                c->rtp_stats = stats;
+                in_stat(opaque, 0, in_stat_rtp);
+            }
+        }
         return r;
     } else {
         int fd = *((int *)(c->opaque));
@@ -369,6 +444,29 @@ in_stat(
         if (debug_frame_level)
             elv_dbg("IN STAT stream_index=%d, fd=%d, data=%s", stream_index, fd, c->data);
         break;
+    case in_stat_timed_metadata:
+        elv_log("IN STAT stream_index=%d, fd=%d, timed metadata type=%s pts=%"PRId64" size=%d",
+            stream_index, fd, c->timed_metadata->type == timed_metadata_id3 ? "id3" : "klv",
+            c->timed_metadata->pts, c->timed_metadata->size);
+        break;
+    case in_stat_qc:
+        elv_log("IN STAT stream_index=%d, fd=%d, qc %s start=%.3f end=%.3f",
+            stream_index, fd, qc_event_type_name(c->qc_event->type), c->qc_event->start, c->qc_event->end);
+        break;
+    case in_stat_scene:
+        elv_log("IN STAT stream_index=%d, fd=%d, scene cut pts=%"PRId64" time=%.3f score=%.3f",
+            stream_index, fd, c->scene_cut->pts, c->scene_cut->time, c->scene_cut->score);
+        break;
+    case in_stat_loudness:
+        elv_log("IN STAT stream_index=%d, fd=%d, loudness integrated=%.1f LUFS, range=%.1f LU, true_peak=%.1f dBTP",
+            c->loudness->stream_index, fd, c->loudness->integrated, c->loudness->range, c->loudness->true_peak);
+        break;
+    case in_stat_rtp:
+        elv_log("IN STAT fd=%d, RTP received=%"PRId64", lost=%"PRId64", recovered=%"PRId64", reordered=%"PRId64", duplicated=%"PRId64", late=%"PRId64", fec=%"PRId64,
+            fd, c->rtp_stats.packets_received, c->rtp_stats.packets_lost, c->rtp_stats.packets_recovered,
+            c->rtp_stats.packets_reordered, c->rtp_stats.packets_duplicated, c->rtp_stats.packets_late,
+            c->rtp_stats.fec_packets_received);
+        break;
     default:
         elv_err("IN STAT stream_index=%d, fd=%d, invalid input stat=%d", stream_index, fd, stat_type);
         return 1;
@@ -479,7 +577,21 @@ out_opener(
         }
         break;
 
+    case avpipe_caption_webvtt_segment:
+    case avpipe_caption_ttml_segment:
+        {
+            const char *segbase = "captions";
+
+            sprintf(segname, "./%s/%s-%s-%05d.%s",
+                dir, segbase, cc_track_name(outctx->stream_index), outctx->seg_index,
+                outctx->type == avpipe_caption_webvtt_segment ? "vtt" : "ttml");
+        }
+        break;
+
     case avpipe_image:
+    case avpipe_qc_report:
+    case avpipe_shot_list:
+    case avpipe_audio_rendition_manifest:
         {
             sprintf(segname, "%s/%s", dir, url);
         }
@@ -662,6 +774,17 @@ out_stat(
                 stream_index, fd, outctx->type, outctx->total_frames_written,
                 outctx->frames_written);
         break;
+    case out_stat_splice_point:
+        elv_log("OUT STAT stream_index=%d, fd=%d, type=%d, splice point pts=%"PRId64", frame_pts=%"PRId64", seg_index=%d",
+            stream_index, fd, outctx->type, outctx->encoder_ctx->splice_point.pts,
+            outctx->encoder_ctx->splice_point.frame_pts, outctx->encoder_ctx->splice_point.seg_index);
+        break;
+    case out_stat_emsg:
+        elv_log("OUT STAT stream_index=%d, fd=%d, type=%d, emsg id=%u scheme=%s presentation_time=%"PRIu64" timescale=%u seg_index=%d",
+            stream_index, fd, outctx->type, outctx->encoder_ctx->emsg_event->id,
+            outctx->encoder_ctx->emsg_event->scheme_id_uri, outctx->encoder_ctx->emsg_event->presentation_time,
+            outctx->encoder_ctx->emsg_event->timescale, outctx->encoder_ctx->emsg_event->seg_index);
+        break;
     default:
         break;
     }
@@ -764,6 +887,9 @@ xc_type_from_string(
     if (!strcmp(xc_type_str, "extract-all-images"))
         return xc_extract_all_images;
 
+    if (!strcmp(xc_type_str, "extract-captions"))
+        return xc_extract_captions;
+
     return xc_none;
 }
 
@@ -820,6 +946,7 @@ do_probe(
                 "\tpix_fmt: %s\n"
                 "\thas_b_frames: %d\n"
                 "\tfield_order: %d\n"
+                "\tcadence: %d\n"
                 "\tsample_aspect_ratio: %d:%d\n"
                 "\tdisplay_aspect_ratio: %d:%d\n"
                 "\tside_data_display_matrix_rotation:%f\n"
@@ -847,6 +974,7 @@ do_probe(
                 av_get_pix_fmt_name(probe->stream_info[i].pix_fmt) != NULL ? av_get_pix_fmt_name(probe->stream_info[i].pix_fmt) : "-",
                 probe->stream_info[i].has_b_frames,
                 probe->stream_info[i].field_order,
+                probe->stream_info[i].cadence,
                 probe->stream_info[i].sample_aspect_ratio.num, probe->stream_info[i].sample_aspect_ratio.den,
                 probe->stream_info[i].display_aspect_ratio.num, probe->stream_info[i].display_aspect_ratio.den,
                 probe->stream_info[i].side_data.display_matrix.rotation,
@@ -1028,11 +1156,14 @@ usage(
         "\t-audio-index :           (optional) Default: the indexes of audio stream (comma separated)\n"
         "\t-audio-seg-duration-ts : (mandatory If format is not \"segment\" and transcoding audio) audio segment duration time base (positive integer).\n"
         "\t-bitdepth :              (optional) Bitdepth of color space. Default is 8, can be 8, 10, or 12.\n"
+        "\t-blank :                 (optional) Replace the decoded video by black frames and the audio by silence. Default is 0, must be 0 or 1\n"
         "\t-bypass :                (optional) Bypass transcoding. Default is 0, must be 0 or 1\n"
         "\t-channel-layout :        (optional) Channel layout for audio, can be \"mono\", \"stereo\", \"5.0\" or \"5.1\"....\n"
+        "\t-color-target :          (optional) Color space of the video. Default is \"none\" (input one), can be: \"sdr\", \"pq\", \"hlg\"\n"
         "\t-command :               (optional) Directing command of exc, can be \"transcode\", \"probe\" or \"mux\" (default is transcode).\n"
         "\t-connection-timeout:     (optional) Seconds (default 10). Connection timeout for rtmp or mpegts protocols.\n"
         "\t-crf :                   (optional) Mutually exclusive with video-bitrate. Default: 23\n"
+        "\t-crop :                  (optional) Crop rectangle w:h:x:y of the video before scaling, or \"auto\" to remove the black bars (two passes)\n"
         "\t-crypt-iv :              (optional) 128-bit AES IV, as hex\n"
         "\t-crypt-key :             (optional) 128-bit AES key, as hex\n"
         "\t-crypt-kid :             (optional) 16-byte key ID, as hex\n"
@@ -1042,14 +1173,21 @@ usage(
         "\t                                    For audio default is \"aac\", but for ts files should be set to \"ac3\"\n"
         "\t-debug-frame-level :     (optional) Enable/disable debug frame level. Default is 0, must be 0 or 1.\n"
         "\t-deinterlace :           (optional) Deinterlace filter. Default is 0 (none), can be: 1 (bwdif send_field), 2 (bwdif send_frame)\n"
+        "\t-detect-black :          (optional) Report the black video frames (in_stat_qc and qc_report.json). Default is 0, must be 0 or 1\n"
+        "\t-detect-freeze :         (optional) Report the frozen video frames (in_stat_qc and qc_report.json). Default is 0, must be 0 or 1\n"
+        "\t-detect-scenes :         (optional) Report the scene cuts of the video (in_stat_scene and shot_list.json). Default is 0, must be 0 or 1\n"
+        "\t-detect-silence :        (optional) Report the silences of the audio outputs (in_stat_qc and qc_report.json). Default is 0, must be 0 or 1\n"
         "\t-duration-ts :           (optional) Default: -1 (entire stream)\n"
-        "\t-e :                     (optional) Video encoder name. Default is \"libx264\", can be: \"libx264\", \"libx265\", \"h264_nvenc\", \"hevc_nvenc\", \"h264_videotoolbox\", or \"mjpeg\"\n"
+        "\t-e :                     (optional) Video encoder name. Default is \"libx264\", can be: \"libx264\", \"libx265\", \"h264_nvenc\", \"hevc_nvenc\", \"h264_videotoolbox\",\n"
+        "\t                                    \"libsvtav1\", \"libaom-av1\", \"libvpx-vp9\", or \"mjpeg\"\n"
         "\t-enc-height :            (optional) Default: -1 (use source height)\n"
         "\t-enc-width :             (optional) Default: -1 (use source width)\n"
+        "\t-emit-emsg :             (optional) Write input SCTE-35 and ID3 events as emsg boxes in the video segments. Default is 0, must be 0 or 1\n"
         "\t-equal-fduration :       (optional) Force equal frame duration. Must be 0 or 1 and only valid for \"fmp4-segment\" format.\n"
+        "\t-extract-captions :      (optional) Write the CEA-608/708 captions as WebVTT (hls) or TTML (dash) segments. Default is 0, must be 0 or 1\n"
         "\t-extract-image-interval-ts : (optional) Write frames at this interval. Default: -1 (10 seconds)\n"
         "\t-extract-images-ts :     (optional) Write frames at these timestamps (comma separated). Mutually exclusive with extract-image-interval-ts\n"
-        "\t-f :                     (mandatory) Input filename for transcoding. Valid formats are: a filename that points to a valid file, or udp://127.0.0.1:<port>.\n"
+        "\t-f :                     (mandatory) Input filename for transcoding. Valid formats are: a filename that points to a valid file, udp://127.0.0.1:<port>, or rtp://127.0.0.1:<port>.\n"
         "\t                                    Output goes to directory ./O\n"
         "\t-filter-descriptor :     (mandatory if xc-type is audio-pan). Audio filter descriptor the same as ffmpeg format.\n"
         "\t                                    For example: -filter-descriptor [0:1]pan=stereo|c0<c1+0.707*c2|c1<c2+0.707*c1[aout]\n"
@@ -1058,37 +1196,56 @@ usage(
         "\t                                    Using \"fmp4-segment\" format produces self contained mp4 segments with continious pts.\n"
         "\t                                    Using \"fmp4-segment\" generates segments that are appropriate for live streaming.\n"
         "\t-force-keyint :          (optional) Force IDR key frame in this interval.\n"
+        "\t-fps-mode :              (optional) Frame rate conversion of the video. Default is \"none\", can be: \"drop-dup\", \"blend\", \"telecine\", \"ivtc\"\n"
+        "\t-frame-rate :            (optional) Output frame rate (i.e. 24000/1001) of fps-mode \"drop-dup\" and \"blend\"\n"
         "\t-gpu-index :             (optional) Use the GPU with specified index for transcoding (export CUDA_DEVICE_ORDER=PCI_BUS_ID would use smi index).\n"
         "\t-level:                  (optional) Encoding level for video. If it is not determined, it will be set automatically.\n"
         "\t-listen:                 (optional) Listen mode for RTMP. Must be 0 or 1, by default is on (value 1)\n"
         "\t-log-size:               (optional) Log size in MB. Default is 100MB.\n"
+        "\t-loudness-target :        (optional) Normalize the audio to this integrated loudness (LUFS, -70 to -5) with a two-pass loudnorm. Default is 0 (none)\n"
+        "\t-loudness-true-peak :     (optional) True peak ceiling (dBTP, -9 to 0) of the loudness normalization. Default is -1\n"
         "\t-master-display :        (optional) Master display, only valid if encoder is libx265.\n"
         "\t-max-cll :               (optional) Maximum Content Light Level and Maximum Frame Average Light Level, only valid if encoder is libx265.\n"
         "\t                                    This parameter is a comma separated of max-cll and max-fall (i.e \"1514,172\").\n"
+        "\t-measure-loudness :      (optional) Measure the EBU R128 loudness of the audio outputs. Default is 0, must be 0 or 1\n"
         "\t-mux-spec :              (optional) Muxing spec file.\n"
         "\t-preset :                (optional) Preset string to determine compression speed. Default is \"medium\". Valid values are: \"ultrafast\", \"superfast\",\n"
         "\t                                    \"veryfast\", \"faster\", \"fast\", \"medium\", \"slow\", \"slower\", \"veryslow\".\n"
+        "\t-probe-cadence :         (optional) With -command probe, decode the first frames of the video to find its cadence. Default is 0, must be 0 or 1\n"
         "\t-profile :               (optional) Encoding profile for video. If it is not determined, it will be set automatically.\n"
         "\t                                    Valid H264 profiles: \"baseline\", \"main\", \"extended\", \"high\", \"high10\", \"high422\", \"high444\"\n"
         "\t                                    Valid H265 profiles: \"main\", \"main10\"\n"
         "\t                                    Valid NVIDIA H264 profiles: \"baseline\", \"main\", \"high\", \"high444p\"\n"
+        "\t-qc-min-duration :       (optional) Minimum duration in seconds of a reported silence, black or frozen interval. Default is 2\n"
         "\t-r :                     (optional) number of repeats. Default is 1 repeat, must be bigger than 1\n"
         "\t-rc-buffer-size :        (optional) Determines the interval used to limit bit rate\n"
         "\t-rc-max-rate :           (optional) Maximum encoding bit rate, used in conjuction with rc-buffer-size\n"
+        "\t-rc-mode :               (optional) Rate control of the video encoder. Default is \"default\" (crf or video-bitrate), can be: \"crf-capped\", \"two-pass\", \"cbr\"\n"
+        "\t-rebase-pts :            (optional) Start the output timestamps at start-pts (in output time base). Default is 0, must be 0 or 1\n"
         "\t-rotate :                (optional) Rotate the input video. Default is 0 with no rotation, other values 90, 180, 270.\n"
+        "\t-rtp-fec :               (optional) Receive SMPTE 2022-1 column and row FEC on port+2 and port+4 for RTP input. Default is 0, must be 0 or 1\n"
+        "\t-rtp-jitter-buffer :     (optional) RTP reorder window in packets. Default is 0 (auto)\n"
         "\t-sample-rate :           (optional) Default: -1. For aac output sample rate is set to input sample rate and this parameter is ignored.\n"
+        "\t-scene-keyframes :       (optional) Place IDR frames and segment boundaries on the scene cuts found by a first pass. Default is 0, must be 0 or 1\n"
+        "\t-scene-threshold :       (optional) Scene change score (0 to 1) of a scene cut. Default is 0.4\n"
+        "\t-scene-tolerance :       (optional) Seconds a segment boundary can move to a scene cut. Default is 1\n"
+        "\t-scte35-pid :            (optional) PID of the SCTE-35 cues inserted in the copy MPEGTS output. Default is 0 (no cue insertion)\n"
         "\t-seekable :              (optional) Seekable stream. Default is 0, must be 0 or 1\n"
         "\t-seg-duration :          (mandatory if format is \"segment\") segment duration secs (positive integer). It is used for making mp4 segments.\n"
+        "\t-silence-threshold :     (optional) Silence threshold in dB. Default is -60\n"
         "\t-skip-decoding :         (optional) If start-time-ts is set and skip-decoding enabled, then will skip until start-time-ts without decoding.\n"
+        "\t-smart-cut :             (optional) Only re-encode the GOPs at start-time-ts and the end with libx264, copy the others. Default is 0, must be 0 or 1\n"
+        "\t-splice-segment :        (optional) Force an IDR frame and start a new dash/hls segment or mez part at SCTE-35 splice points. Default is 0, must be 0 or 1\n"
         "\t-start-pts :             (optional) Starting PTS for output. Default is 0\n"
         "\t-start-frag-index :      (optional) Start fragment index of first segment. Default is 0\n"
         "\t-start-segment :         (optional) Start segment number >= 1, Default is 1\n"
         "\t-start-time-ts :         (optional) Default: 0\n"
         "\t-stream-id :             (optional) Default: -1, if it is valid it will be used to transcode elementary stream with that stream-id.\n"
+        "\t-strip-captions :        (optional) Do not pass the A/53 captions of the input through to the encoded video. Default is 0, must be 0 or 1\n"
         "\t-sync-audio-to-stream-id:(optional) Default: -1, sync audio to video iframe of specific stream-id when input stream is mpegts.\n"
         "\t-t :                     (optional) Transcoding threads. Default is 1 thread, must be bigger than 1\n"
         "\t-xc-type :               (optional) Transcoding type. Default is \"all\", can be \"video\", \"audio\", \"audio-merge\", \"audio-join\", \"audio-pan\", \"all\", \"extract-images\"\n"
-        "\t                                    or \"extract-all-images\". \"all\" means transcoding video and audio together.\n"
+        "\t                                    \"extract-all-images\" or \"extract-captions\". \"all\" means transcoding video and audio together.\n"
         "\t-copy-mpegts :           (optional) Default 0. Create a copy of the MPEGTS input (for MPEGTS, SRT, RTP)\n"
         "\t-video-bitrate :         (optional) Mutually exclusive with crf. Default: -1 (unused)\n"
         "\t-video-frame-duration-ts :  (optional) Frame duration of the output video in time base.\n"
@@ -1201,6 +1358,7 @@ main(
         .debug_frame_level = 0,
         .video_time_base = 0,
         .video_frame_duration_ts = 0,
+        .loudness_true_peak = -1,           /* Default -1 dBTP (EBU R128) */
     };
 
     i = 1;
@@ -1231,7 +1389,14 @@ main(
             }
             break;
         case 'b':
-            if (!strcmp(argv[i], "-bypass") || !strcmp(argv[i], "-b")) {
+            if (!strcmp(argv[i], "-blank")) {
+                if (sscanf(argv[i+1], "%d", &p.blank) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.blank != 0 && p.blank != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-bypass") || !strcmp(argv[i], "-b")) {
                 if (sscanf(argv[i+1], "%d", &bypass_transcoding) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
@@ -1260,10 +1425,22 @@ main(
                 }
             } else if (!strcmp(argv[i], "-crf")) {
                 p.crf_str = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-crop")) {
+                p.crop = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-connection-timeout")) {
                 if (sscanf(argv[i+1], "%d", &p.connection_timeout) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-color-target")) {
+                if (!strcmp(argv[i+1], "sdr")) {
+                    p.color_target = color_target_sdr;
+                } else if (!strcmp(argv[i+1], "pq")) {
+                    p.color_target = color_target_pq;
+                } else if (!strcmp(argv[i+1], "hlg")) {
+                    p.color_target = color_target_hlg;
+                } else if (strcmp(argv[i+1], "none")) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-channel-layout")) {
                 p.channel_layout = av_get_channel_layout(argv[i+1]);
                 if (p.channel_layout == 0)
@@ -1310,6 +1487,34 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.deinterlace) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-detect-black")) {
+                if (sscanf(argv[i+1], "%d", &p.detect_black) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.detect_black != 0 && p.detect_black != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-detect-freeze")) {
+                if (sscanf(argv[i+1], "%d", &p.detect_freeze) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.detect_freeze != 0 && p.detect_freeze != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-detect-scenes")) {
+                if (sscanf(argv[i+1], "%d", &p.detect_scenes) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.detect_scenes != 0 && p.detect_scenes != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-detect-silence")) {
+                if (sscanf(argv[i+1], "%d", &p.detect_silence) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.detect_silence != 0 && p.detect_silence != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             }
             else if (strlen(argv[i]) > 2) {
                 usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1326,6 +1531,13 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.enc_width) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-emit-emsg")) {
+                if (sscanf(argv[i+1], "%d", &p.emit_emsg) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.emit_emsg != 0 && p.emit_emsg != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-equal-fduration")) {
                 if (sscanf(argv[i+1], "%d", &p.force_equal_fduration) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1333,6 +1545,13 @@ main(
                 if (p.force_equal_fduration != 0 && p.force_equal_fduration != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-extract-captions")) {
+                if (sscanf(argv[i+1], "%d", &p.extract_captions) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.extract_captions != 0 && p.extract_captions != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-extract-image-interval-ts")) {
                 if (sscanf(argv[i+1], "%"PRId64, &p.extract_image_interval_ts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1352,6 +1571,20 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.force_keyint) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-fps-mode")) {
+                if (!strcmp(argv[i+1], "drop-dup")) {
+                    p.fps_mode = fps_mode_drop_dup;
+                } else if (!strcmp(argv[i+1], "blend")) {
+                    p.fps_mode = fps_mode_blend;
+                } else if (!strcmp(argv[i+1], "telecine")) {
+                    p.fps_mode = fps_mode_telecine;
+                } else if (!strcmp(argv[i+1], "ivtc")) {
+                    p.fps_mode = fps_mode_ivtc;
+                } else if (strcmp(argv[i+1], "none")) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-frame-rate")) {
+                p.frame_rate = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-format")) {
                 if (strcmp(argv[i+1], "dash") == 0) {
                     p.format = strdup("dash");
@@ -1406,6 +1639,14 @@ main(
                 /* Cap the log size to MAX_LOG_SIZE */
                 if (log_size > MAX_LOG_SIZE)
                     log_size = MAX_LOG_SIZE;
+            } else if (!strcmp(argv[i], "-loudness-target")) {
+                if (sscanf(argv[i+1], "%f", &p.loudness_target) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-loudness-true-peak")) {
+                if (sscanf(argv[i+1], "%f", &p.loudness_true_peak) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             }
             break;
         case 'm':
@@ -1417,6 +1658,13 @@ main(
                 p.master_display = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-max-cll")) {
                 p.max_cll = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-measure-loudness")) {
+                if (sscanf(argv[i+1], "%d", &p.measure_loudness) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.measure_loudness != 0 && p.measure_loudness != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
@@ -1426,6 +1674,19 @@ main(
                 p.preset = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-profile")) {
                 p.profile = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-probe-cadence")) {
+                if (sscanf(argv[i+1], "%d", &p.probe_cadence) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else {
+                usage(argv[0], argv[i], EXIT_FAILURE);
+            }
+            break;
+        case 'q':
+            if (!strcmp(argv[i], "-qc-min-duration")) {
+                if (sscanf(argv[i+1], "%f", &p.qc_min_duration) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
@@ -1439,10 +1700,42 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.rc_max_rate) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-rc-mode")) {
+                if (!strcmp(argv[i+1], "crf-capped")) {
+                    p.rc_mode = rc_mode_crf_capped;
+                } else if (!strcmp(argv[i+1], "two-pass")) {
+                    p.rc_mode = rc_mode_two_pass;
+                } else if (!strcmp(argv[i+1], "cbr")) {
+                    p.rc_mode = rc_mode_cbr;
+                } else if (strcmp(argv[i+1], "default")) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-rebase-pts")) {
+                if (sscanf(argv[i+1], "%d", &p.rebase_pts) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.rebase_pts != 0 && p.rebase_pts != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-rotate")) {
                 if (sscanf(argv[i+1], "%d", &p.rotate) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-rtp-fec")) {
+                if (sscanf(argv[i+1], "%d", &p.rtp_fec) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.rtp_fec != 0 && p.rtp_fec != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-rtp-jitter-buffer")) {
+                if (sscanf(argv[i+1], "%d", &p.rtp_jitter_buffer) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-scte35-pid")) {
+                if (sscanf(argv[i+1], "%d", &p.scte35_pid) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (strlen(argv[i]) > 2) {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             } else {
@@ -1460,10 +1753,36 @@ main(
                 if (p.stream_id < 0) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-scene-keyframes")) {
+                if (sscanf(argv[i+1], "%d", &p.scene_keyframes) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.scene_keyframes != 0 && p.scene_keyframes != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-scene-threshold")) {
+                if (sscanf(argv[i+1], "%f", &p.scene_threshold) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-scene-tolerance")) {
+                if (sscanf(argv[i+1], "%f", &p.scene_tolerance) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-silence-threshold")) {
+                if (sscanf(argv[i+1], "%f", &p.silence_threshold) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-skip-decoding")) {
                 if (sscanf(argv[i+1], "%d", &p.skip_decoding) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-smart-cut")) {
+                if (sscanf(argv[i+1], "%d", &p.smart_cut) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.smart_cut != 0 && p.smart_cut != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-seekable")) {
                 if (sscanf(argv[i+1], "%d", &p.seekable) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1481,6 +1800,13 @@ main(
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
                 p.seg_duration = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-splice-segment")) {
+                if (sscanf(argv[i+1], "%d", &p.splice_segment) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.splice_segment != 0 && p.splice_segment != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-start-pts")) {
                 if (sscanf(argv[i+1], "%"PRId64, &p.start_pts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1495,6 +1821,13 @@ main(
                 if (sscanf(argv[i+1], "%"PRId64, &p.start_time_ts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-strip-captions")) {
+                if (sscanf(argv[i+1], "%d", &p.strip_captions) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.strip_captions != 0 && p.strip_captions != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-sync-audio-to-stream-id")) {
                 if (sscanf(argv[i+1], "%d", &p.sync_audio_to_stream_id) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1594,7 +1927,8 @@ main(
                     strcmp(argv[i+1], "audio-pan") &&
                     strcmp(argv[i+1], "audio-merge") &&
                     strcmp(argv[i+1], "extract-images") &&
-                    strcmp(argv[i+1], "extract-all-images")) {
+                    strcmp(argv[i+1], "extract-all-images") &&
+                    strcmp(argv[i+1], "extract-captions")) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
                 p.xc_type = xc_type_from_string(argv[i+1]);
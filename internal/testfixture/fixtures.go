@@ -0,0 +1,167 @@
+package testfixture
+
+import (
+	"fmt"
+
+	"github.com/eluv-io/avpipe/ts"
+	"github.com/eluv-io/avpipe/ts/scte35"
+)
+
+// CaptionText is the CC1 pop-on caption of CaptionH264()
+const CaptionText = "HELLO"
+
+// CaptionH264 returns a 64x64 25 fps raw H.264 video of 100 frames, with CaptionText as a CC1 pop-on
+// caption in A/53 SEI. The first frame is an IDR frame of I_PCM macroblocks and the others skip all
+// their macroblocks. The caption is loaded from frame 2, displayed at frame 12 and erased at frame 62.
+func CaptionH264() []byte {
+	const widthMbs, heightMbs, frames = 4, 4, 100
+
+	// CEA-608 byte pairs of CC1, the control codes are sent twice
+	pairs := map[int][2]byte{
+		2: {0x14, 0x20}, 3: {0x14, 0x20}, // RCL
+		4: {0x14, 0x70}, 5: {0x14, 0x70}, // PAC row 15, column 0
+		6: {'H', 'E'}, 7: {'L', 'L'}, 8: {'O', 0},
+		12: {0x14, 0x2f}, 13: {0x14, 0x2f}, // EOC
+		62: {0x14, 0x2c}, 63: {0x14, 0x2c}, // EDM
+	}
+
+	var w H264Writer
+	for i := 0; i < frames; i++ {
+		if i == 0 {
+			w.SPS(widthMbs, heightMbs, 25)
+			w.PPS()
+		}
+		pair, ok := pairs[i]
+		if !ok {
+			pair = [2]byte{0, 0}
+		}
+		w.A53(cc608Parity(pair[0]), cc608Parity(pair[1]))
+		w.Slice(widthMbs*heightMbs, i == 0)
+	}
+	return w.Buf
+}
+
+// Size of LetterboxH264() and height of its black bars
+const (
+	LetterboxWidth  = 320
+	LetterboxHeight = 240
+	LetterboxBar    = 48
+)
+
+// LetterboxH264 returns a LetterboxWidth x LetterboxHeight 25 fps raw H.264 video of 50 frames, a light gray
+// picture between black bars of LetterboxBar lines at the top and at the bottom. The frames 0 and 25 are IDR
+// frames of I_PCM macroblocks and the others skip all their macroblocks.
+func LetterboxH264() []byte {
+	const widthMbs, heightMbs, frames, gop = LetterboxWidth / 16, LetterboxHeight / 16, 50, 25
+
+	w := H264Writer{Luma: func(mb int) byte {
+		if row := mb / widthMbs; row < LetterboxBar/16 || row >= heightMbs-LetterboxBar/16 {
+			return 16
+		}
+		return 200
+	}}
+	for i := 0; i < frames; i++ {
+		idr := i%gop == 0
+		if idr {
+			w.SPS(widthMbs, heightMbs, 25)
+			w.PPS()
+		}
+		w.Slice(widthMbs*heightMbs, idr)
+	}
+	return w.Buf
+}
+
+// cc608Parity sets the odd parity bit of a CEA-608 byte
+func cc608Parity(b byte) byte {
+	n := 0
+	for c := b; c != 0; c >>= 1 {
+		n += int(c & 1)
+	}
+	if n%2 == 0 {
+		b |= 0x80
+	}
+	return b
+}
+
+// SpliceTS returns a 64x64 25 fps MPEG-TS video of 10 sec, with a SCTE-35 splice_insert cue sent at 3 sec that
+// splices at spliceTime sec, and the splice_info_section and the splice time (90kHz) of the cue.
+func SpliceTS(spliceTime float64) (ts []byte, cue []byte, splicePTS uint64, err error) {
+	const scte35PID = 0x101
+
+	p := &TSProgram{WidthMbs: 4, HeightMbs: 4, Frames: 250, FPS: 25, StartPTS: 900000}
+	splicePTS = uint64(p.StartPTS + int64(spliceTime*90000))
+	cue, err = (&scte35.SpliceInfoSection{
+		SAPType: 3,
+		CWIndex: 0xff,
+		Tier:    0xfff,
+		SpliceInsert: &scte35.SpliceInsert{
+			SpliceEventID:         1,
+			OutOfNetworkIndicator: true,
+			ProgramSpliceFlag:     true,
+			SpliceTime:            &scte35.SpliceTime{TimeSpecifiedFlag: true, PTSTime: splicePTS},
+		},
+	}).Encode()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	p.ProgramDescriptors = []byte{0x05, 0x04, 'C', 'U', 'E', 'I'} // registration descriptor of the SCTE-35 cues
+	p.Streams = []TSStream{{PID: scte35PID, StreamType: 0x86}}
+	p.Packets = func(frame int) []TSPayload {
+		if frame == 3*p.FPS {
+			return []TSPayload{{PID: scte35PID, Payload: append([]byte{0}, cue...)}}
+		}
+		return nil
+	}
+	return p.Bytes(), cue, splicePTS, nil
+}
+
+// TimedMetadataTS returns a 64x64 25 fps MPEG-TS video of 5 sec with a timed_id3 stream and a KLV stream, that
+// carry a PES packet every second with the frame sent at that time. The ID3 tag of the second n has a TXXX frame
+// "second" with the value n, and the KLV payload is a UAS Datalink Local Set with the mission id "MISSION<n>".
+// It returns the ID3 tags and the KLV payloads of the PES packets with their PTS (90kHz).
+func TimedMetadataTS() (b []byte, id3 [][]byte, klv [][]byte, pts []int64) {
+	const id3PID, klvPID = 0x102, 0x103
+
+	p := &TSProgram{WidthMbs: 4, HeightMbs: 4, Frames: 125, FPS: 25, StartPTS: 900000}
+	p.Streams = []TSStream{
+		// metadata_descriptor of ID3 metadata (metadata_application_format and metadata_format 'ID3 ')
+		{PID: id3PID, StreamType: 0x15, Descriptors: []byte{0x26, 0x0d,
+			0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f}},
+		// registration descriptor of the asynchronous KLV
+		{PID: klvPID, StreamType: 0x06, Descriptors: []byte{0x05, 0x04, 'K', 'L', 'V', 'A'}},
+	}
+	for n := 0; n < p.Frames/p.FPS; n++ {
+		id3 = append(id3, id3Tag("second", fmt.Sprint(n)))
+		klv = append(klv, uasMission(fmt.Sprintf("MISSION%d", n)))
+		pts = append(pts, p.FramePTS(n*p.FPS))
+	}
+	p.Packets = func(frame int) []TSPayload {
+		if frame%p.FPS != 0 {
+			return nil
+		}
+		n := frame / p.FPS
+		return []TSPayload{
+			{PID: id3PID, Payload: PES(0xbd, pts[n], id3[n])},
+			{PID: klvPID, Payload: PES(0xbd, pts[n], klv[n])},
+		}
+	}
+	return p.Bytes(), id3, klv, pts
+}
+
+// id3Tag returns an ID3v2.4 tag with a TXXX frame, the tag must be shorter than 128 bytes
+func id3Tag(description, value string) []byte {
+	frame := append([]byte{0x03}, description...) // UTF-8
+	frame = append(frame, 0)
+	frame = append(frame, value...)
+	tag := []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, byte(10 + len(frame))}
+	tag = append(tag, 'T', 'X', 'X', 'X', 0x00, 0x00, 0x00, byte(len(frame)), 0x00, 0x00)
+	return append(tag, frame...)
+}
+
+// uasMission returns a UAS Datalink Local Set with a mission id, the mission id must be shorter than 126 bytes
+func uasMission(missionID string) []byte {
+	b := append([]byte{}, ts.UASDatalinkLS...)
+	b = append(b, byte(2+len(missionID)), 3, byte(len(missionID)))
+	return append(b, missionID...)
+}
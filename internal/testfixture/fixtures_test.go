@@ -0,0 +1,76 @@
+package testfixture
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/eluv-io/avpipe/ts"
+	"github.com/eluv-io/avpipe/ts/mpegcrc"
+	"github.com/eluv-io/avpipe/ts/scte35"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpliceTS(t *testing.T) {
+	ts, cue, splicePTS, err := SpliceTS(5.2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(900000+468000), splicePTS)
+	require.Equal(t, 0, len(ts)%188)
+
+	sis, err := scte35.Parse(cue)
+	require.NoError(t, err)
+	require.Equal(t, splicePTS, sis.SpliceInsert.SpliceTime.PTSTime)
+
+	// The PAT and the PMT sections start in the first two packets, with a valid CRC
+	for i, pid := range []int{0, PMTPID} {
+		pkt := ts[i*188 : (i+1)*188]
+		require.Equal(t, byte(0x47), pkt[0])
+		require.Equal(t, pid, int(pkt[1]&0x1f)<<8|int(pkt[2]))
+		payload := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		section := payload[1:]
+		n := 3 + (int(section[1]&0x0f)<<8 | int(section[2]))
+		require.Equal(t, uint32(0), mpegcrc.Checksum(section[:n]))
+	}
+}
+
+func TestCaptionH264(t *testing.T) {
+	b := CaptionH264()
+	// SPS, PPS, SEI and IDR slice of the first frame
+	require.Equal(t, []byte{0, 0, 0, 1, 0x67}, b[:5])
+}
+
+func TestLetterboxH264(t *testing.T) {
+	b := LetterboxH264()
+	// SPS, PPS and IDR slice of the first frame, the I_PCM samples of the first macroblock row are black
+	require.Equal(t, []byte{0, 0, 0, 1, 0x67}, b[:5])
+	require.Contains(t, string(b), string(bytes.Repeat([]byte{16}, 256)))
+	require.Contains(t, string(b), string(bytes.Repeat([]byte{200}, 256)))
+}
+
+func TestTimedMetadataTS(t *testing.T) {
+	b, id3, klv, pts := TimedMetadataTS()
+	require.Equal(t, 0, len(b)%188)
+	require.Len(t, id3, 5)
+	require.Len(t, klv, 5)
+	require.Equal(t, []int64{900000, 990000, 1080000, 1170000, 1260000}, pts)
+
+	tags, err := ts.ParseID3(id3[1])
+	require.NoError(t, err)
+	require.Len(t, tags, 1)
+	require.Len(t, tags[0].Frames, 1)
+	desc, val, ok := tags[0].Frames[0].UserText()
+	require.True(t, ok)
+	require.Equal(t, "second", desc)
+	require.Equal(t, "1", val)
+
+	klvs, err := ts.ParseKLV(klv[1])
+	require.NoError(t, err)
+	require.Len(t, klvs, 1)
+	require.True(t, klvs[0].IsUASDatalinkLS())
+	items, err := klvs[0].LocalSet()
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, "MISSION1", string(items[0].Value))
+}
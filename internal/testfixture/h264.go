@@ -0,0 +1,168 @@
+/*
+ * Test fixtures of the avpipe tests, made at run time: raw H.264 (Annex B) baseline streams of
+ * I_PCM and skipped macroblocks, and MPEG-TS streams that carry them with SCTE-35 cues or timed
+ * metadata.
+ */
+package testfixture
+
+// H264Writer writes the NAL units of a raw (Annex B) H.264 baseline stream
+type H264Writer struct {
+	Buf  []byte
+	Luma func(mb int) byte // Luma of the I_PCM macroblock mb of the IDR frames, gray (128) if nil
+
+	rbsp     []byte
+	bits     uint
+	frameNum int
+	idrPicID int
+}
+
+func (w *H264Writer) u(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.rbsp = append(w.rbsp, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.rbsp[len(w.rbsp)-1] |= 0x80 >> (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code
+func (w *H264Writer) ue(v uint64) {
+	n := 0
+	for x := v + 1; x > 1; x >>= 1 {
+		n++
+	}
+	w.u(0, n)
+	w.u(v+1, n+1)
+}
+
+func (w *H264Writer) align() {
+	for w.bits%8 != 0 {
+		w.u(0, 1)
+	}
+}
+
+// nal ends the RBSP with the trailing bits and appends it as a NAL unit, with emulation prevention
+func (w *H264Writer) nal(refIdc, nalType byte) {
+	w.u(1, 1)
+	w.align()
+	w.Buf = append(w.Buf, 0, 0, 0, 1, refIdc<<5|nalType)
+	zeros := 0
+	for _, b := range w.rbsp {
+		if zeros >= 2 && b <= 3 {
+			w.Buf = append(w.Buf, 3)
+			zeros = 0
+		}
+		w.Buf = append(w.Buf, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	w.rbsp = w.rbsp[:0]
+	w.bits = 0
+}
+
+// SPS writes the SPS of a progressive stream of widthMbs x heightMbs macroblocks at fps frames per second
+func (w *H264Writer) SPS(widthMbs, heightMbs int, fps uint64) {
+	w.u(66, 8) // profile_idc baseline
+	w.u(0, 8)  // constraint_set flags
+	w.u(30, 8) // level_idc
+	w.ue(0)    // seq_parameter_set_id
+	w.ue(0)    // log2_max_frame_num_minus4
+	w.ue(2)    // pic_order_cnt_type
+	w.ue(1)    // max_num_ref_frames
+	w.u(0, 1)  // gaps_in_frame_num_value_allowed_flag
+	w.ue(uint64(widthMbs - 1))
+	w.ue(uint64(heightMbs - 1))
+	w.u(1, 1)      // frame_mbs_only_flag
+	w.u(1, 1)      // direct_8x8_inference_flag
+	w.u(0, 1)      // frame_cropping_flag
+	w.u(1, 1)      // vui_parameters_present_flag
+	w.u(0, 4)      // aspect_ratio, overscan, video_signal_type and chroma_loc info not present
+	w.u(1, 1)      // timing_info_present_flag
+	w.u(1, 32)     // num_units_in_tick
+	w.u(2*fps, 32) // time_scale
+	w.u(1, 1)      // fixed_frame_rate_flag
+	w.u(0, 4)      // no HRD, pic_struct and bitstream restriction
+	w.nal(3, 7)
+}
+
+// PPS writes a CAVLC PPS
+func (w *H264Writer) PPS() {
+	w.ue(0)   // pic_parameter_set_id
+	w.ue(0)   // seq_parameter_set_id
+	w.u(0, 1) // entropy_coding_mode_flag (CAVLC)
+	w.u(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)   // num_slice_groups_minus1
+	w.ue(0)   // num_ref_idx_l0_default_active_minus1
+	w.ue(0)   // num_ref_idx_l1_default_active_minus1
+	w.u(0, 3) // weighted_pred_flag, weighted_bipred_idc
+	w.ue(0)   // pic_init_qp_minus26
+	w.ue(0)   // pic_init_qs_minus26
+	w.ue(0)   // chroma_qp_index_offset
+	w.u(1, 1) // deblocking_filter_control_present_flag
+	w.u(0, 2) // constrained_intra_pred_flag, redundant_pic_cnt_present_flag
+	w.nal(3, 8)
+}
+
+// A53 writes an SEI of A/53 cc_data with one CEA-608 field 1 byte pair
+func (w *H264Writer) A53(c1, c2 byte) {
+	payload := []byte{0xb5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03, 0x40 | 1, 0xff, 0xfc, c1, c2, 0xff}
+	w.u(4, 8) // user_data_registered_itu_t_t35
+	w.u(uint64(len(payload)), 8)
+	for _, b := range payload {
+		w.u(uint64(b), 8)
+	}
+	w.nal(0, 6)
+}
+
+// Slice writes the slice of the next frame, of mbs macroblocks: an IDR slice of I_PCM macroblocks if idr
+// is set, or a P slice that skips all the macroblocks.
+func (w *H264Writer) Slice(mbs int, idr bool) {
+	if idr {
+		w.frameNum = 0
+	}
+	w.ue(0) // first_mb_in_slice
+	if idr {
+		w.ue(7) // slice_type I
+	} else {
+		w.ue(5) // slice_type P
+	}
+	w.ue(0)                       // pic_parameter_set_id
+	w.u(uint64(w.frameNum%16), 4) // frame_num
+	w.frameNum++
+	if idr {
+		w.ue(uint64(w.idrPicID % 2)) // idr_pic_id, differs between consecutive IDR frames
+		w.idrPicID++
+		w.u(0, 2) // no_output_of_prior_pics_flag, long_term_reference_flag
+	} else {
+		w.u(0, 2) // num_ref_idx_active_override_flag, ref_pic_list_modification_flag_l0
+		w.u(0, 1) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.ue(0) // slice_qp_delta
+	w.ue(1) // disable_deblocking_filter_idc
+	if idr {
+		for i := 0; i < mbs; i++ {
+			luma := byte(128)
+			if w.Luma != nil {
+				luma = w.Luma(i)
+			}
+			w.ue(25) // mb_type I_PCM
+			w.align()
+			for j := 0; j < 256; j++ {
+				w.u(uint64(luma), 8)
+			}
+			for j := 0; j < 128; j++ {
+				w.u(128, 8)
+			}
+		}
+		w.nal(3, 5)
+	} else {
+		w.ue(uint64(mbs)) // mb_skip_run
+		w.nal(2, 1)
+	}
+}
@@ -0,0 +1,156 @@
+package testfixture
+
+import "github.com/eluv-io/avpipe/ts/mpegcrc"
+
+const (
+	PMTPID   = 0x1000
+	VideoPID = 0x100
+)
+
+// TSStream is an elementary stream of a TSProgram besides its video
+type TSStream struct {
+	PID         int
+	StreamType  byte
+	Descriptors []byte // ES_info descriptors
+}
+
+// TSPayload is a PES packet, or a section with its pointer field, of the stream PID
+type TSPayload struct {
+	PID     int
+	Payload []byte
+}
+
+// TSProgram is a MPEG-TS of one program with a H.264 video of I_PCM and skipped macroblocks on VideoPID,
+// and other streams. The PAT and the PMT are repeated every second.
+type TSProgram struct {
+	WidthMbs, HeightMbs int
+	Frames, FPS         int
+	StartPTS            int64                       // PTS of the first frame (90kHz)
+	GOP                 int                         // IDR interval in frames, 0 means the first frame only
+	Luma                func(mb int) byte           // Luma of the I_PCM macroblocks, gray if nil
+	ProgramDescriptors  []byte                      // program_info descriptors
+	Streams             []TSStream                  // Streams besides the video
+	Packets             func(frame int) []TSPayload // Payloads of Streams sent before the frame, may be nil
+}
+
+// FramePTS returns the PTS of the frame (90kHz)
+func (p *TSProgram) FramePTS(frame int) int64 {
+	return p.StartPTS + int64(frame*90000/p.FPS)
+}
+
+// Bytes returns the TS packets of the program
+func (p *TSProgram) Bytes() []byte {
+	pat := PSISection(0x00, []byte{0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe0 | PMTPID>>8, PMTPID & 0xff})
+
+	pmt := []byte{0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe0 | VideoPID>>8, VideoPID & 0xff, // PCR_PID
+		0xf0 | byte(len(p.ProgramDescriptors)>>8), byte(len(p.ProgramDescriptors))}
+	pmt = append(pmt, p.ProgramDescriptors...)
+	pmt = append(pmt, 0x1b, 0xe0|VideoPID>>8, VideoPID&0xff, 0xf0, 0x00)
+	for _, s := range p.Streams {
+		pmt = append(pmt, s.StreamType, 0xe0|byte(s.PID>>8), byte(s.PID),
+			0xf0|byte(len(s.Descriptors)>>8), byte(len(s.Descriptors)))
+		pmt = append(pmt, s.Descriptors...)
+	}
+	pmt = PSISection(0x02, pmt)
+
+	w := H264Writer{Luma: p.Luma}
+	ts := &TSWriter{}
+	for i := 0; i < p.Frames; i++ {
+		if i%p.FPS == 0 {
+			ts.Write(0, append([]byte{0}, pat...), -1)
+			ts.Write(PMTPID, append([]byte{0}, pmt...), -1)
+		}
+		if p.Packets != nil {
+			for _, payload := range p.Packets(i) {
+				ts.Write(payload.PID, payload.Payload, -1)
+			}
+		}
+
+		start := len(w.Buf)
+		idr := i == 0 || (p.GOP > 0 && i%p.GOP == 0)
+		if idr {
+			w.SPS(p.WidthMbs, p.HeightMbs, uint64(p.FPS))
+			w.PPS()
+		}
+		w.Slice(p.WidthMbs*p.HeightMbs, idr)
+		pts := p.FramePTS(i)
+		ts.Write(VideoPID, PES(0xe0, pts, w.Buf[start:]), pts-9000)
+	}
+	return ts.Buf
+}
+
+// PES returns a PES packet of the stream_id with a PTS (90kHz) and an unbounded length if it doesn't fit
+func PES(streamID byte, pts int64, data []byte) []byte {
+	n := 8 + len(data)
+	if n > 0xffff {
+		n = 0
+	}
+	pes := []byte{0x00, 0x00, 0x01, streamID, byte(n >> 8), byte(n), 0x80, 0x80, 0x05,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14) | 0x01, byte(pts >> 7), byte(pts<<1) | 0x01}
+	return append(pes, data...)
+}
+
+// PSISection returns a PSI section of the table with the section syntax, the section length and the CRC
+func PSISection(tableID byte, body []byte) []byte {
+	n := len(body) + 4
+	b := append([]byte{tableID, 0xb0 | byte(n>>8), byte(n)}, body...)
+	crc := mpegcrc.Checksum(b)
+	return append(b, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// TSWriter writes MPEG-TS packets
+type TSWriter struct {
+	Buf []byte
+	cc  map[int]byte
+}
+
+// Write writes the payload (a PES packet or a PSI section with its pointer field) in TS packets of pid,
+// with a PCR (90kHz) in the first one if pcr is not negative. The last packet is stuffed with an
+// adaptation field.
+func (w *TSWriter) Write(pid int, payload []byte, pcr int64) {
+	if w.cc == nil {
+		w.cc = map[int]byte{}
+	}
+	for first := true; first || len(payload) > 0; first = false {
+		var af []byte // Adaptation field after its length
+		if first && pcr >= 0 {
+			af = []byte{0x10, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7) | 0x7e, 0x00}
+		}
+		room := 184
+		if af != nil {
+			room -= 1 + len(af)
+		}
+		if len(payload) < room {
+			if af == nil {
+				af = []byte{}
+				room--
+				if len(payload) < room {
+					af = append(af, 0x00)
+					room--
+				}
+			}
+			for len(payload) < room {
+				af = append(af, 0xff)
+				room--
+			}
+		}
+
+		b1 := byte(pid >> 8)
+		if first {
+			b1 |= 0x40 // payload_unit_start_indicator
+		}
+		afc := byte(0x10)
+		if af != nil {
+			afc = 0x30
+		}
+		w.Buf = append(w.Buf, 0x47, b1, byte(pid), afc|w.cc[pid])
+		w.cc[pid] = (w.cc[pid] + 1) & 0x0f
+		if af != nil {
+			w.Buf = append(w.Buf, byte(len(af)))
+			w.Buf = append(w.Buf, af...)
+		}
+		w.Buf = append(w.Buf, payload[:room]...)
+		payload = payload[room:]
+	}
+}
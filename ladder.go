@@ -0,0 +1,400 @@
+/*
+ * Per-title encoding: encodes sampled segments of a title at several resolutions and CRFs,
+ * measures their bitrate and quality, and recommends a CRF and a bitrate ladder.
+ */
+package avpipe
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	ladderDefaultSamples        = 3
+	ladderDefaultSampleDuration = 4.0
+	ladderDefaultTargetVmaf     = 93.0
+	ladderDefaultTargetPsnr     = 42.0
+	ladderReferenceCrf          = "10" // CRF of the sampled segments, the reference of the quality measures
+	ladderMinRungStep           = 0.8  // A rung has at most 80% of the bitrate of the rung above
+)
+
+var (
+	ladderDefaultCrfs    = []int{18, 23, 28, 33}
+	ladderDefaultHeights = []int{1080, 720, 540, 360, 270}
+)
+
+// LadderParams are the parameters of the sampled encodes of AnalyzeLadder(), the zero value uses the defaults.
+type LadderParams struct {
+	Samples        int     `json:"samples,omitempty"`         // Number of sampled segments, 3 if not set
+	SampleDuration float64 `json:"sample_duration,omitempty"` // Duration of a sampled segment (sec), 4 if not set
+	Crfs           []int   `json:"crfs,omitempty"`            // CRFs encoded at each resolution, 18, 23, 28 and 33 if not set
+	Heights        []int   `json:"heights,omitempty"`         // Heights of the rungs, 1080, 720, 540, 360 and 270 if not set
+	TargetVmaf     float64 `json:"target_vmaf,omitempty"`     // VMAF of the top rung, 93 if not set
+	TargetPsnr     float64 `json:"target_psnr,omitempty"`     // PSNR of the top rung (dB) when VMAF is not available, 42 if not set
+}
+
+// LadderPoint is the bitrate and the quality of the sampled segments encoded at one resolution and one CRF.
+type LadderPoint struct {
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Crf     int     `json:"crf"`
+	Bitrate int     `json:"bitrate"` // Bits per second
+	Quality float64 `json:"quality"` // Mean VMAF or PSNR of the frames, compared at the source resolution
+}
+
+// LadderRung is a rung of the recommended ladder, encoded with the recommended CRF. The bitrate and the
+// quality are interpolated from the sampled encodes.
+type LadderRung struct {
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Bitrate int     `json:"bitrate"`
+	Quality float64 `json:"quality"`
+}
+
+// LadderReport is the result of AnalyzeLadder().
+type LadderReport struct {
+	Metric string         `json:"metric"` // "vmaf", or "psnr" if FFmpeg is built without libvmaf
+	Crf    int            `json:"crf"`    // Highest CRF that reaches the target quality at the top resolution
+	Rungs  []*LadderRung  `json:"rungs"`  // From the top resolution
+	Points []*LadderPoint `json:"points"`
+}
+
+// Apply sets the resolution of the rung and the recommended CRF to params.
+func (r *LadderReport) Apply(params *XcParams, rung int) error {
+	if rung < 0 || rung >= len(r.Rungs) {
+		return fmt.Errorf("invalid ladder rung=%d, the ladder has %d rungs", rung, len(r.Rungs))
+	}
+	params.EncWidth = int32(r.Rungs[rung].Width)
+	params.EncHeight = int32(r.Rungs[rung].Height)
+	params.CrfStr = strconv.Itoa(r.Crf)
+	params.VideoBitrate = -1
+	return nil
+}
+
+// AnalyzeLadder recommends a CRF and a bitrate ladder for the video of params.Url, opened with inputOpener.
+// lp.Samples segments of lp.SampleDuration are taken evenly from the video and encoded with params (the
+// codec, preset, ...) at every height of lp.Heights not above the source one and every CRF of lp.Crfs.
+// The encodes are compared to the segments at the source resolution with VMAF (PSNR if FFmpeg is built
+// without libvmaf). The recommended CRF is the highest one that reaches the target quality at the top
+// resolution, and each rung gets the bitrate of its resolution at that CRF. A rung that does not save
+// enough bitrate from the rung above is dropped. The encodes are written in workDir.
+func AnalyzeLadder(params *XcParams, lp *LadderParams, workDir string, inputOpener InputOpener) (*LadderReport, error) {
+	if params == nil {
+		log.Error("Failed ladder analysis, params are not set")
+		return nil, EAV_PARAM
+	}
+	if lp == nil {
+		lp = &LadderParams{}
+	}
+
+	la := &ladderAnalysis{params: params, lp: *lp, workDir: workDir, inputOpener: inputOpener}
+	if err := la.init(); err != nil {
+		return nil, err
+	}
+
+	if err := la.encodeSamples(); err != nil {
+		return nil, err
+	}
+
+	points := map[int][]*LadderPoint{}
+	for _, height := range la.heights {
+		for _, crf := range la.lp.Crfs {
+			point, err := la.measure(height, crf)
+			if err != nil {
+				return nil, err
+			}
+			points[height] = append(points[height], point)
+		}
+	}
+
+	report := &LadderReport{Metric: la.metric}
+	for _, height := range la.heights {
+		report.Points = append(report.Points, points[height]...)
+	}
+	target := la.lp.TargetVmaf
+	if la.metric == "psnr" {
+		target = la.lp.TargetPsnr
+	}
+	report.Crf = ladderCrf(points[la.heights[0]], target)
+	report.Rungs = ladderRungs(la.heights, points, report.Crf)
+
+	log.Info("AnalyzeLadder", "url", params.Url, "metric", report.Metric, "crf", report.Crf, "rungs", len(report.Rungs))
+	return report, nil
+}
+
+// ladderAnalysis keeps the sampled segments of a ladder analysis
+type ladderAnalysis struct {
+	params      *XcParams
+	lp          LadderParams
+	workDir     string
+	inputOpener InputOpener
+
+	probe     *ProbeInfo
+	video     *StreamInfo
+	frameRate float64
+	heights   []int    // Heights of the rungs, from the top
+	samples   []string // Paths of the sampled segments
+	seconds   float64  // Duration of the sampled segments
+	metric    string
+}
+
+func (la *ladderAnalysis) init() error {
+	if la.lp.Samples <= 0 {
+		la.lp.Samples = ladderDefaultSamples
+	}
+	if la.lp.SampleDuration <= 0 {
+		la.lp.SampleDuration = ladderDefaultSampleDuration
+	}
+	if len(la.lp.Crfs) == 0 {
+		la.lp.Crfs = ladderDefaultCrfs
+	}
+	if len(la.lp.Heights) == 0 {
+		la.lp.Heights = ladderDefaultHeights
+	}
+	if la.lp.TargetVmaf <= 0 {
+		la.lp.TargetVmaf = ladderDefaultTargetVmaf
+	}
+	if la.lp.TargetPsnr <= 0 {
+		la.lp.TargetPsnr = ladderDefaultTargetPsnr
+	}
+	la.lp.Crfs = append([]int{}, la.lp.Crfs...)
+	sort.Ints(la.lp.Crfs)
+
+	InitUrlIOHandler(la.params.Url, la.inputOpener, &dirOutputOpener{dir: la.workDir})
+	probe, err := Probe(&XcParams{Url: la.params.Url, Seekable: la.params.Seekable})
+	if err != nil {
+		return fmt.Errorf("failed to probe ladder source %s: %w", la.params.Url, err)
+	}
+	vs := probeStream(probe, "video", -1)
+	if vs == nil || vs.Width <= 0 || vs.Height <= 0 {
+		return fmt.Errorf("ladder source %s has no video", la.params.Url)
+	}
+	frameRate := vs.AvgFrameRate
+	if frameRate == nil || frameRate.Sign() <= 0 {
+		frameRate = vs.FrameRate
+	}
+	if frameRate == nil || frameRate.Sign() <= 0 {
+		return fmt.Errorf("ladder source %s has no video frame rate", la.params.Url)
+	}
+	la.probe, la.video = probe, vs
+	la.frameRate, _ = frameRate.Float64()
+
+	heights := append([]int{}, la.lp.Heights...)
+	sort.Sort(sort.Reverse(sort.IntSlice(heights)))
+	for _, height := range heights {
+		if height > 0 && height <= vs.Height && (len(la.heights) == 0 || height != la.heights[len(la.heights)-1]) {
+			la.heights = append(la.heights, height)
+		}
+	}
+	if len(la.heights) == 0 {
+		la.heights = []int{vs.Height}
+	}
+
+	// The samples are spread evenly over the video, one sample is the whole video if it is too short
+	duration := probe.ContainerInfo.Duration
+	if duration <= 0 {
+		return fmt.Errorf("ladder source %s has no duration", la.params.Url)
+	}
+	if duration < float64(la.lp.Samples)*la.lp.SampleDuration {
+		la.lp.Samples = int(duration / la.lp.SampleDuration)
+		if la.lp.Samples == 0 {
+			la.lp.Samples, la.lp.SampleDuration = 1, duration
+		}
+	}
+
+	return os.MkdirAll(la.workDir, 0755)
+}
+
+// encodeSamples encodes the sampled segments at the source resolution with ladderReferenceCrf, they are the
+// source of the encodes and the reference of the quality measures.
+func (la *ladderAnalysis) encodeSamples() error {
+	duration := la.probe.ContainerInfo.Duration
+
+	for i := 0; i < la.lp.Samples; i++ {
+		in := (duration - la.lp.SampleDuration) * float64(2*i+1) / float64(2*la.lp.Samples)
+
+		xp := la.xcParams(la.params.Url)
+		xp.StartTimeTs = secondsToTs(in, la.video.TimeBase)
+		xp.DurationTs = secondsToTs(la.lp.SampleDuration, la.video.TimeBase)
+		xp.EncWidth, xp.EncHeight = int32(la.video.Width), int32(la.video.Height)
+		xp.CrfStr = ladderReferenceCrf
+
+		opener, err := la.xc(xp, filepath.Join(la.workDir, fmt.Sprintf("sample-%03d", i+1)), la.inputOpener)
+		if err != nil {
+			return fmt.Errorf("ladder sample %d: %w", i+1, err)
+		}
+		la.samples = append(la.samples, opener.path)
+		la.seconds += float64(opener.frames) / la.frameRate
+	}
+
+	return nil
+}
+
+// measure encodes the sampled segments at height and crf, and returns their bitrate and mean quality.
+func (la *ladderAnalysis) measure(height, crf int) (*LadderPoint, error) {
+	point := &LadderPoint{
+		Width:  int(math.Round(float64(la.video.Width)*float64(height)/float64(la.video.Height)/2)) * 2,
+		Height: height,
+		Crf:    crf,
+	}
+
+	var bits, quality float64
+	var frames int
+	for i, sample := range la.samples {
+		dir := filepath.Join(la.workDir, fmt.Sprintf("sample-%03d", i+1), fmt.Sprintf("%dp-crf%d", height, crf))
+
+		xp := la.xcParams(sample)
+		xp.EncWidth, xp.EncHeight = int32(point.Width), int32(height)
+		xp.CrfStr = strconv.Itoa(crf)
+		xp.Crop = ""
+		xp.FpsMode = FpsModeNone
+		xp.Deinterlace = 0
+
+		opener, err := la.xc(xp, dir, &localInputOpener{})
+		if err != nil {
+			return nil, fmt.Errorf("ladder sample %d %dp crf %d: %w", i+1, height, crf, err)
+		}
+		fi, err := os.Stat(opener.path)
+		if err != nil {
+			return nil, err
+		}
+		bits += float64(fi.Size() * 8)
+
+		InitUrlIOHandler(sample, &localInputOpener{}, &dirOutputOpener{dir: dir})
+		InitUrlIOHandler(opener.path, &localInputOpener{}, &dirOutputOpener{dir: dir})
+		report, err := Compare(&CompareParams{
+			ReferenceUrl: sample,
+			DistortedUrl: opener.path,
+			Vmaf:         la.metric != "psnr",
+			Seekable:     true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("ladder sample %d %dp crf %d: failed to compare: %w", i+1, height, crf, err)
+		}
+		if la.metric == "" {
+			la.metric = report.Metric
+			if la.metric != "vmaf" {
+				la.metric = "psnr"
+			}
+		}
+		stats := report.Psnr
+		if la.metric == "vmaf" {
+			stats = report.Vmaf
+		}
+		if stats == nil {
+			return nil, fmt.Errorf("ladder sample %d %dp crf %d: no %s score", i+1, height, crf, la.metric)
+		}
+		quality += stats.Mean * float64(report.NFrames)
+		frames += report.NFrames
+	}
+
+	point.Bitrate = int(bits / la.seconds)
+	if frames > 0 {
+		point.Quality = quality / float64(frames)
+	}
+	log.Info("AnalyzeLadder point", "url", la.params.Url, "width", point.Width, "height", point.Height,
+		"crf", crf, "bitrate", point.Bitrate, la.metric, point.Quality)
+	return point, nil
+}
+
+// xcParams returns the video only parameters of an encode of the analysis from url.
+func (la *ladderAnalysis) xcParams(url string) *XcParams {
+	xp := *la.params
+	xp.Url = url
+	xp.Format = "fmp4-segment"
+	xp.XcType = XcVideo
+	xp.StreamId = -1
+	xp.StartSegmentStr = "1"
+	xp.StartTimeTs = 0
+	xp.DurationTs = -1
+	xp.VideoBitrate = -1
+	xp.RcMaxRate = 0
+	xp.RcBufferSize = 0
+	xp.VideoSegDurationTs = -1
+	xp.SegDuration = strconv.Itoa(int(la.lp.SampleDuration) + 10)
+	xp.MuxingSpec = ""
+	return &xp
+}
+
+// xc encodes xp in dir and returns the output opener, which has the path and the number of frames of the output.
+func (la *ladderAnalysis) xc(xp *XcParams, dir string, inputOpener InputOpener) (*dirOutputOpener, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	opener := &dirOutputOpener{dir: dir}
+	InitUrlIOHandler(xp.Url, inputOpener, opener)
+	if err := Xc(xp); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", xp.Url, err)
+	}
+	if opener.err != nil {
+		return nil, opener.err
+	}
+	if opener.path == "" || opener.frames == 0 {
+		return nil, fmt.Errorf("no frames encoded from %s", xp.Url)
+	}
+	return opener, nil
+}
+
+// ladderCrf returns the highest CRF whose quality reaches target, interpolated between the sampled CRFs of
+// points (sorted by CRF). It is the lowest sampled CRF if none reaches the target, and the highest one if
+// all do.
+func ladderCrf(points []*LadderPoint, target float64) int {
+	if len(points) == 0 {
+		return 0
+	}
+	if points[0].Quality < target {
+		return points[0].Crf
+	}
+	for i := 1; i < len(points); i++ {
+		p1, p2 := points[i-1], points[i]
+		if p2.Quality >= target {
+			continue
+		}
+		return p1.Crf + int(math.Floor((p1.Quality-target)/(p1.Quality-p2.Quality)*float64(p2.Crf-p1.Crf)))
+	}
+	return points[len(points)-1].Crf
+}
+
+// ladderInterpolate returns the bitrate and the quality of points (sorted by CRF) at crf, the bitrate is
+// interpolated in the log domain.
+func ladderInterpolate(points []*LadderPoint, crf int) (int, float64) {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Crf >= crf })
+	switch {
+	case i == 0:
+		return points[0].Bitrate, points[0].Quality
+	case i == len(points):
+		return points[i-1].Bitrate, points[i-1].Quality
+	}
+
+	p1, p2 := points[i-1], points[i]
+	x := float64(crf-p1.Crf) / float64(p2.Crf-p1.Crf)
+	bitrate := math.Exp(math.Log(float64(p1.Bitrate)) + x*(math.Log(float64(p2.Bitrate))-math.Log(float64(p1.Bitrate))))
+	return int(math.Round(bitrate)), p1.Quality + x*(p2.Quality-p1.Quality)
+}
+
+// ladderRungs returns the rungs of heights (from the top) at crf. A rung is dropped if its bitrate is more
+// than ladderMinRungStep of the bitrate of the rung above.
+func ladderRungs(heights []int, points map[int][]*LadderPoint, crf int) []*LadderRung {
+	var rungs []*LadderRung
+	for _, height := range heights {
+		if len(points[height]) == 0 {
+			continue
+		}
+		bitrate, quality := ladderInterpolate(points[height], crf)
+		if len(rungs) > 0 && float64(bitrate) > ladderMinRungStep*float64(rungs[len(rungs)-1].Bitrate) {
+			continue
+		}
+		rungs = append(rungs, &LadderRung{
+			Width:   points[height][0].Width,
+			Height:  height,
+			Bitrate: bitrate,
+			Quality: quality,
+		})
+	}
+	return rungs
+}
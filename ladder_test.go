@@ -0,0 +1,71 @@
+package avpipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ladderTestPoints(height int, bitrates []int, qualities []float64) []*LadderPoint {
+	var points []*LadderPoint
+	for i, crf := range []int{18, 23, 28, 33} {
+		points = append(points, &LadderPoint{
+			Width:   height * 16 / 9,
+			Height:  height,
+			Crf:     crf,
+			Bitrate: bitrates[i],
+			Quality: qualities[i],
+		})
+	}
+	return points
+}
+
+func TestLadderCrf(t *testing.T) {
+	points := ladderTestPoints(1080, []int{8000000, 5000000, 3000000, 1800000}, []float64{97, 95, 91, 85})
+
+	require.Equal(t, 25, ladderCrf(points, 93))
+	require.Equal(t, 23, ladderCrf(points, 95))
+	require.Equal(t, 18, ladderCrf(points, 99))
+	require.Equal(t, 33, ladderCrf(points, 80))
+	require.Equal(t, 0, ladderCrf(nil, 93))
+
+	bitrate, quality := ladderInterpolate(points, 25)
+	require.InDelta(t, 4075000, bitrate, 1000)
+	require.InDelta(t, 93.4, quality, 0.001)
+
+	bitrate, quality = ladderInterpolate(points, 10)
+	require.Equal(t, 8000000, bitrate)
+	require.Equal(t, 97.0, quality)
+
+	bitrate, quality = ladderInterpolate(points, 40)
+	require.Equal(t, 1800000, bitrate)
+	require.Equal(t, 85.0, quality)
+}
+
+func TestLadderRungs(t *testing.T) {
+	// The 720p rung saves too little bitrate from the 1080p rung, as with simple animation
+	points := map[int][]*LadderPoint{
+		1080: ladderTestPoints(1080, []int{4000000, 2000000, 1000000, 500000}, []float64{97, 95, 91, 85}),
+		720:  ladderTestPoints(720, []int{3600000, 1800000, 900000, 450000}, []float64{96, 94, 90, 84}),
+		360:  ladderTestPoints(360, []int{1200000, 600000, 300000, 150000}, []float64{85, 83, 80, 75}),
+	}
+
+	rungs := ladderRungs([]int{1080, 720, 360}, points, 23)
+	require.Equal(t, 2, len(rungs))
+	require.Equal(t, 1080, rungs[0].Height)
+	require.Equal(t, 1920, rungs[0].Width)
+	require.Equal(t, 2000000, rungs[0].Bitrate)
+	require.Equal(t, 360, rungs[1].Height)
+	require.Equal(t, 600000, rungs[1].Bitrate)
+	require.Equal(t, 83.0, rungs[1].Quality)
+
+	report := &LadderReport{Crf: 23, Rungs: rungs}
+	params := NewXcParams()
+	params.VideoBitrate = 1000000
+	require.NoError(t, report.Apply(params, 1))
+	require.Equal(t, int32(640), params.EncWidth)
+	require.Equal(t, int32(360), params.EncHeight)
+	require.Equal(t, "23", params.CrfStr)
+	require.Equal(t, int32(-1), params.VideoBitrate)
+	require.Error(t, report.Apply(params, 2))
+}
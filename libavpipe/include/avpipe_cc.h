@@ -0,0 +1,190 @@
+/*
+ * avpipe_cc.h
+ *
+ * CEA-608 and CEA-708 closed caption decoding from A/53 cc_data, and WebVTT/TTML segment documents.
+ */
+
+#ifndef AVPIPE_CC_H
+#define AVPIPE_CC_H
+#pragma once
+
+#include <stdint.h>
+
+#define CC_608_TRACKS       4           /* CC1-CC4 */
+#define CC_708_SERVICES     6           /* SERVICE1-SERVICE6 */
+#define CC_MAX_TRACKS       (CC_608_TRACKS + CC_708_SERVICES)
+#define CC_MAX_CUES         256         /* Pending cues of a track */
+#define CC_NO_END           INT64_MAX   /* End of a cue that is still displayed */
+
+#define CC_608_ROWS         15
+#define CC_608_COLS         32
+#define CC_708_WINDOWS      8
+#define CC_708_ROWS         15
+#define CC_708_COLS         42
+
+#define CC_A53_QUEUE_SIZE   4096        /* Pending cc_data_pkt of a queue */
+#define CC_A53_MAX_COUNT    31          /* Maximum cc_count of a frame */
+
+typedef enum cc_format_t {
+    cc_format_webvtt = 1,               // WebVTT (HLS)
+    cc_format_ttml = 2                  // TTML, IMSC1 text profile (DASH)
+} cc_format_t;
+
+typedef struct cc_cue_t {
+    int64_t     start;                  // In the time base of the pts passed to cc_decode()
+    int64_t     end;                    // CC_NO_END while the cue is displayed
+    char        *text;                  // UTF-8, rows separated by '\n'
+} cc_cue_t;
+
+typedef struct cc_track_t {
+    cc_cue_t    cues[CC_MAX_CUES];      // Cues that are not written completely, in order
+    int         n_cues;
+    int         active;                 // Set by the first cue, segments are only written for active tracks
+    int         n_segments;             // Number of segments written
+} cc_track_t;
+
+typedef enum cc_608_mode_t {
+    cc_608_popon = 0,
+    cc_608_rollup,
+    cc_608_painton,
+    cc_608_text                         // Text mode, the characters are ignored
+} cc_608_mode_t;
+
+/* CEA-608 data channel decoder */
+typedef struct cc_608_t {
+    uint32_t        screen[2][CC_608_ROWS][CC_608_COLS];    // Displayed and non-displayed memory
+    int             displayed;          // Index of the displayed memory
+    cc_608_mode_t   mode;
+    int             rollup_rows;
+    int             row;
+    int             col;
+    int             scroll;             // Roll-up scroll pending since the last CR
+    int             changed;            // The displayed memory changed and is shown
+} cc_608_t;
+
+typedef struct cc_708_window_t {
+    int         defined;
+    int         visible;
+    int         row_count;
+    int         col_count;
+    int         pen_row;
+    int         pen_col;
+    uint32_t    text[CC_708_ROWS][CC_708_COLS];
+} cc_708_window_t;
+
+/* CEA-708 service decoder */
+typedef struct cc_708_t {
+    cc_708_window_t windows[CC_708_WINDOWS];
+    int             current;            // Current window, -1 if none
+    int             changed;
+} cc_708_t;
+
+typedef struct cc_ctx_t {
+    cc_608_t    cc608[CC_608_TRACKS];
+    int         channel[2];             // Last data channel selected in each field
+    uint8_t     last_code[2][2];        // Last control code of each field, to drop the repeated codes
+    cc_708_t    svc708[CC_708_SERVICES];
+    uint8_t     dtvcc[128];             // DTVCC packet being assembled
+    int         dtvcc_len;
+    cc_track_t  tracks[CC_MAX_TRACKS];
+} cc_ctx_t;
+
+typedef struct cc_a53_queue_t {
+    uint8_t     data[CC_A53_QUEUE_SIZE][3];
+    int         head;
+    int         n;
+} cc_a53_queue_t;
+
+/*
+ * A/53 cc_data re-packing, for the captions passed through to the encoded video. The cc_data of the
+ * decoded frames is queued and re-packed with the cc_count of the output frame rate, so that the
+ * captions survive the filters that drop, duplicate or retime the frames.
+ */
+typedef struct cc_a53_t {
+    cc_a53_queue_t  field[2];           // CEA-608 byte pairs of field 1 and field 2
+    cc_a53_queue_t  dtvcc;              // CEA-708 DTVCC packet data
+    int             detected;           // Set by the first valid cc_data_pkt
+    int64_t         dropped;            // Number of cc_data_pkt dropped because a queue was full
+} cc_a53_t;
+
+cc_ctx_t *
+cc_ctx_new();
+
+void
+cc_ctx_free(
+    cc_ctx_t *cc);
+
+/*
+ * Decodes the cc_data of a frame (AV_FRAME_DATA_A53_CC, 3 bytes per cc_data_pkt) presented at pts.
+ * The frames must be passed in presentation order.
+ */
+void
+cc_decode(
+    cc_ctx_t *cc,
+    const uint8_t *cc_data,
+    int size,
+    int64_t pts);
+
+/*
+ * Ends the cues that are displayed at pts, at the end of the input.
+ */
+void
+cc_flush(
+    cc_ctx_t *cc,
+    int64_t pts);
+
+/*
+ * Returns the document of the segment [start, end) of the track in a malloc'd string, with the cues
+ * clipped to the segment. The time base of the pts is tb_num/tb_den.
+ */
+char *
+cc_segment_document(
+    cc_track_t *track,
+    cc_format_t format,
+    int64_t start,
+    int64_t end,
+    int tb_num,
+    int tb_den);
+
+/*
+ * Drops the cues that end before end, once the segment that ends at end is written.
+ */
+void
+cc_segment_done(
+    cc_track_t *track,
+    int64_t end);
+
+/*
+ * Queues the valid cc_data_pkt of the cc_data of a decoded frame (3 bytes per cc_data_pkt).
+ */
+void
+cc_a53_push(
+    cc_a53_t *a53,
+    const uint8_t *cc_data,
+    int size);
+
+/*
+ * Writes the cc_data of an output frame, cc_count cc_data_pkt (3 * cc_count bytes): a field 1 and a
+ * field 2 CEA-608 pair, then DTVCC data, padded with invalid cc_data_pkt.
+ */
+void
+cc_a53_pop(
+    cc_a53_t *a53,
+    uint8_t *cc_data,
+    int cc_count);
+
+/*
+ * Returns the cc_count of a frame at frame_rate frames per second: A/53 carries 600 cc_data_pkt per second.
+ */
+int
+cc_a53_count(
+    double frame_rate);
+
+/*
+ * Returns the name of a track: CC1-CC4 or SERVICE1-SERVICE6.
+ */
+const char *
+cc_track_name(
+    int track);
+
+#endif
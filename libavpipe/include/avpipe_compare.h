@@ -0,0 +1,85 @@
+/*
+ * avpipe_compare.h
+ *
+ * Objective quality of a distorted video (an output of a transcoding) compared to its
+ * reference (the mezzanine): per frame and aggregate PSNR, SSIM and VMAF.
+ */
+
+#ifndef AVPIPE_COMPARE_H
+#define AVPIPE_COMPARE_H
+#pragma once
+
+#define COMPARE_MAX_PSNR                100.0   /* dB, the PSNR of identical frames is capped */
+#define COMPARE_DEFAULT_SEG_DURATION    2.0     /* Seconds */
+#define COMPARE_DEFAULT_N_WORST         5
+
+typedef struct compare_params_t {
+    char    *reference_url;
+    char    *distorted_url;
+    int     width;                      // Common resolution of the comparison, the reference one if not set
+    int     height;
+    double  offset;                     // Seconds added to the timestamps of the distorted to align it on the reference
+    int     vmaf;                       // If set, VMAF is computed (the FFmpeg build needs libvmaf)
+    char    *vmaf_model;                // Path of the VMAF model, the libvmaf default model if not set
+    double  seg_duration;               // Duration of the segments of the worst segments (sec)
+    int     n_worst;                    // Number of worst segments in the report
+    int     seekable;
+    int     debug_frame_level;
+} compare_params_t;
+
+/*
+ * The scores of a frame of the distorted video. The time is in seconds, in the time line
+ * of the reference.
+ */
+typedef struct compare_frame_t {
+    double  time;
+    double  psnr;                       // Average PSNR of the planes (dB), capped at COMPARE_MAX_PSNR
+    double  ssim;                       // SSIM of all the planes, from 0 to 1
+    double  vmaf;                       // VMAF score from 0 to 100, or -1 if VMAF is not computed
+} compare_frame_t;
+
+typedef struct compare_result_t {
+    compare_frame_t *frames;
+    int             n_frames;
+    int             size;
+    int             width;
+    int             height;
+    int             has_vmaf;
+} compare_result_t;
+
+int
+compare_result_add(
+    compare_result_t *result,
+    const compare_frame_t *frame);
+
+void
+compare_result_free(
+    compare_result_t *result);
+
+/*
+ * Reads the per frame VMAF scores of the JSON log of libvmaf (log_fmt=json) and sets
+ * them on the frames of result, in order. Returns the number of scores read, or -1 if
+ * the log can't be read.
+ */
+int
+compare_read_vmaf_log(
+    compare_result_t *result,
+    const char *path);
+
+/*
+ * Returns the JSON document of the comparison, to be freed by the caller. The worst
+ * segments are the n_worst segments of seg_duration with the lowest mean VMAF (SSIM if
+ * there is no VMAF), the percentiles are the nearest rank ones:
+ * {"width":1920,"height":1080,"n_frames":1800,"metric":"ssim",
+ *  "psnr":{"mean":41.2,"min":35.1,"max":48.9,"p1":36.0,"p5":37.2,"p10":38.1,"p50":41.3},
+ *  "ssim":{...},"vmaf":{...},
+ *  "worst_segments":[{"start":10.000,"end":12.000,"psnr":36.2,"ssim":0.951,"vmaf":82.1}, ...],
+ *  "frames":[{"time":0.000,"psnr":42.1,"ssim":0.987,"vmaf":95.3}, ...]}
+ */
+char *
+compare_report_json(
+    const compare_result_t *result,
+    double seg_duration,
+    int n_worst);
+
+#endif
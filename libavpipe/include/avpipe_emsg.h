@@ -0,0 +1,85 @@
+/*
+ * avpipe_emsg.h
+ *
+ * DASH/CMAF event message (emsg) boxes carrying SCTE-35 and ID3 timed metadata
+ * in fragmented MP4 segments.
+ */
+
+#ifndef AVPIPE_EMSG_H
+#define AVPIPE_EMSG_H
+#pragma once
+
+#include <stdint.h>
+
+#define EMSG_SCHEME_SCTE35      "urn:scte:scte35:2013:bin"          /* SCTE 214-3, message_data is a splice_info_section */
+#define EMSG_SCHEME_ID3         "https://aomedia.org/emsg/ID3"      /* AOM ID3 in CMAF, message_data is an ID3v2 tag */
+#define EMSG_DURATION_UNKNOWN   0xFFFFFFFF
+#define MAX_EMSG_EVENTS         256                                 /* Pending emsg events */
+
+typedef struct emsg_event_t {
+    const char  *scheme_id_uri;
+    const char  *value;
+    int64_t     pts;                    // Presentation time in the video decoder time base
+    int64_t     duration;               // Duration (90kHz), or EMSG_DURATION_UNKNOWN
+    uint32_t    id;
+    uint8_t     *message_data;
+    int         message_size;
+
+    /* Set when the box is written in an output segment */
+    uint32_t    timescale;
+    uint64_t    presentation_time;
+    uint32_t    event_duration;
+    int         seg_index;
+} emsg_event_t;
+
+/*
+ * Tracks the top level boxes of a fragmented MP4 output, so emsg boxes can be inserted before a moof.
+ */
+typedef struct mp4_box_scanner_t {
+    uint8_t     header[16];             // Header of the next box, if it is split across writes
+    int         header_len;
+    int         header_done;            // The header is complete and was returned by mp4_box_scan()
+    int64_t     box_left;               // Bytes left in the current box, -1 until the end of the output
+} mp4_box_scanner_t;
+
+emsg_event_t *
+emsg_event_new(
+    const char *scheme_id_uri,
+    const char *value,
+    int64_t pts,
+    int64_t duration,
+    uint32_t id,
+    const uint8_t *message_data,
+    int message_size);
+
+void
+emsg_event_free(
+    emsg_event_t *event);
+
+/*
+ * Returns the size of the version 1 emsg box of the event, using the event timescale, presentation_time
+ * and event_duration. The box is written in buf if buf is not NULL.
+ */
+int
+emsg_box(
+    emsg_event_t *event,
+    uint8_t *buf);
+
+/*
+ * Scans the top level boxes of buf and returns the number of bytes consumed (> 0 if buf_size > 0).
+ * box_type is set to
+ *   - 0 if the bytes are box data that can be written as is,
+ *   - MP4_BOX_INCOMPLETE if the bytes are the beginning of a box header, they are kept in the scanner,
+ *   - the type of the box if its header is complete, the header is in scanner->header (header_len bytes).
+ */
+int
+mp4_box_scan(
+    mp4_box_scanner_t *scanner,
+    const uint8_t *buf,
+    int buf_size,
+    uint32_t *box_type);
+
+#define MP4_BOX_INCOMPLETE  1
+#define MP4_BOX_TYPE(a, b, c, d) (((uint32_t)(a) << 24) | ((uint32_t)(b) << 16) | ((uint32_t)(c) << 8) | (uint32_t)(d))
+
+#endif
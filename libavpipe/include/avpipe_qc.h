@@ -0,0 +1,103 @@
+/*
+ * avpipe_qc.h
+ *
+ * Quality control of the decoded audio and video: silence, black and frozen frame
+ * intervals found by the silencedetect, blackframe and freezedetect filters.
+ */
+
+#ifndef AVPIPE_QC_H
+#define AVPIPE_QC_H
+#pragma once
+
+#define QC_DEFAULT_MIN_DURATION     2.0     /* Seconds */
+#define QC_DEFAULT_SILENCE_DB       -60.0   /* silencedetect noise tolerance */
+
+typedef enum qc_event_type_t {
+    qc_silence = 0,                     // Audio below the silence threshold
+    qc_black = 1,                       // Black video frames
+    qc_freeze = 2                       // Frozen video frames
+} qc_event_type_t;
+
+/*
+ * An interval of silence, black or frozen frames. The times are in seconds, in the
+ * time line of the decoded stream.
+ */
+typedef struct qc_event_t {
+    qc_event_type_t type;
+    int             stream_index;
+    double          start;
+    double          end;
+} qc_event_t;
+
+/*
+ * Tracks the interval of one stream and one event type while the frames are filtered.
+ */
+typedef struct qc_tracker_t {
+    qc_event_type_t type;
+    int             stream_index;
+    double          start;              // Start of the current interval, or -1 if there is none
+    double          last;               // Time of the last frame
+    double          duration;           // Duration of the last frame
+} qc_tracker_t;
+
+/*
+ * The QC report of a transcoding, all the intervals in the order they ended.
+ */
+typedef struct qc_report_t {
+    qc_event_t  *events;
+    int         n_events;
+    int         size;
+} qc_report_t;
+
+const char *
+qc_event_type_name(
+    qc_event_type_t type);
+
+void
+qc_tracker_init(
+    qc_tracker_t *tracker,
+    qc_event_type_t type,
+    int stream_index);
+
+/*
+ * Records a frame at time t, and starts an interval at start if there is none.
+ */
+void
+qc_tracker_frame(
+    qc_tracker_t *tracker,
+    double t);
+
+void
+qc_tracker_start(
+    qc_tracker_t *tracker,
+    double start);
+
+/*
+ * Ends the current interval at end, or at the end of the last frame if end is negative.
+ * Returns 1 and fills event if the interval lasted at least min_duration, otherwise 0.
+ */
+int
+qc_tracker_end(
+    qc_tracker_t *tracker,
+    double end,
+    double min_duration,
+    qc_event_t *event);
+
+int
+qc_report_add(
+    qc_report_t *report,
+    const qc_event_t *event);
+
+void
+qc_report_free(
+    qc_report_t *report);
+
+/*
+ * Returns the JSON document of the report, to be freed by the caller:
+ * {"intervals":[{"type":"black","stream_index":0,"start":0.000,"end":2.002}, ...]}
+ */
+char *
+qc_report_json(
+    const qc_report_t *report);
+
+#endif
@@ -0,0 +1,94 @@
+/*
+ * avpipe_rtp.h
+ *
+ * RTP/MPEGTS de-encapsulation with a reordering jitter buffer and
+ * SMPTE 2022-1 row/column FEC recovery.
+ */
+
+#ifndef AVPIPE_RTP_H
+#define AVPIPE_RTP_H
+#pragma once
+
+#include <stdint.h>
+
+#define RTP_HEADER_LEN          12
+#define RTP_FEC_HEADER_LEN      16              /* SMPTE 2022-1 FEC header */
+#define RTP_MAX_PAYLOAD         1500
+#define RTP_JB_SIZE             1024            /* Must be a power of 2 */
+#define RTP_JB_DEFAULT          32              /* Default reorder window in packets (no FEC) */
+#define RTP_FEC_MAX_PKTS        256             /* Max FEC packets kept for recovery */
+#define RTP_FEC_COLUMN_PORT     2               /* Column FEC is on media port + 2 */
+#define RTP_FEC_ROW_PORT        4               /* Row FEC is on media port + 4 */
+
+typedef struct rtp_stats_t {
+    int64_t     packets_received;       // Media packets received (including duplicates and late ones)
+    int64_t     packets_lost;           // Media packets that were neither received nor recovered in time
+    int64_t     packets_recovered;      // Media packets reconstructed by FEC
+    int64_t     packets_reordered;      // Media packets that arrived out of order but in time
+    int64_t     packets_duplicated;     // Media packets received more than once
+    int64_t     packets_late;           // Media packets that arrived after being delivered or declared lost
+    int64_t     fec_packets_received;   // Row and column FEC packets received
+    int64_t     bytes_received;         // Media payload bytes received
+    uint32_t    ssrc;                   // SSRC of the media stream
+    int         fec_columns;            // FEC matrix L (columns), 0 if no FEC was received
+    int         fec_rows;               // FEC matrix D (rows), 0 if no column FEC was received
+} rtp_stats_t;
+
+/*
+ * Called for each media payload, in sequence order, that leaves the jitter buffer.
+ */
+typedef int
+(*rtp_output_f)(
+    void *opaque,
+    uint8_t *buf,
+    int len);
+
+typedef struct rtp_ctx_t rtp_ctx_t;
+
+/*
+ * Allocates a new RTP context. If jitter_pkts is 0, the reorder window is
+ * RTP_JB_DEFAULT packets, or the FEC matrix size if FEC packets arrive.
+ */
+rtp_ctx_t *
+rtp_ctx_new(
+    int jitter_pkts,
+    rtp_output_f output,
+    void *opaque);
+
+void
+rtp_ctx_free(
+    rtp_ctx_t **ctx);
+
+/*
+ * Adds a media RTP packet to the jitter buffer and delivers all the packets
+ * that are in order. Returns 0 on success, or -1 if the packet is not a valid RTP packet.
+ */
+int
+rtp_push_media(
+    rtp_ctx_t *ctx,
+    uint8_t *buf,
+    int len);
+
+/*
+ * Adds a SMPTE 2022-1 FEC packet (row or column) and tries to recover missing media packets.
+ * Returns 0 on success, or -1 if the packet is not a valid FEC packet.
+ */
+int
+rtp_push_fec(
+    rtp_ctx_t *ctx,
+    uint8_t *buf,
+    int len);
+
+/*
+ * Delivers everything left in the jitter buffer, counting the holes as lost.
+ */
+int
+rtp_flush(
+    rtp_ctx_t *ctx);
+
+void
+rtp_get_stats(
+    rtp_ctx_t *ctx,
+    rtp_stats_t *stats);
+
+#endif
@@ -0,0 +1,153 @@
+/*
+ * avpipe_subtitle.h
+ *
+ * WebVTT and TTML subtitle tracks of a muxing: parsing, ISO/IEC 14496-30 text tracks (wvtt, stpp) written
+ * by the mp4 muxer of libavformat, and DASH/HLS text segments and manifests.
+ */
+
+#ifndef AVPIPE_SUBTITLE_H
+#define AVPIPE_SUBTITLE_H
+#pragma once
+
+#include <stdint.h>
+
+#include <libavformat/avformat.h>
+
+#define SUB_TIMESCALE           1000        /* Cue times are in ms */
+#define SUB_DEFAULT_SEG_DURATION    6000    /* Segment duration of the DASH/HLS text tracks if seg_duration is not set (ms) */
+
+#define SUB_ROLE_SCHEME         "urn:mpeg:dash:role:2011"
+
+typedef enum sub_format_t {
+    sub_format_webvtt = 1,              // WebVTT, muxed as wvtt
+    sub_format_ttml = 2                 // TTML, muxed as stpp
+} sub_format_t;
+
+typedef struct sub_cue_t {
+    int64_t     start;                  // ms
+    int64_t     end;                    // ms
+    char        *id;                    // WebVTT cue identifier, NULL if none
+    char        *settings;              // WebVTT cue settings, or the name and attributes of the TTML p element except the timing
+    char        *text;                  // WebVTT cue payload, or the content of the TTML p element
+} sub_cue_t;
+
+typedef struct sub_track_t {
+    sub_format_t    format;
+    char            *header;            // WebVTT: the text before the first cue. TTML: the tt start tag and the head element
+    char            *body;              // TTML: the body and div start tags of the cues
+    char            *footer;            // TTML: the div, body and tt end tags
+    sub_cue_t       *cues;              // Ordered by start
+    int             n_cues;
+    int64_t         duration;           // End of the last cue (ms)
+
+    /* Signalling, not owned by the track */
+    const char      *lang;              // BCP 47 language tag, NULL if not known
+    const char      *role;              // Role (urn:mpeg:dash:role:2011), i.e. "subtitle", "caption" or "forced-subtitle"
+    const char      *name;              // Name of the rendition, NULL to use the language
+
+    int             bandwidth;          // Peak bitrate of the segments written (bits/s)
+} sub_track_t;
+
+typedef struct sub_buf_t {
+    uint8_t     *data;
+    int         len;
+    int         cap;
+} sub_buf_t;
+
+/*
+ * Parses a WebVTT or TTML document. The documents of the parts of a track can be concatenated, the cue
+ * times are on the timeline of the muxing output.
+ * Returns 0 if successful, -1 if the format is not recognized.
+ */
+int
+sub_track_parse(
+    sub_track_t *track,
+    const char *data,
+    int size);
+
+/*
+ * Frees the cues and documents of a track, not the track itself.
+ */
+void
+sub_track_free(
+    sub_track_t *track);
+
+void
+sub_buf_free(
+    sub_buf_t *buf);
+
+/*
+ * Returns the number of segments of seg_duration ms of a track of duration ms, the segment n (numbered from 1)
+ * is [(n-1)*seg_duration, n*seg_duration) and the last one ends at duration.
+ */
+int
+sub_segment_count(
+    int64_t seg_duration,
+    int64_t duration);
+
+/*
+ * Adds a wvtt or stpp stream for a text track to a mp4 muxer, with the language, name and role of the track.
+ * Returns NULL if the stream can't be allocated.
+ */
+AVStream *
+sub_new_stream(
+    AVFormatContext *format_ctx,
+    sub_track_t *track);
+
+/*
+ * Writes the samples of a text track that start in [*pos, until) as packets of stream_index, with
+ * av_interleaved_write_frame(). The wvtt samples are split at the start and end of the cues, the last
+ * sample ends at limit. *pos is set to the end of the last sample written (ms).
+ * Returns 0 if successful, otherwise the error of the muxer.
+ */
+int
+sub_write_samples(
+    AVFormatContext *format_ctx,
+    int stream_index,
+    sub_track_t *track,
+    int64_t *pos,
+    int64_t until,
+    int64_t limit);
+
+/*
+ * Returns the WebVTT segment [start, end) of a WebVTT track for HLS, with the cues that are displayed in the
+ * segment, in a malloc'd string.
+ */
+char *
+sub_webvtt_segment(
+    sub_track_t *track,
+    int64_t start,
+    int64_t end);
+
+/*
+ * Returns a DASH MPD with an AdaptationSet for each track, in a malloc'd string. The segments of the track i
+ * are subtitle<i+1>-init.mp4 and subtitle<i+1>-<number>.m4s, numbered from 1.
+ */
+char *
+sub_dash_manifest(
+    sub_track_t *tracks,
+    int n_tracks,
+    int64_t seg_duration,
+    int64_t duration);
+
+/*
+ * Returns the HLS media playlist of the track index (0 based), in a malloc'd string. WebVTT tracks have
+ * WebVTT segments subtitle<index+1>-<number>.vtt, TTML tracks have CMAF segments.
+ */
+char *
+sub_hls_playlist(
+    sub_track_t *track,
+    int index,
+    int64_t seg_duration,
+    int64_t duration);
+
+/*
+ * Returns the EXT-X-MEDIA tags of the tracks for a HLS master playlist, in a malloc'd string. The media
+ * playlists are subtitle<i+1>.m3u8.
+ */
+char *
+sub_hls_master(
+    sub_track_t *tracks,
+    int n_tracks);
+
+#endif
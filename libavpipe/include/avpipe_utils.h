@@ -80,3 +80,13 @@ hex_encode(
     byte *buf,
     int sz,
     char *str);
+
+/*
+ * Creates an empty temporary file named prefix followed by 6 random characters in $TMPDIR, or /tmp if TMPDIR
+ * is not set. Returns 0 and the path of the file in path, -1 if the path doesn't fit in size or mkstemp() fails.
+ */
+int
+make_temp_file(
+    char *path,
+    int size,
+    const char *prefix);
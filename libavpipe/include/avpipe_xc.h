@@ -15,10 +15,19 @@
 #include <libavutil/opt.h>
 
 #include <pthread.h>
+#include <limits.h>
 #include "elv_channel.h"
+#include "avpipe_rtp.h"
+#include "avpipe_emsg.h"
+#include "avpipe_cc.h"
+#include "avpipe_subtitle.h"
+#include "avpipe_qc.h"
+#include "avpipe_compare.h"
 
 #define MAX_STREAMS	        64
 #define MAX_MUX_IN_STREAM   (4*4096)        // Up to 4*4096 ABR segments
+#define MAX_SPLICE_POINTS   64              // Pending SCTE-35 splice points
+#define RC_STATS_PATH_SZ    PATH_MAX        // Path of the two-pass rate control stats file, in TMPDIR
 
 #define AVIO_OUT_BUF_SIZE   (1*1024*1024)   // avio output buffer size
 #define AVIO_IN_BUF_SIZE    (1*1024*1024)   // avio input buffer size
@@ -85,7 +94,15 @@ typedef enum avpipe_buftype_t {
     avpipe_audio_fmp4_segment = 14,     // segmented fmp4 audio stream
     avpipe_mux_segment = 15,            // Muxed audio/video segment
     avpipe_image = 16,                  // extracted images
-    avpipe_mpegts_segment = 17          // MPEGTS (muxed audio and video)
+    avpipe_mpegts_segment = 17,         // MPEGTS (muxed audio and video)
+    avpipe_caption_webvtt_segment = 18, // WebVTT caption segment (hls)
+    avpipe_caption_ttml_segment = 19,   // TTML/IMSC1 caption segment (dash)
+    avpipe_subtitle_init_segment = 20,  // Init segment of a muxed subtitle track (dash/hls)
+    avpipe_subtitle_segment = 21,       // WebVTT (hls) or wvtt/stpp (dash) segment of a muxed subtitle track
+    avpipe_subtitle_manifest = 22,      // Subtitle MPD, media playlists and master playlist tags of a muxing
+    avpipe_qc_report = 23,              // QC report (JSON) of the silence, black and frozen frame intervals
+    avpipe_shot_list = 24,              // Shot list (JSON) of the scene cuts of the video
+    avpipe_audio_rendition_manifest = 25    // DASH AdaptationSets (MPD) or HLS EXT-X-MEDIA tags of the audio renditions
 } avpipe_buftype_t;
 
 #define BYTES_READ_REPORT               (10*1024*1024)
@@ -104,9 +121,54 @@ typedef enum avp_stat_t {
     out_stat_encoding_end_pts = 9,          // The last PTS encoded. This stat is recorded when a file is closed
     out_stat_start_file = 10,               // Sent when a new file is opened and reports the segment index
     out_stat_end_file = 11,                 // Sent when a file is closed and reports the segment index
-    in_stat_data_scte35 = 12               // SCTE data arrived
+    in_stat_data_scte35 = 12,               // SCTE data arrived
+    in_stat_rtp = 13,                       // RTP reception stats (loss, reordering and FEC recovery)
+    out_stat_splice_point = 14,             // Sent when a segment starts at a SCTE-35 splice point and reports the pts and segment index
+    out_stat_emsg = 15,                     // Sent when an emsg box (SCTE-35 or ID3 event) is written in a segment
+    in_stat_timed_metadata = 16,            // Timed ID3 or KLV metadata arrived
+    in_stat_loudness = 17,                  // Loudness of an audio output, sent at the end if params->measure_loudness is set
+    in_stat_qc = 18,                        // Silence, black or frozen frame interval, sent when the interval ends
+    in_stat_scene = 19                      // Scene cut of the video, sent if params->detect_scenes is set
 } avp_stat_t;
 
+typedef enum timed_metadata_type_t {
+    timed_metadata_id3 = 1,                 // ID3v2 tag (timed_id3, stream type 0x15)
+    timed_metadata_klv = 2                  // SMPTE 336M KLV (stream type 0x06 or 0x15 with KLVA registration)
+} timed_metadata_type_t;
+
+typedef struct timed_metadata_t {
+    timed_metadata_type_t   type;
+    int64_t                 pts;            // PTS of the metadata (90kHz), or AV_NOPTS_VALUE
+    uint8_t                 *data;          // Payload of the PES packet
+    int                     size;
+} timed_metadata_t;
+
+/* Loudness of an audio output measured by the ebur128 filter (EBU R128, ITU-R BS.1770) */
+typedef struct loudness_stats_t {
+    int     stream_index;                   // Input stream index of the audio output (the first input for merge/join)
+    double  integrated;                     // Integrated loudness (LUFS), -70 if the audio is silent
+    double  range;                          // Loudness range (LU)
+    double  true_peak;                      // True peak of the loudest channel (dBTP)
+} loudness_stats_t;
+
+#define SCENE_DEFAULT_THRESHOLD         0.4     /* Scene change score of a scene cut */
+#define SCENE_DEFAULT_TOLERANCE         1.0     /* Seconds */
+
+/* Scene cut found by the scene change score of the select filter, the first frame of a shot */
+typedef struct scene_cut_t {
+    int64_t pts;                            // PTS of the frame in the video encoder time base
+    double  time;                           // Time of the frame (sec)
+    double  score;                          // Scene change score, from 0 to 1
+} scene_cut_t;
+
+/* Crop rectangle of the decoded video, in the order of the crop filter (w:h:x:y) */
+typedef struct crop_rect_t {
+    int     width;
+    int     height;
+    int     x;
+    int     y;
+} crop_rect_t;
+
 typedef enum avp_live_proto_t {
     avp_proto_none   = 0,
     avp_proto_mpegts = 1,
@@ -139,16 +201,19 @@ typedef struct mux_input_ctx_t {
     int     index;                      /* Index of current input part that should be processed */
     char    **parts;                    /* All the input parts */
     int     header_size;
+    char    *lang;                      /* Language of an audio or caption/subtitle input, NULL if not set in the mux spec */
+    char    *role;                      /* Role of a caption/subtitle input (urn:mpeg:dash:role:2011) */
+    char    *name;                      /* Name of a caption/subtitle input, NULL if not set in the mux spec */
 } mux_input_ctx_t;
 
 typedef struct io_mux_ctx_t {
     char            *out_filename;              /* Output filename/url for this muxing */
     char            *mux_type;                  /* "mux-mez" or "mux-abr" */
     mux_input_ctx_t video;
-    int64_t         last_video_pts;
+    int64_t         last_video_dts;
     int             last_audio_index;
     mux_input_ctx_t audios[MAX_STREAMS];
-    int64_t         last_audio_pts;
+    int64_t         last_audio_dts;
     int             last_caption_index;
     mux_input_ctx_t captions[MAX_STREAMS];
 } io_mux_ctx_t;
@@ -164,6 +229,8 @@ typedef struct ioctx_t {
     int                 is_udp_started; /* Is the first UDP read started? */
     int                 cur_pread;      /* Current packet read */
     pthread_t           utid;           /* UDP thread id */
+    rtp_ctx_t           *rtp_ctx;       /* This is set if input is a RTP url */
+    rtp_stats_t         rtp_stats;      /* Last reported RTP stats */
 
     /* Input filename or url */
     char                *url;
@@ -197,6 +264,16 @@ typedef struct ioctx_t {
     int     seg_index;          /* segment index if this ioctx is a segment */
 
     uint8_t *data;  /* Data stream buffer (e.g. SCTE-35) */
+    timed_metadata_t *timed_metadata;  /* Timed ID3/KLV metadata reported by in_stat_timed_metadata */
+    loudness_stats_t *loudness;        /* Loudness of an audio output reported by in_stat_loudness */
+    qc_event_t *qc_event;              /* Silence, black or frozen frame interval reported by in_stat_qc */
+    scene_cut_t *scene_cut;            /* Scene cut reported by in_stat_scene */
+
+    mp4_box_scanner_t box_scanner;  /* Top level boxes of a video fMP4 segment, to insert emsg boxes */
+
+    char    *manifest;          /* DASH or HLS master manifest held back by elv_io_write_manifest() */
+    int     manifest_len;
+    int     manifest_size;
 
     io_mux_ctx_t    *in_mux_ctx;   /* Input muxer context */
     int             in_mux_index;
@@ -271,6 +348,34 @@ typedef struct avpipe_io_handler_t {
 #define MAX_WRAP_PTS        ((int64_t)8589000000)
 #define MAX_AVFILENAME_LEN  128
 
+typedef struct splice_point_stats_t {
+    int64_t pts;                    /* Splice time of the SCTE-35 cue in the input stream (90kHz) */
+    int64_t frame_pts;              /* PTS of the IDR frame at the splice point in the encoder time base */
+    int     seg_index;              /* Index of the segment that starts at the splice point */
+} splice_point_stats_t;
+
+/* Video smart cut state if params->smart_cut is set */
+typedef enum smart_cut_state_t {
+    smart_cut_head,                 /* Before the start, the GOP that has the start is re-encoded */
+    smart_cut_copy,                 /* The GOPs between the start and the end are copied */
+    smart_cut_done                  /* Past the end, the GOP that has the end is re-encoded when flushing */
+} smart_cut_state_t;
+
+/* Encoder (or packet copy) of an audio rendition if params->n_audio_renditions is set */
+typedef struct rendition_ctx_t {
+    int             stream_index;       /* Input audio stream */
+    int             passthrough;        /* Set if the input packets are copied */
+    AVCodecContext  *codec_context;     /* NULL if passthrough is set */
+    AVStream        *stream;            /* Output stream, in format_context2[] of the rendition */
+    AVFilterGraph   *filter_graph;      /* Converts the decoded frames to the encoder sample format, rate and layout */
+    AVFilterContext *buffersrc_ctx;
+    AVFilterContext *buffersink_ctx;
+    int64_t         first_pts;          /* First and last pts written, in the output stream time base */
+    int64_t         end_pts;
+    int64_t         bytes_written;
+    int64_t         frames_written;
+} rendition_ctx_t;
+
 /* Decoder/encoder context, keeps both video and audio stream ffmpeg contexts */
 typedef struct coderctx_t {
     AVFormatContext     *format_context;                                /* Input format context or video output format context */
@@ -294,6 +399,8 @@ typedef struct coderctx_t {
     int n_audio;                                        /* Number of audio streams that will be decoded */
 
     int data_scte35_stream_index;                       /* Index of SCTE-35 data stream */
+    int data_id3_stream_index;                          /* Index of timed ID3 data stream */
+    int data_klv_stream_index;                          /* Index of SMPTE 336M KLV data stream */
     int data_stream_index;                              /* Index of an unrecognized data stream */
 
     int64_t video_last_wrapped_pts;                     /* Video last wrapped pts */
@@ -323,6 +430,22 @@ typedef struct coderctx_t {
     AVFilterContext *audio_buffersrc_ctx[MAX_STREAMS];
     AVFilterGraph   *audio_filter_graph[MAX_STREAMS];
     int     n_audio_filters;                            /* Number of initialized audio filters */
+    loudness_stats_t loudness[MAX_STREAMS];             /* Loudness of the audio filter outputs if params->measure_loudness is set */
+    loudness_stats_t loudness_measured[MAX_STREAMS];    /* Loudness measured by the first pass if params->loudness_target is set */
+
+    /* Silence, black and frozen frame intervals if params->detect_silence, detect_black or detect_freeze is set */
+    qc_tracker_t    qc_silence[MAX_STREAMS];            /* One per audio filter output */
+    qc_tracker_t    qc_black;
+    qc_tracker_t    qc_freeze;
+    qc_report_t     qc_report;
+
+    crop_rect_t     crop;                               /* Crop rectangle if params->crop is set, width is 0 otherwise */
+    crop_rect_t     crop_detected;                      /* Last rectangle of cropdetect if params->detect_crop is set */
+
+    /* Scene cuts of the video if params->detect_scenes is set */
+    scene_cut_t     *scene_cuts;
+    int             n_scene_cuts;
+    int             scene_cuts_size;
 
     int64_t video_frames_written;                       /* Total video frames written so far */
     int64_t audio_frames_written[MAX_STREAMS];          /* Total audio frames written so far */
@@ -337,6 +460,8 @@ typedef struct coderctx_t {
     int64_t first_encoding_video_pts;                   /* PTS of first video frame sent to the encoder */
     int64_t first_encoding_audio_pts[MAX_STREAMS];      /* PTS of first audio frame sent to the encoder */
     int64_t first_read_packet_pts[MAX_STREAMS];         /* PTS of first packet read - which might not be decodable */
+    int64_t first_encoded_video_pts;                    /* PTS of first encoded or copied video packet, used if params->rebase_pts is set */
+    int64_t first_encoded_audio_pts[MAX_STREAMS];       /* PTS of first encoded or copied audio packet, used if params->rebase_pts is set */
 
     int64_t video_encoder_prev_pts;     /* Previous pts for video output (encoder) */
     int64_t video_duration;             /* Duration/pts of original frame */
@@ -351,6 +476,57 @@ typedef struct coderctx_t {
     int     frame_duration;             /* Will be > 0 if parameter set_equal_fduration is set and doing mez making */
     int     calculated_frame_duration;  /* Approximate/real frame duration of video stream, will be used to fill video frames */
 
+    /* SCTE-35 splice points if params->splice_segment is set */
+    pthread_mutex_t splice_lock;        /* Guards the pending splice points, they are queued by the reader */
+    int64_t splice_pts[MAX_SPLICE_POINTS];      /* Pending splice points in the video decoder time base, in order */
+    int64_t splice_cue_pts[MAX_SPLICE_POINTS];  /* Splice time of the pending splice points (90kHz) */
+    int     n_splice_pts;               /* Number of pending splice points */
+    int64_t splice_frame_pts;           /* PTS of the IDR frame forced at the last splice point, or AV_NOPTS_VALUE */
+    splice_point_stats_t splice_point;  /* Last splice point, reported by out_stat_splice_point */
+    int64_t splice_seg_boundary;        /* Next segment muxer boundary, or AV_NOPTS_VALUE before the first frame */
+
+    /* Scene cuts found by the first pass if params->scene_keyframes is set */
+    scene_cut_t *scene_keyframes;
+    int     n_scene_keyframes;
+    int     scene_keyframe_index;       /* Next scene cut */
+    int64_t scene_seg_boundary;         /* Next fmp4-segment boundary, or AV_NOPTS_VALUE before the first frame */
+
+    /* Two-pass rate control if params->rc_mode is rc_mode_two_pass */
+    int     rc_pass;                    /* 1 in the first pass, 2 in the second one, 0 otherwise */
+    char    rc_stats[RC_STATS_PATH_SZ]; /* Stats file of the encoder, written by the first pass and read by the second */
+
+    /* SCTE-35 and ID3 events written as emsg boxes if params->emit_emsg is set */
+    pthread_mutex_t emsg_lock;          /* Guards the pending events, they are queued by the reader */
+    emsg_event_t    *emsg_events[MAX_EMSG_EVENTS];  /* Pending events, in presentation order */
+    int             n_emsg_events;
+    uint32_t        emsg_id;            /* Id of the next event */
+    AVRational      emsg_time_base;     /* Time base of the event pts (video decoder time base) */
+    emsg_event_t    *emsg_event;        /* Last event written, reported by out_stat_emsg */
+
+    /* CEA-608/708 captions if params->extract_captions is set or xc_type is xc_extract_captions */
+    cc_ctx_t        *cc;                /* Caption decoders and cues, in the video encoder time base */
+    int             cc_seg_index;       /* Index of the current caption segment, -1 before the first segment */
+    int             cc_first_seg_index; /* Index of the first caption segment */
+    int64_t         cc_seg_start;       /* Start of the current caption segment */
+    int64_t         cc_start_pts;       /* Start of the first caption segment */
+    int64_t         cc_last_pts;        /* Last video frame pts, or AV_NOPTS_VALUE */
+    int64_t         cc_frame_duration;  /* Last video frame duration, to end the last caption segment */
+    cc_a53_t        *a53;               /* A/53 captions passed through to the video encoder, unless params->strip_captions is set */
+
+    /* Video GOPs read if params->smart_cut is set, the GOPs at the start and the end are re-encoded and the others copied */
+    smart_cut_state_t smart_cut_state;
+    AVPacket        **smart_cut_gop;    /* Packets of the current GOP, in decoding order */
+    int             smart_cut_gop_len;
+    int             smart_cut_gop_size;
+    int64_t         smart_cut_dts_delay;/* PTS - DTS of the input key frames (reordering delay), in the input time base */
+    int             smart_cut_key;      /* Set to force an IDR frame on the next encoded frame */
+    AVBSFContext    *smart_cut_bsf;     /* h264_mp4toannexb for the copied packets if the input is avcC */
+    uint8_t         *smart_cut_extradata;   /* Annexb SPS/PPS of the input (not owned) */
+    int             smart_cut_extradata_size;
+
+    /* Audio renditions if params->n_audio_renditions is set, indexed like format_context2 */
+    rendition_ctx_t renditions[MAX_STREAMS];
+
     volatile int    cancelled;
     volatile int    stopped;
 } coderctx_t;
@@ -364,6 +540,52 @@ typedef enum crypt_scheme_t {
     crypt_cbcs
 } crypt_scheme_t;
 
+/* Color space of the video outputs, the decoded video is converted (and tone mapped) to it in the filter graph */
+typedef enum color_target_t {
+    color_target_none,      // Keep the color space of the input
+    color_target_sdr,       // SDR BT.709
+    color_target_pq,        // HDR10, BT.2020 with the PQ (SMPTE ST 2084) transfer
+    color_target_hlg        // HDR, BT.2020 with the HLG (ARIB STD-B67) transfer
+} color_target_t;
+
+/* Frame rate conversion of the video, the converted frames keep the timeline of the input */
+typedef enum fps_mode_t {
+    fps_mode_none,          // No frame rate conversion
+    fps_mode_drop_dup,      // Drop or duplicate frames to frame_rate (fps filter)
+    fps_mode_blend,         // Blend the neighbour frames to frame_rate (framerate filter)
+    fps_mode_telecine,      // 3:2 pulldown, 23.976 progressive to 29.97 interlaced (telecine filter)
+    fps_mode_ivtc           // Inverse telecine, 29.97 telecined to 23.976 progressive (fieldmatch and decimate filters)
+} fps_mode_t;
+
+/* Rate control of the video encoder, validated per encoder by check_params() */
+typedef enum rc_mode_t {
+    rc_mode_default,        // CRF (crf_str) or ABR (video_bitrate) with rc_max_rate/rc_buffer_size (VBV)
+    rc_mode_crf_capped,     // CRF (crf_str) capped by rc_max_rate/rc_buffer_size, libx264 and libx265 only
+    rc_mode_two_pass,       // Two-pass VBR to video_bitrate, peaks capped by rc_max_rate if set, libx264 and libx265 only
+    rc_mode_cbr             // Strict CBR at video_bitrate, padded with filler data (HRD), libx264, libx265 and h264_nvenc
+} rc_mode_t;
+
+/* Audio rendition of a dash/hls/fmp4-segment audio transcoding, see params->audio_renditions */
+typedef struct audio_rendition_t {
+    int         audio_index;        // Input audio stream of the rendition
+    char        *ecodec;            // Audio encoder: aac, ac3, eac3 or libopus
+    int         passthrough;        // If set and the input stream is already ecodec, its packets are copied without decoding
+    int         channel_layout;     // Channel layout of the rendition, 0 keeps the layout of the input if the encoder supports it
+    int         bitrate;            // Bitrate of the rendition, 0 means params->audio_bitrate
+    int         sample_rate;        // Sample rate of the rendition, 0 keeps the rate of the input if the encoder supports it
+    char        *name;              // NAME (hls) or Label (dash) of the rendition in the manifest
+    char        *lang;              // Language (RFC 5646) of the rendition in the manifest
+} audio_rendition_t;
+
+/* Cadence of a video found by avpipe_probe() if params->probe_cadence is set */
+typedef enum cadence_t {
+    cadence_unknown,
+    cadence_progressive,
+    cadence_interlaced_tff, // Interlaced, top field first
+    cadence_interlaced_bff, // Interlaced, bottom field first
+    cadence_telecine        // Progressive film with 3:2 pulldown (repeated fields)
+} cadence_t;
+
 typedef enum xc_type_t {
     xc_none                 = 0,
     xc_video                = 1,
@@ -375,7 +597,8 @@ typedef enum xc_type_t {
     xc_mux                  = 32,
     xc_extract_images       = 65,   // 0x40 | xc_video
     xc_extract_all_images   = 129,  // 0x80 | xc_video
-    xc_probe                = 256
+    xc_probe                = 256,
+    xc_extract_captions     = 513   // 0x200 | xc_video
 } xc_type_t;
 
 /* handled image types in get_overlay_filter_string*/
@@ -480,9 +703,41 @@ typedef struct xcparams_t {
     char        *profile;
     int         level;
     dif_type    deinterlace;                // Deinterlacing filter
+    int         rtp_fec;                    // RTP only: if set, receive SMPTE 2022-1 column/row FEC on port+2/port+4
+    int         rtp_jitter_buffer;          // RTP only: reorder window in packets, 0 means auto
+    int         scte35_pid;                 // Copy MPEGTS only: PID of the SCTE-35 cues inserted by xc_insert_cue(), 0 means no cue insertion
+    int         splice_segment;             // dash/hls only: if set, force an IDR frame and start a new segment at SCTE-35 splice points
+    int         emit_emsg;                  // dash/hls/fmp4-segment only: if set, write input SCTE-35 and ID3 events as emsg boxes in video segments
+    int         extract_captions;           // dash/hls only: if set, write the CEA-608/708 captions of the video as WebVTT (hls) or TTML (dash) segments
+    int         strip_captions;             // If set, the A/53 captions of the input are not passed through to the encoded video
+    int         blank;                      // If set, the decoded video is replaced by black frames and the audio by silence (EDL gaps)
+    int         rebase_pts;                 // If set, the output timestamps start at start_pts (in output time base) instead of following the input, a bypass must start on a key frame
+    int         smart_cut;                  // If set, only the GOPs at start_time_ts and the end are re-encoded (h264/libx264), the others are copied
+    int         measure_loudness;           // If set, the loudness of each audio output is measured and reported with in_stat_loudness
+    float       loudness_target;            // Integrated loudness target in LUFS (-70 to -5) of a two-pass loudnorm, 0 means no normalization
+    float       loudness_true_peak;         // True peak ceiling in dBTP (-9 to 0) if loudness_target is set
+    int         detect_silence;             // If set, the silences of the audio outputs are reported with in_stat_qc and in the QC report
+    int         detect_black;               // If set, the black video frames are reported with in_stat_qc and in the QC report
+    int         detect_freeze;              // If set, the frozen video frames are reported with in_stat_qc and in the QC report
+    float       qc_min_duration;            // Minimum duration in seconds of a reported interval, 0 means 2 sec
+    float       silence_threshold;          // Silence threshold in dB, 0 means -60dB
+    int         detect_scenes;              // If set, the scene cuts of the video are reported with in_stat_scene and in the shot list
+    float       scene_threshold;            // Scene change score (0 to 1) of a scene cut, 0 means 0.4
+    int         scene_keyframes;            // If set, IDR frames and segment boundaries are placed on the scene cuts found by a first pass
+    float       scene_tolerance;            // Seconds a segment boundary can move to a scene cut if scene_keyframes is set, 0 means 1 sec
+    char        *crop;                      // Crop rectangle "w:h:x:y" of the decoded video, or "auto" to detect it with a first pass
+    int         detect_crop;                // If set, the crop rectangle of the video is detected by cropdetect (avpipe_analyze_crop())
+    color_target_t  color_target;           // Color space of the video outputs, color_target_none keeps the input one
+    fps_mode_t  fps_mode;                   // Frame rate conversion of the video
+    char        *frame_rate;                // Output frame rate ("24000/1001", "25", ...) of fps_mode_drop_dup and fps_mode_blend
+    int         probe_cadence;              // If set, avpipe_probe() decodes the first frames of the video to find its cadence
+    rc_mode_t   rc_mode;                    // Rate control of the video encoder
+    audio_rendition_t audio_renditions[MAX_STREAMS];    // Audio outputs of a dash/hls/fmp4-segment audio transcoding, instead of ecodec2
+    int         n_audio_renditions;         // Number of entries in audio_renditions
 } xcparams_t;
 
 #define MAX_CODEC_NAME  256
+#define CODEC_STRING_SZ 64
 
 typedef struct side_data_display_matrix_t {
     double rotation;    // Original rotation is CCW with values from -180 to 180
@@ -499,6 +754,7 @@ typedef struct stream_info_t {
     int         codec_type;         // Audio or Video
     int         codec_id;
     char        codec_name[MAX_CODEC_NAME+1];
+    char        codec_string[CODEC_STRING_SZ];  // RFC 6381 codec string of the manifests, e.g. "av01.0.08M.10", or empty
     int64_t     duration_ts;
     AVRational  time_base;
     int64_t     nb_frames;
@@ -518,6 +774,11 @@ typedef struct stream_info_t {
     AVRational          sample_aspect_ratio;
     AVRational          display_aspect_ratio;
     enum AVFieldOrder   field_order;
+    const char          *color_primaries;   // Video only, color names of FFmpeg (static strings), NULL if unknown
+    const char          *color_transfer;
+    const char          *color_space;
+    const char          *color_range;
+    cadence_t           cadence;            // Video only, cadence_unknown unless params->probe_cadence is set
     int                 profile;
     int                 level;
     side_data_t         side_data;
@@ -549,8 +810,20 @@ typedef struct cp_ctx_t {
     // packet seen by the same amount.
     int64_t stream_start_pts;
 
+    int scte35_stream_index;    // Output stream of the inserted SCTE-35 cues, -1 if cue insertion is off
+    int64_t last_pts;           // Input PTS (90kHz) of the last copied audio/video packet, for the packets and cues without one
+    int64_t scte35_pts;         // Input PTS (90kHz) of the last SCTE-35 packet, the next ones can't be earlier
+
 } cp_ctx_t;
 
+/* SCTE-35 cue waiting to be inserted in the copy MPEGTS output */
+typedef struct xc_cue_t {
+    int64_t         pts;        // Input PTS at which the cue is inserted (90kHz), AV_NOPTS_VALUE for the next packet
+    uint8_t         *section;   // splice_info_section, starting at the table_id
+    int             size;
+    struct xc_cue_t *next;
+} xc_cue_t;
+
 typedef int (*associate_thread_f)(int32_t handle);
 
 typedef struct xctx_t {
@@ -575,8 +848,13 @@ typedef struct xctx_t {
     coderctx_t          in_muxer_ctx[MAX_STREAMS];      // Video, audio, captions coder input muxer context (one video, multiple audio/caption)
     ioctx_t             *inctx_muxer[MAX_STREAMS];      // Video, audio, captions io muxer context (one video, multiple audio/caption)
     coderctx_t          out_muxer_ctx;                  // Output muxer
+    sub_track_t         sub_tracks[MAX_STREAMS];        // Caption/subtitle inputs, in_mux_ctx->last_caption_index tracks
+    int64_t             sub_pos[MAX_STREAMS];           // End of the subtitle samples written to the mp4 output (ms)
+    int64_t             mux_duration;                   // End of the muxed audio/video (ms)
 
     cp_ctx_t            cp_ctx; // Context for source copy operation
+    pthread_mutex_t     cue_lock;
+    xc_cue_t            *cues;  // Pending SCTE-35 cues ordered by pts, protected by cue_lock
 
     AVPacket            pkt_array[MAX_STREAMS];
     int                 is_pkt_valid[MAX_STREAMS];
@@ -620,6 +898,7 @@ typedef struct out_tracker_t {
     int audio_stream_index;
 
     int output_stream_index;
+    int rendition;              /* Set for audio renditions, the output files are numbered by output_stream_index */
 } out_tracker_t;
 
 typedef struct encoding_frame_stats_t {
@@ -698,6 +977,92 @@ avpipe_probe_free(
     xcprobe_t *xcprobe,
     int n_streams);
 
+/**
+ * @brief   Measures the loudness of the audio outputs of a transcoding, without writing any output.
+ *          The audio is decoded and filtered the same way as with avpipe_xc(), only the video is skipped.
+ *
+ * @param   in_handlers     A pointer to input handlers that direct the transcoding.
+ * @param   params          A pointer to the parameters for transcoding.
+ * @param   loudness        Loudness of each audio output, will be allocated inside this API.
+ * @param   n_loudness      Will contain the number of entries in loudness if successful.
+ * @return  Returns 0 if successful, otherwise corresponding eav error.
+ */
+int
+avpipe_analyze_loudness(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    loudness_stats_t **loudness,
+    int *n_loudness);
+
+/**
+ * @brief   Finds the scene cuts of the video of a transcoding, without writing any output.
+ *          The video is decoded and filtered the same way as with avpipe_xc(), the audio is skipped.
+ *
+ * @param   in_handlers     A pointer to input handlers that direct the transcoding.
+ * @param   params          A pointer to the parameters for transcoding.
+ * @param   scene_cuts      Scene cuts of the video in presentation order, will be allocated inside this API.
+ * @param   n_scene_cuts    Will contain the number of entries in scene_cuts if successful.
+ * @return  Returns 0 if successful, otherwise corresponding eav error.
+ */
+int
+avpipe_analyze_scenes(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    scene_cut_t **scene_cuts,
+    int *n_scene_cuts);
+
+/**
+ * @brief   Detects the crop rectangle that removes the black bars (letterbox, pillarbox) of the video of a transcoding,
+ *          without writing any output. The rectangle contains all the non black pixels of the decoded frames, it is
+ *          the whole picture if there are no black bars.
+ *
+ * @param   in_handlers     A pointer to input handlers that direct the transcoding.
+ * @param   params          A pointer to the parameters for transcoding.
+ * @param   crop            Will contain the crop rectangle if successful.
+ * @return  Returns 0 if successful, otherwise corresponding eav error.
+ */
+int
+avpipe_analyze_crop(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    crop_rect_t *crop);
+
+/**
+ * @brief   Compares a distorted video (an output of a transcoding) to its reference, without writing any output.
+ *          Both videos are decoded, scaled to a common resolution and paired by timestamp, and each distorted frame
+ *          gets its PSNR, SSIM and VMAF (if params->vmaf is set and FFmpeg has libvmaf) scores.
+ *
+ * @param   in_handlers     A pointer to input handlers that read the reference and the distorted.
+ * @param   params          A pointer to the parameters of the comparison.
+ * @param   report          Will contain the JSON report of the comparison (see compare_report_json()) if successful,
+ *                          to be freed by the caller.
+ * @return  Returns 0 if successful, otherwise corresponding eav error.
+ */
+int
+avpipe_compare(
+    avpipe_io_handler_t *in_handlers,
+    compare_params_t *params,
+    char **report);
+
+/**
+ * @brief   Schedules a SCTE-35 cue to be inserted in the copy MPEGTS output of a running transcoding.
+ *          The cue is written on the scte35_pid before the first input packet with a PTS >= pts.
+ *          The section is written as is, the copy MPEGTS output keeps the input timestamps.
+ *
+ * @param   xctx        A pointer to transcoding context.
+ * @param   pts         Input PTS (90kHz) at which the cue is inserted, usually ahead of the splice time.
+ *                      AV_NOPTS_VALUE inserts it before the next packet.
+ * @param   section     splice_info_section, starting at the table_id. It is copied.
+ * @param   size        Size of the section.
+ * @return  Returns eav_success if the cue is scheduled, otherwise eav_param.
+ */
+int
+avpipe_insert_cue(
+    xctx_t *xctx,
+    int64_t pts,
+    uint8_t *section,
+    int size);
+
 /**
  * @brief   Starts transcoding. Multiple transcoding operations on the same transcoding context is UB.
  *          In case of failure avpipe_fini() should be called to avoid resource leak.
@@ -0,0 +1,992 @@
+/*
+ * avpipe_cc.c
+ *
+ * CEA-608 (CC1-CC4) and CEA-708 (services 1-6) closed caption decoders, fed with the A/53 cc_data
+ * of the video frames, and WebVTT/TTML segment documents of the decoded cues.
+ *
+ * The decoders only keep the text: styles, colors and positions are not converted. A cue starts when
+ * the text of the screen changes, that is
+ *   - 608: at EOC (pop-on), CR (roll-up), or any character (paint-on),
+ *   - 708: at ETX, CR, FF, window visibility changes and window definitions.
+ */
+
+#include <stdlib.h>
+#include <string.h>
+#include <stdio.h>
+#include <inttypes.h>
+
+#include "avpipe_cc.h"
+
+#define CC_MAX_TEXT         (CC_708_WINDOWS * CC_708_ROWS * (CC_708_COLS * 4 + 1) + 1)
+#define CC_TYPE_608_FIELD1  0
+#define CC_TYPE_608_FIELD2  1
+#define CC_TYPE_DTVCC_DATA  2
+#define CC_TYPE_DTVCC_START 3
+#define CC_TRANSPARENT      0x20        /* Transparent space is rendered as a space */
+
+/* CEA-608 basic characters that differ from ASCII */
+static uint32_t
+cc_608_char(
+    uint8_t c)
+{
+    switch (c) {
+    case 0x2a: return 0xe1;     /* á */
+    case 0x5c: return 0xe9;     /* é */
+    case 0x5e: return 0xed;     /* í */
+    case 0x5f: return 0xf3;     /* ó */
+    case 0x60: return 0xfa;     /* ú */
+    case 0x7b: return 0xe7;     /* ç */
+    case 0x7c: return 0xf7;     /* ÷ */
+    case 0x7d: return 0xd1;     /* Ñ */
+    case 0x7e: return 0xf1;     /* ñ */
+    case 0x7f: return 0x2588;   /* █ */
+    default: return c;
+    }
+}
+
+/* CEA-608 special characters, 0x11 0x30-0x3f */
+static const uint32_t cc_608_special[16] = {
+    0xae, 0xb0, 0xbd, 0xbf, 0x2122, 0xa2, 0xa3, 0x266a,
+    0xe0, CC_TRANSPARENT, 0xe8, 0xe2, 0xea, 0xee, 0xf4, 0xfb
+};
+
+/* CEA-608 extended characters, 0x12 0x20-0x3f (Spanish, misc, French) and 0x13 0x20-0x3f (Portuguese, German, Danish) */
+static const uint32_t cc_608_extended[2][32] = {
+    {
+        0xc1, 0xc9, 0xd3, 0xda, 0xdc, 0xfc, 0x2018, 0xa1,
+        0x2a, 0x27, 0x2014, 0xa9, 0x2120, 0x2022, 0x201c, 0x201d,
+        0xc0, 0xc2, 0xc7, 0xc8, 0xca, 0xcb, 0xeb, 0xce,
+        0xcf, 0xef, 0xd4, 0xd9, 0xf9, 0xdb, 0xab, 0xbb
+    },
+    {
+        0xc3, 0xe3, 0xcd, 0xcc, 0xec, 0xd2, 0xf2, 0xd5,
+        0xf5, 0x7b, 0x7d, 0x5c, 0x5e, 0x5f, 0x7c, 0x7e,
+        0xc4, 0xe4, 0xd6, 0xf6, 0xdf, 0xa5, 0xa4, 0x2502,
+        0xc5, 0xe5, 0xd8, 0xf8, 0x250c, 0x2510, 0x2514, 0x2518
+    }
+};
+
+/* Rows (1-15) of the preamble address codes, indexed by the first byte & 0x07 and the second byte & 0x20 */
+static const int cc_608_pac_rows[8][2] = {
+    {11, 11}, {1, 2}, {3, 4}, {12, 13}, {14, 15}, {5, 6}, {7, 8}, {9, 10}
+};
+
+static int
+utf8_encode(
+    uint32_t c,
+    char *buf)
+{
+    if (c < 0x80) {
+        buf[0] = c;
+        return 1;
+    }
+    if (c < 0x800) {
+        buf[0] = 0xc0 | (c >> 6);
+        buf[1] = 0x80 | (c & 0x3f);
+        return 2;
+    }
+    if (c < 0x10000) {
+        buf[0] = 0xe0 | (c >> 12);
+        buf[1] = 0x80 | ((c >> 6) & 0x3f);
+        buf[2] = 0x80 | (c & 0x3f);
+        return 3;
+    }
+    buf[0] = 0xf0 | (c >> 18);
+    buf[1] = 0x80 | ((c >> 12) & 0x3f);
+    buf[2] = 0x80 | ((c >> 6) & 0x3f);
+    buf[3] = 0x80 | (c & 0x3f);
+    return 4;
+}
+
+/*
+ * Appends the rows of a screen to text, without the leading and trailing spaces and the empty rows.
+ */
+static int
+render_rows(
+    const uint32_t *cells,
+    int rows,
+    int cols,
+    char *text,
+    int len)
+{
+    for (int r = 0; r < rows; r++) {
+        const uint32_t *row = cells + r * cols;
+        int first = 0, last = cols - 1;
+
+        while (first < cols && (row[first] == 0 || row[first] == ' '))
+            first++;
+        while (last >= first && (row[last] == 0 || row[last] == ' '))
+            last--;
+        if (first > last)
+            continue;
+
+        if (len > 0)
+            text[len++] = '\n';
+        for (int c = first; c <= last; c++)
+            len += utf8_encode(row[c] ? row[c] : ' ', text + len);
+    }
+    text[len] = '\0';
+    return len;
+}
+
+/*
+ * Ends the displayed cue of the track at pts and starts a new cue with text, if the text changed.
+ */
+static void
+track_update(
+    cc_track_t *track,
+    const char *text,
+    int64_t pts)
+{
+    cc_cue_t *last = track->n_cues > 0 ? &track->cues[track->n_cues-1] : NULL;
+
+    if (last && last->end == CC_NO_END) {
+        if (!strcmp(last->text, text))
+            return;
+        last->end = pts;
+        if (last->end <= last->start) {
+            free(last->text);
+            track->n_cues--;
+        }
+    }
+
+    if (text[0] == '\0' || track->n_cues >= CC_MAX_CUES)
+        return;
+
+    cc_cue_t *cue = &track->cues[track->n_cues++];
+    cue->start = pts;
+    cue->end = CC_NO_END;
+    cue->text = strdup(text);
+    track->active = 1;
+}
+
+/* CEA-608 */
+
+static uint32_t *
+cc_608_row(
+    cc_608_t *d,
+    int memory,
+    int row)
+{
+    return d->screen[memory][row];
+}
+
+/*
+ * Scrolls the roll-up rows up, the rows above are erased. The scroll is deferred from the CR to the
+ * next change, so the cue of the CR shows the row that was just completed.
+ */
+static void
+cc_608_scroll(
+    cc_608_t *d)
+{
+    uint32_t (*screen)[CC_608_COLS] = d->screen[d->displayed];
+    int top = d->row - d->rollup_rows + 1;
+
+    if (!d->scroll)
+        return;
+    d->scroll = 0;
+    if (top < 0)
+        top = 0;
+    for (int r = 0; r < top; r++)
+        memset(screen[r], 0, sizeof(screen[r]));
+    for (int r = top; r < d->row; r++)
+        memcpy(screen[r], screen[r+1], sizeof(screen[r]));
+    memset(screen[d->row], 0, sizeof(screen[d->row]));
+    d->col = 0;
+}
+
+static void
+cc_608_carriage_return(
+    cc_608_t *d)
+{
+    if (d->mode != cc_608_rollup)
+        return;
+    cc_608_scroll(d);
+    d->scroll = 1;
+    d->changed = 1;
+}
+
+static void
+cc_608_write(
+    cc_608_t *d,
+    uint32_t c)
+{
+    int memory = d->mode == cc_608_popon ? !d->displayed : d->displayed;
+
+    if (d->mode == cc_608_text)
+        return;
+    cc_608_scroll(d);
+    cc_608_row(d, memory, d->row)[d->col] = c;
+    if (d->col < CC_608_COLS - 1)
+        d->col++;
+    if (d->mode == cc_608_painton)
+        d->changed = 1;
+}
+
+static void
+cc_608_backspace(
+    cc_608_t *d)
+{
+    int memory = d->mode == cc_608_popon ? !d->displayed : d->displayed;
+
+    cc_608_scroll(d);
+    if (d->col > 0)
+        d->col--;
+    cc_608_row(d, memory, d->row)[d->col] = 0;
+    if (d->mode == cc_608_painton)
+        d->changed = 1;
+}
+
+static void
+cc_608_control(
+    cc_608_t *d,
+    uint8_t c1,
+    uint8_t c2)
+{
+    /* c1 is 0x10-0x17, the data channel bit is masked */
+    if ((c1 == 0x14 || c1 == 0x15) && c2 >= 0x20 && c2 <= 0x2f) {
+        switch (c2) {
+        case 0x20:  /* RCL resume caption loading */
+            d->mode = cc_608_popon;
+            break;
+        case 0x21:  /* BS backspace */
+            cc_608_backspace(d);
+            break;
+        case 0x24:  /* DER delete to end of row */
+            {
+                cc_608_scroll(d);
+                int memory = d->mode == cc_608_popon ? !d->displayed : d->displayed;
+                for (int c = d->col; c < CC_608_COLS; c++)
+                    cc_608_row(d, memory, d->row)[c] = 0;
+                if (d->mode == cc_608_painton)
+                    d->changed = 1;
+            }
+            break;
+        case 0x25:  /* RU2, RU3, RU4 roll-up captions */
+        case 0x26:
+        case 0x27:
+            if (d->mode != cc_608_rollup) {
+                memset(d->screen, 0, sizeof(d->screen));
+                d->scroll = 0;
+                d->row = CC_608_ROWS - 1;
+                d->changed = 1;
+            }
+            d->mode = cc_608_rollup;
+            d->rollup_rows = c2 - 0x23;
+            d->col = 0;
+            break;
+        case 0x29:  /* RDC resume direct captioning */
+            d->mode = cc_608_painton;
+            break;
+        case 0x2a:  /* TR text restart, RTD resume text display */
+        case 0x2b:
+            d->mode = cc_608_text;
+            break;
+        case 0x2c:  /* EDM erase displayed memory */
+            memset(d->screen[d->displayed], 0, sizeof(d->screen[d->displayed]));
+            d->scroll = 0;
+            d->changed = 1;
+            break;
+        case 0x2d:  /* CR carriage return */
+            cc_608_carriage_return(d);
+            break;
+        case 0x2e:  /* ENM erase non-displayed memory */
+            memset(d->screen[!d->displayed], 0, sizeof(d->screen[!d->displayed]));
+            break;
+        case 0x2f:  /* EOC end of caption */
+            d->displayed = !d->displayed;
+            d->mode = cc_608_popon;
+            d->changed = 1;
+            break;
+        default:    /* AOF, AON, FON */
+            break;
+        }
+    } else if (c1 == 0x17 && c2 >= 0x21 && c2 <= 0x23) {
+        /* TO1-TO3 tab offsets */
+        d->col += c2 - 0x20;
+        if (d->col >= CC_608_COLS)
+            d->col = CC_608_COLS - 1;
+    } else if (c1 == 0x11 && c2 >= 0x20 && c2 <= 0x2f) {
+        /* Mid-row code, displayed as a space */
+        cc_608_write(d, ' ');
+    } else if (c1 == 0x11 && c2 >= 0x30 && c2 <= 0x3f) {
+        cc_608_write(d, cc_608_special[c2 - 0x30]);
+    } else if ((c1 == 0x12 || c1 == 0x13) && c2 >= 0x20 && c2 <= 0x3f) {
+        /* Extended characters replace the standard character sent before them */
+        cc_608_backspace(d);
+        cc_608_write(d, cc_608_extended[c1 - 0x12][c2 - 0x20]);
+    } else if (c2 >= 0x40 && c2 <= 0x7f) {
+        /* PAC preamble address code */
+        int row = cc_608_pac_rows[c1 & 0x07][(c2 & 0x20) ? 1 : 0] - 1;
+
+        cc_608_scroll(d);
+        if (d->mode == cc_608_rollup && row != d->row) {
+            /* Move the roll-up rows to the new base row */
+            uint32_t (*screen)[CC_608_COLS] = d->screen[d->displayed];
+            uint32_t rows[4][CC_608_COLS];
+            int n = d->rollup_rows;
+
+            for (int i = 0; i < n; i++) {
+                int r = d->row - n + 1 + i;
+                if (r >= 0)
+                    memcpy(rows[i], screen[r], sizeof(rows[i]));
+                else
+                    memset(rows[i], 0, sizeof(rows[i]));
+            }
+            memset(d->screen[d->displayed], 0, sizeof(d->screen[d->displayed]));
+            for (int i = 0; i < n; i++) {
+                int r = row - n + 1 + i;
+                if (r >= 0)
+                    memcpy(screen[r], rows[i], sizeof(rows[i]));
+            }
+        }
+        d->row = row;
+        d->col = (c2 & 0x10) ? ((c2 & 0x0e) >> 1) * 4 : 0;
+    }
+}
+
+static void
+cc_608_decode(
+    cc_ctx_t *cc,
+    int field,
+    uint8_t c1,
+    uint8_t c2)
+{
+    if (c1 >= 0x10 && c1 <= 0x1f) {
+        /* Control codes are sent twice, the repetition is ignored */
+        if (cc->last_code[field][0] == c1 && cc->last_code[field][1] == c2) {
+            cc->last_code[field][0] = 0;
+            return;
+        }
+        cc->last_code[field][0] = c1;
+        cc->last_code[field][1] = c2;
+        cc->channel[field] = (c1 & 0x08) ? 1 : 0;
+        cc_608_control(&cc->cc608[field * 2 + cc->channel[field]], c1 & 0xf7, c2);
+        return;
+    }
+
+    cc->last_code[field][0] = 0;
+    if (c1 < 0x20)
+        return;
+    cc_608_t *d = &cc->cc608[field * 2 + cc->channel[field]];
+    cc_608_write(d, cc_608_char(c1));
+    if (c2 >= 0x20)
+        cc_608_write(d, cc_608_char(c2));
+}
+
+static int
+odd_parity(
+    uint8_t c)
+{
+    c ^= c >> 4;
+    c ^= c >> 2;
+    c ^= c >> 1;
+    return c & 1;
+}
+
+/* CEA-708 */
+
+static void
+cc_708_clear_window(
+    cc_708_window_t *w)
+{
+    memset(w->text, 0, sizeof(w->text));
+    w->pen_row = 0;
+    w->pen_col = 0;
+}
+
+static void
+cc_708_write(
+    cc_708_t *s,
+    uint32_t c)
+{
+    cc_708_window_t *w;
+
+    if (s->current < 0)
+        return;
+    w = &s->windows[s->current];
+    if (!w->defined || w->pen_row >= w->row_count || w->pen_col >= w->col_count)
+        return;
+    w->text[w->pen_row][w->pen_col++] = c;
+}
+
+/* CEA-708 G2 characters, 0 for the unassigned codes */
+static uint32_t
+cc_708_g2(
+    uint8_t c)
+{
+    switch (c) {
+    case 0x20: return CC_TRANSPARENT;
+    case 0x21: return 0xa0;
+    case 0x25: return 0x2026;   /* … */
+    case 0x2a: return 0x160;    /* Š */
+    case 0x2c: return 0x152;    /* Œ */
+    case 0x30: return 0x2588;   /* █ */
+    case 0x31: return 0x2018;
+    case 0x32: return 0x2019;
+    case 0x33: return 0x201c;
+    case 0x34: return 0x201d;
+    case 0x35: return 0x2022;   /* • */
+    case 0x39: return 0x2122;   /* ™ */
+    case 0x3a: return 0x161;    /* š */
+    case 0x3c: return 0x153;    /* œ */
+    case 0x3d: return 0x2120;   /* ℠ */
+    case 0x3f: return 0x178;    /* Ÿ */
+    case 0x76: return 0x215b;   /* ⅛ */
+    case 0x77: return 0x215c;
+    case 0x78: return 0x215d;
+    case 0x79: return 0x215e;
+    case 0x7a: return 0x2502;   /* box drawing */
+    case 0x7b: return 0x2510;
+    case 0x7c: return 0x2514;
+    case 0x7d: return 0x2500;
+    case 0x7e: return 0x2518;
+    case 0x7f: return 0x250c;
+    default: return 0;
+    }
+}
+
+/*
+ * Decodes the service block of a service, returns when the block is complete or a command is truncated.
+ */
+static void
+cc_708_decode_block(
+    cc_708_t *s,
+    const uint8_t *b,
+    int size)
+{
+    int i = 0;
+
+    while (i < size) {
+        uint8_t c = b[i];
+        int len = 1;
+
+        if (c == 0x10) {
+            /* EXT1, followed by a C2, C3, G2 or G3 code */
+            if (i + 1 >= size)
+                return;
+            uint8_t e = b[i+1];
+            if (e < 0x08)
+                len = 2;
+            else if (e < 0x10)
+                len = 3;
+            else if (e < 0x18)
+                len = 4;
+            else if (e < 0x20)
+                len = 5;
+            else if (e < 0x80) {
+                uint32_t g2 = cc_708_g2(e);
+                if (g2)
+                    cc_708_write(s, g2);
+                len = 2;
+            } else if (e < 0x88)
+                len = 6;
+            else if (e < 0x90)
+                len = 7;
+            else if (e < 0xa0) {
+                if (i + 2 >= size)
+                    return;
+                len = 3 + (b[i+2] & 0x3f);
+            } else {
+                if (e == 0xa0)  /* [CC] icon */
+                    cc_708_write(s, 0x33c4);
+                len = 2;
+            }
+        } else if (c < 0x20) {
+            /* C0 */
+            if (c >= 0x18)
+                len = 3;
+            else if (c >= 0x11)
+                len = 2;
+            if (s->current >= 0 && s->windows[s->current].defined) {
+                cc_708_window_t *w = &s->windows[s->current];
+                switch (c) {
+                case 0x03:  /* ETX */
+                    s->changed = 1;
+                    break;
+                case 0x08:  /* BS */
+                    if (w->pen_col > 0)
+                        w->text[w->pen_row][--w->pen_col] = 0;
+                    break;
+                case 0x0c:  /* FF */
+                    cc_708_clear_window(w);
+                    s->changed = 1;
+                    break;
+                case 0x0d:  /* CR */
+                    w->pen_col = 0;
+                    if (w->pen_row + 1 < w->row_count) {
+                        w->pen_row++;
+                    } else {
+                        memmove(w->text[0], w->text[1], sizeof(w->text[0]) * (w->row_count - 1));
+                        memset(w->text[w->row_count-1], 0, sizeof(w->text[0]));
+                    }
+                    s->changed = 1;
+                    break;
+                case 0x0e:  /* HCR */
+                    memset(w->text[w->pen_row], 0, sizeof(w->text[0]));
+                    w->pen_col = 0;
+                    break;
+                default:
+                    break;
+                }
+            }
+        } else if (c < 0x80) {
+            /* G0 */
+            cc_708_write(s, c == 0x7f ? 0x266a : c);
+        } else if (c < 0xa0) {
+            /* C1 */
+            if (c >= 0x98)
+                len = 7;
+            else if (c == 0x97)
+                len = 5;
+            else if (c == 0x91)
+                len = 4;
+            else if (c == 0x90 || c == 0x92)
+                len = 3;
+            else if (c >= 0x88 && c <= 0x8d)
+                len = 2;
+            if (i + len > size)
+                return;
+
+            if (c <= 0x87) {            /* CW0-CW7 set current window */
+                s->current = c & 0x07;
+            } else if (c <= 0x8c) {     /* CLW, DSW, HDW, TGW, DLW */
+                for (int n = 0; n < CC_708_WINDOWS; n++) {
+                    cc_708_window_t *w = &s->windows[n];
+                    if (!(b[i+1] & (1 << n)) || !w->defined)
+                        continue;
+                    if (c == 0x88)
+                        cc_708_clear_window(w);
+                    else if (c == 0x89)
+                        w->visible = 1;
+                    else if (c == 0x8a)
+                        w->visible = 0;
+                    else if (c == 0x8b)
+                        w->visible = !w->visible;
+                    else {
+                        cc_708_clear_window(w);
+                        w->defined = 0;
+                        w->visible = 0;
+                        if (s->current == n)
+                            s->current = -1;
+                    }
+                }
+                s->changed = 1;
+            } else if (c == 0x8f) {     /* RST */
+                memset(s->windows, 0, sizeof(s->windows));
+                s->current = -1;
+                s->changed = 1;
+            } else if (c == 0x92) {     /* SPL set pen location */
+                if (s->current >= 0) {
+                    cc_708_window_t *w = &s->windows[s->current];
+                    w->pen_row = b[i+1] & 0x0f;
+                    w->pen_col = b[i+2] & 0x3f;
+                }
+            } else if (c >= 0x98) {     /* DF0-DF7 define window */
+                cc_708_window_t *w = &s->windows[c & 0x07];
+                int rows = (b[i+4] & 0x0f) + 1;
+                int cols = (b[i+5] & 0x3f) + 1;
+
+                if (!w->defined)
+                    cc_708_clear_window(w);
+                w->defined = 1;
+                w->visible = (b[i+1] & 0x20) != 0;
+                w->row_count = rows > CC_708_ROWS ? CC_708_ROWS : rows;
+                w->col_count = cols > CC_708_COLS ? CC_708_COLS : cols;
+                s->current = c & 0x07;
+                s->changed = 1;
+            }
+            /* DLY, DLC, SPA, SPC and SWA are ignored */
+        } else {
+            /* G1 Latin-1 */
+            cc_708_write(s, c);
+        }
+        i += len;
+    }
+}
+
+static void
+cc_708_decode_packet(
+    cc_ctx_t *cc,
+    const uint8_t *packet,
+    int size)
+{
+    int i = 1;
+
+    while (i < size) {
+        int service = packet[i] >> 5;
+        int block_size = packet[i] & 0x1f;
+
+        /* Null service, the rest of the packet is padding */
+        if (service == 0)
+            break;
+        i++;
+        if (service == 7) {
+            if (i >= size)
+                break;
+            service = packet[i++] & 0x3f;
+        }
+        if (i + block_size > size)
+            break;
+        if (service >= 1 && service <= CC_708_SERVICES)
+            cc_708_decode_block(&cc->svc708[service-1], packet + i, block_size);
+        i += block_size;
+    }
+}
+
+static int
+dtvcc_packet_size(
+    uint8_t header)
+{
+    int code = header & 0x3f;
+    return code == 0 ? 128 : code * 2;
+}
+
+cc_ctx_t *
+cc_ctx_new()
+{
+    cc_ctx_t *cc = (cc_ctx_t *) calloc(1, sizeof(cc_ctx_t));
+
+    for (int i = 0; i < CC_608_TRACKS; i++) {
+        cc->cc608[i].row = CC_608_ROWS - 1;
+        cc->cc608[i].rollup_rows = 2;
+    }
+    for (int i = 0; i < CC_708_SERVICES; i++)
+        cc->svc708[i].current = -1;
+    return cc;
+}
+
+void
+cc_ctx_free(
+    cc_ctx_t *cc)
+{
+    if (!cc)
+        return;
+    for (int t = 0; t < CC_MAX_TRACKS; t++) {
+        for (int i = 0; i < cc->tracks[t].n_cues; i++)
+            free(cc->tracks[t].cues[i].text);
+    }
+    free(cc);
+}
+
+void
+cc_decode(
+    cc_ctx_t *cc,
+    const uint8_t *cc_data,
+    int size,
+    int64_t pts)
+{
+    char text[CC_MAX_TEXT];
+
+    for (int i = 0; i + 2 < size; i += 3) {
+        int cc_valid = cc_data[i] & 0x04;
+        int cc_type = cc_data[i] & 0x03;
+        uint8_t c1 = cc_data[i+1];
+        uint8_t c2 = cc_data[i+2];
+
+        if (cc_type == CC_TYPE_608_FIELD1 || cc_type == CC_TYPE_608_FIELD2) {
+            if (!cc_valid || !odd_parity(c1) || !odd_parity(c2))
+                continue;
+            cc_608_decode(cc, cc_type, c1 & 0x7f, c2 & 0x7f);
+            continue;
+        }
+
+        if (cc_type == CC_TYPE_DTVCC_START) {
+            /* A new packet starts, decode the previous one even if it is short */
+            if (cc->dtvcc_len > 0)
+                cc_708_decode_packet(cc, cc->dtvcc, cc->dtvcc_len);
+            cc->dtvcc_len = 0;
+            if (!cc_valid)
+                continue;
+        } else if (!cc_valid || cc->dtvcc_len == 0) {
+            continue;
+        }
+
+        cc->dtvcc[cc->dtvcc_len++] = c1;
+        cc->dtvcc[cc->dtvcc_len++] = c2;
+        if (cc->dtvcc_len >= dtvcc_packet_size(cc->dtvcc[0])) {
+            cc_708_decode_packet(cc, cc->dtvcc, dtvcc_packet_size(cc->dtvcc[0]));
+            cc->dtvcc_len = 0;
+        }
+    }
+
+    for (int t = 0; t < CC_608_TRACKS; t++) {
+        cc_608_t *d = &cc->cc608[t];
+        if (!d->changed)
+            continue;
+        render_rows(&d->screen[d->displayed][0][0], CC_608_ROWS, CC_608_COLS, text, 0);
+        track_update(&cc->tracks[t], text, pts);
+        d->changed = 0;
+    }
+
+    for (int s = 0; s < CC_708_SERVICES; s++) {
+        cc_708_t *svc = &cc->svc708[s];
+        int len = 0;
+        if (!svc->changed)
+            continue;
+        text[0] = '\0';
+        for (int n = 0; n < CC_708_WINDOWS; n++) {
+            cc_708_window_t *w = &svc->windows[n];
+            if (w->defined && w->visible)
+                len = render_rows(&w->text[0][0], CC_708_ROWS, CC_708_COLS, text, len);
+        }
+        track_update(&cc->tracks[CC_608_TRACKS + s], text, pts);
+        svc->changed = 0;
+    }
+}
+
+void
+cc_flush(
+    cc_ctx_t *cc,
+    int64_t pts)
+{
+    for (int t = 0; t < CC_MAX_TRACKS; t++)
+        track_update(&cc->tracks[t], "", pts);
+}
+
+static void
+append(
+    char **buf,
+    int *len,
+    int *cap,
+    const char *s)
+{
+    int n = strlen(s);
+
+    if (*len + n + 1 > *cap) {
+        while (*len + n + 1 > *cap)
+            *cap *= 2;
+        *buf = (char *) realloc(*buf, *cap);
+    }
+    memcpy(*buf + *len, s, n + 1);
+    *len += n;
+}
+
+/* Appends text, escaped for WebVTT and XML. Rows are separated with sep. */
+static void
+append_text(
+    char **buf,
+    int *len,
+    int *cap,
+    const char *text,
+    const char *sep)
+{
+    char c[2] = {0, 0};
+
+    for (const char *p = text; *p; p++) {
+        switch (*p) {
+        case '&':
+            append(buf, len, cap, "&amp;");
+            break;
+        case '<':
+            append(buf, len, cap, "&lt;");
+            break;
+        case '>':
+            append(buf, len, cap, "&gt;");
+            break;
+        case '\n':
+            append(buf, len, cap, sep);
+            break;
+        default:
+            c[0] = *p;
+            append(buf, len, cap, c);
+        }
+    }
+}
+
+static void
+format_time(
+    int64_t pts,
+    int tb_num,
+    int tb_den,
+    char *buf,
+    int size)
+{
+    int64_t ms = pts <= 0 ? 0 : (pts * 1000 * tb_num + tb_den / 2) / tb_den;
+
+    snprintf(buf, size, "%02"PRId64":%02d:%02d.%03d",
+        ms / 3600000, (int) (ms / 60000 % 60), (int) (ms / 1000 % 60), (int) (ms % 1000));
+}
+
+char *
+cc_segment_document(
+    cc_track_t *track,
+    cc_format_t format,
+    int64_t start,
+    int64_t end,
+    int tb_num,
+    int tb_den)
+{
+    int cap = 1024;
+    int len = 0;
+    char *buf = (char *) malloc(cap);
+    char begin_str[32], end_str[32];
+    char line[128];
+
+    buf[0] = '\0';
+    if (format == cc_format_webvtt) {
+        append(&buf, &len, &cap, "WEBVTT\n\n");
+    } else {
+        append(&buf, &len, &cap,
+            "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"
+            "<tt xmlns=\"http://www.w3.org/ns/ttml\" xmlns:ttp=\"http://www.w3.org/ns/ttml#parameter\""
+            " xmlns:tts=\"http://www.w3.org/ns/ttml#styling\""
+            " ttp:profile=\"http://www.w3.org/ns/ttml/profile/imsc1/text\" ttp:timeBase=\"media\" xml:lang=\"\">\n"
+            "<head>\n"
+            "<styling><style xml:id=\"s0\" tts:color=\"white\" tts:backgroundColor=\"black\""
+            " tts:fontFamily=\"monospaceSansSerif\"/></styling>\n"
+            "<layout><region xml:id=\"r0\" tts:origin=\"10% 10%\" tts:extent=\"80% 80%\""
+            " tts:displayAlign=\"after\" tts:textAlign=\"center\"/></layout>\n"
+            "</head>\n"
+            "<body region=\"r0\" style=\"s0\">\n<div>\n");
+    }
+
+    for (int i = 0; i < track->n_cues; i++) {
+        cc_cue_t *cue = &track->cues[i];
+        int64_t cue_start = cue->start > start ? cue->start : start;
+        int64_t cue_end = cue->end < end ? cue->end : end;
+
+        if (cue_start >= cue_end)
+            continue;
+        format_time(cue_start, tb_num, tb_den, begin_str, sizeof(begin_str));
+        format_time(cue_end, tb_num, tb_den, end_str, sizeof(end_str));
+        if (format == cc_format_webvtt) {
+            snprintf(line, sizeof(line), "%s --> %s\n", begin_str, end_str);
+            append(&buf, &len, &cap, line);
+            append_text(&buf, &len, &cap, cue->text, "\n");
+            append(&buf, &len, &cap, "\n\n");
+        } else {
+            snprintf(line, sizeof(line), "<p begin=\"%s\" end=\"%s\">", begin_str, end_str);
+            append(&buf, &len, &cap, line);
+            append_text(&buf, &len, &cap, cue->text, "<br/>");
+            append(&buf, &len, &cap, "</p>\n");
+        }
+    }
+
+    if (format == cc_format_ttml)
+        append(&buf, &len, &cap, "</div>\n</body>\n</tt>\n");
+    return buf;
+}
+
+void
+cc_segment_done(
+    cc_track_t *track,
+    int64_t end)
+{
+    int n = 0;
+
+    for (int i = 0; i < track->n_cues; i++) {
+        cc_cue_t *cue = &track->cues[i];
+        if (cue->end <= end) {
+            free(cue->text);
+            continue;
+        }
+        track->cues[n++] = *cue;
+    }
+    track->n_cues = n;
+}
+
+const char *
+cc_track_name(
+    int track)
+{
+    static const char *names[CC_MAX_TRACKS] = {
+        "CC1", "CC2", "CC3", "CC4",
+        "SERVICE1", "SERVICE2", "SERVICE3", "SERVICE4", "SERVICE5", "SERVICE6"
+    };
+
+    if (track < 0 || track >= CC_MAX_TRACKS)
+        return "";
+    return names[track];
+}
+
+static void
+a53_queue_push(
+    cc_a53_t *a53,
+    cc_a53_queue_t *q,
+    const uint8_t *pkt)
+{
+    /* Drop the oldest cc_data_pkt, the queue only fills up if the output has fewer frames than the input */
+    if (q->n == CC_A53_QUEUE_SIZE) {
+        q->head = (q->head + 1) % CC_A53_QUEUE_SIZE;
+        q->n--;
+        a53->dropped++;
+    }
+    memcpy(q->data[(q->head + q->n) % CC_A53_QUEUE_SIZE], pkt, 3);
+    q->n++;
+}
+
+static int
+a53_queue_pop(
+    cc_a53_queue_t *q,
+    uint8_t *pkt)
+{
+    if (q->n == 0)
+        return 0;
+    memcpy(pkt, q->data[q->head], 3);
+    q->head = (q->head + 1) % CC_A53_QUEUE_SIZE;
+    q->n--;
+    return 1;
+}
+
+void
+cc_a53_push(
+    cc_a53_t *a53,
+    const uint8_t *cc_data,
+    int size)
+{
+    for (int i = 0; i + 2 < size; i += 3) {
+        int cc_valid = cc_data[i] & 0x04;
+        int cc_type = cc_data[i] & 0x03;
+
+        if (!cc_valid)
+            continue;
+        a53->detected = 1;
+        if (cc_type == CC_TYPE_608_FIELD1 || cc_type == CC_TYPE_608_FIELD2)
+            a53_queue_push(a53, &a53->field[cc_type], cc_data + i);
+        else
+            a53_queue_push(a53, &a53->dtvcc, cc_data + i);
+    }
+}
+
+void
+cc_a53_pop(
+    cc_a53_t *a53,
+    uint8_t *cc_data,
+    int cc_count)
+{
+    int i = 0;
+
+    for (int f = 0; f < 2 && i < cc_count; f++, i++) {
+        if (!a53_queue_pop(&a53->field[f], cc_data + 3*i)) {
+            /* marker bits, cc_valid = 0, cc_type = field */
+            cc_data[3*i] = 0xf8 | f;
+            cc_data[3*i+1] = 0;
+            cc_data[3*i+2] = 0;
+        }
+    }
+
+    for (; i < cc_count; i++) {
+        if (!a53_queue_pop(&a53->dtvcc, cc_data + 3*i)) {
+            cc_data[3*i] = 0xf8 | CC_TYPE_DTVCC_DATA;
+            cc_data[3*i+1] = 0;
+            cc_data[3*i+2] = 0;
+        }
+    }
+}
+
+int
+cc_a53_count(
+    double frame_rate)
+{
+    int cc_count;
+
+    if (frame_rate <= 0)
+        return 20;
+    cc_count = (int) (600 / frame_rate + 0.5);
+    if (cc_count < 3)
+        return 3;
+    if (cc_count > CC_A53_MAX_COUNT)
+        return CC_A53_MAX_COUNT;
+    return cc_count;
+}
@@ -0,0 +1,310 @@
+/*
+ * avpipe_compare.c
+ *
+ * Per frame scores of a comparison, aggregate statistics and the JSON report.
+ */
+
+#include <math.h>
+#include <stddef.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "avpipe_compare.h"
+
+#define COMPARE_FRAME_JSON_SZ   96
+#define COMPARE_STATS_JSON_SZ   256
+
+typedef struct compare_stats_t {
+    double  mean;
+    double  min;
+    double  max;
+    double  p1;
+    double  p5;
+    double  p10;
+    double  p50;
+} compare_stats_t;
+
+typedef struct compare_segment_t {
+    double  start;
+    double  end;
+    double  psnr;
+    double  ssim;
+    double  vmaf;
+    int     n_frames;
+} compare_segment_t;
+
+int
+compare_result_add(
+    compare_result_t *result,
+    const compare_frame_t *frame)
+{
+    if (result->n_frames == result->size) {
+        int size = result->size ? result->size * 2 : 256;
+        compare_frame_t *frames = realloc(result->frames, size * sizeof(compare_frame_t));
+        if (!frames)
+            return -1;
+        result->frames = frames;
+        result->size = size;
+    }
+    result->frames[result->n_frames++] = *frame;
+    return 0;
+}
+
+void
+compare_result_free(
+    compare_result_t *result)
+{
+    free(result->frames);
+    memset(result, 0, sizeof(*result));
+}
+
+int
+compare_read_vmaf_log(
+    compare_result_t *result,
+    const char *path)
+{
+    FILE *fp = fopen(path, "r");
+    char *doc, *p, *end;
+    long size;
+    int n = 0;
+
+    if (!fp)
+        return -1;
+
+    fseek(fp, 0, SEEK_END);
+    size = ftell(fp);
+    fseek(fp, 0, SEEK_SET);
+    doc = size > 0 ? calloc(size + 1, 1) : NULL;
+    if (!doc || fread(doc, 1, size, fp) != (size_t)size) {
+        free(doc);
+        fclose(fp);
+        return -1;
+    }
+    fclose(fp);
+
+    /* The frames come first, the pooled scores of libvmaf 2 ("pooled_metrics") or 1 ("aggregate") after */
+    p = strstr(doc, "\"frames\"");
+    if ((end = strstr(doc, "\"pooled_metrics\"")) == NULL)
+        end = strstr(doc, "\"aggregate\"");
+    while (p && (p = strstr(p, "\"vmaf\"")) != NULL && (!end || p < end) && n < result->n_frames) {
+        char *value;
+        double score;
+
+        p += strlen("\"vmaf\"");
+        while (*p == ' ' || *p == ':')
+            p++;
+        score = strtod(p, &value);
+        if (value == p)
+            continue;
+        result->frames[n++].vmaf = score;
+        p = value;
+    }
+
+    free(doc);
+    return n;
+}
+
+static int
+cmp_double(
+    const void *a,
+    const void *b)
+{
+    double x = *(const double *)a;
+    double y = *(const double *)b;
+
+    return x < y ? -1 : x > y;
+}
+
+/*
+ * Returns the score of the frame for the metric, which is the offset of the score in compare_frame_t.
+ */
+static double
+frame_score(
+    const compare_frame_t *frame,
+    size_t metric)
+{
+    return *(const double *)((const char *)frame + metric);
+}
+
+/*
+ * Computes the statistics of a metric over all the frames, with the nearest rank percentiles.
+ */
+static int
+compare_stats(
+    const compare_result_t *result,
+    size_t metric,
+    compare_stats_t *stats)
+{
+    int n = result->n_frames;
+    double *scores = calloc(n, sizeof(double));
+    double sum = 0;
+
+    if (!scores)
+        return -1;
+
+    for (int i = 0; i < n; i++) {
+        scores[i] = frame_score(&result->frames[i], metric);
+        sum += scores[i];
+    }
+    qsort(scores, n, sizeof(double), cmp_double);
+
+#define PERCENTILE(p) scores[(int)ceil((p) / 100.0 * n) > 0 ? (int)ceil((p) / 100.0 * n) - 1 : 0]
+    stats->mean = sum / n;
+    stats->min = scores[0];
+    stats->max = scores[n - 1];
+    stats->p1 = PERCENTILE(1);
+    stats->p5 = PERCENTILE(5);
+    stats->p10 = PERCENTILE(10);
+    stats->p50 = PERCENTILE(50);
+#undef PERCENTILE
+
+    free(scores);
+    return 0;
+}
+
+static int
+stats_json(
+    char *buf,
+    int size,
+    const char *name,
+    const compare_stats_t *s)
+{
+    return snprintf(buf, size,
+        ",\"%s\":{\"mean\":%.4f,\"min\":%.4f,\"max\":%.4f,\"p1\":%.4f,\"p5\":%.4f,\"p10\":%.4f,\"p50\":%.4f}",
+        name, s->mean, s->min, s->max, s->p1, s->p5, s->p10, s->p50);
+}
+
+static int
+cmp_segment_vmaf(
+    const void *a,
+    const void *b)
+{
+    return cmp_double(&((const compare_segment_t *)a)->vmaf, &((const compare_segment_t *)b)->vmaf);
+}
+
+static int
+cmp_segment_ssim(
+    const void *a,
+    const void *b)
+{
+    return cmp_double(&((const compare_segment_t *)a)->ssim, &((const compare_segment_t *)b)->ssim);
+}
+
+/*
+ * Splits the frames in segments of seg_duration starting at the first frame, and returns the mean scores of the
+ * segments in *segments, sorted from the worst.
+ */
+static int
+compare_segments(
+    const compare_result_t *result,
+    double seg_duration,
+    compare_segment_t **segments)
+{
+    double t0 = result->frames[0].time;
+    int n_segments = (int)((result->frames[result->n_frames - 1].time - t0) / seg_duration) + 1;
+    compare_segment_t *s = calloc(n_segments, sizeof(compare_segment_t));
+    int n = 0;
+
+    if (!s)
+        return -1;
+
+    for (int i = 0; i < result->n_frames; i++) {
+        const compare_frame_t *f = &result->frames[i];
+        int k = (int)((f->time - t0) / seg_duration);
+
+        if (k < 0 || k >= n_segments)
+            continue;
+        s[k].psnr += f->psnr;
+        s[k].ssim += f->ssim;
+        s[k].vmaf += f->vmaf;
+        s[k].n_frames++;
+    }
+
+    /* Segments without frames (a gap in the distorted) are dropped */
+    for (int k = 0; k < n_segments; k++) {
+        if (s[k].n_frames == 0)
+            continue;
+        s[n].start = t0 + k * seg_duration;
+        s[n].end = s[n].start + seg_duration;
+        s[n].psnr = s[k].psnr / s[k].n_frames;
+        s[n].ssim = s[k].ssim / s[k].n_frames;
+        s[n].vmaf = s[k].vmaf / s[k].n_frames;
+        s[n].n_frames = s[k].n_frames;
+        n++;
+    }
+    qsort(s, n, sizeof(compare_segment_t), result->has_vmaf ? cmp_segment_vmaf : cmp_segment_ssim);
+
+    *segments = s;
+    return n;
+}
+
+char *
+compare_report_json(
+    const compare_result_t *result,
+    double seg_duration,
+    int n_worst)
+{
+    compare_stats_t psnr, ssim, vmaf;
+    compare_segment_t *segments = NULL;
+    int n_segments = 0;
+    int size, len;
+    char *doc;
+
+    if (seg_duration <= 0)
+        seg_duration = COMPARE_DEFAULT_SEG_DURATION;
+    if (n_worst <= 0)
+        n_worst = COMPARE_DEFAULT_N_WORST;
+
+    if (result->n_frames > 0) {
+        if (compare_stats(result, offsetof(compare_frame_t, psnr), &psnr) < 0 ||
+            compare_stats(result, offsetof(compare_frame_t, ssim), &ssim) < 0 ||
+            (result->has_vmaf && compare_stats(result, offsetof(compare_frame_t, vmaf), &vmaf) < 0) ||
+            (n_segments = compare_segments(result, seg_duration, &segments)) < 0)
+            return NULL;
+        if (n_worst > n_segments)
+            n_worst = n_segments;
+    } else {
+        n_worst = 0;
+    }
+
+    size = 128 + 3 * COMPARE_STATS_JSON_SZ + (n_worst + result->n_frames) * COMPARE_FRAME_JSON_SZ;
+    doc = calloc(size, 1);
+    if (!doc) {
+        free(segments);
+        return NULL;
+    }
+
+    len = snprintf(doc, size, "{\"width\":%d,\"height\":%d,\"n_frames\":%d,\"metric\":\"%s\"",
+        result->width, result->height, result->n_frames, result->has_vmaf ? "vmaf" : "ssim");
+    if (result->n_frames > 0) {
+        len += stats_json(doc + len, size - len, "psnr", &psnr);
+        len += stats_json(doc + len, size - len, "ssim", &ssim);
+        if (result->has_vmaf)
+            len += stats_json(doc + len, size - len, "vmaf", &vmaf);
+    }
+
+    len += snprintf(doc + len, size - len, ",\"worst_segments\":[");
+    for (int i = 0; i < n_worst; i++) {
+        const compare_segment_t *s = &segments[i];
+        len += snprintf(doc + len, size - len, "%s{\"start\":%.3f,\"end\":%.3f,\"psnr\":%.4f,\"ssim\":%.6f",
+            i > 0 ? "," : "", s->start, s->end, s->psnr, s->ssim);
+        if (result->has_vmaf)
+            len += snprintf(doc + len, size - len, ",\"vmaf\":%.4f", s->vmaf);
+        len += snprintf(doc + len, size - len, "}");
+    }
+
+    len += snprintf(doc + len, size - len, "],\"frames\":[");
+    for (int i = 0; i < result->n_frames; i++) {
+        const compare_frame_t *f = &result->frames[i];
+        len += snprintf(doc + len, size - len, "%s{\"time\":%.3f,\"psnr\":%.4f,\"ssim\":%.6f",
+            i > 0 ? "," : "", f->time, f->psnr, f->ssim);
+        if (result->has_vmaf)
+            len += snprintf(doc + len, size - len, ",\"vmaf\":%.4f", f->vmaf);
+        len += snprintf(doc + len, size - len, "}");
+    }
+    snprintf(doc + len, size - len, "]}");
+
+    free(segments);
+    return doc;
+}
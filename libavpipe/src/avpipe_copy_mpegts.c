@@ -14,6 +14,8 @@
 #include "avpipe_copy_mpegts.h"
 #include "elv_log.h"
 
+#define MPEGTS_TIME_BASE    (AVRational){1, 90000}
+
 static int
 copy_mpegts_set_encoder_options(
     cp_ctx_t *cp_ctx,
@@ -197,6 +199,44 @@ copy_mpegts_prepare_audio_encoder(
     return 0;
 }
 
+/*
+ * Prepare the output stream of the SCTE-35 cues inserted by avpipe_insert_cue().
+ * If the input has a SCTE-35 stream the cues are merged with it, otherwise a new data stream is added.
+ */
+static int
+copy_mpegts_prepare_scte35(
+    cp_ctx_t *cp_ctx,
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    AVStream *out_stream;
+    int stream_index = decoder_context->data_scte35_stream_index;
+
+    if (stream_index >= 0) {
+        out_stream = encoder_context->stream[stream_index];
+    } else {
+        out_stream = avformat_new_stream(encoder_context->format_context, NULL);
+        if (!out_stream) {
+            elv_err("Failed allocating SCTE-35 output stream, url=%s", params->url);
+            return eav_mem_alloc;
+        }
+        stream_index = out_stream->index;
+        encoder_context->stream[stream_index] = out_stream;
+        out_stream->codecpar->codec_type = AVMEDIA_TYPE_DATA;
+        out_stream->codecpar->codec_id = AV_CODEC_ID_SCTE_35;
+        out_stream->time_base = MPEGTS_TIME_BASE;
+    }
+
+    /* The mpegts muxer uses the stream id as the PID */
+    out_stream->id = params->scte35_pid;
+    cp_ctx->scte35_stream_index = stream_index;
+
+    elv_log("Prepared SCTE-35 cue stream %d, pid=%d, url=%s", stream_index, params->scte35_pid, params->url);
+
+    return eav_success;
+}
+
 /*
  * Prepare the MPEGTS copy (bypass) encoder.
  * This is largely similar to the bypass section of the main 'prepare_encoder()' and must
@@ -293,6 +333,12 @@ copy_mpegts_prepare_encoder(
         return rc;
     }
 
+    if (params->scte35_pid > 0) {
+        rc = copy_mpegts_prepare_scte35(cp_ctx, encoder_context, decoder_context, params);
+        if (rc != eav_success)
+            return rc;
+    }
+
     /*
      * Allocate a single out_tracker (and out_handler) for all video and a audio streams.
      */
@@ -309,17 +355,121 @@ copy_mpegts_prepare_encoder(
     return eav_success;
 }
 
+/*
+ * Write a SCTE-35 cue at pts, the input PTS (90kHz) of the packet that follows it. The output keeps the
+ * input timestamps (see stream_start_pts), so the section is written as is, like the SCTE-35 sections
+ * of the input.
+ */
 static int
-copy_mpegts(
+copy_mpegts_write_cue(
     cp_ctx_t *cp_ctx,
+    xc_cue_t *cue,
+    int64_t pts,
+    xcparams_t *p)
+{
+    AVFormatContext *format_context = cp_ctx->encoder_ctx.format_context;
+    AVStream *out_stream = format_context->streams[cp_ctx->scte35_stream_index];
+    int64_t start_pts = cp_ctx->stream_start_pts != AV_NOPTS_VALUE ? cp_ctx->stream_start_pts : 0;
+    int rc;
+
+    if (cp_ctx->scte35_pts != AV_NOPTS_VALUE && pts < cp_ctx->scte35_pts)
+        pts = cp_ctx->scte35_pts;
+    cp_ctx->scte35_pts = pts;
+
+    AVPacket *packet = av_packet_alloc();
+    if (!packet || av_new_packet(packet, cue->size) < 0) {
+        av_packet_free(&packet);
+        return eav_mem_alloc;
+    }
+    memcpy(packet->data, cue->section, cue->size);
+    packet->stream_index = cp_ctx->scte35_stream_index;
+    packet->pts = av_rescale_q(pts - start_pts, MPEGTS_TIME_BASE, out_stream->time_base);
+    packet->dts = packet->pts;
+
+    elv_log("Inserting SCTE-35 cue pts=%"PRId64", cue_pts=%"PRId64", size=%d, url=%s",
+        pts, cue->pts, cue->size, p->url);
+
+    rc = av_interleaved_write_frame(format_context, packet);
+    av_packet_free(&packet);
+    if (rc < 0) {
+        elv_err("Failure in writing SCTE-35 cue rc=%d url=%s", rc, p->url);
+        return eav_write_frame;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Write the cues that are due at the input PTS of packet, or at its DTS or the last PTS if the packet
+ * has no PTS. The cues wait for the first packet with a timestamp.
+ */
+static int
+copy_mpegts_write_cues(
+    xctx_t *xctx,
+    AVPacket *packet,
+    xcparams_t *p)
+{
+    cp_ctx_t *cp_ctx = &xctx->cp_ctx;
+    AVStream *in_stream = xctx->decoder_ctx.format_context->streams[packet->stream_index];
+    int64_t pts = packet->pts != AV_NOPTS_VALUE ? packet->pts : packet->dts;
+    int rc = eav_success;
+
+    if (pts != AV_NOPTS_VALUE)
+        pts = av_rescale_q(pts, in_stream->time_base, MPEGTS_TIME_BASE);
+    else if ((pts = cp_ctx->last_pts) == AV_NOPTS_VALUE)
+        return eav_success;
+
+    for (;;) {
+        pthread_mutex_lock(&xctx->cue_lock);
+        xc_cue_t *cue = xctx->cues;
+        /* A cue without PTS is due now (AV_NOPTS_VALUE is the smallest PTS) */
+        if (cue == NULL || cue->pts > pts) {
+            pthread_mutex_unlock(&xctx->cue_lock);
+            break;
+        }
+        xctx->cues = cue->next;
+        pthread_mutex_unlock(&xctx->cue_lock);
+
+        rc = copy_mpegts_write_cue(cp_ctx, cue, pts, p);
+        free(cue->section);
+        free(cue);
+        if (rc != eav_success)
+            break;
+    }
+
+    return rc;
+}
+
+static int
+copy_mpegts(
+    xctx_t *xctx,
     AVPacket *packet,
     xcparams_t *p)
 {
     AVFormatContext *format_context;
+    cp_ctx_t *cp_ctx = &xctx->cp_ctx;
     coderctx_t *encoder_context = &cp_ctx->encoder_ctx;
+    AVStream *in_stream = xctx->decoder_ctx.format_context->streams[packet->stream_index];
+    int is_scte35 = packet->stream_index == xctx->decoder_ctx.data_scte35_stream_index;
 
     format_context = encoder_context->format_context;
 
+    if (cp_ctx->scte35_stream_index >= 0) {
+        int rc = copy_mpegts_write_cues(xctx, packet, p);
+        if (rc != eav_success)
+            return rc;
+    }
+
+    /*
+     * The demuxer only times the SCTE-35 sections of the input after a PCR, the others are written at the last
+     * PTS instead of being dropped.
+     */
+    if (is_scte35 && packet->pts == AV_NOPTS_VALUE && packet->dts == AV_NOPTS_VALUE &&
+        cp_ctx->last_pts != AV_NOPTS_VALUE) {
+        packet->pts = av_rescale_q(cp_ctx->last_pts, MPEGTS_TIME_BASE, in_stream->time_base);
+        packet->dts = packet->pts;
+    }
+
     if (packet->pts == AV_NOPTS_VALUE ||
         packet->dts == AV_NOPTS_VALUE ||
         packet->data == NULL) {
@@ -332,6 +482,19 @@ copy_mpegts(
         return eav_success; // Respect the logic in regular bypass encoder
     }
 
+    if (is_scte35) {
+        /* The inserted cues are on the same stream, its timestamps can't go back */
+        int64_t pts = av_rescale_q(packet->pts, in_stream->time_base, MPEGTS_TIME_BASE);
+        if (cp_ctx->scte35_pts != AV_NOPTS_VALUE && pts < cp_ctx->scte35_pts) {
+            packet->pts = av_rescale_q(cp_ctx->scte35_pts, MPEGTS_TIME_BASE, in_stream->time_base);
+            packet->dts = packet->pts;
+        } else {
+            cp_ctx->scte35_pts = pts;
+        }
+    } else {
+        cp_ctx->last_pts = av_rescale_q(packet->pts, in_stream->time_base, MPEGTS_TIME_BASE);
+    }
+
     packet->pts -= cp_ctx->stream_start_pts;
     packet->dts -= cp_ctx->stream_start_pts;
 
@@ -376,7 +539,7 @@ copy_mpegts_func(
         }
 
         err = copy_mpegts(
-            cp_ctx,
+            xctx,
             packet,
             params
         );
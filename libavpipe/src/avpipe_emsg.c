@@ -0,0 +1,160 @@
+/*
+ * avpipe_emsg.c
+ *
+ * Version 1 emsg boxes (ISO/IEC 23009-1 5.10.3.3) and a scanner of the top level
+ * boxes of a fragmented MP4 output, to insert the emsg boxes before a moof box.
+ */
+
+#include <stdlib.h>
+#include <string.h>
+
+#include "avpipe_emsg.h"
+
+#define EMSG_HEADER_LEN     32      /* size, type, version/flags, timescale, presentation_time (64 bit), event_duration, id */
+
+static void
+write32(
+    uint8_t *buf,
+    uint32_t v)
+{
+    buf[0] = v >> 24;
+    buf[1] = v >> 16;
+    buf[2] = v >> 8;
+    buf[3] = v;
+}
+
+static uint32_t
+read32(
+    const uint8_t *buf)
+{
+    return ((uint32_t)buf[0] << 24) | ((uint32_t)buf[1] << 16) | ((uint32_t)buf[2] << 8) | buf[3];
+}
+
+emsg_event_t *
+emsg_event_new(
+    const char *scheme_id_uri,
+    const char *value,
+    int64_t pts,
+    int64_t duration,
+    uint32_t id,
+    const uint8_t *message_data,
+    int message_size)
+{
+    emsg_event_t *event = (emsg_event_t *) calloc(1, sizeof(emsg_event_t));
+
+    event->scheme_id_uri = scheme_id_uri;
+    event->value = value;
+    event->pts = pts;
+    event->duration = duration;
+    event->id = id;
+    event->seg_index = -1;
+    if (message_size > 0) {
+        event->message_data = (uint8_t *) malloc(message_size);
+        memcpy(event->message_data, message_data, message_size);
+        event->message_size = message_size;
+    }
+    return event;
+}
+
+void
+emsg_event_free(
+    emsg_event_t *event)
+{
+    if (!event)
+        return;
+    free(event->message_data);
+    free(event);
+}
+
+int
+emsg_box(
+    emsg_event_t *event,
+    uint8_t *buf)
+{
+    int scheme_len = strlen(event->scheme_id_uri) + 1;
+    int value_len = strlen(event->value) + 1;
+    int size = EMSG_HEADER_LEN + scheme_len + value_len + event->message_size;
+
+    if (!buf)
+        return size;
+
+    write32(buf, size);
+    memcpy(buf + 4, "emsg", 4);
+    write32(buf + 8, 1 << 24);      /* version 1, flags 0 */
+    write32(buf + 12, event->timescale);
+    write32(buf + 16, event->presentation_time >> 32);
+    write32(buf + 20, event->presentation_time);
+    write32(buf + 24, event->event_duration);
+    write32(buf + 28, event->id);
+    buf += EMSG_HEADER_LEN;
+    memcpy(buf, event->scheme_id_uri, scheme_len);
+    buf += scheme_len;
+    memcpy(buf, event->value, value_len);
+    buf += value_len;
+    if (event->message_size > 0)
+        memcpy(buf, event->message_data, event->message_size);
+    return size;
+}
+
+int
+mp4_box_scan(
+    mp4_box_scanner_t *scanner,
+    const uint8_t *buf,
+    int buf_size,
+    uint32_t *box_type)
+{
+    int header_size;
+    int n;
+
+    *box_type = 0;
+
+    /* The box extends to the end of the output */
+    if (scanner->box_left < 0)
+        return buf_size;
+
+    if (scanner->box_left > 0) {
+        scanner->header_done = 0;
+        scanner->header_len = 0;
+        n = scanner->box_left < buf_size ? scanner->box_left : buf_size;
+        scanner->box_left -= n;
+        return n;
+    }
+
+    /* The header returned by the previous call was written */
+    if (scanner->header_done) {
+        scanner->header_done = 0;
+        scanner->header_len = 0;
+    }
+
+    /* A size of 1 means a 64-bit largesize follows the type */
+    header_size = 8;
+    if (scanner->header_len >= 4 && read32(scanner->header) == 1)
+        header_size = 16;
+
+    n = 0;
+    while (scanner->header_len < header_size && n < buf_size) {
+        scanner->header[scanner->header_len++] = buf[n++];
+        if (scanner->header_len == 4 && read32(scanner->header) == 1)
+            header_size = 16;
+    }
+
+    if (scanner->header_len < header_size) {
+        *box_type = MP4_BOX_INCOMPLETE;
+        return n;
+    }
+
+    uint64_t size = read32(scanner->header);
+    if (size == 1)
+        size = ((uint64_t)read32(scanner->header + 8) << 32) | read32(scanner->header + 12);
+
+    if (size == 0)
+        scanner->box_left = -1;
+    else if (size < header_size)
+        scanner->box_left = 0;  /* Invalid box, keep scanning after the header */
+    else
+        scanner->box_left = size - header_size;
+
+    scanner->header_done = 1;
+    *box_type = read32(scanner->header + 4);
+    return n;
+}
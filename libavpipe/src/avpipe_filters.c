@@ -2,9 +2,546 @@
  * avpipe_filters.c
  */
 
+#include <libavutil/pixdesc.h>
+
 #include "avpipe_xc.h"
 #include "elv_log.h"
 
+/*
+ * @brief   Sets the color primaries, transfer and matrix of a color target.
+ */
+void
+color_target_tags(
+    color_target_t color_target,
+    enum AVColorPrimaries *primaries,
+    enum AVColorTransferCharacteristic *trc,
+    enum AVColorSpace *colorspace)
+{
+    switch (color_target) {
+    case color_target_pq:
+        *primaries = AVCOL_PRI_BT2020;
+        *trc = AVCOL_TRC_SMPTE2084;
+        *colorspace = AVCOL_SPC_BT2020_NCL;
+        break;
+    case color_target_hlg:
+        *primaries = AVCOL_PRI_BT2020;
+        *trc = AVCOL_TRC_ARIB_STD_B67;
+        *colorspace = AVCOL_SPC_BT2020_NCL;
+        break;
+    default:
+        *primaries = AVCOL_PRI_BT709;
+        *trc = AVCOL_TRC_BT709;
+        *colorspace = AVCOL_SPC_BT709;
+        break;
+    }
+}
+
+/* Names of the zscale options, an unspecified input color space is taken as BT.709 */
+static const char *
+zscale_primaries(
+    enum AVColorPrimaries primaries)
+{
+    switch (primaries) {
+    case AVCOL_PRI_BT2020:      return "2020";
+    case AVCOL_PRI_SMPTE170M:   return "170m";
+    case AVCOL_PRI_SMPTE240M:   return "240m";
+    default:                    return "709";
+    }
+}
+
+static const char *
+zscale_transfer(
+    enum AVColorTransferCharacteristic trc)
+{
+    switch (trc) {
+    case AVCOL_TRC_SMPTE2084:       return "smpte2084";
+    case AVCOL_TRC_ARIB_STD_B67:    return "arib-std-b67";
+    case AVCOL_TRC_BT2020_10:       return "2020_10";
+    case AVCOL_TRC_BT2020_12:       return "2020_12";
+    case AVCOL_TRC_SMPTE170M:       return "601";
+    default:                        return "709";
+    }
+}
+
+static const char *
+zscale_matrix(
+    enum AVColorSpace colorspace)
+{
+    switch (colorspace) {
+    case AVCOL_SPC_BT2020_NCL:  return "2020_ncl";
+    case AVCOL_SPC_BT2020_CL:   return "2020_cl";
+    case AVCOL_SPC_BT470BG:     return "470bg";
+    case AVCOL_SPC_SMPTE170M:   return "170m";
+    default:                    return "709";
+    }
+}
+
+/*
+ * @brief   Creates the filter name with args, links it after last and sets last to it.
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_video_filter(
+    AVFilterGraph *filter_graph,
+    AVFilterContext **last,
+    const char *filter_name,
+    const char *name,
+    const char *args)
+{
+    AVFilterContext *filter_ctx = NULL;
+    const AVFilter *filter = avfilter_get_by_name(filter_name);
+    int ret;
+
+    if (!filter) {
+        elv_err("link_video_filter, filter %s is not available", filter_name);
+        return AVERROR_FILTER_NOT_FOUND;
+    }
+
+    if ((ret = avfilter_graph_create_filter(&filter_ctx, filter, name, args, NULL, filter_graph)) < 0) {
+        elv_err("link_video_filter, cannot create %s filter, args=%s", filter_name, args ? args : "");
+        return ret;
+    }
+
+    if ((ret = avfilter_link(*last, 0, filter_ctx, 0)) < 0) {
+        elv_err("link_video_filter, failed to link %s, ret=%d", filter_name, ret);
+        return ret;
+    }
+    *last = filter_ctx;
+
+    return 0;
+}
+
+/*
+ * @brief   Links the color conversion of the video to params->color_target after last, and sets last to the last
+ *          filter. The input color space is the one of the decoder:
+ *
+ *          - HDR (PQ or HLG) to SDR: zscale (to linear light) --> tonemap (hable) --> zscale (to BT.709)
+ *          - other conversions (SDR to HDR, PQ to HLG, ...): zscale
+ *
+ *          The chain ends with the pixel format of the encoder, so the RGB to YUV conversion is done by zscale with
+ *          the target matrix. Nothing is linked if the input is already in the target color space.
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_video_color_filters(
+    AVFilterGraph *filter_graph,
+    AVFilterContext **last,
+    AVCodecContext *dec_codec_ctx,
+    enum AVPixelFormat pix_fmt,
+    xcparams_t *params)
+{
+    enum AVColorPrimaries primaries;
+    enum AVColorTransferCharacteristic trc;
+    enum AVColorSpace colorspace;
+    char in_args[128];
+    char args[256];
+    int is_hdr;
+    int ret;
+
+    if (params->color_target == color_target_none)
+        return 0;
+
+    color_target_tags(params->color_target, &primaries, &trc, &colorspace);
+    if (!strcmp(zscale_primaries(dec_codec_ctx->color_primaries), zscale_primaries(primaries)) &&
+        !strcmp(zscale_transfer(dec_codec_ctx->color_trc), zscale_transfer(trc)) &&
+        !strcmp(zscale_matrix(dec_codec_ctx->colorspace), zscale_matrix(colorspace))) {
+        elv_dbg("link_video_color_filters, input is already in color_target=%d, url=%s",
+            params->color_target, params->url);
+        return 0;
+    }
+
+    is_hdr = dec_codec_ctx->color_trc == AVCOL_TRC_SMPTE2084 || dec_codec_ctx->color_trc == AVCOL_TRC_ARIB_STD_B67;
+    snprintf(in_args, sizeof(in_args), "pin=%s:tin=%s:min=%s:rin=%s",
+        zscale_primaries(dec_codec_ctx->color_primaries), zscale_transfer(dec_codec_ctx->color_trc),
+        zscale_matrix(dec_codec_ctx->colorspace), dec_codec_ctx->color_range == AVCOL_RANGE_JPEG ? "pc" : "tv");
+
+    if (is_hdr && params->color_target == color_target_sdr) {
+        /* Tone mapping is done on linear RGB, with the SDR white at 100 nits */
+        snprintf(args, sizeof(args), "%s:t=linear:npl=100", in_args);
+        if ((ret = link_video_filter(filter_graph, last, "zscale", "zscale_linear", args)) < 0 ||
+            (ret = link_video_filter(filter_graph, last, "format", "format_linear", "gbrpf32le")) < 0 ||
+            (ret = link_video_filter(filter_graph, last, "zscale", "zscale_primaries", "p=709")) < 0 ||
+            (ret = link_video_filter(filter_graph, last, "tonemap", "tonemap", "tonemap=hable:desat=0")) < 0 ||
+            (ret = link_video_filter(filter_graph, last, "zscale", "zscale_sdr", "t=709:m=709:r=tv")) < 0)
+            return ret;
+    } else {
+        snprintf(args, sizeof(args), "%s:p=%s:t=%s:m=%s:r=tv:npl=100", in_args,
+            zscale_primaries(primaries), zscale_transfer(trc), zscale_matrix(colorspace));
+        if ((ret = link_video_filter(filter_graph, last, "zscale", "zscale", args)) < 0)
+            return ret;
+    }
+
+    return link_video_filter(filter_graph, last, "format", "format_color", av_get_pix_fmt_name(pix_fmt));
+}
+
+/*
+ * @brief   Links the frame rate conversion of params->fps_mode after last, and sets last to the last filter:
+ *
+ *          - fps_mode_drop_dup: fps (drops or duplicates frames)
+ *          - fps_mode_blend: framerate (blends the neighbour frames)
+ *          - fps_mode_telecine: telecine (3:2 pulldown)
+ *          - fps_mode_ivtc: fieldmatch --> yadif (only the frames that are still combed) --> decimate
+ *
+ *          These filters change the time base of the frames, settb sets it back to the time base of the input so the
+ *          converted frames keep the timeline of the input (and of the audio).
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_video_fps_filters(
+    AVFilterGraph *filter_graph,
+    AVFilterContext **last,
+    AVRational time_base,
+    xcparams_t *params)
+{
+    char args[128];
+    int ret;
+
+    switch (params->fps_mode) {
+    case fps_mode_drop_dup:
+        snprintf(args, sizeof(args), "fps=%s", params->frame_rate);
+        ret = link_video_filter(filter_graph, last, "fps", "fps", args);
+        break;
+    case fps_mode_blend:
+        snprintf(args, sizeof(args), "fps=%s", params->frame_rate);
+        ret = link_video_filter(filter_graph, last, "framerate", "framerate", args);
+        break;
+    case fps_mode_telecine:
+        ret = link_video_filter(filter_graph, last, "telecine", "telecine", "first_field=top:pattern=23");
+        break;
+    case fps_mode_ivtc:
+        if ((ret = link_video_filter(filter_graph, last, "fieldmatch", "fieldmatch", "order=auto:combmatch=full")) < 0 ||
+            (ret = link_video_filter(filter_graph, last, "yadif", "yadif", "deint=interlaced")) < 0)
+            return ret;
+        ret = link_video_filter(filter_graph, last, "decimate", "decimate", "cycle=5");
+        break;
+    default:
+        return 0;
+    }
+    if (ret < 0)
+        return ret;
+
+    snprintf(args, sizeof(args), "expr=%d/%d", time_base.num, time_base.den);
+    return link_video_filter(filter_graph, last, "settb", "settb", args);
+}
+
+/*
+ * @brief   Links the crop filter after last if decoder_context->crop is set, and sets last to it. The crop
+ *          runs on the decoded frames, before the analysis filters, scaling and watermarking.
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_video_crop_filter(
+    AVFilterGraph *filter_graph,
+    AVFilterContext **last,
+    coderctx_t *decoder_context)
+{
+    crop_rect_t *crop = &decoder_context->crop;
+    AVFilterContext *crop_ctx = NULL;
+    char args[128];
+    int ret;
+
+    if (crop->width <= 0)
+        return 0;
+
+    snprintf(args, sizeof(args), "w=%d:h=%d:x=%d:y=%d:exact=1", crop->width, crop->height, crop->x, crop->y);
+    ret = avfilter_graph_create_filter(&crop_ctx, avfilter_get_by_name("crop"), "crop", args, NULL, filter_graph);
+    if (ret < 0) {
+        elv_err("link_video_crop_filter, cannot create crop filter, args=%s", args);
+        return ret;
+    }
+
+    if ((ret = avfilter_link(*last, 0, crop_ctx, 0)) < 0) {
+        elv_err("link_video_crop_filter, failed to link crop, ret=%d", ret);
+        return ret;
+    }
+    *last = crop_ctx;
+
+    return 0;
+}
+
+/*
+ * @brief   Links the analysis filters of the video after the buffer source, and sets last to the last one:
+ *
+ *          last --> cropdetect (if params->detect_crop is set) --> blackframe (if params->detect_black is set)
+ *               --> freezedetect (if params->detect_freeze is set) --> select (if params->detect_scenes is set)
+ *
+ *          They run on the decoded frames, before scaling and watermarking. cropdetect sets the rectangle of the
+ *          non black pixels seen so far in lavfi.cropdetect.*, blackframe sets lavfi.blackframe.pblack in the
+ *          metadata of the black frames, freezedetect writes the start and the end of the frozen frames
+ *          (lavfi.freezedetect.*) and select the scene change score of every frame (lavfi.scene_score).
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_video_analysis_filters(
+    AVFilterGraph *filter_graph,
+    AVFilterContext **last,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    double min_duration = params->qc_min_duration > 0 ? params->qc_min_duration : QC_DEFAULT_MIN_DURATION;
+    char args[128];
+    int ret;
+
+    /* reset=0 makes cropdetect grow its rectangle over the whole video instead of following each frame */
+    if (params->detect_crop) {
+        AVFilterContext *cropdetect_ctx = NULL;
+
+        ret = avfilter_graph_create_filter(&cropdetect_ctx, avfilter_get_by_name("cropdetect"), "cropdetect",
+            "limit=24:round=2:reset=0", NULL, filter_graph);
+        if (ret < 0) {
+            elv_err("link_video_analysis_filters, cannot create cropdetect filter");
+            return ret;
+        }
+
+        if ((ret = avfilter_link(*last, 0, cropdetect_ctx, 0)) < 0) {
+            elv_err("link_video_analysis_filters, failed to link cropdetect, ret=%d", ret);
+            return ret;
+        }
+        *last = cropdetect_ctx;
+    }
+
+    if (params->detect_black) {
+        AVFilterContext *black_ctx = NULL;
+
+        ret = avfilter_graph_create_filter(&black_ctx, avfilter_get_by_name("blackframe"), "blackframe",
+            "amount=98:threshold=32", NULL, filter_graph);
+        if (ret < 0) {
+            elv_err("link_video_analysis_filters, cannot create blackframe filter");
+            return ret;
+        }
+
+        if ((ret = avfilter_link(*last, 0, black_ctx, 0)) < 0) {
+            elv_err("link_video_analysis_filters, failed to link blackframe, ret=%d", ret);
+            return ret;
+        }
+        *last = black_ctx;
+
+        qc_tracker_init(&decoder_context->qc_black, qc_black, decoder_context->video_stream_index);
+    }
+
+    if (params->detect_freeze) {
+        AVFilterContext *freeze_ctx = NULL;
+
+        snprintf(args, sizeof(args), "noise=-60dB:duration=%.3f", min_duration);
+        ret = avfilter_graph_create_filter(&freeze_ctx, avfilter_get_by_name("freezedetect"), "freezedetect",
+            args, NULL, filter_graph);
+        if (ret < 0) {
+            elv_err("link_video_analysis_filters, cannot create freezedetect filter");
+            return ret;
+        }
+
+        if ((ret = avfilter_link(*last, 0, freeze_ctx, 0)) < 0) {
+            elv_err("link_video_analysis_filters, failed to link freezedetect, ret=%d", ret);
+            return ret;
+        }
+        *last = freeze_ctx;
+
+        qc_tracker_init(&decoder_context->qc_freeze, qc_freeze, decoder_context->video_stream_index);
+    }
+
+    /* The select filter writes the scene change score of every frame in lavfi.scene_score, all the frames are kept */
+    if (params->detect_scenes) {
+        AVFilterContext *select_ctx = NULL;
+
+        ret = avfilter_graph_create_filter(&select_ctx, avfilter_get_by_name("select"), "scene",
+            "expr=gte(scene,0)", NULL, filter_graph);
+        if (ret < 0) {
+            elv_err("link_video_analysis_filters, cannot create select filter");
+            return ret;
+        }
+
+        if ((ret = avfilter_link(*last, 0, select_ctx, 0)) < 0) {
+            elv_err("link_video_analysis_filters, failed to link select, ret=%d", ret);
+            return ret;
+        }
+        *last = select_ctx;
+    }
+
+    return 0;
+}
+
+/*
+ * @brief   Initializes the filter graph of the cadence detection of avpipe_probe():
+ *
+ *          buffer --> idet --> buffersink
+ *
+ *          idet writes its cumulated statistics (lavfi.idet.*) in the metadata of every frame.
+ * @return  Returns 0 if successful, otherwise eav_filter_init if there is an error.
+ */
+int
+init_video_probe_filters(
+    coderctx_t *decoder_context)
+{
+    AVCodecContext *dec_codec_ctx = decoder_context->codec_context[decoder_context->video_stream_index];
+    AVRational time_base = decoder_context->format_context->streams[decoder_context->video_stream_index]->time_base;
+    AVFilterContext *last_ctx;
+    char args[512];
+    int ret;
+
+    decoder_context->video_filter_graph = avfilter_graph_alloc();
+    if (!decoder_context->video_filter_graph)
+        return eav_filter_init;
+
+    snprintf(args, sizeof(args),
+        "video_size=%dx%d:pix_fmt=%d:time_base=%d/%d:pixel_aspect=%d/%d",
+        dec_codec_ctx->width, dec_codec_ctx->height, dec_codec_ctx->pix_fmt,
+        time_base.num, time_base.den,
+        dec_codec_ctx->sample_aspect_ratio.num, dec_codec_ctx->sample_aspect_ratio.den);
+    ret = avfilter_graph_create_filter(&decoder_context->video_buffersrc_ctx, avfilter_get_by_name("buffer"), "in",
+                                       args, NULL, decoder_context->video_filter_graph);
+    if (ret < 0) {
+        elv_err("init_video_probe_filters, cannot create buffer source err=%d", ret);
+        return eav_filter_init;
+    }
+
+    last_ctx = decoder_context->video_buffersrc_ctx;
+    if (link_video_filter(decoder_context->video_filter_graph, &last_ctx, "idet", "idet", NULL) < 0 ||
+        link_video_filter(decoder_context->video_filter_graph, &last_ctx, "buffersink", "out", NULL) < 0)
+        return eav_filter_init;
+    decoder_context->video_buffersink_ctx = last_ctx;
+
+    if ((ret = avfilter_graph_config(decoder_context->video_filter_graph, NULL)) < 0) {
+        elv_err("init_video_probe_filters, failed to configure the filter graph err=%d", ret);
+        return eav_filter_init;
+    }
+
+    return 0;
+}
+
+/*
+ * @brief   Scales and converts a video of the comparison to the common resolution and pixel format, from its buffer
+ *          source named name. Sets *src to the buffer source and *last to the last filter.
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_compare_input(
+    AVFilterGraph *filter_graph,
+    coderctx_t *decoder_context,
+    const char *name,
+    const char *scale_args,
+    const char *format_args,
+    AVFilterContext **src,
+    AVFilterContext **last)
+{
+    AVCodecContext *dec_codec_ctx = decoder_context->codec_context[decoder_context->video_stream_index];
+    AVRational time_base = decoder_context->format_context->streams[decoder_context->video_stream_index]->time_base;
+    char args[512];
+    int ret;
+
+    snprintf(args, sizeof(args),
+        "video_size=%dx%d:pix_fmt=%d:time_base=%d/%d:pixel_aspect=%d/%d",
+        dec_codec_ctx->width, dec_codec_ctx->height, dec_codec_ctx->pix_fmt,
+        time_base.num, time_base.den,
+        dec_codec_ctx->sample_aspect_ratio.num, dec_codec_ctx->sample_aspect_ratio.den);
+    ret = avfilter_graph_create_filter(src, avfilter_get_by_name("buffer"), name, args, NULL, filter_graph);
+    if (ret < 0) {
+        elv_err("link_compare_input, cannot create buffer source %s err=%d", name, ret);
+        return ret;
+    }
+
+    *last = *src;
+    if ((ret = link_video_filter(filter_graph, last, "scale", NULL, scale_args)) < 0 ||
+        (ret = link_video_filter(filter_graph, last, "format", NULL, format_args)) < 0)
+        return ret;
+
+    return 0;
+}
+
+/*
+ * @brief   Links the metric filter_name comparing the frames of *last (the distorted) to the frames of ref (the
+ *          reference), and sets last to it. The metric stops with the shortest input.
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_compare_metric(
+    AVFilterGraph *filter_graph,
+    AVFilterContext **last,
+    AVFilterContext *ref,
+    int ref_pad,
+    const char *filter_name,
+    const char *args)
+{
+    int ret;
+
+    if ((ret = link_video_filter(filter_graph, last, filter_name, filter_name, args)) < 0)
+        return ret;
+
+    if ((ret = avfilter_link(ref, ref_pad, *last, 1)) < 0) {
+        elv_err("link_compare_metric, failed to link the reference to %s, ret=%d", filter_name, ret);
+        return ret;
+    }
+
+    return 0;
+}
+
+/*
+ * @brief   Initializes the filter graph comparing a distorted video to its reference, buffersrc_ctx[0] is the
+ *          buffer source of the reference and buffersrc_ctx[1] the one of the distorted:
+ *
+ *          buffer (ref)  --> scale --> format --> split -------+--------+--------+
+ *                                                              |        |        |
+ *          buffer (dist) --> scale --> format -------------> psnr --> ssim --> [libvmaf] --> buffersink
+ *
+ *          Both videos are scaled to width x height and converted to the same pixel format. psnr and ssim write
+ *          their scores (lavfi.psnr.*, lavfi.ssim.*) in the metadata of the distorted frames, libvmaf is linked if
+ *          vmaf_args is set and writes its scores in the log of vmaf_args. The frames are paired by timestamp, a
+ *          distorted frame is compared to the last reference frame at or before it.
+ * @return  Returns 0 if successful, otherwise eav_filter_init if there is an error.
+ */
+int
+init_compare_filters(
+    AVFilterGraph **filter_graph,
+    AVFilterContext **buffersrc_ctx,
+    AVFilterContext **buffersink_ctx,
+    coderctx_t *ref_decoder_context,
+    coderctx_t *dist_decoder_context,
+    int width,
+    int height,
+    const char *vmaf_args)
+{
+    AVCodecContext *ref_codec_ctx = ref_decoder_context->codec_context[ref_decoder_context->video_stream_index];
+    const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(ref_codec_ctx->pix_fmt);
+    AVFilterContext *ref_last, *dist_last, *split_ctx;
+    char scale_args[128];
+    char format_args[64];
+    int ret;
+
+    *filter_graph = avfilter_graph_alloc();
+    if (!*filter_graph)
+        return eav_filter_init;
+
+    /* The metrics are computed in 4:2:0, 10 bit if the reference has more than 8 bits */
+    snprintf(scale_args, sizeof(scale_args), "w=%d:h=%d:flags=bicubic", width, height);
+    snprintf(format_args, sizeof(format_args), "pix_fmts=%s",
+        desc && desc->comp[0].depth > 8 ? "yuv420p10le" : "yuv420p");
+
+    if (link_compare_input(*filter_graph, ref_decoder_context, "ref", scale_args, format_args,
+            &buffersrc_ctx[0], &ref_last) < 0 ||
+        link_compare_input(*filter_graph, dist_decoder_context, "dist", scale_args, format_args,
+            &buffersrc_ctx[1], &dist_last) < 0)
+        return eav_filter_init;
+
+    split_ctx = ref_last;
+    if (link_video_filter(*filter_graph, &split_ctx, "split", "split", vmaf_args ? "outputs=3" : "outputs=2") < 0 ||
+        link_compare_metric(*filter_graph, &dist_last, split_ctx, 0, "psnr", "shortest=1") < 0 ||
+        link_compare_metric(*filter_graph, &dist_last, split_ctx, 1, "ssim", "shortest=1") < 0)
+        return eav_filter_init;
+
+    if (vmaf_args && link_compare_metric(*filter_graph, &dist_last, split_ctx, 2, "libvmaf", vmaf_args) < 0)
+        return eav_filter_init;
+
+    if (link_video_filter(*filter_graph, &dist_last, "buffersink", "out", NULL) < 0)
+        return eav_filter_init;
+    *buffersink_ctx = dist_last;
+
+    if ((ret = avfilter_graph_config(*filter_graph, NULL)) < 0) {
+        elv_err("init_compare_filters, failed to configure the filter graph err=%d", ret);
+        return eav_filter_init;
+    }
+
+    return 0;
+}
+
 /*
  * @brief   Used to initialize video filter.
  * @return  Returns 0 if successful, otherwise eav_filter_init if there is an error.
@@ -83,8 +620,23 @@ init_video_filters(
      * filter input label is not specified, it is set to "in" by
      * default.
      */
+    AVFilterContext *last_ctx = decoder_context->video_buffersrc_ctx;
+    if ((ret = link_video_crop_filter(decoder_context->video_filter_graph, &last_ctx, decoder_context)) < 0)
+        goto end;
+
+    if ((ret = link_video_analysis_filters(decoder_context->video_filter_graph, &last_ctx,
+            decoder_context, params)) < 0)
+        goto end;
+
+    if ((ret = link_video_color_filters(decoder_context->video_filter_graph, &last_ctx,
+            dec_codec_ctx, pix_fmts[0], params)) < 0)
+        goto end;
+
+    if ((ret = link_video_fps_filters(decoder_context->video_filter_graph, &last_ctx, time_base, params)) < 0)
+        goto end;
+
     outputs->name       = av_strdup("in");
-    outputs->filter_ctx = decoder_context->video_buffersrc_ctx;
+    outputs->filter_ctx = last_ctx;
     outputs->pad_idx    = 0;
     outputs->next       = NULL;
 
@@ -145,6 +697,110 @@ get_avfilter_args(
             dec_codec_ctx->channel_layout);
 }
 
+/*
+ * @brief   Links the analysis filters of audio output i after the filter last, and sets last to the last one:
+ *
+ *          last --> silencedetect (if params->detect_silence is set) --> loudnorm (if params->loudness_target is set)
+ *               --> ebur128 (if params->measure_loudness is set)
+ *
+ *          silencedetect writes the start and the end of the silences in the frame metadata (lavfi.silence_*).
+ *          loudnorm uses the loudness measured by the first pass, in linear mode if the true peak allows it.
+ *          ebur128 writes the loudness in the frame metadata (lavfi.r128.*).
+ * @return  Returns 0 if successful, otherwise a negative AVERROR.
+ */
+static int
+link_audio_analysis_filters(
+    AVFilterGraph *filter_graph,
+    AVFilterContext **last,
+    int i,
+    int stream_index,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    char args[512];
+    int ret;
+
+    if (params->detect_silence) {
+        AVFilterContext *silence_ctx = NULL;
+
+        snprintf(args, sizeof(args), "noise=%.1fdB:duration=%.3f",
+            params->silence_threshold != 0 ? params->silence_threshold : QC_DEFAULT_SILENCE_DB,
+            params->qc_min_duration > 0 ? params->qc_min_duration : QC_DEFAULT_MIN_DURATION);
+        ret = avfilter_graph_create_filter(&silence_ctx, avfilter_get_by_name("silencedetect"), "silencedetect",
+            args, NULL, filter_graph);
+        if (ret < 0) {
+            elv_err("link_audio_analysis_filters, cannot create silencedetect filter");
+            return ret;
+        }
+
+        if ((ret = avfilter_link(*last, 0, silence_ctx, 0)) < 0) {
+            elv_err("link_audio_analysis_filters, failed to link silencedetect, ret=%d", ret);
+            return ret;
+        }
+        *last = silence_ctx;
+
+        qc_tracker_init(&decoder_context->qc_silence[i], qc_silence, stream_index);
+    }
+
+    if (params->loudness_target != 0) {
+        loudness_stats_t *measured = &decoder_context->loudness_measured[i];
+        AVFilterContext *loudnorm_ctx = NULL;
+
+        if (measured->integrated <= -70) {
+            elv_warn("link_audio_analysis_filters, audio output %d is silent, not normalized, url=%s", i, params->url);
+        } else {
+            /*
+             * The LRA target is not lower than the measured LRA to keep loudnorm in linear mode (a gain), and
+             * the gating threshold is approximated by the relative gate of BS.1770 (-10 LU).
+             */
+            snprintf(args, sizeof(args),
+                "I=%.1f:TP=%.1f:LRA=%.1f:measured_I=%.2f:measured_LRA=%.2f:measured_TP=%.2f:measured_thresh=%.2f:linear=true",
+                params->loudness_target, params->loudness_true_peak,
+                FFMAX(7.0, FFMIN(20.0, measured->range)),
+                measured->integrated, FFMIN(99.0, measured->range), FFMAX(-99.0, FFMIN(99.0, measured->true_peak)),
+                FFMAX(-99.0, measured->integrated - 10));
+            elv_dbg("link_audio_analysis_filters, audio output %d loudnorm args=%s", i, args);
+
+            ret = avfilter_graph_create_filter(&loudnorm_ctx, avfilter_get_by_name("loudnorm"), "loudnorm",
+                args, NULL, filter_graph);
+            if (ret < 0) {
+                elv_err("link_audio_analysis_filters, cannot create loudnorm filter");
+                return ret;
+            }
+
+            if ((ret = avfilter_link(*last, 0, loudnorm_ctx, 0)) < 0) {
+                elv_err("link_audio_analysis_filters, failed to link loudnorm, ret=%d", ret);
+                return ret;
+            }
+            *last = loudnorm_ctx;
+        }
+    }
+
+    if (params->measure_loudness) {
+        AVFilterContext *ebur128_ctx = NULL;
+
+        ret = avfilter_graph_create_filter(&ebur128_ctx, avfilter_get_by_name("ebur128"), "ebur128",
+            "metadata=1:peak=true", NULL, filter_graph);
+        if (ret < 0) {
+            elv_err("link_audio_analysis_filters, cannot create ebur128 filter");
+            return ret;
+        }
+
+        if ((ret = avfilter_link(*last, 0, ebur128_ctx, 0)) < 0) {
+            elv_err("link_audio_analysis_filters, failed to link ebur128, ret=%d", ret);
+            return ret;
+        }
+        *last = ebur128_ctx;
+
+        decoder_context->loudness[i].stream_index = stream_index;
+        decoder_context->loudness[i].integrated = -70;
+        decoder_context->loudness[i].range = 0;
+        decoder_context->loudness[i].true_peak = -99;
+    }
+
+    return 0;
+}
+
 /*
  * @brief   Used to initialize audio filter.
  * @return  Returns 0 if successful.
@@ -243,7 +899,11 @@ init_audio_filters(
             goto end;
         }
 
-        if ((ret = avfilter_link(abuffersrc_ctx[i], 0, format_ctx, 0)) < 0) {
+        AVFilterContext *last_ctx = abuffersrc_ctx[i];
+        if ((ret = link_audio_analysis_filters(filter_graph, &last_ctx, i, audio_stream_index, decoder_context, params)) < 0)
+            goto end;
+
+        if ((ret = avfilter_link(last_ctx, 0, format_ctx, 0)) < 0) {
             elv_err("init_audio_filters, failed to link audio src to format, ret=%d", ret);
             goto end;
         }
@@ -273,6 +933,102 @@ end:
 
 }
 
+/*
+ * @brief   Initializes the filters of the encoded audio renditions (params->n_audio_renditions),
+ *          one filter graph per rendition converts the decoded frames of its input stream
+ *          to the sample format, rate, layout and frame size of its encoder:
+ *
+ *          asrc_abuffer --> aformat --> asink_abuffer
+ *
+ *          The passthrough renditions have no filter.
+ * @return  Returns 0 if successful, otherwise eav_filter_init.
+ */
+int
+init_audio_rendition_filters(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    char args[512];
+    int ret = 0;
+    const AVFilter *buffersrc = avfilter_get_by_name("abuffer");
+    const AVFilter *buffersink = avfilter_get_by_name("abuffersink");
+    const AVFilter *aformat = avfilter_get_by_name("aformat");
+
+    for (int i=0; i<encoder_context->n_audio_output; i++) {
+        rendition_ctx_t *r = &encoder_context->renditions[i];
+        AVFilterContext *format_ctx = NULL;
+
+        if (r->passthrough)
+            continue;
+
+        AVCodecContext *enc_codec_ctx = r->codec_context;
+        if (!decoder_context->codec_context[r->stream_index] || !enc_codec_ctx) {
+            elv_err("init_audio_rendition_filters, audio decoder or encoder of rendition %d was not initialized", i);
+            ret = AVERROR_UNKNOWN;
+            goto end;
+        }
+
+        r->filter_graph = avfilter_graph_alloc();
+        if (!buffersrc || !buffersink || !aformat || !r->filter_graph) {
+            elv_err("init_audio_rendition_filters, audio filtering source or sink element not found");
+            ret = AVERROR_UNKNOWN;
+            goto end;
+        }
+
+        get_avfilter_args(decoder_context, r->stream_index, args, sizeof(args));
+        elv_dbg("init_audio_rendition_filters, rendition=%d, audio srcfilter args=%s", i, args);
+
+        ret = avfilter_graph_create_filter(&r->buffersrc_ctx, buffersrc, "in", args, NULL, r->filter_graph);
+        if (ret < 0) {
+            elv_err("init_audio_rendition_filters, cannot create audio buffer source, rendition=%d", i);
+            goto end;
+        }
+
+        ret = avfilter_graph_create_filter(&r->buffersink_ctx, buffersink, "out", NULL, NULL, r->filter_graph);
+        if (ret < 0) {
+            elv_err("init_audio_rendition_filters, cannot create audio buffer sink, rendition=%d", i);
+            goto end;
+        }
+
+        snprintf(args, sizeof(args),
+             "sample_fmts=%s:sample_rates=%d:channel_layouts=0x%"PRIx64,
+             av_get_sample_fmt_name(enc_codec_ctx->sample_fmt), enc_codec_ctx->sample_rate,
+             (uint64_t)enc_codec_ctx->channel_layout);
+        elv_dbg("init_audio_rendition_filters, rendition=%d, audio format_filter args=%s", i, args);
+
+        ret = avfilter_graph_create_filter(&format_ctx, aformat, "format_out", args, NULL, r->filter_graph);
+        if (ret < 0) {
+            elv_err("init_audio_rendition_filters, cannot create audio format filter, rendition=%d", i);
+            goto end;
+        }
+
+        if ((ret = avfilter_link(r->buffersrc_ctx, 0, format_ctx, 0)) < 0) {
+            elv_err("init_audio_rendition_filters, failed to link audio src to format, rendition=%d, ret=%d", i, ret);
+            goto end;
+        }
+
+        if ((ret = avfilter_link(format_ctx, 0, r->buffersink_ctx, 0)) < 0) {
+            elv_err("init_audio_rendition_filters, failed to link audio format to sink, rendition=%d, ret=%d", i, ret);
+            goto end;
+        }
+
+        /* The encoders without a variable frame size need frames of frame_size samples */
+        if (enc_codec_ctx->frame_size > 0 &&
+            !(enc_codec_ctx->codec->capabilities & AV_CODEC_CAP_VARIABLE_FRAME_SIZE))
+            av_buffersink_set_frame_size(r->buffersink_ctx, enc_codec_ctx->frame_size);
+
+        if ((ret = avfilter_graph_config(r->filter_graph, NULL)) < 0)
+            goto end;
+    }
+
+end:
+    if (ret < 0)
+        return eav_filter_init;
+
+    return ret;
+}
+
 /*
  * @brief   This filter pans multiple channels in one input stream to one output stereo stream.
  *          A sample equvalent ffmpeg command is something like this:
@@ -292,7 +1048,8 @@ int
 init_audio_pan_filters(
     const char *filters_descr,
     coderctx_t *decoder_context,
-    coderctx_t *encoder_context)
+    coderctx_t *encoder_context,
+    xcparams_t *params)
 {
     /* Only one innput stream is accepted for this filter */
     if (decoder_context->n_audio != 1) {
@@ -382,8 +1139,13 @@ init_audio_pan_filters(
         goto end;
     }
 
-    /* Link audio pan output to audio format input */
-    if ((ret = avfilter_link(filter_graph->filters[3], 0, filter_graph->filters[2], 0)) < 0) {
+    /* Link audio pan output to audio format input, through the loudness filters if there are any */
+    AVFilterContext *last_ctx = filter_graph->filters[3];
+    if ((ret = link_audio_analysis_filters(filter_graph, &last_ctx, 0, decoder_context->audio_stream_index[0],
+            decoder_context, params)) < 0)
+        goto end;
+
+    if ((ret = avfilter_link(last_ctx, 0, filter_graph->filters[2], 0)) < 0) {
         elv_err("init_audio_pan_filters, failed to link audio src to pan, ret=%d", ret);
         goto end;
     }
@@ -438,7 +1200,8 @@ int
 init_audio_merge_pan_filters(
     const char *filters_descr,
     coderctx_t *decoder_context,
-    coderctx_t *encoder_context)
+    coderctx_t *encoder_context,
+    xcparams_t *params)
 {
     /* Only one innput stream is accepted for this filter */
     if (decoder_context->n_audio <= 1) {
@@ -523,8 +1286,13 @@ init_audio_merge_pan_filters(
         }
     }
 
-    /* Link audio pan output to audio sink input */
-    if ((ret = avfilter_link(filter_graph->filters[2], 0, filter_graph->filters[0], 0)) < 0) {
+    /* Link audio pan output to audio sink input, through the loudness filters if there are any */
+    AVFilterContext *last_ctx = filter_graph->filters[2];
+    if ((ret = link_audio_analysis_filters(filter_graph, &last_ctx, 0, decoder_context->audio_stream_index[0],
+            decoder_context, params)) < 0)
+        goto end;
+
+    if ((ret = avfilter_link(last_ctx, 0, filter_graph->filters[0], 0)) < 0) {
         elv_err("init_audio_merge_pan_filters, failed to link audio pan to sink, ret=%d", ret);
         goto end;
     }
@@ -666,7 +1434,12 @@ init_audio_join_filters(
         goto end;
     }
 
-    if ((ret = avfilter_link(join_ctx, 0, format_ctx, 0)) < 0) {
+    AVFilterContext *last_ctx = join_ctx;
+    if ((ret = link_audio_analysis_filters(decoder_context->audio_filter_graph[0], &last_ctx, 0,
+            decoder_context->audio_stream_index[0], decoder_context, params)) < 0)
+        goto end;
+
+    if ((ret = avfilter_link(last_ctx, 0, format_ctx, 0)) < 0) {
         elv_err("init_audio_join_filters, failed to link audio join to format, ret=%d", ret);
         goto end;
     }
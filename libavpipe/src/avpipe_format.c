@@ -7,6 +7,7 @@
 #include <libavutil/opt.h>
 #include <libavutil/log.h>
 #include <libavutil/pixdesc.h>
+#include <libavutil/intreadwrite.h>
 
 #include "avpipe_utils.h"
 #include "avpipe_xc.h"
@@ -110,6 +111,10 @@ num_audio_output(
     if (params->xc_type == xc_audio_merge || params->xc_type == xc_audio_join || params->xc_type == xc_audio_pan)
         return 1;
 
+    /* One output per rendition, several renditions can be made from the same input stream */
+    if (params->n_audio_renditions > 0)
+        return params->n_audio_renditions;
+
     return params->n_audio > 0 ? params->n_audio : n_decoder_auido;
 }
 
@@ -209,3 +214,346 @@ packet_clone(
     return 0;
 }
 
+
+/*
+ * Returns the bit reversed value of a 32 bit HEVC profile compatibility flags field.
+ */
+static uint32_t
+reverse_bits(
+    uint32_t value)
+{
+    uint32_t reversed = 0;
+
+    for (int i=0; i<32; i++) {
+        reversed = (reversed << 1) | (value & 1);
+        value >>= 1;
+    }
+    return reversed;
+}
+
+/*
+ * avc1.PPCCLL from the avcC (or the SPS of Annex B extradata): profile, constraint flags and level.
+ */
+static void
+avc_codec_string(
+    AVCodecParameters *codecpar,
+    char *str,
+    int size)
+{
+    const uint8_t *data = codecpar->extradata;
+    int data_size = codecpar->extradata_size;
+
+    if (data_size >= 4 && data[0] == 1) {
+        snprintf(str, size, "avc1.%02x%02x%02x", data[1], data[2], data[3]);
+        return;
+    }
+
+    for (int i=0; i+6<data_size; i++) {
+        if (data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 && (data[i+3] & 0x1f) == 7) {
+            snprintf(str, size, "avc1.%02x%02x%02x", data[i+4], data[i+5], data[i+6]);
+            return;
+        }
+    }
+
+    if (codecpar->profile > 0 && codecpar->level > 0)
+        snprintf(str, size, "avc1.%02x00%02x", codecpar->profile & 0xff, codecpar->level);
+    else
+        snprintf(str, size, "avc1");
+}
+
+/*
+ * hvc1.[A-C]P.C.TL.B from the hvcC: profile space and profile, compatibility flags, tier and level, constraint flags.
+ */
+static void
+hevc_codec_string(
+    AVCodecParameters *codecpar,
+    char *str,
+    int size)
+{
+    const uint8_t *data = codecpar->extradata;
+    const char *tag = codecpar->codec_tag == MKTAG('h','e','v','1') ? "hev1" : "hvc1";
+    int len;
+
+    if (codecpar->extradata_size < 13 || data[0] != 1) {
+        if (codecpar->profile > 0 && codecpar->level > 0)
+            snprintf(str, size, "%s.%d.%X.L%d", tag, codecpar->profile, 1u << codecpar->profile, codecpar->level);
+        else
+            snprintf(str, size, "%s", tag);
+        return;
+    }
+
+    int profile_space = data[1] >> 6;
+    int tier = (data[1] >> 5) & 1;
+    int profile_idc = data[1] & 0x1f;
+    uint32_t compatibility = AV_RB32(data + 2);
+    int n_constraints = 6;
+
+    len = snprintf(str, size, "%s.%s%d.%X.%c%d", tag,
+        profile_space == 0 ? "" : (profile_space == 1 ? "A" : (profile_space == 2 ? "B" : "C")),
+        profile_idc, reverse_bits(compatibility), tier ? 'H' : 'L', data[12]);
+
+    /* The trailing zero bytes of the constraint flags are omitted */
+    while (n_constraints > 0 && data[6 + n_constraints - 1] == 0)
+        n_constraints--;
+    for (int i=0; i<n_constraints && len<size; i++)
+        len += snprintf(str + len, size - len, ".%02X", data[6 + i]);
+}
+
+/*
+ * Returns the bit depth of the luma of a video stream, 8 if it is not known.
+ */
+static int
+video_bit_depth(
+    AVCodecParameters *codecpar)
+{
+    const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(codecpar->format);
+
+    return desc ? desc->comp[0].depth : 8;
+}
+
+/*
+ * Reads n bits (n <= 32) of a bit string, MSB first. Reads past the end of data return zero bits.
+ */
+static uint32_t
+read_bits(
+    const uint8_t *data,
+    int size,
+    int *pos,
+    int n)
+{
+    uint32_t value = 0;
+
+    for (int i=0; i<n; i++, (*pos)++) {
+        int bit = *pos/8 < size ? (data[*pos/8] >> (7 - *pos%8)) & 1 : 0;
+        value = (value << 1) | bit;
+    }
+    return value;
+}
+
+/*
+ * Parses the profile, the level and the tier of the first operating point of an AV1 sequence header OBU.
+ * The encoders (libsvtav1, libaom-av1) set the extradata to the sequence header OBU, the av1C is only made by the
+ * mp4 muxer. Returns -1 if data doesn't start with a sequence header OBU.
+ */
+static int
+av1_seq_header_level(
+    const uint8_t *data,
+    int size,
+    int *profile,
+    int *level,
+    int *tier)
+{
+    int pos = 8;
+
+    /* obu_header: forbidden bit, obu_type (1 is OBU_SEQUENCE_HEADER), extension flag, has_size_field, reserved */
+    if (size < 2 || (data[0] & 0x80) || ((data[0] >> 3) & 0x0f) != 1)
+        return -1;
+    if (data[0] & 0x04)
+        pos += 8;
+    if (data[0] & 0x02) {
+        /* obu_size leb128 */
+        while (pos/8 < size && (data[pos/8] & 0x80))
+            pos += 8;
+        pos += 8;
+    }
+
+    *profile = read_bits(data, size, &pos, 3);
+    read_bits(data, size, &pos, 1);                     /* still_picture */
+    *tier = 0;
+    if (read_bits(data, size, &pos, 1)) {               /* reduced_still_picture_header */
+        *level = read_bits(data, size, &pos, 5);
+        return 0;
+    }
+
+    if (read_bits(data, size, &pos, 1)) {               /* timing_info_present_flag */
+        read_bits(data, size, &pos, 32);                /* num_units_in_display_tick */
+        read_bits(data, size, &pos, 32);                /* time_scale */
+        if (read_bits(data, size, &pos, 1)) {           /* equal_picture_interval, num_ticks_per_picture_minus_1 uvlc */
+            int leading_zeros = 0;
+            while (leading_zeros < 32 && !read_bits(data, size, &pos, 1))
+                leading_zeros++;
+            read_bits(data, size, &pos, leading_zeros);
+        }
+        if (read_bits(data, size, &pos, 1)) {           /* decoder_model_info_present_flag */
+            read_bits(data, size, &pos, 5);             /* buffer_delay_length_minus_1 */
+            read_bits(data, size, &pos, 32);            /* num_units_in_decoding_tick */
+            read_bits(data, size, &pos, 10);            /* buffer_removal_time_length_minus_1, frame_presentation_... */
+        }
+    }
+    read_bits(data, size, &pos, 1);                     /* initial_display_delay_present_flag */
+    read_bits(data, size, &pos, 5);                     /* operating_points_cnt_minus_1 */
+    read_bits(data, size, &pos, 12);                    /* operating_point_idc[0] */
+    *level = read_bits(data, size, &pos, 5);
+    if (*level > 7)
+        *tier = read_bits(data, size, &pos, 1);
+
+    return pos <= size*8 ? 0 : -1;
+}
+
+/*
+ * av01.P.LLT.DD from the av1C, or from the sequence header OBU of the encoder: profile, level and tier, bit depth.
+ */
+static void
+av1_codec_string(
+    AVCodecParameters *codecpar,
+    char *str,
+    int size)
+{
+    const uint8_t *data = codecpar->extradata;
+    int profile, level, tier;
+
+    if (codecpar->extradata_size >= 4 && data[0] == 0x81) {
+        int high_bitdepth = (data[2] >> 6) & 1;
+        int twelve_bit = (data[2] >> 5) & 1;
+
+        snprintf(str, size, "av01.%d.%02d%c.%02d", data[1] >> 5, data[1] & 0x1f, (data[2] & 0x80) ? 'H' : 'M',
+            high_bitdepth ? (twelve_bit ? 12 : 10) : 8);
+        return;
+    }
+
+    if (av1_seq_header_level(data, codecpar->extradata_size, &profile, &level, &tier) == 0) {
+        snprintf(str, size, "av01.%d.%02d%c.%02d", profile, level, tier ? 'H' : 'M', video_bit_depth(codecpar));
+        return;
+    }
+
+    if (codecpar->level >= 0)
+        snprintf(str, size, "av01.%d.%02dM.%02d", codecpar->profile > 0 ? codecpar->profile : 0, codecpar->level,
+            video_bit_depth(codecpar));
+    else
+        snprintf(str, size, "av01");
+}
+
+/* Max luma sample rate and picture size of the VP9 levels */
+static const struct {
+    int     level;
+    int64_t sample_rate;
+    int64_t picture_size;
+} vp9_levels[] = {
+    {10, 829440, 36864},
+    {11, 2764800, 73728},
+    {20, 4608000, 122880},
+    {21, 9216000, 245760},
+    {30, 20736000, 552960},
+    {31, 36864000, 983040},
+    {40, 83558400, 2228224},
+    {41, 160432128, 2228224},
+    {50, 311951360, 8912896},
+    {51, 588251136, 8912896},
+    {52, 1176502272, 8912896},
+    {60, 1176502272, 35651584},
+    {61, 2353004544, 35651584},
+    {62, 4706009088, 35651584},
+};
+
+/*
+ * vp09.PP.LL.DD: profile, level and bit depth, from the CodecPrivate of WebM if it has them. The level is the lowest
+ * one of the picture size and sample rate otherwise.
+ */
+static void
+vp9_codec_string(
+    AVCodecParameters *codecpar,
+    AVRational frame_rate,
+    char *str,
+    int size)
+{
+    const uint8_t *data = codecpar->extradata;
+    int bit_depth = video_bit_depth(codecpar);
+    int profile = codecpar->profile >= 0 ? codecpar->profile : (bit_depth > 8 ? 2 : 0);
+    int level = codecpar->level > 0 ? codecpar->level : 0;
+
+    /* CodecPrivate features: ID (1 profile, 2 level, 3 bit depth), length and value */
+    for (int i=0; i+2<codecpar->extradata_size && data[i+1] == 1; i+=3) {
+        if (data[i] == 1)
+            profile = data[i+2];
+        else if (data[i] == 2)
+            level = data[i+2];
+        else if (data[i] == 3)
+            bit_depth = data[i+2];
+    }
+
+    if (level <= 0) {
+        int64_t picture_size = (int64_t) codecpar->width * codecpar->height;
+        double fps = frame_rate.num > 0 && frame_rate.den > 0 ? av_q2d(frame_rate) : 30;
+        int n_levels = sizeof(vp9_levels)/sizeof(vp9_levels[0]);
+
+        level = vp9_levels[n_levels-1].level;
+        for (int i=0; i<n_levels; i++) {
+            if (picture_size <= vp9_levels[i].picture_size && picture_size * fps <= vp9_levels[i].sample_rate) {
+                level = vp9_levels[i].level;
+                break;
+            }
+        }
+    }
+
+    snprintf(str, size, "vp09.%02d.%02d.%02d", profile, level, bit_depth);
+}
+
+/*
+ * mp4a.40.AOT from the AudioSpecificConfig, or from the profile without one.
+ */
+static void
+aac_codec_string(
+    AVCodecParameters *codecpar,
+    char *str,
+    int size)
+{
+    const uint8_t *data = codecpar->extradata;
+    int aot = 2;
+
+    if (codecpar->extradata_size >= 2) {
+        aot = data[0] >> 3;
+        if (aot == 31)
+            aot = 32 + (((data[0] & 0x07) << 3) | (data[1] >> 5));
+    } else if (codecpar->profile == FF_PROFILE_AAC_HE) {
+        aot = 5;
+    } else if (codecpar->profile == FF_PROFILE_AAC_HE_V2) {
+        aot = 29;
+    }
+
+    snprintf(str, size, "mp4a.40.%d", aot);
+}
+
+void
+get_codec_string(
+    AVCodecParameters *codecpar,
+    AVRational frame_rate,
+    char *str,
+    int size)
+{
+    str[0] = '\0';
+
+    switch (codecpar->codec_id) {
+    case AV_CODEC_ID_H264:
+        avc_codec_string(codecpar, str, size);
+        break;
+    case AV_CODEC_ID_HEVC:
+        hevc_codec_string(codecpar, str, size);
+        break;
+    case AV_CODEC_ID_AV1:
+        av1_codec_string(codecpar, str, size);
+        break;
+    case AV_CODEC_ID_VP9:
+        vp9_codec_string(codecpar, frame_rate, str, size);
+        break;
+    case AV_CODEC_ID_AAC:
+        aac_codec_string(codecpar, str, size);
+        break;
+    case AV_CODEC_ID_MP3:
+        snprintf(str, size, "mp4a.40.34");
+        break;
+    case AV_CODEC_ID_AC3:
+        snprintf(str, size, "ac-3");
+        break;
+    case AV_CODEC_ID_EAC3:
+        snprintf(str, size, "ec-3");
+        break;
+    case AV_CODEC_ID_OPUS:
+        snprintf(str, size, "opus");
+        break;
+    case AV_CODEC_ID_FLAC:
+        snprintf(str, size, "fLaC");
+        break;
+    default:
+        break;
+    }
+}
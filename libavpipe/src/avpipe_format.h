@@ -63,4 +63,16 @@ int
 packet_clone(
     AVPacket *src,
     AVPacket **dst
-);
\ No newline at end of file
+);
+
+/*
+ * Writes the RFC 6381 codec string of the stream used in DASH and HLS manifests ("avc1.64001f", "hvc1.2.4.L120.90",
+ * "av01.0.08M.10", "vp09.00.40.08", "mp4a.40.2", "opus", "ec-3", ...), an empty string if the codec has none.
+ */
+void
+get_codec_string(
+    AVCodecParameters *codecpar,
+    AVRational frame_rate,
+    char *str,
+    int size
+);
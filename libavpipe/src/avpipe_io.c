@@ -11,6 +11,7 @@
 
 #include "avpipe_xc.h"
 #include "avpipe_utils.h"
+#include "avpipe_format.h"
 #include "elv_log.h"
 
 #include <stdio.h>
@@ -23,6 +24,355 @@
 #include <errno.h>
 #include <ctype.h>
 
+#define EMSG_MAX_BOX_SIZE   (64*1024)
+
+/*
+ * Writes the emsg boxes of the pending events that are presented before the last video packet sent to the
+ * muxer. It is called before a moof box, so the events are written in the fragment that contains them.
+ */
+static int
+write_emsg_events(
+    ioctx_t *outctx)
+{
+    coderctx_t *encoder_context = outctx->encoder_ctx;
+    avpipe_io_handler_t *out_handlers = encoder_context->out_handlers;
+    xcparams_t *params = outctx->inctx->params;
+    AVStream *stream = encoder_context->stream[encoder_context->video_stream_index];
+    emsg_event_t *events[MAX_EMSG_EVENTS];
+    int n_events = 0;
+    int rc = 0;
+
+    if (encoder_context->video_pts == AV_NOPTS_VALUE)
+        return 0;
+
+    pthread_mutex_lock(&encoder_context->emsg_lock);
+    while (n_events < encoder_context->n_emsg_events) {
+        emsg_event_t *event = encoder_context->emsg_events[n_events];
+        int64_t pts = event->pts;
+
+        /* Same adjustments as the video packets in encode_frame() */
+        if (!strcmp(params->format, "fmp4-segment") && encoder_context->first_encoding_video_pts != -1)
+            pts -= encoder_context->first_encoding_video_pts;
+        pts += params->start_pts;
+        pts = av_rescale_q(pts, encoder_context->emsg_time_base, stream->time_base);
+        if (pts >= encoder_context->video_pts)
+            break;
+
+        event->timescale = stream->time_base.den / stream->time_base.num;
+        event->presentation_time = pts < 0 ? 0 : pts;
+        event->event_duration = event->duration == EMSG_DURATION_UNKNOWN ? EMSG_DURATION_UNKNOWN :
+            av_rescale_q(event->duration, (AVRational) {1, 90000}, stream->time_base);
+        events[n_events++] = event;
+    }
+    encoder_context->n_emsg_events -= n_events;
+    memmove(encoder_context->emsg_events, encoder_context->emsg_events + n_events,
+        encoder_context->n_emsg_events * sizeof(emsg_event_t *));
+    pthread_mutex_unlock(&encoder_context->emsg_lock);
+
+    for (int i = 0; i < n_events; i++) {
+        emsg_event_t *event = events[i];
+        int size = emsg_box(event, NULL);
+
+        if (rc == 0 && size <= EMSG_MAX_BOX_SIZE) {
+            uint8_t *box = (uint8_t *) malloc(size);
+            emsg_box(event, box);
+            if (out_handlers->avpipe_writer(outctx, box, size) < 0)
+                rc = -1;
+            free(box);
+
+            event->seg_index = outctx->seg_index;
+            elv_dbg("EMSG written id=%u presentation_time=%"PRIu64" timescale=%u scheme=%s seg_index=%d, url=%s",
+                event->id, event->presentation_time, event->timescale, event->scheme_id_uri, outctx->seg_index, params->url);
+            if (rc == 0 && out_handlers->avpipe_stater) {
+                encoder_context->emsg_event = event;
+                out_handlers->avpipe_stater(outctx, outctx->stream_index, out_stat_emsg);
+                encoder_context->emsg_event = NULL;
+            }
+        } else if (size > EMSG_MAX_BOX_SIZE) {
+            elv_warn("EMSG dropping event id=%u, box too big size=%d, url=%s", event->id, size, params->url);
+        }
+        emsg_event_free(event);
+    }
+
+    return rc;
+}
+
+/*
+ * Output writer of the video fMP4 segments if params->emit_emsg is set. The segment is passed through
+ * to the output handler, with the pending emsg boxes inserted before each moof box.
+ * The output is not seekable, so the inserted bytes don't shift any position the muxer writes back to.
+ */
+static int
+elv_io_write_emsg(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size)
+{
+    ioctx_t *outctx = (ioctx_t *)opaque;
+    avpipe_io_handler_t *out_handlers = outctx->encoder_ctx->out_handlers;
+    mp4_box_scanner_t *scanner = &outctx->box_scanner;
+    int pos = 0;
+
+    while (pos < buf_size) {
+        uint32_t box_type;
+        int n = mp4_box_scan(scanner, buf + pos, buf_size - pos, &box_type);
+
+        if (box_type == 0) {
+            if (out_handlers->avpipe_writer(outctx, buf + pos, n) < 0)
+                return -1;
+        } else if (box_type != MP4_BOX_INCOMPLETE) {
+            if (box_type == MP4_BOX_TYPE('m', 'o', 'o', 'f') && write_emsg_events(outctx) < 0)
+                return -1;
+            if (out_handlers->avpipe_writer(outctx, scanner->header, scanner->header_len) < 0)
+                return -1;
+        }
+        pos += n;
+    }
+
+    return buf_size;
+}
+
+/*
+ * Output writer of the DASH manifest and of the HLS master playlist of an AV1 or VP9 video output. The manifest
+ * is held back until elv_io_close(), see write_manifest().
+ */
+static int
+elv_io_write_manifest(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size)
+{
+    ioctx_t *outctx = (ioctx_t *)opaque;
+
+    if (outctx->manifest_len + buf_size + 1 > outctx->manifest_size) {
+        int size = outctx->manifest_size * 2 > outctx->manifest_len + buf_size + 1 ?
+            outctx->manifest_size * 2 : outctx->manifest_len + buf_size + 1;
+        char *manifest = (char *) realloc(outctx->manifest, size);
+
+        if (!manifest)
+            return -1;
+        outctx->manifest = manifest;
+        outctx->manifest_size = size;
+    }
+
+    memcpy(outctx->manifest + outctx->manifest_len, buf, buf_size);
+    outctx->manifest_len += buf_size;
+    outctx->manifest[outctx->manifest_len] = '\0';
+    return buf_size;
+}
+
+/*
+ * True if a codecs entry of a manifest is the bare sample entry ("av01", "vp09" or "vp9" of WebM) of the codec of
+ * codec_string.
+ */
+static int
+is_bare_codec(
+    const char *entry,
+    int len,
+    const char *codec_string)
+{
+    if (!strchr(codec_string, '.') || strncmp(entry, codec_string, 2))
+        return 0;
+    return (len == 4 && (!strncmp(entry, "av01", 4) || !strncmp(entry, "vp09", 4))) ||
+        (len == 3 && !strncmp(entry, "vp9", 3));
+}
+
+/*
+ * Writes the manifest held back by elv_io_write_manifest(). Depending on the version, the dash and hls muxers write
+ * the bare "av01" and "vp9" codecs of AV1 and VP9, and hls doesn't write the CODECS of the codecs it doesn't know.
+ * They are replaced by (or set to) the RFC 6381 codec string of the video encoder, like the one of avpipe_probe().
+ */
+static int
+write_manifest(
+    ioctx_t *outctx,
+    avpipe_io_handler_t *out_handlers)
+{
+    coderctx_t *encoder_context = outctx->encoder_ctx;
+    int index = encoder_context->video_stream_index;
+    char codec_string[CODEC_STRING_SZ];
+    char codecs_attr[CODEC_STRING_SZ + 16];
+    const char *doc = outctx->manifest;
+    const char *start = doc;
+    const char *p = doc;
+
+    get_codec_string(encoder_context->stream[index]->codecpar, encoder_context->codec_context[index]->framerate,
+        codec_string, sizeof(codec_string));
+    snprintf(codecs_attr, sizeof(codecs_attr), ",CODECS=\"%s\"", codec_string);
+
+    while (*p) {
+        if (outctx->type == avpipe_master_m3u && (p == doc || p[-1] == '\n') &&
+            !strncmp(p, "#EXT-X-STREAM-INF:", 18)) {
+            const char *eol = p + strcspn(p, "\r\n");
+            const char *codecs = strstr(p, "CODECS=");
+
+            if ((!codecs || codecs > eol) && strchr(codec_string, '.')) {
+                if (out_handlers->avpipe_writer(outctx, (uint8_t *) start, eol - start) < 0 ||
+                    out_handlers->avpipe_writer(outctx, (uint8_t *) codecs_attr, strlen(codecs_attr)) < 0)
+                    return -1;
+                start = p = eol;
+                continue;
+            }
+        }
+
+        /* codecs="..." of the DASH representations, CODECS="..." of the HLS variants */
+        if (strncmp(p, "codecs=\"", 8) && strncmp(p, "CODECS=\"", 8)) {
+            p++;
+            continue;
+        }
+        p += 8;
+        while (*p && *p != '"') {
+            int len = strcspn(p, ",\"");
+
+            if (is_bare_codec(p, len, codec_string)) {
+                if (out_handlers->avpipe_writer(outctx, (uint8_t *) start, p - start) < 0 ||
+                    out_handlers->avpipe_writer(outctx, (uint8_t *) codec_string, strlen(codec_string)) < 0)
+                    return -1;
+                start = p + len;
+            }
+            p += len;
+            if (*p == ',')
+                p++;
+        }
+    }
+
+    if (p > start && out_handlers->avpipe_writer(outctx, (uint8_t *) start, p - start) < 0)
+        return -1;
+    return 0;
+}
+
+/*
+ * True if the video encoder of an output is AV1 or VP9.
+ */
+static int
+is_av1_vp9_output(
+    out_tracker_t *out_tracker,
+    ioctx_t *outctx)
+{
+    coderctx_t *encoder_context = outctx->encoder_ctx;
+    int index;
+
+    if (!encoder_context || out_tracker->xc_type != xc_video)
+        return 0;
+    index = encoder_context->video_stream_index;
+    if (index < 0 || !encoder_context->stream[index] || !encoder_context->codec_context[index])
+        return 0;
+    return encoder_context->stream[index]->codecpar->codec_id == AV_CODEC_ID_AV1 ||
+        encoder_context->stream[index]->codecpar->codec_id == AV_CODEC_ID_VP9;
+}
+
+/*
+ * Returns the writer of an output, emsg boxes are only written in the video fMP4 segments and the codecs of the
+ * manifests are only rewritten for AV1 and VP9.
+ */
+static avpipe_writer_f
+output_writer(
+    out_tracker_t *out_tracker,
+    ioctx_t *outctx)
+{
+    xcparams_t *params = out_tracker->inctx ? out_tracker->inctx->params : NULL;
+
+    if (params && params->emit_emsg && outctx->encoder_ctx &&
+        (outctx->type == avpipe_video_segment || outctx->type == avpipe_video_fmp4_segment))
+        return elv_io_write_emsg;
+    if ((outctx->type == avpipe_manifest || outctx->type == avpipe_master_m3u) &&
+        is_av1_vp9_output(out_tracker, outctx))
+        return elv_io_write_manifest;
+    return out_tracker->out_handlers->avpipe_writer;
+}
+
+/*
+ * Writes a caption document through the output handlers, as the segment seg_index of the caption track.
+ */
+static int
+write_caption_document(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int track,
+    int seg_index,
+    const char *doc)
+{
+    avpipe_io_handler_t *out_handlers = encoder_context->out_handlers;
+    int webvtt = !strcmp(params->format, "hls");
+    char url[MAX_AVFILENAME_LEN];
+    int size = strlen(doc);
+    int rc = 0;
+
+    ioctx_t *outctx = (ioctx_t *) calloc(1, sizeof(ioctx_t));
+    snprintf(url, sizeof(url), "captions%d-%05d.%s", track, seg_index, webvtt ? "vtt" : "ttml");
+    outctx->url = strdup(url);
+    outctx->type = webvtt ? avpipe_caption_webvtt_segment : avpipe_caption_ttml_segment;
+    outctx->stream_index = track;
+    outctx->seg_index = seg_index;
+    outctx->encoder_ctx = encoder_context;
+    outctx->inctx = encoder_context->inctx;
+
+    if (out_handlers->avpipe_opener(url, outctx) < 0) {
+        elv_err("CAPTIONS failed to open %s, url=%s", url, params->url);
+        free(outctx->url);
+        free(outctx);
+        return -1;
+    }
+    out_handlers->avpipe_stater(outctx, track, out_stat_start_file);
+
+    if (out_handlers->avpipe_writer(outctx, (uint8_t *) doc, size) < 0) {
+        elv_err("CAPTIONS failed to write %s, url=%s", url, params->url);
+        rc = -1;
+    }
+
+    out_handlers->avpipe_stater(outctx, track, out_stat_end_file);
+    out_handlers->avpipe_closer(outctx);
+    elv_dbg("CAPTIONS written %s track=%s size=%d", url, cc_track_name(track), size);
+    free(outctx->url);
+    av_freep(&outctx->buf);
+    free(outctx);
+    return rc;
+}
+
+int
+elv_io_caption_segment(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int seg_index,
+    int64_t pts)
+{
+    cc_ctx_t *cc = encoder_context->cc;
+    AVStream *stream = encoder_context->stream[encoder_context->video_stream_index];
+    cc_format_t format = !strcmp(params->format, "hls") ? cc_format_webvtt : cc_format_ttml;
+    int rc = 0;
+
+    if (encoder_context->cc_seg_index >= 0) {
+        for (int t = 0; t < CC_MAX_TRACKS; t++) {
+            cc_track_t *track = &cc->tracks[t];
+            if (!track->active)
+                continue;
+
+            /* A track starts with its first cue, its previous segments are empty */
+            while (encoder_context->cc_first_seg_index + track->n_segments < encoder_context->cc_seg_index) {
+                char *doc = cc_segment_document(track, format, 0, 0, stream->time_base.num, stream->time_base.den);
+                if (write_caption_document(encoder_context, params, t,
+                    encoder_context->cc_first_seg_index + track->n_segments, doc) < 0)
+                    rc = -1;
+                free(doc);
+                track->n_segments++;
+            }
+
+            char *doc = cc_segment_document(track, format, encoder_context->cc_seg_start, pts,
+                stream->time_base.num, stream->time_base.den);
+            if (write_caption_document(encoder_context, params, t, encoder_context->cc_seg_index, doc) < 0)
+                rc = -1;
+            free(doc);
+            track->n_segments++;
+            cc_segment_done(track, pts);
+        }
+    } else {
+        encoder_context->cc_first_seg_index = seg_index;
+        encoder_context->cc_start_pts = pts;
+    }
+
+    encoder_context->cc_seg_index = seg_index;
+    encoder_context->cc_seg_start = pts;
+    return rc;
+}
 
 /*
  * Returns the AVIOContext as output argument 'pb'
@@ -54,6 +404,9 @@ elv_io_open(
         outctx->stream_index = (int) strtol(stream_opt->value, &endptr, 10);
         outctx->url = strdup(url);
         assert(outctx->stream_index == 0 || outctx->stream_index == 1);
+        /* Each audio rendition has its own muxer, its segments are numbered by rendition */
+        if (out_tracker->rendition)
+            outctx->stream_index = out_tracker->output_stream_index;
         if (out_tracker->xc_type == xc_video)
             outctx->type = avpipe_video_segment;
         else
@@ -68,7 +421,7 @@ elv_io_open(
         }
 
         AVIOContext *avioctx = avio_alloc_context(outctx->buf, outctx->bufsz, AVIO_FLAG_WRITE, (void *)outctx,
-            out_handlers->avpipe_reader, out_handlers->avpipe_writer, out_handlers->avpipe_seeker);
+            out_handlers->avpipe_reader, output_writer(out_tracker, outctx), out_handlers->avpipe_seeker);
 
         avioctx->seekable = 0;
         avioctx->direct = 1;
@@ -172,6 +525,8 @@ elv_io_open(
             outctx->type == avpipe_mpegts_segment)
             // not set for outctx->type == avpipe_image because elv_io_close will free outctx for each frame extracted
             out_tracker->last_outctx = outctx;
+        if (out_tracker->rendition)
+            outctx->stream_index = out_tracker->output_stream_index;
         /* Manifest or init segments */
         if (out_handlers->avpipe_opener(url, outctx) < 0) {
             free(outctx);
@@ -179,7 +534,7 @@ elv_io_open(
         }
 
         AVIOContext *avioctx = avio_alloc_context(outctx->buf, outctx->bufsz, AVIO_FLAG_WRITE, (void *)outctx,
-            out_handlers->avpipe_reader, out_handlers->avpipe_writer, out_handlers->avpipe_seeker);
+            out_handlers->avpipe_reader, output_writer(out_tracker, outctx), out_handlers->avpipe_seeker);
 
         elv_dbg("OUT elv_io_open url=%s, type=%d, stream_index=%d, seg_index=%d, last_outctx=%p, buf=%p",
             url, outctx->type, outctx->stream_index, outctx->seg_index, out_tracker->last_outctx, avioctx->buffer);
@@ -223,6 +578,12 @@ elv_io_close(
     elv_dbg("OUT elv_io_close url=%s, stream_index=%d, seg_index=%d avioctx=%p, avioctx->opaque=%p buf=%p outtracker->last_outctx=%p, outhandlers=%p",
         outctx != NULL ? outctx->url : "", outctx != NULL ? outctx->stream_index : -1, outctx != NULL ? outctx->seg_index : -1, pb, pb->opaque, avioctx->buffer,
 	    out_tracker != NULL ? out_tracker->last_outctx : 0, out_handlers);
+    if (out_handlers && outctx && outctx->manifest) {
+        if (write_manifest(outctx, out_handlers) < 0)
+            elv_err("Failed to write manifest, url=%s", outctx->url != NULL ? outctx->url : "");
+    }
+    if (outctx)
+        free(outctx->manifest);
     if (out_handlers) {
         // TODO(Nate): Separate out this stat into something more descriptive of the particular case
         // For now, this double-stat is fine because the 'out_stat_encoding_end_pts' is also used
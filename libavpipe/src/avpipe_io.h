@@ -11,3 +11,14 @@ void
 elv_io_close(
     struct AVFormatContext *s,
     AVIOContext *pb);
+
+/*
+ * Writes the current caption segment of the active caption tracks, that ends at pts, and starts the
+ * caption segment seg_index at pts. The segment is not written before the first call.
+ */
+int
+elv_io_caption_segment(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int seg_index,
+    int64_t pts);
@@ -16,11 +16,13 @@ elv_mux_open(
 {
     int ret = 0;
     avpipe_io_handler_t *out_handlers = (avpipe_io_handler_t *) format_ctx->avpipe_opaque;
+    xctx_t *xctx = (xctx_t *) format_ctx->opaque;
     ioctx_t *outctx = (ioctx_t *) calloc(1, sizeof(ioctx_t));
 
     /* Set mux output format to avpipe_fmp4_segment */
     outctx->type = avpipe_mp4_segment;
     outctx->url = (char *) url;
+    outctx->in_mux_ctx = xctx->in_mux_ctx;
     elv_dbg("OUT elv_mux_open url=%s", url);
     if (out_handlers->avpipe_opener(url, outctx) < 0) {
         free(outctx);
@@ -81,8 +83,6 @@ prepare_input_muxer(
         inctx->url = in_mux_ctx->video.parts[0];
     } else if (in_mux_index <= in_mux_ctx->last_audio_index) {
         inctx->url = in_mux_ctx->audios[in_mux_index-1].parts[0];
-    } else if (in_mux_index <= in_mux_ctx->last_audio_index + in_mux_ctx->last_caption_index) {
-        inctx->url = in_mux_ctx->captions[in_mux_index-in_mux_ctx->last_audio_index-1].parts[0];
     } else {
         elv_err("prepare_input_muxer() invalid in_mux_index=%d", in_mux_index);
         return eav_stream_index;
@@ -132,6 +132,116 @@ prepare_input_muxer(
     return eav_success;
 }
 
+/*
+ * Reads all the parts of the caption/subtitle input index (0 based) and parses them as one WebVTT or
+ * TTML track.
+ */
+static int
+read_subtitle_input(
+    avpipe_io_handler_t *in_handlers,
+    io_mux_ctx_t *in_mux_ctx,
+    int index,
+    sub_track_t *track)
+{
+    ioctx_t inctx;
+    uint8_t *data = NULL;
+    int size = 0;
+    int cap = 0;
+    int rc = eav_success;
+
+    memset(&inctx, 0, sizeof(inctx));
+    inctx.in_mux_ctx = in_mux_ctx;
+    inctx.in_mux_index = in_mux_ctx->last_audio_index + index + 1;
+
+    while (1) {
+        if (cap - size < AVIO_IN_BUF_SIZE) {
+            cap += 4 * AVIO_IN_BUF_SIZE;
+            data = (uint8_t *) realloc(data, cap);
+        }
+        int r = in_handlers->avpipe_reader(&inctx, data + size, cap - size);
+        if (r == AVERROR_EOF)
+            break;
+        if (r < 0) {
+            elv_err("Could not read subtitle input %d, url=%s", index+1, in_mux_ctx->out_filename);
+            rc = eav_read_input;
+            goto end_read_subtitle;
+        }
+        size += r;
+    }
+
+    if (sub_track_parse(track, (char *) data, size) < 0) {
+        elv_err("Subtitle input %d is not WebVTT or TTML, url=%s", index+1, in_mux_ctx->out_filename);
+        rc = eav_param;
+        goto end_read_subtitle;
+    }
+    track->lang = in_mux_ctx->captions[index].lang;
+    track->role = in_mux_ctx->captions[index].role;
+    track->name = in_mux_ctx->captions[index].name;
+
+    elv_dbg("Subtitle input %d format=%s, cues=%d, duration=%"PRId64", lang=%s, role=%s",
+        index+1, track->format == sub_format_ttml ? "ttml" : "webvtt", track->n_cues, track->duration,
+        track->lang ? track->lang : "", track->role);
+
+end_read_subtitle:
+    free(data);
+    return rc;
+}
+
+/*
+ * Parses the attributes that follow the type of a caption/subtitle section of a mux spec,
+ * i.e. "lang=en role=caption name=\"English SDH\"".
+ */
+static int
+parse_mux_attributes(
+    char *attrs,
+    mux_input_ctx_t *input)
+{
+    char *p = attrs;
+
+    while (*p) {
+        while (*p == ' ' || *p == '\t')
+            p++;
+        if (!*p)
+            break;
+
+        char *key = p;
+        while (*p && *p != '=' && *p != ' ' && *p != '\t')
+            p++;
+        if (*p != '=') {
+            elv_err("init_mux_ctx invalid attribute %s", key);
+            return eav_param;
+        }
+        *p++ = '\0';
+
+        char *value = p;
+        if (*p == '"') {
+            value = ++p;
+            while (*p && *p != '"')
+                p++;
+            if (!*p) {
+                elv_err("init_mux_ctx unterminated attribute %s", key);
+                return eav_param;
+            }
+        } else {
+            while (*p && *p != ' ' && *p != '\t')
+                p++;
+        }
+        if (*p)
+            *p++ = '\0';
+
+        if (!strcmp(key, "lang"))
+            input->lang = value;
+        else if (!strcmp(key, "role"))
+            input->role = value;
+        else if (!strcmp(key, "name"))
+            input->name = value;
+        else
+            elv_warn("init_mux_ctx unknown attribute %s", key);
+    }
+
+    return eav_success;
+}
+
 /**
  * @brief   Initializes an io_mux_ctx_t
  *
@@ -159,6 +269,11 @@ init_mux_ctx(
         char *stream_type = strtok_r(NULL, "\n\r,", &ptr);
         if (!stream_type)
             break;
+        /* The type of a section can be followed by attributes (lang, role, name) */
+        char *attrs = stream_type + strcspn(stream_type, " \t");
+        if (*attrs)
+            *attrs++ = '\0';
+        int is_subtitle = !strcmp(stream_type, "caption") || !strcmp(stream_type, "subtitle");
         char *index_str = strtok_r(NULL, "\n\r,", &ptr);
         if (!index_str)
             break;
@@ -174,8 +289,8 @@ init_mux_ctx(
             elv_err("init_mux_ctx invalid audio stream_index=%d", stream_index);
             return eav_param;
         }
-        if (!strcmp(stream_type, "caption") && (stream_index > MAX_STREAMS || stream_index > in_mux_ctx->last_caption_index+1)) {
-            elv_err("init_mux_ctx invalid caption stream_index=%d", stream_index);
+        if (is_subtitle && (stream_index > MAX_STREAMS || stream_index > in_mux_ctx->last_caption_index+1)) {
+            elv_err("init_mux_ctx invalid %s stream_index=%d", stream_type, stream_index);
             return eav_param;
         }
         char *stream_url = strtok_r(NULL, "\n\r,", &ptr);
@@ -184,7 +299,7 @@ init_mux_ctx(
 
         if (strcmp(stream_type, "audio") &&
             strcmp(stream_type, "video") &&
-            strcmp(stream_type, "caption"))
+            !is_subtitle)
             continue;
 
         found_muxing_input++;
@@ -192,14 +307,21 @@ init_mux_ctx(
         if (!strcmp(stream_type, "audio") && in_mux_ctx->audios[stream_index-1].n_parts < MAX_MUX_IN_STREAM) {
             in_mux_ctx->audios[stream_index-1].parts[in_mux_ctx->audios[stream_index-1].n_parts] = stream_url;
             in_mux_ctx->audios[stream_index-1].n_parts++;
+            if (parse_mux_attributes(attrs, &in_mux_ctx->audios[stream_index-1]) != eav_success)
+                return eav_param;
             if (stream_index > in_mux_ctx->last_audio_index)
                 in_mux_ctx->last_audio_index = stream_index;
         } else if (!strcmp(stream_type, "video") && in_mux_ctx->video.n_parts < MAX_MUX_IN_STREAM) {
             in_mux_ctx->video.parts[in_mux_ctx->video.n_parts] = stream_url;
             in_mux_ctx->video.n_parts++;
-        } else if (!strcmp(stream_type, "caption") && in_mux_ctx->captions[stream_index-1].n_parts < MAX_MUX_IN_STREAM) {
-            in_mux_ctx->captions[stream_index-1].parts[in_mux_ctx->captions[stream_index-1].n_parts] = stream_url;
-            in_mux_ctx->captions[stream_index-1].n_parts++;
+        } else if (is_subtitle && in_mux_ctx->captions[stream_index-1].n_parts < MAX_MUX_IN_STREAM) {
+            mux_input_ctx_t *caption = &in_mux_ctx->captions[stream_index-1];
+            caption->parts[caption->n_parts] = stream_url;
+            caption->n_parts++;
+            if (!caption->role)
+                caption->role = !strcmp(stream_type, "caption") ? "caption" : "subtitle";
+            if (parse_mux_attributes(attrs, caption) != eav_success)
+                return eav_param;
             if (stream_index > in_mux_ctx->last_caption_index)
                 in_mux_ctx->last_caption_index = stream_index;
         }
@@ -217,6 +339,40 @@ init_mux_ctx(
 }
 
 
+/* Returns 1 if the subtitle tracks of a muxing are written as separate outputs instead of mp4 tracks */
+static int
+separate_subtitle_outputs(
+    xcparams_t *params)
+{
+    return params->format && (!strcmp(params->format, "dash") || !strcmp(params->format, "hls"));
+}
+
+/*
+ * Writes the samples of the subtitle tracks of a mp4 output that start before until (ms).
+ */
+static int
+write_subtitle_samples(
+    xctx_t *xctx,
+    int64_t until)
+{
+    io_mux_ctx_t *in_mux_ctx = xctx->in_mux_ctx;
+
+    if (separate_subtitle_outputs(xctx->params))
+        return 0;
+
+    for (int i=0; i<in_mux_ctx->last_caption_index; i++) {
+        sub_track_t *track = &xctx->sub_tracks[i];
+        int rc = sub_write_samples(xctx->out_muxer_ctx.format_context, in_mux_ctx->last_audio_index + 1 + i,
+            track, &xctx->sub_pos[i], until, track->duration);
+        if (rc < 0) {
+            elv_err("Failure in writing subtitle %d samples, rc=%d", i+1, rc);
+            return eav_write_frame;
+        }
+    }
+
+    return 0;
+}
+
 /*
  * url is the output filename.
  */
@@ -253,8 +409,16 @@ avpipe_init_muxer(
 
     coderctx_t *out_muxer_ctx = &p_xctx->out_muxer_ctx;
 
-    /* Prepare video, audio, captions input muxer */
-    for (int i=0; i<in_mux_ctx->last_audio_index+in_mux_ctx->last_caption_index+1; i++) {
+    xcparams_t *params = (xcparams_t *) calloc(1, sizeof(xcparams_t));
+    *params = *p;
+    p_xctx->in_mux_ctx = in_mux_ctx;
+    p_xctx->params = params;
+    p_xctx->in_handlers = in_handlers;
+    p_xctx->out_handlers = out_handlers;
+    p_xctx->debug_frame_level = params->debug_frame_level;
+
+    /* Prepare video, audio input muxer */
+    for (int i=0; i<in_mux_ctx->last_audio_index+1; i++) {
         ioctx_t *inctx = (ioctx_t *)calloc(1, sizeof(ioctx_t));
         inctx->in_mux_index = i;
         inctx->in_mux_ctx = in_mux_ctx;
@@ -262,6 +426,12 @@ avpipe_init_muxer(
         p_xctx->inctx_muxer[i] = inctx;
     }
 
+    /* Captions and subtitles are read completely, they are added as text tracks */
+    for (int i=0; i<in_mux_ctx->last_caption_index; i++) {
+        if ((ret = read_subtitle_input(in_handlers, in_mux_ctx, i, &p_xctx->sub_tracks[i])) != eav_success)
+            return ret;
+    }
+
     /* allocate the output format context */
     //avformat_alloc_output_context2(&out_muxer_ctx->format_context, NULL, "segment", out_filename);
     avformat_alloc_output_context2(&out_muxer_ctx->format_context, NULL, "mp4", out_filename);
@@ -280,12 +450,13 @@ avpipe_init_muxer(
     }
 
     out_muxer_ctx->format_context->avpipe_opaque = out_handlers;
+    out_muxer_ctx->format_context->opaque = p_xctx;
 
     /* Custom output buffer */
     out_muxer_ctx->format_context->io_open = elv_mux_open;
     out_muxer_ctx->format_context->io_close = elv_mux_close;
 
-    for (int i=0; i<in_mux_ctx->last_audio_index+in_mux_ctx->last_caption_index+1; i++) {
+    for (int i=0; i<in_mux_ctx->last_audio_index+1; i++) {
         /* Add a new stream to output format for each input in muxer context (source) */
         out_muxer_ctx->stream[i] = avformat_new_stream(out_muxer_ctx->format_context, NULL);
 
@@ -304,7 +475,18 @@ avpipe_init_muxer(
         out_muxer_ctx->stream[i]->time_base = in_stream->time_base;
         out_muxer_ctx->stream[i]->avg_frame_rate = in_stream->avg_frame_rate;
         out_muxer_ctx->stream[i]->r_frame_rate = in_stream->r_frame_rate;
+        if (i > 0 && in_mux_ctx->audios[i-1].lang)
+            av_dict_set(&out_muxer_ctx->stream[i]->metadata, "language", in_mux_ctx->audios[i-1].lang, 0);
+    }
 
+    /* The subtitle tracks are muxed as wvtt/stpp tracks, dash and hls get separate subtitle outputs */
+    if (!separate_subtitle_outputs(params)) {
+        for (int i=0; i<in_mux_ctx->last_caption_index; i++) {
+            if (!sub_new_stream(out_muxer_ctx->format_context, &p_xctx->sub_tracks[i])) {
+                elv_err("Failed to add subtitle stream %d to muxer output", i+1);
+                return eav_mem_alloc;
+            }
+        }
     }
 
     av_dump_format(out_muxer_ctx->format_context, 0, out_filename, 1);
@@ -320,13 +502,6 @@ avpipe_init_muxer(
         return eav_write_header;
     }
 
-    xcparams_t *params = (xcparams_t *) calloc(1, sizeof(xcparams_t));
-    *params = *p;
-    p_xctx->in_mux_ctx = in_mux_ctx;
-    p_xctx->params = params;
-    p_xctx->in_handlers = in_handlers;
-    p_xctx->out_handlers = out_handlers;
-    p_xctx->debug_frame_level = params->debug_frame_level;
     *xctx = p_xctx;
 
     return eav_success;
@@ -343,14 +518,14 @@ get_next_packet(
     int ret = 0;
     int i;
 
-    for (i=0; i<in_mux_ctx->last_audio_index + in_mux_ctx->last_caption_index + 1; i++) {
+    for (i=0; i<in_mux_ctx->last_audio_index + 1; i++) {
         if (xctx->is_pkt_valid[i]) {
             index = i;
             break;
         }
     }
 
-    for (i=index+1; i<in_mux_ctx->last_audio_index + in_mux_ctx->last_caption_index + 1; i++) {
+    for (i=index+1; i<in_mux_ctx->last_audio_index + 1; i++) {
         if (!xctx->is_pkt_valid[i])
             continue;
         AVStream *stream1 = xctx->in_muxer_ctx[i].format_context->streams[0];
@@ -369,7 +544,9 @@ get_next_packet(
     pkt->stream_index = index;
     xctx->is_pkt_valid[index] = 0;
 
-    pkt->dts = pkt->pts;
+    /* The mez parts made by a copy (EDL stream copy) can have B-frames, their dts are kept */
+    if (pkt->dts == AV_NOPTS_VALUE)
+        pkt->dts = pkt->pts;
     dump_packet(pkt->stream_index, "MUX IN ", pkt, xctx->debug_frame_level);
 
 read_frame_again:
@@ -379,20 +556,21 @@ read_frame_again:
         if (pkts[index].pts == pkt->pts)
             goto read_frame_again;
         xctx->is_pkt_valid[index] = 1;
+        /* A part that restarts its timestamps follows the previous one, the dts are increasing even with B-frames */
         if (pkt->pts >= 0) {
             if (index == 0) {
-                if (pkt->pts > in_mux_ctx->last_video_pts)
-                    in_mux_ctx->last_video_pts = pkt->pts;
+                if (pkt->dts > in_mux_ctx->last_video_dts)
+                    in_mux_ctx->last_video_dts = pkt->dts;
                 else {
-                    pkt->pts += in_mux_ctx->last_video_pts;
-                    pkt->dts += in_mux_ctx->last_video_pts;
+                    pkt->pts += in_mux_ctx->last_video_dts;
+                    pkt->dts += in_mux_ctx->last_video_dts;
                 }
             } else if (index <= in_mux_ctx->last_audio_index) {
-                if (pkt->pts > in_mux_ctx->last_audio_pts)
-                    in_mux_ctx->last_audio_pts = pkt->pts;
+                if (pkt->dts > in_mux_ctx->last_audio_dts)
+                    in_mux_ctx->last_audio_dts = pkt->dts;
                 else {
-                    pkt->pts += in_mux_ctx->last_audio_pts;
-                    pkt->dts += in_mux_ctx->last_audio_pts;
+                    pkt->pts += in_mux_ctx->last_audio_dts;
+                    pkt->dts += in_mux_ctx->last_audio_dts;
                 }
             }
         }
@@ -405,6 +583,200 @@ read_frame_again:
     return index;
 }
 
+/*
+ * Writes an output of the subtitle tracks through the output handlers of the muxing.
+ */
+static int
+write_subtitle_output(
+    xctx_t *xctx,
+    const char *url,
+    avpipe_buftype_t type,
+    int stream_index,
+    int seg_index,
+    const uint8_t *data,
+    int size)
+{
+    avpipe_io_handler_t *out_handlers = xctx->out_handlers;
+    int rc = 0;
+
+    ioctx_t *outctx = (ioctx_t *) calloc(1, sizeof(ioctx_t));
+    outctx->url = strdup(url);
+    outctx->type = type;
+    outctx->stream_index = stream_index;
+    outctx->seg_index = seg_index;
+    outctx->in_mux_ctx = xctx->in_mux_ctx;
+
+    if (out_handlers->avpipe_opener(url, outctx) < 0) {
+        elv_err("SUBTITLES failed to open %s, url=%s", url, xctx->params->url);
+        free(outctx->url);
+        free(outctx);
+        return eav_write_frame;
+    }
+
+    if (out_handlers->avpipe_writer(outctx, (uint8_t *) data, size) < 0) {
+        elv_err("SUBTITLES failed to write %s, url=%s", url, xctx->params->url);
+        rc = eav_write_frame;
+    }
+
+    out_handlers->avpipe_closer(outctx);
+    elv_dbg("SUBTITLES written %s size=%d", url, size);
+    free(outctx->url);
+    free(outctx);
+    return rc;
+}
+
+/* Sets the bandwidth of a subtitle track to the peak bitrate of its segments */
+static void
+update_subtitle_bandwidth(
+    sub_track_t *track,
+    int size,
+    int64_t duration)
+{
+    if (duration > 0 && size * 8000LL / duration > track->bandwidth)
+        track->bandwidth = size * 8000LL / duration;
+}
+
+/*
+ * Writes the CMAF init segment subtitle<index+1>-init.mp4 and the media segments subtitle<index+1>-<number>.m4s
+ * of a subtitle track with the mp4 muxer. Each segment is a fragment, flushed at the end of the segment.
+ */
+static int
+write_subtitle_cmaf(
+    xctx_t *xctx,
+    int index,
+    int64_t seg_duration,
+    int64_t duration,
+    int n_segments)
+{
+    sub_track_t *track = &xctx->sub_tracks[index];
+    AVFormatContext *format_ctx = NULL;
+    char url[MAX_AVFILENAME_LEN];
+    uint8_t *data = NULL;
+    int64_t pos = 0;
+    int size;
+    int rc = 0;
+
+    avformat_alloc_output_context2(&format_ctx, NULL, "mp4", NULL);
+    if (!format_ctx) {
+        elv_err("SUBTITLES could not allocate the mp4 muxer, url=%s", xctx->params->url);
+        return eav_mem_alloc;
+    }
+    av_opt_set(format_ctx->priv_data, "movflags", "frag_custom+empty_moov+default_base_moof+cmaf", 0);
+
+    if (!sub_new_stream(format_ctx, track) || avio_open_dyn_buf(&format_ctx->pb) < 0) {
+        rc = eav_mem_alloc;
+        goto end_subtitle_cmaf;
+    }
+
+    if (avformat_write_header(format_ctx, NULL) < 0) {
+        elv_err("SUBTITLES failed to write the init segment of subtitle %d, url=%s", index+1, xctx->params->url);
+        rc = eav_write_header;
+        goto end_subtitle_cmaf;
+    }
+    size = avio_close_dyn_buf(format_ctx->pb, &data);
+    format_ctx->pb = NULL;
+    snprintf(url, sizeof(url), "subtitle%d-init.mp4", index+1);
+    rc = write_subtitle_output(xctx, url, avpipe_subtitle_init_segment, index, 0, data, size);
+    av_freep(&data);
+
+    for (int s = 0; s < n_segments && rc == 0; s++) {
+        int64_t start = s * seg_duration;
+        int64_t end = s == n_segments - 1 ? duration : start + seg_duration;
+
+        if (avio_open_dyn_buf(&format_ctx->pb) < 0) {
+            rc = eav_mem_alloc;
+            break;
+        }
+        if (sub_write_samples(format_ctx, 0, track, &pos, end, end) < 0 || av_write_frame(format_ctx, NULL) < 0) {
+            elv_err("SUBTITLES failed to write segment %d of subtitle %d, url=%s", s+1, index+1, xctx->params->url);
+            rc = eav_write_frame;
+        }
+        size = avio_close_dyn_buf(format_ctx->pb, &data);
+        format_ctx->pb = NULL;
+        if (rc == 0) {
+            snprintf(url, sizeof(url), "subtitle%d-%05d.m4s", index+1, s+1);
+            rc = write_subtitle_output(xctx, url, avpipe_subtitle_segment, index, s+1, data, size);
+            update_subtitle_bandwidth(track, size, end - start);
+        }
+        av_freep(&data);
+    }
+
+    /* The trailer (mfra) is not part of the segments */
+    if (avio_open_dyn_buf(&format_ctx->pb) == 0)
+        av_write_trailer(format_ctx);
+
+end_subtitle_cmaf:
+    if (format_ctx->pb) {
+        avio_close_dyn_buf(format_ctx->pb, &data);
+        format_ctx->pb = NULL;
+        av_freep(&data);
+    }
+    avformat_free_context(format_ctx);
+    return rc;
+}
+
+/*
+ * Writes the segments and manifests of the subtitle tracks of a dash or hls muxing: CMAF segments and a MPD
+ * for dash, WebVTT (or CMAF for TTML) segments, media playlists and the master playlist tags for hls.
+ */
+static int
+write_subtitle_outputs(
+    xctx_t *xctx)
+{
+    xcparams_t *params = xctx->params;
+    int n_tracks = xctx->in_mux_ctx->last_caption_index;
+    int hls = !strcmp(params->format, "hls");
+    int64_t seg_duration = SUB_DEFAULT_SEG_DURATION;
+    int64_t duration = xctx->mux_duration;
+    char url[MAX_AVFILENAME_LEN];
+    char *doc;
+    int rc = 0;
+
+    if (params->seg_duration && atof(params->seg_duration) > 0)
+        seg_duration = (int64_t) (atof(params->seg_duration) * 1000);
+    for (int i = 0; i < n_tracks; i++) {
+        if (xctx->sub_tracks[i].duration > duration)
+            duration = xctx->sub_tracks[i].duration;
+    }
+    int n_segments = sub_segment_count(seg_duration, duration);
+
+    for (int i = 0; i < n_tracks && rc == 0; i++) {
+        sub_track_t *track = &xctx->sub_tracks[i];
+
+        if (hls && track->format == sub_format_webvtt) {
+            for (int s = 0; s < n_segments && rc == 0; s++) {
+                int64_t start = s * seg_duration;
+                int64_t end = s == n_segments - 1 ? duration : start + seg_duration;
+
+                doc = sub_webvtt_segment(track, start, end);
+                snprintf(url, sizeof(url), "subtitle%d-%05d.vtt", i+1, s+1);
+                rc = write_subtitle_output(xctx, url, avpipe_subtitle_segment, i, s+1, (uint8_t *) doc, strlen(doc));
+                update_subtitle_bandwidth(track, strlen(doc), end - start);
+                free(doc);
+            }
+        } else {
+            rc = write_subtitle_cmaf(xctx, i, seg_duration, duration, n_segments);
+        }
+
+        if (hls && rc == 0) {
+            doc = sub_hls_playlist(track, i, seg_duration, duration);
+            snprintf(url, sizeof(url), "subtitle%d.m3u8", i+1);
+            rc = write_subtitle_output(xctx, url, avpipe_subtitle_manifest, i, 0, (uint8_t *) doc, strlen(doc));
+            free(doc);
+        }
+    }
+
+    if (rc == 0) {
+        doc = hls ? sub_hls_master(xctx->sub_tracks, n_tracks) :
+            sub_dash_manifest(xctx->sub_tracks, n_tracks, seg_duration, duration);
+        rc = write_subtitle_output(xctx, hls ? "subtitles.m3u8" : "subtitles.mpd", avpipe_subtitle_manifest,
+            0, 0, (uint8_t *) doc, strlen(doc));
+        free(doc);
+    }
+
+    return rc;
+}
+
 int
 avpipe_mux(
     xctx_t *xctx)
@@ -431,7 +803,7 @@ avpipe_mux(
     valid_pkts = xctx->is_pkt_valid;
     in_mux_ctx = xctx->in_mux_ctx;
 
-    for (int i=0; i<in_mux_ctx->last_caption_index + in_mux_ctx->last_audio_index + 1; i++) {
+    for (int i=0; i<in_mux_ctx->last_audio_index + 1; i++) {
         ret = av_read_frame(xctx->in_muxer_ctx[i].format_context, &pkts[i]);
         if (ret >= 0) {
             valid_pkts[i] = 1;
@@ -458,10 +830,22 @@ avpipe_mux(
 
         /* Adjust PTS and DTS and start always from 0 */
         pkt.pts -= first_pts_array[ret];
-        pkt.dts = pkt.pts;
+        pkt.dts -= first_pts_array[ret];
 
         dump_packet(pkt.stream_index, "MUX OUT ", &pkt, xctx->debug_frame_level);
 
+        AVStream *in_stream = xctx->in_muxer_ctx[ret].format_context->streams[0];
+        int64_t end = av_rescale_q(pkt.pts + pkt.duration, in_stream->time_base, (AVRational) {1, SUB_TIMESCALE});
+        if (end > xctx->mux_duration)
+            xctx->mux_duration = end;
+
+        /* The subtitle samples are interleaved with audio/video */
+        ret = write_subtitle_samples(xctx, av_rescale_q(pkt.pts, in_stream->time_base, (AVRational) {1, SUB_TIMESCALE}));
+        if (ret != 0) {
+            av_packet_unref(&pkt);
+            break;
+        }
+
         if (av_interleaved_write_frame(xctx->out_muxer_ctx.format_context, &pkt) < 0) {
             elv_err("Failure in copying mux packet");
             ret = eav_write_frame;
@@ -470,10 +854,13 @@ avpipe_mux(
         av_packet_unref(&pkt);
     }
 
+    if (ret == AVERROR_EOF)
+        ret = write_subtitle_samples(xctx, INT64_MAX);
+
     av_write_trailer(xctx->out_muxer_ctx.format_context);
 
-    if (ret == AVERROR_EOF)
-        ret = 0;
+    if (ret == 0 && in_mux_ctx->last_caption_index > 0 && separate_subtitle_outputs(xctx->params))
+        ret = write_subtitle_outputs(xctx);
 
     elv_log("avpipe_mux done url=%s, rc=%d, xctx->err=%d",
         xctx->params->url, ret, xctx->err);
@@ -494,7 +881,10 @@ avpipe_mux_fini(
     p_xctx = *xctx;
     in_mux_ctx = p_xctx->in_mux_ctx;
 
-    for (int i=0; i<in_mux_ctx->last_audio_index+in_mux_ctx->last_caption_index+1; i++) {
+    for (int i=0; i<in_mux_ctx->last_caption_index; i++)
+        sub_track_free(&p_xctx->sub_tracks[i]);
+
+    for (int i=0; i<in_mux_ctx->last_audio_index+1; i++) {
         avcodec_close(p_xctx->in_muxer_ctx[i].codec_context[0]);
         avcodec_free_context(&p_xctx->in_muxer_ctx[i].codec_context[0]);
 
@@ -0,0 +1,132 @@
+/*
+ * avpipe_qc.c
+ *
+ * Silence, black and frozen frame intervals of a transcoding and its QC report.
+ */
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "avpipe_qc.h"
+
+#define QC_EVENT_JSON_SZ    128
+
+const char *
+qc_event_type_name(
+    qc_event_type_t type)
+{
+    switch (type) {
+    case qc_silence:
+        return "silence";
+    case qc_black:
+        return "black";
+    case qc_freeze:
+        return "freeze";
+    }
+    return "unknown";
+}
+
+void
+qc_tracker_init(
+    qc_tracker_t *tracker,
+    qc_event_type_t type,
+    int stream_index)
+{
+    tracker->type = type;
+    tracker->stream_index = stream_index;
+    tracker->start = -1;
+    tracker->last = -1;
+    tracker->duration = 0;
+}
+
+void
+qc_tracker_frame(
+    qc_tracker_t *tracker,
+    double t)
+{
+    if (tracker->last >= 0 && t > tracker->last)
+        tracker->duration = t - tracker->last;
+    tracker->last = t;
+}
+
+void
+qc_tracker_start(
+    qc_tracker_t *tracker,
+    double start)
+{
+    if (tracker->start < 0)
+        tracker->start = start;
+}
+
+int
+qc_tracker_end(
+    qc_tracker_t *tracker,
+    double end,
+    double min_duration,
+    qc_event_t *event)
+{
+    double start = tracker->start;
+
+    if (start < 0)
+        return 0;
+    tracker->start = -1;
+
+    if (end < 0)
+        end = tracker->last + tracker->duration;
+    if (end - start < min_duration)
+        return 0;
+
+    event->type = tracker->type;
+    event->stream_index = tracker->stream_index;
+    event->start = start;
+    event->end = end;
+    return 1;
+}
+
+int
+qc_report_add(
+    qc_report_t *report,
+    const qc_event_t *event)
+{
+    if (report->n_events == report->size) {
+        int size = report->size ? report->size * 2 : 16;
+        qc_event_t *events = realloc(report->events, size * sizeof(qc_event_t));
+        if (!events)
+            return -1;
+        report->events = events;
+        report->size = size;
+    }
+    report->events[report->n_events++] = *event;
+    return 0;
+}
+
+void
+qc_report_free(
+    qc_report_t *report)
+{
+    free(report->events);
+    memset(report, 0, sizeof(*report));
+}
+
+char *
+qc_report_json(
+    const qc_report_t *report)
+{
+    int size = 32 + report->n_events * QC_EVENT_JSON_SZ;
+    char *doc = calloc(size, 1);
+    int len;
+
+    if (!doc)
+        return NULL;
+
+    len = snprintf(doc, size, "{\"intervals\":[");
+    for (int i = 0; i < report->n_events; i++) {
+        const qc_event_t *e = &report->events[i];
+        len += snprintf(doc + len, size - len,
+            "%s{\"type\":\"%s\",\"stream_index\":%d,\"start\":%.3f,\"end\":%.3f}",
+            i > 0 ? "," : "", qc_event_type_name(e->type), e->stream_index, e->start, e->end);
+    }
+    snprintf(doc + len, size - len, "]}");
+    return doc;
+}
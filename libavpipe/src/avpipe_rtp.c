@@ -0,0 +1,503 @@
+/*
+ * avpipe_rtp.c
+ *
+ * RTP/MPEGTS de-encapsulation. Media packets are kept in a jitter buffer indexed by
+ * the RTP sequence number and are delivered in order. A missing packet is waited for
+ * until the reorder window is exceeded. Before declaring it lost, SMPTE 2022-1 row/column
+ * FEC packets (XOR based) are used to reconstruct it.
+ */
+
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#include "avpipe_rtp.h"
+#include "elv_log.h"
+
+typedef struct rtp_header_t {
+    uint8_t     pt;
+    uint16_t    seq;
+    uint32_t    ts;
+    uint32_t    ssrc;
+    uint8_t     *payload;
+    int         len;
+} rtp_header_t;
+
+typedef struct rtp_slot_t {
+    int         valid;
+    uint16_t    seq;
+    uint8_t     pt;
+    uint32_t    ts;
+    int         len;
+    uint8_t     payload[RTP_MAX_PAYLOAD];
+} rtp_slot_t;
+
+typedef struct rtp_fec_t {
+    int         valid;
+    int         d;              /* 0: column FEC, 1: row FEC */
+    uint16_t    snbase;
+    int         offset;
+    int         na;
+    uint16_t    len_recovery;
+    uint8_t     pt_recovery;
+    uint32_t    ts_recovery;
+    int         len;
+    uint8_t     payload[RTP_MAX_PAYLOAD];
+} rtp_fec_t;
+
+struct rtp_ctx_t {
+    rtp_slot_t      *slots;
+    rtp_fec_t       *fec;
+    int             jitter_pkts;    /* Reorder window set by the caller, 0 means auto */
+    int             window;         /* Reorder window in use */
+    int             started;
+    uint16_t        next_seq;       /* Next sequence number to deliver */
+    uint16_t        highest_seq;    /* Highest sequence number received */
+    rtp_output_f    output;
+    void            *opaque;
+    rtp_stats_t     stats;          /* Only updated by the thread pushing the packets */
+    rtp_stats_t     pub_stats;      /* Copy of stats, protected by lock */
+    pthread_mutex_t lock;
+};
+
+static inline uint16_t
+rb16(
+    const uint8_t *p)
+{
+    return (p[0] << 8) | p[1];
+}
+
+static inline uint32_t
+rb24(
+    const uint8_t *p)
+{
+    return (p[0] << 16) | (p[1] << 8) | p[2];
+}
+
+static inline uint32_t
+rb32(
+    const uint8_t *p)
+{
+    return ((uint32_t)p[0] << 24) | (p[1] << 16) | (p[2] << 8) | p[3];
+}
+
+/* Signed distance from b to a, taking care of sequence number wrap around */
+static inline int
+seq_diff(
+    uint16_t a,
+    uint16_t b)
+{
+    return (int16_t)(a - b);
+}
+
+static int
+parse_rtp_header(
+    uint8_t *buf,
+    int len,
+    rtp_header_t *hdr)
+{
+    int off;
+
+    if (len < RTP_HEADER_LEN || (buf[0] >> 6) != 2)
+        return -1;
+
+    hdr->pt = buf[1] & 0x7f;
+    hdr->seq = rb16(buf+2);
+    hdr->ts = rb32(buf+4);
+    hdr->ssrc = rb32(buf+8);
+
+    off = RTP_HEADER_LEN + (buf[0] & 0x0f) * 4;     /* CSRC list */
+    if (buf[0] & 0x10) {                            /* Header extension */
+        if (off + 4 > len)
+            return -1;
+        off += 4 + rb16(buf+off+2) * 4;
+    }
+    if (off > len)
+        return -1;
+
+    hdr->payload = buf + off;
+    hdr->len = len - off;
+    if (buf[0] & 0x20) {                            /* Padding */
+        int padding = buf[len-1];
+        if (padding == 0 || padding > hdr->len)
+            return -1;
+        hdr->len -= padding;
+    }
+
+    if (hdr->len > RTP_MAX_PAYLOAD)
+        return -1;
+    return 0;
+}
+
+static inline rtp_slot_t *
+slot_at(
+    rtp_ctx_t *ctx,
+    uint16_t seq)
+{
+    return &ctx->slots[seq & (RTP_JB_SIZE-1)];
+}
+
+static inline int
+has_packet(
+    rtp_ctx_t *ctx,
+    uint16_t seq)
+{
+    rtp_slot_t *slot = slot_at(ctx, seq);
+    return slot->valid && slot->seq == seq;
+}
+
+static void
+publish_stats(
+    rtp_ctx_t *ctx)
+{
+    pthread_mutex_lock(&ctx->lock);
+    ctx->pub_stats = ctx->stats;
+    pthread_mutex_unlock(&ctx->lock);
+}
+
+/*
+ * Tries to reconstruct the only missing media packet protected by FEC packet f.
+ * Returns 1 if a packet was recovered, otherwise 0.
+ */
+static int
+fec_try_recover(
+    rtp_ctx_t *ctx,
+    rtp_fec_t *f)
+{
+    uint8_t payload[RTP_MAX_PAYLOAD];
+    uint16_t missing_seq = 0;
+    int n_missing = 0;
+
+    for (int i=0; i<f->na; i++) {
+        uint16_t seq = f->snbase + i * f->offset;
+        if (!has_packet(ctx, seq)) {
+            missing_seq = seq;
+            if (++n_missing > 1)
+                return 0;
+        }
+    }
+
+    /* Nothing to recover, or the missing packet has been declared lost already */
+    if (n_missing == 0 || seq_diff(missing_seq, ctx->next_seq) < 0)
+        return 0;
+
+    uint16_t len = f->len_recovery;
+    uint8_t pt = f->pt_recovery;
+    uint32_t ts = f->ts_recovery;
+
+    memset(payload, 0, sizeof(payload));
+    memcpy(payload, f->payload, f->len);
+    for (int i=0; i<f->na; i++) {
+        uint16_t seq = f->snbase + i * f->offset;
+        if (seq == missing_seq)
+            continue;
+        rtp_slot_t *slot = slot_at(ctx, seq);
+        int n = slot->len < f->len ? slot->len : f->len;
+        for (int j=0; j<n; j++)
+            payload[j] ^= slot->payload[j];
+        len ^= slot->len;
+        pt ^= slot->pt;
+        ts ^= slot->ts;
+    }
+
+    if (len > f->len) {
+        elv_warn("RTP FEC invalid recovered length=%d, fec_len=%d, seq=%d", len, f->len, missing_seq);
+        return 0;
+    }
+
+    rtp_slot_t *slot = slot_at(ctx, missing_seq);
+    slot->valid = 1;
+    slot->seq = missing_seq;
+    slot->pt = pt & 0x7f;
+    slot->ts = ts;
+    slot->len = len;
+    memcpy(slot->payload, payload, len);
+    if (seq_diff(missing_seq, ctx->highest_seq) > 0)
+        ctx->highest_seq = missing_seq;
+    ctx->stats.packets_recovered++;
+    elv_dbg("RTP FEC recovered seq=%d, len=%d, d=%d", missing_seq, len, f->d);
+    return 1;
+}
+
+/*
+ * Runs the FEC recovery until seq is recovered or no more progress is made.
+ * Iterating makes it possible to recover a packet with column FEC after
+ * another packet of the same column was recovered with row FEC.
+ */
+static int
+fec_recover(
+    rtp_ctx_t *ctx,
+    uint16_t seq)
+{
+    int progress;
+
+    do {
+        progress = 0;
+        for (int i=0; i<RTP_FEC_MAX_PKTS; i++) {
+            if (ctx->fec[i].valid && fec_try_recover(ctx, &ctx->fec[i]))
+                progress = 1;
+        }
+        if (has_packet(ctx, seq))
+            return 1;
+    } while (progress);
+
+    return 0;
+}
+
+/*
+ * Delivers the packets that are in order. A missing packet is skipped (lost) if it can not
+ * be recovered and either the reorder window is exceeded or flush is set.
+ */
+static void
+deliver(
+    rtp_ctx_t *ctx,
+    int flush)
+{
+    for ( ; ; ) {
+        int buffered = seq_diff(ctx->highest_seq, ctx->next_seq);
+        if (buffered < 0)
+            break;
+
+        rtp_slot_t *slot = slot_at(ctx, ctx->next_seq);
+        if (!has_packet(ctx, ctx->next_seq)) {
+            if (!flush && buffered < ctx->window)
+                break;
+            if (!fec_recover(ctx, ctx->next_seq)) {
+                elv_dbg("RTP lost seq=%d, highest=%d", ctx->next_seq, ctx->highest_seq);
+                slot->valid = 0;
+                ctx->stats.packets_lost++;
+                ctx->next_seq++;
+                continue;
+            }
+        }
+
+        /* The slot is kept valid after delivery since it might be needed for FEC recovery */
+        ctx->output(ctx->opaque, slot->payload, slot->len);
+        ctx->next_seq++;
+    }
+}
+
+static void
+reset(
+    rtp_ctx_t *ctx,
+    uint16_t seq)
+{
+    for (int i=0; i<RTP_JB_SIZE; i++)
+        ctx->slots[i].valid = 0;
+    for (int i=0; i<RTP_FEC_MAX_PKTS; i++)
+        ctx->fec[i].valid = 0;
+    ctx->next_seq = seq;
+    ctx->highest_seq = seq - 1;
+}
+
+rtp_ctx_t *
+rtp_ctx_new(
+    int jitter_pkts,
+    rtp_output_f output,
+    void *opaque)
+{
+    rtp_ctx_t *ctx = (rtp_ctx_t *) calloc(1, sizeof(rtp_ctx_t));
+
+    ctx->slots = (rtp_slot_t *) calloc(RTP_JB_SIZE, sizeof(rtp_slot_t));
+    ctx->fec = (rtp_fec_t *) calloc(RTP_FEC_MAX_PKTS, sizeof(rtp_fec_t));
+    if (jitter_pkts < 0)
+        jitter_pkts = 0;
+    if (jitter_pkts > RTP_JB_SIZE/2)
+        jitter_pkts = RTP_JB_SIZE/2;
+    ctx->jitter_pkts = jitter_pkts;
+    ctx->window = jitter_pkts > 0 ? jitter_pkts : RTP_JB_DEFAULT;
+    ctx->output = output;
+    ctx->opaque = opaque;
+    pthread_mutex_init(&ctx->lock, NULL);
+    return ctx;
+}
+
+void
+rtp_ctx_free(
+    rtp_ctx_t **ctx)
+{
+    if (!ctx || !*ctx)
+        return;
+
+    pthread_mutex_destroy(&(*ctx)->lock);
+    free((*ctx)->slots);
+    free((*ctx)->fec);
+    free(*ctx);
+    *ctx = NULL;
+}
+
+int
+rtp_push_media(
+    rtp_ctx_t *ctx,
+    uint8_t *buf,
+    int len)
+{
+    rtp_header_t hdr;
+
+    if (parse_rtp_header(buf, len, &hdr) < 0) {
+        elv_warn("RTP invalid media packet, len=%d", len);
+        return -1;
+    }
+
+    ctx->stats.packets_received++;
+    ctx->stats.bytes_received += hdr.len;
+
+    if (!ctx->started || hdr.ssrc != ctx->stats.ssrc) {
+        if (ctx->started) {
+            elv_log("RTP SSRC changed from %u to %u", ctx->stats.ssrc, hdr.ssrc);
+            deliver(ctx, 1);
+        }
+        ctx->started = 1;
+        ctx->stats.ssrc = hdr.ssrc;
+        reset(ctx, hdr.seq);
+    }
+
+    int d = seq_diff(hdr.seq, ctx->next_seq);
+    if (d < 0) {
+        ctx->stats.packets_late++;
+        goto done;
+    }
+    if (d >= RTP_JB_SIZE/2) {
+        elv_warn("RTP sequence jump seq=%d, expected=%d", hdr.seq, ctx->next_seq);
+        deliver(ctx, 1);
+        reset(ctx, hdr.seq);
+    }
+
+    if (has_packet(ctx, hdr.seq)) {
+        ctx->stats.packets_duplicated++;
+        goto done;
+    }
+
+    rtp_slot_t *slot = slot_at(ctx, hdr.seq);
+    slot->valid = 1;
+    slot->seq = hdr.seq;
+    slot->pt = hdr.pt;
+    slot->ts = hdr.ts;
+    slot->len = hdr.len;
+    memcpy(slot->payload, hdr.payload, hdr.len);
+
+    if (seq_diff(hdr.seq, ctx->highest_seq) > 0)
+        ctx->highest_seq = hdr.seq;
+    else
+        ctx->stats.packets_reordered++;
+
+    deliver(ctx, 0);
+
+done:
+    publish_stats(ctx);
+    return 0;
+}
+
+int
+rtp_push_fec(
+    rtp_ctx_t *ctx,
+    uint8_t *buf,
+    int len)
+{
+    rtp_header_t hdr;
+    rtp_fec_t *f = NULL;
+
+    if (parse_rtp_header(buf, len, &hdr) < 0 || hdr.len <= RTP_FEC_HEADER_LEN) {
+        elv_warn("RTP invalid FEC packet, len=%d", len);
+        return -1;
+    }
+
+    /*
+     * SMPTE 2022-1 FEC header:
+     * SNBase low bits (16) | Length recovery (16) | E (1) PT recovery (7) | Mask (24) |
+     * TS recovery (32) | N (1) D (1) Type (3) Index (3) | Offset (8) | NA (8) | SNBase ext bits (8)
+     */
+    uint8_t *p = hdr.payload;
+    int type = (p[12] >> 3) & 0x07;
+    int offset = p[13];
+    int na = p[14];
+    if (type != 0 || offset == 0 || na == 0 || rb24(p+5) != 0) {
+        elv_warn("RTP unsupported FEC packet, type=%d, offset=%d, na=%d", type, offset, na);
+        return -1;
+    }
+
+    ctx->stats.fec_packets_received++;
+
+    int d = (p[12] >> 6) & 0x01;
+    if (d == 0) {
+        ctx->stats.fec_columns = offset;
+        ctx->stats.fec_rows = na;
+    } else {
+        ctx->stats.fec_columns = na;
+    }
+
+    /* The whole FEC matrix has to fit in the reorder window for column FEC to be useful */
+    if (ctx->jitter_pkts == 0 && ctx->stats.fec_rows > 0) {
+        int window = 2 * ctx->stats.fec_columns * ctx->stats.fec_rows;
+        if (window > RTP_JB_SIZE/2)
+            window = RTP_JB_SIZE/2;
+        if (window > RTP_JB_DEFAULT && window != ctx->window) {
+            elv_log("RTP FEC L=%d, D=%d, reorder window=%d",
+                ctx->stats.fec_columns, ctx->stats.fec_rows, window);
+            ctx->window = window;
+        }
+    }
+
+    if (!ctx->started)
+        goto done;
+
+    uint16_t snbase = rb16(p);
+    uint16_t last = snbase + (na - 1) * offset;
+    if (seq_diff(last, ctx->next_seq) < 0)
+        goto done;  /* Too late, all the protected packets are delivered or lost */
+
+    /* Find a free or expired entry, otherwise replace the oldest one */
+    for (int i=0; i<RTP_FEC_MAX_PKTS; i++) {
+        rtp_fec_t *e = &ctx->fec[i];
+        if (e->valid && e->d == d && e->snbase == snbase)
+            goto done;  /* Duplicate */
+        if (!e->valid ||
+            seq_diff(e->snbase + (e->na - 1) * e->offset, ctx->next_seq) < 0) {
+            if (!f || f->valid)
+                f = e;
+            continue;
+        }
+        if (!f || (f->valid && seq_diff(e->snbase, f->snbase) < 0))
+            f = e;
+    }
+
+    f->valid = 1;
+    f->d = d;
+    f->snbase = snbase;
+    f->offset = offset;
+    f->na = na;
+    f->len_recovery = rb16(p+2);
+    f->pt_recovery = p[4] & 0x7f;
+    f->ts_recovery = rb32(p+8);
+    f->len = hdr.len - RTP_FEC_HEADER_LEN;
+    memcpy(f->payload, p + RTP_FEC_HEADER_LEN, f->len);
+
+    if (fec_try_recover(ctx, f))
+        deliver(ctx, 0);
+
+done:
+    publish_stats(ctx);
+    return 0;
+}
+
+int
+rtp_flush(
+    rtp_ctx_t *ctx)
+{
+    if (!ctx->started)
+        return 0;
+
+    deliver(ctx, 1);
+    publish_stats(ctx);
+    return 0;
+}
+
+void
+rtp_get_stats(
+    rtp_ctx_t *ctx,
+    rtp_stats_t *stats)
+{
+    pthread_mutex_lock(&ctx->lock);
+    *stats = ctx->pub_stats;
+    pthread_mutex_unlock(&ctx->lock);
+}
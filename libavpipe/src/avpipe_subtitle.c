@@ -0,0 +1,1213 @@
+/*
+ * avpipe_subtitle.c
+ *
+ * WebVTT and TTML parsing, wvtt and stpp samples (ISO/IEC 14496-30) written to the mp4 muxer, and DASH/HLS
+ * text segments and manifests.
+ */
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdarg.h>
+#include <ctype.h>
+#include <inttypes.h>
+
+#include "avpipe_subtitle.h"
+
+static void
+write32(
+    uint8_t *buf,
+    uint32_t v)
+{
+    buf[0] = v >> 24;
+    buf[1] = v >> 16;
+    buf[2] = v >> 8;
+    buf[3] = v;
+}
+
+static void
+buf_put(
+    sub_buf_t *b,
+    const void *data,
+    int size)
+{
+    if (b->len + size + 1 > b->cap) {
+        int cap = b->cap > 0 ? b->cap : 1024;
+        while (b->len + size + 1 > cap)
+            cap *= 2;
+        b->data = (uint8_t *) realloc(b->data, cap);
+        b->cap = cap;
+    }
+    if (size > 0)
+        memcpy(b->data + b->len, data, size);
+    b->len += size;
+}
+
+static void
+buf_u8(
+    sub_buf_t *b,
+    uint8_t v)
+{
+    buf_put(b, &v, 1);
+}
+
+static void
+buf_u32(
+    sub_buf_t *b,
+    uint32_t v)
+{
+    uint8_t d[4];
+    write32(d, v);
+    buf_put(b, d, 4);
+}
+
+/* Appends s, with its terminating null character if with_null is set */
+static void
+buf_text(
+    sub_buf_t *b,
+    const char *s,
+    int with_null)
+{
+    buf_put(b, s, strlen(s) + (with_null ? 1 : 0));
+}
+
+static void
+buf_printf(
+    sub_buf_t *b,
+    const char *fmt,
+    ...)
+{
+    char s[512];
+    va_list args;
+
+    va_start(args, fmt);
+    int n = vsnprintf(s, sizeof(s), fmt, args);
+    va_end(args);
+    if (n < (int) sizeof(s)) {
+        buf_put(b, s, n);
+        return;
+    }
+
+    char *l = (char *) malloc(n + 1);
+    va_start(args, fmt);
+    vsnprintf(l, n + 1, fmt, args);
+    va_end(args);
+    buf_put(b, l, n);
+    free(l);
+}
+
+/* Appends s escaped for XML attribute values and text */
+static void
+buf_xml(
+    sub_buf_t *b,
+    const char *s)
+{
+    for (; *s; s++) {
+        switch (*s) {
+        case '&':
+            buf_text(b, "&amp;", 0);
+            break;
+        case '<':
+            buf_text(b, "&lt;", 0);
+            break;
+        case '>':
+            buf_text(b, "&gt;", 0);
+            break;
+        case '"':
+            buf_text(b, "&quot;", 0);
+            break;
+        default:
+            buf_put(b, s, 1);
+        }
+    }
+}
+
+/* Appends s as a HLS quoted-string, that can't have double quotes or line terminators */
+static void
+buf_quoted(
+    sub_buf_t *b,
+    const char *s)
+{
+    buf_u8(b, '"');
+    for (; *s; s++)
+        buf_u8(b, *s == '"' ? '\'' : (*s == '\n' || *s == '\r') ? ' ' : *s);
+    buf_u8(b, '"');
+}
+
+/* Returns the data of a text buffer as a malloc'd string */
+static char *
+buf_string(
+    sub_buf_t *b)
+{
+    buf_put(b, "", 1);
+    return (char *) b->data;
+}
+
+void
+sub_buf_free(
+    sub_buf_t *b)
+{
+    free(b->data);
+    b->data = NULL;
+    b->len = 0;
+    b->cap = 0;
+}
+
+static int
+box_start(
+    sub_buf_t *b,
+    const char *type)
+{
+    int offset = b->len;
+
+    buf_u32(b, 0);
+    buf_put(b, type, 4);
+    return offset;
+}
+
+static void
+box_end(
+    sub_buf_t *b,
+    int offset)
+{
+    write32(b->data + offset, b->len - offset);
+}
+
+static char *
+strndup_text(
+    const char *s,
+    int len)
+{
+    char *d = (char *) malloc(len + 1);
+
+    memcpy(d, s, len);
+    d[len] = '\0';
+    return d;
+}
+
+static void
+format_time(
+    int64_t ms,
+    char *buf,
+    int size)
+{
+    if (ms < 0)
+        ms = 0;
+    snprintf(buf, size, "%02"PRId64":%02d:%02d.%03d",
+        ms / 3600000, (int) (ms / 60000 % 60), (int) (ms / 1000 % 60), (int) (ms % 1000));
+}
+
+static void
+add_cue(
+    sub_track_t *track,
+    int64_t start,
+    int64_t end,
+    char *id,
+    char *settings,
+    char *text)
+{
+    if (end <= start) {
+        free(id);
+        free(settings);
+        free(text);
+        return;
+    }
+
+    track->cues = (sub_cue_t *) realloc(track->cues, (track->n_cues + 1) * sizeof(sub_cue_t));
+
+    /* The cues are usually in order, insert from the end to keep the cues with the same start in order */
+    int i = track->n_cues;
+    while (i > 0 && track->cues[i-1].start > start) {
+        track->cues[i] = track->cues[i-1];
+        i--;
+    }
+    track->cues[i] = (sub_cue_t) {start, end, id, settings, text};
+    track->n_cues++;
+    if (end > track->duration)
+        track->duration = end;
+}
+
+/*
+ * Returns the next line of data after *pos and its length without the line terminator, or NULL at the
+ * end of data.
+ */
+static const char *
+next_line(
+    const char *data,
+    int size,
+    int *pos,
+    int *len)
+{
+    int start = *pos;
+    int i = start;
+
+    if (start >= size)
+        return NULL;
+    while (i < size && data[i] != '\n' && data[i] != '\r')
+        i++;
+    *len = i - start;
+    if (i < size && data[i] == '\r')
+        i++;
+    if (i < size && data[i] == '\n')
+        i++;
+    *pos = i;
+    return data + start;
+}
+
+/* Parses a WebVTT timestamp ([hh:]mm:ss.ttt), returns the number of characters parsed or -1 */
+static int
+parse_webvtt_time(
+    const char *s,
+    const char *end,
+    int64_t *ms)
+{
+    const char *p = s;
+    int64_t v[3];
+    int n = 0;
+    int frac = 0;
+
+    while (n < 3) {
+        if (p >= end || !isdigit((unsigned char) *p))
+            return -1;
+        v[n] = 0;
+        while (p < end && isdigit((unsigned char) *p))
+            v[n] = v[n] * 10 + (*p++ - '0');
+        n++;
+        if (p >= end || *p != ':')
+            break;
+        p++;
+    }
+    if (n < 2 || p >= end || *p != '.')
+        return -1;
+    p++;
+    for (int i = 0; i < 3; i++, p++) {
+        if (p >= end || !isdigit((unsigned char) *p))
+            return -1;
+        frac = frac * 10 + (*p - '0');
+    }
+
+    *ms = (((n == 3 ? v[0] : 0) * 60 + v[n-2]) * 60 + v[n-1]) * 1000 + frac;
+    return p - s;
+}
+
+/* Parses a WebVTT cue timings and settings line, returns 0 if successful */
+static int
+parse_webvtt_timing(
+    const char *line,
+    int len,
+    int64_t *start,
+    int64_t *end,
+    char **settings)
+{
+    const char *p = line;
+    const char *line_end = line + len;
+    int n;
+
+    if ((n = parse_webvtt_time(p, line_end, start)) < 0)
+        return -1;
+    p += n;
+    while (p < line_end && (*p == ' ' || *p == '\t'))
+        p++;
+    if (line_end - p < 3 || strncmp(p, "-->", 3))
+        return -1;
+    p += 3;
+    while (p < line_end && (*p == ' ' || *p == '\t'))
+        p++;
+    if ((n = parse_webvtt_time(p, line_end, end)) < 0)
+        return -1;
+    p += n;
+    while (p < line_end && (*p == ' ' || *p == '\t'))
+        p++;
+    *settings = p < line_end ? strndup_text(p, line_end - p) : NULL;
+    return 0;
+}
+
+static int
+has_arrow(
+    const char *line,
+    int len)
+{
+    for (int i = 0; i + 3 <= len; i++) {
+        if (!strncmp(line + i, "-->", 3))
+            return 1;
+    }
+    return 0;
+}
+
+/*
+ * Parses the blocks of a WebVTT document, separated by blank lines. The blocks before the first cue
+ * (the WEBVTT line, STYLE and REGION blocks) are the header, NOTE blocks and the WEBVTT lines of the
+ * next parts are skipped.
+ */
+static int
+parse_webvtt(
+    sub_track_t *track,
+    const char *data,
+    int size)
+{
+    sub_buf_t header = {0};
+    int pos = 0;
+
+    while (pos < size) {
+        const char *lines[3];
+        int lens[3];
+        int n_lines = 0;
+        int block_start;
+        int len;
+        const char *line;
+
+        /* Skip the blank lines */
+        while ((line = next_line(data, size, &pos, &len)) != NULL && len == 0)
+            ;
+        if (!line)
+            break;
+
+        block_start = line - data;
+        lines[n_lines] = line;
+        lens[n_lines++] = len;
+        while (n_lines < 3 && (line = next_line(data, size, &pos, &len)) != NULL && len > 0) {
+            lines[n_lines] = line;
+            lens[n_lines++] = len;
+        }
+
+        int timing = -1;
+        if (has_arrow(lines[0], lens[0]))
+            timing = 0;
+        else if (n_lines > 1 && has_arrow(lines[1], lens[1]))
+            timing = 1;
+
+        /* The end of the block: the end of its last line */
+        int block_end = pos;
+        if (n_lines == 3 || line != NULL) {
+            while (line && len > 0)
+                line = next_line(data, size, &pos, &len);
+            block_end = line ? line - data : pos;
+        }
+        while (block_end > block_start && (data[block_end-1] == '\n' || data[block_end-1] == '\r'))
+            block_end--;
+
+        if (timing < 0) {
+            if (track->n_cues == 0 &&
+                ((header.len == 0 && !strncmp(lines[0], "WEBVTT", 6)) ||
+                 (header.len > 0 && (!strncmp(lines[0], "STYLE", 5) || !strncmp(lines[0], "REGION", 6))))) {
+                if (header.len > 0)
+                    buf_text(&header, "\n\n", 0);
+                buf_put(&header, data + block_start, block_end - block_start);
+            }
+            continue;
+        }
+
+        int64_t start, end;
+        char *settings = NULL;
+        if (parse_webvtt_timing(lines[timing], lens[timing], &start, &end, &settings) < 0)
+            continue;
+
+        char *id = timing == 1 ? strndup_text(lines[0], lens[0]) : NULL;
+        const char *payload = lines[timing] + lens[timing];
+        while (payload < data + block_end && (*payload == '\r' || *payload == '\n'))
+            payload++;
+        int payload_len = data + block_end - payload;
+
+        /* Normalize the line terminators of the payload */
+        char *text = (char *) malloc(payload_len + 1);
+        int n = 0;
+        for (int i = 0; i < payload_len; i++) {
+            if (payload[i] == '\r') {
+                if (i + 1 < payload_len && payload[i+1] == '\n')
+                    continue;
+                text[n++] = '\n';
+            } else {
+                text[n++] = payload[i];
+            }
+        }
+        text[n] = '\0';
+        add_cue(track, start, end, id, settings, text);
+    }
+
+    track->format = sub_format_webvtt;
+    if (header.len == 0)
+        buf_text(&header, "WEBVTT", 0);
+
+    /*
+     * The header with '\n' line terminators and without the X-TIMESTAMP-MAP of a HLS segment, the cue
+     * times are already on the output timeline.
+     */
+    sub_buf_t normalized = {0};
+    int header_pos = 0;
+    const char *line;
+    int len;
+    while ((line = next_line((char *) header.data, header.len, &header_pos, &len)) != NULL) {
+        if (len >= 15 && !strncmp(line, "X-TIMESTAMP-MAP", 15))
+            continue;
+        if (normalized.len > 0)
+            buf_u8(&normalized, '\n');
+        buf_put(&normalized, line, len);
+    }
+    sub_buf_free(&header);
+    track->header = buf_string(&normalized);
+    return 0;
+}
+
+typedef struct xml_tag_t {
+    const char  *start;                 // '<'
+    const char  *end;                   // After '>'
+    const char  *name;
+    int         name_len;
+    const char  *local;                 // Name without the namespace prefix
+    int         local_len;
+    const char  *attrs;                 // After the name
+    int         closing;                // </name>
+    int         empty;                  // <name/>
+} xml_tag_t;
+
+static const char *
+find_text(
+    const char *p,
+    const char *end,
+    const char *s)
+{
+    int n = strlen(s);
+
+    for (; p + n <= end; p++) {
+        if (!memcmp(p, s, n))
+            return p;
+    }
+    return NULL;
+}
+
+/* Finds the next element tag after p, skipping the comments, CDATA sections and processing instructions */
+static int
+next_tag(
+    const char *p,
+    const char *end,
+    xml_tag_t *tag)
+{
+    while ((p = memchr(p, '<', end - p)) != NULL) {
+        const char *skip_end = NULL;
+        if (end - p >= 4 && !strncmp(p, "<!--", 4))
+            skip_end = "-->";
+        else if (end - p >= 9 && !strncmp(p, "<![CDATA[", 9))
+            skip_end = "]]>";
+        else if (end - p >= 2 && (p[1] == '?' || p[1] == '!'))
+            skip_end = ">";
+        if (skip_end) {
+            p = find_text(p + 1, end, skip_end);
+            if (!p)
+                return -1;
+            continue;
+        }
+
+        const char *gt = memchr(p, '>', end - p);
+        if (!gt)
+            return -1;
+        memset(tag, 0, sizeof(*tag));
+        tag->start = p;
+        tag->end = gt + 1;
+        tag->closing = p[1] == '/';
+        tag->empty = gt[-1] == '/';
+        tag->name = p + 1 + tag->closing;
+        const char *q = tag->name;
+        while (q < gt && !isspace((unsigned char) *q) && *q != '/')
+            q++;
+        tag->name_len = q - tag->name;
+        tag->attrs = q;
+        tag->local = tag->name;
+        for (const char *c = tag->name; c < q; c++) {
+            if (*c == ':')
+                tag->local = c + 1;
+        }
+        tag->local_len = q - tag->local;
+        return 0;
+    }
+    return -1;
+}
+
+static int
+is_tag(
+    const xml_tag_t *tag,
+    const char *local)
+{
+    return !tag->closing && tag->local_len == (int) strlen(local) && !strncmp(tag->local, local, tag->local_len);
+}
+
+/*
+ * Finds the next attribute after *p in the start tag, returns 0 if found. name is the local name of the
+ * attribute and [attr_start, attr_end) is the attribute text.
+ */
+static int
+next_attr(
+    const char **p,
+    const char *end,
+    const char **name,
+    int *name_len,
+    const char **value,
+    int *value_len,
+    const char **attr_start)
+{
+    const char *s = *p;
+
+    while (s < end && isspace((unsigned char) *s))
+        s++;
+    if (s >= end || *s == '/' || *s == '>')
+        return -1;
+    *attr_start = s;
+    const char *n = s;
+    while (s < end && *s != '=' && !isspace((unsigned char) *s) && *s != '>')
+        s++;
+    *name = n;
+    for (const char *c = n; c < s; c++) {
+        if (*c == ':')
+            *name = c + 1;
+    }
+    *name_len = s - *name;
+    while (s < end && isspace((unsigned char) *s))
+        s++;
+    if (s >= end || *s != '=')
+        return -1;
+    s++;
+    while (s < end && isspace((unsigned char) *s))
+        s++;
+    if (s >= end || (*s != '"' && *s != '\''))
+        return -1;
+    char quote = *s++;
+    *value = s;
+    while (s < end && *s != quote)
+        s++;
+    if (s >= end)
+        return -1;
+    *value_len = s - *value;
+    *p = s + 1;
+    return 0;
+}
+
+/* Copies the value of the attribute local name of the tag to buf, returns 0 if found */
+static int
+attr_value(
+    const xml_tag_t *tag,
+    const char *local,
+    char *buf,
+    int size)
+{
+    const char *p = tag->attrs;
+    const char *name, *value, *attr_start;
+    int name_len, value_len;
+
+    while (next_attr(&p, tag->end, &name, &name_len, &value, &value_len, &attr_start) == 0) {
+        if (name_len == (int) strlen(local) && !strncmp(name, local, name_len)) {
+            if (value_len >= size)
+                value_len = size - 1;
+            memcpy(buf, value, value_len);
+            buf[value_len] = '\0';
+            return 0;
+        }
+    }
+    return -1;
+}
+
+typedef struct ttml_timing_t {
+    double  frame_rate;                 // ttp:frameRate * ttp:frameRateMultiplier
+    double  tick_rate;                  // ttp:tickRate
+} ttml_timing_t;
+
+static void
+parse_ttml_timing(
+    const xml_tag_t *tt,
+    ttml_timing_t *timing)
+{
+    char v[64];
+    int has_frame_rate = 0;
+
+    timing->frame_rate = 30;
+    timing->tick_rate = 1;
+    if (attr_value(tt, "frameRate", v, sizeof(v)) == 0 && atof(v) > 0) {
+        timing->frame_rate = atof(v);
+        has_frame_rate = 1;
+    }
+    if (attr_value(tt, "frameRateMultiplier", v, sizeof(v)) == 0) {
+        int num, den;
+        if (sscanf(v, "%d %d", &num, &den) == 2 && num > 0 && den > 0)
+            timing->frame_rate = timing->frame_rate * num / den;
+    }
+    if (has_frame_rate)
+        timing->tick_rate = timing->frame_rate;
+    if (attr_value(tt, "tickRate", v, sizeof(v)) == 0 && atof(v) > 0)
+        timing->tick_rate = atof(v);
+}
+
+/*
+ * Parses a TTML time expression, a clock time (hh:mm:ss[.fraction] or hh:mm:ss:frames) or an offset
+ * time (<number>h|m|s|ms|f|t). Returns 0 if successful.
+ */
+static int
+parse_ttml_time(
+    const char *s,
+    const ttml_timing_t *timing,
+    int64_t *ms)
+{
+    double seconds;
+    char *end;
+
+    while (isspace((unsigned char) *s))
+        s++;
+
+    if (strchr(s, ':')) {
+        double v[4];
+        int n = 0;
+        const char *p = s;
+        while (n < 4) {
+            v[n++] = strtod(p, &end);
+            if (end == p)
+                return -1;
+            if (*end != ':')
+                break;
+            p = end + 1;
+        }
+        if (n < 3)
+            return -1;
+        seconds = v[0] * 3600 + v[1] * 60 + v[2];
+        if (n == 4)
+            seconds += v[3] / timing->frame_rate;
+    } else {
+        double v = strtod(s, &end);
+        if (end == s)
+            return -1;
+        if (!strncmp(end, "ms", 2))
+            seconds = v / 1000;
+        else if (*end == 'h')
+            seconds = v * 3600;
+        else if (*end == 'm')
+            seconds = v * 60;
+        else if (*end == 's')
+            seconds = v;
+        else if (*end == 'f')
+            seconds = v / timing->frame_rate;
+        else if (*end == 't')
+            seconds = v / timing->tick_rate;
+        else
+            return -1;
+    }
+
+    *ms = (int64_t) (seconds * 1000 + 0.5);
+    return 0;
+}
+
+/*
+ * Parses the p elements of the TTML documents. The header, body and footer of the segment documents are
+ * the ones of the first document, the div elements of the body are flattened to a single div.
+ * The timing of a p element is its begin and end or dur attributes, the timing of its parents is ignored.
+ */
+static int
+parse_ttml(
+    sub_track_t *track,
+    const char *data,
+    int size)
+{
+    const char *end = data + size;
+    const char *p = data;
+    const char *tt_start = NULL;
+    const char *body_start = NULL;
+    sub_buf_t body = {0};
+    ttml_timing_t timing;
+    xml_tag_t tag;
+    char prefix[64] = "";
+
+    while (next_tag(p, end, &tag) == 0) {
+        p = tag.end;
+
+        if (is_tag(&tag, "tt")) {
+            parse_ttml_timing(&tag, &timing);
+            if (!tt_start) {
+                tt_start = tag.start;
+                int prefix_len = tag.name_len - tag.local_len;
+                if (prefix_len < (int) sizeof(prefix)) {
+                    memcpy(prefix, tag.name, prefix_len);
+                    prefix[prefix_len] = '\0';
+                }
+            }
+            continue;
+        }
+        if (!tt_start)
+            continue;
+
+        if (is_tag(&tag, "body") && !body_start) {
+            body_start = tag.start;
+            buf_put(&body, tag.start, tag.end - tag.start);
+            if (tag.empty)
+                body.len--;
+            continue;
+        }
+        if (is_tag(&tag, "div") && body.len > 0 && track->n_cues == 0 && !tag.empty &&
+            !find_text((char *) body.data, (char *) body.data + body.len, "div")) {
+            buf_put(&body, tag.start, tag.end - tag.start);
+            continue;
+        }
+        if (!is_tag(&tag, "p") || tag.empty)
+            continue;
+
+        /* The content of the p element, up to its end tag */
+        char end_tag[80];
+        snprintf(end_tag, sizeof(end_tag), "</%.*s>", tag.name_len, tag.name);
+        const char *content_end = find_text(tag.end, end, end_tag);
+        if (!content_end)
+            break;
+        p = content_end + strlen(end_tag);
+
+        /* The name and attributes of the p element, without begin, end and dur */
+        sub_buf_t settings = {0};
+        int64_t begin = -1, cue_end = -1, dur = -1;
+        const char *a = tag.attrs;
+        const char *name, *value, *attr_start;
+        int name_len, value_len;
+        buf_put(&settings, tag.name, tag.name_len);
+        while (next_attr(&a, tag.end, &name, &name_len, &value, &value_len, &attr_start) == 0) {
+            char v[64];
+            int64_t *t = NULL;
+            if (name_len == 5 && !strncmp(name, "begin", 5))
+                t = &begin;
+            else if (name_len == 3 && !strncmp(name, "end", 3))
+                t = &cue_end;
+            else if (name_len == 3 && !strncmp(name, "dur", 3))
+                t = &dur;
+            if (!t) {
+                buf_u8(&settings, ' ');
+                buf_put(&settings, attr_start, a - attr_start);
+                continue;
+            }
+            snprintf(v, sizeof(v), "%.*s", value_len, value);
+            if (parse_ttml_time(v, &timing, t) < 0)
+                *t = -1;
+        }
+
+        if (begin < 0)
+            begin = 0;
+        if (cue_end < 0 && dur >= 0)
+            cue_end = begin + dur;
+        if (cue_end < 0) {
+            sub_buf_free(&settings);
+            continue;
+        }
+        add_cue(track, begin, cue_end, NULL, buf_string(&settings),
+            strndup_text(tag.end, content_end - tag.end));
+    }
+
+    if (!tt_start) {
+        sub_buf_free(&body);
+        return -1;
+    }
+
+    track->format = sub_format_ttml;
+    if (body_start) {
+        track->header = strndup_text(tt_start, body_start - tt_start);
+    } else {
+        /* The tt start tag only */
+        xml_tag_t tt;
+        next_tag(tt_start, end, &tt);
+        track->header = strndup_text(tt_start, tt.end - tt_start);
+        buf_printf(&body, "<%sbody>", prefix);
+    }
+    if (!find_text((char *) body.data, (char *) body.data + body.len, "div"))
+        buf_printf(&body, "<%sdiv>", prefix);
+    track->body = buf_string(&body);
+
+    sub_buf_t footer = {0};
+    buf_printf(&footer, "</%sdiv>\n</%sbody>\n</%stt>\n", prefix, prefix, prefix);
+    track->footer = buf_string(&footer);
+    return 0;
+}
+
+int
+sub_track_parse(
+    sub_track_t *track,
+    const char *data,
+    int size)
+{
+    int pos = 0;
+
+    /* UTF-8 BOM */
+    if (size >= 3 && !memcmp(data, "\xEF\xBB\xBF", 3))
+        pos = 3;
+    while (pos < size && isspace((unsigned char) data[pos]))
+        pos++;
+
+    if (size - pos >= 6 && !strncmp(data + pos, "WEBVTT", 6))
+        return parse_webvtt(track, data + pos, size - pos);
+    return parse_ttml(track, data + pos, size - pos);
+}
+
+void
+sub_track_free(
+    sub_track_t *track)
+{
+    for (int i = 0; i < track->n_cues; i++) {
+        free(track->cues[i].id);
+        free(track->cues[i].settings);
+        free(track->cues[i].text);
+    }
+    free(track->cues);
+    free(track->header);
+    free(track->body);
+    free(track->footer);
+    track->cues = NULL;
+    track->n_cues = 0;
+    track->header = NULL;
+    track->body = NULL;
+    track->footer = NULL;
+}
+
+int
+sub_segment_count(
+    int64_t seg_duration,
+    int64_t duration)
+{
+    if (seg_duration <= 0 || duration <= seg_duration)
+        return 1;
+    return (duration + seg_duration - 1) / seg_duration;
+}
+
+/*
+ * Returns the end of the sample that starts at start, end at most. A wvtt sample has the cues displayed
+ * during the sample, so the samples are split at the start and end of the cues. A stpp sample is a
+ * document with the cues of [start, end).
+ */
+static int64_t
+sample_end(
+    sub_track_t *track,
+    int64_t start,
+    int64_t end)
+{
+    if (track->format != sub_format_webvtt)
+        return end;
+
+    for (int i = 0; i < track->n_cues && track->cues[i].start < end; i++) {
+        if (track->cues[i].start > start)
+            end = track->cues[i].start;
+        else if (track->cues[i].end > start && track->cues[i].end < end)
+            end = track->cues[i].end;
+    }
+    return end;
+}
+
+static void
+ttml_document(
+    sub_buf_t *b,
+    sub_track_t *track,
+    int64_t start,
+    int64_t end)
+{
+    if (strncmp(track->header, "<?xml", 5))
+        buf_text(b, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n", 0);
+    buf_text(b, track->header, 0);
+    buf_text(b, track->body, 0);
+    buf_u8(b, '\n');
+
+    for (int i = 0; i < track->n_cues && track->cues[i].start < end; i++) {
+        sub_cue_t *cue = &track->cues[i];
+        char begin_str[32], end_str[32];
+        if (cue->end <= start)
+            continue;
+
+        const char *name_end = strchr(cue->settings, ' ');
+        int name_len = name_end ? name_end - cue->settings : (int) strlen(cue->settings);
+        format_time(cue->start > start ? cue->start : start, begin_str, sizeof(begin_str));
+        format_time(cue->end < end ? cue->end : end, end_str, sizeof(end_str));
+        buf_printf(b, "<%.*s begin=\"%s\" end=\"%s\"%s>", name_len, cue->settings, begin_str, end_str,
+            cue->settings + name_len);
+        buf_text(b, cue->text, 0);
+        buf_printf(b, "</%.*s>\n", name_len, cue->settings);
+    }
+
+    buf_text(b, track->footer, 0);
+}
+
+/*
+ * Writes the sample [start, end): a wvtt sample with a vttc box for each cue displayed during the sample
+ * (a vtte box if there is none), or a stpp sample with a TTML document.
+ */
+static void
+write_sample(
+    sub_buf_t *b,
+    sub_track_t *track,
+    int64_t start,
+    int64_t end)
+{
+    int n = 0;
+
+    if (track->format == sub_format_ttml) {
+        ttml_document(b, track, start, end);
+        return;
+    }
+
+    for (int i = 0; i < track->n_cues && track->cues[i].start < end; i++) {
+        sub_cue_t *cue = &track->cues[i];
+        if (cue->end <= start)
+            continue;
+
+        int vttc = box_start(b, "vttc");
+        if (cue->id) {
+            int iden = box_start(b, "iden");
+            buf_text(b, cue->id, 0);
+            box_end(b, iden);
+        }
+        if (cue->settings) {
+            int sttg = box_start(b, "sttg");
+            buf_text(b, cue->settings, 0);
+            box_end(b, sttg);
+        }
+        int payl = box_start(b, "payl");
+        buf_text(b, cue->text, 0);
+        box_end(b, payl);
+        box_end(b, vttc);
+        n++;
+    }
+
+    if (n == 0) {
+        int vtte = box_start(b, "vtte");
+        box_end(b, vtte);
+    }
+}
+
+AVStream *
+sub_new_stream(
+    AVFormatContext *format_ctx,
+    sub_track_t *track)
+{
+    AVStream *stream = avformat_new_stream(format_ctx, NULL);
+
+    if (!stream)
+        return NULL;
+
+    stream->time_base = (AVRational) {1, SUB_TIMESCALE};
+    stream->codecpar->codec_type = AVMEDIA_TYPE_SUBTITLE;
+    if (track->format == sub_format_ttml) {
+        stream->codecpar->codec_id = AV_CODEC_ID_TTML;
+        stream->codecpar->codec_tag = MKTAG('s','t','p','p');
+    } else {
+        /* The WebVTT header goes to the vttC box of the sample entry */
+        int len = strlen(track->header);
+        stream->codecpar->codec_id = AV_CODEC_ID_WEBVTT;
+        stream->codecpar->codec_tag = MKTAG('w','v','t','t');
+        stream->codecpar->extradata = (uint8_t *) av_mallocz(len + AV_INPUT_BUFFER_PADDING_SIZE);
+        if (!stream->codecpar->extradata)
+            return NULL;
+        memcpy(stream->codecpar->extradata, track->header, len);
+        stream->codecpar->extradata_size = len;
+    }
+
+    /* The mdhd box only has ISO-639-2 codes, the full language is in the manifests */
+    if (track->lang && strlen(track->lang) >= 3 && (track->lang[3] == '\0' || track->lang[3] == '-')) {
+        char code[4];
+        snprintf(code, sizeof(code), "%s", track->lang);
+        av_dict_set(&stream->metadata, "language", code, 0);
+    }
+    if (track->name)
+        av_dict_set(&stream->metadata, "title", track->name, 0);
+    if (track->role && !strcmp(track->role, "caption"))
+        stream->disposition |= AV_DISPOSITION_CAPTIONS;
+    else if (track->role && !strcmp(track->role, "forced-subtitle"))
+        stream->disposition |= AV_DISPOSITION_FORCED;
+
+    return stream;
+}
+
+int
+sub_write_samples(
+    AVFormatContext *format_ctx,
+    int stream_index,
+    sub_track_t *track,
+    int64_t *pos,
+    int64_t until,
+    int64_t limit)
+{
+    AVStream *stream = format_ctx->streams[stream_index];
+    int rc = 0;
+
+    while (*pos < until && *pos < limit) {
+        int64_t end = sample_end(track, *pos, limit);
+        sub_buf_t sample = {0};
+        AVPacket pkt;
+
+        write_sample(&sample, track, *pos, end);
+        av_init_packet(&pkt);
+        if ((rc = av_new_packet(&pkt, sample.len)) < 0) {
+            sub_buf_free(&sample);
+            return rc;
+        }
+        memcpy(pkt.data, sample.data, sample.len);
+        sub_buf_free(&sample);
+
+        pkt.stream_index = stream_index;
+        pkt.pts = av_rescale_q(*pos, (AVRational) {1, SUB_TIMESCALE}, stream->time_base);
+        pkt.dts = pkt.pts;
+        pkt.duration = av_rescale_q(end - *pos, (AVRational) {1, SUB_TIMESCALE}, stream->time_base);
+        pkt.flags |= AV_PKT_FLAG_KEY;
+        if ((rc = av_interleaved_write_frame(format_ctx, &pkt)) < 0)
+            return rc;
+        *pos = end;
+    }
+
+    return 0;
+}
+
+char *
+sub_webvtt_segment(
+    sub_track_t *track,
+    int64_t start,
+    int64_t end)
+{
+    sub_buf_t b = {0};
+    const char *header = track->header;
+    const char *nl = strchr(header, '\n');
+
+    /* The WEBVTT line, the timestamp map of the segment and the rest of the header */
+    buf_put(&b, header, nl ? nl - header : (int) strlen(header));
+    buf_text(&b, "\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n", 0);
+    if (nl)
+        buf_printf(&b, "%s\n", nl + 1);
+    buf_u8(&b, '\n');
+
+    for (int i = 0; i < track->n_cues && track->cues[i].start < end; i++) {
+        sub_cue_t *cue = &track->cues[i];
+        char start_str[32], end_str[32];
+        if (cue->end <= start)
+            continue;
+
+        format_time(cue->start, start_str, sizeof(start_str));
+        format_time(cue->end, end_str, sizeof(end_str));
+        if (cue->id)
+            buf_printf(&b, "%s\n", cue->id);
+        buf_printf(&b, "%s --> %s%s%s\n", start_str, end_str, cue->settings ? " " : "",
+            cue->settings ? cue->settings : "");
+        buf_text(&b, cue->text, 0);
+        buf_text(&b, "\n\n", 0);
+    }
+
+    return buf_string(&b);
+}
+
+static const char *
+track_name(
+    sub_track_t *track,
+    int index,
+    char *buf,
+    int size)
+{
+    if (track->name)
+        return track->name;
+    if (track->lang)
+        return track->lang;
+    snprintf(buf, size, "Subtitle %d", index + 1);
+    return buf;
+}
+
+char *
+sub_dash_manifest(
+    sub_track_t *tracks,
+    int n_tracks,
+    int64_t seg_duration,
+    int64_t duration)
+{
+    sub_buf_t b = {0};
+
+    buf_printf(&b,
+        "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"
+        "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\""
+        " type=\"static\" mediaPresentationDuration=\"PT%.3fS\" minBufferTime=\"PT2.0S\">\n"
+        "  <Period id=\"0\" start=\"PT0.0S\">\n", duration / 1000.0);
+
+    for (int i = 0; i < n_tracks; i++) {
+        sub_track_t *track = &tracks[i];
+
+        buf_printf(&b, "    <AdaptationSet id=\"%d\" contentType=\"text\" mimeType=\"application/mp4\""
+            " segmentAlignment=\"true\"", i + 1);
+        if (track->lang) {
+            buf_text(&b, " lang=\"", 0);
+            buf_xml(&b, track->lang);
+            buf_u8(&b, '"');
+        }
+        buf_text(&b, ">\n", 0);
+        if (track->role) {
+            buf_text(&b, "      <Role schemeIdUri=\"" SUB_ROLE_SCHEME "\" value=\"", 0);
+            buf_xml(&b, track->role);
+            buf_text(&b, "\"/>\n", 0);
+        }
+        if (track->name) {
+            buf_text(&b, "      <Label>", 0);
+            buf_xml(&b, track->name);
+            buf_text(&b, "</Label>\n", 0);
+        }
+        buf_printf(&b,
+            "      <SegmentTemplate timescale=\"%d\" duration=\"%"PRId64"\" startNumber=\"1\""
+            " initialization=\"subtitle%d-init.mp4\" media=\"subtitle%d-$Number%%05d$.m4s\"/>\n"
+            "      <Representation id=\"subtitle%d\" bandwidth=\"%d\" codecs=\"%s\"/>\n"
+            "    </AdaptationSet>\n",
+            SUB_TIMESCALE, seg_duration, i + 1, i + 1, i + 1, track->bandwidth > 0 ? track->bandwidth : 1,
+            track->format == sub_format_ttml ? "stpp" : "wvtt");
+    }
+
+    buf_text(&b, "  </Period>\n</MPD>\n", 0);
+    return buf_string(&b);
+}
+
+char *
+sub_hls_playlist(
+    sub_track_t *track,
+    int index,
+    int64_t seg_duration,
+    int64_t duration)
+{
+    sub_buf_t b = {0};
+    int n = sub_segment_count(seg_duration, duration);
+    int64_t target = duration < seg_duration ? duration : seg_duration;
+
+    buf_printf(&b,
+        "#EXTM3U\n"
+        "#EXT-X-VERSION:6\n"
+        "#EXT-X-TARGETDURATION:%d\n"
+        "#EXT-X-MEDIA-SEQUENCE:1\n"
+        "#EXT-X-PLAYLIST-TYPE:VOD\n", (int) ((target + 999) / 1000));
+    if (track->format == sub_format_ttml)
+        buf_printf(&b, "#EXT-X-MAP:URI=\"subtitle%d-init.mp4\"\n", index + 1);
+
+    for (int i = 0; i < n; i++) {
+        int64_t start = i * seg_duration;
+        int64_t end = i == n - 1 ? duration : start + seg_duration;
+        buf_printf(&b, "#EXTINF:%.3f,\nsubtitle%d-%05d.%s\n", (end - start) / 1000.0, index + 1, i + 1,
+            track->format == sub_format_ttml ? "m4s" : "vtt");
+    }
+
+    buf_text(&b, "#EXT-X-ENDLIST\n", 0);
+    return buf_string(&b);
+}
+
+char *
+sub_hls_master(
+    sub_track_t *tracks,
+    int n_tracks)
+{
+    sub_buf_t b = {0};
+
+    buf_text(&b, "#EXTM3U\n#EXT-X-VERSION:6\n", 0);
+    for (int i = 0; i < n_tracks; i++) {
+        sub_track_t *track = &tracks[i];
+        const char *role = track->role ? track->role : "";
+        char name[32];
+
+        buf_text(&b, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=", 0);
+        buf_quoted(&b, track_name(track, i, name, sizeof(name)));
+        if (track->lang) {
+            buf_text(&b, ",LANGUAGE=", 0);
+            buf_quoted(&b, track->lang);
+        }
+        buf_text(&b, ",DEFAULT=NO,AUTOSELECT=YES", 0);
+        if (!strcmp(role, "forced-subtitle"))
+            buf_text(&b, ",FORCED=YES", 0);
+        if (!strcmp(role, "caption"))
+            buf_text(&b, ",CHARACTERISTICS=\"public.accessibility.transcribes-spoken-dialog,"
+                "public.accessibility.describes-music-and-sound\"", 0);
+        else if (!strcmp(role, "easyreader"))
+            buf_text(&b, ",CHARACTERISTICS=\"public.easy-to-read\"", 0);
+        buf_printf(&b, ",URI=\"subtitle%d.m3u8\"\n", i + 1);
+    }
+
+    return buf_string(&b);
+}
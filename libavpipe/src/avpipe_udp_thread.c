@@ -1,13 +1,16 @@
 /*
  * avpipe_udp_thread.c
  *
- * Thread function to read UDP/MPEGTS datagrams and push them into udp channel.
+ * Thread functions to read UDP/MPEGTS and RTP/MPEGTS datagrams and push them into udp channel.
  *
  */
 #include <sys/types.h>
 #include <sys/socket.h>
+#include <sys/select.h>
+#include <unistd.h>
 
 #include "avpipe_xc.h"
+#include "avpipe_rtp.h"
 #include "elv_channel.h"
 #include "elv_sock.h"
 #include "elv_log.h"
@@ -17,6 +20,8 @@ typedef struct udp_thread_params_t {
     elv_channel_t   *udp_channel;   /* udp channel to keep incomming UDP packets */
     socklen_t       salen;
     ioctx_t         *inctx;
+    int             fec_fd[2];      /* RTP only: SMPTE 2022-1 column and row FEC sockets, -1 if not used */
+    int             pkt_num;        /* RTP only: # of packets pushed into udp channel */
 } udp_thread_params_t;
 
 /*
@@ -137,3 +142,197 @@ recv_again:
     return NULL;
 }
 
+
+/*
+ * Opens a nonblocking UDP socket bound to host:port to receive a live stream.
+ * Returns the socket fd, or -1 if there is an error.
+ */
+int
+udp_bind_socket(
+    const char *host,
+    const char *port,
+    const char *url,
+    socklen_t *salen)
+{
+    int                 rc;
+    int                 sockfd;
+    const int           on = 1;
+    struct sockaddr     *sa;
+    struct timeval      tv;
+    size_t              bufsz = UDP_PIPE_BUFSIZE;
+
+    sockfd = udp_socket(host, port, &sa, salen);
+    if (sockfd < 0) {
+        elv_err("Failed to open UDP socket port=%s, url=%s, error=%d", port, url, errno);
+        return -1;
+    }
+
+    setsockopt(sockfd, SOL_SOCKET, SO_REUSEADDR, &on, sizeof(on));
+    rc = bind(sockfd, sa, *salen);
+    free(sa);
+    if (rc < 0) {
+        elv_err("Failed to bind UDP socket, rc=%d, port=%s, url=%s, errno=%d", rc, port, url, errno);
+        close(sockfd);
+        return -1;
+    }
+
+    tv.tv_sec = UDP_PIPE_TIMEOUT;
+    tv.tv_usec = 0;
+    if ((rc = setsockopt(sockfd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv))) < 0) {
+        elv_err("Failed to set UDP socket timeout, rc=%d, url=%s, errno=%d", rc, url, errno);
+        close(sockfd);
+        return -1;
+    }
+
+    if (setsockopt(sockfd, SOL_SOCKET, SO_RCVBUF, (const void *)&bufsz, (socklen_t)sizeof(bufsz)) == -1) {
+        elv_warn("Failed to set UDP socket buf size to=%"PRId64", url=%s, errno=%d", bufsz, url, errno);
+    }
+
+    if (set_sock_nonblocking(sockfd) < 0) {
+        elv_err("Failed to make UDP socket nonblocking, url=%s, errno=%d", url, errno);
+        close(sockfd);
+        return -1;
+    }
+
+    return sockfd;
+}
+
+/*
+ * Output callback of the RTP jitter buffer, pushes the in order MPEGTS payload into udp channel.
+ */
+int
+rtp_channel_output(
+    void *opaque,
+    uint8_t *buf,
+    int len)
+{
+    udp_thread_params_t *params = (udp_thread_params_t *) opaque;
+    udp_packet_t *udp_packet;
+
+    if (len <= 0)
+        return 0;
+
+    udp_packet = (udp_packet_t *) calloc(1, sizeof(udp_packet_t));
+    udp_packet->len = len > MAX_UDP_PKT_LEN ? MAX_UDP_PKT_LEN : len;
+    memcpy(udp_packet->buf, buf, udp_packet->len);
+    udp_packet->pkt_num = ++params->pkt_num;
+    if (elv_channel_send(params->udp_channel, udp_packet) < 0) {
+        free(udp_packet);
+        return -1;
+    }
+    return 0;
+}
+
+void *
+rtp_thread_func(
+    void *thread_params)
+{
+    udp_thread_params_t *params = (udp_thread_params_t *) thread_params;
+    xcparams_t *xcparams = params->inctx->params;
+    rtp_ctx_t *rtp_ctx = params->inctx->rtp_ctx;
+    char *url = (xcparams != NULL) ? xcparams->url : "";
+    int fds[3] = { params->fd, params->fec_fd[0], params->fec_fd[1] };
+    uint8_t buf[MAX_UDP_PKT_LEN];
+    fd_set rset;
+    struct timeval tv;
+    int max_fd = -1;
+    int ret;
+    int first = 1;
+    int timedout = 0;
+    int connection_timeout = xcparams->connection_timeout;
+
+    for (int i=0; i<3; i++) {
+        if (fds[i] > max_fd)
+            max_fd = fds[i];
+    }
+
+    for ( ; ; ) {
+        if (params->inctx->closed)
+            break;
+
+        FD_ZERO(&rset);
+        for (int i=0; i<3; i++) {
+            if (fds[i] >= 0)
+                FD_SET(fds[i], &rset);
+        }
+        tv.tv_sec = 1;
+        tv.tv_usec = 0;
+
+        ret = select(max_fd+1, &rset, NULL, NULL, &tv);
+        if (ret == -1) {
+            if (errno == EINTR) {
+                elv_dbg("Got EINTR select");
+                continue;
+            }
+            elv_err("RTP select error fd=%d, err=%d, url=%s", params->fd, errno, url);
+            break;
+        } else if (ret == 0) {
+            /* If no packet has not received yet, check connection_timeout */
+            if (first) {
+                if (connection_timeout > 0) {
+                    connection_timeout--;
+                    if (connection_timeout == 0) {
+                        elv_channel_close(params->udp_channel, 1);
+                        break;
+                    }
+                }
+                continue;
+            }
+
+            /* Nothing else is going to arrive in time, release what is left in the jitter buffer */
+            rtp_flush(rtp_ctx);
+            elv_log("RTP recv fd=%d, url=%s, timeout=%dsec, pkt_num=%d", params->fd, url, timedout+1, params->pkt_num);
+            if (timedout++ == UDP_PIPE_TIMEOUT) {
+                elv_err("RTP recv timeout fd=%d, url=%s, pkt_num=%d", params->fd, url, params->pkt_num);
+                break;
+            }
+            continue;
+        }
+
+        for (int i=0; i<3; i++) {
+            if (fds[i] < 0 || !FD_ISSET(fds[i], &rset))
+                continue;
+
+            /* Drain the socket */
+            for ( ; ; ) {
+                if (params->inctx->closed)
+                    goto done;
+
+                int len = recv(fds[i], buf, sizeof(buf), 0);
+                if (len < 0) {
+                    if (errno == EINTR)
+                        continue;
+                    if (errno == EAGAIN || errno == EWOULDBLOCK)
+                        break;
+                    elv_err("RTP recv fd=%d, errno=%d, url=%s", fds[i], errno, url);
+                    goto done;
+                }
+                if (len == 0)
+                    continue;
+
+                if (i == 0) {
+                    if (first) {
+                        first = 0;
+                        elv_log("RTP FIRST url=%s", url);
+                    }
+                    rtp_push_media(rtp_ctx, buf, len);
+                } else {
+                    rtp_push_fec(rtp_ctx, buf, len);
+                }
+
+                /* If the channel is closed, exit the thread */
+                if (elv_channel_is_closed(params->udp_channel))
+                    goto done;
+            }
+        }
+        timedout = 0;
+    }
+
+done:
+    for (int i=0; i<2; i++) {
+        if (params->fec_fd[i] >= 0)
+            close(params->fec_fd[i]);
+    }
+    elv_log("RTP thread terminated, url=%s", url);
+    return NULL;
+}
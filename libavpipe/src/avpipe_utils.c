@@ -13,6 +13,9 @@
 #include "elv_log.h"
 
 #include <sys/time.h>
+#include <stdlib.h>
+#include <unistd.h>
+#include <errno.h>
 
 const char *stream_type_str(
     coderctx_t *c,
@@ -332,3 +335,30 @@ hex_encode(byte *buf, int sz, char *str)
         sprintf(str + 2 * i, "%02x", buf[i]);
     }
 }
+
+int
+make_temp_file(
+    char *path,
+    int size,
+    const char *prefix)
+{
+    const char *dir = getenv("TMPDIR");
+    int fd;
+
+    if (!dir || dir[0] == '\0')
+        dir = "/tmp";
+
+    if (snprintf(path, size, "%s/%sXXXXXX", dir, prefix) >= size) {
+        elv_err("Temporary file path is too long, dir=%s", dir);
+        path[0] = '\0';
+        return -1;
+    }
+
+    if ((fd = mkstemp(path)) < 0) {
+        elv_err("Failed to create temporary file %s, errno=%d", path, errno);
+        path[0] = '\0';
+        return -1;
+    }
+    close(fd);
+    return 0;
+}
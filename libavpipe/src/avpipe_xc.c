@@ -13,6 +13,11 @@
 #include <libswscale/swscale.h>
 #include <libavutil/imgutils.h>
 #include <libavutil/display.h>
+#include <libavutil/crc.h>
+#include <libavutil/intreadwrite.h>
+#include <libavutil/pixdesc.h>
+#include <libavutil/parseutils.h>
+#include <libavutil/avstring.h>
 
 #include "avpipe_xc.h"
 #include "avpipe_utils.h"
@@ -46,6 +51,10 @@
 #define DEFAULT_FRAME_INTERVAL_S    10
 
 #define DEFAULT_ACC_SAMPLE_RATE     48000
+#define DEFAULT_OPUS_SAMPLE_RATE    48000
+#define DEFAULT_AUDIO_SAMPLE_RATE   48000       /* Sample rate of a rendition if the encoder doesn't support the input one */
+#define SCTE35_MIN_SECTION_SIZE     20          /* splice_info_section with an empty command and no descriptors */
+#define CADENCE_PROBE_FRAMES        300         /* Number of frames decoded by avpipe_probe() to find the cadence */
 
 extern int
 init_video_filters(
@@ -64,13 +73,15 @@ int
 init_audio_pan_filters(
     const char *filters_descr,
     coderctx_t *decoder_context,
-    coderctx_t *encoder_context);
+    coderctx_t *encoder_context,
+    xcparams_t *params);
 
 int
 init_audio_merge_pan_filters(
     const char *filters_descr,
     coderctx_t *decoder_context,
-    coderctx_t *encoder_context);
+    coderctx_t *encoder_context,
+    xcparams_t *params);
 
 extern int
 init_audio_join_filters(
@@ -78,6 +89,34 @@ init_audio_join_filters(
     coderctx_t *encoder_context,
     xcparams_t *params);
 
+extern int
+init_audio_rendition_filters(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params);
+
+extern void
+color_target_tags(
+    color_target_t color_target,
+    enum AVColorPrimaries *primaries,
+    enum AVColorTransferCharacteristic *trc,
+    enum AVColorSpace *colorspace);
+
+extern int
+init_video_probe_filters(
+    coderctx_t *decoder_context);
+
+extern int
+init_compare_filters(
+    AVFilterGraph **filter_graph,
+    AVFilterContext **buffersrc_ctx,
+    AVFilterContext **buffersink_ctx,
+    coderctx_t *ref_decoder_context,
+    coderctx_t *dist_decoder_context,
+    int width,
+    int height,
+    const char *vmaf_args);
+
 extern const char *
 av_get_pix_fmt_name(
     enum AVPixelFormat pix_fmt);
@@ -90,6 +129,25 @@ const char*
 avpipe_channel_layout_name(
     int channel_layout);
 
+static int
+smart_cut_video(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    xcparams_t *params,
+    int do_instrument,
+    int debug_frame_level);
+
+static int
+rc_first_pass(
+    xctx_t *xctx);
+
+static void
+rc_stats_remove(
+    const char *stats);
+
 //#define USE_RESAMPLE_AAC
 /* This will be removed after more testing with new audio transcoding using filters */
 #ifdef USE_RESAMPLE_AAC
@@ -274,11 +332,13 @@ prepare_input(
     AVIOContext *avioctx;
     int bufin_sz = AVIO_IN_BUF_SIZE;
 
-    /* For the live sources we don't use a custom input don't create input callbacks (RTMP, SRT, RTP) */
+    /*
+     * For the live sources we don't use a custom input don't create input callbacks (RTMP, SRT).
+     * RTP is de-encapsulated by avpipe (jitter buffer and FEC) and is read like UDP.
+     */
     switch (decoder_context->live_proto) {
         case avp_proto_rtmp:
         case avp_proto_srt:
-        case avp_proto_rtp:
             return 0;
         default:
             // Proceed
@@ -332,6 +392,10 @@ check_stream_index(
         return eav_param;
     if (selected_audio_index(params, decoder_context->data_scte35_stream_index) >= 0)
         return eav_param;
+    if (selected_audio_index(params, decoder_context->data_id3_stream_index) >= 0)
+        return eav_param;
+    if (selected_audio_index(params, decoder_context->data_klv_stream_index) >= 0)
+        return eav_param;
     if (selected_audio_index(params, decoder_context->data_stream_index) >= 0)
         return eav_param;
 
@@ -347,8 +411,6 @@ check_input_stream(
     xcparams_t *params,
     coderctx_t *decoder_context) {
 
-    int rc;
-
     if (!decoder_context->format_context->iformat ||
         !decoder_context->format_context->iformat->name) {
         elv_err("Failed to open input stream properly - no format name");
@@ -358,6 +420,7 @@ check_input_stream(
     switch(decoder_context->live_proto) {
         case avp_proto_mpegts:
         case avp_proto_srt:
+        case avp_proto_rtp:
             if (strcmp(decoder_context->format_context->iformat->name, "mpegts")) {
                 elv_err("Unsupported live source: proto=%d container=%s",
                     decoder_context->live_proto, decoder_context->format_context->iformat->name);
@@ -371,23 +434,6 @@ check_input_stream(
                 return eav_open_codec;
             }
             break;
-        case avp_proto_rtp:
-            if (decoder_context->format_context->priv_data) {
-                int64_t payload_type;
-                rc = av_opt_get_int(decoder_context->format_context->priv_data, "payload_type", 0, &payload_type);
-                if (rc == 0) {
-                    const int rtp_payload_type_mpegts = 33;
-                    if (payload_type != rtp_payload_type_mpegts) {
-                        elv_err("Unsupported RTP container %d", payload_type);
-                        return eav_open_codec;
-                    }
-                } else {
-                    // In the current version of libavformat the "payload_type" is not set by the decoder - log and proceed.
-                    // However if the payload_type is not MPEGTS the decoder errors out early (so we don't get here).
-                    elv_log("Unable to retrieve RTP payload type rc=%d", rc);
-                }
-            }
-            break;
         default:
             // Nothing to check
             break;
@@ -413,6 +459,8 @@ prepare_decoder(
     decoder_context->inctx = inctx;
     decoder_context->video_stream_index = -1;
     decoder_context->data_scte35_stream_index = -1;
+    decoder_context->data_id3_stream_index = -1;
+    decoder_context->data_klv_stream_index = -1;
     decoder_context->data_stream_index = -1;
     for (int j=0; j<MAX_STREAMS; j++) {
         decoder_context->audio_stream_index[j] = -1;
@@ -451,11 +499,6 @@ prepare_decoder(
             sprintf(timeout, "%"PRId64, connection_timeout_micros);
             av_dict_set(&opts, "listen_timeout", timeout, 0);
             break;
-        case avp_proto_rtp:
-            // RTP timeout is in microseconds
-            sprintf(timeout, "%"PRId64, connection_timeout_micros);
-            av_dict_set(&opts, "timeout", timeout, 0);
-            break;
         default:
             // No special timeout options
             break;
@@ -558,6 +601,22 @@ prepare_decoder(
                 if (check_stream_index(params, decoder_context) != eav_success)
                     return eav_param;
                 break;
+            case AV_CODEC_ID_TIMED_ID3:
+                decoder_context->data_id3_stream_index = i;
+                elv_dbg("DATA STREAM TIMED ID3 %d, codec_id=%s, stream_id=%d, url=%s",
+                    i, avcodec_get_name(decoder_context->codec_parameters[i]->codec_id),
+                    decoder_context->stream[i]->id, url);
+                if (check_stream_index(params, decoder_context) != eav_success)
+                    return eav_param;
+                break;
+            case AV_CODEC_ID_SMPTE_KLV:
+                decoder_context->data_klv_stream_index = i;
+                elv_dbg("DATA STREAM KLV %d, codec_id=%s, stream_id=%d, url=%s",
+                    i, avcodec_get_name(decoder_context->codec_parameters[i]->codec_id),
+                    decoder_context->stream[i]->id, url);
+                if (check_stream_index(params, decoder_context) != eav_success)
+                    return eav_param;
+                break;
             default:
                 // Unrecognized data stream
                 decoder_context->data_stream_index = i;
@@ -775,13 +834,21 @@ set_encoder_options(
         return eav_timebase;
     }
 
+    /* The mov muxer writes the colr box of the video only with write_colr */
+    const char *video_movflags = params->color_target != color_target_none ?
+        "frag_every_frame+write_colr" : "frag_every_frame";
+
     if (!strcmp(params->format, "fmp4")) {
         if (stream_index == decoder_context->video_stream_index)
-            av_opt_set(encoder_context->format_context->priv_data, "movflags", "frag_every_frame", 0);
+            av_opt_set(encoder_context->format_context->priv_data, "movflags", video_movflags, 0);
         if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0)
             av_opt_set(encoder_context->format_context2[i]->priv_data, "movflags", "frag_every_frame", 0);
     }
 
+    if (!strcmp(params->format, "mp4") && params->color_target != color_target_none &&
+        stream_index == decoder_context->video_stream_index)
+        av_opt_set(encoder_context->format_context->priv_data, "movflags", "write_colr", 0);
+
     // Segment duration (in ts) - notice it is set on the format context not codec
     if (params->audio_seg_duration_ts > 0 && (!strcmp(params->format, "dash") || !strcmp(params->format, "hls"))) {
         if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0)
@@ -795,6 +862,23 @@ set_encoder_options(
                 AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
     }
 
+    /* The DASH segments of VP9 and Opus are WebM, the other ones (AV1 included) are CMAF fMP4 */
+    if (!strcmp(params->format, "dash")) {
+        AVFormatContext *format_context = NULL;
+
+        if (stream_index == decoder_context->video_stream_index &&
+            params->ecodec && !strcmp(params->ecodec, "libvpx-vp9"))
+            format_context = encoder_context->format_context;
+        else if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0 &&
+            params->ecodec2 && !strcmp(params->ecodec2, "libopus"))
+            format_context = encoder_context->format_context2[i];
+
+        if (format_context && av_opt_set(format_context->priv_data, "dash_segment_type", "webm", 0) < 0) {
+            elv_err("Failed to set WebM DASH segments, stream_index=%d, url=%s", stream_index, params->url);
+            return eav_param;
+        }
+    }
+
     if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0) {
         if (!(params->xc_type & xc_audio)) {
             elv_err("Failed to set audio encoder options, stream_index=%d, xc_type=%d, url=%s",
@@ -855,14 +939,99 @@ set_encoder_options(
         if (!strcmp(params->format, "fmp4-segment")) {
             if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0)
                 av_opt_set(encoder_context->format_context2[i]->priv_data, "segment_format_options", "movflags=frag_every_frame", 0);
-            if (stream_index == decoder_context->video_stream_index)
-                av_opt_set(encoder_context->format_context->priv_data, "segment_format_options", "movflags=frag_every_frame", 0);
+            if (stream_index == decoder_context->video_stream_index) {
+                char format_options[64];
+                snprintf(format_options, sizeof(format_options), "movflags=%s", video_movflags);
+                av_opt_set(encoder_context->format_context->priv_data, "segment_format_options", format_options, 0);
+            }
         }
     }
 
     return 0;
 }
 
+/*
+ * Reads an unsigned Exp-Golomb code, returns -1 if it doesn't fit in the buffer.
+ */
+static int
+read_ue_golomb(
+    const uint8_t *buf,
+    int size)
+{
+    int nbits = size * 8;
+    int bit = 0;
+    int zeros = 0;
+    int value = 0;
+
+    while (bit < nbits && !((buf[bit >> 3] >> (7 - (bit & 7))) & 1)) {
+        zeros++;
+        bit++;
+    }
+    if (zeros > 30 || bit + 1 + zeros > nbits)
+        return -1;
+
+    bit++;
+    for (int i=0; i<zeros; i++, bit++)
+        value = (value << 1) | ((buf[bit >> 3] >> (7 - (bit & 7))) & 1);
+
+    return (1 << zeros) - 1 + value;
+}
+
+/*
+ * Returns 1 if the annexb h264 data has an SPS NAL unit.
+ */
+static int
+h264_has_sps(
+    const uint8_t *data,
+    int size)
+{
+    for (int i=0; i+3<size; i++) {
+        if (data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 && (data[i+3] & 0x1f) == 7)
+            return 1;
+    }
+    return 0;
+}
+
+/*
+ * Returns the id of the first SPS in the h264 extradata (avcC or annexb), or 0 if there is no SPS.
+ */
+static int
+h264_sps_id(
+    const uint8_t *extradata,
+    int size)
+{
+    const uint8_t *sps = NULL;
+    int sps_size = 0;
+    int id;
+
+    if (!extradata)
+        return 0;
+
+    if (size >= 8 && extradata[0] == 1) {
+        /* avcC: 5 bytes of header, the number of SPS, then the size and the SPS NAL unit */
+        if ((extradata[5] & 0x1f) > 0) {
+            sps_size = AV_RB16(extradata + 6);
+            sps = extradata + 8;
+            if (sps_size > size - 8)
+                return 0;
+        }
+    } else {
+        for (int i=0; i+3<size; i++) {
+            if (extradata[i] == 0 && extradata[i+1] == 0 && extradata[i+2] == 1 && (extradata[i+3] & 0x1f) == 7) {
+                sps = extradata + i + 3;
+                sps_size = size - i - 3;
+                break;
+            }
+        }
+    }
+
+    /* seq_parameter_set_id follows the NAL header, profile_idc, the constraint flags and level_idc */
+    if (!sps || sps_size < 5)
+        return 0;
+    id = read_ue_golomb(sps + 4, sps_size - 4);
+    return id >= 0 && id < 32 ? id : 0;
+}
+
 /*
  * Set H264 specific params profile, and level based on encoding height.
  */
@@ -879,6 +1048,10 @@ set_h264_params(
     if (avpipe_h264_profile(params->profile) > 0) {
         /* If there is a valid parameter for profile use it */
         encoder_codec_context->profile = avpipe_h264_profile(params->profile);
+    } else if (params->smart_cut && decoder_context->codec_context[index]->profile > 0) {
+        /* Smart cut re-encodes like the input (libx264 takes the profile without the constraint flags) */
+        encoder_codec_context->profile = decoder_context->codec_context[index]->profile &
+            ~(FF_PROFILE_H264_CONSTRAINED | FF_PROFILE_H264_INTRA);
     } else {
         /* Codec level and profile must be set correctly per H264 spec */
         encoder_codec_context->profile = avpipe_h264_guess_profile(params->bitdepth,
@@ -890,6 +1063,8 @@ set_h264_params(
 
     if (params->level > 0) {
         encoder_codec_context->level = params->level;
+    } else if (params->smart_cut && decoder_context->codec_context[index]->level > 0) {
+        encoder_codec_context->level = decoder_context->codec_context[index]->level;
     } else {
         encoder_codec_context->level = avpipe_h264_guess_level(
                                                 encoder_codec_context->profile,
@@ -900,6 +1075,23 @@ set_h264_params(
     }
 }
 
+/*
+ * Returns the x265-params of the color space of a 10 or 12 bit output, HDR10 unless params->color_target is set.
+ */
+static const char *
+x265_color_params(
+    xcparams_t *params)
+{
+    switch (params->color_target) {
+    case color_target_sdr:
+        return "repeat-headers=1:colorprim=bt709:transfer=bt709:colormatrix=bt709";
+    case color_target_hlg:
+        return "repeat-headers=1:colorprim=bt2020:transfer=arib-std-b67:colormatrix=bt2020nc";
+    default:
+        return "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc";
+    }
+}
+
 static void
 set_h265_params(
     coderctx_t *encoder_context,
@@ -919,26 +1111,23 @@ set_h265_params(
         /* Can be only main or main10 profiles */
         av_opt_set(encoder_codec_context->priv_data, "profile", params->profile, 0);
         if (params->bitdepth == 10) {
-            av_opt_set(encoder_codec_context->priv_data, "x265-params",
-                "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc", 0);
+            av_opt_set(encoder_codec_context->priv_data, "x265-params", x265_color_params(params), 0);
         }
     } else if (params->bitdepth == 8) {
         av_opt_set(encoder_codec_context->priv_data, "profile", "main", 0);
     } else if (params->bitdepth == 10) {
         av_opt_set(encoder_codec_context->priv_data, "profile", "main10", 0);
-        av_opt_set(encoder_codec_context->priv_data, "x265-params",
-            "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc", 0);
+        av_opt_set(encoder_codec_context->priv_data, "x265-params", x265_color_params(params), 0);
     } else {
         /* bitdepth == 12 */
         av_opt_set(encoder_codec_context->priv_data, "profile", "main12", 0);
-        av_opt_set(encoder_codec_context->priv_data, "x265-params",
-            "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc", 0);
+        av_opt_set(encoder_codec_context->priv_data, "x265-params", x265_color_params(params), 0);
     }
 
-    /* Set max_cll and master_display meta data for HDR content */
-    if (params->max_cll && params->max_cll[0] != '\0')
+    /* Set max_cll and master_display meta data for HDR content, an SDR output has none */
+    if (params->max_cll && params->max_cll[0] != '\0' && params->color_target != color_target_sdr)
         av_opt_set(encoder_codec_context->priv_data, "max-cll", params->max_cll, 0);
-    if (params->master_display && params->master_display[0] != '\0')
+    if (params->master_display && params->master_display[0] != '\0' && params->color_target != color_target_sdr)
         av_opt_set(encoder_codec_context->priv_data, "master-display", params->master_display, 0);
 
     /* Set the number of bframes to 0 and avoid having bframes */
@@ -952,6 +1141,106 @@ set_h265_params(
      */
 }
 
+/*
+ * Speed settings of the AV1 and VP9 encoders for the x264 preset names of params->preset.
+ */
+typedef struct speed_preset_t {
+    const char  *preset;
+    int         av1_speed;          /* libsvtav1 preset and libaom-av1 cpu-used, 0 is the slowest */
+    const char  *vp9_deadline;      /* libvpx-vp9 deadline */
+    int         vp9_cpu_used;       /* libvpx-vp9 cpu-used, 0 is the slowest */
+} speed_preset_t;
+
+static const speed_preset_t speed_presets[] = {
+    {"ultrafast",   8,  "realtime", 8},
+    {"superfast",   8,  "realtime", 7},
+    {"veryfast",    7,  "good",     5},
+    {"faster",      6,  "good",     4},
+    {"fast",        5,  "good",     3},
+    {"medium",      4,  "good",     2},
+    {"slow",        3,  "good",     1},
+    {"slower",      2,  "good",     0},
+    {"veryslow",    1,  "best",     0},
+};
+
+/*
+ * Returns the speed settings of params->preset, "medium" if it is not set or unknown.
+ */
+static const speed_preset_t *
+find_speed_preset(
+    xcparams_t *params)
+{
+    for (int i=0; i<sizeof(speed_presets)/sizeof(speed_presets[0]); i++) {
+        if (params->preset && !strcmp(params->preset, speed_presets[i].preset))
+            return &speed_presets[i];
+    }
+    return &speed_presets[5];
+}
+
+/*
+ * Returns the CRF of params->crf_str, in the x264/x265 scale (0-51), mapped to the AV1/VP9 scale (0-63), or -1 if
+ * crf_str is not set. The default CRF 23 of x264 is 28.
+ */
+static int
+av1_vp9_crf(
+    xcparams_t *params)
+{
+    if (!params->crf_str || params->crf_str[0] == '\0')
+        return -1;
+    return (int) lrint(atoi(params->crf_str) * 63.0 / 51.0);
+}
+
+static void
+set_av1_params(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int index = decoder_context->video_stream_index;
+    AVCodecContext *encoder_codec_context = encoder_context->codec_context[index];
+    const speed_preset_t *speed = find_speed_preset(params);
+    int crf = av1_vp9_crf(params);
+
+    if (!strcmp(params->ecodec, "libsvtav1")) {
+        av_opt_set_int(encoder_codec_context->priv_data, "preset", speed->av1_speed, 0);
+        /* Older libsvtav1 wrappers only have a constant QP, newer ones a CRF */
+        if (crf >= 0 && params->video_bitrate <= 0 &&
+            av_opt_set_int(encoder_codec_context->priv_data, "crf", crf, 0) < 0) {
+            av_opt_set(encoder_codec_context->priv_data, "rc", "cqp", 0);
+            av_opt_set_int(encoder_codec_context->priv_data, "qp", crf, 0);
+        }
+    } else {
+        av_opt_set_int(encoder_codec_context->priv_data, "cpu-used", speed->av1_speed, 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "row-mt", 1, 0);
+        /* Without a bitrate the CRF is a constant quality, with a bitrate it is a constrained quality */
+        if (crf >= 0)
+            av_opt_set_int(encoder_codec_context->priv_data, "crf", crf, 0);
+    }
+}
+
+static void
+set_vp9_params(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int index = decoder_context->video_stream_index;
+    AVCodecContext *encoder_codec_context = encoder_context->codec_context[index];
+    const speed_preset_t *speed = find_speed_preset(params);
+    int crf = av1_vp9_crf(params);
+
+    av_opt_set(encoder_codec_context->priv_data, "deadline", speed->vp9_deadline, 0);
+    av_opt_set_int(encoder_codec_context->priv_data, "cpu-used", speed->vp9_cpu_used, 0);
+    av_opt_set_int(encoder_codec_context->priv_data, "row-mt", 1, 0);
+
+    /* Without a bitrate the CRF is a constant quality, with a bitrate it is a constrained quality */
+    if (crf >= 0)
+        av_opt_set_int(encoder_codec_context->priv_data, "crf", crf, 0);
+
+    /* The VP9 profile follows the bit depth: profile 0 is 8 bit and profile 2 is 10 or 12 bit (4:2:0) */
+    encoder_codec_context->profile = params->bitdepth > 8 ? FF_PROFILE_VP9_2 : FF_PROFILE_VP9_0;
+}
+
 static void
 set_netint_h264_params(
     coderctx_t *encoder_context,
@@ -1127,14 +1416,15 @@ set_pixel_fmt(
         encoder_codec_context->pix_fmt = AV_PIX_FMT_YUV420P10LE;
         break;
     case 12:
-        if (!strcmp(params->ecodec, "libx265")) {
+        if (!strcmp(params->ecodec, "libx265") || !strcmp(params->ecodec, "libaom-av1") ||
+            !strcmp(params->ecodec, "libvpx-vp9")) {
             /* AV_PIX_FMT_YUV422P12LE: 24bpp, (1 Cr & Cb sample per 2x1 Y samples), little-endian */
             //encoder_codec_context->pix_fmt = AV_PIX_FMT_YUV422P12LE;
             encoder_codec_context->pix_fmt = AV_PIX_FMT_YUV420P12LE;
             break;
         }
 
-        /* x264 doesn't support 12 bitdepth pixel format */
+        /* x264 and libsvtav1 don't support 12 bitdepth pixel format */
     default:
         elv_err("Invalid bitdepth=%d, url=%s", params->bitdepth, params->url);
         return eav_param;
@@ -1143,6 +1433,111 @@ set_pixel_fmt(
     return 0;
 }
 
+/*
+ * Appends the ':' separated key=value pairs of value to the x264-params or x265-params of the encoder.
+ */
+static void
+append_codec_params(
+    AVCodecContext *codec_context,
+    const char *name,
+    const char *value)
+{
+    uint8_t *current = NULL;
+    char *codec_params;
+
+    if (av_opt_get(codec_context->priv_data, name, 0, &current) < 0 || !current || current[0] == '\0') {
+        av_opt_set(codec_context->priv_data, name, value, 0);
+        av_free(current);
+        return;
+    }
+
+    codec_params = av_asprintf("%s:%s", current, value);
+    av_opt_set(codec_context->priv_data, name, codec_params, 0);
+    av_free(codec_params);
+    av_free(current);
+}
+
+/*
+ * Sets the rate control of params->rc_mode, after the codec specific params. The bit_rate, rc_max_rate and
+ * rc_buffer_size of the encoder are set from params (check_params() validated them for the mode), the peak
+ * rate of a CBR is its bitrate and the VBV buffer of a capped rate is 1 sec of the peak rate if not set.
+ */
+static void
+set_rc_mode(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int index = decoder_context->video_stream_index;
+    AVCodecContext *encoder_codec_context = encoder_context->codec_context[index];
+    const char *codec_params = !strcmp(params->ecodec, "libx265") ? "x265-params" : "x264-params";
+    char pass_params[RC_STATS_PATH_SZ + 32];
+
+    switch (params->rc_mode) {
+    case rc_mode_crf_capped:
+        /* The 'crf' option is set, the VBV of rc_max_rate/rc_buffer_size caps the bitrate of the CRF */
+        break;
+    case rc_mode_two_pass:
+        if (encoder_context->rc_pass == 0)
+            break;
+        /*
+         * The pass is only set in the x264/x265 params: the libx265 wrapper ignores AV_CODEC_FLAG_PASS1/2,
+         * and the flags would configure the libx264 stats a second time.
+         */
+        snprintf(pass_params, sizeof(pass_params), "pass=%d:stats=%s",
+            encoder_context->rc_pass, encoder_context->rc_stats);
+        append_codec_params(encoder_codec_context, codec_params, pass_params);
+        break;
+    case rc_mode_cbr:
+        if (params->rc_max_rate > 0 && params->rc_max_rate != params->video_bitrate)
+            elv_log("Replacing rc_max_rate %d with video_bitrate %d for CBR, url=%s",
+                params->rc_max_rate, params->video_bitrate, params->url);
+        encoder_codec_context->rc_min_rate = encoder_codec_context->bit_rate;
+        encoder_codec_context->rc_max_rate = encoder_codec_context->bit_rate;
+        if (!strcmp(params->ecodec, "h264_nvenc"))
+            av_opt_set(encoder_codec_context->priv_data, "rc", "cbr", 0);
+        else if (!strcmp(params->ecodec, "libx265"))
+            append_codec_params(encoder_codec_context, codec_params, "strict-cbr=1:hrd=1");
+        else
+            /* The HRD of x264 pads the stream with filler data up to the bitrate */
+            av_opt_set(encoder_codec_context->priv_data, "nal-hrd", "cbr", 0);
+        break;
+    default:
+        break;
+    }
+
+    if (encoder_codec_context->rc_max_rate > 0 && params->rc_buffer_size <= 0)
+        encoder_codec_context->rc_buffer_size = encoder_codec_context->rc_max_rate;
+}
+
+/*
+ * Returns the frame rate of the video after the frame rate conversion of params->fps_mode, or the frame rate of the
+ * input if there is no conversion.
+ */
+static AVRational
+converted_frame_rate(
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    AVRational frame_rate = decoder_context->stream[decoder_context->video_stream_index]->avg_frame_rate;
+
+    switch (params->fps_mode) {
+    case fps_mode_drop_dup:
+    case fps_mode_blend:
+        av_parse_video_rate(&frame_rate, params->frame_rate);
+        break;
+    case fps_mode_telecine:
+        frame_rate = av_mul_q(frame_rate, (AVRational) {5, 4});
+        break;
+    case fps_mode_ivtc:
+        frame_rate = av_mul_q(frame_rate, (AVRational) {4, 5});
+        break;
+    default:
+        break;
+    }
+    return frame_rate;
+}
+
 static int
 prepare_video_encoder(
     coderctx_t *encoder_context,
@@ -1211,8 +1606,9 @@ prepare_video_encoder(
 
     /* Set encoder parameters (directly in the coder context priv_data dictionary) */
 
-    /* Added to fix/improve encoding quality of the first frame - PENDING(SSS) research */
-    if ( params->crf_str && strlen(params->crf_str) > 0 ) {
+    /* Added to fix/improve encoding quality of the first frame - PENDING(SSS) research. A two-pass VBR or CBR has no CRF */
+    if ( params->crf_str && strlen(params->crf_str) > 0 &&
+        params->rc_mode != rc_mode_two_pass && params->rc_mode != rc_mode_cbr ) {
         /* The 'crf' option may be overriden by rate control options - 'crf_max' is used as a safety net */
         av_opt_set(encoder_codec_context->priv_data, "crf", params->crf_str, AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
         // av_opt_set(encoder_codec_context->priv_data, "crf_max", params->crf_str, AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
@@ -1231,15 +1627,70 @@ prepare_video_encoder(
         encoder_codec_context->gop_size = params->force_keyint;
     }
 
+    /*
+     * The key frames are placed at the scene cuts by avpipe, not by the scene change detection of the encoder. A segment
+     * boundary can move up to scene_tolerance after a forced key frame, so the encoder must not insert one before.
+     */
+    if (params->scene_keyframes) {
+        AVRational frame_rate = decoder_context->stream[index]->avg_frame_rate;
+        double tolerance = params->scene_tolerance > 0 ? params->scene_tolerance : SCENE_DEFAULT_TOLERANCE;
+
+        if (params->force_keyint > 0 && frame_rate.num > 0 && frame_rate.den > 0)
+            encoder_codec_context->gop_size = params->force_keyint + (int) ceil(tolerance * av_q2d(frame_rate));
+        if (!strcmp(params->ecodec, "libx264"))
+            av_opt_set_int(encoder_codec_context->priv_data, "sc_threshold", 0, 0);
+    }
+
+    /*
+     * Smart cut re-encodes the GOPs at the cut points like the input (same bitrate), without B-frames or delay so the
+     * encoded packets end before the next copied packet, and with other SPS/PPS ids than the input ones. The SPS/PPS
+     * are repeated in-band (avc3), the output extradata only has the encoder ones.
+     */
+    if (params->smart_cut) {
+        AVCodecParameters *in_codecpar = decoder_context->stream[index]->codecpar;
+        char x264_params[32];
+
+        encoder_codec_context->max_b_frames = 0;
+        if (params->video_bitrate <= 0 && in_codecpar->bit_rate > 0)
+            encoder_codec_context->bit_rate = in_codecpar->bit_rate;
+        av_opt_set(encoder_codec_context->priv_data, "tune", "zerolatency", 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "forced-idr", 1, 0);
+        snprintf(x264_params, sizeof(x264_params), "sps-id=%d:repeat-headers=1",
+            (h264_sps_id(in_codecpar->extradata, in_codecpar->extradata_size) + 1) % 32);
+        av_opt_set(encoder_codec_context->priv_data, "x264-params", x264_params, 0);
+    }
+
+    /* The source of the scale filter is the cropped picture if there is a crop */
+    int src_width = decoder_context->codec_context[index]->width;
+    int src_height = decoder_context->codec_context[index]->height;
+    crop_rect_t *crop = &decoder_context->crop;
+    if (crop->width > 0) {
+        if (crop->x + crop->width > src_width || crop->y + crop->height > src_height) {
+            elv_err("Invalid crop=%d:%d:%d:%d - outside of the video %dx%d, url=%s",
+                crop->width, crop->height, crop->x, crop->y, src_width, src_height, params->url);
+            return eav_param;
+        }
+        src_width = crop->width;
+        src_height = crop->height;
+    }
+
     /* Set codec context parameters */
-    encoder_codec_context->height = params->enc_height != -1 ? params->enc_height : decoder_context->codec_context[index]->height;
-    encoder_codec_context->width = params->enc_width != -1 ? params->enc_width : decoder_context->codec_context[index]->width;
+    encoder_codec_context->height = params->enc_height != -1 ? params->enc_height : src_height;
+    encoder_codec_context->width = params->enc_width != -1 ? params->enc_width : src_width;
 
     /* If the rotation param is set to 90 or 270 degree then change width and hight */
     if (params->rotate == 90 || params->rotate == 270) {
-        encoder_codec_context->height = params->enc_height != -1 ? params->enc_height : decoder_context->codec_context[index]->width;
-        encoder_codec_context->width = params->enc_width != -1 ? params->enc_width : decoder_context->codec_context[index]->height;
+        encoder_codec_context->height = params->enc_height != -1 ? params->enc_height : src_width;
+        encoder_codec_context->width = params->enc_width != -1 ? params->enc_width : src_height;
+        FFSWAP(int, src_width, src_height);
     }
+
+    /* With a crop and only one of enc_width/enc_height, the other one keeps the aspect ratio of the cropped picture */
+    if (crop->width > 0 && params->enc_width == -1 && params->enc_height != -1)
+        encoder_codec_context->width = (int) lrint((double) params->enc_height * src_width / src_height / 2) * 2;
+    else if (crop->width > 0 && params->enc_height == -1 && params->enc_width != -1)
+        encoder_codec_context->height = (int) lrint((double) params->enc_width * src_height / src_width / 2) * 2;
+
     if (params->video_time_base > 0)
         encoder_codec_context->time_base = (AVRational) {1, params->video_time_base};
     else
@@ -1254,6 +1705,8 @@ prepare_video_encoder(
         encoder_codec_context->rc_max_rate = params->rc_max_rate;
 
     encoder_codec_context->framerate = decoder_context->codec_context[index]->framerate;
+    if (params->fps_mode != fps_mode_none)
+        encoder_codec_context->framerate = converted_frame_rate(decoder_context, params);
 
     // This needs to be set before open (ffmpeg samples have it wrong)
     if (encoder_context->format_context->oformat->flags & AVFMT_GLOBALHEADER) {
@@ -1292,6 +1745,13 @@ prepare_video_encoder(
     if ((rc = set_pixel_fmt(encoder_codec_context, params)) != eav_success)
         return rc;
 
+    /* The color tags of the converted video, written in the VUI by the encoder and in the colr box by the muxer */
+    if (params->color_target != color_target_none) {
+        color_target_tags(params->color_target, &encoder_codec_context->color_primaries,
+            &encoder_codec_context->color_trc, &encoder_codec_context->colorspace);
+        encoder_codec_context->color_range = AVCOL_RANGE_MPEG;
+    }
+
     if (!strcmp(params->ecodec, "h264_nvenc"))
         /* Set NVIDIA specific params if the encoder is NVIDIA */
         set_nvidia_params(encoder_context, decoder_context, params);
@@ -1304,10 +1764,19 @@ prepare_video_encoder(
     else if (!strcmp(params->ecodec, "h265_ni_enc"))
         /* Set netint H265 codensity params */
         set_netint_h265_params(encoder_context, decoder_context, params);
+    else if (!strcmp(params->ecodec, "libsvtav1") || !strcmp(params->ecodec, "libaom-av1"))
+        /* Set AV1 speed and CRF params */
+        set_av1_params(encoder_context, decoder_context, params);
+    else if (!strcmp(params->ecodec, "libvpx-vp9"))
+        /* Set VP9 speed, CRF and profile params */
+        set_vp9_params(encoder_context, decoder_context, params);
     else
         /* Set H264 specific params (profile and level) */
         set_h264_params(encoder_context, decoder_context, params);
 
+    if (params->rc_mode != rc_mode_default)
+        set_rc_mode(encoder_context, decoder_context, params);
+
     elv_log("Output pixel_format=%s, profile=%d, level=%d",
         av_get_pix_fmt_name(encoder_codec_context->pix_fmt),
         encoder_codec_context->profile,
@@ -1321,6 +1790,21 @@ prepare_video_encoder(
         return rc;
     }
 
+    /*
+     * Pass the A/53 captions of the input through if the encoder writes them as SEI (the encoders with the
+     * a53cc option, like libx264 and nvenc). The captions are only added once they are detected in the input.
+     */
+    if (av_opt_find(encoder_codec_context->priv_data, "a53cc", NULL, 0, 0)) {
+        if (params->strip_captions || params->xc_type == xc_extract_captions) {
+            av_opt_set_int(encoder_codec_context->priv_data, "a53cc", 0, 0);
+        } else {
+            av_opt_set_int(encoder_codec_context->priv_data, "a53cc", 1, 0);
+            encoder_context->a53 = (cc_a53_t *) calloc(1, sizeof(cc_a53_t));
+        }
+    } else if (!params->strip_captions) {
+        elv_log("Encoder %s can not pass A/53 captions through, url=%s", params->ecodec, params->url);
+    }
+
     /* Open video encoder (initialize the encoder codec_context[i] using given codec[i]). */
     if ((rc = avcodec_open2(encoder_context->codec_context[index], encoder_context->codec[index], NULL)) < 0) {
         elv_dbg("Could not open encoder for video, err=%d", rc);
@@ -1335,8 +1819,12 @@ prepare_video_encoder(
         return eav_codec_param;
     }
 
+    /* The copied GOPs of a smart cut use the SPS/PPS in-band, not the ones of the avcC */
+    if (params->smart_cut)
+        encoder_context->stream[index]->codecpar->codec_tag = MKTAG('a', 'v', 'c', '3');
+
     encoder_context->stream[index]->time_base = encoder_codec_context->time_base;
-    encoder_context->stream[index]->avg_frame_rate = decoder_context->stream[decoder_context->video_stream_index]->avg_frame_rate;
+    encoder_context->stream[index]->avg_frame_rate = converted_frame_rate(decoder_context, params);
 
     return 0;
 }
@@ -1355,6 +1843,20 @@ is_valid_aac_sample_rate(
     return 0;
 }
 
+static int
+is_valid_opus_sample_rate(
+    int sample_rate)
+{
+    int valid_sample_rates[] = {8000, 12000, 16000, 24000, 48000};
+
+    for (int i=0; i<sizeof(valid_sample_rates)/sizeof(int); i++) {
+        if (sample_rate == valid_sample_rates[i])
+            return 1;
+    }
+
+    return 0;
+}
+
 static int
 prepare_audio_encoder(
     coderctx_t *encoder_context,
@@ -1466,6 +1968,10 @@ prepare_audio_encoder(
             !is_valid_aac_sample_rate(encoder_context->codec_context[output_stream_index]->sample_rate) &&
             sample_rate <= 0)
             sample_rate = DEFAULT_ACC_SAMPLE_RATE;
+        if (!strcmp(ecodec, "libopus") &&
+            !is_valid_opus_sample_rate(encoder_context->codec_context[output_stream_index]->sample_rate) &&
+            sample_rate <= 0)
+            sample_rate = DEFAULT_OPUS_SAMPLE_RATE;
 
         /*
          *  If sample_rate is set and
@@ -1555,16 +2061,216 @@ prepare_audio_encoder(
     return 0;
 }
 
-static int
-prepare_encoder(
-    coderctx_t *encoder_context,
-    coderctx_t *decoder_context,
-    avpipe_io_handler_t *out_handlers,
-    ioctx_t *inctx,
-    xcparams_t *params)
+/*
+ * Returns the channel layout of the encoder closest to channel_layout: the same layout,
+ * else a layout with the same number of channels, else stereo.
+ */
+static uint64_t
+rendition_channel_layout(
+    AVCodec *codec,
+    uint64_t channel_layout)
 {
-    out_tracker_t *out_tracker;
-    char *filename = "";
+    const uint64_t *layouts = codec->channel_layouts;
+    int nb_channels = av_get_channel_layout_nb_channels(channel_layout);
+
+    if (!layouts)
+        return channel_layout;
+
+    for (int i=0; layouts[i]; i++) {
+        if (layouts[i] == channel_layout)
+            return channel_layout;
+    }
+    for (int i=0; layouts[i]; i++) {
+        if (av_get_channel_layout_nb_channels(layouts[i]) == nb_channels)
+            return layouts[i];
+    }
+    return AV_CH_LAYOUT_STEREO;
+}
+
+/*
+ * Returns sample_rate if the encoder supports it, otherwise DEFAULT_AUDIO_SAMPLE_RATE
+ * or the first sample rate of the encoder.
+ */
+static int
+rendition_sample_rate(
+    AVCodec *codec,
+    int sample_rate)
+{
+    const int *rates = codec->supported_samplerates;
+
+    if (!rates)
+        return sample_rate > 0 ? sample_rate : DEFAULT_AUDIO_SAMPLE_RATE;
+
+    for (int i=0; rates[i]; i++) {
+        if (rates[i] == sample_rate)
+            return sample_rate;
+    }
+    for (int i=0; rates[i]; i++) {
+        if (rates[i] == DEFAULT_AUDIO_SAMPLE_RATE)
+            return DEFAULT_AUDIO_SAMPLE_RATE;
+    }
+    return rates[0];
+}
+
+/*
+ * Sets the muxer options of audio rendition i. The dash/hls segments are named after the rendition
+ * so that the segments of the renditions don't overwrite each other.
+ */
+static int
+set_rendition_options(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int i)
+{
+    rendition_ctx_t *r = &encoder_context->renditions[i];
+    void *priv_data = encoder_context->format_context2[i]->priv_data;
+    int64_t seg_duration_ts = atof(params->seg_duration) * r->stream->time_base.den;
+    char seg_name[MAX_AVFILENAME_LEN];
+
+    if (!strcmp(params->format, "dash") || !strcmp(params->format, "hls")) {
+        av_opt_set_int(priv_data, "seg_duration_ts", seg_duration_ts,
+            AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
+        snprintf(seg_name, sizeof(seg_name), "init-stream%d.$ext$", i);
+        av_opt_set(priv_data, "init_seg_name", seg_name, 0);
+        snprintf(seg_name, sizeof(seg_name), "chunk-stream%d-$Number%%05d$.$ext$", i);
+        av_opt_set(priv_data, "media_seg_name", seg_name, 0);
+
+        /* Same as set_encoder_options(), the DASH segments of Opus are WebM */
+        if (!strcmp(params->format, "dash") &&
+            r->stream->codecpar->codec_id == AV_CODEC_ID_OPUS &&
+            av_opt_set(priv_data, "dash_segment_type", "webm", 0) < 0) {
+            elv_err("Failed to set WebM DASH segments, audio rendition=%d, url=%s", i, params->url);
+            return eav_param;
+        }
+    } else {
+        av_opt_set_int(priv_data, "segment_duration_ts", seg_duration_ts, 0);
+        av_opt_set(priv_data, "reset_timestamps", "on", 0);
+        av_opt_set(priv_data, "segment_format_options", "movflags=frag_every_frame", 0);
+    }
+
+    av_opt_set_int(priv_data, "start_fragment_index", params->start_fragment_index,
+        AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
+    av_opt_set(priv_data, "start_segment", params->start_segment_str, 0);
+    return 0;
+}
+
+/*
+ * Prepares the audio renditions (params->audio_renditions), one output per rendition in format_context2.
+ * A passthrough rendition copies the packets of its input stream if they are already in the codec
+ * (and the channel layout if it is set) of the rendition, the other renditions are encoded.
+ */
+static int
+prepare_audio_renditions(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int rc;
+
+    for (int i=0; i<encoder_context->n_audio_output; i++) {
+        audio_rendition_t *rendition = &params->audio_renditions[i];
+        rendition_ctx_t *r = &encoder_context->renditions[i];
+        AVFormatContext *format_context = encoder_context->format_context2[i];
+        AVCodecContext *dec_codec_context = decoder_context->codec_context[rendition->audio_index];
+        AVCodec *codec = avcodec_find_encoder_by_name(rendition->ecodec);
+
+        if (!dec_codec_context || dec_codec_context->codec_type != AVMEDIA_TYPE_AUDIO || !codec) {
+            elv_err("Failed to prepare audio rendition %d, audio_index=%d, ecodec=%s, url=%s",
+                i, rendition->audio_index, rendition->ecodec, params->url);
+            return eav_codec_context;
+        }
+
+        AVCodecParameters *codecpar = decoder_context->stream[rendition->audio_index]->codecpar;
+
+        r->stream_index = rendition->audio_index;
+        r->first_pts = AV_NOPTS_VALUE;
+        r->end_pts = AV_NOPTS_VALUE;
+        r->passthrough = rendition->passthrough &&
+            codecpar->codec_id == codec->id &&
+            (rendition->channel_layout <= 0 || (uint64_t) rendition->channel_layout == codecpar->channel_layout);
+
+        format_context->io_open = elv_io_open;
+        format_context->io_close = elv_io_close;
+
+        r->stream = avformat_new_stream(format_context, NULL);
+        if (!r->stream) {
+            elv_err("Failed to allocate audio rendition %d stream, url=%s", i, params->url);
+            return eav_mem_alloc;
+        }
+
+        if (r->passthrough) {
+            if (avcodec_parameters_copy(r->stream->codecpar, codecpar) < 0) {
+                elv_err("Failed to copy audio rendition %d parameters, url=%s", i, params->url);
+                return eav_codec_param;
+            }
+            r->stream->codecpar->codec_tag = 0;
+            r->stream->time_base = (AVRational){1, codecpar->sample_rate};
+        } else {
+            if (rendition->passthrough)
+                elv_log("Audio rendition %d is encoded, input codec=%s is not %s, url=%s",
+                    i, avcodec_get_name(codecpar->codec_id), rendition->ecodec, params->url);
+
+            r->codec_context = avcodec_alloc_context3(codec);
+            if (!r->codec_context)
+                return eav_mem_alloc;
+
+            AVCodecContext *codec_context = r->codec_context;
+            uint64_t channel_layout = rendition->channel_layout > 0 ? rendition->channel_layout : 0;
+            if (!channel_layout)
+                channel_layout = get_channel_layout_for_encoder(dec_codec_context->channel_layout);
+            if (!channel_layout)
+                channel_layout = av_get_default_channel_layout(dec_codec_context->channels);
+
+            codec_context->channel_layout = rendition_channel_layout(codec, channel_layout);
+            codec_context->channels = av_get_channel_layout_nb_channels(codec_context->channel_layout);
+            codec_context->sample_rate = rendition_sample_rate(codec,
+                rendition->sample_rate > 0 ? rendition->sample_rate : dec_codec_context->sample_rate);
+            codec_context->sample_fmt = codec->sample_fmts ? codec->sample_fmts[0] : AV_SAMPLE_FMT_FLTP;
+            codec_context->time_base = (AVRational){1, codec_context->sample_rate};
+            if (rendition->bitrate > 0)
+                codec_context->bit_rate = rendition->bitrate;
+            else if (params->audio_bitrate > 0)
+                codec_context->bit_rate = params->audio_bitrate;
+
+            /* Allow the use of the experimental encoders */
+            codec_context->strict_std_compliance = FF_COMPLIANCE_EXPERIMENTAL;
+            if (format_context->oformat->flags & AVFMT_GLOBALHEADER)
+                codec_context->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+
+            if (avcodec_open2(codec_context, codec, NULL) < 0) {
+                elv_err("Could not open encoder of audio rendition %d, ecodec=%s, url=%s", i, rendition->ecodec, params->url);
+                return eav_open_codec;
+            }
+
+            if (avcodec_parameters_from_context(r->stream->codecpar, codec_context) < 0) {
+                elv_err("Failed to copy encoder parameters to audio rendition %d, url=%s", i, params->url);
+                return eav_codec_param;
+            }
+            r->stream->time_base = codec_context->time_base;
+        }
+
+        if ((rc = set_rendition_options(encoder_context, params, i)) < 0)
+            return rc;
+
+        elv_log("AUDIO RENDITION %d audio_index=%d, codec=%s, passthrough=%d, channels=%d, sample_rate=%d, bit_rate=%"PRId64", url=%s",
+            i, r->stream_index, avcodec_get_name(r->stream->codecpar->codec_id), r->passthrough,
+            r->stream->codecpar->channels, r->stream->codecpar->sample_rate,
+            r->stream->codecpar->bit_rate, params->url);
+    }
+
+    return 0;
+}
+
+static int
+prepare_encoder(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    avpipe_io_handler_t *out_handlers,
+    ioctx_t *inctx,
+    xcparams_t *params)
+{
+    out_tracker_t *out_tracker;
+    char *filename = "";
     char *filename2 = "";
     char *format = params->format;
     int rc = 0;
@@ -1603,6 +2309,10 @@ prepare_encoder(
         filename = "%d.jpeg";
     }
 
+    /* Only the captions are written, through the output handlers */
+    if (params->xc_type == xc_extract_captions)
+        format = "null";
+
     /*
      * Allocate an AVFormatContext for output.
      * Setting 3th paramter to "dash" determines the output file format and avoids guessing
@@ -1779,7 +2489,12 @@ prepare_encoder(
     if (params->xc_type & xc_audio) {
         //for (int i=0; i<MAX_STREAMS; i++) CLEAN
         //    encoder_context->audio_enc_stream_index[i] = -1;
-        if ((rc = prepare_audio_encoder(encoder_context, decoder_context, params)) != eav_success) {
+        if (params->n_audio_renditions > 0) {
+            if ((rc = prepare_audio_renditions(encoder_context, decoder_context, params)) != eav_success) {
+                elv_err("Failure in preparing audio renditions, rc=%d, url=%s", rc, params->url);
+                return rc;
+            }
+        } else if ((rc = prepare_audio_encoder(encoder_context, decoder_context, params)) != eav_success) {
             elv_err("Failure in preparing audio encoder, rc=%d, url=%s", rc, params->url);
             return rc;
         }
@@ -1812,10 +2527,21 @@ prepare_encoder(
             out_tracker->encoder_ctx = encoder_context;
             out_tracker->xc_type = xc_audio;
             out_tracker->output_stream_index = j;
+            if (params->n_audio_renditions > 0) {
+                out_tracker->audio_stream_index = encoder_context->renditions[j].stream_index;
+                out_tracker->rendition = 1;
+            }
             encoder_context->format_context2[j]->avpipe_opaque = out_tracker;
         }
     }
 
+    if (params->extract_captions || params->xc_type == xc_extract_captions) {
+        encoder_context->inctx = inctx;
+        encoder_context->cc = cc_ctx_new();
+        encoder_context->cc_seg_index = -1;
+        encoder_context->cc_last_pts = AV_NOPTS_VALUE;
+    }
+
     dump_encoder(inctx->url, encoder_context->format_context, params);
     dump_codec_context(encoder_context->codec_context[encoder_context->video_stream_index]);
     for (int i=0; i<encoder_context->n_audio_output; i++) {
@@ -1826,6 +2552,357 @@ prepare_encoder(
     return 0;
 }
 
+/*
+ * Converts a SCTE-35 splice time (90kHz, 33 bits) to the video decoder time base.
+ */
+static int64_t
+splice_time_to_video_pts(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    int64_t splice_time)
+{
+    AVRational mpegts_time_base = (AVRational) {1, 90000};
+    AVRational video_time_base = decoder_context->stream[decoder_context->video_stream_index]->time_base;
+    int64_t pts = av_rescale_q(splice_time, mpegts_time_base, video_time_base);
+    int64_t wrap = av_rescale_q(1LL << 33, mpegts_time_base, video_time_base);
+
+    /* The video pts might have wrapped already */
+    while (encoder_context->video_last_pts_read != AV_NOPTS_VALUE &&
+        pts + wrap/2 < encoder_context->video_last_pts_read)
+        pts += wrap;
+    return pts;
+}
+
+/*
+ * Queues a SCTE-35 or ID3 event of the input to be written as an emsg box in the video segments, if
+ * params->emit_emsg is set. SCTE-35 events are presented at their splice time if there is one and ID3
+ * events at the packet pts.
+ */
+static void
+queue_emsg_event(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    const char *scheme_id_uri,
+    AVPacket *packet,
+    xcparams_t *params)
+{
+    int64_t duration = EMSG_DURATION_UNKNOWN;
+    int64_t splice_time;
+    int64_t pts = AV_NOPTS_VALUE;
+
+    if (decoder_context->video_stream_index < 0)
+        return;
+
+    if (!strcmp(scheme_id_uri, EMSG_SCHEME_SCTE35)) {
+        if (parse_scte35_splice_time(&splice_time, packet) == 0 && splice_time != AV_NOPTS_VALUE)
+            pts = splice_time_to_video_pts(decoder_context, encoder_context, splice_time);
+        if (parse_scte35_break_duration(&duration, packet) != 0)
+            duration = EMSG_DURATION_UNKNOWN;
+    }
+
+    if (pts == AV_NOPTS_VALUE) {
+        if (packet->pts == AV_NOPTS_VALUE) {
+            elv_warn("EMSG [%d] event without pts, scheme=%s, url=%s", packet->stream_index, scheme_id_uri, params->url);
+            return;
+        }
+        pts = av_rescale_q(packet->pts, decoder_context->stream[packet->stream_index]->time_base,
+            decoder_context->stream[decoder_context->video_stream_index]->time_base);
+    }
+
+    pthread_mutex_lock(&encoder_context->emsg_lock);
+    if (encoder_context->n_emsg_events >= MAX_EMSG_EVENTS) {
+        pthread_mutex_unlock(&encoder_context->emsg_lock);
+        elv_warn("EMSG [%d] too many pending events, dropping pts=%"PRId64", scheme=%s, url=%s",
+            packet->stream_index, pts, scheme_id_uri, params->url);
+        return;
+    }
+
+    emsg_event_t *event = emsg_event_new(scheme_id_uri, "", pts, duration, encoder_context->emsg_id++,
+        packet->data, packet->size);
+    encoder_context->emsg_time_base = decoder_context->stream[decoder_context->video_stream_index]->time_base;
+
+    int i = encoder_context->n_emsg_events;
+    while (i > 0 && encoder_context->emsg_events[i-1]->pts > pts) {
+        encoder_context->emsg_events[i] = encoder_context->emsg_events[i-1];
+        i--;
+    }
+    encoder_context->emsg_events[i] = event;
+    encoder_context->n_emsg_events++;
+    pthread_mutex_unlock(&encoder_context->emsg_lock);
+
+    elv_dbg("EMSG [%d] queued event id=%u pts=%"PRId64" duration=%"PRId64" scheme=%s size=%d, url=%s",
+        packet->stream_index, event->id, pts, duration, scheme_id_uri, packet->size, params->url);
+}
+
+/*
+ * Queues the splice point of a SCTE-35 splice_insert or time_signal packet if params->splice_segment is set.
+ * The splice time is converted to the video decoder time base, a splice_immediate_flag splices at the packet pts.
+ */
+static void
+queue_splice_point(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    xcparams_t *params)
+{
+    AVRational mpegts_time_base = (AVRational) {1, 90000};
+    int64_t cue_pts;
+    int64_t pts;
+    int res;
+
+    if (decoder_context->video_stream_index < 0)
+        return;
+
+    res = parse_scte35_splice_time(&cue_pts, packet);
+    if (res != 0) {
+        if (res < 0)
+            elv_warn("SCTE [%d] fail to parse splice time pts=%"PRId64" size=%d, url=%s",
+                packet->stream_index, packet->pts, packet->size, params->url);
+        return;
+    }
+
+    if (cue_pts == AV_NOPTS_VALUE) {
+        if (packet->pts == AV_NOPTS_VALUE)
+            return;
+        cue_pts = av_rescale_q(packet->pts, decoder_context->stream[packet->stream_index]->time_base, mpegts_time_base);
+    }
+
+    pts = splice_time_to_video_pts(decoder_context, encoder_context, cue_pts);
+
+    pthread_mutex_lock(&encoder_context->splice_lock);
+    if (encoder_context->n_splice_pts >= MAX_SPLICE_POINTS) {
+        pthread_mutex_unlock(&encoder_context->splice_lock);
+        elv_warn("SCTE [%d] too many pending splice points, dropping cue_pts=%"PRId64", url=%s",
+            packet->stream_index, cue_pts, params->url);
+        return;
+    }
+
+    int i = encoder_context->n_splice_pts;
+    while (i > 0 && encoder_context->splice_pts[i-1] > pts) {
+        encoder_context->splice_pts[i] = encoder_context->splice_pts[i-1];
+        encoder_context->splice_cue_pts[i] = encoder_context->splice_cue_pts[i-1];
+        i--;
+    }
+    encoder_context->splice_pts[i] = pts;
+    encoder_context->splice_cue_pts[i] = cue_pts;
+    encoder_context->n_splice_pts++;
+    pthread_mutex_unlock(&encoder_context->splice_lock);
+
+    elv_log("SCTE [%d] queued splice point cue_pts=%"PRId64" pts=%"PRId64", url=%s",
+        packet->stream_index, cue_pts, pts, params->url);
+}
+
+/*
+ * Forces a key frame at the first frame at or after a pending splice point. The key frame also restarts
+ * the segment duration and force_keyint intervals, so the dash/hls muxer starts a new segment at the splice point.
+ * The segment muxer starts a new part at the splice point if splice_key_frame_deferred() kept the frames before it
+ * from being key frames.
+ */
+static void
+set_splice_key_frame(
+    AVFrame *frame,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    int64_t splice_pts = AV_NOPTS_VALUE;
+    int64_t cue_pts = AV_NOPTS_VALUE;
+
+    if (frame->pts == AV_NOPTS_VALUE)
+        return;
+
+    /* Splice points that fall on the same frame are merged */
+    pthread_mutex_lock(&encoder_context->splice_lock);
+    while (encoder_context->n_splice_pts > 0 && frame->pts >= encoder_context->splice_pts[0]) {
+        splice_pts = encoder_context->splice_pts[0];
+        cue_pts = encoder_context->splice_cue_pts[0];
+        encoder_context->n_splice_pts--;
+        memmove(encoder_context->splice_pts, encoder_context->splice_pts + 1,
+            encoder_context->n_splice_pts * sizeof(int64_t));
+        memmove(encoder_context->splice_cue_pts, encoder_context->splice_cue_pts + 1,
+            encoder_context->n_splice_pts * sizeof(int64_t));
+    }
+    pthread_mutex_unlock(&encoder_context->splice_lock);
+
+    if (splice_pts == AV_NOPTS_VALUE)
+        return;
+
+    elv_log("FRAME SET KEY flag at splice point, pts=%"PRId64" splice_pts=%"PRId64" cue_pts=%"PRId64", url=%s",
+        frame->pts, splice_pts, cue_pts, params->url);
+
+    frame->pict_type = AV_PICTURE_TYPE_I;
+    encoder_context->last_key_frame = frame->pts;
+    if (params->force_keyint > 0)
+        encoder_context->forced_keyint_countdown = params->force_keyint - 1;
+    encoder_context->splice_frame_pts = frame->pts;
+    encoder_context->splice_point.pts = cue_pts;
+}
+
+static int
+is_segment_muxer(
+    xcparams_t *params)
+{
+    return !strcmp(params->format, "fmp4-segment") || !strcmp(params->format, "segment");
+}
+
+/*
+ * Returns 1 if the frame is at or after the segment muxer boundary it reached and before the next pending splice point,
+ * when the splice point is before the next boundary. The segment muxer cuts at the first key frame at or after every
+ * video_seg_duration_ts, so without a key frame between the boundary and the splice point the part ends at the splice
+ * point key frame, and is longer than video_seg_duration_ts. A splice point queued after its boundary was reached
+ * is a key frame inside a part.
+ */
+static int
+splice_key_frame_deferred(
+    AVFrame *frame,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    int64_t boundary;
+    int64_t splice_pts = AV_NOPTS_VALUE;
+
+    if (frame->pts == AV_NOPTS_VALUE || params->video_seg_duration_ts <= 0 || !is_segment_muxer(params))
+        return 0;
+
+    if (encoder_context->splice_seg_boundary == AV_NOPTS_VALUE)
+        encoder_context->splice_seg_boundary = frame->pts + params->video_seg_duration_ts;
+    boundary = encoder_context->splice_seg_boundary;
+    if (frame->pts < boundary)
+        return 0;
+
+    pthread_mutex_lock(&encoder_context->splice_lock);
+    if (encoder_context->n_splice_pts > 0)
+        splice_pts = encoder_context->splice_pts[0];
+    pthread_mutex_unlock(&encoder_context->splice_lock);
+
+    return splice_pts != AV_NOPTS_VALUE && splice_pts > frame->pts &&
+        splice_pts < boundary + params->video_seg_duration_ts;
+}
+
+/*
+ * Moves the segment muxer boundary tracked for the splice points past a key frame that reached it, the segment muxer
+ * boundaries do not move.
+ */
+static void
+update_splice_seg_boundary(
+    AVFrame *frame,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    if (frame->pts == AV_NOPTS_VALUE || params->video_seg_duration_ts <= 0 || !is_segment_muxer(params) ||
+        encoder_context->splice_seg_boundary == AV_NOPTS_VALUE || frame->pict_type != AV_PICTURE_TYPE_I)
+        return;
+
+    if (frame->pts < encoder_context->splice_seg_boundary) {
+        if (encoder_context->splice_frame_pts == frame->pts)
+            elv_warn("SPLICE point pts=%"PRId64" is inside a part, it was queued after the part boundary, url=%s",
+                frame->pts, params->url);
+        return;
+    }
+    while (encoder_context->splice_seg_boundary <= frame->pts)
+        encoder_context->splice_seg_boundary += params->video_seg_duration_ts;
+}
+
+/*
+ * Returns 1 if the segment boundary that the frame reached is moved to a scene cut within params->scene_tolerance
+ * after it, in which case the frame must not be a key frame. The dash/hls segments start at the last key frame, the
+ * segment muxer cuts at the first key frame at or after every video_seg_duration_ts.
+ */
+static int
+scene_key_frame_deferred(
+    AVFrame *frame,
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    AVRational time_base = av_buffersink_get_time_base(decoder_context->video_buffersink_ctx);
+    double tolerance = params->scene_tolerance > 0 ? params->scene_tolerance : SCENE_DEFAULT_TOLERANCE;
+    scene_cut_t *scene_cuts = encoder_context->scene_keyframes;
+    int64_t boundary;
+
+    if (frame->pts == AV_NOPTS_VALUE)
+        return 0;
+
+    /* The scene cuts of the frames that were not encoded are skipped */
+    while (encoder_context->scene_keyframe_index < encoder_context->n_scene_keyframes &&
+        scene_cuts[encoder_context->scene_keyframe_index].pts < frame->pts)
+        encoder_context->scene_keyframe_index++;
+    if (encoder_context->scene_keyframe_index >= encoder_context->n_scene_keyframes ||
+        params->video_seg_duration_ts <= 0)
+        return 0;
+
+    if (is_segment_muxer(params)) {
+        if (encoder_context->scene_seg_boundary == AV_NOPTS_VALUE)
+            encoder_context->scene_seg_boundary = frame->pts + params->video_seg_duration_ts;
+        boundary = encoder_context->scene_seg_boundary;
+    } else if (!strcmp(params->format, "dash") || !strcmp(params->format, "hls")) {
+        boundary = encoder_context->last_key_frame + params->video_seg_duration_ts;
+    } else {
+        return 0;
+    }
+
+    return frame->pts >= boundary &&
+        scene_cuts[encoder_context->scene_keyframe_index].pts > frame->pts &&
+        scene_cuts[encoder_context->scene_keyframe_index].pts - boundary <= tolerance / av_q2d(time_base);
+}
+
+/*
+ * Forces a key frame at a scene cut found by the first pass if params->scene_keyframes is set. With dash/hls a key frame
+ * starts a new segment, so only the scene cuts within params->scene_tolerance of a segment boundary are key frames and
+ * the boundary moves to them. With the segment muxer and mp4/fmp4 every scene cut is a key frame. The force_keyint
+ * interval restarts at the scene cuts that are segment boundaries, and at every scene cut with mp4/fmp4.
+ */
+static void
+set_scene_key_frame(
+    AVFrame *frame,
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int deferred)
+{
+    AVRational time_base = av_buffersink_get_time_base(decoder_context->video_buffersink_ctx);
+    double tolerance = params->scene_tolerance > 0 ? params->scene_tolerance : SCENE_DEFAULT_TOLERANCE;
+    scene_cut_t *scene_cut;
+    int restart = 0;                    /* The force_keyint interval restarts at the key frame */
+
+    if (frame->pts == AV_NOPTS_VALUE)
+        return;
+
+    /* The segment muxer boundaries do not move, a deferred boundary ends at the scene cut */
+    if (is_segment_muxer(params) && !deferred && encoder_context->scene_seg_boundary != AV_NOPTS_VALUE &&
+        frame->pts >= encoder_context->scene_seg_boundary) {
+        while (encoder_context->scene_seg_boundary <= frame->pts)
+            encoder_context->scene_seg_boundary += params->video_seg_duration_ts;
+        restart = 1;
+    }
+
+    if (encoder_context->scene_keyframe_index >= encoder_context->n_scene_keyframes ||
+        encoder_context->scene_keyframes[encoder_context->scene_keyframe_index].pts != frame->pts)
+        return;
+    scene_cut = &encoder_context->scene_keyframes[encoder_context->scene_keyframe_index++];
+
+    if (!strcmp(params->format, "dash") || !strcmp(params->format, "hls")) {
+        /* A scene cut at or after the boundary already started the segment */
+        if (frame->pict_type != AV_PICTURE_TYPE_I) {
+            int64_t next_boundary = encoder_context->last_key_frame + params->video_seg_duration_ts;
+            if (next_boundary - frame->pts > tolerance / av_q2d(time_base))
+                return;
+            frame->pict_type = AV_PICTURE_TYPE_I;
+            encoder_context->last_key_frame = frame->pts;
+        }
+        restart = 1;
+    } else if (!is_segment_muxer(params)) {
+        restart = 1;
+    }
+
+    if (params->debug_frame_level)
+        elv_dbg("FRAME SET KEY flag at scene cut, pts=%"PRId64" score=%.3f restart=%d, url=%s",
+            frame->pts, scene_cut->score, restart, params->url);
+
+    frame->pict_type = AV_PICTURE_TYPE_I;
+    if (restart && params->force_keyint > 0)
+        encoder_context->forced_keyint_countdown = params->force_keyint - 1;
+}
+
 static void
 set_idr_frame_key_flag(
     AVFrame *frame,
@@ -1834,6 +2911,9 @@ set_idr_frame_key_flag(
     xcparams_t *params,
     int debug_frame_level)
 {
+    int deferred = 0;
+    int splice_deferred = 0;
+
     if (!frame)
         return;
 
@@ -1856,11 +2936,18 @@ set_idr_frame_key_flag(
 #endif
         frame->pict_type = AV_PICTURE_TYPE_NONE;
 
+    /* A segment boundary moved to an upcoming scene cut or splice point has no key frame */
+    if (params->scene_keyframes)
+        deferred = scene_key_frame_deferred(frame, decoder_context, encoder_context, params);
+    if (params->splice_segment)
+        splice_deferred = splice_key_frame_deferred(frame, encoder_context, params);
+    deferred |= splice_deferred;
+
     /*
      * Set key frame in the beginning of every abr segment.
      */
     if (!strcmp(params->format, "dash") || !strcmp(params->format, "hls")) {
-        if (frame->pts >= encoder_context->last_key_frame + params->video_seg_duration_ts) {
+        if (!deferred && frame->pts >= encoder_context->last_key_frame + params->video_seg_duration_ts) {
             int64_t diff = frame->pts - (encoder_context->last_key_frame + params->video_seg_duration_ts);
             int missing_frames = 0;
             /* We can have some missing_frames only when transcoding a UDP live source */
@@ -1877,7 +2964,7 @@ set_idr_frame_key_flag(
     }
 
     if (params->force_keyint > 0) {
-        if (encoder_context->forced_keyint_countdown <= 0) {
+        if (encoder_context->forced_keyint_countdown <= 0 && !deferred) {
             if (debug_frame_level) {
                 elv_dbg("FRAME SET KEY flag, forced_keyint=%d pts=%"PRId64", forced_keyint_countdown=%d",
                     params->force_keyint, frame->pts, encoder_context->forced_keyint_countdown);
@@ -1890,6 +2977,14 @@ set_idr_frame_key_flag(
         }
         encoder_context->forced_keyint_countdown --;
     }
+
+    if (params->scene_keyframes && !splice_deferred)
+        set_scene_key_frame(frame, decoder_context, encoder_context, params, deferred);
+
+    if (params->splice_segment) {
+        set_splice_key_frame(frame, encoder_context, params);
+        update_splice_seg_boundary(frame, encoder_context, params);
+    }
 }
 
 static int
@@ -2026,6 +3121,38 @@ should_skip_encoding(
     return 0;
 }
 
+/*
+ * Returns the frame rate of the encoded video, or 0 if it is not known.
+ */
+static double
+output_frame_rate(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *p)
+{
+    AVRational frame_rate;
+
+    if (p->video_frame_duration_ts > 0)
+        return 1 / (p->video_frame_duration_ts *
+            av_q2d(encoder_context->stream[encoder_context->video_stream_index]->time_base));
+
+    if (p->fps_mode != fps_mode_none) {
+        frame_rate = converted_frame_rate(decoder_context, p);
+        return frame_rate.num > 0 && frame_rate.den > 0 ? av_q2d(frame_rate) : 0;
+    }
+
+    frame_rate = decoder_context->codec_context[decoder_context->video_stream_index]->framerate;
+    if (frame_rate.num <= 0 || frame_rate.den <= 0)
+        frame_rate = decoder_context->stream[decoder_context->video_stream_index]->avg_frame_rate;
+    if (frame_rate.num <= 0 || frame_rate.den <= 0)
+        return 0;
+
+    /* bwdif send_field outputs a frame for each field */
+    if (p->deinterlace == dif_bwdif)
+        return 2 * av_q2d(frame_rate);
+    return av_q2d(frame_rate);
+}
+
 /*
  * encode_frame() encodes the frame and writes it to the output.
  * If the incoming stream is a mpeg-ts or a rtmp stream, encode_frame() adjusts the
@@ -2072,7 +3199,11 @@ encode_frame(
     if (skip)
         return eav_success;
 
-    // Prepare packet before encoding - adjust PTS and IDR frame signaling
+    /* The captions are decoded in transcode_video(), the video is not encoded */
+    if (params->xc_type == xc_extract_captions)
+        return eav_success;
+
+    // Prepare packet before encoding - adjust PTS and IDR frame signaling
     if (frame) {
 
         const char *st = stream_type_str(decoder_context, stream_index);
@@ -2125,6 +3256,24 @@ encode_frame(
         if (params->xc_type & xc_video &&
             stream_index == decoder_context->video_stream_index) {
             set_idr_frame_key_flag(frame, decoder_context, encoder_context, params, debug_frame_level);
+
+            /* The GOPs re-encoded by smart cut start with an IDR frame */
+            if (params->smart_cut && encoder_context->smart_cut_key) {
+                frame->pict_type = AV_PICTURE_TYPE_I;
+                encoder_context->smart_cut_key = 0;
+            }
+        }
+
+        /* Add the pass through captions, re-packed with the cc_count of the output frame rate */
+        if (encoder_context->a53 && encoder_context->a53->detected &&
+            stream_index == decoder_context->video_stream_index) {
+            int cc_count = cc_a53_count(output_frame_rate(decoder_context, encoder_context, params));
+            AVFrameSideData *sd;
+
+            av_frame_remove_side_data(frame, AV_FRAME_DATA_A53_CC);
+            sd = av_frame_new_side_data(frame, AV_FRAME_DATA_A53_CC, 3 * cc_count);
+            if (sd)
+                cc_a53_pop(encoder_context->a53, sd->data, cc_count);
         }
 
         // Special case to extract the first frame image
@@ -2162,6 +3311,8 @@ encode_frame(
     }
 
     while (ret >= 0) {
+        int splice_packet = 0;
+
         // Get the output packet from encoder
         ret = avcodec_receive_packet(codec_context, output_packet);
 
@@ -2220,6 +3371,21 @@ encode_frame(
             encoder_context->video_last_pts_encoded = output_packet->pts;
         }
 
+        /* The key frame forced at a splice point starts a new segment, it is reported once written */
+        if (stream_index == decoder_context->video_stream_index &&
+            encoder_context->splice_frame_pts != AV_NOPTS_VALUE &&
+            output_packet->pts == encoder_context->splice_frame_pts) {
+            splice_packet = 1;
+            encoder_context->splice_frame_pts = AV_NOPTS_VALUE;
+        }
+
+        /* The encoder has no B-frames with smart cut, keep the DTS of the copied packets behind the PTS the same way */
+        if (params->smart_cut &&
+            stream_index == decoder_context->video_stream_index &&
+            decoder_context->smart_cut_dts_delay != AV_NOPTS_VALUE &&
+            decoder_context->smart_cut_dts_delay > 0)
+            output_packet->dts = output_packet->pts - decoder_context->smart_cut_dts_delay;
+
         output_packet->pts += params->start_pts;
         output_packet->dts += params->start_pts;
 
@@ -2262,6 +3428,19 @@ encode_frame(
             );
         }
 
+        /*
+         * Move the output timeline so that it starts at start_pts (in the output time base). The first encoded packet
+         * is a key frame with the lowest pts of the output, its dts can be lower if the encoder has B-frames.
+         */
+        if (params->rebase_pts) {
+            int64_t *first_pts = selected_decoded_audio(decoder_context, stream_index) >= 0 ?
+                &encoder_context->first_encoded_audio_pts[stream_index] : &encoder_context->first_encoded_video_pts;
+            if (*first_pts == AV_NOPTS_VALUE)
+                *first_pts = output_packet->pts;
+            output_packet->pts += params->start_pts - *first_pts;
+            output_packet->dts += params->start_pts - *first_pts;
+        }
+
         if (selected_decoded_audio(decoder_context, stream_index) >= 0) {
             /* Set the packet duration if it is not the first audio packet */
             if (encoder_context->audio_pts[stream_index] != AV_NOPTS_VALUE) {
@@ -2325,6 +3504,11 @@ encode_frame(
             out_handlers->avpipe_stater(outctx, stream_index, out_stat_frame_written);
         }
 
+        if (splice_packet)
+            encoder_context->splice_point.frame_pts = output_packet->pts;
+
+        int64_t packet_pts = output_packet->pts;
+
         /* mux encoded frame */
         ret = av_interleaved_write_frame(format_context, output_packet);
         if (ret != 0) {
@@ -2334,6 +3518,26 @@ encode_frame(
             break;
         }
 
+        /* The muxer opened the segment that starts with the splice point key frame */
+        if (splice_packet) {
+            outctx = out_tracker->last_outctx;
+            if (outctx) {
+                encoder_context->splice_point.seg_index = outctx->seg_index;
+                elv_log("SPLICE segment seg_index=%d pts=%"PRId64" frame_pts=%"PRId64", url=%s",
+                    outctx->seg_index, encoder_context->splice_point.pts,
+                    encoder_context->splice_point.frame_pts, params->url);
+                if (out_handlers->avpipe_stater)
+                    out_handlers->avpipe_stater(outctx, stream_index, out_stat_splice_point);
+            }
+        }
+
+        /* The caption segments start with the video segments */
+        if (encoder_context->cc &&
+            stream_index == decoder_context->video_stream_index &&
+            out_tracker->last_outctx &&
+            out_tracker->last_outctx->seg_index != encoder_context->cc_seg_index)
+            elv_io_caption_segment(encoder_context, params, out_tracker->last_outctx->seg_index, packet_pts);
+
         /* Reset the packet to receive the next frame */
         av_packet_unref(output_packet);
     }
@@ -2357,8 +3561,27 @@ do_bypass(
         decoder_context->stream[packet->stream_index]->time_base,
         encoder_context->stream[packet->stream_index]->time_base);
 
-    packet->pts += p->start_pts;
-    packet->dts += p->start_pts;
+    /*
+     * A rebased copy (EDL stream copy) starts on a video key frame, its pts moves to start_pts and the B-frames
+     * after it keep their dts offset.
+     */
+    if (p->rebase_pts) {
+        int64_t *first_pts = is_audio ?
+            &encoder_context->first_encoded_audio_pts[packet->stream_index] : &encoder_context->first_encoded_video_pts;
+        if (*first_pts == AV_NOPTS_VALUE) {
+            if (!is_audio && !(packet->flags & AV_PKT_FLAG_KEY)) {
+                elv_err("BYPASS failed to rebase pts, first packet pts=%"PRId64" is not a key frame, url=%s",
+                    packet->pts, p->url);
+                return eav_param;
+            }
+            *first_pts = packet->pts;
+        }
+        packet->pts += p->start_pts - *first_pts;
+        packet->dts += p->start_pts - *first_pts;
+    } else {
+        packet->pts += p->start_pts;
+        packet->dts += p->start_pts;
+    }
 
     dump_packet(is_audio, "BYPASS ", packet, debug_frame_level);
 
@@ -2433,6 +3656,520 @@ check_pts_wrapped(
     return eav_success;
 }
 
+/*
+ * Replaces the content of a decoded frame with black (video) or silence (audio).
+ * It is used to fill the gaps of an edit decision list when params->blank is set.
+ */
+static avpipe_error_t
+blank_frame(
+    AVFrame *frame,
+    enum AVMediaType type)
+{
+    if (av_frame_make_writable(frame) < 0)
+        return eav_mem_alloc;
+
+    if (type == AVMEDIA_TYPE_AUDIO) {
+        if (av_samples_set_silence(frame->extended_data, 0, frame->nb_samples, frame->channels, frame->format) < 0)
+            return eav_param;
+        return eav_success;
+    }
+
+    const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(frame->format);
+    if (!desc || (desc->flags & (AV_PIX_FMT_FLAG_HWACCEL | AV_PIX_FMT_FLAG_BITSTREAM | AV_PIX_FMT_FLAG_PAL))) {
+        elv_err("Can not blank frame with pix_fmt=%d", frame->format);
+        return eav_param;
+    }
+
+    int is_rgb = desc->flags & AV_PIX_FMT_FLAG_RGB;
+    for (int c=0; c<desc->nb_components; c++) {
+        const AVComponentDescriptor *comp = &desc->comp[c];
+        int is_chroma = !is_rgb && (c == 1 || c == 2);
+        int is_alpha = (desc->flags & AV_PIX_FMT_FLAG_ALPHA) && c == desc->nb_components - 1;
+        int width = is_chroma ? AV_CEIL_RSHIFT(frame->width, desc->log2_chroma_w) : frame->width;
+        int height = is_chroma ? AV_CEIL_RSHIFT(frame->height, desc->log2_chroma_h) : frame->height;
+        int value = 0;
+
+        if (is_alpha)
+            value = (1 << comp->depth) - 1;
+        else if (is_chroma)
+            value = 1 << (comp->depth - 1);
+        else if (!is_rgb && frame->color_range != AVCOL_RANGE_JPEG)
+            value = 16 << (comp->depth - 8);
+        value <<= comp->shift;
+
+        for (int y=0; y<height; y++) {
+            uint8_t *p = frame->data[comp->plane] + y * frame->linesize[comp->plane] + comp->offset;
+            for (int x=0; x<width; x++, p += comp->step) {
+                if (comp->depth + comp->shift <= 8)
+                    *p = value;
+                else if (desc->flags & AV_PIX_FMT_FLAG_BE)
+                    AV_WB16(p, value);
+                else
+                    AV_WL16(p, value);
+            }
+        }
+    }
+
+    return eav_success;
+}
+
+/*
+ * Keeps the loudness that the ebur128 filter of audio output i wrote in the metadata of a filtered frame.
+ * The integrated loudness and the LRA are measured since the start, the true peak is the maximum so far.
+ */
+static void
+update_loudness(
+    coderctx_t *decoder_context,
+    int i,
+    AVFrame *frame)
+{
+    loudness_stats_t *loudness = &decoder_context->loudness[i];
+    AVDictionaryEntry *e;
+
+    if ((e = av_dict_get(frame->metadata, "lavfi.r128.I", NULL, 0)) != NULL)
+        loudness->integrated = strtod(e->value, NULL);
+    if ((e = av_dict_get(frame->metadata, "lavfi.r128.LRA", NULL, 0)) != NULL)
+        loudness->range = strtod(e->value, NULL);
+
+    /* The true peaks are linear, one per channel */
+    e = NULL;
+    while ((e = av_dict_get(frame->metadata, "lavfi.r128.true_peaks_ch", e, AV_DICT_IGNORE_SUFFIX)) != NULL) {
+        double peak = strtod(e->value, NULL);
+        if (peak > 0 && 20 * log10(peak) > loudness->true_peak)
+            loudness->true_peak = 20 * log10(peak);
+    }
+}
+
+static double
+qc_min_duration(
+    xcparams_t *params)
+{
+    return params->qc_min_duration > 0 ? params->qc_min_duration : QC_DEFAULT_MIN_DURATION;
+}
+
+/*
+ * Adds a silence, black or frozen frame interval to the QC report and reports it with in_stat_qc.
+ */
+static void
+report_qc_event(
+    coderctx_t *decoder_context,
+    xcparams_t *params,
+    qc_event_t *event)
+{
+    avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+
+    elv_log("QC %s stream_index=%d start=%.3f end=%.3f, url=%s",
+        qc_event_type_name(event->type), event->stream_index, event->start, event->end, params->url);
+    if (qc_report_add(&decoder_context->qc_report, event) < 0)
+        elv_err("QC failed to add %s interval to the report, url=%s", qc_event_type_name(event->type), params->url);
+
+    if (in_handlers->avpipe_stater) {
+        decoder_context->inctx->qc_event = event;
+        in_handlers->avpipe_stater(decoder_context->inctx, event->stream_index, in_stat_qc);
+        decoder_context->inctx->qc_event = NULL;
+    }
+}
+
+/*
+ * Follows the silences that the silencedetect filter of audio output i wrote in the metadata of a filtered frame.
+ */
+static void
+update_qc_audio(
+    coderctx_t *decoder_context,
+    xcparams_t *params,
+    int i,
+    AVFrame *frame)
+{
+    qc_tracker_t *tracker = &decoder_context->qc_silence[i];
+    AVRational time_base = av_buffersink_get_time_base(decoder_context->audio_buffersink_ctx[i]);
+    AVDictionaryEntry *e;
+    qc_event_t event;
+
+    if (frame->pts != AV_NOPTS_VALUE)
+        qc_tracker_frame(tracker, frame->pts * av_q2d(time_base));
+    if ((e = av_dict_get(frame->metadata, "lavfi.silence_start", NULL, 0)) != NULL)
+        qc_tracker_start(tracker, strtod(e->value, NULL));
+    if ((e = av_dict_get(frame->metadata, "lavfi.silence_end", NULL, 0)) != NULL &&
+        qc_tracker_end(tracker, strtod(e->value, NULL), qc_min_duration(params), &event))
+        report_qc_event(decoder_context, params, &event);
+}
+
+/*
+ * Follows the black frames (blackframe filter) and the frozen frames (freezedetect filter) of a filtered video frame.
+ */
+static void
+update_qc_video(
+    coderctx_t *decoder_context,
+    xcparams_t *params,
+    AVFrame *frame)
+{
+    AVRational time_base = av_buffersink_get_time_base(decoder_context->video_buffersink_ctx);
+    AVDictionaryEntry *e;
+    qc_event_t event;
+    double t;
+
+    if (frame->pts == AV_NOPTS_VALUE)
+        return;
+    t = frame->pts * av_q2d(time_base);
+
+    if (params->detect_black) {
+        qc_tracker_t *tracker = &decoder_context->qc_black;
+        qc_tracker_frame(tracker, t);
+        if (av_dict_get(frame->metadata, "lavfi.blackframe.pblack", NULL, 0) != NULL)
+            qc_tracker_start(tracker, t);
+        else if (qc_tracker_end(tracker, t, qc_min_duration(params), &event))
+            report_qc_event(decoder_context, params, &event);
+    }
+
+    if (params->detect_freeze) {
+        qc_tracker_t *tracker = &decoder_context->qc_freeze;
+        qc_tracker_frame(tracker, t);
+        if ((e = av_dict_get(frame->metadata, "lavfi.freezedetect.freeze_start", NULL, 0)) != NULL)
+            qc_tracker_start(tracker, strtod(e->value, NULL));
+        if ((e = av_dict_get(frame->metadata, "lavfi.freezedetect.freeze_end", NULL, 0)) != NULL &&
+            qc_tracker_end(tracker, strtod(e->value, NULL), qc_min_duration(params), &event))
+            report_qc_event(decoder_context, params, &event);
+    }
+}
+
+/*
+ * Writes a document of the transcoding (QC report, shot list, audio rendition manifest) as one output of the given type.
+ */
+static int
+write_json_output(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    const char *url,
+    avpipe_buftype_t type,
+    const char *doc)
+{
+    avpipe_io_handler_t *out_handlers = encoder_context->out_handlers;
+    int rc = 0;
+
+    ioctx_t *outctx = (ioctx_t *) calloc(1, sizeof(ioctx_t));
+    outctx->url = strdup(url);
+    outctx->type = type;
+    outctx->encoder_ctx = encoder_context;
+    outctx->inctx = encoder_context->inctx;
+
+    if (out_handlers->avpipe_opener(url, outctx) < 0) {
+        elv_err("Failed to open %s, url=%s", url, params->url);
+        rc = eav_write_frame;
+    } else {
+        if (out_handlers->avpipe_writer(outctx, (uint8_t *) doc, strlen(doc)) < 0) {
+            elv_err("Failed to write %s, url=%s", url, params->url);
+            rc = eav_write_frame;
+        }
+        out_handlers->avpipe_closer(outctx);
+    }
+
+    free(outctx->url);
+    av_freep(&outctx->buf);
+    free(outctx);
+    return rc;
+}
+
+/*
+ * Ends the intervals that last until the end of the input and writes the QC report through the output handlers.
+ */
+static int
+write_qc_report(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    qc_event_t event;
+    char *doc;
+    int rc;
+
+    if (params->detect_silence) {
+        for (int i=0; i<decoder_context->n_audio_filters; i++) {
+            if (qc_tracker_end(&decoder_context->qc_silence[i], -1, qc_min_duration(params), &event))
+                report_qc_event(decoder_context, params, &event);
+        }
+    }
+    if (params->detect_black && qc_tracker_end(&decoder_context->qc_black, -1, qc_min_duration(params), &event))
+        report_qc_event(decoder_context, params, &event);
+    if (params->detect_freeze && qc_tracker_end(&decoder_context->qc_freeze, -1, qc_min_duration(params), &event))
+        report_qc_event(decoder_context, params, &event);
+
+    doc = qc_report_json(&decoder_context->qc_report);
+    if (!doc)
+        return eav_mem_alloc;
+
+    if ((rc = write_json_output(encoder_context, params, "qc_report.json", avpipe_qc_report, doc)) == eav_success)
+        elv_log("QC report written intervals=%d, url=%s", decoder_context->qc_report.n_events, params->url);
+    free(doc);
+    return rc;
+}
+
+/*
+ * Keeps the crop rectangle that cropdetect wrote in the metadata of a filtered video frame. Since cropdetect does not
+ * reset, the last rectangle contains the non black pixels of all the frames.
+ */
+static void
+update_crop(
+    coderctx_t *decoder_context,
+    AVFrame *frame)
+{
+    crop_rect_t *crop = &decoder_context->crop_detected;
+    AVDictionaryEntry *w, *h, *x, *y;
+
+    if ((w = av_dict_get(frame->metadata, "lavfi.cropdetect.w", NULL, 0)) == NULL ||
+        (h = av_dict_get(frame->metadata, "lavfi.cropdetect.h", NULL, 0)) == NULL ||
+        (x = av_dict_get(frame->metadata, "lavfi.cropdetect.x", NULL, 0)) == NULL ||
+        (y = av_dict_get(frame->metadata, "lavfi.cropdetect.y", NULL, 0)) == NULL)
+        return;
+
+    crop->width = atoi(w->value);
+    crop->height = atoi(h->value);
+    crop->x = atoi(x->value);
+    crop->y = atoi(y->value);
+}
+
+/*
+ * Adds a scene cut if the scene change score that the select filter wrote in the metadata of a filtered video frame
+ * reaches params->scene_threshold, and reports it with in_stat_scene.
+ */
+static void
+update_scenes(
+    coderctx_t *decoder_context,
+    xcparams_t *params,
+    AVFrame *frame)
+{
+    AVRational time_base = av_buffersink_get_time_base(decoder_context->video_buffersink_ctx);
+    avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+    double threshold = params->scene_threshold > 0 ? params->scene_threshold : SCENE_DEFAULT_THRESHOLD;
+    AVDictionaryEntry *e;
+    scene_cut_t *scene_cut;
+    double score;
+
+    if (frame->pts == AV_NOPTS_VALUE ||
+        (e = av_dict_get(frame->metadata, "lavfi.scene_score", NULL, 0)) == NULL)
+        return;
+    score = strtod(e->value, NULL);
+    if (score < threshold)
+        return;
+
+    if (decoder_context->n_scene_cuts == decoder_context->scene_cuts_size) {
+        int size = decoder_context->scene_cuts_size ? decoder_context->scene_cuts_size * 2 : 64;
+        scene_cut_t *scene_cuts = realloc(decoder_context->scene_cuts, size * sizeof(scene_cut_t));
+        if (!scene_cuts) {
+            elv_err("SCENE failed to add scene cut pts=%"PRId64", url=%s", frame->pts, params->url);
+            return;
+        }
+        decoder_context->scene_cuts = scene_cuts;
+        decoder_context->scene_cuts_size = size;
+    }
+
+    scene_cut = &decoder_context->scene_cuts[decoder_context->n_scene_cuts++];
+    scene_cut->pts = frame->pts;
+    scene_cut->time = frame->pts * av_q2d(time_base);
+    scene_cut->score = score;
+
+    if (params->debug_frame_level)
+        elv_dbg("SCENE cut pts=%"PRId64" time=%.3f score=%.3f, url=%s",
+            scene_cut->pts, scene_cut->time, scene_cut->score, params->url);
+
+    if (in_handlers->avpipe_stater) {
+        decoder_context->inctx->scene_cut = scene_cut;
+        in_handlers->avpipe_stater(decoder_context->inctx, decoder_context->video_stream_index, in_stat_scene);
+        decoder_context->inctx->scene_cut = NULL;
+    }
+}
+
+/*
+ * Writes the shot list, the scene cuts of the video, through the output handlers:
+ * {"scene_cuts":[{"pts":48048,"time":2.002,"score":0.512}, ...]}
+ */
+static int
+write_shot_list(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    int size = 32 + decoder_context->n_scene_cuts * 80;
+    char *doc = calloc(size, 1);
+    int len;
+    int rc;
+
+    if (!doc)
+        return eav_mem_alloc;
+
+    len = snprintf(doc, size, "{\"scene_cuts\":[");
+    for (int i = 0; i < decoder_context->n_scene_cuts; i++) {
+        scene_cut_t *c = &decoder_context->scene_cuts[i];
+        len += snprintf(doc + len, size - len, "%s{\"pts\":%"PRId64",\"time\":%.3f,\"score\":%.3f}",
+            i > 0 ? "," : "", c->pts, c->time, c->score);
+    }
+    snprintf(doc + len, size - len, "]}");
+
+    if ((rc = write_json_output(encoder_context, params, "shot_list.json", avpipe_shot_list, doc)) == eav_success)
+        elv_log("SCENE shot list written scene_cuts=%d, url=%s", decoder_context->n_scene_cuts, params->url);
+    free(doc);
+    return rc;
+}
+
+/*
+ * Dolby audio_channel_configuration (ETSI TS 102 366 Annex I) of a channel layout, a bit per speaker
+ * location from L (0x8000) to LFE (0x0001). The back surrounds of 5.1(back) are the surrounds (Ls/Rs).
+ */
+static int
+dolby_channel_configuration(
+    uint64_t channel_layout)
+{
+    int config = 0;
+
+    if (channel_layout & AV_CH_FRONT_LEFT)
+        config |= 0x8000;
+    if (channel_layout & AV_CH_FRONT_CENTER)
+        config |= 0x4000;
+    if (channel_layout & AV_CH_FRONT_RIGHT)
+        config |= 0x2000;
+    if (channel_layout & (AV_CH_SIDE_LEFT | AV_CH_SIDE_RIGHT)) {
+        config |= 0x1800;
+        if (channel_layout & (AV_CH_BACK_LEFT | AV_CH_BACK_RIGHT))
+            config |= 0x0200;
+    } else if (channel_layout & (AV_CH_BACK_LEFT | AV_CH_BACK_RIGHT)) {
+        config |= 0x1800;
+    }
+    if (channel_layout & (AV_CH_FRONT_LEFT_OF_CENTER | AV_CH_FRONT_RIGHT_OF_CENTER))
+        config |= 0x0400;
+    if (channel_layout & AV_CH_BACK_CENTER)
+        config |= 0x0100;
+    if (channel_layout & AV_CH_TOP_CENTER)
+        config |= 0x0080;
+    if (channel_layout & (AV_CH_WIDE_LEFT | AV_CH_WIDE_RIGHT))
+        config |= 0x0020;
+    if (channel_layout & (AV_CH_TOP_FRONT_LEFT | AV_CH_TOP_FRONT_RIGHT))
+        config |= 0x0010;
+    if (channel_layout & AV_CH_TOP_FRONT_CENTER)
+        config |= 0x0008;
+    if (channel_layout & AV_CH_LOW_FREQUENCY_2)
+        config |= 0x0002;
+    if (channel_layout & AV_CH_LOW_FREQUENCY)
+        config |= 0x0001;
+    return config;
+}
+
+/*
+ * Writes the manifest of the audio renditions through the output handlers, the renditions can
+ * be added to the manifests of the video:
+ *   - dash: an MPD with one AdaptationSet per rendition (audio_renditions.mpd)
+ *   - hls: one EXT-X-MEDIA tag per rendition (audio_renditions.m3u8), the renditions with the same
+ *     codec and number of channels are in the same GROUP-ID
+ */
+static int
+write_rendition_manifest(
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    int is_dash = !strcmp(params->format, "dash");
+    int start_number = atoi(params->start_segment_str);
+    double duration = 0;
+    int size = 512;
+    int len = 0;
+    char *doc;
+    int rc;
+
+    for (int i=0; i<encoder_context->n_audio_output; i++) {
+        audio_rendition_t *rendition = &params->audio_renditions[i];
+        rendition_ctx_t *r = &encoder_context->renditions[i];
+        size += 1024 + (rendition->name ? strlen(rendition->name) : 0) + (rendition->lang ? strlen(rendition->lang) : 0);
+        if (r->first_pts != AV_NOPTS_VALUE && (r->end_pts - r->first_pts) * av_q2d(r->stream->time_base) > duration)
+            duration = (r->end_pts - r->first_pts) * av_q2d(r->stream->time_base);
+    }
+
+    doc = calloc(size, 1);
+    if (!doc)
+        return eav_mem_alloc;
+
+    if (is_dash)
+        len = snprintf(doc, size,
+            "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"
+            "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" "
+            "type=\"static\" mediaPresentationDuration=\"PT%.3fS\" minBufferTime=\"PT%sS\">\n"
+            "  <Period id=\"0\" start=\"PT0.0S\">\n",
+            duration, params->seg_duration);
+    else
+        len = snprintf(doc, size, "#EXTM3U\n#EXT-X-VERSION:6\n");
+
+    for (int i=0; i<encoder_context->n_audio_output; i++) {
+        audio_rendition_t *rendition = &params->audio_renditions[i];
+        rendition_ctx_t *r = &encoder_context->renditions[i];
+        AVCodecParameters *codecpar = r->stream->codecpar;
+        const char *codec_name = avcodec_get_name(codecpar->codec_id);
+        uint64_t channel_layout = codecpar->channel_layout ?
+            codecpar->channel_layout : av_get_default_channel_layout(codecpar->channels);
+        const char *lang = rendition->lang && rendition->lang[0] ? rendition->lang : "und";
+        char name[MAX_AVFILENAME_LEN];
+        char codec_string[CODEC_STRING_SZ];
+
+        if (rendition->name && rendition->name[0])
+            snprintf(name, sizeof(name), "%s", rendition->name);
+        else
+            snprintf(name, sizeof(name), "%s %s", codec_name, avpipe_channel_name(codecpar->channels, (int) channel_layout));
+
+        if (is_dash) {
+            int webm = codecpar->codec_id == AV_CODEC_ID_OPUS;
+            const char *ext = webm ? "webm" : "m4s";
+            int64_t bandwidth = codecpar->bit_rate;
+            double rendition_duration = r->first_pts != AV_NOPTS_VALUE ?
+                (r->end_pts - r->first_pts) * av_q2d(r->stream->time_base) : 0;
+
+            /* The passthrough renditions and the VBR encoders might not have a nominal bitrate */
+            if (rendition_duration > 0 && r->bytes_written * 8 / rendition_duration > bandwidth)
+                bandwidth = r->bytes_written * 8 / rendition_duration;
+
+            get_codec_string(codecpar, (AVRational){0, 1}, codec_string, sizeof(codec_string));
+            len += snprintf(doc + len, size - len,
+                "    <AdaptationSet id=\"%d\" contentType=\"audio\" mimeType=\"audio/%s\" lang=\"%s\" segmentAlignment=\"true\">\n"
+                "      <Label>%s</Label>\n"
+                "      <Representation id=\"%d\" codecs=\"%s\" bandwidth=\"%"PRId64"\" audioSamplingRate=\"%d\">\n",
+                i, webm ? "webm" : "mp4", lang, name, i, codec_string, bandwidth, codecpar->sample_rate);
+
+            if (codecpar->codec_id == AV_CODEC_ID_AC3 || codecpar->codec_id == AV_CODEC_ID_EAC3)
+                len += snprintf(doc + len, size - len,
+                    "        <AudioChannelConfiguration schemeIdUri=\"tag:dolby.com,2014:dash:audio_channel_configuration:2011\" value=\"%04X\"/>\n",
+                    dolby_channel_configuration(channel_layout));
+            else
+                len += snprintf(doc + len, size - len,
+                    "        <AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:audio_channel_configuration:2011\" value=\"%d\"/>\n",
+                    codecpar->channels);
+
+            len += snprintf(doc + len, size - len,
+                "        <SegmentTemplate timescale=\"%d\" duration=\"%"PRId64"\" startNumber=\"%d\" "
+                "initialization=\"init-stream%d.%s\" media=\"chunk-stream%d-$Number%%05d$.%s\"/>\n"
+                "      </Representation>\n"
+                "    </AdaptationSet>\n",
+                r->stream->time_base.den, (int64_t) (atof(params->seg_duration) * r->stream->time_base.den),
+                start_number, i, ext, i, ext);
+        } else {
+            /* The first rendition of a group is its default one */
+            int is_default = 1;
+            for (int j=0; j<i; j++) {
+                AVCodecParameters *prev = encoder_context->renditions[j].stream->codecpar;
+                if (prev->codec_id == codecpar->codec_id && prev->channels == codecpar->channels)
+                    is_default = 0;
+            }
+
+            len += snprintf(doc + len, size - len,
+                "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio-%s-%d\",NAME=\"%s\",LANGUAGE=\"%s\","
+                "DEFAULT=%s,AUTOSELECT=YES,CHANNELS=\"%d\",URI=\"media_%d.m3u8\"\n",
+                codec_name, codecpar->channels, name, lang, is_default ? "YES" : "NO", codecpar->channels, i);
+        }
+    }
+
+    if (is_dash)
+        snprintf(doc + len, size - len, "  </Period>\n</MPD>\n");
+
+    if ((rc = write_json_output(encoder_context, params, is_dash ? "audio_renditions.mpd" : "audio_renditions.m3u8",
+        avpipe_audio_rendition_manifest, doc)) == eav_success)
+        elv_log("AUDIO RENDITION manifest written renditions=%d, url=%s", encoder_context->n_audio_output, params->url);
+    free(doc);
+    return rc;
+}
+
 static int
 transcode_audio(
     coderctx_t *decoder_context,
@@ -2509,6 +4246,11 @@ transcode_audio(
 
         decoder_context->audio_pts[stream_index] = packet->pts;
 
+        if (params->blank && blank_frame(frame, AVMEDIA_TYPE_AUDIO) != eav_success) {
+            av_frame_unref(frame);
+            return eav_param;
+        }
+
         /* push the decoded frame into the filtergraph */
         int i = selected_decoded_audio(decoder_context, stream_index);
         if (i >= 0) {
@@ -2537,6 +4279,10 @@ transcode_audio(
             }
 
             dump_frame(1, stream_index, "FILT ", codec_context->frame_number, filt_frame, debug_frame_level);
+            if (params->measure_loudness)
+                update_loudness(decoder_context, i, filt_frame);
+            if (params->detect_silence)
+                update_qc_audio(decoder_context, params, i, filt_frame);
             ret = encode_frame(decoder_context, encoder_context, filt_frame, packet->stream_index, params, debug_frame_level);
             av_frame_unref(filt_frame);
             if (ret == eav_write_frame) {
@@ -2550,48 +4296,379 @@ transcode_audio(
     return eav_success;
 }
 
-#ifdef USE_RESAMPLE_AAC
+/*
+ * Writes a packet of audio rendition i, its timestamps are in the time base of the rendition stream.
+ */
 static int
-transcode_audio_aac(
-    coderctx_t *decoder_context,
+write_rendition_packet(
     coderctx_t *encoder_context,
+    xcparams_t *params,
+    int i,
     AVPacket *packet,
-    AVFrame *frame,
-    int stream_index,
-    xcparams_t *p,
     int debug_frame_level)
 {
-    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
-    AVCodecContext *output_codec_context = encoder_context->codec_context[stream_index];
-    SwrContext *resampler_context = decoder_context->resampler_context;
-    int response;
-    AVFrame *filt_frame;
+    rendition_ctx_t *r = &encoder_context->renditions[i];
+    AVFormatContext *format_context = encoder_context->format_context2[i];
+    out_tracker_t *out_tracker = (out_tracker_t *) format_context->avpipe_opaque;
+    avpipe_io_handler_t *out_handlers = out_tracker->out_handlers;
+    ioctx_t *outctx = out_tracker->last_outctx;
     int ret;
 
-    if (debug_frame_level)
-        elv_dbg("DECODE stream_index=%d send_packet pts=%"PRId64" dts=%"PRId64
-            " duration=%d, input frame_size=%d, output frame_size=%d, url=%s",
-            stream_index, packet->pts, packet->dts,
-            packet->duration, codec_context->frame_size,
-            encoder_context->codec_context[stream_index]->frame_size, p->url);
+    packet->stream_index = 0;
+    packet->pts += params->start_pts;
+    packet->dts += params->start_pts;
 
-    if (p->bypass_transcoding) {
-        return do_bypass(1, decoder_context, encoder_context, packet, p, debug_frame_level);
+    if (r->first_pts == AV_NOPTS_VALUE)
+        r->first_pts = packet->pts;
+    if (r->end_pts == AV_NOPTS_VALUE || packet->pts + packet->duration > r->end_pts)
+        r->end_pts = packet->pts + packet->duration;
+    r->bytes_written += packet->size;
+    r->frames_written++;
+
+    dump_packet(1, "OUT ", packet, debug_frame_level);
+
+    /* Update the stats before writing the packet, the outctx might be freed in av_interleaved_write_frame() */
+    if (out_handlers->avpipe_stater && outctx) {
+        outctx->total_frames_written = r->frames_written;
+        outctx->frames_written++;
+        out_handlers->avpipe_stater(outctx, r->stream_index, out_stat_frame_written);
     }
 
-    response = avcodec_send_packet(codec_context, packet);
-    if (response < 0) {
-        /*
-         * AVERROR_INVALIDDATA means the frame is invalid (mostly because of bad header).
-         * Ignore the error and continue.
-         */
-        elv_err("Failure while sending an audio packet to the decoder: err=%d, %s, url=%s",
-            response, av_err2str(response), p->url);
-        // Ignore the error and continue
-        return eav_success;
+    ret = av_interleaved_write_frame(format_context, packet);
+    if (ret != 0) {
+        elv_err("Error %d writing audio rendition %d packet: %s, url=%s", ret, i, av_err2str(ret), params->url);
+        return eav_write_frame;
     }
+    return eav_success;
+}
 
-    while (response >= 0) {
+/*
+ * Encodes a filtered frame of audio rendition i (NULL flushes the encoder) and writes the packets.
+ */
+static int
+encode_rendition_frame(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int i,
+    AVFrame *frame,
+    int debug_frame_level)
+{
+    rendition_ctx_t *r = &encoder_context->renditions[i];
+    int rc = eav_success;
+    int ret;
+
+    ret = avcodec_send_frame(r->codec_context, frame);
+    if (ret < 0)
+        elv_err("Failed to send frame to audio rendition %d encoder err=%d, url=%s", i, ret, params->url);
+
+    AVPacket *packet = av_packet_alloc();
+    if (!packet)
+        return eav_mem_alloc;
+
+    while (ret >= 0) {
+        ret = avcodec_receive_packet(r->codec_context, packet);
+        if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF) {
+            break;
+        } else if (ret < 0) {
+            elv_err("Failure while receiving a packet from audio rendition %d encoder: %s, url=%s",
+                i, av_err2str(ret), params->url);
+            rc = eav_receive_packet;
+            break;
+        }
+
+        /* Same as encode_frame(), the encoder delay can give the first packet a negative pts */
+        if (packet->pts < 0) {
+            elv_log("Skipping audio rendition %d packet with negative pts %"PRId64, i, packet->pts);
+            av_packet_unref(packet);
+            continue;
+        }
+
+        av_packet_rescale_ts(packet, r->codec_context->time_base, r->stream->time_base);
+        rc = write_rendition_packet(encoder_context, params, i, packet, debug_frame_level);
+        av_packet_unref(packet);
+        if (rc != eav_success)
+            break;
+    }
+
+    av_packet_free(&packet);
+    return rc;
+}
+
+/*
+ * Pushes a decoded frame (NULL at the end) into the filter graph of audio rendition i and encodes the filtered frames.
+ */
+static int
+filter_rendition_frame(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int i,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    int debug_frame_level)
+{
+    rendition_ctx_t *r = &encoder_context->renditions[i];
+    AVRational time_base = av_buffersink_get_time_base(r->buffersink_ctx);
+    int ret;
+    int rc;
+
+    if (av_buffersrc_add_frame_flags(r->buffersrc_ctx, frame, AV_BUFFERSRC_FLAG_KEEP_REF) < 0) {
+        elv_err("Failure in feeding into audio rendition %d filtergraph, url=%s", i, params->url);
+        return eav_success;
+    }
+
+    while (1) {
+        ret = av_buffersink_get_frame(r->buffersink_ctx, filt_frame);
+        if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF)
+            break;
+        if (ret < 0) {
+            elv_err("Failed to execute audio rendition %d frame filter ret=%d, url=%s", i, ret, params->url);
+            return eav_receive_filter_frame;
+        }
+
+        if (filt_frame->pts != AV_NOPTS_VALUE)
+            filt_frame->pts = av_rescale_q(filt_frame->pts, time_base, r->codec_context->time_base);
+        dump_frame(1, r->stream_index, "FILT ", r->codec_context->frame_number, filt_frame, debug_frame_level);
+
+        rc = encode_rendition_frame(encoder_context, params, i, filt_frame, debug_frame_level);
+        av_frame_unref(filt_frame);
+        if (rc != eav_success)
+            return rc;
+    }
+    return eav_success;
+}
+
+/*
+ * Returns 1 if an audio rendition of the input stream is encoded, 0 if there is none or they are all passthrough.
+ */
+static int
+has_encoded_rendition(
+    coderctx_t *encoder_context,
+    int stream_index)
+{
+    for (int i=0; i<encoder_context->n_audio_output; i++) {
+        if (encoder_context->renditions[i].stream_index == stream_index &&
+            !encoder_context->renditions[i].passthrough)
+            return 1;
+    }
+    return 0;
+}
+
+/*
+ * Filters and encodes a decoded frame of the input stream for each of its encoded audio renditions.
+ */
+static int
+encode_renditions(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    int stream_index,
+    xcparams_t *params,
+    int debug_frame_level)
+{
+    int rc;
+
+    if (should_skip_encoding(decoder_context, encoder_context, stream_index, params, frame))
+        return eav_success;
+
+    for (int i=0; i<encoder_context->n_audio_output; i++) {
+        rendition_ctx_t *r = &encoder_context->renditions[i];
+        if (r->stream_index != stream_index || r->passthrough)
+            continue;
+        rc = filter_rendition_frame(encoder_context, params, i, frame, filt_frame, debug_frame_level);
+        if (rc != eav_success)
+            return rc;
+    }
+    return eav_success;
+}
+
+/*
+ * Copies the audio packet to the passthrough renditions of its stream, and decodes it if
+ * the stream has encoded renditions. The packets are copied with the timestamps of the input,
+ * like the encoded renditions.
+ */
+static int
+transcode_renditions(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    xcparams_t *params,
+    int debug_frame_level)
+{
+    int stream_index = packet->stream_index;
+    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+    int64_t pts_offset = packet->pts - decoder_context->audio_input_start_pts[stream_index];
+    int response;
+    int rc;
+
+    for (int i=0; i<encoder_context->n_audio_output; i++) {
+        rendition_ctx_t *r = &encoder_context->renditions[i];
+        if (r->stream_index != stream_index || !r->passthrough)
+            continue;
+
+        /* Drop the packets out of start_time_ts and duration_ts, the same as should_skip_encoding() */
+        if (packet->pts == AV_NOPTS_VALUE ||
+            pts_offset < params->start_time_ts ||
+            (params->duration_ts > 0 && pts_offset >= params->start_time_ts + params->duration_ts))
+            continue;
+
+        AVPacket *copy_packet = av_packet_clone(packet);
+        if (!copy_packet)
+            return eav_mem_alloc;
+        av_packet_rescale_ts(copy_packet, decoder_context->stream[stream_index]->time_base, r->stream->time_base);
+        copy_packet->pos = -1;
+        rc = write_rendition_packet(encoder_context, params, i, copy_packet, debug_frame_level);
+        av_packet_free(&copy_packet);
+        if (rc != eav_success)
+            return rc;
+    }
+
+    if (!has_encoded_rendition(encoder_context, stream_index))
+        return eav_success;
+
+    response = avcodec_send_packet(codec_context, packet);
+    if (response < 0) {
+        /* Same as transcode_audio(), ignore the invalid packets */
+        elv_err("Failure while sending an audio packet to the decoder: err=%d, %s, url=%s",
+            response, av_err2str(response), params->url);
+        return eav_success;
+    }
+
+    while (response >= 0) {
+        response = avcodec_receive_frame(codec_context, frame);
+        if (response == AVERROR(EAGAIN) || response == AVERROR_EOF) {
+            break;
+        } else if (response < 0) {
+            elv_err("Failure while receiving a frame from the decoder: %s, url=%s",
+                av_err2str(response), params->url);
+            return eav_receive_frame;
+        }
+
+        if (decoder_context->first_decoding_audio_pts[stream_index] == AV_NOPTS_VALUE) {
+            decoder_context->first_decoding_audio_pts[stream_index] = frame->pts;
+            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+            decoder_context->inctx->decoding_start_pts = decoder_context->first_decoding_audio_pts[stream_index];
+            elv_log("stream_index=%d first_decoding_audio_pts=%"PRId64,
+                stream_index, decoder_context->first_decoding_audio_pts[stream_index]);
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(decoder_context->inctx, stream_index, in_stat_decoding_audio_start_pts);
+        }
+
+        dump_frame(1, stream_index, "IN ", codec_context->frame_number, frame, debug_frame_level);
+
+        rc = check_pts_wrapped(&decoder_context->audio_last_input_pts[stream_index], frame, stream_index);
+        if (rc == eav_pts_wrapped) {
+            av_frame_unref(frame);
+            return rc;
+        }
+
+        decoder_context->audio_pts[stream_index] = packet->pts;
+
+        if (params->blank && blank_frame(frame, AVMEDIA_TYPE_AUDIO) != eav_success) {
+            av_frame_unref(frame);
+            return eav_param;
+        }
+
+        rc = encode_renditions(decoder_context, encoder_context, frame, filt_frame, stream_index, params, debug_frame_level);
+        av_frame_unref(frame);
+        if (rc != eav_success)
+            return rc;
+    }
+    return eav_success;
+}
+
+/*
+ * Flushes the audio decoders of the encoded renditions, then their filters and encoders.
+ */
+static int
+flush_renditions(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int debug_frame_level)
+{
+    AVFrame *frame = av_frame_alloc();
+    AVFrame *filt_frame = av_frame_alloc();
+    int rc = eav_success;
+
+    for (int j=0; j<decoder_context->n_audio && rc == eav_success; j++) {
+        int stream_index = decoder_context->audio_stream_index[j];
+        AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+        int response;
+
+        if (!codec_context || !has_encoded_rendition(encoder_context, stream_index))
+            continue;
+
+        response = avcodec_send_packet(codec_context, NULL);    /* Passing NULL means flush the decoder buffers */
+        while (response >= 0 && rc == eav_success) {
+            response = avcodec_receive_frame(codec_context, frame);
+            if (response < 0)
+                break;
+            dump_frame(1, stream_index, "IN FLUSH", codec_context->frame_number, frame, debug_frame_level);
+            if (params->blank)
+                blank_frame(frame, AVMEDIA_TYPE_AUDIO);
+            rc = encode_renditions(decoder_context, encoder_context, frame, filt_frame, stream_index, params, debug_frame_level);
+            av_frame_unref(frame);
+        }
+    }
+
+    for (int i=0; i<encoder_context->n_audio_output && rc == eav_success; i++) {
+        if (encoder_context->renditions[i].passthrough)
+            continue;
+        rc = filter_rendition_frame(encoder_context, params, i, NULL, filt_frame, debug_frame_level);
+        if (rc == eav_success)
+            rc = encode_rendition_frame(encoder_context, params, i, NULL, debug_frame_level);
+    }
+
+    av_frame_free(&frame);
+    av_frame_free(&filt_frame);
+    return rc;
+}
+
+#ifdef USE_RESAMPLE_AAC
+static int
+transcode_audio_aac(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    AVFrame *frame,
+    int stream_index,
+    xcparams_t *p,
+    int debug_frame_level)
+{
+    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+    AVCodecContext *output_codec_context = encoder_context->codec_context[stream_index];
+    SwrContext *resampler_context = decoder_context->resampler_context;
+    int response;
+    AVFrame *filt_frame;
+    int ret;
+
+    if (debug_frame_level)
+        elv_dbg("DECODE stream_index=%d send_packet pts=%"PRId64" dts=%"PRId64
+            " duration=%d, input frame_size=%d, output frame_size=%d, url=%s",
+            stream_index, packet->pts, packet->dts,
+            packet->duration, codec_context->frame_size,
+            encoder_context->codec_context[stream_index]->frame_size, p->url);
+
+    if (p->bypass_transcoding) {
+        return do_bypass(1, decoder_context, encoder_context, packet, p, debug_frame_level);
+    }
+
+    response = avcodec_send_packet(codec_context, packet);
+    if (response < 0) {
+        /*
+         * AVERROR_INVALIDDATA means the frame is invalid (mostly because of bad header).
+         * Ignore the error and continue.
+         */
+        elv_err("Failure while sending an audio packet to the decoder: err=%d, %s, url=%s",
+            response, av_err2str(response), p->url);
+        // Ignore the error and continue
+        return eav_success;
+    }
+
+    while (response >= 0) {
         response = avcodec_receive_frame(codec_context, frame);
         if (response == AVERROR(EAGAIN) || response == AVERROR_EOF) {
             break;
@@ -2613,6 +4690,11 @@ transcode_audio_aac(
 
         dump_frame(1, stream_index, "IN ", codec_context->frame_number, frame, debug_frame_level);
 
+        if (p->blank && blank_frame(frame, AVMEDIA_TYPE_AUDIO) != eav_success) {
+            av_frame_unref(frame);
+            return eav_param;
+        }
+
         ret = check_pts_wrapped(&decoder_context->audio_last_input_pts[stream_index], frame, stream_index);
         if (ret == eav_pts_wrapped) {
             av_frame_unref(frame);
@@ -2712,26 +4794,92 @@ transcode_audio_aac(
 }
 #endif
 
-static int
-transcode_video(
+/*
+ * Decodes the CEA-608/708 captions of a decoded video frame. If xc_type is xc_extract_captions the
+ * caption segments are cut every segment duration, otherwise they follow the video segments (see encode_frame()).
+ */
+static void
+decode_captions(
     coderctx_t *decoder_context,
     coderctx_t *encoder_context,
-    AVPacket *packet,
     AVFrame *frame,
-    AVFrame *filt_frame,
-    int stream_index,
-    xcparams_t *p,
-    int do_instrument,
-    int debug_frame_level)
+    xcparams_t *p)
 {
-    int ret;
-    struct timeval tv;
-    u_int64_t since;
-    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
-    int response;
+    AVFrameSideData *sd;
+    AVStream *stream = encoder_context->stream[encoder_context->video_stream_index];
+    int64_t pts;
 
-    if (debug_frame_level)
-        elv_dbg("DECODE stream_index=%d send_packet pts=%"PRId64" dts=%"PRId64" duration=%d",
+    if (!encoder_context->cc || frame->pts == AV_NOPTS_VALUE)
+        return;
+
+    /* start_pts is in the encoder time base, like in encode_frame() */
+    pts = av_rescale_q(frame->pts,
+        decoder_context->stream[decoder_context->video_stream_index]->time_base, stream->time_base) + p->start_pts;
+    if (encoder_context->cc_last_pts != AV_NOPTS_VALUE && pts > encoder_context->cc_last_pts)
+        encoder_context->cc_frame_duration = pts - encoder_context->cc_last_pts;
+    encoder_context->cc_last_pts = pts;
+
+    if (p->xc_type == xc_extract_captions) {
+        int64_t seg_duration = p->video_seg_duration_ts;
+        if (seg_duration <= 0 && p->seg_duration)
+            seg_duration = (int64_t) (atof(p->seg_duration) * stream->time_base.den / stream->time_base.num);
+
+        if (encoder_context->cc_seg_index < 0) {
+            elv_io_caption_segment(encoder_context, p, atoi(p->start_segment_str), pts);
+        } else {
+            while (seg_duration > 0 &&
+                pts >= encoder_context->cc_start_pts +
+                    (encoder_context->cc_seg_index - encoder_context->cc_first_seg_index + 1) * seg_duration) {
+                elv_io_caption_segment(encoder_context, p, encoder_context->cc_seg_index + 1,
+                    encoder_context->cc_start_pts +
+                    (encoder_context->cc_seg_index - encoder_context->cc_first_seg_index + 1) * seg_duration);
+            }
+        }
+    }
+
+    sd = av_frame_get_side_data(frame, AV_FRAME_DATA_A53_CC);
+    if (sd)
+        cc_decode(encoder_context->cc, sd->data, sd->size, pts);
+}
+
+/*
+ * Moves the A/53 captions of a decoded video frame to the pass through queue, so that the filters can not
+ * drop or duplicate them. They are added back to the filtered frames in encode_frame().
+ */
+static void
+queue_captions(
+    coderctx_t *encoder_context,
+    AVFrame *frame)
+{
+    AVFrameSideData *sd = av_frame_get_side_data(frame, AV_FRAME_DATA_A53_CC);
+
+    if (!sd)
+        return;
+    if (encoder_context->a53)
+        cc_a53_push(encoder_context->a53, sd->data, sd->size);
+    av_frame_remove_side_data(frame, AV_FRAME_DATA_A53_CC);
+}
+
+static int
+transcode_video(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    int stream_index,
+    xcparams_t *p,
+    int do_instrument,
+    int debug_frame_level)
+{
+    int ret;
+    struct timeval tv;
+    u_int64_t since;
+    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+    int response;
+
+    if (debug_frame_level)
+        elv_dbg("DECODE stream_index=%d send_packet pts=%"PRId64" dts=%"PRId64" duration=%d",
             stream_index, packet->pts, packet->dts, packet->duration);
 
     if (p->bypass_transcoding) {
@@ -2829,6 +4977,14 @@ transcode_video(
 
         decoder_context->video_pts = packet->pts;
 
+        if (p->blank && blank_frame(frame, AVMEDIA_TYPE_VIDEO) != eav_success) {
+            av_frame_unref(frame);
+            return eav_param;
+        }
+
+        decode_captions(decoder_context, encoder_context, frame, p);
+        queue_captions(encoder_context, frame);
+
         /* push the decoded frame into the filtergraph */
         elv_get_time(&tv);
         if (av_buffersrc_add_frame_flags(decoder_context->video_buffersrc_ctx, frame, AV_BUFFERSRC_FLAG_KEEP_REF) < 0) {
@@ -2868,6 +5024,12 @@ transcode_video(
 
             dump_frame(0, stream_index, "FILT ", codec_context->frame_number, filt_frame, debug_frame_level);
             filt_frame->pkt_dts = filt_frame->pts;
+            if (p->detect_crop)
+                update_crop(decoder_context, filt_frame);
+            if (p->detect_black || p->detect_freeze)
+                update_qc_video(decoder_context, p, filt_frame);
+            if (p->detect_scenes)
+                update_scenes(decoder_context, p, filt_frame);
 
             elv_get_time(&tv);
             if (decoder_context->video_duration < filt_frame->pts) {
@@ -2948,17 +5110,29 @@ transcode_video_func(
 
         dump_packet(0, "IN THREAD", packet, xctx->debug_frame_level);
 
-        err = transcode_video(
-                decoder_context,
-                encoder_context,
-                packet,
-                frame,
-                filt_frame,
-                packet->stream_index,
-                params,
-                xctx->do_instrument,
-                xctx->debug_frame_level
-            );
+        if (params->smart_cut)
+            err = smart_cut_video(
+                    decoder_context,
+                    encoder_context,
+                    packet,
+                    frame,
+                    filt_frame,
+                    params,
+                    xctx->do_instrument,
+                    xctx->debug_frame_level
+                );
+        else
+            err = transcode_video(
+                    decoder_context,
+                    encoder_context,
+                    packet,
+                    frame,
+                    filt_frame,
+                    packet->stream_index,
+                    params,
+                    xctx->do_instrument,
+                    xctx->debug_frame_level
+                );
 
         av_frame_unref(frame);
         av_frame_unref(filt_frame);
@@ -3018,13 +5192,24 @@ transcode_audio_func(
 
         dump_packet(1, "IN THREAD", packet, xctx->debug_frame_level);
 
+        if (params->n_audio_renditions > 0) {
+            err = transcode_renditions(
+                decoder_context,
+                encoder_context,
+                packet,
+                frame,
+                filt_frame,
+                params,
+                xctx->debug_frame_level);
+            av_frame_unref(filt_frame);
+        }
 #ifdef USE_RESAMPLE_AAC
         /*
          * If decoder frame_size is not set (or it is zero), then using fifo for transcoding would not work,
          * so fallback to use audio filtering for transcoding.
          * Optimal solution would be to make filtering working for both aac and other cases (RM).
          */
-        if (!strcmp(params->ecodec2, "aac") &&
+        else if (!strcmp(params->ecodec2, "aac") &&
             params->xc_type != xc_audio_join &&
             params->xc_type != xc_audio_merge &&
             params->xc_type != xc_audio_pan) {
@@ -3049,16 +5234,18 @@ transcode_audio_func(
             av_frame_unref(filt_frame);
         }
 #else
-        err = transcode_audio(
-            decoder_context,
-            encoder_context,
-            packet,
-            frame,
-            filt_frame,
-            packet->stream_index,
-            params,
-            xctx->debug_frame_level);
-        av_frame_unref(filt_frame);
+        else {
+            err = transcode_audio(
+                decoder_context,
+                encoder_context,
+                packet,
+                frame,
+                filt_frame,
+                packet->stream_index,
+                params,
+                xctx->debug_frame_level);
+            av_frame_unref(filt_frame);
+        }
 #endif
 
         av_frame_unref(frame);
@@ -3126,6 +5313,16 @@ flush_decoder(
         dump_frame(selected_decoded_audio(decoder_context, stream_index) >= 0, stream_index,
             "IN FLUSH", codec_context->frame_number, frame, debug_frame_level);
 
+        if (codec_context->codec_type == AVMEDIA_TYPE_VIDEO) {
+            decode_captions(decoder_context, encoder_context, frame, p);
+            queue_captions(encoder_context, frame);
+        }
+
+        if (p->blank &&
+            (codec_context->codec_type == AVMEDIA_TYPE_VIDEO || codec_context->codec_type == AVMEDIA_TYPE_AUDIO) &&
+            blank_frame(frame, codec_context->codec_type) != eav_success)
+            break;
+
         if (codec_context->codec_type == AVMEDIA_TYPE_VIDEO ||
             codec_context->codec_type == AVMEDIA_TYPE_AUDIO) {
 
@@ -3150,6 +5347,22 @@ flush_decoder(
                 dump_frame(selected_decoded_audio(decoder_context, stream_index) >= 0, stream_index,
                     "FILT ", codec_context->frame_number, filt_frame, debug_frame_level);
 
+                if (p->measure_loudness && !p->bypass_transcoding &&
+                    codec_context->codec_type == AVMEDIA_TYPE_AUDIO && i >= 0)
+                    update_loudness(decoder_context, i, filt_frame);
+                if (p->detect_silence && !p->bypass_transcoding &&
+                    codec_context->codec_type == AVMEDIA_TYPE_AUDIO && i >= 0)
+                    update_qc_audio(decoder_context, p, i, filt_frame);
+                if (p->detect_crop && !p->bypass_transcoding &&
+                    codec_context->codec_type == AVMEDIA_TYPE_VIDEO)
+                    update_crop(decoder_context, filt_frame);
+                if ((p->detect_black || p->detect_freeze) && !p->bypass_transcoding &&
+                    codec_context->codec_type == AVMEDIA_TYPE_VIDEO)
+                    update_qc_video(decoder_context, p, filt_frame);
+                if (p->detect_scenes && !p->bypass_transcoding &&
+                    codec_context->codec_type == AVMEDIA_TYPE_VIDEO)
+                    update_scenes(decoder_context, p, filt_frame);
+
                 ret = encode_frame(decoder_context, encoder_context, filt_frame, stream_index, p, debug_frame_level);
                 av_frame_unref(filt_frame);
                 if (ret == eav_write_frame) {
@@ -3167,155 +5380,518 @@ flush_decoder(
     return eav_success;
 }
 
-int
-should_stop_decoding(
-    AVPacket *input_packet,
+/*
+ * Smart cut: the video packets are kept one GOP at a time. The GOP that has the start (start_time_ts) and the GOP
+ * that has the end (start_time_ts + duration_ts) are decoded and re-encoded, the frames out of the range are skipped
+ * by should_skip_encoding(). The GOPs in between are copied. The encoder has no B-frames and no delay, so each
+ * re-encoded GOP is written before the next copied packet, and its SPS/PPS have other ids than the input ones.
+ * Every GOP carries its SPS/PPS in-band (see smart_cut_write_packet()) and the sample entry is avc3, the avcC
+ * only has the encoder SPS/PPS. The input GOPs must be closed.
+ */
+static int
+smart_cut_init(
     coderctx_t *decoder_context,
     coderctx_t *encoder_context,
-    xcparams_t *params,
-    int64_t audio_frames_read,
-    int64_t video_frames_read,
-    int *frames_read_past_duration,
-    int frames_allowed_past_duration)
+    xcparams_t *params)
 {
-    int64_t input_packet_rel_pts = 0;
-    int stream_index = input_packet->stream_index;
+    int index = decoder_context->video_stream_index;
+    AVCodecParameters *in_codecpar;
+    AVCodecParameters *out_codecpar;
+    AVCodecContext *encoder_codec_context;
+    uint8_t *in_extradata;
+    int in_extradata_size;
+    int rc;
 
-    if (decoder_context->cancelled)
-        return 1;
+    if (index < 0 || !encoder_context->codec_context[index]) {
+        elv_err("Invalid smart_cut - no video to cut, url=%s", params->url);
+        return eav_param;
+    }
 
-    if (stream_index != decoder_context->video_stream_index &&
-        selected_decoded_audio(decoder_context, stream_index) < 0)
-        return 0;
+    in_codecpar = decoder_context->stream[index]->codecpar;
+    out_codecpar = encoder_context->stream[index]->codecpar;
+    encoder_codec_context = encoder_context->codec_context[index];
+
+    /* The copied packets must be decodable with the re-encoded ones */
+    if (in_codecpar->codec_id != AV_CODEC_ID_H264 ||
+        encoder_codec_context->width != in_codecpar->width ||
+        encoder_codec_context->height != in_codecpar->height ||
+        encoder_codec_context->pix_fmt != in_codecpar->format) {
+        elv_err("Invalid smart_cut - the input video must be h264 with the encoding size and pixel format, "
+            "codec=%s, size=%dx%d, enc_size=%dx%d, pix_fmt=%s, enc_pix_fmt=%s, url=%s",
+            avcodec_get_name(in_codecpar->codec_id), in_codecpar->width, in_codecpar->height,
+            encoder_codec_context->width, encoder_codec_context->height,
+            av_get_pix_fmt_name(in_codecpar->format), av_get_pix_fmt_name(encoder_codec_context->pix_fmt), params->url);
+        return eav_param;
+    }
 
-    if (stream_index == decoder_context->video_stream_index &&
-        (params->xc_type & xc_video)) {
-        if (decoder_context->video_input_start_pts == AV_NOPTS_VALUE) {
-            decoder_context->video_input_start_pts = input_packet->pts;
-            elv_log("video_input_start_pts=%"PRId64" flags=%d dts=%"PRId64,
-                decoder_context->video_input_start_pts, input_packet->flags, input_packet->dts);
-        }
+    decoder_context->smart_cut_state = smart_cut_head;
+    decoder_context->smart_cut_dts_delay = AV_NOPTS_VALUE;
+    in_extradata = in_codecpar->extradata;
+    in_extradata_size = in_codecpar->extradata_size;
 
-        input_packet_rel_pts = input_packet->pts - decoder_context->video_input_start_pts;
-    } else if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
-        params->xc_type & xc_audio) {
-        if (decoder_context->audio_input_start_pts[stream_index] == AV_NOPTS_VALUE) {
-            decoder_context->audio_input_start_pts[stream_index] = input_packet->pts;
-            elv_log("stream_index=%d audio_input_start_pts=%"PRId64,
-                stream_index, decoder_context->audio_input_start_pts[stream_index]);
-        }
+    /* The encoder writes annexb, convert the copied avcC packets too */
+    if (in_codecpar->extradata_size > 0 && in_codecpar->extradata[0] == 1) {
+        const AVBitStreamFilter *filter = av_bsf_get_by_name("h264_mp4toannexb");
+        AVBSFContext *bsf;
 
-        input_packet_rel_pts = input_packet->pts - decoder_context->audio_input_start_pts[stream_index];
+        if (!filter || av_bsf_alloc(filter, &decoder_context->smart_cut_bsf) < 0) {
+            elv_err("Failed to allocate h264_mp4toannexb for smart_cut, url=%s", params->url);
+            return eav_mem_alloc;
+        }
+        bsf = decoder_context->smart_cut_bsf;
+        if (avcodec_parameters_copy(bsf->par_in, in_codecpar) < 0) {
+            elv_err("Failed to copy codec parameters to h264_mp4toannexb, url=%s", params->url);
+            return eav_codec_param;
+        }
+        bsf->time_base_in = decoder_context->stream[index]->time_base;
+        if ((rc = av_bsf_init(bsf)) < 0) {
+            elv_err("Failed to initialize h264_mp4toannexb for smart_cut, err=%s, url=%s", av_err2str(rc), params->url);
+            return eav_codec_param;
+        }
+        in_extradata = bsf->par_out->extradata;
+        in_extradata_size = bsf->par_out->extradata_size;
     }
 
-    /* PENDING (RM) for some of the live feeds (like RTMP) we need to scale input_packet_rel_pts */
-    if (params->duration_ts != -1 &&
-        input_packet->pts != AV_NOPTS_VALUE &&
-        input_packet_rel_pts >= params->start_time_ts + params->duration_ts) {
+    /* The annexb SPS/PPS of the input, added to the copied key frames that don't have them */
+    decoder_context->smart_cut_extradata = in_extradata;
+    decoder_context->smart_cut_extradata_size = in_extradata_size;
 
-        (*frames_read_past_duration) ++;
-        elv_dbg("DURATION OVER param start_time=%"PRId64" duration=%"PRId64" pkt pts=%"PRId64" rel_pts=%"PRId64" "
-                "audio_frames_read=%"PRId64", video_frames_read=%"PRId64", past_duration=%d",
-                params->start_time_ts, params->duration_ts, input_packet->pts, input_packet_rel_pts,
-                audio_frames_read, video_frames_read, *frames_read_past_duration);
+    elv_log("SMART CUT start_time_ts=%"PRId64" duration_ts=%"PRId64" profile=%d level=%d bit_rate=%"PRId64", url=%s",
+        params->start_time_ts, params->duration_ts, encoder_codec_context->profile, encoder_codec_context->level,
+        encoder_codec_context->bit_rate, params->url);
+    return eav_success;
+}
 
-        /* If it is a bypass simply return since there is no decoding/encoding involved */
-        if (params->bypass_transcoding)
-            return 1;
+static void
+smart_cut_free_gop(
+    coderctx_t *decoder_context)
+{
+    for (int i=0; i<decoder_context->smart_cut_gop_len; i++)
+        av_packet_free(&decoder_context->smart_cut_gop[i]);
+    decoder_context->smart_cut_gop_len = 0;
+}
 
-        /* Allow decoding past specified duration to accommodate reordered packets */
-        if (*frames_read_past_duration > frames_allowed_past_duration) {
-            elv_dbg("frames_read_past_duration=%d, frames_allowed_past_duration=%d",
-                        *frames_read_past_duration, frames_allowed_past_duration);
-            return 1;
-        }
-    }
+static int
+smart_cut_add_packet(
+    coderctx_t *decoder_context,
+    AVPacket *packet)
+{
+    AVPacket *gop_packet;
 
-    if (input_packet->pts != AV_NOPTS_VALUE) {
-        if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
-            params->xc_type & xc_audio)
-            encoder_context->audio_last_pts_read[stream_index] = input_packet->pts;
-        else if (stream_index == decoder_context->video_stream_index &&
-            params->xc_type & xc_video)
-            encoder_context->video_last_pts_read = input_packet->pts;
+    if (decoder_context->smart_cut_gop_len == decoder_context->smart_cut_gop_size) {
+        int size = decoder_context->smart_cut_gop_size > 0 ? 2 * decoder_context->smart_cut_gop_size : 256;
+        AVPacket **gop = av_realloc_array(decoder_context->smart_cut_gop, size, sizeof(AVPacket *));
+        if (!gop)
+            return eav_mem_alloc;
+        decoder_context->smart_cut_gop = gop;
+        decoder_context->smart_cut_gop_size = size;
     }
-    return 0;
+
+    gop_packet = av_packet_clone(packet);
+    if (!gop_packet)
+        return eav_mem_alloc;
+    decoder_context->smart_cut_gop[decoder_context->smart_cut_gop_len++] = gop_packet;
+    return eav_success;
 }
 
+/*
+ * Returns 1 if a packet of the current GOP is at or past the end of the cut.
+ */
 static int
-skip_until_start_time_pts(
+smart_cut_gop_has_end(
     coderctx_t *decoder_context,
-    AVPacket *input_packet,
     xcparams_t *params)
 {
-    /* If start_time_ts > 0 and it is a bypass skip here
-     * Also if start_time_ts > 0 and skip_decoding is set then skip here
-     */
-    if (params->start_time_ts <= 0 || (!params->skip_decoding && !params->bypass_transcoding))
+    if (params->duration_ts <= 0)
         return 0;
 
-    /* If the format is not dash/hls then return.
-     * For dash/hls format, we know the mezzanines are generated by avpipe
-     * and there is no BFrames in mezzanines. Therefore, it is safe to skip
-     * the frame without decoding the frame.
-     */
-    if (strcmp(params->format, "dash") && strcmp(params->format, "hls"))
-        return 0;
+    for (int i=0; i<decoder_context->smart_cut_gop_len; i++) {
+        AVPacket *packet = decoder_context->smart_cut_gop[i];
+        if (packet->pts != AV_NOPTS_VALUE &&
+            packet->pts - decoder_context->video_input_start_pts >= params->start_time_ts + params->duration_ts)
+            return 1;
+    }
+    return 0;
+}
 
-    int64_t input_start_pts;
-    if (params->xc_type == xc_video)
-        input_start_pts = decoder_context->video_input_start_pts;
-    else
-        input_start_pts = decoder_context->audio_input_start_pts[input_packet->stream_index];
+/*
+ * Decodes and encodes the current GOP, then resets the decoder for the next one.
+ */
+static int
+smart_cut_encode_gop(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    xcparams_t *params,
+    int do_instrument,
+    int debug_frame_level)
+{
+    int stream_index = decoder_context->video_stream_index;
+    int rc = eav_success;
 
-    const int64_t packet_in_pts_offset = input_packet->pts - input_start_pts;
-    /* Drop frames before the desired 'start_time' */
-    if (packet_in_pts_offset < params->start_time_ts) {
-        elv_dbg("PREDECODE SKIP frame early stream_index=%d, pts=%" PRId64 ", start_time_ts=%" PRId64
-            ", input_start_pts=%" PRId64 ", packet_in_pts_offset=%" PRId64,
-            input_packet->stream_index,
-            input_packet->pts, params->start_time_ts,
-            input_start_pts, packet_in_pts_offset);
-        return 1;
+    if (decoder_context->smart_cut_gop_len == 0)
+        return eav_success;
+
+    elv_log("SMART CUT encode GOP pts=%"PRId64" packets=%d, url=%s",
+        decoder_context->smart_cut_gop[0]->pts, decoder_context->smart_cut_gop_len, params->url);
+
+    /* The re-encoded GOP starts with an IDR frame */
+    encoder_context->smart_cut_key = 1;
+    for (int i=0; i<decoder_context->smart_cut_gop_len && rc == eav_success; i++) {
+        rc = transcode_video(decoder_context, encoder_context, decoder_context->smart_cut_gop[i],
+            frame, filt_frame, stream_index, params, do_instrument, debug_frame_level);
+        av_frame_unref(frame);
+        av_frame_unref(filt_frame);
     }
 
-    return 0;
+    if (rc == eav_success)
+        rc = flush_decoder(decoder_context, encoder_context, stream_index, params, debug_frame_level);
+    avcodec_flush_buffers(decoder_context->codec_context[stream_index]);
+    smart_cut_free_gop(decoder_context);
+    return rc;
 }
 
 static int
-skip_for_sync(
+smart_cut_write_packet(
     coderctx_t *decoder_context,
-    AVPacket *input_packet,
-    xcparams_t *params)
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    xcparams_t *params,
+    int debug_frame_level)
 {
-    if (params->sync_audio_to_stream_id < 0)
-        return 0;
+    int stream_index = decoder_context->video_stream_index;
+    AVFormatContext *format_context = encoder_context->format_context;
+    out_tracker_t *out_tracker = (out_tracker_t *) format_context->avpipe_opaque;
+    avpipe_io_handler_t *out_handlers = out_tracker->out_handlers;
+    ioctx_t *outctx = out_tracker->last_outctx;
+    int size = decoder_context->smart_cut_extradata_size;
+    int ret;
 
-    /* No need to sync if:
-     * - it is not a live source (mpegts, rtmp, srt, rtp)
-     * - or it is already synced
-     * - or format is not fmp4-segment.
-     */
-    if (!is_live_source(decoder_context) ||
-        decoder_context->is_av_synced ||
-        strcmp(params->format, "fmp4-segment"))
-        return 0;
+    /* The decoder needs the input SPS/PPS again after a re-encoded GOP */
+    if ((packet->flags & AV_PKT_FLAG_KEY) && size > 0 && !h264_has_sps(packet->data, packet->size)) {
+        if (av_grow_packet(packet, size) < 0)
+            return eav_mem_alloc;
+        memmove(packet->data + size, packet->data, packet->size - size);
+        memcpy(packet->data, decoder_context->smart_cut_extradata, size);
+    }
 
-    /* Check if the packet is video and it is a key frame */
-    if (input_packet->stream_index == decoder_context->video_stream_index) {
-        /* first_key_frame_pts points to first video key frame. */
-        if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE &&
-            input_packet->flags == AV_PKT_FLAG_KEY) {
-            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
-            decoder_context->first_key_frame_pts = input_packet->pts;
-            decoder_context->inctx->first_key_frame_pts = decoder_context->first_key_frame_pts;
-            elv_log("PTS first_key_frame_pts=%"PRId64" sidx=%d flags=%d dts=%"PRId64,
-                decoder_context->first_key_frame_pts, input_packet->stream_index, input_packet->flags, input_packet->dts);
+    av_packet_rescale_ts(packet,
+        decoder_context->stream[stream_index]->time_base,
+        encoder_context->stream[stream_index]->time_base);
+    packet->pts += params->start_pts;
+    packet->dts += params->start_pts;
+    if (format_context->nb_streams == 1)
+        packet->stream_index = 0;
 
-            if (in_handlers->avpipe_stater)
-                in_handlers->avpipe_stater(decoder_context->inctx, input_packet->stream_index, in_stat_first_keyframe_pts);
+    /* The next encoded packet follows the copied one */
+    encoder_context->video_pts = packet->pts;
+    encoder_context->video_frames_written++;
 
-            dump_packet(0, "SYNC ", input_packet, 1);
+    dump_packet(0, "COPY ", packet, debug_frame_level);
+
+    if (out_handlers->avpipe_stater && outctx) {
+        outctx->total_frames_written = encoder_context->video_frames_written;
+        outctx->frames_written++;
+        out_handlers->avpipe_stater(outctx, stream_index, out_stat_frame_written);
+    }
+
+    ret = av_interleaved_write_frame(format_context, packet);
+    if (ret < 0) {
+        elv_err("Failure in copying smart_cut packet error=%s (%d) url=%s", av_err2str(ret), ret, params->url);
+        return eav_write_frame;
+    }
+    return eav_success;
+}
+
+/*
+ * Copies the current GOP to the output, converted to annexb like the encoded packets.
+ */
+static int
+smart_cut_copy_gop(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int debug_frame_level)
+{
+    AVBSFContext *bsf = decoder_context->smart_cut_bsf;
+    int rc = eav_success;
+    int ret;
+
+    if (decoder_context->smart_cut_gop_len == 0)
+        return eav_success;
+
+    if (debug_frame_level)
+        elv_dbg("SMART CUT copy GOP pts=%"PRId64" packets=%d, url=%s",
+            decoder_context->smart_cut_gop[0]->pts, decoder_context->smart_cut_gop_len, params->url);
+
+    for (int i=0; i<decoder_context->smart_cut_gop_len && rc == eav_success; i++) {
+        AVPacket *packet = decoder_context->smart_cut_gop[i];
+
+        if (!bsf) {
+            rc = smart_cut_write_packet(decoder_context, encoder_context, packet, params, debug_frame_level);
+            continue;
+        }
+
+        if ((ret = av_bsf_send_packet(bsf, packet)) < 0) {
+            elv_err("Failed to convert smart_cut packet pts=%"PRId64", err=%s, url=%s",
+                packet->pts, av_err2str(ret), params->url);
+            rc = eav_write_frame;
+            break;
+        }
+        while ((ret = av_bsf_receive_packet(bsf, packet)) == 0 && rc == eav_success) {
+            rc = smart_cut_write_packet(decoder_context, encoder_context, packet, params, debug_frame_level);
+            av_packet_unref(packet);
+        }
+        if (rc == eav_success && ret != AVERROR(EAGAIN)) {
+            elv_err("Failed to convert smart_cut packet, err=%s, url=%s", av_err2str(ret), params->url);
+            rc = eav_write_frame;
+        }
+    }
+
+    smart_cut_free_gop(decoder_context);
+    return rc;
+}
+
+/*
+ * Keeps the video packet in the current GOP, and re-encodes or copies the previous GOP when a key frame starts a new one.
+ */
+static int
+smart_cut_video(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    xcparams_t *params,
+    int do_instrument,
+    int debug_frame_level)
+{
+    int64_t rel_pts = packet->pts - decoder_context->video_input_start_pts;
+    int64_t end_ts = params->duration_ts > 0 ? params->start_time_ts + params->duration_ts : INT64_MAX;
+    int rc;
+
+    if (decoder_context->smart_cut_state == smart_cut_done)
+        return eav_success;
+
+    if (packet->pts != AV_NOPTS_VALUE && (packet->flags & AV_PKT_FLAG_KEY)) {
+        if (decoder_context->smart_cut_dts_delay == AV_NOPTS_VALUE && packet->dts != AV_NOPTS_VALUE)
+            decoder_context->smart_cut_dts_delay = packet->pts - packet->dts;
+
+        if (decoder_context->smart_cut_state == smart_cut_head) {
+            /* The GOP read so far has the start */
+            if (rel_pts > params->start_time_ts &&
+                (rc = smart_cut_encode_gop(decoder_context, encoder_context, frame, filt_frame,
+                    params, do_instrument, debug_frame_level)) != eav_success)
+                return rc;
+            smart_cut_free_gop(decoder_context);
+            if (rel_pts >= params->start_time_ts) {
+                elv_log("SMART CUT copy from pts=%"PRId64", url=%s", packet->pts, params->url);
+                decoder_context->smart_cut_state = smart_cut_copy;
+            }
+        } else {
+            /* The GOP that has the end is re-encoded when flushing */
+            if (smart_cut_gop_has_end(decoder_context, params)) {
+                decoder_context->smart_cut_state = smart_cut_done;
+                return eav_success;
+            }
+            if ((rc = smart_cut_copy_gop(decoder_context, encoder_context, params, debug_frame_level)) != eav_success)
+                return rc;
+        }
+
+        if (rel_pts >= end_ts) {
+            decoder_context->smart_cut_state = smart_cut_done;
+            return eav_success;
+        }
+    } else if (decoder_context->smart_cut_gop_len == 0) {
+        /* Can't decode without the key frame */
+        return eav_success;
+    } else if (packet->pts != AV_NOPTS_VALUE && packet->pts < decoder_context->smart_cut_gop[0]->pts) {
+        elv_err("Invalid smart_cut - open GOP, packet pts=%"PRId64" before key frame pts=%"PRId64", url=%s",
+            packet->pts, decoder_context->smart_cut_gop[0]->pts, params->url);
+        return eav_param;
+    }
+
+    return smart_cut_add_packet(decoder_context, packet);
+}
+
+/*
+ * Re-encodes the last GOP if it has the end of the cut (or the start), otherwise copies it.
+ */
+static int
+smart_cut_flush(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int debug_frame_level)
+{
+    AVFrame *frame;
+    AVFrame *filt_frame;
+    int rc;
+
+    if (decoder_context->smart_cut_state == smart_cut_copy && !smart_cut_gop_has_end(decoder_context, params))
+        return smart_cut_copy_gop(decoder_context, encoder_context, params, debug_frame_level);
+
+    frame = av_frame_alloc();
+    filt_frame = av_frame_alloc();
+    rc = smart_cut_encode_gop(decoder_context, encoder_context, frame, filt_frame, params, 0, debug_frame_level);
+    av_frame_free(&filt_frame);
+    av_frame_free(&frame);
+    return rc;
+}
+
+int
+should_stop_decoding(
+    AVPacket *input_packet,
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int64_t audio_frames_read,
+    int64_t video_frames_read,
+    int *frames_read_past_duration,
+    int frames_allowed_past_duration)
+{
+    int64_t input_packet_rel_pts = 0;
+    int stream_index = input_packet->stream_index;
+
+    if (decoder_context->cancelled)
+        return 1;
+
+    if (stream_index != decoder_context->video_stream_index &&
+        selected_decoded_audio(decoder_context, stream_index) < 0)
+        return 0;
+
+    if (stream_index == decoder_context->video_stream_index &&
+        (params->xc_type & xc_video)) {
+        if (decoder_context->video_input_start_pts == AV_NOPTS_VALUE) {
+            decoder_context->video_input_start_pts = input_packet->pts;
+            elv_log("video_input_start_pts=%"PRId64" flags=%d dts=%"PRId64,
+                decoder_context->video_input_start_pts, input_packet->flags, input_packet->dts);
+        }
+
+        input_packet_rel_pts = input_packet->pts - decoder_context->video_input_start_pts;
+    } else if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
+        params->xc_type & xc_audio) {
+        if (decoder_context->audio_input_start_pts[stream_index] == AV_NOPTS_VALUE) {
+            decoder_context->audio_input_start_pts[stream_index] = input_packet->pts;
+            elv_log("stream_index=%d audio_input_start_pts=%"PRId64,
+                stream_index, decoder_context->audio_input_start_pts[stream_index]);
+        }
+
+        input_packet_rel_pts = input_packet->pts - decoder_context->audio_input_start_pts[stream_index];
+    }
+
+    /* PENDING (RM) for some of the live feeds (like RTMP) we need to scale input_packet_rel_pts */
+    if (params->duration_ts != -1 &&
+        input_packet->pts != AV_NOPTS_VALUE &&
+        input_packet_rel_pts >= params->start_time_ts + params->duration_ts) {
+
+        (*frames_read_past_duration) ++;
+        elv_dbg("DURATION OVER param start_time=%"PRId64" duration=%"PRId64" pkt pts=%"PRId64" rel_pts=%"PRId64" "
+                "audio_frames_read=%"PRId64", video_frames_read=%"PRId64", past_duration=%d",
+                params->start_time_ts, params->duration_ts, input_packet->pts, input_packet_rel_pts,
+                audio_frames_read, video_frames_read, *frames_read_past_duration);
+
+        /* If it is a bypass simply return since there is no decoding/encoding involved */
+        if (params->bypass_transcoding)
+            return 1;
+
+        /* Allow decoding past specified duration to accommodate reordered packets */
+        if (*frames_read_past_duration > frames_allowed_past_duration) {
+            elv_dbg("frames_read_past_duration=%d, frames_allowed_past_duration=%d",
+                        *frames_read_past_duration, frames_allowed_past_duration);
+            return 1;
+        }
+    }
+
+    if (input_packet->pts != AV_NOPTS_VALUE) {
+        if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
+            params->xc_type & xc_audio)
+            encoder_context->audio_last_pts_read[stream_index] = input_packet->pts;
+        else if (stream_index == decoder_context->video_stream_index &&
+            params->xc_type & xc_video)
+            encoder_context->video_last_pts_read = input_packet->pts;
+    }
+    return 0;
+}
+
+static int
+skip_until_start_time_pts(
+    coderctx_t *decoder_context,
+    AVPacket *input_packet,
+    xcparams_t *params)
+{
+    /* If start_time_ts > 0 and it is a bypass skip here
+     * Also if start_time_ts > 0 and skip_decoding is set then skip here
+     */
+    if (params->start_time_ts <= 0 || (!params->skip_decoding && !params->bypass_transcoding))
+        return 0;
+
+    /* If the format is not dash/hls then return.
+     * For dash/hls format, we know the mezzanines are generated by avpipe
+     * and there is no BFrames in mezzanines. Therefore, it is safe to skip
+     * the frame without decoding the frame.
+     * A rebased bypass (EDL stream copy) starts on a key frame, the leading
+     * pictures of an open GOP are skipped with the frames before it.
+     */
+    if (strcmp(params->format, "dash") && strcmp(params->format, "hls") &&
+        !(params->bypass_transcoding && params->rebase_pts))
+        return 0;
+
+    int64_t input_start_pts;
+    if (params->xc_type == xc_video)
+        input_start_pts = decoder_context->video_input_start_pts;
+    else
+        input_start_pts = decoder_context->audio_input_start_pts[input_packet->stream_index];
+
+    const int64_t packet_in_pts_offset = input_packet->pts - input_start_pts;
+    /* Drop frames before the desired 'start_time' */
+    if (packet_in_pts_offset < params->start_time_ts) {
+        elv_dbg("PREDECODE SKIP frame early stream_index=%d, pts=%" PRId64 ", start_time_ts=%" PRId64
+            ", input_start_pts=%" PRId64 ", packet_in_pts_offset=%" PRId64,
+            input_packet->stream_index,
+            input_packet->pts, params->start_time_ts,
+            input_start_pts, packet_in_pts_offset);
+        return 1;
+    }
+
+    return 0;
+}
+
+static int
+skip_for_sync(
+    coderctx_t *decoder_context,
+    AVPacket *input_packet,
+    xcparams_t *params)
+{
+    if (params->sync_audio_to_stream_id < 0)
+        return 0;
+
+    /* No need to sync if:
+     * - it is not a live source (mpegts, rtmp, srt, rtp)
+     * - or it is already synced
+     * - or format is not fmp4-segment.
+     */
+    if (!is_live_source(decoder_context) ||
+        decoder_context->is_av_synced ||
+        strcmp(params->format, "fmp4-segment"))
+        return 0;
+
+    /* Check if the packet is video and it is a key frame */
+    if (input_packet->stream_index == decoder_context->video_stream_index) {
+        /* first_key_frame_pts points to first video key frame. */
+        if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE &&
+            input_packet->flags == AV_PKT_FLAG_KEY) {
+            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+            decoder_context->first_key_frame_pts = input_packet->pts;
+            decoder_context->inctx->first_key_frame_pts = decoder_context->first_key_frame_pts;
+            elv_log("PTS first_key_frame_pts=%"PRId64" sidx=%d flags=%d dts=%"PRId64,
+                decoder_context->first_key_frame_pts, input_packet->stream_index, input_packet->flags, input_packet->dts);
+
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(decoder_context->inctx, input_packet->stream_index, in_stat_first_keyframe_pts);
+
+            dump_packet(0, "SYNC ", input_packet, 1);
             return 0;
         }
         if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE) {
@@ -3662,6 +6238,24 @@ get_filter_str(
     return 0;
 }
 
+/*
+ * Parses a crop rectangle "w:h:x:y" (the order of the crop filter).
+ * Returns 0 if successful, otherwise -1.
+ */
+static int
+parse_crop(
+    const char *str,
+    crop_rect_t *crop)
+{
+    char c;
+
+    if (!str ||
+        sscanf(str, "%d:%d:%d:%d%c", &crop->width, &crop->height, &crop->x, &crop->y, &c) != 4 ||
+        crop->width <= 0 || crop->height <= 0 || crop->x < 0 || crop->y < 0)
+        return -1;
+    return 0;
+}
+
 int
 avpipe_xc(
     xctx_t *xctx,
@@ -3680,20 +6274,73 @@ avpipe_xc(
     int av_read_frame_rc = 0;
     AVPacket *input_packet = NULL;
 
-    if (!params->url || params->url[0] == '\0' ||
-        in_handlers->avpipe_opener(params->url, inctx) < 0) {
-        elv_err("Failed to open avpipe input \"%s\"", params->url != NULL ? params->url : "");
-        rc = eav_open_input;
-        return rc;
-    }
+    /* Two-pass loudness normalization: the first pass measures the loudness of the audio outputs */
+    if (params->loudness_target != 0 &&
+        !params->bypass_transcoding &&
+        (params->xc_type & xc_audio)) {
+        loudness_stats_t *loudness = NULL;
+        int n_loudness = 0;
 
-    if ((rc = prepare_decoder(&xctx->decoder_ctx,
-            in_handlers, inctx, params, params->seekable)) != eav_success) {
-        elv_err("Failure in preparing decoder, url=%s, rc=%d", params->url, rc);
-        return rc;
+        if ((rc = avpipe_analyze_loudness(in_handlers, params, &loudness, &n_loudness)) != eav_success) {
+            elv_err("Failed to measure the loudness, url=%s, rc=%d", params->url, rc);
+            return rc;
+        }
+        for (int i=0; i<n_loudness && i<MAX_STREAMS; i++)
+            decoder_context->loudness_measured[i] = loudness[i];
+        free(loudness);
     }
 
-    // Set up "copy" (bypass) encoder for MPEGTS
+    /*
+     * Crop: an explicit rectangle, or the rectangle found by a first pass if it is "auto". The first pass of a two-pass
+     * rate control gets the crop and the scene cuts of the second pass.
+     */
+    if (params->crop && params->crop[0] != '\0' &&
+        encoder_context->rc_pass != 1 &&
+        !params->bypass_transcoding &&
+        (params->xc_type & xc_video)) {
+        if (!strcmp(params->crop, "auto")) {
+            if ((rc = avpipe_analyze_crop(in_handlers, params, &decoder_context->crop)) != eav_success) {
+                elv_err("Failed to detect the crop, url=%s, rc=%d", params->url, rc);
+                return rc;
+            }
+        } else if (parse_crop(params->crop, &decoder_context->crop) < 0) {
+            elv_err("Invalid crop=%s, url=%s", params->crop, params->url);
+            return eav_param;
+        }
+    }
+
+    /* Scene keyframes: the first pass finds the scene cuts of the video */
+    if (params->scene_keyframes && encoder_context->rc_pass != 1) {
+        if ((rc = avpipe_analyze_scenes(in_handlers, params,
+                &encoder_context->scene_keyframes, &encoder_context->n_scene_keyframes)) != eav_success) {
+            elv_err("Failed to find the scene cuts, url=%s, rc=%d", params->url, rc);
+            return rc;
+        }
+    }
+
+    /* Two-pass rate control: the first pass writes the stats of the encoder, this pass is the second one */
+    if (params->rc_mode == rc_mode_two_pass && encoder_context->rc_pass == 0) {
+        encoder_context->rc_pass = 2;
+        if ((rc = rc_first_pass(xctx)) != eav_success) {
+            elv_err("Failed the first pass of the rate control, url=%s, rc=%d", params->url, rc);
+            return rc;
+        }
+    }
+
+    if (!params->url || params->url[0] == '\0' ||
+        in_handlers->avpipe_opener(params->url, inctx) < 0) {
+        elv_err("Failed to open avpipe input \"%s\"", params->url != NULL ? params->url : "");
+        rc = eav_open_input;
+        return rc;
+    }
+
+    if ((rc = prepare_decoder(&xctx->decoder_ctx,
+            in_handlers, inctx, params, params->seekable)) != eav_success) {
+        elv_err("Failure in preparing decoder, url=%s, rc=%d", params->url, rc);
+        return rc;
+    }
+
+    // Set up "copy" (bypass) encoder for MPEGTS
     if (params->copy_mpegts) {
         cp_ctx_t *cp_ctx = &xctx->cp_ctx;
 
@@ -3716,6 +6363,12 @@ avpipe_xc(
         return rc;
     }
 
+    if (params->smart_cut &&
+        (rc = smart_cut_init(&xctx->decoder_ctx, &xctx->encoder_ctx, params)) != eav_success) {
+        elv_err("Failure in preparing smart cut, url=%s, rc=%d", params->url, rc);
+        return rc;
+    }
+
     elv_channel_init(&xctx->vc, 10000, (free_elem_f) av_packet_free);
     elv_channel_init(&xctx->ac, 10000, (free_elem_f) av_packet_free);
 
@@ -3737,11 +6390,18 @@ avpipe_xc(
         free(filter_str);
     }
 
+    if (params->n_audio_renditions > 0 &&
+        (rc = init_audio_rendition_filters(decoder_context, encoder_context, xctx->params)) != eav_success) {
+        elv_err("Failed to initialize audio rendition filters, url=%s", params->url);
+        goto xc_done;
+    }
+
     if (!params->bypass_transcoding &&
         (params->xc_type & xc_audio) &&
         params->xc_type != xc_audio_join &&
         params->xc_type != xc_audio_pan &&
         params->xc_type != xc_audio_merge &&
+        params->n_audio_renditions == 0 &&
         (rc = init_audio_filters(decoder_context, encoder_context, xctx->params)) != eav_success) {
         elv_err("Failed to initialize audio filter, url=%s", params->url);
         goto xc_done;
@@ -3749,7 +6409,7 @@ avpipe_xc(
 
     if (!params->bypass_transcoding &&
         params->xc_type == xc_audio_pan &&
-        (rc = init_audio_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context)) != eav_success) {
+        (rc = init_audio_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context, xctx->params)) != eav_success) {
         elv_err("Failed to initialize audio pan filter, url=%s", params->url);
         goto xc_done;
     }
@@ -3763,7 +6423,7 @@ avpipe_xc(
 
     if (!params->bypass_transcoding &&
         params->xc_type == xc_audio_merge &&
-        (rc = init_audio_merge_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context)) != eav_success) {
+        (rc = init_audio_merge_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context, xctx->params)) != eav_success) {
         elv_err("Failed to initialize audio merge pan filter, url=%s", params->url);
         goto xc_done;
     }
@@ -3839,6 +6499,10 @@ avpipe_xc(
     decoder_context->first_decoding_video_pts = AV_NOPTS_VALUE;
     encoder_context->first_encoding_video_pts = -1;
     encoder_context->video_pts = AV_NOPTS_VALUE;
+    encoder_context->splice_frame_pts = AV_NOPTS_VALUE;
+    encoder_context->scene_seg_boundary = AV_NOPTS_VALUE;
+    encoder_context->splice_seg_boundary = AV_NOPTS_VALUE;
+    encoder_context->first_encoded_video_pts = AV_NOPTS_VALUE;
 
     for (int j=0; j<MAX_STREAMS; j++) {
         decoder_context->first_decoding_audio_pts[j] = AV_NOPTS_VALUE;
@@ -3848,11 +6512,32 @@ avpipe_xc(
         encoder_context->first_read_packet_pts[j] = AV_NOPTS_VALUE;
         encoder_context->audio_last_pts_sent_encode[j] = AV_NOPTS_VALUE;
         encoder_context->audio_last_pts_encoded[j] = AV_NOPTS_VALUE;
+        encoder_context->first_encoded_audio_pts[j] = AV_NOPTS_VALUE;
     }
     decoder_context->first_key_frame_pts = AV_NOPTS_VALUE;
     decoder_context->is_av_synced = 0;
     encoder_context->video_last_pts_sent_encode = -1;
 
+    /*
+     * Smart cut seeks to the key frame before the start instead of reading the input from the beginning.
+     * The input start pts are set first, start_time_ts is relative to them.
+     */
+    if (params->smart_cut && params->seekable && params->start_time_ts > 0) {
+        AVStream *vs = decoder_context->stream[decoder_context->video_stream_index];
+        int64_t start_pts = vs->start_time != AV_NOPTS_VALUE ? vs->start_time : 0;
+
+        decoder_context->video_input_start_pts = start_pts;
+        for (int i=0; i<decoder_context->n_audio; i++) {
+            int audio_stream_index = decoder_context->audio_stream_index[i];
+            AVStream *as = decoder_context->stream[audio_stream_index];
+            decoder_context->audio_input_start_pts[audio_stream_index] = as->start_time != AV_NOPTS_VALUE ? as->start_time : 0;
+        }
+        if (av_seek_frame(decoder_context->format_context, decoder_context->video_stream_index,
+                start_pts + params->start_time_ts, AVSEEK_FLAG_BACKWARD) < 0)
+            elv_warn("SMART CUT failed seeking to start_time_ts=%"PRId64", reading from the beginning, url=%s",
+                params->start_time_ts, params->url);
+    }
+
     int64_t video_last_dts = 0;
     int frames_read_past_duration = 0;
     const int frames_allowed_past_duration = 5;
@@ -4038,9 +6723,37 @@ avpipe_xc(
                             inctx->data = (uint8_t *)hex_str;
                             in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_data_scte35);
                         }
+                        if (params->splice_segment)
+                            queue_splice_point(decoder_context, encoder_context, input_packet, params);
+                        if (params->emit_emsg)
+                            queue_emsg_event(decoder_context, encoder_context, EMSG_SCHEME_SCTE35, input_packet, params);
                         break;
                     }
                 }
+            } else if (stream_index == decoder_context->data_id3_stream_index ||
+                stream_index == decoder_context->data_klv_stream_index) {
+                timed_metadata_t timed_metadata = {
+                    .type = stream_index == decoder_context->data_id3_stream_index ?
+                        timed_metadata_id3 : timed_metadata_klv,
+                    .pts = AV_NOPTS_VALUE,
+                    .data = input_packet->data,
+                    .size = input_packet->size,
+                };
+                if (input_packet->pts != AV_NOPTS_VALUE)
+                    timed_metadata.pts = av_rescale_q(input_packet->pts,
+                        decoder_context->stream[stream_index]->time_base, (AVRational) {1, 90000});
+                if (debug_frame_level)
+                    elv_dbg("%s [%d] pts=%"PRId64" size=%d",
+                        timed_metadata.type == timed_metadata_id3 ? "ID3" : "KLV",
+                        input_packet->stream_index, timed_metadata.pts, input_packet->size);
+
+                if (in_handlers->avpipe_stater) {
+                    inctx->timed_metadata = &timed_metadata;
+                    in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_timed_metadata);
+                    inctx->timed_metadata = NULL;
+                }
+                if (params->emit_emsg && timed_metadata.type == timed_metadata_id3)
+                    queue_emsg_event(decoder_context, encoder_context, EMSG_SCHEME_ID3, input_packet, params);
             } else {
                 if (debug_frame_level)
                     elv_dbg("Skip stream - packet index=%d, pts=%"PRId64" dts=%"PRId64" url=%s",
@@ -4060,12 +6773,23 @@ xc_done:
     pthread_join(xctx->vthread_id, NULL);
     pthread_join(xctx->athread_id, NULL);
 
+    /* Smart cut re-encodes or copies the last GOP it kept */
+    if (params->smart_cut && xctx->err == eav_success) {
+        xctx->err = smart_cut_flush(decoder_context, encoder_context, params, debug_frame_level);
+        if (xctx->err != eav_success)
+            rc = xctx->err;
+    }
+
     /*
      * Flush all frames, first flush decoder buffers, then encoder buffers by passing NULL frame.
      */
     if (params->xc_type & xc_video && xctx->err != eav_write_frame)
         flush_decoder(decoder_context, encoder_context, encoder_context->video_stream_index, params, debug_frame_level);
-    if (params->xc_type & xc_audio && xctx->err != eav_write_frame) {
+    if (params->xc_type & xc_audio && params->n_audio_renditions > 0 && xctx->err != eav_write_frame) {
+        int err = flush_renditions(decoder_context, encoder_context, params, debug_frame_level);
+        if (err != eav_success && xctx->err == eav_success)
+            xctx->err = err;
+    } else if (params->xc_type & xc_audio && xctx->err != eav_write_frame) {
         for (int i=0; i<decoder_context->n_audio; i++)
             flush_decoder(decoder_context, encoder_context, encoder_context->audio_stream_index[i], params, debug_frame_level);
     }
@@ -4077,11 +6801,23 @@ xc_done:
     if (!params->bypass_transcoding && (params->xc_type & xc_video) && xctx->err != eav_write_frame)
         encode_frame(decoder_context, encoder_context, NULL, decoder_context->video_stream_index, params, debug_frame_level);
     /* Loop through and flush all audio frames */
-    if (!params->bypass_transcoding && params->xc_type & xc_audio && xctx->err != eav_write_frame) {
+    if (!params->bypass_transcoding && params->xc_type & xc_audio &&
+        params->n_audio_renditions == 0 && xctx->err != eav_write_frame) {
         for (int i=0; i<decoder_context->n_audio; i++)
             encode_frame(decoder_context, encoder_context, NULL, decoder_context->audio_stream_index[i], params, debug_frame_level);
     }
 
+    if (encoder_context->a53 && encoder_context->a53->dropped > 0)
+        elv_warn("Dropped %"PRId64" A/53 cc_data_pkt passed through, url=%s", encoder_context->a53->dropped, params->url);
+
+    /* Write the last caption segment, it ends with the last video frame */
+    if (encoder_context->cc && encoder_context->cc_last_pts != AV_NOPTS_VALUE && rc == eav_success) {
+        int64_t end_pts = encoder_context->cc_last_pts + encoder_context->cc_frame_duration;
+        cc_flush(encoder_context->cc, end_pts);
+        if (encoder_context->cc_seg_index >= 0)
+            elv_io_caption_segment(encoder_context, params, encoder_context->cc_seg_index + 1, end_pts);
+    }
+
     dump_trackers(decoder_context->format_context, encoder_context->format_context);
 
     if ((params->xc_type & xc_video) && rc == eav_success)
@@ -4091,6 +6827,28 @@ xc_done:
             av_write_trailer(encoder_context->format_context2[i]);
     }
 
+    /* Report the loudness of the audio outputs */
+    if (params->measure_loudness && rc == eav_success && in_handlers->avpipe_stater) {
+        for (int i=0; i<decoder_context->n_audio_filters; i++) {
+            inctx->loudness = &decoder_context->loudness[i];
+            in_handlers->avpipe_stater(inctx, decoder_context->loudness[i].stream_index, in_stat_loudness);
+        }
+        inctx->loudness = NULL;
+    }
+
+    /* Write the QC report of the silence, black and frozen frame intervals */
+    if ((params->detect_silence || params->detect_black || params->detect_freeze) && rc == eav_success)
+        rc = write_qc_report(decoder_context, encoder_context, params);
+
+    /* Write the shot list of the scene cuts */
+    if (params->detect_scenes && rc == eav_success)
+        rc = write_shot_list(decoder_context, encoder_context, params);
+
+    /* Write the DASH AdaptationSets or HLS EXT-X-MEDIA tags of the audio renditions */
+    if (params->n_audio_renditions > 0 && rc == eav_success && xctx->err == eav_success &&
+        (!strcmp(params->format, "dash") || !strcmp(params->format, "hls")))
+        rc = write_rendition_manifest(encoder_context, params);
+
     /* Purge the audio/video channels */
     elv_channel_close(xctx->vc, 1);
     elv_channel_close(xctx->ac, 1);
@@ -4316,6 +7074,8 @@ get_xc_type_name(
         return "xc_extract_all_images";
     case xc_probe:
         return "xc_probe";
+    case xc_extract_captions:
+        return "xc_extract_captions";
     default:
         return "none";
     }
@@ -4323,6 +7083,105 @@ get_xc_type_name(
     return "none";
 }
 
+/*
+ * Returns the value of an integer of the metadata of a frame, or -1 if it is not set.
+ */
+static int64_t
+frame_metadata_int(
+    AVFrame *frame,
+    const char *key)
+{
+    AVDictionaryEntry *e = av_dict_get(frame->metadata, key, NULL, 0);
+    return e ? strtoll(e->value, NULL, 10) : -1;
+}
+
+/*
+ * Decodes the first CADENCE_PROBE_FRAMES frames of the video through idet and returns the cadence of the video.
+ * It is telecine if the frames are flagged to repeat a field (soft telecine), or if a quarter of the frames repeat a
+ * field and a fifth are combed (3:2 pulldown repeats 2 fields and combs 2 frames every 5 frames). Otherwise it is
+ * interlaced or progressive as most of the frames.
+ */
+static cadence_t
+probe_cadence(
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int index = decoder_context->video_stream_index;
+    AVCodecContext *codec_context = decoder_context->codec_context[index];
+    AVPacket *packet = av_packet_alloc();
+    AVFrame *frame = av_frame_alloc();
+    AVFrame *filt_frame = av_frame_alloc();
+    int64_t tff = 0, bff = 0, progressive = 0, repeated = 0, neither = 0, v;
+    int n_frames = 0;
+    int n_repeat_pict = 0;
+    cadence_t cadence = cadence_unknown;
+
+    if (!packet || !frame || !filt_frame || init_video_probe_filters(decoder_context) != eav_success)
+        goto end_probe_cadence;
+
+    while (n_frames < CADENCE_PROBE_FRAMES) {
+        int eof = av_read_frame(decoder_context->format_context, packet) < 0;
+
+        if (!eof && packet->stream_index != index) {
+            av_packet_unref(packet);
+            continue;
+        }
+        avcodec_send_packet(codec_context, eof ? NULL : packet);
+        av_packet_unref(packet);
+
+        while (avcodec_receive_frame(codec_context, frame) >= 0) {
+            if (frame->repeat_pict > 0)
+                n_repeat_pict++;
+            frame->pts = frame->best_effort_timestamp;
+            if (av_buffersrc_add_frame(decoder_context->video_buffersrc_ctx, frame) < 0) {
+                av_frame_unref(frame);
+                continue;
+            }
+
+            /* The statistics of idet are cumulated, the last frame has them all */
+            while (av_buffersink_get_frame(decoder_context->video_buffersink_ctx, filt_frame) >= 0) {
+                if ((v = frame_metadata_int(filt_frame, "lavfi.idet.multiple.tff")) >= 0)
+                    tff = v;
+                if ((v = frame_metadata_int(filt_frame, "lavfi.idet.multiple.bff")) >= 0)
+                    bff = v;
+                if ((v = frame_metadata_int(filt_frame, "lavfi.idet.multiple.progressive")) >= 0)
+                    progressive = v;
+                if ((v = frame_metadata_int(filt_frame, "lavfi.idet.repeated.neither")) >= 0)
+                    neither = v;
+                if ((v = frame_metadata_int(filt_frame, "lavfi.idet.repeated.top")) >= 0)
+                    repeated = v;
+                if ((v = frame_metadata_int(filt_frame, "lavfi.idet.repeated.bottom")) >= 0)
+                    repeated += v;
+                n_frames++;
+                av_frame_unref(filt_frame);
+            }
+        }
+        if (eof)
+            break;
+    }
+
+    if (n_frames == 0)
+        goto end_probe_cadence;
+
+    if (n_repeat_pict * 4 >= n_frames ||
+        (repeated * 4 >= repeated + neither && (tff + bff) * 5 >= tff + bff + progressive))
+        cadence = cadence_telecine;
+    else if (tff + bff > progressive)
+        cadence = tff >= bff ? cadence_interlaced_tff : cadence_interlaced_bff;
+    else
+        cadence = cadence_progressive;
+
+    elv_log("CADENCE cadence=%d frames=%d repeat_pict=%d tff=%"PRId64" bff=%"PRId64" progressive=%"PRId64
+        " repeated=%"PRId64" neither=%"PRId64", url=%s", cadence, n_frames, n_repeat_pict,
+        tff, bff, progressive, repeated, neither, params->url);
+
+end_probe_cadence:
+    av_packet_free(&packet);
+    av_frame_free(&frame);
+    av_frame_free(&filt_frame);
+    return cadence;
+}
+
 int
 avpipe_probe(
     avpipe_io_handler_t *in_handlers,
@@ -4417,91 +7276,803 @@ avpipe_probe(
             stream_probes_ptr->sample_aspect_ratio = codec_context->sample_aspect_ratio;
         }
 
-        stream_probes_ptr->frame_rate = s->r_frame_rate;
-        stream_probes_ptr->ticks_per_frame = codec_context->ticks_per_frame;
-        stream_probes_ptr->bit_rate = codec_context->bit_rate;
-        stream_probes_ptr->has_b_frames = codec_context->has_b_frames;
-        stream_probes_ptr->sample_rate = codec_context->sample_rate;
-        stream_probes_ptr->channels = codec_context->channels;
-        if (codec && codec->type == AVMEDIA_TYPE_AUDIO)
-            stream_probes_ptr->channel_layout = codec_context->channel_layout;
-        else
-            stream_probes_ptr->channel_layout = -1;
-        stream_probes_ptr->width = codec_context->width;
-        stream_probes_ptr->height = codec_context->height;
-        stream_probes_ptr->pix_fmt = codec_context->pix_fmt;
-        stream_probes_ptr->field_order = codec_context->field_order;
-        stream_probes_ptr->profile = codec_context->profile;
-        stream_probes_ptr->level = codec_context->level;
+        stream_probes_ptr->frame_rate = s->r_frame_rate;
+        stream_probes_ptr->ticks_per_frame = codec_context->ticks_per_frame;
+        stream_probes_ptr->bit_rate = codec_context->bit_rate;
+        stream_probes_ptr->has_b_frames = codec_context->has_b_frames;
+        stream_probes_ptr->sample_rate = codec_context->sample_rate;
+        stream_probes_ptr->channels = codec_context->channels;
+        if (codec && codec->type == AVMEDIA_TYPE_AUDIO)
+            stream_probes_ptr->channel_layout = codec_context->channel_layout;
+        else
+            stream_probes_ptr->channel_layout = -1;
+        stream_probes_ptr->width = codec_context->width;
+        stream_probes_ptr->height = codec_context->height;
+        stream_probes_ptr->pix_fmt = codec_context->pix_fmt;
+        stream_probes_ptr->field_order = codec_context->field_order;
+        stream_probes_ptr->color_primaries = av_color_primaries_name(codec_context->color_primaries);
+        stream_probes_ptr->color_transfer = av_color_transfer_name(codec_context->color_trc);
+        stream_probes_ptr->color_space = av_color_space_name(codec_context->colorspace);
+        stream_probes_ptr->color_range = av_color_range_name(codec_context->color_range);
+        stream_probes_ptr->profile = codec_context->profile;
+        stream_probes_ptr->level = codec_context->level;
+        get_codec_string(s->codecpar, s->avg_frame_rate, stream_probes_ptr->codec_string,
+            sizeof(stream_probes_ptr->codec_string));
+
+        if (probe->container_info.duration <
+            ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den)
+            probe->container_info.duration =
+                ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den;
+
+        av_dict_copy(&stream_probes_ptr->tags, s->metadata, 0);
+
+        for (int i = 0; i < s->nb_side_data; i++) {
+            const AVPacketSideData *sd = &s->side_data[i];
+            switch (sd->type) {
+                case AV_PKT_DATA_DISPLAYMATRIX:
+                    stream_probes_ptr->side_data.display_matrix.rotation = av_display_rotation_get((int32_t *)sd->data);
+                    double rot = stream_probes_ptr->side_data.display_matrix.rotation;
+                    // Convert from CCW [-180:180] value to straight CW
+                    rot = rot >= 0 ? rot : 360.0 + rot;
+                    rot = rot > 0 ? 360 - rot : 0;
+                    stream_probes_ptr->side_data.display_matrix.rotation_cw = rot;
+                    break;
+                default:
+                    // Not handled
+                    break;
+            }
+        }
+    }
+
+    /* The cadence is found after the stream info since it reads the input */
+    if (params->probe_cadence && decoder_ctx.video_stream_index >= 0) {
+        cadence_t cadence = probe_cadence(&decoder_ctx, params);
+        for (int i=0; i<nb_streams - nb_skipped_streams; i++) {
+            if (stream_probes[i].stream_index == decoder_ctx.video_stream_index)
+                stream_probes[i].cadence = cadence;
+        }
+    }
+
+    inctx.closed = 1;
+    probe->stream_info = stream_probes;
+    probe->container_info.format_name = strdup(decoder_ctx.format_context->iformat->name);
+    *xcprobe = probe;
+    *n_streams = nb_streams - nb_skipped_streams;
+
+avpipe_probe_end:
+    avfilter_graph_free(&decoder_ctx.video_filter_graph);
+    if (decoder_ctx.format_context) {
+        if (decoder_ctx.format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
+            AVIOContext *avioctx = decoder_ctx.format_context->pb;
+            if (avioctx) {
+                av_freep(&avioctx->buffer);
+                av_freep(&avioctx);
+            }
+        }
+        avformat_close_input(&decoder_ctx.format_context);
+    }
+
+    for (int i=0; i<MAX_STREAMS; i++) {
+        if (decoder_ctx.codec_context[i]) {
+            /* Corresponds to avcodec_open2() */
+            avcodec_close(decoder_ctx.codec_context[i]);
+            avcodec_free_context(&decoder_ctx.codec_context[i]);
+        }
+    }
+
+    /* Close input handler resources */
+    in_handlers->avpipe_closer(&inctx);
+
+    return rc;
+}
+
+int avpipe_probe_free(xcprobe_t *probe, int n_streams) {
+    if (probe == NULL)
+        return 0;
+
+    for (int i=0; i<n_streams; i++) {
+        av_dict_free(&probe->stream_info[i].tags);
+    }
+    free(probe->stream_info);
+
+    free(probe);
+    return 0;
+}
+
+/*
+ * Output handlers of avpipe_analyze_loudness(), the encoded audio is dropped.
+ */
+static int
+null_out_opener(
+    const char *url,
+    ioctx_t *outctx)
+{
+    outctx->bufsz = AVIO_OUT_BUF_SIZE;
+    outctx->buf = (unsigned char *)av_malloc(outctx->bufsz); /* Freed with the avio context */
+    if (!outctx->buf)
+        return -1;
+    return 0;
+}
+
+static int
+null_out_closer(
+    ioctx_t *outctx)
+{
+    return 0;
+}
+
+static int
+null_out_read_packet(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size)
+{
+    return -1;
+}
+
+static int
+null_out_write_packet(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size)
+{
+    ioctx_t *outctx = (ioctx_t *)opaque;
+    outctx->written_bytes += buf_size;
+    return buf_size;
+}
+
+static int64_t
+null_out_seek(
+    void *opaque,
+    int64_t offset,
+    int whence)
+{
+    if (whence & AVSEEK_SIZE)
+        return -1;
+    return offset;
+}
+
+static int
+null_out_stat(
+    void *opaque,
+    int stream_index,
+    avp_stat_t stat_type)
+{
+    return 0;
+}
+
+/*
+ * Initializes the transcoding of an analysis pass, which reads the input with in_handlers and drops the outputs.
+ */
+static int
+init_analysis_pass(
+    xctx_t **xctx,
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *p)
+{
+    avpipe_io_handler_t *pass_in_handlers;
+    avpipe_io_handler_t *pass_out_handlers;
+    int rc;
+
+    /* The stats of the input are reported by the transcoding */
+    pass_in_handlers = (avpipe_io_handler_t *)calloc(1, sizeof(avpipe_io_handler_t));
+    *pass_in_handlers = *in_handlers;
+    pass_in_handlers->avpipe_stater = NULL;
+
+    pass_out_handlers = (avpipe_io_handler_t *)calloc(1, sizeof(avpipe_io_handler_t));
+    pass_out_handlers->avpipe_opener = null_out_opener;
+    pass_out_handlers->avpipe_closer = null_out_closer;
+    pass_out_handlers->avpipe_reader = null_out_read_packet;
+    pass_out_handlers->avpipe_writer = null_out_write_packet;
+    pass_out_handlers->avpipe_seeker = null_out_seek;
+    pass_out_handlers->avpipe_stater = null_out_stat;
+
+    if ((rc = avpipe_init(xctx, pass_in_handlers, pass_out_handlers, p)) != eav_success) {
+        free(pass_in_handlers);
+        free(pass_out_handlers);
+    }
+    return rc;
+}
+
+int
+avpipe_analyze_loudness(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    loudness_stats_t **loudness,
+    int *n_loudness)
+{
+    xctx_t *xctx = NULL;
+    xcparams_t p;
+    int rc;
+
+    if (!params || !in_handlers || !loudness || !n_loudness) {
+        elv_err("avpipe_analyze_loudness parameters are not set");
+        return eav_param;
+    }
+
+    /* Only the audio is transcoded, the loudness of the outputs is measured and the outputs are dropped */
+    p = *params;
+    p.xc_type = params->xc_type & ~xc_video;
+    p.measure_loudness = 1;
+    p.loudness_target = 0;
+    p.copy_mpegts = 0;
+    p.smart_cut = 0;
+    p.splice_segment = 0;
+    p.emit_emsg = 0;
+    p.extract_captions = 0;
+    p.detect_silence = 0;
+    p.detect_black = 0;
+    p.detect_freeze = 0;
+    p.detect_scenes = 0;
+    p.scene_keyframes = 0;
+    p.crop = NULL;
+    p.detect_crop = 0;
+    if (!(p.xc_type & xc_audio)) {
+        elv_err("avpipe_analyze_loudness no audio to measure, xc_type=%d, url=%s", params->xc_type, params->url);
+        return eav_param;
+    }
+
+    if ((rc = init_analysis_pass(&xctx, in_handlers, &p)) != eav_success)
+        return rc;
+
+    if ((rc = avpipe_xc(xctx, 0)) == eav_success) {
+        coderctx_t *decoder_context = &xctx->decoder_ctx;
+
+        *n_loudness = decoder_context->n_audio_filters;
+        *loudness = (loudness_stats_t *)calloc(decoder_context->n_audio_filters, sizeof(loudness_stats_t));
+        for (int i=0; i<decoder_context->n_audio_filters; i++) {
+            (*loudness)[i] = decoder_context->loudness[i];
+            elv_log("LOUDNESS measured stream_index=%d, I=%.1f LUFS, LRA=%.1f LU, TP=%.1f dBTP, url=%s",
+                decoder_context->loudness[i].stream_index, decoder_context->loudness[i].integrated,
+                decoder_context->loudness[i].range, decoder_context->loudness[i].true_peak, params->url);
+        }
+    }
+
+    avpipe_fini(&xctx);
+    return rc;
+}
+
+int
+avpipe_analyze_scenes(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    scene_cut_t **scene_cuts,
+    int *n_scene_cuts)
+{
+    xctx_t *xctx = NULL;
+    xcparams_t p;
+    int rc;
+
+    if (!params || !in_handlers || !scene_cuts || !n_scene_cuts) {
+        elv_err("avpipe_analyze_scenes parameters are not set");
+        return eav_param;
+    }
+
+    if (params->xc_type != xc_video && params->xc_type != xc_all) {
+        elv_err("avpipe_analyze_scenes no video to analyze, xc_type=%d, url=%s", params->xc_type, params->url);
+        return eav_param;
+    }
+
+    /* Only the video is transcoded, the scene cuts are found by the filters and the outputs are dropped */
+    p = *params;
+    p.xc_type = xc_video;
+    p.n_audio = 0;
+    p.detect_scenes = 1;
+    p.scene_keyframes = 0;
+    p.measure_loudness = 0;
+    p.loudness_target = 0;
+    p.copy_mpegts = 0;
+    p.smart_cut = 0;
+    p.splice_segment = 0;
+    p.emit_emsg = 0;
+    p.extract_captions = 0;
+    p.detect_silence = 0;
+    p.detect_black = 0;
+    p.detect_freeze = 0;
+    p.crop = NULL;
+    p.detect_crop = 0;
+
+    if ((rc = init_analysis_pass(&xctx, in_handlers, &p)) != eav_success)
+        return rc;
+
+    if ((rc = avpipe_xc(xctx, 0)) == eav_success) {
+        coderctx_t *decoder_context = &xctx->decoder_ctx;
+
+        *n_scene_cuts = decoder_context->n_scene_cuts;
+        *scene_cuts = decoder_context->scene_cuts;
+        decoder_context->scene_cuts = NULL;
+        elv_log("SCENE found scene_cuts=%d, url=%s", *n_scene_cuts, params->url);
+    }
+
+    avpipe_fini(&xctx);
+    return rc;
+}
+
+int
+avpipe_analyze_crop(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    crop_rect_t *crop)
+{
+    xctx_t *xctx = NULL;
+    xcparams_t p;
+    int rc;
+
+    if (!params || !in_handlers || !crop) {
+        elv_err("avpipe_analyze_crop parameters are not set");
+        return eav_param;
+    }
+
+    if (params->xc_type != xc_video && params->xc_type != xc_all) {
+        elv_err("avpipe_analyze_crop no video to analyze, xc_type=%d, url=%s", params->xc_type, params->url);
+        return eav_param;
+    }
+
+    /* Only the video is transcoded, the crop rectangle is found by cropdetect and the outputs are dropped */
+    p = *params;
+    p.xc_type = xc_video;
+    p.n_audio = 0;
+    p.crop = NULL;
+    p.detect_crop = 1;
+    p.detect_scenes = 0;
+    p.scene_keyframes = 0;
+    p.measure_loudness = 0;
+    p.loudness_target = 0;
+    p.copy_mpegts = 0;
+    p.smart_cut = 0;
+    p.splice_segment = 0;
+    p.emit_emsg = 0;
+    p.extract_captions = 0;
+    p.detect_silence = 0;
+    p.detect_black = 0;
+    p.detect_freeze = 0;
+
+    if ((rc = init_analysis_pass(&xctx, in_handlers, &p)) != eav_success)
+        return rc;
+
+    if ((rc = avpipe_xc(xctx, 0)) == eav_success) {
+        coderctx_t *decoder_context = &xctx->decoder_ctx;
+        AVCodecContext *codec_context = decoder_context->codec_context[decoder_context->video_stream_index];
+
+        /* No rectangle means that all the frames were black, then the whole picture is kept */
+        *crop = decoder_context->crop_detected;
+        if (crop->width <= 0 || crop->height <= 0) {
+            crop->width = codec_context->width;
+            crop->height = codec_context->height;
+            crop->x = 0;
+            crop->y = 0;
+        }
+        elv_log("CROP found crop=%d:%d:%d:%d in %dx%d, url=%s", crop->width, crop->height, crop->x, crop->y,
+            codec_context->width, codec_context->height, params->url);
+    }
+
+    avpipe_fini(&xctx);
+    return rc;
+}
+
+/*
+ * Runs the first pass of a two-pass rate control: the video is encoded with the same params, the encoder writes its
+ * stats to a temporary file (removed by avpipe_fini() of the second pass) and the outputs are dropped.
+ */
+static int
+rc_first_pass(
+    xctx_t *xctx)
+{
+    xcparams_t *params = xctx->params;
+    coderctx_t *encoder_context = &xctx->encoder_ctx;
+    xctx_t *pass_xctx = NULL;
+    xcparams_t p;
+    int rc;
+
+    if (make_temp_file(encoder_context->rc_stats, sizeof(encoder_context->rc_stats), "avpipe_rc_") < 0) {
+        elv_err("Failed to create the rate control stats file, url=%s", params->url);
+        return eav_param;
+    }
+
+    /* Only the video is transcoded, with the same encoder params, frame types and key frames as the second pass */
+    p = *params;
+    p.xc_type = xc_video;
+    p.n_audio = 0;
+    p.measure_loudness = 0;
+    p.loudness_target = 0;
+    p.copy_mpegts = 0;
+    p.splice_segment = 0;
+    p.emit_emsg = 0;
+    p.extract_captions = 0;
+    p.detect_silence = 0;
+    p.detect_black = 0;
+    p.detect_freeze = 0;
+    p.detect_scenes = 0;
+    p.detect_crop = 0;
+
+    if ((rc = init_analysis_pass(&pass_xctx, xctx->in_handlers, &p)) != eav_success)
+        return rc;
+
+    pass_xctx->encoder_ctx.rc_pass = 1;
+    snprintf(pass_xctx->encoder_ctx.rc_stats, sizeof(pass_xctx->encoder_ctx.rc_stats), "%s", encoder_context->rc_stats);
+    pass_xctx->decoder_ctx.crop = xctx->decoder_ctx.crop;
+    if (encoder_context->n_scene_keyframes > 0) {
+        pass_xctx->encoder_ctx.scene_keyframes =
+            (scene_cut_t *) calloc(encoder_context->n_scene_keyframes, sizeof(scene_cut_t));
+        memcpy(pass_xctx->encoder_ctx.scene_keyframes, encoder_context->scene_keyframes,
+            encoder_context->n_scene_keyframes * sizeof(scene_cut_t));
+        pass_xctx->encoder_ctx.n_scene_keyframes = encoder_context->n_scene_keyframes;
+    }
+
+    if ((rc = avpipe_xc(pass_xctx, 0)) == eav_success)
+        elv_log("RC first pass done, stats=%s, url=%s", encoder_context->rc_stats, params->url);
+
+    avpipe_fini(&pass_xctx);
+    return rc;
+}
+
+static void
+rc_stats_remove(
+    const char *stats)
+{
+    /* x264 writes the macroblock tree to .mbtree and x265 the CU tree to .cutree, both through .temp files */
+    const char *suffixes[] = {"", ".temp", ".mbtree", ".mbtree.temp", ".cutree", ".cutree.temp"};
+    char path[RC_STATS_PATH_SZ + 16];
+
+    for (int i=0; i<sizeof(suffixes)/sizeof(suffixes[0]); i++) {
+        snprintf(path, sizeof(path), "%s%s", stats, suffixes[i]);
+        unlink(path);
+    }
+}
+
+/*
+ * An input of avpipe_compare(), the reference or the distorted video.
+ */
+typedef struct compare_input_t {
+    xcparams_t      params;
+    ioctx_t         inctx;
+    coderctx_t      decoder_ctx;
+    AVFilterContext *buffersrc_ctx;
+    int64_t         pts_shift;              // Added to the pts of the frames, in the stream time base
+    double          time;                   // Time of the last frame sent to the filter graph (sec)
+    int             opened;
+    int             eof;
+} compare_input_t;
+
+static int
+compare_open_input(
+    avpipe_io_handler_t *in_handlers,
+    compare_input_t *input,
+    char *url,
+    compare_params_t *params)
+{
+    int rc;
+
+    input->params.url = url;
+    input->params.xc_type = xc_video;
+    input->params.stream_id = -1;
+    input->params.sync_audio_to_stream_id = -1;
+    input->params.seekable = params->seekable;
+    input->params.debug_frame_level = params->debug_frame_level;
+    input->inctx.params = &input->params;
+
+    if (in_handlers->avpipe_opener(url, &input->inctx) < 0)
+        return eav_open_input;
+    input->opened = 1;
+
+    if ((rc = prepare_decoder(&input->decoder_ctx, in_handlers, &input->inctx, &input->params,
+            params->seekable)) != eav_success) {
+        elv_err("avpipe_compare failed to prepare decoder, url=%s", url);
+        return rc;
+    }
+
+    if (input->decoder_ctx.video_stream_index < 0) {
+        elv_err("avpipe_compare no video stream, url=%s", url);
+        return eav_num_streams;
+    }
+    return eav_success;
+}
+
+static void
+compare_close_input(
+    avpipe_io_handler_t *in_handlers,
+    compare_input_t *input)
+{
+    coderctx_t *decoder_ctx = &input->decoder_ctx;
+
+    if (decoder_ctx->format_context) {
+        if (decoder_ctx->format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
+            AVIOContext *avioctx = decoder_ctx->format_context->pb;
+            if (avioctx) {
+                av_freep(&avioctx->buffer);
+                av_freep(&avioctx);
+            }
+        }
+        avformat_close_input(&decoder_ctx->format_context);
+    }
+
+    for (int i=0; i<MAX_STREAMS; i++) {
+        if (decoder_ctx->codec_context[i]) {
+            /* Corresponds to avcodec_open2() */
+            avcodec_close(decoder_ctx->codec_context[i]);
+            avcodec_free_context(&decoder_ctx->codec_context[i]);
+        }
+    }
+
+    if (input->opened)
+        in_handlers->avpipe_closer(&input->inctx);
+}
+
+/*
+ * Reads the next packet of the video of input, and sends its decoded frames to the filter graph. At the end of the
+ * input, the decoder is flushed and the buffer source is closed.
+ */
+static int
+compare_read_frames(
+    compare_input_t *input,
+    AVPacket *packet,
+    AVFrame *frame)
+{
+    coderctx_t *decoder_ctx = &input->decoder_ctx;
+    int index = decoder_ctx->video_stream_index;
+    AVCodecContext *codec_context = decoder_ctx->codec_context[index];
+    AVRational time_base = decoder_ctx->format_context->streams[index]->time_base;
+    int ret;
+
+    for (;;) {
+        if (av_read_frame(decoder_ctx->format_context, packet) < 0) {
+            input->eof = 1;
+            break;
+        }
+        if (packet->stream_index == index)
+            break;
+        av_packet_unref(packet);
+    }
+
+    ret = avcodec_send_packet(codec_context, input->eof ? NULL : packet);
+    av_packet_unref(packet);
+    if (ret < 0 && ret != AVERROR_EOF) {
+        elv_err("avpipe_compare failed to decode ret=%d, url=%s", ret, input->params.url);
+        return eav_send_packet;
+    }
+
+    while (avcodec_receive_frame(codec_context, frame) >= 0) {
+        if (frame->best_effort_timestamp == AV_NOPTS_VALUE) {
+            av_frame_unref(frame);
+            continue;
+        }
+        frame->pts = frame->best_effort_timestamp + input->pts_shift;
+        input->time = frame->pts * av_q2d(time_base);
+        if (input->params.debug_frame_level)
+            elv_dbg("COMPARE frame pts=%"PRId64", url=%s", frame->pts, input->params.url);
+
+        /* The filter graph is closed once the shortest input ended, the rest of the other one is not needed */
+        ret = av_buffersrc_add_frame(input->buffersrc_ctx, frame);
+        av_frame_unref(frame);
+        if (ret == AVERROR_EOF) {
+            input->eof = 1;
+            return eav_success;
+        }
+        if (ret < 0) {
+            elv_err("avpipe_compare failed to filter frame ret=%d, url=%s", ret, input->params.url);
+            return eav_receive_filter_frame;
+        }
+    }
+
+    if (input->eof)
+        av_buffersrc_add_frame(input->buffersrc_ctx, NULL);
+
+    return eav_success;
+}
+
+/*
+ * Gets the scored frames of the filter graph and adds them to result. The distorted frames without a reference
+ * frame have no score and are skipped. Sets eof at the end of the filter graph.
+ */
+static int
+compare_sink_frames(
+    AVFilterContext *buffersink_ctx,
+    AVFrame *frame,
+    compare_result_t *result,
+    int *eof)
+{
+    AVRational time_base = av_buffersink_get_time_base(buffersink_ctx);
+    AVDictionaryEntry *psnr, *ssim;
+    compare_frame_t f;
+    int ret;
+
+    while ((ret = av_buffersink_get_frame(buffersink_ctx, frame)) >= 0) {
+        psnr = av_dict_get(frame->metadata, "lavfi.psnr.psnr_avg", NULL, 0);
+        ssim = av_dict_get(frame->metadata, "lavfi.ssim.All", NULL, 0);
+        if (psnr && ssim) {
+            f.time = frame->pts * av_q2d(time_base);
+            f.psnr = strtod(psnr->value, NULL);
+            /* Identical frames have an infinite PSNR */
+            if (!(f.psnr < COMPARE_MAX_PSNR))
+                f.psnr = COMPARE_MAX_PSNR;
+            f.ssim = strtod(ssim->value, NULL);
+            f.vmaf = -1;
+            if (compare_result_add(result, &f) < 0) {
+                av_frame_unref(frame);
+                return eav_mem_alloc;
+            }
+        }
+        av_frame_unref(frame);
+    }
+
+    if (ret == AVERROR_EOF) {
+        *eof = 1;
+        return eav_success;
+    }
+    if (ret != AVERROR(EAGAIN)) {
+        elv_err("avpipe_compare failed to get a filtered frame ret=%d", ret);
+        return eav_receive_filter_frame;
+    }
+    return eav_success;
+}
+
+static int
+check_compare_params(
+    compare_params_t *params)
+{
+    if (!params->reference_url || params->reference_url[0] == '\0' ||
+        !params->distorted_url || params->distorted_url[0] == '\0') {
+        elv_err("avpipe_compare reference_url and distorted_url must be set");
+        return eav_param;
+    }
+
+    if (params->width < 0 || params->height < 0 || (params->width > 0) != (params->height > 0)) {
+        elv_err("avpipe_compare invalid resolution %dx%d - width and height must be both set or not set, url=%s",
+            params->width, params->height, params->distorted_url);
+        return eav_param;
+    }
+
+    if (params->seg_duration < 0 || params->n_worst < 0) {
+        elv_err("avpipe_compare invalid seg_duration=%.3f or n_worst=%d, url=%s",
+            params->seg_duration, params->n_worst, params->distorted_url);
+        return eav_param;
+    }
+    return eav_success;
+}
 
-        if (probe->container_info.duration <
-            ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den)
-            probe->container_info.duration =
-                ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den;
+int
+avpipe_compare(
+    avpipe_io_handler_t *in_handlers,
+    compare_params_t *params,
+    char **report)
+{
+    compare_input_t *input[2] = {NULL, NULL};
+    AVFilterGraph *filter_graph = NULL;
+    AVFilterContext *buffersrc_ctx[2];
+    AVFilterContext *buffersink_ctx = NULL;
+    AVPacket *packet = NULL;
+    AVFrame *frame = NULL;
+    compare_result_t result;
+    char vmaf_log[PATH_MAX];
+    char vmaf_args[2*PATH_MAX + 64];
+    int has_vmaf = 0;
+    int sink_eof = 0;
+    int rc;
 
-        av_dict_copy(&stream_probes_ptr->tags, s->metadata, 0);
+    memset(&result, 0, sizeof(result));
 
-        for (int i = 0; i < s->nb_side_data; i++) {
-            const AVPacketSideData *sd = &s->side_data[i];
-            switch (sd->type) {
-                case AV_PKT_DATA_DISPLAYMATRIX:
-                    stream_probes_ptr->side_data.display_matrix.rotation = av_display_rotation_get((int32_t *)sd->data);
-                    double rot = stream_probes_ptr->side_data.display_matrix.rotation;
-                    // Convert from CCW [-180:180] value to straight CW
-                    rot = rot >= 0 ? rot : 360.0 + rot;
-                    rot = rot > 0 ? 360 - rot : 0;
-                    stream_probes_ptr->side_data.display_matrix.rotation_cw = rot;
-                    break;
-                default:
-                    // Not handled
-                    break;
-            }
-        }
+    if (!params || !in_handlers || !report) {
+        elv_err("avpipe_compare parameters are not set");
+        return eav_param;
     }
 
-    inctx.closed = 1;
-    probe->stream_info = stream_probes;
-    probe->container_info.format_name = strdup(decoder_ctx.format_context->iformat->name);
-    *xcprobe = probe;
-    *n_streams = nb_streams - nb_skipped_streams;
+    if ((rc = check_compare_params(params)) != eav_success)
+        return rc;
 
-avpipe_probe_end:
-    if (decoder_ctx.format_context) {
-        if (decoder_ctx.format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
-            AVIOContext *avioctx = decoder_ctx.format_context->pb;
-            if (avioctx) {
-                av_freep(&avioctx->buffer);
-                av_freep(&avioctx);
-            }
+    input[0] = (compare_input_t *)calloc(1, sizeof(compare_input_t));
+    input[1] = (compare_input_t *)calloc(1, sizeof(compare_input_t));
+    packet = av_packet_alloc();
+    frame = av_frame_alloc();
+    if (!input[0] || !input[1] || !packet || !frame) {
+        rc = eav_mem_alloc;
+        goto avpipe_compare_end;
+    }
+
+    if ((rc = compare_open_input(in_handlers, input[0], params->reference_url, params)) != eav_success ||
+        (rc = compare_open_input(in_handlers, input[1], params->distorted_url, params)) != eav_success)
+        goto avpipe_compare_end;
+
+    /* The common resolution is the reference one by default, the distorted is upscaled */
+    result.width = params->width;
+    result.height = params->height;
+    if (result.width <= 0) {
+        AVCodecContext *codec_context = input[0]->decoder_ctx.codec_context[input[0]->decoder_ctx.video_stream_index];
+        result.width = codec_context->width;
+        result.height = codec_context->height;
+    }
+
+    if (params->vmaf) {
+        if (!avfilter_get_by_name("libvmaf")) {
+            elv_warn("avpipe_compare VMAF is not available, FFmpeg is built without libvmaf, url=%s",
+                params->distorted_url);
+        } else if (make_temp_file(vmaf_log, sizeof(vmaf_log), "avpipe_vmaf_") < 0) {
+            elv_err("avpipe_compare failed to create the VMAF log, url=%s", params->distorted_url);
+            rc = eav_filter_init;
+            goto avpipe_compare_end;
+        } else {
+            has_vmaf = 1;
+            snprintf(vmaf_args, sizeof(vmaf_args), "log_path=%s:log_fmt=json:shortest=1%s%s", vmaf_log,
+                params->vmaf_model ? ":model_path=" : "", params->vmaf_model ? params->vmaf_model : "");
         }
-        avformat_close_input(&decoder_ctx.format_context);
     }
 
-    for (int i=0; i<MAX_STREAMS; i++) {
-        if (decoder_ctx.codec_context[i]) {
-            /* Corresponds to avcodec_open2() */
-            avcodec_close(decoder_ctx.codec_context[i]);
-            avcodec_free_context(&decoder_ctx.codec_context[i]);
-        }
+    if ((rc = init_compare_filters(&filter_graph, buffersrc_ctx, &buffersink_ctx, &input[0]->decoder_ctx,
+            &input[1]->decoder_ctx, result.width, result.height, has_vmaf ? vmaf_args : NULL)) != eav_success)
+        goto avpipe_compare_end;
+    input[0]->buffersrc_ctx = buffersrc_ctx[0];
+    input[1]->buffersrc_ctx = buffersrc_ctx[1];
+
+    /*
+     * A distorted frame is compared to the last reference frame at or before it, the reference is moved back by half
+     * a frame to pair the frames with the nearest one. The offset moves the distorted.
+     */
+    for (int i=0; i<2; i++) {
+        coderctx_t *d = &input[i]->decoder_ctx;
+        AVStream *s = d->format_context->streams[d->video_stream_index];
+        AVRational frame_rate = s->avg_frame_rate.num > 0 ? s->avg_frame_rate : s->r_frame_rate;
+
+        if (i == 0 && frame_rate.num > 0 && frame_rate.den > 0)
+            input[i]->pts_shift = -av_rescale_q(1, av_inv_q(frame_rate), s->time_base) / 2;
+        else if (i == 1)
+            input[i]->pts_shift = llrint(params->offset / av_q2d(s->time_base));
+    }
+
+    /* The input behind is read first, so that the filter graph buffers a few frames */
+    while (!input[0]->eof || !input[1]->eof) {
+        compare_input_t *in = input[0];
+
+        if (input[0]->eof || (!input[1]->eof && input[1]->time < input[0]->time))
+            in = input[1];
+        if ((rc = compare_read_frames(in, packet, frame)) != eav_success)
+            goto avpipe_compare_end;
+        if ((rc = compare_sink_frames(buffersink_ctx, frame, &result, &sink_eof)) != eav_success)
+            goto avpipe_compare_end;
+        if (sink_eof)
+            break;
     }
+    if (!sink_eof && (rc = compare_sink_frames(buffersink_ctx, frame, &result, &sink_eof)) != eav_success)
+        goto avpipe_compare_end;
 
-    /* Close input handler resources */
-    in_handlers->avpipe_closer(&inctx);
+    /* libvmaf writes its log when it is freed */
+    avfilter_graph_free(&filter_graph);
+    if (has_vmaf) {
+        int n = compare_read_vmaf_log(&result, vmaf_log);
+        if (n != result.n_frames)
+            elv_warn("avpipe_compare found %d VMAF scores for %d frames, url=%s",
+                n, result.n_frames, params->distorted_url);
+        result.has_vmaf = n > 0;
+    }
 
-    return rc;
-}
+    elv_log("COMPARE done frames=%d width=%d height=%d vmaf=%d, reference=%s, distorted=%s", result.n_frames,
+        result.width, result.height, result.has_vmaf, params->reference_url, params->distorted_url);
 
-int avpipe_probe_free(xcprobe_t *probe, int n_streams) {
-    if (probe == NULL)
-        return 0;
+    *report = compare_report_json(&result, params->seg_duration, params->n_worst);
+    if (!*report)
+        rc = eav_mem_alloc;
 
-    for (int i=0; i<n_streams; i++) {
-        av_dict_free(&probe->stream_info[i].tags);
+avpipe_compare_end:
+    avfilter_graph_free(&filter_graph);
+    if (has_vmaf)
+        unlink(vmaf_log);
+    for (int i=0; i<2; i++) {
+        if (input[i]) {
+            compare_close_input(in_handlers, input[i]);
+            free(input[i]);
+        }
     }
-    free(probe->stream_info);
+    av_packet_free(&packet);
+    av_frame_free(&frame);
+    compare_result_free(&result);
+    return rc;
+}
 
-    free(probe);
-    return 0;
+static int
+is_live_url(
+    const char *url)
+{
+    return url &&
+        (!strncmp(url, "udp://", 6) || !strncmp(url, "rtp://", 6) ||
+         !strncmp(url, "srt://", 6) || !strncmp(url, "rtmp://", 7));
 }
 
 /*
@@ -4528,6 +8099,12 @@ check_params(
         return eav_param;
     }
 
+    if (params->rtp_jitter_buffer < 0 || params->rtp_jitter_buffer > RTP_JB_SIZE/2) {
+        elv_err("Invalid rtp_jitter_buffer=%d, must be between 0 and %d, url=%s",
+            params->rtp_jitter_buffer, RTP_JB_SIZE/2, params->url);
+        return eav_param;
+    }
+
     if (params->stream_id >= 0 && (params->xc_type != xc_none || params->n_audio > 0)) {
         elv_err("Incompatible params, stream_id=%d, xc_type=%d, n_audio=%d, url=%s",
             params->stream_id, params->xc_type, params->n_audio, params->url);
@@ -4561,8 +8138,10 @@ check_params(
      * References:
      *   - https://trac.ffmpeg.org/wiki/Limiting%20the%20output%20bitrate
      *   - https://trac.ffmpeg.org/wiki/Encode/H.264
+     *
+     * A two-pass VBR is only capped if rc_max_rate is set.
      */
-    if (params->video_bitrate > 0) {
+    if (params->video_bitrate > 0 && params->rc_mode != rc_mode_two_pass) {
         if (params->video_bitrate > params->rc_max_rate) {
             elv_log("Replacing rc_max_rate %d with video_bitrate %d, url=%s",
                 params->rc_max_rate, params->video_bitrate, params->url);
@@ -4670,6 +8249,299 @@ check_params(
             return eav_param;
         }
     }
+
+    if (params->scte35_pid != 0) {
+        if (!params->copy_mpegts) {
+            elv_err("Invalid scte35_pid=%d - only valid with copy MPEGTS, url=%s", params->scte35_pid, params->url);
+            return eav_param;
+        }
+        /* PIDs below 0x10 are reserved and 0x1fff is the null PID */
+        if (params->scte35_pid < 0x10 || params->scte35_pid >= 0x1fff) {
+            elv_err("Invalid scte35_pid=%d, must be between 16 and 8190, url=%s", params->scte35_pid, params->url);
+            return eav_param;
+        }
+    }
+
+    /*
+     * The dash/hls muxers start a new segment at a forced key frame, the segment muxer used for mez parts cuts at the
+     * first key frame after segment_duration_ts (see splice_key_frame_deferred()).
+     */
+    if (params->splice_segment) {
+        if ((params->xc_type & xc_video) == 0 ||
+            (strcmp(params->format, "dash") && strcmp(params->format, "hls") && !is_segment_muxer(params))) {
+            elv_err("Invalid splice_segment - only valid for dash/hls/fmp4-segment/segment video, format=%s, xc_type=%s, url=%s",
+                params->format, get_xc_type_name(params->xc_type), params->url);
+            return eav_param;
+        }
+    }
+
+    /* The emsg boxes are written in the video fMP4 segments */
+    if (params->emit_emsg) {
+        if ((params->xc_type & xc_video) == 0 ||
+            (strcmp(params->format, "dash") && strcmp(params->format, "hls") && strcmp(params->format, "fmp4-segment"))) {
+            elv_err("Invalid emit_emsg - only valid for dash/hls/fmp4-segment video, format=%s, xc_type=%s, url=%s",
+                params->format, get_xc_type_name(params->xc_type), params->url);
+            return eav_param;
+        }
+    }
+
+    /* The caption segments follow the dash/hls video segments, the A/53 captions are only in decoded frames */
+    if (params->extract_captions || params->xc_type == xc_extract_captions) {
+        if ((params->xc_type & xc_video) == 0 ||
+            params->bypass_transcoding ||
+            (strcmp(params->format, "dash") && strcmp(params->format, "hls"))) {
+            elv_err("Invalid extract_captions - only valid for dash/hls video without bypass, format=%s, xc_type=%s, url=%s",
+                params->format, get_xc_type_name(params->xc_type), params->url);
+            return eav_param;
+        }
+    }
+
+    /* Blanking works on decoded frames, rebasing on encoded or copied packets */
+    if ((params->blank && (params->bypass_transcoding || params->copy_mpegts)) ||
+        (params->rebase_pts && params->copy_mpegts)) {
+        elv_err("Invalid blank=%d rebase_pts=%d - blank is not valid with bypass or copy_mpegts, "
+            "rebase_pts is not valid with copy_mpegts, url=%s", params->blank, params->rebase_pts, params->url);
+        return eav_param;
+    }
+
+    /* Smart cut copies the input GOPs between the ones it re-encodes with libx264, the video must keep its timing and pixels */
+    if (params->smart_cut) {
+        if ((params->xc_type & xc_video) == 0 ||
+            params->bypass_transcoding || params->copy_mpegts || params->blank || params->rebase_pts ||
+            !params->ecodec || strcmp(params->ecodec, "libx264") ||
+            (strcmp(params->format, "mp4") && strcmp(params->format, "fmp4") && strcmp(params->format, "fmp4-segment"))) {
+            elv_err("Invalid smart_cut - only valid for mp4/fmp4/fmp4-segment video encoded with libx264, without bypass, copy_mpegts, blank or rebase_pts, format=%s, xc_type=%s, ecodec=%s, url=%s",
+                params->format, get_xc_type_name(params->xc_type), params->ecodec ? params->ecodec : "", params->url);
+            return eav_param;
+        }
+        if (params->video_time_base > 0 || params->video_frame_duration_ts > 0 || params->force_equal_fduration ||
+            params->rotate || params->deinterlace != dif_none ||
+            (params->watermark_text && *params->watermark_text != '\0') ||
+            (params->watermark_timecode && *params->watermark_timecode != '\0') ||
+            params->watermark_overlay_len > 0) {
+            elv_err("Invalid smart_cut - not valid with video_time_base, video_frame_duration_ts, force_equal_fduration, rotate, deinterlace or watermarks, url=%s",
+                params->url);
+            return eav_param;
+        }
+    }
+
+    /* Loudness is measured and normalized in the audio filter graph */
+    if ((params->measure_loudness || params->loudness_target != 0) &&
+        ((params->xc_type & xc_audio) == 0 || params->bypass_transcoding)) {
+        elv_err("Invalid measure_loudness=%d loudness_target=%.1f - only valid when transcoding audio, xc_type=%s, url=%s",
+            params->measure_loudness, params->loudness_target, get_xc_type_name(params->xc_type), params->url);
+        return eav_param;
+    }
+
+    if (params->loudness_target != 0) {
+        if (params->loudness_target < -70 || params->loudness_target > -5 ||
+            params->loudness_true_peak < -9 || params->loudness_true_peak > 0) {
+            elv_err("Invalid loudness_target=%.1f loudness_true_peak=%.1f - valid ranges are -70 to -5 LUFS and -9 to 0 dBTP, url=%s",
+                params->loudness_target, params->loudness_true_peak, params->url);
+            return eav_param;
+        }
+
+        /* The first pass reads the whole input before the normalization */
+        if (is_live_url(params->url)) {
+            elv_err("Invalid loudness_target - not valid with live inputs, url=%s", params->url);
+            return eav_param;
+        }
+    }
+
+    if ((params->detect_silence && ((params->xc_type & xc_audio) == 0 || params->bypass_transcoding)) ||
+        ((params->detect_black || params->detect_freeze) &&
+            ((params->xc_type & xc_video) == 0 || params->bypass_transcoding || params->smart_cut))) {
+        elv_err("Invalid detect_silence=%d detect_black=%d detect_freeze=%d - only valid when transcoding audio (silence) "
+            "or video (black and freeze) without smart_cut, xc_type=%s, url=%s",
+            params->detect_silence, params->detect_black, params->detect_freeze,
+            get_xc_type_name(params->xc_type), params->url);
+        return eav_param;
+    }
+
+    if (params->qc_min_duration < 0 || params->silence_threshold > 0) {
+        elv_err("Invalid qc_min_duration=%.3f silence_threshold=%.1f - must not be negative (duration) or positive (dB), url=%s",
+            params->qc_min_duration, params->silence_threshold, params->url);
+        return eav_param;
+    }
+
+    /* Scenes are detected in the video filter graph, the scene keyframes are set on the frames sent to the encoder */
+    if ((params->detect_scenes || params->scene_keyframes) &&
+        ((params->xc_type != xc_video && params->xc_type != xc_all) ||
+         params->bypass_transcoding || params->smart_cut || !strcmp(params->format, "image2"))) {
+        elv_err("Invalid detect_scenes=%d scene_keyframes=%d - only valid when transcoding video without smart_cut, "
+            "xc_type=%s, format=%s, url=%s", params->detect_scenes, params->scene_keyframes,
+            get_xc_type_name(params->xc_type), params->format, params->url);
+        return eav_param;
+    }
+
+    if (params->scene_threshold < 0 || params->scene_threshold > 1 || params->scene_tolerance < 0) {
+        elv_err("Invalid scene_threshold=%.3f scene_tolerance=%.3f - valid ranges are 0 to 1 and 0 or more sec, url=%s",
+            params->scene_threshold, params->scene_tolerance, params->url);
+        return eav_param;
+    }
+
+    /* The first pass reads the whole input before the transcoding */
+    if (params->scene_keyframes && is_live_url(params->url)) {
+        elv_err("Invalid scene_keyframes - not valid with live inputs, url=%s", params->url);
+        return eav_param;
+    }
+
+    if (params->crop && params->crop[0] != '\0') {
+        crop_rect_t crop;
+
+        if ((params->xc_type != xc_video && params->xc_type != xc_all) ||
+            params->bypass_transcoding || params->smart_cut || params->copy_mpegts) {
+            elv_err("Invalid crop=%s - only valid when transcoding video without smart_cut or copy_mpegts, "
+                "xc_type=%s, url=%s", params->crop, get_xc_type_name(params->xc_type), params->url);
+            return eav_param;
+        }
+
+        if (strcmp(params->crop, "auto") && parse_crop(params->crop, &crop) < 0) {
+            elv_err("Invalid crop=%s - must be \"auto\" or w:h:x:y, url=%s", params->crop, params->url);
+            return eav_param;
+        }
+
+        /* The first pass reads the whole input before the transcoding */
+        if (!strcmp(params->crop, "auto") && is_live_url(params->url)) {
+            elv_err("Invalid crop=auto - not valid with live inputs, url=%s", params->url);
+            return eav_param;
+        }
+    }
+
+    if (params->color_target < color_target_none || params->color_target > color_target_hlg ||
+        (params->color_target != color_target_none && (params->bypass_transcoding || params->smart_cut))) {
+        elv_err("Invalid color_target=%d - only valid when transcoding video without smart_cut, url=%s",
+            params->color_target, params->url);
+        return eav_param;
+    }
+
+    /* HDR outputs need 10 or 12 bit pixel formats */
+    if ((params->color_target == color_target_pq || params->color_target == color_target_hlg) &&
+        params->bitdepth < 10) {
+        elv_err("Invalid color_target=%d - HDR needs bitdepth 10 or 12, bitdepth=%d, url=%s",
+            params->color_target, params->bitdepth, params->url);
+        return eav_param;
+    }
+
+    if (params->fps_mode < fps_mode_none || params->fps_mode > fps_mode_ivtc ||
+        (params->fps_mode != fps_mode_none && (params->bypass_transcoding || params->smart_cut))) {
+        elv_err("Invalid fps_mode=%d - only valid when transcoding video without smart_cut, url=%s",
+            params->fps_mode, params->url);
+        return eav_param;
+    }
+
+    if (params->fps_mode == fps_mode_drop_dup || params->fps_mode == fps_mode_blend) {
+        AVRational frame_rate;
+
+        if (!params->frame_rate || av_parse_video_rate(&frame_rate, params->frame_rate) < 0) {
+            elv_err("Invalid frame_rate=%s - must be set with fps_mode=%d, url=%s",
+                params->frame_rate ? params->frame_rate : "", params->fps_mode, params->url);
+            return eav_param;
+        }
+    }
+
+    /* The pulldown works on the fields, the frames must not be deinterlaced before */
+    if ((params->fps_mode == fps_mode_telecine || params->fps_mode == fps_mode_ivtc) &&
+        params->deinterlace != dif_none) {
+        elv_err("Invalid fps_mode=%d - not valid with deinterlace, url=%s", params->fps_mode, params->url);
+        return eav_param;
+    }
+
+    /* HLS segments are fMP4 (or TS), VP9 is only packaged in WebM for DASH or in MP4 */
+    if ((params->xc_type & xc_video) && params->ecodec && !strcmp(params->ecodec, "libvpx-vp9") &&
+        !strcmp(params->format, "hls")) {
+        elv_err("Invalid ecodec=%s - not valid with format=%s, url=%s", params->ecodec, params->format, params->url);
+        return eav_param;
+    }
+
+    if (params->rc_mode < rc_mode_default || params->rc_mode > rc_mode_cbr) {
+        elv_err("Invalid rc_mode=%d, url=%s", params->rc_mode, params->url);
+        return eav_param;
+    }
+
+    if (params->rc_mode != rc_mode_default) {
+        const char *ecodec = params->ecodec ? params->ecodec : "";
+        int x26x = !strcmp(ecodec, "libx264") || !strcmp(ecodec, "libx265");
+        int has_crf = params->crf_str && params->crf_str[0] != '\0';
+
+        /* Only x264 and x265 have a CRF and two-pass stats, h264_nvenc has a CBR */
+        if (!(params->xc_type & xc_video) || params->bypass_transcoding || params->smart_cut ||
+            !(x26x || (params->rc_mode == rc_mode_cbr && !strcmp(ecodec, "h264_nvenc")))) {
+            elv_err("Invalid rc_mode=%d - not valid with ecodec=%s, bypass_transcoding=%d or smart_cut=%d, url=%s",
+                params->rc_mode, ecodec, params->bypass_transcoding, params->smart_cut, params->url);
+            return eav_param;
+        }
+
+        if (params->rc_mode == rc_mode_crf_capped && (!has_crf || params->video_bitrate > 0 || params->rc_max_rate <= 0)) {
+            elv_err("Invalid rc_mode=%d - needs crf_str and rc_max_rate without video_bitrate, crf_str=%s, "
+                "video_bitrate=%d, rc_max_rate=%d, url=%s", params->rc_mode, has_crf ? params->crf_str : "",
+                params->video_bitrate, params->rc_max_rate, params->url);
+            return eav_param;
+        }
+
+        /* The crf_str is ignored */
+        if ((params->rc_mode == rc_mode_two_pass || params->rc_mode == rc_mode_cbr) && params->video_bitrate <= 0) {
+            elv_err("Invalid rc_mode=%d - needs video_bitrate, video_bitrate=%d, url=%s",
+                params->rc_mode, params->video_bitrate, params->url);
+            return eav_param;
+        }
+
+        if (params->rc_mode == rc_mode_two_pass && params->rc_max_rate > 0 &&
+            params->rc_max_rate < params->video_bitrate) {
+            elv_err("Invalid rc_max_rate=%d - lower than video_bitrate=%d with rc_mode=%d, url=%s",
+                params->rc_max_rate, params->video_bitrate, params->rc_mode, params->url);
+            return eav_param;
+        }
+
+        if (params->rc_mode == rc_mode_two_pass && is_live_url(params->url)) {
+            elv_err("Invalid rc_mode=%d - two-pass is not valid with live inputs, url=%s", params->rc_mode, params->url);
+            return eav_param;
+        }
+    }
+
+    /* The audio renditions replace ecodec2, each one has its own output */
+    if (params->n_audio_renditions != 0) {
+        if (params->n_audio_renditions < 0 || params->n_audio_renditions > MAX_STREAMS ||
+            params->xc_type != xc_audio || params->bypass_transcoding || params->copy_mpegts ||
+            params->measure_loudness || params->loudness_target != 0 || params->detect_silence ||
+            (strcmp(params->format, "dash") && strcmp(params->format, "hls") && strcmp(params->format, "fmp4-segment"))) {
+            elv_err("Invalid n_audio_renditions=%d - only valid when transcoding audio to dash, hls or fmp4-segment "
+                "without bypass, copy_mpegts, loudness or silence detection, xc_type=%s, format=%s, url=%s",
+                params->n_audio_renditions, get_xc_type_name(params->xc_type), params->format, params->url);
+            return eav_param;
+        }
+
+        if (!params->seg_duration || atof(params->seg_duration) <= 0) {
+            elv_err("Invalid seg_duration - audio renditions need seg_duration, url=%s", params->url);
+            return eav_param;
+        }
+
+        for (int i=0; i<params->n_audio_renditions; i++) {
+            audio_rendition_t *r = &params->audio_renditions[i];
+
+            if (!r->ecodec ||
+                (strcmp(r->ecodec, "aac") && strcmp(r->ecodec, "ac3") &&
+                 strcmp(r->ecodec, "eac3") && strcmp(r->ecodec, "libopus")) ||
+                !avcodec_find_encoder_by_name(r->ecodec) ||
+                r->audio_index < 0 || r->channel_layout < 0 || r->bitrate < 0 || r->sample_rate < 0 ||
+                (r->name && strpbrk(r->name, "\"<>&")) || (r->lang && strpbrk(r->lang, "\"<>&"))) {
+                elv_err("Invalid audio rendition %d, audio_index=%d, ecodec=%s, channel_layout=%d, bitrate=%d, "
+                    "sample_rate=%d, name=%s, lang=%s - ecodec must be aac, ac3, eac3 or libopus, name and lang "
+                    "can't have any of \"<>&, url=%s", i, r->audio_index, r->ecodec ? r->ecodec : "",
+                    r->channel_layout, r->bitrate, r->sample_rate, r->name ? r->name : "", r->lang ? r->lang : "",
+                    params->url);
+                return eav_param;
+            }
+
+            /* If audio_index is not set, avpipe_init() selects the input streams of the renditions */
+            if (params->n_audio > 0 && selected_audio_index(params, r->audio_index) < 0) {
+                elv_err("Invalid audio rendition %d, audio_index=%d is not in audio_index, url=%s",
+                    i, r->audio_index, params->url);
+                return eav_param;
+            }
+        }
+    }
+
     return eav_success;
 }
 
@@ -4746,7 +8618,35 @@ log_params(
         "rotate=%d "
         "profile=%s "
         "level=%d "
-        "deinterlace=%d",
+        "deinterlace=%d "
+        "rtp_fec=%d "
+        "rtp_jitter_buffer=%d "
+        "scte35_pid=%d "
+        "splice_segment=%d "
+        "emit_emsg=%d "
+        "extract_captions=%d "
+        "strip_captions=%d "
+        "blank=%d "
+        "rebase_pts=%d "
+        "smart_cut=%d "
+        "measure_loudness=%d "
+        "loudness_target=%.1f "
+        "loudness_true_peak=%.1f "
+        "detect_silence=%d "
+        "detect_black=%d "
+        "detect_freeze=%d "
+        "qc_min_duration=%.3f "
+        "silence_threshold=%.1f "
+        "detect_scenes=%d "
+        "scene_threshold=%.3f "
+        "scene_keyframes=%d "
+        "scene_tolerance=%.3f "
+        "crop=%s "
+        "color_target=%d "
+        "fps_mode=%d "
+        "frame_rate=%s "
+        "rc_mode=%d "
+        "n_audio_renditions=%d",
         params->stream_id, params->url,
         avpipe_version(),
         params->bypass_transcoding, params->skip_decoding,
@@ -4770,7 +8670,17 @@ log_params(
         params->filter_descriptor,
         params->extract_image_interval_ts, params->extract_images_sz,
         1, params->video_time_base, params->video_frame_duration_ts, params->rotate,
-        params->profile ? params->profile : "", params->level,  params->deinterlace);
+        params->profile ? params->profile : "", params->level,  params->deinterlace,
+        params->rtp_fec, params->rtp_jitter_buffer, params->scte35_pid,
+        params->splice_segment, params->emit_emsg, params->extract_captions,
+        params->strip_captions, params->blank, params->rebase_pts, params->smart_cut,
+        params->measure_loudness, params->loudness_target, params->loudness_true_peak,
+        params->detect_silence, params->detect_black, params->detect_freeze,
+        params->qc_min_duration, params->silence_threshold,
+        params->detect_scenes, params->scene_threshold, params->scene_keyframes, params->scene_tolerance,
+        params->crop ? params->crop : "", params->color_target,
+        params->fps_mode, params->frame_rate ? params->frame_rate : "",
+        params->rc_mode, params->n_audio_renditions);
     elv_log("AVPIPE XCPARAMS %s", buf);
 }
 
@@ -4821,6 +8731,13 @@ avpipe_copy_xcparams(
         memcpy(p2->extract_images_ts, p->extract_images_ts, size);
     }
     p2->seg_duration = safe_strdup(p->seg_duration);
+    p2->crop = safe_strdup(p->crop);
+    p2->frame_rate = safe_strdup(p->frame_rate);
+    for (int i=0; i<p->n_audio_renditions && i<MAX_STREAMS; i++) {
+        p2->audio_renditions[i].ecodec = safe_strdup(p->audio_renditions[i].ecodec);
+        p2->audio_renditions[i].name = safe_strdup(p->audio_renditions[i].name);
+        p2->audio_renditions[i].lang = safe_strdup(p->audio_renditions[i].lang);
+    }
 
     return p2;
 }
@@ -4860,6 +8777,12 @@ avpipe_init(
     p_xctx->in_handlers = in_handlers;
     p_xctx->out_handlers = out_handlers;
     p_xctx->debug_frame_level = p->debug_frame_level;
+    p_xctx->cp_ctx.scte35_stream_index = -1;
+    p_xctx->cp_ctx.last_pts = AV_NOPTS_VALUE;
+    p_xctx->cp_ctx.scte35_pts = AV_NOPTS_VALUE;
+    pthread_mutex_init(&p_xctx->cue_lock, NULL);
+    pthread_mutex_init(&p_xctx->encoder_ctx.splice_lock, NULL);
+    pthread_mutex_init(&p_xctx->encoder_ctx.emsg_lock, NULL);
 
     log_params(params);
 
@@ -4869,6 +8792,15 @@ avpipe_init(
         goto avpipe_init_failed;
     }
 
+    /* Decode the input streams of the audio renditions if audio_index is not set */
+    if (params->n_audio_renditions > 0 && params->n_audio <= 0) {
+        params->n_audio = 0;
+        for (int i=0; i<params->n_audio_renditions; i++) {
+            if (selected_audio_index(params, params->audio_renditions[i].audio_index) < 0)
+                params->audio_index[params->n_audio++] = params->audio_renditions[i].audio_index;
+        }
+    }
+
     *xctx = p_xctx;
 
     return eav_success;
@@ -4916,10 +8848,66 @@ avpipe_free_params(
     free(params->filter_descriptor);
     free(params->mux_spec);
     free(params->extract_images_ts);
+    free(params->crop);
+    free(params->frame_rate);
+    for (int i=0; i<params->n_audio_renditions && i<MAX_STREAMS; i++) {
+        free(params->audio_renditions[i].ecodec);
+        free(params->audio_renditions[i].name);
+        free(params->audio_renditions[i].lang);
+    }
     free(params);
     xctx->params = NULL;
 }
 
+int
+avpipe_insert_cue(
+    xctx_t *xctx,
+    int64_t pts,
+    uint8_t *section,
+    int size)
+{
+    xc_cue_t **p;
+
+    if (!xctx || !section || size < SCTE35_MIN_SECTION_SIZE) {
+        elv_err("Invalid SCTE-35 cue, size=%d", size);
+        return eav_param;
+    }
+
+    if (xctx->params->scte35_pid == 0) {
+        elv_err("SCTE-35 cue insertion is not enabled (scte35_pid is not set), url=%s", xctx->params->url);
+        return eav_param;
+    }
+
+    /* splice_info_section: table_id 0xfc and section_length covering the whole section */
+    if (section[0] != 0xfc || 3 + (((section[1] & 0x0f) << 8) | section[2]) != size) {
+        elv_err("Invalid SCTE-35 section, table_id=0x%x, size=%d, url=%s", section[0], size, xctx->params->url);
+        return eav_param;
+    }
+
+    /* The section is written as is, the CRC_32 over the whole section is 0 */
+    if (av_crc(av_crc_get_table(AV_CRC_32_IEEE), UINT32_MAX, section, size) != 0) {
+        elv_err("Invalid SCTE-35 section CRC_32, size=%d, url=%s", size, xctx->params->url);
+        return eav_param;
+    }
+
+    xc_cue_t *cue = (xc_cue_t *) calloc(1, sizeof(xc_cue_t));
+    cue->pts = pts;
+    cue->size = size;
+    cue->section = (uint8_t *) malloc(size);
+    memcpy(cue->section, section, size);
+
+    /* Keep the cues ordered by pts, cues with the same pts are inserted in order */
+    pthread_mutex_lock(&xctx->cue_lock);
+    for (p = &xctx->cues; *p != NULL && (*p)->pts <= pts; p = &(*p)->next)
+        ;
+    cue->next = *p;
+    *p = cue;
+    pthread_mutex_unlock(&xctx->cue_lock);
+
+    elv_log("Scheduled SCTE-35 cue pts=%"PRId64", size=%d, url=%s", pts, size, xctx->params->url);
+    return eav_success;
+}
+
 int
 avpipe_fini(
     xctx_t **xctx)
@@ -4963,11 +8951,22 @@ avpipe_fini(
             avfilter_graph_free(&decoder_context->audio_filter_graph[i]);
     }
 
+    /* Free the smart cut GOP and bitstream filter */
+    if (decoder_context) {
+        smart_cut_free_gop(decoder_context);
+        av_freep(&decoder_context->smart_cut_gop);
+        qc_report_free(&decoder_context->qc_report);
+        free(decoder_context->scene_cuts);
+        av_bsf_free(&decoder_context->smart_cut_bsf);
+    }
+
     if (encoder_context && encoder_context->format_context) {
         void *avpipe_opaque = encoder_context->format_context->avpipe_opaque;
         avformat_free_context(encoder_context->format_context);
         free(avpipe_opaque);
     }
+    if (encoder_context)
+        free(encoder_context->scene_keyframes);
     if (encoder_context) {
         for (int i=0; i<encoder_context->n_audio_output; i++) { 
             void *avpipe_opaque = encoder_context->format_context2[i]->avpipe_opaque;
@@ -4976,6 +8975,14 @@ avpipe_fini(
         }
     }
 
+    /* Free the encoders and filter graphs of the audio renditions */
+    if (encoder_context) {
+        for (int i=0; i<encoder_context->n_audio_output; i++) {
+            avfilter_graph_free(&encoder_context->renditions[i].filter_graph);
+            avcodec_free_context(&encoder_context->renditions[i].codec_context);
+        }
+    }
+
     for (int i=0; i<MAX_STREAMS; i++) {
         if (decoder_context->codec_context[i]) {
             /* Corresponds to avcodec_open2() */
@@ -4990,6 +8997,10 @@ avpipe_fini(
         }
     }
 
+    /* The stats of a two-pass rate control are removed once the encoder of the second pass is closed */
+    if (encoder_context->rc_pass == 2 && encoder_context->rc_stats[0] != '\0')
+        rc_stats_remove(encoder_context->rc_stats);
+
 #ifdef USE_RESAMPLE_AAC
     if ((*xctx)->params && !strcmp((*xctx)->params->ecodec2, "aac")) {
         av_audio_fifo_free(decoder_context->fifo);
@@ -5003,10 +9014,30 @@ avpipe_fini(
 
     if ((*xctx)->inctx && (*xctx)->inctx->udp_channel)
         elv_channel_fini(&((*xctx)->inctx->udp_channel));
+    if ((*xctx)->inctx && (*xctx)->inctx->rtp_ctx)
+        rtp_ctx_free(&((*xctx)->inctx->rtp_ctx));
     free((*xctx)->inctx);
     elv_channel_fini(&((*xctx)->vc));
     elv_channel_fini(&((*xctx)->ac));
 
+    for (xc_cue_t *cue = (*xctx)->cues; cue != NULL; ) {
+        xc_cue_t *next = cue->next;
+        free(cue->section);
+        free(cue);
+        cue = next;
+    }
+    (*xctx)->cues = NULL;
+    pthread_mutex_destroy(&(*xctx)->cue_lock);
+    pthread_mutex_destroy(&(*xctx)->encoder_ctx.splice_lock);
+
+    for (int i = 0; i < (*xctx)->encoder_ctx.n_emsg_events; i++)
+        emsg_event_free((*xctx)->encoder_ctx.emsg_events[i]);
+    (*xctx)->encoder_ctx.n_emsg_events = 0;
+    pthread_mutex_destroy(&(*xctx)->encoder_ctx.emsg_lock);
+
+    cc_ctx_free((*xctx)->encoder_ctx.cc);
+    free((*xctx)->encoder_ctx.a53);
+
     avpipe_free_params(*xctx);
     free(*xctx);
     *xctx = NULL;
@@ -54,3 +54,164 @@ int parse_scte35_pkt(uint8_t *scte35_cmd_type, const AVPacket *avpkt)
     *scte35_cmd_type = buf[13];
     return 0;
 }
+
+#define SCTE35_PTS_MASK 0x1ffffffffLL
+
+static int64_t
+read_pts33(const uint8_t *buf)
+{
+    return ((int64_t)(buf[0] & 0x01) << 32) |
+        ((int64_t)buf[1] << 24) | ((int64_t)buf[2] << 16) | ((int64_t)buf[3] << 8) | buf[4];
+}
+
+/*
+ * Parse the splice time of a splice_insert or time_signal command. The pts_adjustment is
+ * applied to the returned pts (90kHz, 33 bits).
+ *
+ * Returns 0 and sets pts if the command has a splice time. Sets pts to AV_NOPTS_VALUE for a
+ * splice_insert with splice_immediate_flag, in which case the splice is at the packet pts.
+ * Returns 1 if the command doesn't splice at a given time (cancelled, component splice,
+ * time_specified_flag not set or other command types) and -1 if the packet can't be parsed.
+ *
+ * Simplified byte format of the commands (starting at byte 14)
+ *
+ *   splice_insert
+ *   - 32 bits  - splice event id
+ *   -  1 bit   - splice event cancel indicator
+ *   -  7 bits  - reserved
+ *   -  1 bit   - out of network indicator
+ *   -  1 bit   - program splice flag
+ *   -  1 bit   - duration flag
+ *   -  1 bit   - splice immediate flag
+ *   -  4 bits  - event id compliance flag and reserved
+ *   (splice_time() follows if program splice flag is set and splice immediate flag is not)
+ *
+ *   time_signal
+ *   (splice_time())
+ *
+ *   splice_time()
+ *   -  1 bit   - time specified flag
+ *   -  6 bits  - reserved (7 bits if time specified flag is not set)
+ *   - 33 bits  - pts time (if time specified flag is set)
+ */
+int parse_scte35_splice_time(int64_t *pts, const AVPacket *avpkt)
+{
+    const uint8_t *buf = avpkt->data;
+    const uint8_t *splice_time;
+    int size = avpkt->size;
+    int64_t pts_adjustment;
+
+    if (pts == NULL)
+        return -1;
+
+    *pts = AV_NOPTS_VALUE;
+
+    if (size < 20 || buf[0] != 0xfc)
+        return -1;
+
+    /* Encrypted commands can't be parsed */
+    if (buf[4] & 0x80)
+        return 1;
+
+    pts_adjustment = read_pts33(buf + 4);
+
+    switch (buf[13]) {
+    case 5: /* splice_insert */
+        if (buf[18] & 0x80)
+            return 1;
+        if (!(buf[19] & 0x40))
+            return 1;
+        if (buf[19] & 0x10)
+            return 0;
+        splice_time = buf + 20;
+        break;
+    case 6: /* time_signal */
+        splice_time = buf + 14;
+        break;
+    default:
+        return 1;
+    }
+
+    if (splice_time + 1 > buf + size)
+        return -1;
+    if (!(splice_time[0] & 0x80))
+        return 1;
+    if (splice_time + 5 > buf + size)
+        return -1;
+
+    *pts = (read_pts33(splice_time) + pts_adjustment) & SCTE35_PTS_MASK;
+    return 0;
+}
+
+/*
+ * Parse the break_duration of a splice_insert command (90kHz).
+ *
+ * Returns 0 and sets duration if the splice_insert has a break duration, 1 if it doesn't
+ * (no duration flag, cancelled or other command types) and -1 if the packet can't be parsed.
+ *
+ * The break_duration follows the splice_time() of a program splice or the component loop:
+ *
+ *   -  8 bits  - component count
+ *   component_count x
+ *     -  8 bits  - component tag
+ *     (splice_time() if splice immediate flag is not set)
+ *
+ *   break_duration()
+ *   -  1 bit   - auto return
+ *   -  6 bits  - reserved
+ *   - 33 bits  - duration
+ */
+int parse_scte35_break_duration(int64_t *duration, const AVPacket *avpkt)
+{
+    const uint8_t *buf = avpkt->data;
+    int size = avpkt->size;
+    int program_splice;
+    int immediate;
+    int pos;
+
+    if (duration == NULL)
+        return -1;
+
+    *duration = 0;
+
+    if (size < 20 || buf[0] != 0xfc)
+        return -1;
+
+    if (buf[4] & 0x80 || buf[13] != 5)
+        return 1;
+
+    /* Cancelled or no duration flag */
+    if (buf[18] & 0x80 || !(buf[19] & 0x20))
+        return 1;
+
+    program_splice = buf[19] & 0x40;
+    immediate = buf[19] & 0x10;
+    pos = 20;
+
+    if (program_splice) {
+        if (!immediate) {
+            if (pos >= size)
+                return -1;
+            pos += (buf[pos] & 0x80) ? 5 : 1;
+        }
+    } else {
+        int component_count;
+        if (pos >= size)
+            return -1;
+        component_count = buf[pos++];
+        for (int i = 0; i < component_count; i++) {
+            pos++;
+            if (!immediate) {
+                if (pos >= size)
+                    return -1;
+                pos += (buf[pos] & 0x80) ? 5 : 1;
+            }
+        }
+    }
+
+    if (pos + 5 > size)
+        return -1;
+
+    *duration = read_pts33(buf + pos);
+    return 0;
+}
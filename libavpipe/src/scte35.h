@@ -12,3 +12,13 @@ int
 parse_scte35_pkt(
     uint8_t *scte35_cmd_type,
     const AVPacket *avpkt);
+
+int
+parse_scte35_splice_time(
+    int64_t *pts,
+    const AVPacket *avpkt);
+
+int
+parse_scte35_break_duration(
+    int64_t *duration,
+    const AVPacket *avpkt);
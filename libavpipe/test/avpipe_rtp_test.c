@@ -0,0 +1,497 @@
+#include <stdlib.h>
+#include <stdio.h>
+#include <stdint.h>
+#include <inttypes.h>
+#include <string.h>
+#include "avpipe_rtp.h"
+#include "elv_log.h"
+
+#define RTP_PT_MP2T         33
+#define RTP_SSRC            0x12345678
+#define MAX_DELIVERED       256
+#define FEC_L               4           /* FEC matrix columns */
+#define FEC_D               4           /* FEC matrix rows */
+
+#define CHECK(cond) \
+    do { \
+        if (!(cond)) { \
+            printf("Test %s failed line %d: %s\n", __func__, __LINE__, #cond); \
+            failed++; \
+        } \
+    } while (0)
+
+static int failed;
+
+/* Payloads delivered by the RTP context, in delivery order */
+typedef struct test_output_t {
+    int         n;
+    int         len[MAX_DELIVERED];
+    uint8_t     payload[MAX_DELIVERED][RTP_MAX_PAYLOAD];
+} test_output_t;
+
+static int
+test_output(
+    void *opaque,
+    uint8_t *buf,
+    int len)
+{
+    test_output_t *out = (test_output_t *) opaque;
+
+    if (out->n < MAX_DELIVERED) {
+        out->len[out->n] = len;
+        memcpy(out->payload[out->n], buf, len);
+    }
+    out->n++;
+    return 0;
+}
+
+/* The payload length varies with seq so that the FEC length recovery is exercised */
+static int
+payload_len(
+    uint16_t seq)
+{
+    return 7*188 - (seq % 5) * 188;
+}
+
+static void
+fill_payload(
+    uint16_t seq,
+    uint8_t *payload,
+    int len)
+{
+    for (int i=0; i<len; i++)
+        payload[i] = (uint8_t) (seq * 31 + i);
+}
+
+static uint32_t
+rtp_ts(
+    uint16_t seq)
+{
+    return 90000 + seq * 3000;
+}
+
+static void
+wb16(
+    uint8_t *p,
+    uint16_t v)
+{
+    p[0] = v >> 8;
+    p[1] = v;
+}
+
+static void
+wb32(
+    uint8_t *p,
+    uint32_t v)
+{
+    p[0] = v >> 24;
+    p[1] = v >> 16;
+    p[2] = v >> 8;
+    p[3] = v;
+}
+
+static int
+make_rtp(
+    uint8_t *buf,
+    uint8_t pt,
+    uint16_t seq,
+    uint32_t ts)
+{
+    buf[0] = 0x80;
+    buf[1] = pt;
+    wb16(buf+2, seq);
+    wb32(buf+4, ts);
+    wb32(buf+8, RTP_SSRC);
+    return RTP_HEADER_LEN;
+}
+
+static int
+make_media(
+    uint8_t *buf,
+    uint16_t seq)
+{
+    int off = make_rtp(buf, RTP_PT_MP2T, seq, rtp_ts(seq));
+    int len = payload_len(seq);
+
+    fill_payload(seq, buf+off, len);
+    return off + len;
+}
+
+/*
+ * Builds a SMPTE 2022-1 FEC packet protecting na media packets starting at snbase,
+ * offset apart. d is 0 for column FEC and 1 for row FEC.
+ */
+static int
+make_fec(
+    uint8_t *buf,
+    int d,
+    uint16_t snbase,
+    int offset,
+    int na)
+{
+    uint8_t payload[RTP_MAX_PAYLOAD];
+    uint8_t recovery[RTP_MAX_PAYLOAD];
+    uint16_t len_recovery = 0;
+    uint8_t pt_recovery = 0;
+    uint32_t ts_recovery = 0;
+    int max_len = 0;
+
+    memset(recovery, 0, sizeof(recovery));
+    for (int i=0; i<na; i++) {
+        uint16_t seq = snbase + i * offset;
+        int len = payload_len(seq);
+        fill_payload(seq, payload, len);
+        for (int j=0; j<len; j++)
+            recovery[j] ^= payload[j];
+        if (len > max_len)
+            max_len = len;
+        len_recovery ^= len;
+        pt_recovery ^= RTP_PT_MP2T;
+        ts_recovery ^= rtp_ts(seq);
+    }
+
+    int off = make_rtp(buf, 96, 0, 0);
+    uint8_t *p = buf + off;
+    memset(p, 0, RTP_FEC_HEADER_LEN);
+    wb16(p, snbase);
+    wb16(p+2, len_recovery);
+    p[4] = 0x80 | pt_recovery;          /* E=1, mask is 0 */
+    wb32(p+8, ts_recovery);
+    p[12] = (d << 6);                   /* N=0, type=0 (XOR), index=0 */
+    p[13] = offset;
+    p[14] = na;
+    memcpy(p + RTP_FEC_HEADER_LEN, recovery, max_len);
+    return off + RTP_FEC_HEADER_LEN + max_len;
+}
+
+static void
+push_media(
+    rtp_ctx_t *ctx,
+    uint16_t seq)
+{
+    uint8_t buf[RTP_HEADER_LEN + RTP_MAX_PAYLOAD];
+    int len = make_media(buf, seq);
+
+    CHECK(rtp_push_media(ctx, buf, len) == 0);
+}
+
+static void
+push_column_fec(
+    rtp_ctx_t *ctx,
+    uint16_t snbase)
+{
+    uint8_t buf[RTP_HEADER_LEN + RTP_FEC_HEADER_LEN + RTP_MAX_PAYLOAD];
+    int len = make_fec(buf, 0, snbase, FEC_L, FEC_D);
+
+    CHECK(rtp_push_fec(ctx, buf, len) == 0);
+}
+
+static void
+push_row_fec(
+    rtp_ctx_t *ctx,
+    uint16_t snbase)
+{
+    uint8_t buf[RTP_HEADER_LEN + RTP_FEC_HEADER_LEN + RTP_MAX_PAYLOAD];
+    int len = make_fec(buf, 1, snbase, 1, FEC_L);
+
+    CHECK(rtp_push_fec(ctx, buf, len) == 0);
+}
+
+/* Checks that out holds the payloads of the n packets starting at first, except the skipped ones */
+static void
+check_delivered(
+    const char *name,
+    test_output_t *out,
+    uint16_t first,
+    int n,
+    const uint16_t *skip,
+    int n_skip)
+{
+    uint8_t payload[RTP_MAX_PAYLOAD];
+    int k = 0;
+
+    for (int i=0; i<n; i++) {
+        uint16_t seq = first + i;
+        int skipped = 0;
+        for (int j=0; j<n_skip; j++) {
+            if (skip[j] == seq)
+                skipped = 1;
+        }
+        if (skipped)
+            continue;
+
+        if (k >= out->n) {
+            printf("Test %s failed: seq=%d not delivered\n", name, seq);
+            failed++;
+            return;
+        }
+        fill_payload(seq, payload, payload_len(seq));
+        if (out->len[k] != payload_len(seq) || memcmp(out->payload[k], payload, out->len[k])) {
+            printf("Test %s failed: packet %d is not seq=%d, len=%d\n", name, k, seq, out->len[k]);
+            failed++;
+        }
+        k++;
+    }
+    if (k != out->n) {
+        printf("Test %s failed: delivered=%d, expected=%d\n", name, out->n, k);
+        failed++;
+    }
+}
+
+static void
+test_in_order()
+{
+    test_output_t *out = calloc(1, sizeof(test_output_t));
+    rtp_ctx_t *ctx = rtp_ctx_new(0, test_output, out);
+    rtp_stats_t stats;
+
+    for (int i=0; i<10; i++)
+        push_media(ctx, 100+i);
+    check_delivered(__func__, out, 100, 10, NULL, 0);
+
+    rtp_get_stats(ctx, &stats);
+    CHECK(stats.packets_received == 10);
+    CHECK(stats.packets_lost == 0);
+    CHECK(stats.packets_reordered == 0);
+    CHECK(stats.ssrc == RTP_SSRC);
+
+    rtp_ctx_free(&ctx);
+    CHECK(ctx == NULL);
+    free(out);
+}
+
+static void
+test_reorder()
+{
+    test_output_t *out = calloc(1, sizeof(test_output_t));
+    rtp_ctx_t *ctx = rtp_ctx_new(8, test_output, out);
+    rtp_stats_t stats;
+    /* Sequence numbers wrap around in the middle, seq=4 is received twice before seq=3 fills the hole */
+    uint16_t order[] = { 65533, 65535, 65534, 1, 0, 2, 4, 4, 3, 5 };
+    int n = sizeof(order)/sizeof(order[0]);
+
+    for (int i=0; i<n; i++)
+        push_media(ctx, order[i]);
+
+    /* Everything is delivered as soon as the holes are filled, without a flush */
+    check_delivered(__func__, out, 65533, n-1, NULL, 0);
+
+    /* A packet that was delivered already is late */
+    push_media(ctx, 65534);
+    CHECK(out->n == n-1);
+
+    rtp_get_stats(ctx, &stats);
+    CHECK(stats.packets_received == n + 1);
+    CHECK(stats.packets_reordered == 3);
+    CHECK(stats.packets_duplicated == 1);
+    CHECK(stats.packets_late == 1);
+    CHECK(stats.packets_lost == 0);
+
+    rtp_ctx_free(&ctx);
+    free(out);
+}
+
+static void
+test_loss()
+{
+    test_output_t *out = calloc(1, sizeof(test_output_t));
+    rtp_ctx_t *ctx = rtp_ctx_new(4, test_output, out);
+    rtp_stats_t stats;
+    uint16_t lost[] = { 3, 11, 12 };
+
+    push_media(ctx, 0);
+    push_media(ctx, 1);
+    push_media(ctx, 2);
+    push_media(ctx, 4);
+    push_media(ctx, 5);
+    push_media(ctx, 6);
+    /* seq=3 is still waited for within the reorder window */
+    CHECK(out->n == 3);
+
+    push_media(ctx, 7);
+    /* The reorder window is exceeded, seq=3 is declared lost */
+    CHECK(out->n == 7);
+
+    /* seq=3 is too late now */
+    push_media(ctx, 3);
+    CHECK(out->n == 7);
+
+    for (int seq=8; seq<16; seq++) {
+        if (seq != 11 && seq != 12)
+            push_media(ctx, seq);
+    }
+    CHECK(rtp_flush(ctx) == 0);
+    check_delivered(__func__, out, 0, 16, lost, 3);
+
+    rtp_get_stats(ctx, &stats);
+    CHECK(stats.packets_lost == 3);
+    CHECK(stats.packets_late == 1);
+    CHECK(stats.packets_recovered == 0);
+
+    rtp_ctx_free(&ctx);
+    free(out);
+}
+
+static void
+test_invalid()
+{
+    test_output_t *out = calloc(1, sizeof(test_output_t));
+    rtp_ctx_t *ctx = rtp_ctx_new(0, test_output, out);
+    uint8_t buf[RTP_HEADER_LEN + RTP_FEC_HEADER_LEN + RTP_MAX_PAYLOAD];
+    int len;
+
+    /* Too short */
+    len = make_media(buf, 0);
+    CHECK(rtp_push_media(ctx, buf, RTP_HEADER_LEN-1) == -1);
+
+    /* Not RTP version 2 */
+    buf[0] = 0x40;
+    CHECK(rtp_push_media(ctx, buf, len) == -1);
+
+    /* Unsupported FEC type */
+    len = make_fec(buf, 0, 0, FEC_L, FEC_D);
+    buf[RTP_HEADER_LEN+12] |= 1 << 3;
+    CHECK(rtp_push_fec(ctx, buf, len) == -1);
+
+    CHECK(out->n == 0);
+    rtp_ctx_free(&ctx);
+    free(out);
+}
+
+/*
+ * Drops one packet in the FEC matrix and recovers it with the column FEC.
+ */
+static void
+test_fec_column()
+{
+    test_output_t *out = calloc(1, sizeof(test_output_t));
+    rtp_ctx_t *ctx = rtp_ctx_new(0, test_output, out);
+    rtp_stats_t stats;
+    uint16_t base = 1000;
+    uint16_t lost = base + 2*FEC_L + 1;
+
+    for (int i=0; i<FEC_L*FEC_D; i++) {
+        if (base+i != lost)
+            push_media(ctx, base+i);
+    }
+    CHECK(out->n == 2*FEC_L + 1);
+
+    for (int c=0; c<FEC_L; c++)
+        push_column_fec(ctx, base+c);
+    check_delivered(__func__, out, base, FEC_L*FEC_D, NULL, 0);
+
+    rtp_get_stats(ctx, &stats);
+    CHECK(stats.packets_recovered == 1);
+    CHECK(stats.packets_lost == 0);
+    CHECK(stats.fec_packets_received == FEC_L);
+    CHECK(stats.fec_columns == FEC_L);
+    CHECK(stats.fec_rows == FEC_D);
+
+    rtp_ctx_free(&ctx);
+    free(out);
+}
+
+/*
+ * Drops a whole row, which row FEC can't recover, plus another packet in
+ * column 1. Row FEC recovers the packet in row 3, which leaves a single packet
+ * missing in each column for column FEC to recover.
+ */
+static void
+test_fec_row_column()
+{
+    test_output_t *out = calloc(1, sizeof(test_output_t));
+    rtp_ctx_t *ctx = rtp_ctx_new(0, test_output, out);
+    rtp_stats_t stats;
+    uint16_t base = 65530;                      /* The matrix wraps around */
+    uint16_t lost[FEC_L+1];
+    int n_lost = 0;
+
+    for (int c=0; c<FEC_L; c++)
+        lost[n_lost++] = base + FEC_L + c;      /* Row 1 */
+    lost[n_lost++] = base + 3*FEC_L + 1;        /* Row 3, column 1 */
+
+    for (int i=0; i<FEC_L*FEC_D; i++) {
+        uint16_t seq = base + i;
+        int drop = 0;
+        for (int j=0; j<n_lost; j++) {
+            if (lost[j] == seq)
+                drop = 1;
+        }
+        if (!drop)
+            push_media(ctx, seq);
+    }
+    CHECK(out->n == FEC_L);
+
+    /* Row FEC can't recover row 1 but recovers (3, 1) */
+    for (int r=0; r<FEC_D; r++)
+        push_row_fec(ctx, base + r*FEC_L);
+    CHECK(out->n == FEC_L);
+    rtp_get_stats(ctx, &stats);
+    CHECK(stats.packets_recovered == 1);
+
+    for (int c=0; c<FEC_L; c++)
+        push_column_fec(ctx, base+c);
+    check_delivered(__func__, out, base, FEC_L*FEC_D, NULL, 0);
+
+    rtp_get_stats(ctx, &stats);
+    CHECK(stats.packets_recovered == n_lost);
+    CHECK(stats.packets_lost == 0);
+    CHECK(stats.fec_packets_received == FEC_L + FEC_D);
+
+    rtp_ctx_free(&ctx);
+    free(out);
+}
+
+/*
+ * Two packets missing in the same row and the same column can't be recovered.
+ */
+static void
+test_fec_unrecoverable()
+{
+    test_output_t *out = calloc(1, sizeof(test_output_t));
+    rtp_ctx_t *ctx = rtp_ctx_new(0, test_output, out);
+    rtp_stats_t stats;
+    uint16_t base = 0;
+    uint16_t lost[] = { base + FEC_L, base + FEC_L + 1, base + 2*FEC_L, base + 2*FEC_L + 1 };
+
+    for (int i=0; i<FEC_L*FEC_D; i++) {
+        uint16_t seq = base + i;
+        if (seq != lost[0] && seq != lost[1] && seq != lost[2] && seq != lost[3])
+            push_media(ctx, seq);
+    }
+    for (int r=0; r<FEC_D; r++)
+        push_row_fec(ctx, base + r*FEC_L);
+    for (int c=0; c<FEC_L; c++)
+        push_column_fec(ctx, base+c);
+    CHECK(out->n == FEC_L);
+
+    CHECK(rtp_flush(ctx) == 0);
+    check_delivered(__func__, out, base, FEC_L*FEC_D, lost, 4);
+
+    rtp_get_stats(ctx, &stats);
+    CHECK(stats.packets_recovered == 0);
+    CHECK(stats.packets_lost == 4);
+
+    rtp_ctx_free(&ctx);
+    free(out);
+}
+
+int
+main() {
+    elv_set_log_level(elv_log_warning);
+
+    test_in_order();
+    test_reorder();
+    test_loss();
+    test_invalid();
+    test_fec_column();
+    test_fec_row_column();
+    test_fec_unrecoverable();
+
+    if (failed) {
+        printf("%d checks failed\n", failed);
+        return 1;
+    }
+    printf("All tests passed\n");
+    return 0;
+}
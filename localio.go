@@ -0,0 +1,136 @@
+/*
+ * Local file IO and probe helpers of the Go side transcoding flows (EDL, ladder analysis)
+ * that run several transcodings in a work directory.
+ */
+package avpipe
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// probeStream returns the stream with the given index, or the first stream of codecType if index < 0
+func probeStream(probe *ProbeInfo, codecType string, index int) *StreamInfo {
+	for i := range probe.StreamInfo {
+		si := &probe.StreamInfo[i]
+		if si.CodecType == codecType && (index < 0 || si.StreamIndex == index) {
+			return si
+		}
+	}
+	return nil
+}
+
+// secondsToTs converts seconds to a number of ticks of timeBase
+func secondsToTs(seconds float64, timeBase *big.Rat) int64 {
+	tb, _ := timeBase.Float64()
+	if tb <= 0 {
+		return 0
+	}
+	return int64(math.Round(seconds / tb))
+}
+
+// dirOutputOpener writes the single fmp4-segment video or audio output of a transcoding in dir
+type dirOutputOpener struct {
+	dir    string
+	path   string
+	frames int64
+	err    error
+}
+
+func (o *dirOutputOpener) Open(h, fd int64, streamIndex, segIndex int, pts int64, outType AVType) (OutputHandler, error) {
+	var name string
+	switch outType {
+	case FMP4VideoSegment:
+		name = "video.mp4"
+	case FMP4AudioSegment:
+		name = "audio.mp4"
+	default:
+		o.err = fmt.Errorf("unexpected output type %s", outType.Name())
+		return nil, o.err
+	}
+
+	if segIndex > 1 {
+		o.err = fmt.Errorf("output split in more than one segment, seg_index=%d", segIndex)
+		return nil, o.err
+	}
+
+	o.path = filepath.Join(o.dir, name)
+	file, err := os.Create(o.path)
+	if err != nil {
+		o.err = err
+		return nil, err
+	}
+
+	return &dirOutput{opener: o, file: file}, nil
+}
+
+type dirOutput struct {
+	opener *dirOutputOpener
+	file   *os.File
+}
+
+func (o *dirOutput) Write(buf []byte) (int, error) {
+	return o.file.Write(buf)
+}
+
+func (o *dirOutput) Seek(offset int64, whence int) (int64, error) {
+	return o.file.Seek(offset, whence)
+}
+
+func (o *dirOutput) Close() error {
+	return o.file.Close()
+}
+
+func (o *dirOutput) Stat(streamIndex int, avType AVType, statType AVStatType, statArgs interface{}) error {
+	if statType == AV_OUT_STAT_FRAME_WRITTEN {
+		o.opener.frames = statArgs.(*EncodingFrameStats).TotalFramesWritten
+	}
+	return nil
+}
+
+// localInputOpener reads a local file
+type localInputOpener struct{}
+
+func (o *localInputOpener) Open(fd int64, url string) (InputHandler, error) {
+	file, err := os.Open(url)
+	if err != nil {
+		return nil, err
+	}
+	return &localInput{file: file}, nil
+}
+
+type localInput struct {
+	file *os.File
+}
+
+func (i *localInput) Read(buf []byte) (int, error) {
+	n, err := i.file.Read(buf)
+	if err == io.EOF {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (i *localInput) Seek(offset int64, whence int) (int64, error) {
+	return i.file.Seek(offset, whence)
+}
+
+func (i *localInput) Close() error {
+	return i.file.Close()
+}
+
+func (i *localInput) Size() int64 {
+	fi, err := i.file.Stat()
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+func (i *localInput) Stat(streamIndex int, statType AVStatType, statArgs interface{}) error {
+	return nil
+}
@@ -0,0 +1,14 @@
+package avpipe
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondsToTs(t *testing.T) {
+	require.Equal(t, int64(240240), secondsToTs(10.01, big.NewRat(1, 24000)))
+	require.Equal(t, int64(900000), secondsToTs(10, big.NewRat(1, 90000)))
+	require.Equal(t, int64(0), secondsToTs(10, big.NewRat(0, 1)))
+}
@@ -0,0 +1,306 @@
+/*
+ * Typed representation of the muxing spec that is passed to avpipe in
+ * XcParams.MuxingSpec.
+ */
+package avpipe
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MuxType is the type of a muxing job, the first line of a muxing spec.
+type MuxType string
+
+const (
+	// MuxTypeMez muxes mezzanine parts (the default)
+	MuxTypeMez MuxType = "mez-mux"
+	// MuxTypeAbr muxes ABR init and media segments
+	MuxTypeAbr MuxType = "abr-mux"
+)
+
+const (
+	muxKindVideo    = "video"
+	muxKindAudio    = "audio"
+	muxKindCaption  = "caption"
+	muxKindSubtitle = "subtitle"
+)
+
+// MuxInput is one input stream of a muxing job. The parts are stitched
+// together in order to produce the output stream.
+type MuxInput struct {
+	Parts []string `json:"parts"`
+	Lang  string   `json:"lang,omitempty"`
+	// Kind, Role and Name only apply to captions. Kind is "caption" (default)
+	// or "subtitle". Role is free form and defaults to the kind.
+	Kind string `json:"kind,omitempty"`
+	Role string `json:"role,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// MuxSpec describes a muxing job. String() produces the text format expected
+// by XcParams.MuxingSpec and ParseMuxSpec() reads it back.
+type MuxSpec struct {
+	Type     MuxType    `json:"type,omitempty"`
+	Video    *MuxInput  `json:"video,omitempty"`
+	Audios   []MuxInput `json:"audios,omitempty"`
+	Captions []MuxInput `json:"captions,omitempty"`
+}
+
+// NewMuxSpec returns an empty muxing spec of the given type.
+func NewMuxSpec(muxType MuxType) *MuxSpec {
+	return &MuxSpec{Type: muxType}
+}
+
+// SetVideo sets the parts of the video stream.
+func (s *MuxSpec) SetVideo(parts ...string) *MuxSpec {
+	s.Video = &MuxInput{Parts: parts}
+	return s
+}
+
+// AddAudio adds an audio stream with the given language and parts.
+func (s *MuxSpec) AddAudio(lang string, parts ...string) *MuxSpec {
+	s.Audios = append(s.Audios, MuxInput{Parts: parts, Lang: lang})
+	return s
+}
+
+// AddCaption adds a caption or subtitle stream (WebVTT or TTML parts).
+func (s *MuxSpec) AddCaption(caption MuxInput) *MuxSpec {
+	s.Captions = append(s.Captions, caption)
+	return s
+}
+
+// Validate checks the spec against the limits of the C muxer and makes sure
+// that local input files exist.
+func (s *MuxSpec) Validate() error {
+	if s.Type != "" && s.Type != MuxTypeMez && s.Type != MuxTypeAbr {
+		return fmt.Errorf("invalid mux type %q", s.Type)
+	}
+
+	nStreams := len(s.Audios) + len(s.Captions)
+	if s.Video != nil {
+		nStreams++
+	}
+	if nStreams == 0 {
+		return fmt.Errorf("mux spec has no input streams")
+	}
+	if nStreams > MaxAudioMux {
+		return fmt.Errorf("mux spec has too many streams, n=%d, max=%d", nStreams, MaxAudioMux)
+	}
+
+	if s.Video != nil {
+		if err := s.Video.validate(muxKindVideo, 1); err != nil {
+			return err
+		}
+	}
+	for i := range s.Audios {
+		if err := s.Audios[i].validate(muxKindAudio, i+1); err != nil {
+			return err
+		}
+	}
+	for i := range s.Captions {
+		if err := s.Captions[i].validate(muxKindCaption, i+1); err != nil {
+			return err
+		}
+		kind := s.Captions[i].Kind
+		if kind != "" && kind != muxKindCaption && kind != muxKindSubtitle {
+			return fmt.Errorf("invalid kind %q for caption %d", kind, i+1)
+		}
+	}
+
+	return nil
+}
+
+func (in *MuxInput) validate(kind string, index int) error {
+	if len(in.Parts) == 0 {
+		return fmt.Errorf("%s %d has no parts", kind, index)
+	}
+	if len(in.Parts) > MaxMuxParts {
+		return fmt.Errorf("%s %d has too many parts, n=%d, max=%d", kind, index, len(in.Parts), MaxMuxParts)
+	}
+
+	for _, v := range []string{in.Lang, in.Role, in.Name} {
+		if strings.ContainsAny(v, "\"\n\r,") {
+			return fmt.Errorf("invalid attribute %q for %s %d", v, kind, index)
+		}
+	}
+
+	for _, part := range in.Parts {
+		if part == "" || strings.ContainsAny(part, "\n\r,") {
+			return fmt.Errorf("invalid part %q for %s %d", part, kind, index)
+		}
+		if u, err := url.Parse(part); err == nil && len(u.Scheme) > 1 {
+			if u.Scheme == "file" {
+				part = u.Path
+			} else {
+				continue
+			}
+		}
+		if _, err := os.Stat(part); err != nil {
+			return fmt.Errorf("%s %d part %s: %w", kind, index, part, err)
+		}
+	}
+
+	return nil
+}
+
+// String returns the spec in the text format of XcParams.MuxingSpec.
+func (s *MuxSpec) String() string {
+	var b strings.Builder
+
+	muxType := s.Type
+	if muxType == "" {
+		muxType = MuxTypeMez
+	}
+	b.WriteString(string(muxType))
+	b.WriteString("\n")
+
+	if s.Video != nil {
+		s.Video.write(&b, muxKindVideo, 1, "")
+	}
+	for i := range s.Audios {
+		s.Audios[i].write(&b, muxKindAudio, i+1, "")
+	}
+	for i := range s.Captions {
+		kind := s.Captions[i].Kind
+		if kind == "" {
+			kind = muxKindCaption
+		}
+		s.Captions[i].write(&b, kind, i+1, kind)
+	}
+
+	return b.String()
+}
+
+func (in *MuxInput) write(b *strings.Builder, kind string, index int, defaultRole string) {
+	typ := kind
+	if in.Lang != "" {
+		typ += " lang=" + quoteMuxAttribute(in.Lang)
+	}
+	if in.Role != "" && in.Role != defaultRole {
+		typ += " role=" + quoteMuxAttribute(in.Role)
+	}
+	if in.Name != "" {
+		typ += " name=" + quoteMuxAttribute(in.Name)
+	}
+
+	for _, part := range in.Parts {
+		fmt.Fprintf(b, "%s,%d,%s\n", typ, index, part)
+	}
+}
+
+func quoteMuxAttribute(v string) string {
+	if strings.ContainsAny(v, " \t") {
+		return "\"" + v + "\""
+	}
+	return v
+}
+
+// ParseMuxSpec parses a muxing spec in the text format of XcParams.MuxingSpec.
+// Both the comma and the newline separated forms are accepted.
+func ParseMuxSpec(spec string) (*MuxSpec, error) {
+	tokens := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ','
+	})
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty mux spec")
+	}
+
+	s := &MuxSpec{Type: MuxType(tokens[0])}
+	if s.Type != MuxTypeMez && s.Type != MuxTypeAbr {
+		return nil, fmt.Errorf("invalid mux type %q", tokens[0])
+	}
+
+	tokens = tokens[1:]
+	if len(tokens)%3 != 0 {
+		return nil, fmt.Errorf("incomplete mux spec entry %q", strings.Join(tokens[len(tokens)-len(tokens)%3:], ","))
+	}
+
+	for ; len(tokens) > 0; tokens = tokens[3:] {
+		kind, attrs, _ := strings.Cut(strings.TrimSpace(tokens[0]), " ")
+		index, err := strconv.Atoi(strings.TrimSpace(tokens[1]))
+		if err != nil || index <= 0 {
+			return nil, fmt.Errorf("invalid %s index %q", kind, tokens[1])
+		}
+		part := tokens[2]
+
+		var in *MuxInput
+		switch kind {
+		case muxKindVideo:
+			if index > 1 {
+				return nil, fmt.Errorf("invalid video index %d", index)
+			}
+			if s.Video == nil {
+				s.Video = &MuxInput{}
+			}
+			in = s.Video
+		case muxKindAudio:
+			if index > len(s.Audios)+1 {
+				return nil, fmt.Errorf("invalid audio index %d", index)
+			}
+			if index > len(s.Audios) {
+				s.Audios = append(s.Audios, MuxInput{})
+			}
+			in = &s.Audios[index-1]
+		case muxKindCaption, muxKindSubtitle:
+			if index > len(s.Captions)+1 {
+				return nil, fmt.Errorf("invalid %s index %d", kind, index)
+			}
+			if index > len(s.Captions) {
+				s.Captions = append(s.Captions, MuxInput{Kind: kind})
+			}
+			in = &s.Captions[index-1]
+		default:
+			return nil, fmt.Errorf("invalid stream type %q", kind)
+		}
+
+		if err = in.parseAttributes(attrs); err != nil {
+			return nil, err
+		}
+		in.Parts = append(in.Parts, part)
+	}
+
+	return s, nil
+}
+
+func (in *MuxInput) parseAttributes(attrs string) error {
+	for {
+		attrs = strings.TrimLeft(attrs, " \t")
+		if attrs == "" {
+			return nil
+		}
+
+		key, rest, found := strings.Cut(attrs, "=")
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("invalid mux attribute %q", attrs)
+		}
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return fmt.Errorf("unterminated mux attribute %s", key)
+			}
+			value, attrs = rest[1:end+1], rest[end+2:]
+		} else if end := strings.IndexAny(rest, " \t"); end >= 0 {
+			value, attrs = rest[:end], rest[end:]
+		} else {
+			value, attrs = rest, ""
+		}
+
+		switch key {
+		case "lang":
+			in.Lang = value
+		case "role":
+			in.Role = value
+		case "name":
+			in.Name = value
+		default:
+			// Same as the C muxer, which ignores unknown attributes
+			log.Warn("ParseMuxSpec unknown attribute", "key", key, "value", value)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package avpipe
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMuxSpecString(t *testing.T) {
+	spec := NewMuxSpec(MuxTypeAbr).
+		SetVideo("v/init.m4s", "v/chunk-00001.m4s").
+		AddAudio("en", "a1/init.m4s", "a1/chunk-00001.m4s").
+		AddAudio("", "a2/init.m4s").
+		AddCaption(MuxInput{Parts: []string{"s/en.vtt"}, Lang: "en", Kind: "subtitle", Name: "English US"}).
+		AddCaption(MuxInput{Parts: []string{"s/fr.ttml"}, Lang: "fr"}).
+		AddCaption(MuxInput{Parts: []string{"s/en-forced.vtt"}, Lang: "en", Kind: "subtitle", Role: "forced-subtitle", Name: "English forced"})
+
+	expected := "abr-mux\n" +
+		"video,1,v/init.m4s\n" +
+		"video,1,v/chunk-00001.m4s\n" +
+		"audio lang=en,1,a1/init.m4s\n" +
+		"audio lang=en,1,a1/chunk-00001.m4s\n" +
+		"audio,2,a2/init.m4s\n" +
+		"subtitle lang=en name=\"English US\",1,s/en.vtt\n" +
+		"caption lang=fr,2,s/fr.ttml\n" +
+		"subtitle lang=en role=forced-subtitle name=\"English forced\",3,s/en-forced.vtt\n"
+	require.Equal(t, expected, spec.String())
+
+	parsed, err := ParseMuxSpec(spec.String())
+	require.NoError(t, err)
+	require.Equal(t, spec.String(), parsed.String())
+	require.Equal(t, "English US", parsed.Captions[0].Name)
+	require.Equal(t, "caption", parsed.Captions[1].Kind)
+	require.Equal(t, "", parsed.Captions[1].Role)
+	require.Equal(t, "subtitle", parsed.Captions[2].Kind)
+	require.Equal(t, "forced-subtitle", parsed.Captions[2].Role)
+
+	b, err := json.Marshal(spec)
+	require.NoError(t, err)
+	unmarshaled := &MuxSpec{}
+	require.NoError(t, json.Unmarshal(b, unmarshaled))
+	require.Equal(t, spec, unmarshaled)
+}
+
+func TestParseMuxSpec(t *testing.T) {
+	// Legacy newline separated form
+	spec, err := ParseMuxSpec("mez-mux\naudio\n1\nO/a.mp4\nvideo\n1\nO/v.mp4\ncaption lang=fr\n1\nO/fr.ttml\n")
+	require.NoError(t, err)
+	require.Equal(t, MuxTypeMez, spec.Type)
+	require.Equal(t, []string{"O/v.mp4"}, spec.Video.Parts)
+	require.Len(t, spec.Audios, 1)
+	require.Equal(t, "fr", spec.Captions[0].Lang)
+
+	// Unknown attributes are ignored, like in the C muxer
+	spec, err = ParseMuxSpec("mez-mux\ncaption foo=bar lang=en,1,en.vtt\n")
+	require.NoError(t, err)
+	require.Equal(t, "en", spec.Captions[0].Lang)
+
+	for _, s := range []string{
+		"",
+		"bad-mux\nvideo,1,v.mp4\n",
+		"mez-mux\nvideo,2,v.mp4\n",
+		"mez-mux\naudio,2,a.mp4\n",
+		"mez-mux\naudio,x,a.mp4\n",
+		"mez-mux\ndata,1,d.mp4\n",
+		"mez-mux\nvideo,1\n",
+		"mez-mux\ncaption lang=\"en,1,en.vtt\n",
+		"mez-mux\ncaption foo,1,en.vtt\n",
+	} {
+		_, err = ParseMuxSpec(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestMuxSpecValidate(t *testing.T) {
+	dir := t.TempDir()
+	video := filepath.Join(dir, "v.mp4")
+	require.NoError(t, os.WriteFile(video, []byte{}, 0644))
+
+	spec := NewMuxSpec(MuxTypeMez).SetVideo(video)
+	require.NoError(t, spec.Validate())
+
+	spec.AddAudio("en", "https://example.com/a.mp4")
+	require.NoError(t, spec.Validate())
+
+	require.Error(t, NewMuxSpec(MuxTypeMez).Validate())
+	require.Error(t, NewMuxSpec("bad-mux").SetVideo(video).Validate())
+	require.Error(t, NewMuxSpec(MuxTypeMez).SetVideo(filepath.Join(dir, "missing.mp4")).Validate())
+	require.Error(t, NewMuxSpec(MuxTypeMez).SetVideo("a,b.mp4").Validate())
+	require.Error(t, NewMuxSpec(MuxTypeMez).AddAudio("en").Validate())
+	require.NoError(t, NewMuxSpec(MuxTypeMez).AddCaption(MuxInput{Parts: []string{video}, Role: "forced-subtitle"}).Validate())
+	require.Error(t, NewMuxSpec(MuxTypeMez).AddCaption(MuxInput{Parts: []string{video}, Kind: "main"}).Validate())
+
+	spec = NewMuxSpec(MuxTypeMez)
+	for i := 0; i < MaxAudioMux+1; i++ {
+		spec.AddAudio("", video)
+	}
+	require.Error(t, spec.Validate())
+}
@@ -10,5 +10,7 @@ then
     gsutil -m cp 'gs://eluvio-test-assets/*' ./media
 fi
 
+(cd libavpipe/test && make test) || exit 1
+
 go test --timeout 10000s
 
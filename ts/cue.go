@@ -0,0 +1,308 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eluv-io/errors-go"
+
+	"github.com/eluv-io/avpipe/ts/scte35"
+)
+
+const (
+	// DASHScte35Scheme is the EventStream scheme of SCTE-35 sections in binary form (SCTE 214-1)
+	DASHScte35Scheme = "urn:scte:scte35:2014:xml+bin"
+	scte35Namespace  = "http://www.scte.org/schemas/35/2016"
+)
+
+// breakSegmentationTypes are the segmentation_type_ids that start (true) or end (false) a break.
+// The other types (content identification, program, chapter, network...) are not cues.
+var breakSegmentationTypes = map[scte35.SegmentationType]bool{
+	scte35.BreakStart:                                  true,
+	scte35.BreakEnd:                                    false,
+	scte35.ProviderAdvertisementStart:                  true,
+	scte35.ProviderAdvertisementEnd:                    false,
+	scte35.DistributorAdvertisementStart:               true,
+	scte35.DistributorAdvertisementEnd:                 false,
+	scte35.ProviderPlacementOpportunityStart:           true,
+	scte35.ProviderPlacementOpportunityEnd:             false,
+	scte35.DistributorPlacementOpportunityStart:        true,
+	scte35.DistributorPlacementOpportunityEnd:          false,
+	scte35.ProviderOverlayPlacementOpportunityStart:    true,
+	scte35.ProviderOverlayPlacementOpportunityEnd:      false,
+	scte35.DistributorOverlayPlacementOpportunityStart: true,
+	scte35.DistributorOverlayPlacementOpportunityEnd:   false,
+	scte35.ProviderPromoStart:                          true,
+	scte35.ProviderPromoEnd:                            false,
+	scte35.DistributorPromoStart:                       true,
+	scte35.DistributorPromoEnd:                         false,
+	scte35.UnscheduledEventStart:                       true,
+	scte35.UnscheduledEventEnd:                         false,
+	scte35.AlternateContentOpportunityStart:            true,
+	scte35.AlternateContentOpportunityEnd:              false,
+	scte35.ProviderAdBlockStart:                        true,
+	scte35.ProviderAdBlockEnd:                          false,
+	scte35.DistributorAdBlockStart:                     true,
+	scte35.DistributorAdBlockEnd:                       false,
+}
+
+// Cue is an encoded SCTE-35 splice, with the information needed to mark it in the HLS and DASH
+// manifests.
+type Cue struct {
+	ID       string `json:"id"`       // splice_event_id or segmentation_event_id
+	PTS      uint64 `json:"pts"`      // Splice time (90kHz)
+	Duration uint64 `json:"duration"` // Break duration (90kHz), 0 if unknown
+	Out      bool   `json:"out"`      // Start of a break, otherwise end of a break
+	Section  []byte `json:"section"`  // splice_info_section
+}
+
+// SpliceInsertOut returns a splice_insert that starts a break of duration (90kHz) at pts.
+// The break returns automatically if duration is not 0.
+func SpliceInsertOut(eventID uint32, pts, duration uint64) SpliceInfo {
+	si := SpliceInfo{
+		PTS:               pts,
+		Tier:              0xfff,
+		SpliceCommandType: scte35.SpliceInsertType,
+		SpliceInsert: &scte35.SpliceInsert{
+			SpliceEventID:         eventID,
+			OutOfNetworkIndicator: true,
+			ProgramSpliceFlag:     true,
+			EventIDComplianceFlag: true,
+			SpliceTime:            &scte35.SpliceTime{TimeSpecifiedFlag: true, PTSTime: pts & scte35.PTSMask},
+		},
+	}
+	if duration > 0 {
+		si.SpliceInsert.BreakDuration = &scte35.BreakDuration{AutoReturn: true, Duration: duration}
+	}
+	return si
+}
+
+// SpliceInsertIn returns a splice_insert that ends the break eventID at pts.
+func SpliceInsertIn(eventID uint32, pts uint64) SpliceInfo {
+	return SpliceInfo{
+		PTS:               pts,
+		Tier:              0xfff,
+		SpliceCommandType: scte35.SpliceInsertType,
+		SpliceInsert: &scte35.SpliceInsert{
+			SpliceEventID:         eventID,
+			ProgramSpliceFlag:     true,
+			EventIDComplianceFlag: true,
+			SpliceTime:            &scte35.SpliceTime{TimeSpecifiedFlag: true, PTSTime: pts & scte35.PTSMask},
+		},
+	}
+}
+
+// NewCue encodes the splice info and derives the cue id, direction and duration from the
+// splice_insert or from the first segmentation_descriptor of a time_signal that starts or ends a
+// break.
+func NewCue(si SpliceInfo) (*Cue, error) {
+	e := errors.Template("ts.NewCue", errors.K.Invalid)
+
+	section, err := si.Encode()
+	if err != nil {
+		return nil, e(err)
+	}
+	c := &Cue{PTS: si.PTS, Section: section}
+
+	switch {
+	case si.SpliceInsert != nil:
+		ins := si.SpliceInsert
+		if ins.SpliceEventCancelIndicator {
+			return nil, e("reason", "cancelled splice_insert", "splice_event_id", ins.SpliceEventID)
+		}
+		c.ID = strconv.FormatUint(uint64(ins.SpliceEventID), 10)
+		c.Out = ins.OutOfNetworkIndicator
+		if ins.BreakDuration != nil {
+			c.Duration = ins.BreakDuration.Duration
+		}
+		if ins.SpliceTime != nil && ins.SpliceTime.TimeSpecifiedFlag {
+			c.PTS = ins.SpliceTime.PTSTime
+		}
+	case si.SpliceCommandType == scte35.TimeSignalType:
+		var sd *SpliceDescriptor
+		for i := range si.SpliceDescriptors {
+			d := &si.SpliceDescriptors[i]
+			if _, ok := breakSegmentationTypes[d.SegmentationTypeId]; ok &&
+				d.SpliceDescriptorTag == scte35.SegmentationDescriptorTag {
+				sd = d
+				break
+			}
+		}
+		if sd == nil {
+			return nil, e("reason", "time_signal without break segmentation_descriptor")
+		}
+		c.ID = strconv.FormatUint(uint64(sd.SegmentationEventId), 10)
+		c.Out = breakSegmentationTypes[sd.SegmentationTypeId]
+		c.Duration = sd.SegmentationDuration
+		if si.TimeSignal != nil && si.TimeSignal.SpliceTime.TimeSpecifiedFlag {
+			c.PTS = si.TimeSignal.SpliceTime.PTSTime
+		}
+	default:
+		return nil, e("reason", "unsupported splice command", "splice_command_type", si.SpliceCommandType)
+	}
+	return c, nil
+}
+
+// HLSTags returns the HLS tags of the cue: an EXT-X-DATERANGE with the section in SCTE35-OUT or
+// SCTE35-IN (RFC 8216 4.3.2.7.1), followed by EXT-X-CUE-OUT or EXT-X-CUE-IN for the players that
+// don't support EXT-X-DATERANGE. The EXT-X-DATERANGE is only returned if startDate is set, since
+// it requires EXT-X-PROGRAM-DATE-TIME in the playlist.
+// The SCTE35-IN of a break goes on the EXT-X-DATERANGE of its SCTE35-OUT, whose START-DATE is
+// outDate, with the DURATION of the break. If outDate is not set, the EXT-X-DATERANGE has its own
+// ID, the cue ID with an "-in" suffix.
+func (c *Cue) HLSTags(startDate, outDate time.Time) []string {
+	var tags []string
+	if !startDate.IsZero() {
+		var tag string
+		switch {
+		case c.Out:
+			tag = fmt.Sprintf(`#EXT-X-DATERANGE:ID="%s",START-DATE="%s"`, c.ID, formatDate(startDate))
+			if c.Duration > 0 {
+				tag += ",PLANNED-DURATION=" + formatSeconds(c.Duration)
+			}
+			tag += ",SCTE35-OUT="
+		case !outDate.IsZero():
+			tag = fmt.Sprintf(`#EXT-X-DATERANGE:ID="%s",START-DATE="%s",DURATION=%.3f,SCTE35-IN=`,
+				c.ID, formatDate(outDate), startDate.Sub(outDate).Seconds())
+		default:
+			tag = fmt.Sprintf(`#EXT-X-DATERANGE:ID="%s-in",START-DATE="%s",SCTE35-IN=`, c.ID, formatDate(startDate))
+		}
+		tags = append(tags, tag+"0x"+strings.ToUpper(hex.EncodeToString(c.Section)))
+	}
+	if c.Out {
+		if c.Duration > 0 {
+			tags = append(tags, "#EXT-X-CUE-OUT:DURATION="+formatSeconds(c.Duration))
+		} else {
+			tags = append(tags, "#EXT-X-CUE-OUT")
+		}
+	} else {
+		tags = append(tags, "#EXT-X-CUE-IN")
+	}
+	return tags
+}
+
+// InsertHLSCues inserts the tags of the cues in a media playlist, before the segment that contains
+// the splice time of each cue. segmentPTS returns the start PTS (90kHz) of a segment by its URI.
+// Cues outside of the playlist segments are ignored.
+func InsertHLSCues(playlist []byte, cues []*Cue, segmentPTS func(uri string) (pts uint64, ok bool)) []byte {
+	lines := strings.Split(string(playlist), "\n")
+	var out []string
+	var pending []string // Segment tags, written after the cue tags
+	var pdt time.Time
+	var duration float64
+	done := make([]bool, len(cues))
+	outDates := map[string]time.Time{} // START-DATE of the breaks, by cue ID
+
+	for _, line := range lines {
+		l := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(l, "#EXT-X-PROGRAM-DATE-TIME:"):
+			pdt, _ = time.Parse(time.RFC3339Nano, strings.TrimPrefix(l, "#EXT-X-PROGRAM-DATE-TIME:"))
+			pending = append(pending, line)
+		case strings.HasPrefix(l, "#EXTINF:"):
+			v := strings.TrimPrefix(l, "#EXTINF:")
+			if i := strings.IndexByte(v, ','); i >= 0 {
+				v = v[:i]
+			}
+			duration, _ = strconv.ParseFloat(v, 64)
+			pending = append(pending, line)
+		case l == "" || strings.HasPrefix(l, "#"):
+			if pending != nil {
+				pending = append(pending, line)
+			} else {
+				out = append(out, line)
+			}
+		default: // Segment URI
+			if start, ok := segmentPTS(l); ok {
+				end := start + uint64(duration*90000+0.5)
+				for i, c := range cues {
+					if done[i] || c.PTS < start || c.PTS >= end {
+						continue
+					}
+					var date time.Time
+					if !pdt.IsZero() {
+						date = pdt.Add(time.Duration(c.PTS-start) * time.Second / 90000)
+					}
+					if c.Out {
+						outDates[c.ID] = date
+						out = append(out, c.HLSTags(date, time.Time{})...)
+					} else {
+						out = append(out, c.HLSTags(date, outDates[c.ID])...)
+						delete(outDates, c.ID)
+					}
+					done[i] = true
+				}
+			}
+			out = append(out, pending...)
+			out = append(out, line)
+			pending = nil
+			if !pdt.IsZero() {
+				pdt = pdt.Add(time.Duration(duration * float64(time.Second)))
+			}
+		}
+	}
+	out = append(out, pending...)
+	return []byte(strings.Join(out, "\n"))
+}
+
+// DASHEvent returns the Event element of the cue for an EventStream with the DASHScte35Scheme and
+// a timescale of 90000. presentationTimeOffset is the PTS of the start of the Period.
+func (c *Cue) DASHEvent(presentationTimeOffset uint64) string {
+	s := fmt.Sprintf(`<Event presentationTime="%d"`, c.PTS-presentationTimeOffset)
+	if c.Duration > 0 {
+		s += fmt.Sprintf(` duration="%d"`, c.Duration)
+	}
+	return s + fmt.Sprintf(` id="%s"><Signal xmlns="%s"><Binary>%s</Binary></Signal></Event>`,
+		c.ID, scte35Namespace, base64.StdEncoding.EncodeToString(c.Section))
+}
+
+// DASHEventStream returns an EventStream element with the cues.
+func DASHEventStream(cues []*Cue, presentationTimeOffset uint64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<EventStream schemeIdUri="%s" timescale="90000">`, DASHScte35Scheme)
+	for _, c := range cues {
+		if c.PTS < presentationTimeOffset {
+			continue
+		}
+		b.WriteString("\n\t\t\t")
+		b.WriteString(c.DASHEvent(presentationTimeOffset))
+	}
+	b.WriteString("\n\t\t</EventStream>")
+	return b.String()
+}
+
+// InsertDASHCues inserts an EventStream with the cues in the last Period of a MPD, before its
+// first AdaptationSet. presentationTimeOffset is the PTS of the start of the Period.
+func InsertDASHCues(mpd []byte, cues []*Cue, presentationTimeOffset uint64) ([]byte, error) {
+	period := bytes.LastIndex(mpd, []byte("<Period"))
+	if period < 0 {
+		return nil, errors.E("ts.InsertDASHCues", errors.K.Invalid, "reason", "no Period in MPD")
+	}
+	as := bytes.Index(mpd[period:], []byte("<AdaptationSet"))
+	if as < 0 {
+		return nil, errors.E("ts.InsertDASHCues", errors.K.Invalid, "reason", "no AdaptationSet in Period")
+	}
+	as += period
+
+	var b bytes.Buffer
+	b.Write(mpd[:as])
+	b.WriteString(DASHEventStream(cues, presentationTimeOffset))
+	b.WriteString("\n\t\t")
+	b.Write(mpd[as:])
+	return b.Bytes(), nil
+}
+
+// formatDate formats a date as an EXT-X-DATERANGE START-DATE.
+func formatDate(date time.Time) string {
+	return date.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// formatSeconds formats a duration in 90kHz ticks as seconds with millisecond precision.
+func formatSeconds(ticks uint64) string {
+	return strconv.FormatFloat(float64(ticks)/90000, 'f', 3, 64)
+}
@@ -0,0 +1,221 @@
+package ts
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/avpipe/ts/scte35"
+)
+
+func TestSpliceInfoEncode(t *testing.T) {
+	// Round trip through the JSON subset
+	b, _ := base64.StdEncoding.DecodeString("/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg==")
+	s, err := scte35.Parse(b)
+	require.NoError(t, err)
+	si, err := Convert(0, s)
+	require.NoError(t, err)
+	enc, err := si.Encode()
+	require.NoError(t, err)
+	s2, err := scte35.Parse(enc)
+	require.NoError(t, err)
+	si2, err := Convert(0, s2)
+	require.NoError(t, err)
+	assert.Equal(t, si, si2)
+
+	// splice_insert out and in
+	out := SpliceInsertOut(10, 0x1_0000_0000, 30*90000)
+	enc, err = out.Encode()
+	require.NoError(t, err)
+	s, err = scte35.Parse(enc)
+	require.NoError(t, err)
+	require.NotNil(t, s.SpliceInsert)
+	assert.True(t, s.SpliceInsert.OutOfNetworkIndicator)
+	assert.Equal(t, &scte35.BreakDuration{AutoReturn: true, Duration: 30 * 90000}, s.SpliceInsert.BreakDuration)
+	pts, ok := s.PTS()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0x1_0000_0000), pts)
+
+	in := SpliceInsertIn(10, 0x1_0000_0000+30*90000)
+	enc, err = in.Encode()
+	require.NoError(t, err)
+	s, err = scte35.Parse(enc)
+	require.NoError(t, err)
+	assert.False(t, s.SpliceInsert.OutOfNetworkIndicator)
+	assert.Nil(t, s.SpliceInsert.BreakDuration)
+}
+
+func TestNewCue(t *testing.T) {
+	c, err := NewCue(SpliceInsertOut(10, 900000, 30*90000))
+	require.NoError(t, err)
+	assert.Equal(t, "10", c.ID)
+	assert.Equal(t, uint64(900000), c.PTS)
+	assert.Equal(t, uint64(30*90000), c.Duration)
+	assert.True(t, c.Out)
+
+	si := SpliceInfo{
+		SpliceCommandType: scte35.TimeSignalType,
+		PTS:               1800000,
+		Tier:              0xfff,
+		SpliceDescriptors: []SpliceDescriptor{{
+			SpliceDescriptorTag:  scte35.SegmentationDescriptorTag,
+			SegmentationEventId:  7,
+			SegmentationDuration: 60 * 90000,
+			SegmentationTypeId:   scte35.ProviderPlacementOpportunityStart,
+			SegmentNum:           1,
+			SegmentsExpected:     1,
+		}},
+	}
+	c, err = NewCue(si)
+	require.NoError(t, err)
+	assert.Equal(t, "7", c.ID)
+	assert.Equal(t, uint64(1800000), c.PTS)
+	assert.Equal(t, uint64(60*90000), c.Duration)
+	assert.True(t, c.Out)
+	s, err := scte35.Parse(c.Section)
+	require.NoError(t, err)
+	sd := s.SpliceDescriptors[0].SegmentationDescriptor
+	require.NotNil(t, sd.SubSegmentNum) // Placement opportunity start carries sub segments
+	assert.Equal(t, uint8(0), *sd.SubSegmentsExpected)
+
+	si.SpliceDescriptors[0].SegmentationTypeId = scte35.ProviderPlacementOpportunityEnd
+	c, err = NewCue(si)
+	require.NoError(t, err)
+	assert.False(t, c.Out)
+
+	// Only the break types are cues, whatever the parity of the type
+	for typ, out := range map[scte35.SegmentationType]bool{
+		scte35.BreakStart:                         true,
+		scte35.DistributorAdvertisementEnd:        false,
+		scte35.ProviderAdBlockStart:               true,
+		scte35.AlternateContentOpportunityEnd:     false,
+		scte35.UnscheduledEventStart:              true,
+		scte35.DistributorPlacementOpportunityEnd: false,
+	} {
+		si.SpliceDescriptors[0].SegmentationTypeId = typ
+		c, err = NewCue(si)
+		require.NoError(t, err, typ.Name())
+		assert.Equal(t, out, c.Out, typ.Name())
+	}
+	for _, typ := range []scte35.SegmentationType{
+		scte35.NotIndicated, scte35.ContentIdentification, scte35.CallAdServer, scte35.ProgramStart,
+		scte35.ProgramEarlyTermination, scte35.ProgramResumption, scte35.ProgramOverlapStart,
+		scte35.ProgramBlackoutOverride, scte35.ProgramJoin, scte35.ChapterEnd, scte35.NetworkStart,
+	} {
+		si.SpliceDescriptors[0].SegmentationTypeId = typ
+		_, err = NewCue(si)
+		assert.Error(t, err, typ.Name())
+	}
+
+	// The break descriptor is used, not the first one
+	si.SpliceDescriptors[0].SegmentationTypeId = scte35.ContentIdentification
+	si.SpliceDescriptors = append(si.SpliceDescriptors, SpliceDescriptor{
+		SpliceDescriptorTag: scte35.SegmentationDescriptorTag,
+		SegmentationEventId: 8,
+		SegmentationTypeId:  scte35.ProviderAdvertisementEnd,
+		SegmentNum:          1,
+		SegmentsExpected:    1,
+	})
+	c, err = NewCue(si)
+	require.NoError(t, err)
+	assert.Equal(t, "8", c.ID)
+	assert.False(t, c.Out)
+
+	_, err = NewCue(SpliceInfo{SpliceCommandType: scte35.TimeSignalType, Tier: 0xfff})
+	assert.Error(t, err)
+	_, err = NewCue(SpliceInfo{SpliceCommandType: scte35.SpliceNullType, SpliceNull: &scte35.SpliceNull{}})
+	assert.Error(t, err)
+}
+
+func TestInsertHLSCues(t *testing.T) {
+	out, err := NewCue(SpliceInsertOut(1, 2*90000*2+45000, 4*90000))
+	require.NoError(t, err)
+	in, err := NewCue(SpliceInsertIn(1, 2*90000*4+45000))
+	require.NoError(t, err)
+
+	playlist := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-PROGRAM-DATE-TIME:2026-10-19T10:00:02.000Z
+#EXTINF:2.000000,
+seg-1.m4s
+#EXTINF:2.000000,
+seg-2.m4s
+#EXTINF:2.000000,
+seg-3.m4s
+#EXTINF:2.000000,
+seg-4.m4s
+`
+	segmentPTS := func(uri string) (uint64, bool) {
+		var n uint64
+		for _, c := range strings.TrimSuffix(strings.TrimPrefix(uri, "seg-"), ".m4s") {
+			n = n*10 + uint64(c-'0')
+		}
+		return n * 2 * 90000, true
+	}
+	res := string(InsertHLSCues([]byte(playlist), []*Cue{out, in}, segmentPTS))
+
+	lines := strings.Split(res, "\n")
+	require.Len(t, lines, 18)
+	assert.Equal(t, `#EXT-X-DATERANGE:ID="1",START-DATE="2026-10-19T10:00:04.500Z",PLANNED-DURATION=4.000,SCTE35-OUT=0x`+
+		strings.ToUpper(hex.EncodeToString(out.Section)), lines[7])
+	assert.Equal(t, "#EXT-X-CUE-OUT:DURATION=4.000", lines[8])
+	assert.Equal(t, "#EXTINF:2.000000,", lines[9])
+	assert.Equal(t, "seg-2.m4s", lines[10])
+	// Same ID and START-DATE as the SCTE35-OUT, the end of the break is its DURATION
+	assert.Equal(t, `#EXT-X-DATERANGE:ID="1",START-DATE="2026-10-19T10:00:04.500Z",DURATION=4.000,SCTE35-IN=0x`+
+		strings.ToUpper(hex.EncodeToString(in.Section)), lines[13])
+	assert.Equal(t, "#EXT-X-CUE-IN", lines[14])
+	assert.Equal(t, "seg-4.m4s", lines[16])
+
+	// No EXT-X-PROGRAM-DATE-TIME
+	res = string(InsertHLSCues([]byte(strings.Replace(playlist, "#EXT-X-PROGRAM-DATE-TIME:2026-10-19T10:00:02.000Z\n", "", 1)),
+		[]*Cue{out}, segmentPTS))
+	assert.NotContains(t, res, "EXT-X-DATERANGE")
+	assert.Contains(t, res, "#EXT-X-CUE-OUT:DURATION=4.000\n#EXTINF:2.000000,\nseg-2.m4s")
+}
+
+func TestInsertDASHCues(t *testing.T) {
+	out, err := NewCue(SpliceInsertOut(1, 900000+45000, 4*90000))
+	require.NoError(t, err)
+
+	mpd := `<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic">
+	<Period id="0" start="PT0.0S">
+		<AdaptationSet id="0" contentType="video">
+		</AdaptationSet>
+	</Period>
+</MPD>
+`
+	res, err := InsertDASHCues([]byte(mpd), []*Cue{out}, 900000)
+	require.NoError(t, err)
+	assert.Contains(t, string(res), `<Period id="0" start="PT0.0S">
+		<EventStream schemeIdUri="urn:scte:scte35:2014:xml+bin" timescale="90000">
+			<Event presentationTime="45000" duration="360000" id="1"><Signal xmlns="http://www.scte.org/schemas/35/2016"><Binary>`+
+		base64.StdEncoding.EncodeToString(out.Section)+`</Binary></Signal></Event>
+		</EventStream>
+		<AdaptationSet id="0" contentType="video">`)
+
+	_, err = InsertDASHCues([]byte("<MPD></MPD>"), []*Cue{out}, 0)
+	assert.Error(t, err)
+}
+
+func TestHLSTags(t *testing.T) {
+	c := &Cue{ID: "5", Out: true, Section: []byte{0xfc, 0x30}}
+	assert.Equal(t, []string{"#EXT-X-CUE-OUT"}, c.HLSTags(time.Time{}, time.Time{}))
+	assert.Equal(t, []string{`#EXT-X-DATERANGE:ID="5",START-DATE="2026-10-19T10:00:00.000Z",SCTE35-OUT=0xFC30`, "#EXT-X-CUE-OUT"},
+		c.HLSTags(time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), time.Time{}))
+
+	// SCTE35-IN without the SCTE35-OUT of the break has its own ID
+	c.Out = false
+	assert.Equal(t, []string{`#EXT-X-DATERANGE:ID="5-in",START-DATE="2026-10-19T10:00:30.000Z",SCTE35-IN=0xFC30`, "#EXT-X-CUE-IN"},
+		c.HLSTags(time.Date(2026, 10, 19, 10, 0, 30, 0, time.UTC), time.Time{}))
+	assert.Equal(t, []string{`#EXT-X-DATERANGE:ID="5",START-DATE="2026-10-19T10:00:00.000Z",DURATION=30.000,SCTE35-IN=0xFC30`, "#EXT-X-CUE-IN"},
+		c.HLSTags(time.Date(2026, 10, 19, 10, 0, 30, 0, time.UTC), time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)))
+}
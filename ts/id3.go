@@ -0,0 +1,176 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf16"
+
+	"github.com/eluv-io/errors-go"
+)
+
+// ID3Tag is an ID3v2 tag, as carried in a timed_id3 stream (stream type 0x15) of a MPEG-TS.
+type ID3Tag struct {
+	Version  uint8      `json:"version"`  // Major version, 3 or 4
+	Revision uint8      `json:"revision"` // Revision
+	Frames   []ID3Frame `json:"frames"`
+}
+
+// ID3Frame is a frame of an ID3v2 tag. Data is the frame content, after the frame header.
+type ID3Frame struct {
+	ID   string `json:"id"`
+	Data []byte `json:"data"`
+}
+
+// ParseID3 parses the ID3v2 tags of a timed_id3 payload. A payload usually has a single tag.
+// Frames of unsynchronised or compressed tags are returned as is.
+func ParseID3(b []byte) ([]*ID3Tag, error) {
+	e := errors.Template("ts.ParseID3", errors.K.Invalid)
+
+	var tags []*ID3Tag
+	for len(b) > 0 {
+		if len(b) < 10 || string(b[:3]) != "ID3" {
+			return nil, e("reason", "missing ID3 header", "len", len(b))
+		}
+		t := &ID3Tag{Version: b[3], Revision: b[4]}
+		if t.Version < 3 || t.Version > 4 {
+			return nil, e("reason", "unsupported ID3 version", "version", t.Version)
+		}
+		flags := b[5]
+		size, ok := syncsafe(b[6:10])
+		if !ok || 10+size > len(b) {
+			return nil, e("reason", "invalid tag size", "size", size, "len", len(b))
+		}
+		body := b[10 : 10+size]
+		b = b[10+size:]
+		if flags&0x10 != 0 && len(b) >= 10 && string(b[:3]) == "3DI" {
+			b = b[10:] // Footer
+		}
+
+		if flags&0x40 != 0 { // Extended header
+			if len(body) < 4 {
+				return nil, e("reason", "invalid extended header")
+			}
+			n := int(binary.BigEndian.Uint32(body)) + 4
+			if t.Version == 4 {
+				n, _ = syncsafe(body[:4])
+			}
+			if n > len(body) {
+				return nil, e("reason", "invalid extended header size", "size", n)
+			}
+			body = body[n:]
+		}
+
+		for len(body) >= 10 && body[0] != 0 {
+			id := string(body[:4])
+			n := int(binary.BigEndian.Uint32(body[4:8]))
+			if t.Version == 4 {
+				n, ok = syncsafe(body[4:8])
+				if !ok {
+					return nil, e("reason", "invalid frame size", "id", id)
+				}
+			}
+			if 10+n > len(body) {
+				return nil, e("reason", "frame too long", "id", id, "size", n)
+			}
+			t.Frames = append(t.Frames, ID3Frame{ID: id, Data: body[10 : 10+n]})
+			body = body[10+n:]
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// Text returns the text of a text information frame (T000-TZZZ, except TXXX).
+func (f ID3Frame) Text() (string, bool) {
+	if len(f.ID) != 4 || f.ID[0] != 'T' || f.ID == "TXXX" || len(f.Data) == 0 {
+		return "", false
+	}
+	s, _ := id3String(f.Data[0], f.Data[1:])
+	return s, true
+}
+
+// UserText returns the description and value of a user defined text information frame (TXXX).
+func (f ID3Frame) UserText() (description, value string, ok bool) {
+	if f.ID != "TXXX" || len(f.Data) == 0 {
+		return "", "", false
+	}
+	description, rest := id3String(f.Data[0], f.Data[1:])
+	value, _ = id3String(f.Data[0], rest)
+	return description, value, true
+}
+
+// Private returns the owner identifier and data of a private frame (PRIV), for example
+// com.apple.streaming.transportStreamTimestamp.
+func (f ID3Frame) Private() (owner string, data []byte, ok bool) {
+	if f.ID != "PRIV" {
+		return "", nil, false
+	}
+	i := bytes.IndexByte(f.Data, 0)
+	if i < 0 {
+		return string(f.Data), nil, true
+	}
+	return string(f.Data[:i]), f.Data[i+1:], true
+}
+
+// syncsafe decodes a 28 bit syncsafe integer.
+func syncsafe(b []byte) (int, bool) {
+	n := 0
+	for _, c := range b[:4] {
+		if c&0x80 != 0 {
+			return 0, false
+		}
+		n = n<<7 | int(c)
+	}
+	return n, true
+}
+
+// id3String decodes a null terminated string in the given text encoding and returns the rest of b.
+func id3String(encoding byte, b []byte) (string, []byte) {
+	switch encoding {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		end := len(b)
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+		s := b[:end]
+		rest := b[end:]
+		if len(rest) >= 2 {
+			rest = rest[2:]
+		}
+		var order binary.ByteOrder = binary.BigEndian
+		if encoding == 1 && len(s) >= 2 {
+			if s[0] == 0xff && s[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			if (s[0] == 0xff && s[1] == 0xfe) || (s[0] == 0xfe && s[1] == 0xff) {
+				s = s[2:]
+			}
+		}
+		u := make([]uint16, len(s)/2)
+		for i := range u {
+			u[i] = order.Uint16(s[2*i:])
+		}
+		return string(utf16.Decode(u)), rest
+	default: // ISO-8859-1, UTF-8
+		end := bytes.IndexByte(b, 0)
+		if end < 0 {
+			end = len(b)
+		}
+		s := b[:end]
+		rest := b[end:]
+		if len(rest) > 0 {
+			rest = rest[1:]
+		}
+		if encoding == 0 {
+			r := make([]rune, len(s))
+			for i, c := range s {
+				r[i] = rune(c)
+			}
+			return string(r), rest
+		}
+		return string(s), rest
+	}
+}
@@ -0,0 +1,65 @@
+package ts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ID3v2.4 tag with a PRIV com.apple.streaming.transportStreamTimestamp frame and a TXXX frame
+var id3Tag = []byte{
+	'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x51,
+	'P', 'R', 'I', 'V', 0x00, 0x00, 0x00, 0x35, 0x00, 0x00,
+	'c', 'o', 'm', '.', 'a', 'p', 'p', 'l', 'e', '.', 's', 't', 'r', 'e', 'a', 'm', 'i', 'n', 'g', '.',
+	't', 'r', 'a', 'n', 's', 'p', 'o', 'r', 't', 'S', 't', 'r', 'e', 'a', 'm', 'T', 'i', 'm', 'e', 's', 't', 'a', 'm', 'p', 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x5f, 0x90,
+	'T', 'X', 'X', 'X', 0x00, 0x00, 0x00, 0x08, 0x00, 0x00,
+	0x03, 'k', 'e', 'y', 0x00, 'v', 'a', 'l',
+}
+
+func TestParseID3(t *testing.T) {
+	tags, err := ParseID3(id3Tag)
+	require.NoError(t, err)
+	require.Len(t, tags, 1)
+	assert.Equal(t, uint8(4), tags[0].Version)
+	require.Len(t, tags[0].Frames, 2)
+
+	owner, data, ok := tags[0].Frames[0].Private()
+	assert.True(t, ok)
+	assert.Equal(t, "com.apple.streaming.transportStreamTimestamp", owner)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 1, 0x5f, 0x90}, data)
+
+	desc, val, ok := tags[0].Frames[1].UserText()
+	assert.True(t, ok)
+	assert.Equal(t, "key", desc)
+	assert.Equal(t, "val", val)
+
+	_, ok = tags[0].Frames[1].Text()
+	assert.False(t, ok)
+}
+
+func TestID3Text(t *testing.T) {
+	f := ID3Frame{ID: "TIT2", Data: []byte{0x01, 0xff, 0xfe, 'h', 0, 'i', 0, 0, 0}}
+	s, ok := f.Text()
+	assert.True(t, ok)
+	assert.Equal(t, "hi", s)
+
+	f = ID3Frame{ID: "TIT2", Data: []byte{0x00, 0xe9}}
+	s, ok = f.Text()
+	assert.True(t, ok)
+	assert.Equal(t, "é", s)
+}
+
+func TestParseID3Invalid(t *testing.T) {
+	_, err := ParseID3([]byte("ID3"))
+	assert.Error(t, err)
+
+	_, err = ParseID3(id3Tag[:len(id3Tag)-1])
+	assert.Error(t, err)
+
+	bad := append([]byte{}, id3Tag...)
+	bad[9] = 0x80 // Not syncsafe
+	_, err = ParseID3(bad)
+	assert.Error(t, err)
+}
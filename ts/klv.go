@@ -0,0 +1,151 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/eluv-io/errors-go"
+)
+
+var (
+	// UASDatalinkLS is the universal key of the MISB ST 0601 UAS Datalink Local Set
+	UASDatalinkLS = []byte{0x06, 0x0e, 0x2b, 0x34, 0x02, 0x0b, 0x01, 0x01, 0x0e, 0x01, 0x03, 0x01, 0x01, 0x00, 0x00, 0x00}
+	smpteULPrefix = []byte{0x06, 0x0e, 0x2b, 0x34}
+)
+
+const (
+	// UASChecksumTag is the tag of the checksum item of the UAS Datalink Local Set
+	UASChecksumTag = 1
+	// UASPrecisionTimeStampTag is the tag of the precision time stamp item of the UAS Datalink Local
+	// Set (microseconds since 1970-01-01 UTC)
+	UASPrecisionTimeStampTag = 2
+)
+
+// KLV is a SMPTE 336M key-length-value triplet, as carried in a KLV stream (stream type 0x06 or 0x15
+// with KLVA registration) of a MPEG-TS.
+type KLV struct {
+	Key   []byte `json:"key"` // 16 byte SMPTE universal label
+	Value []byte `json:"value"`
+}
+
+// LocalSetItem is an item of a MISB local set, the tag is BER-OID encoded.
+type LocalSetItem struct {
+	Tag   int    `json:"tag"`
+	Value []byte `json:"value"`
+}
+
+// ParseKLV parses the KLV triplets of a KLV payload. Lengths are BER encoded.
+func ParseKLV(b []byte) ([]KLV, error) {
+	e := errors.Template("ts.ParseKLV", errors.K.Invalid)
+
+	var res []KLV
+	for len(b) > 0 {
+		if len(b) < 17 {
+			return nil, e("reason", "truncated KLV", "len", len(b))
+		}
+		if !bytes.Equal(b[:4], smpteULPrefix) {
+			return nil, e("reason", "invalid universal label", "key", b[:16])
+		}
+		n, l, err := berLength(b[16:])
+		if err != nil {
+			return nil, e(err)
+		}
+		start := 16 + l
+		if n > len(b)-start {
+			return nil, e("reason", "value too long", "len", n)
+		}
+		res = append(res, KLV{Key: b[:16], Value: b[start : start+n]})
+		b = b[start+n:]
+	}
+	return res, nil
+}
+
+// IsUASDatalinkLS returns true if the KLV is a MISB ST 0601 UAS Datalink Local Set. The version byte of
+// the key is ignored.
+func (k KLV) IsUASDatalinkLS() bool {
+	return len(k.Key) == 16 && bytes.Equal(k.Key[:7], UASDatalinkLS[:7]) && bytes.Equal(k.Key[8:], UASDatalinkLS[8:])
+}
+
+// LocalSet parses the value of the KLV as a local set.
+func (k KLV) LocalSet() ([]LocalSetItem, error) {
+	e := errors.Template("ts.LocalSet", errors.K.Invalid)
+
+	var res []LocalSetItem
+	b := k.Value
+	for len(b) > 0 {
+		tag := 0
+		i := 0
+		for {
+			if i >= len(b) || i == 4 {
+				return nil, e("reason", "invalid tag")
+			}
+			tag = tag<<7 | int(b[i]&0x7f)
+			i++
+			if b[i-1]&0x80 == 0 {
+				break
+			}
+		}
+		n, l, err := berLength(b[i:])
+		if err != nil {
+			return nil, e(err, "tag", tag)
+		}
+		i += l
+		if n > len(b)-i {
+			return nil, e("reason", "value too long", "tag", tag, "len", n)
+		}
+		res = append(res, LocalSetItem{Tag: tag, Value: b[i : i+n]})
+		b = b[i+n:]
+	}
+	return res, nil
+}
+
+// VerifyUASChecksum verifies the checksum item of a UAS Datalink Local Set, the 16-bit running sum
+// of the bytes from the start of the key through the checksum length (MISB ST 0601). payload is the
+// KLV payload that starts with the key of the local set.
+func VerifyUASChecksum(payload []byte) bool {
+	klvs, err := ParseKLV(payload)
+	if err != nil || len(klvs) == 0 || !klvs[0].IsUASDatalinkLS() {
+		return false
+	}
+	_, l, _ := berLength(payload[16:])
+	end := 16 + l + len(klvs[0].Value)
+	if end < 4 || payload[end-4] != UASChecksumTag || payload[end-3] != 2 {
+		return false // The checksum is the last item
+	}
+	var sum uint16
+	for i, c := range payload[:end-2] {
+		sum += uint16(c) << (8 * uint((i+1)%2))
+	}
+	return sum == binary.BigEndian.Uint16(payload[end-2:])
+}
+
+// PrecisionTimeStamp returns the precision time stamp of a UAS Datalink Local Set.
+func PrecisionTimeStamp(items []LocalSetItem) (time.Time, bool) {
+	for _, it := range items {
+		if it.Tag == UASPrecisionTimeStampTag && len(it.Value) == 8 {
+			us := int64(binary.BigEndian.Uint64(it.Value))
+			return time.Unix(us/1e6, us%1e6*1e3).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// berLength decodes a BER length, in short or long form, and returns it with the number of bytes read.
+func berLength(b []byte) (int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errors.E("berLength", errors.K.Invalid, "reason", "missing length")
+	}
+	if b[0]&0x80 == 0 {
+		return int(b[0]), 1, nil
+	}
+	l := int(b[0] & 0x7f)
+	if l == 0 || l > 4 || len(b) < 1+l {
+		return 0, 0, errors.E("berLength", errors.K.Invalid, "reason", "invalid long form length", "bytes", l)
+	}
+	n := 0
+	for _, c := range b[1 : 1+l] {
+		n = n<<8 | int(c)
+	}
+	return n, 1 + l, nil
+}
@@ -0,0 +1,69 @@
+package ts
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uasLocalSet returns a UAS Datalink Local Set with a precision time stamp, a mission id and a checksum
+func uasLocalSet() []byte {
+	b := append([]byte{}, UASDatalinkLS...)
+	b = append(b, 0x1a) // Length
+	b = append(b, UASPrecisionTimeStampTag, 8)
+	b = binary.BigEndian.AppendUint64(b, 1231798102000000)
+	b = append(b, 3, 10)
+	b = append(b, []byte("MISSION01 ")...)
+	b = append(b, UASChecksumTag, 2)
+	var sum uint16
+	for i := 0; i < len(b); i++ {
+		if i%2 == 0 {
+			sum += uint16(b[i]) << 8
+		} else {
+			sum += uint16(b[i])
+		}
+	}
+	return binary.BigEndian.AppendUint16(b, sum)
+}
+
+func TestParseKLV(t *testing.T) {
+	payload := uasLocalSet()
+	klvs, err := ParseKLV(payload)
+	require.NoError(t, err)
+	require.Len(t, klvs, 1)
+	assert.True(t, klvs[0].IsUASDatalinkLS())
+	assert.True(t, VerifyUASChecksum(payload))
+
+	items, err := klvs[0].LocalSet()
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	assert.Equal(t, 3, items[1].Tag)
+	assert.Equal(t, "MISSION01 ", string(items[1].Value))
+
+	ts, ok := PrecisionTimeStamp(items)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2009, 1, 12, 22, 8, 22, 0, time.UTC), ts)
+
+	payload[len(payload)-1]++
+	assert.False(t, VerifyUASChecksum(payload))
+}
+
+func TestParseKLVLongLength(t *testing.T) {
+	b := append([]byte{}, UASDatalinkLS...)
+	b = append(b, 0x82, 0x01, 0x00)
+	b = append(b, make([]byte, 256)...)
+	klvs, err := ParseKLV(b)
+	require.NoError(t, err)
+	require.Len(t, klvs, 1)
+	assert.Len(t, klvs[0].Value, 256)
+
+	_, err = ParseKLV(b[:len(b)-1])
+	assert.Error(t, err)
+
+	b[0] = 0
+	_, err = ParseKLV(b)
+	assert.Error(t, err)
+}
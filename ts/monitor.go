@@ -0,0 +1,701 @@
+package ts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Check is an ETSI TR 101 290 check. The value is the indicator name used by the spec.
+type Check string
+
+const (
+	// Priority 1
+	CheckTsSyncLoss      Check = "TS_sync_loss"           // 1.1
+	CheckSyncByte        Check = "Sync_byte_error"        // 1.2
+	CheckPat             Check = "PAT_error"              // 1.3
+	CheckContinuityCount Check = "Continuity_count_error" // 1.4
+	CheckPmt             Check = "PMT_error"              // 1.5
+	CheckPid             Check = "PID_error"              // 1.6
+	// Priority 2
+	CheckPcrRepetition    Check = "PCR_repetition_error"              // 2.3a
+	CheckPcrDiscontinuity Check = "PCR_discontinuity_indicator_error" // 2.3b
+	CheckPcrAccuracy      Check = "PCR_accuracy_error"                // 2.4
+	CheckPts              Check = "PTS_error"                         // 2.5
+)
+
+// Priority returns the TR 101 290 priority of the check (1 or 2).
+func (c Check) Priority() int {
+	switch c {
+	case CheckTsSyncLoss, CheckSyncByte, CheckPat, CheckContinuityCount, CheckPmt, CheckPid:
+		return 1
+	default:
+		return 2
+	}
+}
+
+const (
+	pcrClock   = 27000000               // PCR runs at 27 MHz
+	pcrWrap    = (int64(1) << 33) * 300 // PCR base is 33 bits
+	syncLock   = 5                      // Consecutive sync bytes to acquire sync
+	syncUnlock = 2                      // Consecutive corrupted sync bytes to lose sync
+)
+
+// MonitorConfig holds the thresholds of the time based checks. Zero values are replaced by
+// the TR 101 290 defaults, and a negative PcrAccuracy disables the PCR accuracy check
+// (it is only meaningful for constant bitrate streams).
+type MonitorConfig struct {
+	PatInterval      time.Duration // Max interval between PAT sections (default 500ms)
+	PmtInterval      time.Duration // Max interval between PMT sections (default 500ms)
+	PidInterval      time.Duration // Max interval a PID referred in a PMT can be absent (default 5s)
+	PcrInterval      time.Duration // Max interval between PCRs (default 40ms)
+	PcrDiscontinuity time.Duration // Max difference between consecutive PCRs (default 100ms)
+	PcrAccuracy      time.Duration // Max PCR inaccuracy (default 500ns)
+	PtsInterval      time.Duration // Max interval between PTS of an audio/video PID (default 700ms)
+}
+
+func (c *MonitorConfig) setDefaults() {
+	if c.PatInterval == 0 {
+		c.PatInterval = 500 * time.Millisecond
+	}
+	if c.PmtInterval == 0 {
+		c.PmtInterval = 500 * time.Millisecond
+	}
+	if c.PidInterval == 0 {
+		c.PidInterval = 5 * time.Second
+	}
+	if c.PcrInterval == 0 {
+		c.PcrInterval = 40 * time.Millisecond
+	}
+	if c.PcrDiscontinuity == 0 {
+		c.PcrDiscontinuity = 100 * time.Millisecond
+	}
+	if c.PcrAccuracy == 0 {
+		c.PcrAccuracy = 500 * time.Nanosecond
+	}
+	if c.PtsInterval == 0 {
+		c.PtsInterval = 700 * time.Millisecond
+	}
+}
+
+// MonitorEvent is sent every time a check fails.
+type MonitorEvent struct {
+	Check      Check         `json:"check"`
+	Priority   int           `json:"priority"`
+	PID        int           `json:"pid"`         // -1 if the event is not related to a PID (sync errors)
+	Time       time.Time     `json:"time"`        // Wall clock time the error was detected
+	StreamTime time.Duration `json:"stream_time"` // Position in the stream based on the PCR, -1 if unknown
+	Packet     uint64        `json:"packet"`      // Index of the TS packet
+	Count      uint64        `json:"count"`       // # of times this check failed on this PID, including this one
+	Details    string        `json:"details"`
+}
+
+// PIDSummary holds the counters of a PID.
+type PIDSummary struct {
+	PID        uint16           `json:"pid"`
+	StreamType uint8            `json:"stream_type,omitempty"` // Stream type from the PMT, 0 if not an elementary stream
+	Packets    uint64           `json:"packets"`
+	Errors     map[Check]uint64 `json:"errors,omitempty"`
+}
+
+// MonitorSummary holds the counters of a Monitor.
+type MonitorSummary struct {
+	Packets        uint64                `json:"packets"`
+	Bytes          uint64                `json:"bytes"`
+	Priority1      uint64                `json:"priority1_errors"`
+	Priority2      uint64                `json:"priority2_errors"`
+	Errors         map[Check]uint64      `json:"errors"`
+	PIDs           map[uint16]PIDSummary `json:"pids"`
+	DroppedEvents  uint64                `json:"dropped_events"` // Events not sent because the channel was full
+	StreamDuration time.Duration         `json:"stream_duration"`
+}
+
+type pidState struct {
+	summary PIDSummary
+
+	cc         int // Last continuity counter, -1 if unknown
+	duplicates int
+
+	sections sectionAssembler // PAT and PMT PIDs
+
+	lastSeen    int64 // Stream clock (27MHz) when the PID was last seen / last PSI / last PTS
+	lastSection int64
+	lastPts     int64
+	hasPts      bool
+	gapReported bool
+	ptsReported bool
+	psiReported bool
+
+	lastPcr    int64 // Last PCR value, -1 if none
+	lastPcrPos uint64
+	pcrRate    float64 // PCR ticks per byte between the last two PCRs, 0 if unknown
+}
+
+// Monitor runs ETSI TR 101 290 priority 1 and 2 checks on a MPEG-TS stream written into it.
+// Time based checks use a clock derived from the PCR and the byte position, so they work the
+// same on live and file inputs. Events are sent to the channel without blocking, if the channel is
+// full they are dropped (but still counted in the summary).
+type Monitor struct {
+	mu     sync.Mutex
+	cfg    MonitorConfig
+	events chan<- MonitorEvent
+	closed bool
+
+	buf       []byte
+	bytes     uint64 // Bytes consumed so far
+	packets   uint64
+	synced    bool
+	badSyncs  int
+	wasSynced bool
+
+	pids      map[uint16]*pidState
+	pmtPIDs   map[uint16]bool // PMT PIDs referred in the PAT
+	referred  map[uint16]bool // Elementary stream and PCR PIDs referred in the PMTs
+	streamTyp map[uint16]uint8
+
+	lastPat     int64
+	patReported bool
+
+	// Stream clock in 27MHz ticks, derived from the PCR of clockPID
+	clockPID   int
+	clockValid bool
+	clockRaw   int64
+	clockTicks int64
+	clockPos   uint64
+	clockRate  float64
+	clockStart int64
+	lastCheck  int64
+
+	errors        map[Check]uint64
+	priority1     uint64
+	priority2     uint64
+	droppedEvents uint64
+}
+
+// NewMonitor creates a Monitor that sends events to the events channel (can be nil).
+// If cfg is nil the TR 101 290 default thresholds are used.
+func NewMonitor(events chan<- MonitorEvent, cfg *MonitorConfig) *Monitor {
+	m := &Monitor{
+		events:    events,
+		pids:      make(map[uint16]*pidState),
+		pmtPIDs:   make(map[uint16]bool),
+		referred:  make(map[uint16]bool),
+		streamTyp: make(map[uint16]uint8),
+		errors:    make(map[Check]uint64),
+		clockPID:  -1,
+		lastPat:   -1,
+	}
+	if cfg != nil {
+		m.cfg = *cfg
+	}
+	m.cfg.setDefaults()
+	return m
+}
+
+// Write feeds the stream into the monitor. It never fails so that it can be used with a TeeReader.
+func (m *Monitor) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return len(p), nil
+	}
+	m.buf = append(m.buf, p...)
+	m.process()
+	return len(p), nil
+}
+
+// Close closes the events channel.
+func (m *Monitor) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		if m.events != nil {
+			close(m.events)
+		}
+	}
+	return nil
+}
+
+// Summary returns a copy of the counters.
+func (m *Monitor) Summary() MonitorSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := MonitorSummary{
+		Packets:       m.packets,
+		Bytes:         m.bytes,
+		Priority1:     m.priority1,
+		Priority2:     m.priority2,
+		Errors:        make(map[Check]uint64, len(m.errors)),
+		PIDs:          make(map[uint16]PIDSummary, len(m.pids)),
+		DroppedEvents: m.droppedEvents,
+	}
+	for c, n := range m.errors {
+		s.Errors[c] = n
+	}
+	for pid, st := range m.pids {
+		ps := st.summary
+		ps.StreamType = m.streamTyp[pid]
+		ps.Errors = make(map[Check]uint64, len(st.summary.Errors))
+		for c, n := range st.summary.Errors {
+			ps.Errors[c] = n
+		}
+		s.PIDs[pid] = ps
+	}
+	if m.clockValid {
+		s.StreamDuration = ticksToDuration(m.now() - m.clockStart)
+	}
+	return s
+}
+
+func (m *Monitor) process() {
+	for {
+		if !m.synced {
+			if !m.acquireSync() {
+				return
+			}
+		}
+		if len(m.buf) < tsPacketSize {
+			return
+		}
+
+		if m.buf[0] != tsSyncByte {
+			m.badSyncs++
+			m.report(CheckSyncByte, -1, "sync byte 0x%02x", m.buf[0])
+			if m.badSyncs >= syncUnlock {
+				m.synced = false
+				m.report(CheckTsSyncLoss, -1, "%d consecutive corrupted sync bytes", m.badSyncs)
+				continue
+			}
+			m.consume(tsPacketSize)
+			continue
+		}
+		m.badSyncs = 0
+
+		m.packet(m.buf[:tsPacketSize])
+		m.consume(tsPacketSize)
+	}
+}
+
+// acquireSync looks for syncLock consecutive sync bytes, dropping the bytes before them.
+func (m *Monitor) acquireSync() bool {
+	for len(m.buf) >= syncLock*tsPacketSize {
+		found := true
+		for i := 0; i < syncLock; i++ {
+			if m.buf[i*tsPacketSize] != tsSyncByte {
+				found = false
+				break
+			}
+		}
+		if found {
+			m.synced = true
+			m.badSyncs = 0
+			if m.wasSynced {
+				log.Debug("TS monitor sync acquired again", "bytes", m.bytes)
+			}
+			m.wasSynced = true
+			return true
+		}
+		m.consume(1)
+	}
+	return false
+}
+
+func (m *Monitor) consume(n int) {
+	m.bytes += uint64(n)
+	m.buf = m.buf[n:]
+	if len(m.buf) == 0 {
+		m.buf = nil
+	}
+}
+
+func (m *Monitor) pid(pid uint16) *pidState {
+	st := m.pids[pid]
+	if st == nil {
+		st = &pidState{
+			summary:     PIDSummary{PID: pid, Errors: make(map[Check]uint64)},
+			cc:          -1,
+			lastPcr:     -1,
+			lastSeen:    -1,
+			lastSection: -1,
+			lastPts:     -1,
+		}
+		m.pids[pid] = st
+	}
+	return st
+}
+
+func (m *Monitor) packet(pkt []byte) {
+	m.packets++
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	pusi := pkt[1]&0x40 != 0
+	scrambling := pkt[3] >> 6
+	afc := (pkt[3] >> 4) & 0x03
+	cc := int(pkt[3] & 0x0f)
+
+	st := m.pid(pid)
+	st.summary.Packets++
+
+	payload := pkt[4:]
+	discontinuity := false
+	if afc&0x02 != 0 {
+		afLen := int(pkt[4])
+		if afLen > tsPacketSize-5 {
+			afLen = tsPacketSize - 5
+		}
+		if afLen > 0 {
+			flags := pkt[5]
+			discontinuity = flags&0x80 != 0
+			if flags&0x10 != 0 && afLen >= 7 {
+				m.pcr(pid, st, pcrValue(pkt[6:12]), discontinuity)
+			}
+		}
+		payload = pkt[5+afLen:]
+	}
+	hasPayload := afc&0x01 != 0
+	if !hasPayload {
+		payload = nil
+	}
+
+	now := m.now()
+	st.lastSeen = now
+	st.gapReported = false
+
+	if pid != nullPID {
+		m.continuity(pid, st, cc, hasPayload, discontinuity)
+	}
+
+	switch {
+	case pid == patPID:
+		if scrambling != 0 {
+			m.report(CheckPat, int(pid), "scrambling control %d", scrambling)
+		} else if hasPayload {
+			m.psi(pid, st, payload, pusi)
+		}
+	case m.pmtPIDs[pid]:
+		if scrambling != 0 {
+			m.report(CheckPmt, int(pid), "scrambling control %d", scrambling)
+		} else if hasPayload {
+			m.psi(pid, st, payload, pusi)
+		}
+	case pusi && hasPayload && scrambling == 0:
+		m.pes(st, payload)
+	}
+
+	m.checkTimeouts(now)
+}
+
+func (m *Monitor) continuity(pid uint16, st *pidState, cc int, hasPayload bool, discontinuity bool) {
+	if st.cc < 0 || discontinuity {
+		st.cc = cc
+		st.duplicates = 0
+		return
+	}
+
+	switch {
+	case !hasPayload:
+		// The continuity counter must not be incremented for packets without payload
+		if cc != st.cc {
+			m.report(CheckContinuityCount, int(pid), "counter changed to %d without payload, expected %d", cc, st.cc)
+		}
+	case cc == st.cc:
+		st.duplicates++
+		if st.duplicates > 1 {
+			m.report(CheckContinuityCount, int(pid), "packet duplicated %d times", st.duplicates)
+		}
+	case cc == (st.cc+1)&0x0f:
+		st.duplicates = 0
+	default:
+		m.report(CheckContinuityCount, int(pid), "counter %d, expected %d (%d packets lost)", cc, (st.cc+1)&0x0f, (cc-st.cc-1)&0x0f)
+		st.duplicates = 0
+	}
+	st.cc = cc
+}
+
+// psi assembles PSI sections and parses the complete ones.
+func (m *Monitor) psi(pid uint16, st *pidState, payload []byte, pusi bool) {
+	for _, sec := range st.sections.push(payload, pusi) {
+		m.section(pid, st, sec)
+	}
+}
+
+func (m *Monitor) section(pid uint16, st *pidState, s []byte) {
+	tableID := s[0]
+	if pid == patPID && tableID != patTableID {
+		m.report(CheckPat, int(pid), "table_id 0x%02x", tableID)
+		return
+	}
+	if pid != patPID && tableID != pmtTableID {
+		m.report(CheckPmt, int(pid), "table_id 0x%02x", tableID)
+		return
+	}
+	// Corrupted sections are ignored, which eventually triggers a repetition error
+	if !validSection(s) {
+		log.Debug("TS monitor invalid section", "pid", pid, "table_id", tableID, "len", len(s))
+		return
+	}
+
+	now := m.now()
+	if pid == patPID {
+		m.lastPat = now
+		m.patReported = false
+		m.updatePat(s)
+	} else {
+		st.lastSection = now
+		st.psiReported = false
+		m.updatePmt(s)
+	}
+}
+
+func (m *Monitor) updatePat(s []byte) {
+	pmtPIDs := make(map[uint16]bool)
+	for _, pid := range parsePat(s) {
+		pmtPIDs[pid] = true
+		if !m.pmtPIDs[pid] {
+			st := m.pid(pid)
+			st.lastSection = m.now()
+		}
+	}
+	m.pmtPIDs = pmtPIDs
+}
+
+func (m *Monitor) updatePmt(s []byte) {
+	pcrPID, streams := parsePmt(s)
+	if pcrPID != nullPID {
+		m.addReferred(pcrPID)
+		if m.clockPID < 0 {
+			m.clockPID = int(pcrPID)
+		}
+	}
+	for _, es := range streams {
+		m.streamTyp[es.pid] = es.streamType
+		m.addReferred(es.pid)
+	}
+}
+
+func (m *Monitor) addReferred(pid uint16) {
+	if m.referred[pid] {
+		return
+	}
+	m.referred[pid] = true
+	st := m.pid(pid)
+	if st.lastSeen < 0 {
+		st.lastSeen = m.now()
+	}
+}
+
+func (m *Monitor) pes(st *pidState, payload []byte) {
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return
+	}
+	if payload[7]&0x80 == 0 { // No PTS
+		return
+	}
+	st.hasPts = true
+	st.lastPts = m.now()
+	st.ptsReported = false
+}
+
+func (m *Monitor) pcr(pid uint16, st *pidState, pcr int64, discontinuity bool) {
+	pos := m.bytes
+	if m.clockPID < 0 {
+		m.clockPID = int(pid)
+	}
+	if int(pid) == m.clockPID {
+		m.updateClock(pcr, pos, discontinuity)
+	}
+
+	if st.lastPcr < 0 || discontinuity {
+		st.lastPcr = pcr
+		st.lastPcrPos = pos
+		st.pcrRate = 0
+		return
+	}
+
+	delta := pcrDelta(pcr, st.lastPcr)
+	switch {
+	case delta <= 0 || delta > durationToTicks(m.cfg.PcrDiscontinuity):
+		m.report(CheckPcrDiscontinuity, int(pid), "PCR difference %v", ticksToDuration(delta))
+		st.pcrRate = 0
+	case delta > durationToTicks(m.cfg.PcrInterval):
+		m.report(CheckPcrRepetition, int(pid), "PCR interval %v", ticksToDuration(delta))
+		m.pcrAccuracy(pid, st, pcr, pos)
+		st.pcrRate = float64(delta) / float64(pos-st.lastPcrPos)
+	default:
+		m.pcrAccuracy(pid, st, pcr, pos)
+		if pos > st.lastPcrPos {
+			st.pcrRate = float64(delta) / float64(pos-st.lastPcrPos)
+		}
+	}
+	st.lastPcr = pcr
+	st.lastPcrPos = pos
+}
+
+// pcrAccuracy compares the PCR with the value extrapolated at a constant bitrate from the previous PCRs.
+func (m *Monitor) pcrAccuracy(pid uint16, st *pidState, pcr int64, pos uint64) {
+	if m.cfg.PcrAccuracy < 0 || st.pcrRate == 0 {
+		return
+	}
+	expected := st.lastPcr + int64(float64(pos-st.lastPcrPos)*st.pcrRate+0.5)
+	diff := pcrDelta(pcr, expected%pcrWrap)
+	if diff < 0 {
+		diff = -diff
+	}
+	if ticksToDuration(diff) > m.cfg.PcrAccuracy {
+		m.report(CheckPcrAccuracy, int(pid), "PCR inaccuracy %v", ticksToDuration(diff))
+	}
+}
+
+func (m *Monitor) updateClock(pcr int64, pos uint64, discontinuity bool) {
+	if !m.clockValid {
+		m.clockValid = true
+		m.clockRaw = pcr
+		m.clockTicks = 0
+		m.clockPos = pos
+		m.clockStart = 0
+		m.lastCheck = 0
+		if m.lastPat < 0 {
+			m.lastPat = 0
+		}
+		return
+	}
+
+	delta := pcrDelta(pcr, m.clockRaw)
+	if !discontinuity && delta > 0 && delta <= durationToTicks(m.cfg.PcrDiscontinuity) {
+		if pos > m.clockPos {
+			m.clockRate = float64(delta) / float64(pos-m.clockPos)
+		}
+		m.clockTicks += delta
+	} else {
+		// Keep the clock monotonic across PCR discontinuities
+		m.clockTicks = m.now()
+	}
+	m.clockRaw = pcr
+	m.clockPos = pos
+}
+
+// now returns the stream clock in 27MHz ticks at the current byte position, or -1 if unknown.
+func (m *Monitor) now() int64 {
+	if !m.clockValid {
+		return -1
+	}
+	return m.clockTicks + int64(float64(m.bytes-m.clockPos)*m.clockRate)
+}
+
+// checkTimeouts runs the repetition checks, every 10ms of stream time.
+func (m *Monitor) checkTimeouts(now int64) {
+	if now < 0 || now-m.lastCheck < pcrClock/100 {
+		return
+	}
+	m.lastCheck = now
+
+	if !m.patReported && m.lastPat >= 0 && now-m.lastPat > durationToTicks(m.cfg.PatInterval) {
+		m.patReported = true
+		m.report(CheckPat, patPID, "no PAT for %v", ticksToDuration(now-m.lastPat))
+	}
+
+	for pid, st := range m.pids {
+		// Tables and PIDs found before the first PCR are timed from the first check
+		if st.lastSection < 0 {
+			st.lastSection = now
+		}
+		if st.lastSeen < 0 {
+			st.lastSeen = now
+		}
+		if st.lastPts < 0 {
+			st.lastPts = now
+		}
+		if m.pmtPIDs[pid] && !st.psiReported && now-st.lastSection > durationToTicks(m.cfg.PmtInterval) {
+			st.psiReported = true
+			m.report(CheckPmt, int(pid), "no PMT for %v", ticksToDuration(now-st.lastSection))
+		}
+		if m.referred[pid] && !st.gapReported && now-st.lastSeen > durationToTicks(m.cfg.PidInterval) {
+			st.gapReported = true
+			m.report(CheckPid, int(pid), "PID absent for %v", ticksToDuration(now-st.lastSeen))
+		}
+		if st.hasPts && !st.ptsReported && isAVStreamType(m.streamTyp[pid]) &&
+			now-st.lastPts > durationToTicks(m.cfg.PtsInterval) {
+			st.ptsReported = true
+			m.report(CheckPts, int(pid), "no PTS for %v", ticksToDuration(now-st.lastPts))
+		}
+	}
+}
+
+func (m *Monitor) report(check Check, pid int, format string, args ...interface{}) {
+	m.errors[check]++
+	if check.Priority() == 1 {
+		m.priority1++
+	} else {
+		m.priority2++
+	}
+
+	count := m.errors[check]
+	if pid >= 0 {
+		st := m.pid(uint16(pid))
+		st.summary.Errors[check]++
+		count = st.summary.Errors[check]
+	}
+
+	streamTime := time.Duration(-1)
+	if now := m.now(); now >= 0 {
+		streamTime = ticksToDuration(now - m.clockStart)
+	}
+	ev := MonitorEvent{
+		Check:      check,
+		Priority:   check.Priority(),
+		PID:        pid,
+		Time:       time.Now(),
+		StreamTime: streamTime,
+		Packet:     m.packets,
+		Count:      count,
+		Details:    fmt.Sprintf(format, args...),
+	}
+	log.Debug("TS monitor", "check", check, "pid", pid, "packet", m.packets, "details", ev.Details)
+
+	if m.events == nil {
+		return
+	}
+	select {
+	case m.events <- ev:
+	default:
+		m.droppedEvents++
+	}
+}
+
+func pcrValue(b []byte) int64 {
+	base := int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4])>>7
+	ext := int64(b[4]&0x01)<<8 | int64(b[5])
+	return base*300 + ext
+}
+
+// pcrDelta returns a - b taking care of the PCR wrap around.
+func pcrDelta(a, b int64) int64 {
+	d := (a - b) % pcrWrap
+	if d > pcrWrap/2 {
+		d -= pcrWrap
+	} else if d < -pcrWrap/2 {
+		d += pcrWrap
+	}
+	return d
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks * 1000 / (pcrClock / 1000000))
+}
+
+func durationToTicks(d time.Duration) int64 {
+	return int64(d) * (pcrClock / 1000000) / 1000
+}
+
+func isAVStreamType(streamType uint8) bool {
+	switch streamType {
+	case 0x01, 0x02, 0x10, 0x1b, 0x24, 0x33, 0x42, 0xea, // Video
+		0x03, 0x04, 0x0f, 0x11, 0x1c, 0x81, 0x87: // Audio
+		return true
+	default:
+		return false
+	}
+}
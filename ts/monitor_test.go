@@ -0,0 +1,286 @@
+package ts
+
+import (
+	"testing"
+
+	"github.com/eluv-io/avpipe/ts/mpegcrc"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testPmtPID   = 0x100
+	testVideoPID = 0x101
+	testAudioPID = 0x102
+
+	testTicksPerPacket = 5400 // 0.2ms per packet, ~7.5 Mbps
+)
+
+// testStream generates a CBR stream with a PAT and PMT every 100ms, a PCR on the video PID
+// every 20ms and PTS every 30ms on the video and audio PIDs.
+type testStream struct {
+	cc  map[uint16]byte
+	pcr func(i int) (int64, bool) // PCR of packet i and its discontinuity indicator
+	pkt func(i int, b []byte) []byte
+}
+
+func newTestStream() *testStream {
+	return &testStream{cc: make(map[uint16]byte)}
+}
+
+func (ts *testStream) header(b []byte, pid uint16, pusi bool, afc byte) {
+	b[0] = tsSyncByte
+	b[1] = byte(pid>>8) & 0x1f
+	if pusi {
+		b[1] |= 0x40
+	}
+	b[2] = byte(pid)
+	cc := ts.cc[pid]
+	if afc&0x01 != 0 {
+		cc = (cc + 1) & 0x0f
+		ts.cc[pid] = cc
+	}
+	b[3] = afc<<4 | cc
+}
+
+func testSection(tableID byte, body []byte) []byte {
+	n := len(body) + 5 + 4
+	s := []byte{tableID, 0xb0 | byte(n>>8), byte(n), 0x00, 0x01, 0xc1, 0x00, 0x00}
+	s = append(s, body...)
+	crc := mpegcrc.Checksum(s)
+	return append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func (ts *testStream) psi(pid uint16, s []byte) []byte {
+	b := make([]byte, tsPacketSize)
+	for i := range b {
+		b[i] = 0xff
+	}
+	ts.header(b, pid, true, 0x01)
+	b[4] = 0
+	copy(b[5:], s)
+	return b
+}
+
+func (ts *testStream) packet(i int) []byte {
+	switch i % 500 {
+	case 0:
+		return ts.psi(patPID, testSection(0x00, []byte{0x00, 0x01, 0xe0 | testPmtPID>>8, testPmtPID & 0xff}))
+	case 1:
+		return ts.psi(testPmtPID, testSection(0x02, []byte{
+			0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0x00,
+			0x1b, 0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0x00,
+			0x0f, 0xe0 | testAudioPID>>8, testAudioPID & 0xff, 0xf0, 0x00,
+		}))
+	}
+
+	b := make([]byte, tsPacketSize)
+	pid := uint16(testVideoPID)
+	if i%10 == 7 {
+		pid = testAudioPID
+	}
+	pusi := i%150 == 10 || i%150 == 17
+	payload := b[4:]
+	if pid == testVideoPID && i%100 == 5 {
+		ts.header(b, pid, pusi, 0x03)
+		pcr, discontinuity := int64(i)*testTicksPerPacket, false
+		if ts.pcr != nil {
+			pcr, discontinuity = ts.pcr(i)
+		}
+		b[4] = 7
+		b[5] = 0x10
+		if discontinuity {
+			b[5] |= 0x80
+		}
+		base, ext := pcr/300, pcr%300
+		b[6], b[7], b[8], b[9] = byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1)
+		b[10] = byte(base<<7) | 0x7e | byte(ext>>8)
+		b[11] = byte(ext)
+		payload = b[12:]
+	} else {
+		ts.header(b, pid, pusi, 0x01)
+	}
+	if pusi {
+		copy(payload, []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01})
+	}
+	return b
+}
+
+func (ts *testStream) generate(n int) []byte {
+	var out []byte
+	for i := 0; i < n; i++ {
+		b := ts.packet(i)
+		if ts.pkt != nil {
+			b = ts.pkt(i, b)
+		}
+		out = append(out, b...)
+	}
+	return out
+}
+
+func runMonitor(t *testing.T, data []byte, cfg *MonitorConfig) ([]MonitorEvent, MonitorSummary) {
+	events := make(chan MonitorEvent, 1000)
+	m := NewMonitor(events, cfg)
+	// Write in odd sized chunks to exercise the packet buffering
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := m.Write(data[:n])
+		assert.NoError(t, err)
+		data = data[n:]
+	}
+	assert.NoError(t, m.Close())
+
+	var evs []MonitorEvent
+	for ev := range events {
+		evs = append(evs, ev)
+	}
+	return evs, m.Summary()
+}
+
+func checks(evs []MonitorEvent) map[Check]int {
+	c := make(map[Check]int)
+	for _, ev := range evs {
+		c[ev.Check]++
+	}
+	return c
+}
+
+func TestMonitorCleanStream(t *testing.T) {
+	evs, s := runMonitor(t, newTestStream().generate(10000), nil)
+	assert.Empty(t, evs)
+	assert.Equal(t, uint64(10000), s.Packets)
+	assert.Equal(t, uint64(10000*tsPacketSize), s.Bytes)
+	assert.Equal(t, uint64(0), s.Priority1+s.Priority2)
+	assert.Equal(t, uint8(0x1b), s.PIDs[testVideoPID].StreamType)
+	assert.Equal(t, uint8(0x0f), s.PIDs[testAudioPID].StreamType)
+	assert.InDelta(t, 1999, s.StreamDuration.Milliseconds(), 1)
+}
+
+func TestMonitorContinuityCount(t *testing.T) {
+	s := newTestStream()
+	s.pkt = func(i int, b []byte) []byte {
+		switch i {
+		case 1003: // Lost packet
+			return nil
+		case 2003: // Duplicated once is allowed
+			return append(b, b...)
+		case 3003: // Duplicated twice is not
+			return append(append(b, b...), b...)
+		}
+		return b
+	}
+	// Lost and duplicated packets also break the PCR accuracy of a CBR stream
+	evs, sum := runMonitor(t, s.generate(5000), &MonitorConfig{PcrAccuracy: -1})
+	assert.Equal(t, map[Check]int{CheckContinuityCount: 2}, checks(evs))
+	assert.Equal(t, testVideoPID, evs[0].PID)
+	assert.Equal(t, uint64(1), evs[0].Count)
+	assert.Equal(t, uint64(2), evs[1].Count)
+	assert.Equal(t, uint64(2), sum.PIDs[testVideoPID].Errors[CheckContinuityCount])
+	assert.Equal(t, uint64(2), sum.Priority1)
+}
+
+func TestMonitorSync(t *testing.T) {
+	s := newTestStream()
+	s.pkt = func(i int, b []byte) []byte {
+		switch i {
+		case 1003:
+			b[0] = 0x00
+		case 2003, 2004:
+			b[0] = 0x00
+		case 3000:
+			return append([]byte{0x00, 0x00, 0x00}, b...)
+		}
+		return b
+	}
+	evs, _ := runMonitor(t, s.generate(5000), nil)
+	c := checks(evs)
+	assert.Equal(t, 5, c[CheckSyncByte]) // 1003, 2003, 2004 and the 2 packets after the garbage at 3000
+	assert.Equal(t, 2, c[CheckTsSyncLoss])
+	for _, ev := range evs {
+		if ev.Check == CheckSyncByte || ev.Check == CheckTsSyncLoss {
+			assert.Equal(t, -1, ev.PID)
+			assert.Equal(t, 1, ev.Priority)
+		}
+	}
+}
+
+func TestMonitorPatPmt(t *testing.T) {
+	s := newTestStream()
+	s.pkt = func(i int, b []byte) []byte {
+		if i >= 2000 && i < 6000 && i%500 <= 1 { // No PAT nor PMT for 0.8s
+			b[1] = 0x1f
+			b[2] = 0xff
+		}
+		if i == 8000 { // Wrong table_id on the PAT PID
+			b[5] = 0x02
+		}
+		return b
+	}
+	evs, sum := runMonitor(t, s.generate(10000), nil)
+	// The counters of the PAT and PMT PIDs also jump when they are back
+	assert.Equal(t, map[Check]int{CheckPat: 2, CheckPmt: 1, CheckContinuityCount: 2}, checks(evs))
+	assert.Equal(t, uint64(2), sum.PIDs[patPID].Errors[CheckPat])
+	assert.Equal(t, uint64(1), sum.PIDs[testPmtPID].Errors[CheckPmt])
+}
+
+func TestMonitorPid(t *testing.T) {
+	s := newTestStream()
+	s.pkt = func(i int, b []byte) []byte {
+		if i > 1000 && i%10 == 7 { // Audio disappears
+			b[1] = 0x1f
+			b[2] = 0xff
+		}
+		return b
+	}
+	evs, _ := runMonitor(t, s.generate(40000), nil)
+	c := checks(evs)
+	assert.Equal(t, 1, c[CheckPid])
+	assert.Equal(t, 1, c[CheckPts])
+	for _, ev := range evs {
+		assert.Equal(t, testAudioPID, ev.PID)
+		if ev.Check == CheckPid {
+			assert.InDelta(t, 5.2, ev.StreamTime.Seconds(), 0.1)
+		}
+	}
+}
+
+func TestMonitorPcr(t *testing.T) {
+	s := newTestStream()
+	s.pcr = func(i int) (int64, bool) {
+		pcr := int64(i) * testTicksPerPacket
+		switch {
+		case i == 1005: // Jitter
+			pcr += 1000
+		case i >= 2005 && i < 3005: // Jump without discontinuity indicator, and back at 3005
+			pcr += 10 * pcrClock
+		case i >= 3505: // Jump with discontinuity indicator
+			return pcr + 20*pcrClock, i == 3505
+		}
+		return pcr, false
+	}
+	s.pkt = func(i int, b []byte) []byte {
+		if i == 4005 || i == 4105 { // PCR interval 60ms
+			b[3] = b[3]&0xcf | 0x10
+			b[4] = 0
+		}
+		return b
+	}
+	evs, _ := runMonitor(t, s.generate(5000), nil)
+	c := checks(evs)
+	assert.Equal(t, 2, c[CheckPcrDiscontinuity])
+	assert.Equal(t, 1, c[CheckPcrRepetition])
+	assert.Equal(t, 3, c[CheckPcrAccuracy]) // Jittered PCR, and the next 2 extrapolated from it
+	assert.Equal(t, 0, c[CheckContinuityCount])
+
+	// No accuracy check for VBR streams
+	evs, _ = runMonitor(t, s.generate(5000), &MonitorConfig{PcrAccuracy: -1})
+	assert.Equal(t, 0, checks(evs)[CheckPcrAccuracy])
+}
+
+func TestPcrDelta(t *testing.T) {
+	assert.Equal(t, int64(10), pcrDelta(5, pcrWrap-5))
+	assert.Equal(t, int64(-10), pcrDelta(pcrWrap-5, 5))
+	assert.Equal(t, int64(300), pcrDelta(600, 300))
+}
@@ -0,0 +1,28 @@
+/*
+ * CRC32/MPEG-2 of the MPEG-TS sections (PSI tables, SCTE-35 splice_info_section).
+ */
+package mpegcrc
+
+var table = func() (t [256]uint32) {
+	for i := range t {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return
+}()
+
+// Checksum returns the CRC32/MPEG-2 of b. It is 0 for a section including its CRC_32.
+func Checksum(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc = crc<<8 ^ table[byte(crc>>24)^v]
+	}
+	return crc
+}
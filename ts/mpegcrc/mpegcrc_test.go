@@ -0,0 +1,18 @@
+package mpegcrc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksum(t *testing.T) {
+	// Check value of the CRC-32/MPEG-2 catalogue entry
+	require.Equal(t, uint32(0x0376e6e7), Checksum([]byte("123456789")))
+
+	// A PAT section with its CRC_32
+	pat := []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00}
+	crc := Checksum(pat)
+	pat = append(pat, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	require.Equal(t, uint32(0), Checksum(pat))
+}
@@ -9,7 +9,6 @@ import (
 	"io"
 	"os"
 
-	"github.com/Comcast/gots/packet"
 	"github.com/eluv-io/avpipe/live"
 	"github.com/eluv-io/avpipe/ts"
 	"github.com/eluv-io/log-go"
@@ -20,6 +19,7 @@ func main() {
 	fileName := flag.String("f", "", "Read from TS file")
 	help := flag.Bool("h", false, "Print help")
 	pid := flag.Int("pid", -1, "PID to filter by")
+	monitor := flag.Bool("monitor", false, "Run TR 101 290 checks and print the errors and summary to stderr")
 	flag.Parse()
 	if *help {
 		flag.Usage()
@@ -62,7 +62,7 @@ func main() {
 		peekScanner := bufio.NewReader(tsFile)
 
 		// Verify if sync-byte is present and seek to the first sync-byte
-		_, err = packet.Sync(peekScanner)
+		_, err = ts.Sync(peekScanner)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -73,13 +73,28 @@ func main() {
 	}
 
 	tsInfo := make(chan ts.ScteSignal)
-	tsPipe := ts.NewPipe(reader, closer, *pid, tsInfo)
+	var tsMonitor *ts.Monitor
+	monitorDone := make(chan struct{})
+	if *monitor {
+		events := make(chan ts.MonitorEvent, 100)
+		tsMonitor = ts.NewMonitor(events, nil)
+		go func() {
+			for ev := range events {
+				fmt.Fprintf(os.Stderr, "%v P%d %s pid=%d packet=%d count=%d: %s\n",
+					ev.StreamTime, ev.Priority, ev.Check, ev.PID, ev.Packet, ev.Count, ev.Details)
+			}
+			close(monitorDone)
+		}()
+	} else {
+		close(monitorDone)
+	}
+	tsPipe := ts.NewMonitoredPipe(reader, closer, *pid, tsInfo, tsMonitor)
 
 	// Read UDP and throw away
 	go func() {
-		var pkt packet.Packet
+		pkt := make([]byte, 188)
 		for {
-			if _, err := io.ReadFull(tsPipe, pkt[:]); err != nil {
+			if _, err := io.ReadFull(tsPipe, pkt); err != nil {
 				if err != io.EOF && err != io.ErrUnexpectedEOF {
 					fmt.Println(err)
 				}
@@ -107,4 +122,14 @@ func main() {
 		}
 	}
 	fmt.Println("]")
+
+	<-monitorDone
+	if tsMonitor != nil {
+		jsonBytes, err := json.MarshalIndent(tsMonitor.Summary(), "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			fmt.Fprintln(os.Stderr, string(jsonBytes))
+		}
+	}
 }
@@ -0,0 +1,130 @@
+package ts
+
+import "github.com/eluv-io/avpipe/ts/mpegcrc"
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	nullPID      = 0x1fff
+	patPID       = 0
+
+	patTableID = 0x00
+	pmtTableID = 0x02
+
+	StreamTypeScte35 = 0x86
+)
+
+// packetHeader returns the PID, payload_unit_start_indicator and payload of a TS packet.
+// The payload is nil if the packet has no payload.
+func packetHeader(pkt []byte) (pid uint16, pusi bool, payload []byte) {
+	pid = uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	pusi = pkt[1]&0x40 != 0
+	afc := (pkt[3] >> 4) & 0x03
+	if afc&0x01 == 0 {
+		return
+	}
+	payload = pkt[4:]
+	if afc&0x02 != 0 {
+		afLen := int(pkt[4])
+		if 5+afLen > tsPacketSize {
+			return pid, pusi, nil
+		}
+		payload = pkt[5+afLen:]
+	}
+	return
+}
+
+// sectionAssembler reassembles the PSI sections of a PID from the TS packet payloads.
+type sectionAssembler struct {
+	buf []byte
+}
+
+// push adds the payload of a packet and returns the sections completed by it.
+func (a *sectionAssembler) push(payload []byte, pusi bool) (sections [][]byte) {
+	if pusi {
+		if len(payload) == 0 {
+			return
+		}
+		pointer := int(payload[0])
+		if 1+pointer > len(payload) {
+			a.buf = nil
+			return
+		}
+		if a.buf != nil {
+			a.buf = append(a.buf, payload[1:1+pointer]...)
+			if s := a.next(); s != nil {
+				sections = append(sections, s)
+			}
+		}
+		a.buf = append([]byte(nil), payload[1+pointer:]...)
+	} else if a.buf != nil {
+		a.buf = append(a.buf, payload...)
+	}
+
+	for {
+		s := a.next()
+		if s == nil {
+			return
+		}
+		sections = append(sections, s)
+	}
+}
+
+// next returns the next complete section, or nil.
+func (a *sectionAssembler) next() []byte {
+	s := a.buf
+	if len(s) == 0 || s[0] == 0xff { // Stuffing
+		a.buf = nil
+		return nil
+	}
+	if len(s) < 3 {
+		return nil
+	}
+	n := 3 + (int(s[1]&0x0f)<<8 | int(s[2]))
+	if len(s) < n {
+		return nil
+	}
+	if len(s) > n {
+		a.buf = s[n:]
+	} else {
+		a.buf = nil
+	}
+	return s[:n]
+}
+
+// validSection returns true if the section has the syntax of a PAT or PMT section and a valid CRC.
+func validSection(s []byte) bool {
+	return len(s) >= 12 && mpegcrc.Checksum(s) == 0
+}
+
+// parsePat returns the PMT PIDs of a PAT section, by program number.
+func parsePat(s []byte) map[uint16]uint16 {
+	pmtPIDs := make(map[uint16]uint16)
+	for i := 8; i+4 <= len(s)-4; i += 4 {
+		program := uint16(s[i])<<8 | uint16(s[i+1])
+		pid := uint16(s[i+2]&0x1f)<<8 | uint16(s[i+3])
+		if program != 0 { // Program 0 is the network PID
+			pmtPIDs[program] = pid
+		}
+	}
+	return pmtPIDs
+}
+
+type elementaryStream struct {
+	streamType uint8
+	pid        uint16
+}
+
+// parsePmt returns the PCR PID and the elementary streams of a PMT section.
+func parsePmt(s []byte) (pcrPID uint16, streams []elementaryStream) {
+	pcrPID = uint16(s[8]&0x1f)<<8 | uint16(s[9])
+	i := 12 + (int(s[10]&0x0f)<<8 | int(s[11]))
+	for i+5 <= len(s)-4 {
+		streams = append(streams, elementaryStream{
+			streamType: s[i],
+			pid:        uint16(s[i+1]&0x1f)<<8 | uint16(s[i+2]),
+		})
+		i += 5 + (int(s[i+3]&0x0f)<<8 | int(s[i+4]))
+	}
+	return
+}
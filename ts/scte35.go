@@ -1,59 +1,46 @@
 package ts
 
 import (
-	"fmt"
-	"github.com/Comcast/gots/scte35"
+	"github.com/eluv-io/errors-go"
+
+	"github.com/eluv-io/avpipe/ts/scte35"
 )
 
 // The purpose of this struct is for JSON marshaling with minimal complexity
 type SpliceInfo struct {
 	PID                 uint16                   `json:"pid"`
-	PTS                 uint64                   `json:"pts"`
+	PTS                 uint64                   `json:"pts"`                        // Splice time with pts_adjustment applied
 	ProtocolVersion     uint8                    `json:"protocol_version,omitempty"` // always 0
 	Tier                uint16                   `json:"tier"`
-	EncryptionAlgorithm uint8                    `json:"encryption_algorithm,omitempty"` // not handled
-	CWIndex             uint8                    `json:"cw_index,omitempty"`             // not handled
+	EncryptionAlgorithm uint8                    `json:"encryption_algorithm,omitempty"`
+	CWIndex             uint8                    `json:"cw_index,omitempty"`
 	SpliceCommandType   scte35.SpliceCommandType `json:"splice_command_type"`
 	SpliceDescriptors   []SpliceDescriptor       `json:"splice_descriptors,omitempty"`
-	//SpliceNull          *SpliceNull              `json:"splice_null,omitempty"`
-	//TimeSignal          *TimeSignal              `json:"time_signal,omitempty"`
+	SpliceNull          *scte35.SpliceNull       `json:"splice_null,omitempty"`
+	TimeSignal          *scte35.TimeSignal       `json:"time_signal,omitempty"`
+	SpliceInsert        *scte35.SpliceInsert     `json:"splice_insert,omitempty"`
 }
 
-// unnecessary for now
-//type SpliceNull struct {
-//}
-//
-//type TimeSignal struct {
-//}
-
 type SpliceDescriptor struct {
-	SpliceDescriptorTag uint8 `json:"splice_descriptor_tag"`
-	//SpliceDescriptorName string `json:"splice_descriptor_name"`
+	SpliceDescriptorTag scte35.SpliceDescriptorTag `json:"splice_descriptor_tag"`
 
 	// SegmentationDescriptor fields
-	//
-	// scte35.SegDescType seems to be missing:
-	//   OpeningCreditStart                                   = 36
-	//   OpeningCreditEnd                                     = 37
-	//   ClosingCreditStart                                   = 38
-	//   ClosingCreditEnd                                     = 39
-	//   ProviderOverlayPlacementOpportunityStart             = 56
-	//   ProviderOverlayPlacementOpportunityEnd               = 57
-	//   DistributorOverlayPlacementOpportunityStart          = 58
-	//   DistributorOverlayPlacementOpportunityEnd            = 59
-	SegmentationEventId              uint32                `json:"segmentation_event_id"`
-	SegmentationEventCancelIndicator bool                  `json:"segmentation_event_cancel_indicator"`
-	SegmentationDuration             uint64                `json:"segmentation_duration,omitempty"`
-	SegmentationTypeId               scte35.SegDescType    `json:"segmentation_type_id"`
-	SegmentNum                       uint8                 `json:"segment_num"`
-	SegmentsExpected                 uint8                 `json:"segments_expected"`
-	SubSegmentNum                    uint8                 `json:"sub_segment_num"`
-	SubSegmentsExpected              uint8                 `json:"sub_segments_expected"`
-	DeliveryRestrictions             *DeliveryRestrictions `json:"delivery_restrictions,omitempty"`
-	SegmentationUpids                []SegmentationUpid    `json:"segmentation_upids,omitempty"`
-	Components                       []Component           `json:"components,omitempty"`
-
-	// Not implemnted: AvailDescriptor, DTMFDescriptor, TimeDescriptor, AudioDescriptor
+	SegmentationEventId              uint32                  `json:"segmentation_event_id"`
+	SegmentationEventCancelIndicator bool                    `json:"segmentation_event_cancel_indicator"`
+	SegmentationDuration             uint64                  `json:"segmentation_duration,omitempty"`
+	SegmentationTypeId               scte35.SegmentationType `json:"segmentation_type_id"`
+	SegmentNum                       uint8                   `json:"segment_num"`
+	SegmentsExpected                 uint8                   `json:"segments_expected"`
+	SubSegmentNum                    uint8                   `json:"sub_segment_num"`
+	SubSegmentsExpected              uint8                   `json:"sub_segments_expected"`
+	DeliveryRestrictions             *DeliveryRestrictions   `json:"delivery_restrictions,omitempty"`
+	SegmentationUpids                []SegmentationUpid      `json:"segmentation_upids,omitempty"`
+	Components                       []Component             `json:"components,omitempty"`
+
+	AvailDescriptor *scte35.AvailDescriptor `json:"avail_descriptor,omitempty"`
+	DTMFDescriptor  *scte35.DTMFDescriptor  `json:"dtmf_descriptor,omitempty"`
+	TimeDescriptor  *scte35.TimeDescriptor  `json:"time_descriptor,omitempty"`
+	AudioDescriptor *scte35.AudioDescriptor `json:"audio_descriptor,omitempty"`
 }
 
 type DeliveryRestrictions struct {
@@ -64,9 +51,9 @@ type DeliveryRestrictions struct {
 }
 
 type SegmentationUpid struct {
-	SegmentationUpidType scte35.SegUPIDType `json:"segmentation_upid_type"`
-	FormatIdentifier     uint32             `json:"format_identifier,omitempty"` // not handled
-	Upid                 []byte             `json:"upid,omitempty"`
+	SegmentationUpidType scte35.SegmentationUPIDType `json:"segmentation_upid_type"`
+	FormatIdentifier     uint32                      `json:"format_identifier,omitempty"` // MPU only
+	Upid                 []byte                      `json:"upid,omitempty"`
 }
 
 type Component struct {
@@ -74,73 +61,170 @@ type Component struct {
 	PTSOffset    uint64 `json:"pts_offset"`
 }
 
-// TODO We should parse the SCTE data directly instead of going through layers of gots, which doesn't support JSON marshaling
-func ConvertGots(pid uint16, gsi scte35.SCTE35) (si SpliceInfo, err error) {
+// Convert converts a parsed splice_info_section to the JSON subset. Descriptors with an
+// identifier other than "CUEI" are skipped.
+func Convert(pid uint16, s *scte35.SpliceInfoSection) (si SpliceInfo, err error) {
 	si = SpliceInfo{
-		PID:               pid,
-		SpliceDescriptors: []SpliceDescriptor{},
+		PID:                 pid,
+		ProtocolVersion:     s.ProtocolVersion,
+		Tier:                s.Tier,
+		EncryptionAlgorithm: s.EncryptionAlgorithm,
+		CWIndex:             s.CWIndex,
+		SpliceCommandType:   s.SpliceCommandType,
+		SpliceDescriptors:   []SpliceDescriptor{},
+		SpliceNull:          s.SpliceNull,
+		TimeSignal:          s.TimeSignal,
+		SpliceInsert:        s.SpliceInsert,
 	}
-	si.PTS = uint64(gsi.PTS())
-	si.Tier = gsi.Tier()
-	si.SpliceCommandType = gsi.Command()
-	switch si.SpliceCommandType {
-	case scte35.SpliceNull:
-		//si.SpliceNull = &SpliceNull{}
-	case scte35.TimeSignal:
-		//si.TimeSignal = &TimeSignal{}
-	default:
-		err = fmt.Errorf("SpliceCommandType %d not handled", si.SpliceCommandType)
+	if s.EncryptedPacket {
+		return si, errors.E("ts.Convert", errors.K.Invalid, "reason", "encrypted splice_info_section not handled",
+			"encryption_algorithm", s.EncryptionAlgorithm)
 	}
-	for _, gdesc := range gsi.Descriptors() {
+	si.PTS, _ = s.PTS()
+
+	for _, d := range s.SpliceDescriptors {
+		if d.Identifier != scte35.CUEIdentifier {
+			continue
+		}
 		desc := SpliceDescriptor{
-			//SpliceDescriptorName:           "segmentation_descriptor",
-			SpliceDescriptorTag:              2, // gots only parses SegmentationDescriptors
-			SegmentationEventId:              gdesc.EventID(),
-			SegmentationEventCancelIndicator: gdesc.IsEventCanceled(),
-			SegmentationDuration:             uint64(gdesc.Duration()),
-			SegmentationTypeId:               gdesc.TypeID(),
-			SegmentNum:                       gdesc.SegmentNum(),
-			SegmentsExpected:                 gdesc.SegmentsExpected(),
-			SubSegmentNum:                    gdesc.SubSegmentNumber(),
-			SubSegmentsExpected:              gdesc.SubSegmentsExpected(),
-			SegmentationUpids:                []SegmentationUpid{},
-			Components:                       []Component{},
+			SpliceDescriptorTag: d.SpliceDescriptorTag,
+			AvailDescriptor:     d.AvailDescriptor,
+			DTMFDescriptor:      d.DTMFDescriptor,
+			TimeDescriptor:      d.TimeDescriptor,
+			AudioDescriptor:     d.AudioDescriptor,
 		}
-		if !gdesc.IsDeliveryNotRestricted() {
-			desc.DeliveryRestrictions = &DeliveryRestrictions{
-				WebDeliveryAllowed: gdesc.IsWebDeliveryAllowed(),
-				NoRegionalBlackout: gdesc.HasNoRegionalBlackout(),
-				ArchiveAllowed:     gdesc.IsArchiveAllowed(),
-				DeviceRestrictions: gdesc.DeviceRestrictions(),
+		if sd := d.SegmentationDescriptor; sd != nil {
+			desc.SegmentationEventId = sd.SegmentationEventID
+			desc.SegmentationEventCancelIndicator = sd.SegmentationEventCancelIndicator
+			if sd.SegmentationDuration != nil {
+				desc.SegmentationDuration = *sd.SegmentationDuration
 			}
-		}
-		if gdesc.UPIDType() == scte35.SegUPIDMID {
-			for _, gupid := range gdesc.MID() {
-				upid := make([]byte, len(gupid.UPID()))
-				copy(upid, gupid.UPID())
+			desc.SegmentationTypeId = sd.SegmentationTypeID
+			desc.SegmentNum = sd.SegmentNum
+			desc.SegmentsExpected = sd.SegmentsExpected
+			if sd.SubSegmentNum != nil {
+				desc.SubSegmentNum = *sd.SubSegmentNum
+				desc.SubSegmentsExpected = *sd.SubSegmentsExpected
+			}
+			if dr := sd.DeliveryRestrictions; dr != nil {
+				desc.DeliveryRestrictions = &DeliveryRestrictions{
+					WebDeliveryAllowed: dr.WebDeliveryAllowedFlag,
+					NoRegionalBlackout: dr.NoRegionalBlackoutFlag,
+					ArchiveAllowed:     dr.ArchiveAllowedFlag,
+					DeviceRestrictions: dr.DeviceRestrictions,
+				}
+			}
+			desc.SegmentationUpids = []SegmentationUpid{}
+			for _, u := range sd.SegmentationUPIDs {
 				desc.SegmentationUpids = append(desc.SegmentationUpids, SegmentationUpid{
-					SegmentationUpidType: gupid.UPIDType(),
-					FormatIdentifier:     0,
-					Upid:                 gupid.UPID(),
+					SegmentationUpidType: u.SegmentationUPIDType,
+					FormatIdentifier:     u.FormatIdentifier,
+					Upid:                 u.UPID,
+				})
+			}
+			desc.Components = []Component{}
+			for _, c := range sd.Components {
+				desc.Components = append(desc.Components, Component{
+					ComponentTag: c.ComponentTag,
+					PTSOffset:    c.PTSOffset,
 				})
 			}
-		} else {
-			upid := make([]byte, len(gdesc.UPID()))
-			copy(upid, gdesc.UPID())
-			desc.SegmentationUpids = append(desc.SegmentationUpids, SegmentationUpid{
-				SegmentationUpidType: gdesc.UPIDType(),
-				FormatIdentifier:     0,
-				Upid:                 upid,
-			})
-		}
-		for _, gc := range gdesc.Components() {
-			desc.Components = append(desc.Components, Component{
-				ComponentTag: gc.ComponentTag(),
-				PTSOffset:    uint64(gc.PTSOffset()),
-			})
 		}
 		si.SpliceDescriptors = append(si.SpliceDescriptors, desc)
 	}
 
-	return si, err
+	return si, nil
+}
+
+// Section converts the JSON subset back to a splice_info_section. The sub_segment fields are
+// set for the segmentation types that carry them.
+func (si *SpliceInfo) Section() *scte35.SpliceInfoSection {
+	s := &scte35.SpliceInfoSection{
+		SAPType:             3, // Not specified
+		ProtocolVersion:     si.ProtocolVersion,
+		EncryptionAlgorithm: si.EncryptionAlgorithm,
+		CWIndex:             si.CWIndex,
+		Tier:                si.Tier,
+		SpliceCommandType:   si.SpliceCommandType,
+		SpliceNull:          si.SpliceNull,
+		TimeSignal:          si.TimeSignal,
+		SpliceInsert:        si.SpliceInsert,
+	}
+	if s.SpliceCommandType == scte35.TimeSignalType && s.TimeSignal == nil {
+		s.TimeSignal = &scte35.TimeSignal{SpliceTime: scte35.SpliceTime{TimeSpecifiedFlag: true, PTSTime: si.PTS}}
+	}
+
+	for _, d := range si.SpliceDescriptors {
+		desc := scte35.SpliceDescriptor{
+			SpliceDescriptorTag: d.SpliceDescriptorTag,
+			Identifier:          scte35.CUEIdentifier,
+			AvailDescriptor:     d.AvailDescriptor,
+			DTMFDescriptor:      d.DTMFDescriptor,
+			TimeDescriptor:      d.TimeDescriptor,
+			AudioDescriptor:     d.AudioDescriptor,
+		}
+		if d.SpliceDescriptorTag == scte35.SegmentationDescriptorTag {
+			desc.SegmentationDescriptor = d.segmentationDescriptor()
+		}
+		s.SpliceDescriptors = append(s.SpliceDescriptors, desc)
+	}
+	return s
+}
+
+func (d *SpliceDescriptor) segmentationDescriptor() *scte35.SegmentationDescriptor {
+	sd := &scte35.SegmentationDescriptor{
+		SegmentationEventID:                    d.SegmentationEventId,
+		SegmentationEventCancelIndicator:       d.SegmentationEventCancelIndicator,
+		SegmentationEventIDComplianceIndicator: true,
+	}
+	if sd.SegmentationEventCancelIndicator {
+		return sd
+	}
+
+	sd.ProgramSegmentationFlag = len(d.Components) == 0
+	for _, c := range d.Components {
+		sd.Components = append(sd.Components, scte35.SegmentationComponent{ComponentTag: c.ComponentTag, PTSOffset: c.PTSOffset})
+	}
+	if d.SegmentationDuration > 0 {
+		duration := d.SegmentationDuration
+		sd.SegmentationDuration = &duration
+	}
+	if dr := d.DeliveryRestrictions; dr != nil {
+		sd.DeliveryRestrictions = &scte35.DeliveryRestrictions{
+			WebDeliveryAllowedFlag: dr.WebDeliveryAllowed,
+			NoRegionalBlackoutFlag: dr.NoRegionalBlackout,
+			ArchiveAllowedFlag:     dr.ArchiveAllowed,
+			DeviceRestrictions:     dr.DeviceRestrictions,
+		}
+	}
+	for _, u := range d.SegmentationUpids {
+		sd.SegmentationUPIDs = append(sd.SegmentationUPIDs, scte35.SegmentationUPID{
+			SegmentationUPIDType: u.SegmentationUpidType,
+			FormatIdentifier:     u.FormatIdentifier,
+			UPID:                 u.Upid,
+		})
+	}
+	switch len(sd.SegmentationUPIDs) {
+	case 0:
+		sd.SegmentationUPIDType = scte35.UPIDNotUsed
+	case 1:
+		sd.SegmentationUPIDType = sd.SegmentationUPIDs[0].SegmentationUPIDType
+	default:
+		sd.SegmentationUPIDType = scte35.UPIDMID
+	}
+	sd.SegmentationTypeID = d.SegmentationTypeId
+	sd.SegmentNum = d.SegmentNum
+	sd.SegmentsExpected = d.SegmentsExpected
+	if d.SegmentationTypeId.HasSubSegments() || d.SubSegmentsExpected > 0 {
+		num, expected := d.SubSegmentNum, d.SubSegmentsExpected
+		sd.SubSegmentNum = &num
+		sd.SubSegmentsExpected = &expected
+	}
+	return sd
+}
+
+// Encode encodes the splice info as a splice_info_section with a valid CRC_32, e.g. to be
+// inserted in a live MPEGTS output with avpipe.XcInsertCue.
+func (si *SpliceInfo) Encode() ([]byte, error) {
+	return si.Section().Encode()
 }
@@ -0,0 +1,128 @@
+package scte35
+
+import (
+	"github.com/eluv-io/errors-go"
+)
+
+// bitReader reads big endian bit fields. The first error is kept and reported by error(),
+// reads after an error return 0.
+type bitReader struct {
+	b      []byte
+	pos    int // In bits
+	err    error
+	parent *bitReader
+}
+
+func (r *bitReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	if r.parent != nil {
+		r.parent.fail(err)
+	}
+}
+
+func (r *bitReader) read(n int) (v uint64) {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+n > len(r.b)*8 {
+		r.fail(errors.E("read", errors.K.Invalid, "reason", "section too short", "bits", n, "pos", r.pos))
+		return 0
+	}
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint64(r.b[r.pos>>3]>>(7-r.pos&7))&1
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.read(1) == 1
+}
+
+func (r *bitReader) skip(n int) {
+	r.read(n)
+}
+
+// left returns the number of bytes left.
+func (r *bitReader) left() int {
+	return len(r.b) - (r.pos+7)/8
+}
+
+// bytes returns a copy of the next n bytes. The reader must be byte aligned.
+func (r *bitReader) bytes(n int) []byte {
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	if n > r.left() {
+		r.fail(errors.E("read", errors.K.Invalid, "reason", "section too short", "bytes", n, "pos", r.pos))
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.b[r.pos/8:])
+	r.pos += n * 8
+	return b
+}
+
+// sub returns a reader of the next n bytes and skips them. Errors of the sub reader are also
+// reported by this reader.
+func (r *bitReader) sub(n int) *bitReader {
+	s := &bitReader{parent: r}
+	if r.err != nil {
+		s.err = r.err
+		return s
+	}
+	if n > r.left() {
+		r.fail(errors.E("read", errors.K.Invalid, "reason", "length exceeds section", "bytes", n, "pos", r.pos))
+		s.err = r.err
+		return s
+	}
+	s.b = r.b[r.pos/8 : r.pos/8+n]
+	r.pos += n * 8
+	return s
+}
+
+// at returns a reader positioned at byte pos.
+func (r *bitReader) at(pos int) *bitReader {
+	return &bitReader{b: r.b, pos: pos * 8, parent: r}
+}
+
+func (r *bitReader) error() error {
+	return r.err
+}
+
+// bitWriter writes big endian bit fields.
+type bitWriter struct {
+	b   []byte
+	pos int // In bits
+}
+
+func (w *bitWriter) write(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos&7 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>i&1) << (7 - w.pos&7)
+		w.pos++
+	}
+}
+
+func (w *bitWriter) flag(f bool) {
+	if f {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+}
+
+// reserved writes n reserved bits, set to 1.
+func (w *bitWriter) reserved(n int) {
+	w.write(^uint64(0), n)
+}
+
+// append appends b. The writer must be byte aligned.
+func (w *bitWriter) append(b []byte) {
+	w.b = append(w.b, b...)
+	w.pos += len(b) * 8
+}
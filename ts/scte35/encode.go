@@ -0,0 +1,310 @@
+package scte35
+
+import (
+	"github.com/eluv-io/avpipe/ts/mpegcrc"
+	"github.com/eluv-io/errors-go"
+)
+
+// Encode encodes the splice_info_section, starting at the table_id. The splice_command_type,
+// splice_command_length, descriptor_loop_length and section_length are computed from the
+// command and descriptors, and CRC_32 is recomputed. Reserved bits are set to 1.
+func (s *SpliceInfoSection) Encode() ([]byte, error) {
+	e := errors.Template("scte35.Encode", errors.K.Invalid)
+
+	w := &bitWriter{}
+	w.write(uint64(s.ProtocolVersion), 8)
+	w.flag(s.EncryptedPacket)
+	w.write(uint64(s.EncryptionAlgorithm), 6)
+	w.write(s.PTSAdjustment&PTSMask, 33)
+	w.write(uint64(s.CWIndex), 8)
+	w.write(uint64(s.Tier), 12)
+
+	if s.EncryptedPacket {
+		w.write(0xfff, 12)
+		w.append(s.EncryptedData)
+	} else {
+		cmdType, cmd, err := s.encodeCommand()
+		if err != nil {
+			return nil, e(err)
+		}
+		w.write(uint64(len(cmd)), 12)
+		w.write(uint64(cmdType), 8)
+		w.append(cmd)
+
+		dw := &bitWriter{}
+		for _, d := range s.SpliceDescriptors {
+			if err = d.encode(dw); err != nil {
+				return nil, e(err)
+			}
+		}
+		if len(dw.b) > 0xffff {
+			return nil, e("reason", "descriptor loop too long", "len", len(dw.b))
+		}
+		w.write(uint64(len(dw.b)), 16)
+		w.append(dw.b)
+	}
+
+	sectionLength := len(w.b) + 4
+	if sectionLength > 0xfff-3 {
+		return nil, e("reason", "section too long", "section_length", sectionLength)
+	}
+	b := make([]byte, 3, 3+sectionLength)
+	b[0] = TableID
+	b[1] = s.SAPType<<4&0x30 | byte(sectionLength>>8)
+	b[2] = byte(sectionLength)
+	b = append(b, w.b...)
+	crc := mpegcrc.Checksum(b)
+	b = append(b, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	return b, nil
+}
+
+// encodeCommand returns the type and encoding of the splice command. The command type is
+// taken from the command set, or from SpliceCommandType if none is set.
+func (s *SpliceInfoSection) encodeCommand() (SpliceCommandType, []byte, error) {
+	w := &bitWriter{}
+	t := s.SpliceCommandType
+	switch {
+	case s.SpliceNull != nil:
+		t = SpliceNullType
+	case s.SpliceSchedule != nil:
+		t = SpliceScheduleType
+		encodeSpliceSchedule(w, s.SpliceSchedule)
+	case s.SpliceInsert != nil:
+		t = SpliceInsertType
+		encodeSpliceInsert(w, s.SpliceInsert)
+	case s.TimeSignal != nil:
+		t = TimeSignalType
+		encodeSpliceTime(w, &s.TimeSignal.SpliceTime)
+	case s.BandwidthReservation != nil:
+		t = BandwidthReservationType
+	case s.PrivateCommand != nil:
+		t = PrivateCommandType
+		w.write(uint64(s.PrivateCommand.Identifier), 32)
+		w.append(s.PrivateCommand.PrivateByte)
+	case t == SpliceNullType || t == BandwidthReservationType:
+	default:
+		return t, nil, errors.E("encode splice command", errors.K.Invalid,
+			"reason", "missing splice command", "splice_command_type", t)
+	}
+	if len(w.b) >= 0xfff {
+		return t, nil, errors.E("encode splice command", errors.K.Invalid,
+			"reason", "splice command too long", "len", len(w.b))
+	}
+	return t, w.b, nil
+}
+
+func encodeSpliceTime(w *bitWriter, st *SpliceTime) {
+	w.flag(st.TimeSpecifiedFlag)
+	if st.TimeSpecifiedFlag {
+		w.reserved(6)
+		w.write(st.PTSTime&PTSMask, 33)
+	} else {
+		w.reserved(7)
+	}
+}
+
+func encodeBreakDuration(w *bitWriter, bd *BreakDuration) {
+	w.flag(bd.AutoReturn)
+	w.reserved(6)
+	w.write(bd.Duration&PTSMask, 33)
+}
+
+func encodeSpliceSchedule(w *bitWriter, ss *SpliceSchedule) {
+	w.write(uint64(len(ss.Events)), 8)
+	for _, ev := range ss.Events {
+		w.write(uint64(ev.SpliceEventID), 32)
+		w.flag(ev.SpliceEventCancelIndicator)
+		w.reserved(7)
+		if ev.SpliceEventCancelIndicator {
+			continue
+		}
+		w.flag(ev.OutOfNetworkIndicator)
+		w.flag(ev.ProgramSpliceFlag)
+		w.flag(ev.BreakDuration != nil)
+		w.reserved(5)
+		if ev.ProgramSpliceFlag {
+			w.write(uint64(ev.UTCSpliceTime), 32)
+		} else {
+			w.write(uint64(len(ev.Components)), 8)
+			for _, c := range ev.Components {
+				w.write(uint64(c.ComponentTag), 8)
+				w.write(uint64(c.UTCSpliceTime), 32)
+			}
+		}
+		if ev.BreakDuration != nil {
+			encodeBreakDuration(w, ev.BreakDuration)
+		}
+		w.write(uint64(ev.UniqueProgramID), 16)
+		w.write(uint64(ev.AvailNum), 8)
+		w.write(uint64(ev.AvailsExpected), 8)
+	}
+}
+
+func encodeSpliceInsert(w *bitWriter, si *SpliceInsert) {
+	w.write(uint64(si.SpliceEventID), 32)
+	w.flag(si.SpliceEventCancelIndicator)
+	w.reserved(7)
+	if si.SpliceEventCancelIndicator {
+		return
+	}
+	w.flag(si.OutOfNetworkIndicator)
+	w.flag(si.ProgramSpliceFlag)
+	w.flag(si.BreakDuration != nil)
+	w.flag(si.SpliceImmediateFlag)
+	w.flag(si.EventIDComplianceFlag)
+	w.reserved(3)
+	if si.ProgramSpliceFlag && !si.SpliceImmediateFlag {
+		st := si.SpliceTime
+		if st == nil {
+			st = &SpliceTime{}
+		}
+		encodeSpliceTime(w, st)
+	}
+	if !si.ProgramSpliceFlag {
+		w.write(uint64(len(si.Components)), 8)
+		for _, c := range si.Components {
+			w.write(uint64(c.ComponentTag), 8)
+			if !si.SpliceImmediateFlag {
+				st := c.SpliceTime
+				if st == nil {
+					st = &SpliceTime{}
+				}
+				encodeSpliceTime(w, st)
+			}
+		}
+	}
+	if si.BreakDuration != nil {
+		encodeBreakDuration(w, si.BreakDuration)
+	}
+	w.write(uint64(si.UniqueProgramID), 16)
+	w.write(uint64(si.AvailNum), 8)
+	w.write(uint64(si.AvailsExpected), 8)
+}
+
+func (d *SpliceDescriptor) encode(w *bitWriter) error {
+	dw := &bitWriter{}
+	dw.write(uint64(d.Identifier), 32)
+
+	switch {
+	case d.Identifier != CUEIdentifier:
+		dw.append(d.PrivateByte)
+	case d.AvailDescriptor != nil:
+		dw.write(uint64(d.AvailDescriptor.ProviderAvailID), 32)
+	case d.DTMFDescriptor != nil:
+		if len(d.DTMFDescriptor.DTMFChar) > 7 {
+			return errors.E("encode splice descriptor", errors.K.Invalid,
+				"reason", "too many DTMF chars", "dtmf_char", d.DTMFDescriptor.DTMFChar)
+		}
+		dw.write(uint64(d.DTMFDescriptor.Preroll), 8)
+		dw.write(uint64(len(d.DTMFDescriptor.DTMFChar)), 3)
+		dw.reserved(5)
+		dw.append([]byte(d.DTMFDescriptor.DTMFChar))
+	case d.SegmentationDescriptor != nil:
+		if err := encodeSegmentationDescriptor(dw, d.SegmentationDescriptor); err != nil {
+			return err
+		}
+	case d.TimeDescriptor != nil:
+		dw.write(d.TimeDescriptor.TAISeconds, 48)
+		dw.write(uint64(d.TimeDescriptor.TAINs), 32)
+		dw.write(uint64(d.TimeDescriptor.UTCOffset), 16)
+	case d.AudioDescriptor != nil:
+		dw.write(uint64(len(d.AudioDescriptor.Components)), 4)
+		dw.reserved(4)
+		for _, c := range d.AudioDescriptor.Components {
+			if len(c.ISOCode) != 3 {
+				return errors.E("encode splice descriptor", errors.K.Invalid,
+					"reason", "invalid ISO_code", "iso_code", c.ISOCode)
+			}
+			dw.write(uint64(c.ComponentTag), 8)
+			dw.append([]byte(c.ISOCode))
+			dw.write(uint64(c.BitStreamMode), 3)
+			dw.write(uint64(c.NumChannels), 4)
+			dw.flag(c.FullSrvcAudio)
+		}
+	default:
+		dw.append(d.PrivateByte)
+	}
+
+	if len(dw.b) > 0xff {
+		return errors.E("encode splice descriptor", errors.K.Invalid,
+			"reason", "descriptor too long", "splice_descriptor_tag", d.SpliceDescriptorTag, "len", len(dw.b))
+	}
+	w.write(uint64(d.SpliceDescriptorTag), 8)
+	w.write(uint64(len(dw.b)), 8)
+	w.append(dw.b)
+	return nil
+}
+
+func encodeSegmentationDescriptor(w *bitWriter, sd *SegmentationDescriptor) error {
+	w.write(uint64(sd.SegmentationEventID), 32)
+	w.flag(sd.SegmentationEventCancelIndicator)
+	w.flag(sd.SegmentationEventIDComplianceIndicator)
+	w.reserved(6)
+	if sd.SegmentationEventCancelIndicator {
+		return nil
+	}
+
+	w.flag(sd.ProgramSegmentationFlag)
+	w.flag(sd.SegmentationDuration != nil)
+	w.flag(sd.DeliveryRestrictions == nil)
+	if dr := sd.DeliveryRestrictions; dr != nil {
+		w.flag(dr.WebDeliveryAllowedFlag)
+		w.flag(dr.NoRegionalBlackoutFlag)
+		w.flag(dr.ArchiveAllowedFlag)
+		w.write(uint64(dr.DeviceRestrictions), 2)
+	} else {
+		w.reserved(5)
+	}
+	if !sd.ProgramSegmentationFlag {
+		w.write(uint64(len(sd.Components)), 8)
+		for _, c := range sd.Components {
+			w.write(uint64(c.ComponentTag), 8)
+			w.reserved(7)
+			w.write(c.PTSOffset&PTSMask, 33)
+		}
+	}
+	if sd.SegmentationDuration != nil {
+		w.write(*sd.SegmentationDuration, 40)
+	}
+
+	uw := &bitWriter{}
+	if sd.SegmentationUPIDType == UPIDMID {
+		for _, u := range sd.SegmentationUPIDs {
+			b := encodeUPID(u)
+			if len(b) > 0xff {
+				return errors.E("encode segmentation descriptor", errors.K.Invalid,
+					"reason", "segmentation_upid too long", "len", len(b))
+			}
+			uw.write(uint64(u.SegmentationUPIDType), 8)
+			uw.write(uint64(len(b)), 8)
+			uw.append(b)
+		}
+	} else if len(sd.SegmentationUPIDs) > 0 {
+		uw.append(encodeUPID(sd.SegmentationUPIDs[0]))
+	}
+	if len(uw.b) > 0xff {
+		return errors.E("encode segmentation descriptor", errors.K.Invalid,
+			"reason", "segmentation_upid too long", "len", len(uw.b))
+	}
+	w.write(uint64(sd.SegmentationUPIDType), 8)
+	w.write(uint64(len(uw.b)), 8)
+	w.append(uw.b)
+
+	w.write(uint64(sd.SegmentationTypeID), 8)
+	w.write(uint64(sd.SegmentNum), 8)
+	w.write(uint64(sd.SegmentsExpected), 8)
+	if sd.SubSegmentNum != nil && sd.SubSegmentsExpected != nil {
+		w.write(uint64(*sd.SubSegmentNum), 8)
+		w.write(uint64(*sd.SubSegmentsExpected), 8)
+	}
+	return nil
+}
+
+func encodeUPID(u SegmentationUPID) []byte {
+	if u.SegmentationUPIDType != UPIDMPU {
+		return u.UPID
+	}
+	b := []byte{byte(u.FormatIdentifier >> 24), byte(u.FormatIdentifier >> 16),
+		byte(u.FormatIdentifier >> 8), byte(u.FormatIdentifier)}
+	return append(b, u.UPID...)
+}
@@ -0,0 +1,329 @@
+package scte35
+
+import (
+	"github.com/eluv-io/avpipe/ts/mpegcrc"
+	"github.com/eluv-io/errors-go"
+)
+
+// Parse parses a splice_info_section, starting at the table_id, and verifies its CRC_32.
+// Bytes after the section (e.g. TS packet stuffing) are ignored.
+func Parse(b []byte) (s *SpliceInfoSection, err error) {
+	e := errors.Template("scte35.Parse", errors.K.Invalid)
+
+	if len(b) < 3 {
+		return nil, e("reason", "section too short", "len", len(b))
+	}
+	r := &bitReader{b: b}
+	if tableID := r.read(8); tableID != TableID {
+		return nil, e("reason", "invalid table_id", "table_id", tableID)
+	}
+	if r.flag() || r.flag() {
+		return nil, e("reason", "invalid section_syntax_indicator or private_indicator")
+	}
+	s = &SpliceInfoSection{}
+	s.SAPType = uint8(r.read(2))
+	sectionLength := int(r.read(12))
+	if len(b) < 3+sectionLength || sectionLength < 17 {
+		return nil, e("reason", "invalid section_length", "section_length", sectionLength, "len", len(b))
+	}
+	b = b[:3+sectionLength]
+	if mpegcrc.Checksum(b) != 0 {
+		return nil, e("reason", "CRC_32 mismatch")
+	}
+	r.b = b
+
+	s.ProtocolVersion = uint8(r.read(8))
+	s.EncryptedPacket = r.flag()
+	s.EncryptionAlgorithm = uint8(r.read(6))
+	s.PTSAdjustment = r.read(33)
+	s.CWIndex = uint8(r.read(8))
+	s.Tier = uint16(r.read(12))
+	commandLength := int(r.read(12))
+	s.CRC32 = uint32(r.at(len(b) - 4).read(32))
+
+	if s.EncryptedPacket {
+		s.EncryptedData = r.bytes(len(b) - 4 - r.pos/8)
+		if r.err != nil {
+			return nil, e(r.err)
+		}
+		return s, nil
+	}
+
+	s.SpliceCommandType = SpliceCommandType(r.read(8))
+	if commandLength == 0xfff {
+		// Legacy encoders may not set the length
+		err = s.parseCommand(r)
+	} else {
+		cr := r.sub(commandLength)
+		err = s.parseCommand(cr)
+		if err == nil && cr.err == nil && cr.left() != 0 {
+			err = e("reason", "splice_command_length mismatch", "left", cr.left())
+		}
+	}
+	if err != nil {
+		return nil, e(err)
+	}
+
+	loopLength := int(r.read(16))
+	dr := r.sub(loopLength)
+	for dr.err == nil && dr.left() > 0 {
+		var d SpliceDescriptor
+		if d, err = parseDescriptor(dr); err != nil {
+			return nil, e(err)
+		}
+		s.SpliceDescriptors = append(s.SpliceDescriptors, d)
+	}
+	if err = r.error(); err == nil {
+		err = dr.error()
+	}
+	if err != nil {
+		return nil, e(err)
+	}
+	return s, nil
+}
+
+func (s *SpliceInfoSection) parseCommand(r *bitReader) error {
+	switch s.SpliceCommandType {
+	case SpliceNullType:
+		s.SpliceNull = &SpliceNull{}
+	case SpliceScheduleType:
+		s.SpliceSchedule = parseSpliceSchedule(r)
+	case SpliceInsertType:
+		s.SpliceInsert = parseSpliceInsert(r)
+	case TimeSignalType:
+		s.TimeSignal = &TimeSignal{SpliceTime: parseSpliceTime(r)}
+	case BandwidthReservationType:
+		s.BandwidthReservation = &BandwidthReservation{}
+	case PrivateCommandType:
+		s.PrivateCommand = &PrivateCommand{
+			Identifier:  uint32(r.read(32)),
+			PrivateByte: r.bytes(r.left()),
+		}
+	default:
+		return errors.E("parse splice command", errors.K.Invalid,
+			"reason", "reserved splice_command_type", "splice_command_type", s.SpliceCommandType)
+	}
+	return r.error()
+}
+
+func parseSpliceTime(r *bitReader) (st SpliceTime) {
+	st.TimeSpecifiedFlag = r.flag()
+	if st.TimeSpecifiedFlag {
+		r.skip(6)
+		st.PTSTime = r.read(33)
+	} else {
+		r.skip(7)
+	}
+	return
+}
+
+func parseBreakDuration(r *bitReader) *BreakDuration {
+	bd := &BreakDuration{AutoReturn: r.flag()}
+	r.skip(6)
+	bd.Duration = r.read(33)
+	return bd
+}
+
+func parseSpliceSchedule(r *bitReader) *SpliceSchedule {
+	ss := &SpliceSchedule{}
+	count := int(r.read(8))
+	for i := 0; i < count && r.err == nil; i++ {
+		ev := SpliceScheduleEvent{
+			SpliceEventID:              uint32(r.read(32)),
+			SpliceEventCancelIndicator: r.flag(),
+		}
+		r.skip(7)
+		if !ev.SpliceEventCancelIndicator {
+			ev.OutOfNetworkIndicator = r.flag()
+			ev.ProgramSpliceFlag = r.flag()
+			durationFlag := r.flag()
+			r.skip(5)
+			if ev.ProgramSpliceFlag {
+				ev.UTCSpliceTime = uint32(r.read(32))
+			} else {
+				n := int(r.read(8))
+				for j := 0; j < n && r.err == nil; j++ {
+					ev.Components = append(ev.Components, SpliceScheduleComponent{
+						ComponentTag:  uint8(r.read(8)),
+						UTCSpliceTime: uint32(r.read(32)),
+					})
+				}
+			}
+			if durationFlag {
+				ev.BreakDuration = parseBreakDuration(r)
+			}
+			ev.UniqueProgramID = uint16(r.read(16))
+			ev.AvailNum = uint8(r.read(8))
+			ev.AvailsExpected = uint8(r.read(8))
+		}
+		ss.Events = append(ss.Events, ev)
+	}
+	return ss
+}
+
+func parseSpliceInsert(r *bitReader) *SpliceInsert {
+	si := &SpliceInsert{
+		SpliceEventID:              uint32(r.read(32)),
+		SpliceEventCancelIndicator: r.flag(),
+	}
+	r.skip(7)
+	if si.SpliceEventCancelIndicator {
+		return si
+	}
+	si.OutOfNetworkIndicator = r.flag()
+	si.ProgramSpliceFlag = r.flag()
+	durationFlag := r.flag()
+	si.SpliceImmediateFlag = r.flag()
+	si.EventIDComplianceFlag = r.flag()
+	r.skip(3)
+	if si.ProgramSpliceFlag && !si.SpliceImmediateFlag {
+		st := parseSpliceTime(r)
+		si.SpliceTime = &st
+	}
+	if !si.ProgramSpliceFlag {
+		n := int(r.read(8))
+		for i := 0; i < n && r.err == nil; i++ {
+			c := SpliceInsertComponent{ComponentTag: uint8(r.read(8))}
+			if !si.SpliceImmediateFlag {
+				st := parseSpliceTime(r)
+				c.SpliceTime = &st
+			}
+			si.Components = append(si.Components, c)
+		}
+	}
+	if durationFlag {
+		si.BreakDuration = parseBreakDuration(r)
+	}
+	si.UniqueProgramID = uint16(r.read(16))
+	si.AvailNum = uint8(r.read(8))
+	si.AvailsExpected = uint8(r.read(8))
+	return si
+}
+
+func parseDescriptor(r *bitReader) (d SpliceDescriptor, err error) {
+	d.SpliceDescriptorTag = SpliceDescriptorTag(r.read(8))
+	length := int(r.read(8))
+	dr := r.sub(length)
+	d.Identifier = uint32(dr.read(32))
+	if err = dr.error(); err != nil {
+		return
+	}
+
+	if d.Identifier != CUEIdentifier {
+		d.PrivateByte = dr.bytes(dr.left())
+		return d, dr.error()
+	}
+	switch d.SpliceDescriptorTag {
+	case AvailDescriptorTag:
+		d.AvailDescriptor = &AvailDescriptor{ProviderAvailID: uint32(dr.read(32))}
+	case DTMFDescriptorTag:
+		dtmf := &DTMFDescriptor{Preroll: uint8(dr.read(8))}
+		n := int(dr.read(3))
+		dr.skip(5)
+		dtmf.DTMFChar = string(dr.bytes(n))
+		d.DTMFDescriptor = dtmf
+	case SegmentationDescriptorTag:
+		d.SegmentationDescriptor = parseSegmentationDescriptor(dr)
+	case TimeDescriptorTag:
+		d.TimeDescriptor = &TimeDescriptor{
+			TAISeconds: dr.read(48),
+			TAINs:      uint32(dr.read(32)),
+			UTCOffset:  uint16(dr.read(16)),
+		}
+	case AudioDescriptorTag:
+		ad := &AudioDescriptor{}
+		n := int(dr.read(4))
+		dr.skip(4)
+		for i := 0; i < n && dr.err == nil; i++ {
+			ad.Components = append(ad.Components, AudioComponent{
+				ComponentTag:  uint8(dr.read(8)),
+				ISOCode:       string(dr.bytes(3)),
+				BitStreamMode: uint8(dr.read(3)),
+				NumChannels:   uint8(dr.read(4)),
+				FullSrvcAudio: dr.flag(),
+			})
+		}
+		d.AudioDescriptor = ad
+	default:
+		d.PrivateByte = dr.bytes(dr.left())
+	}
+	if err = dr.error(); err != nil {
+		return
+	}
+	if dr.left() != 0 {
+		err = errors.E("parse splice descriptor", errors.K.Invalid,
+			"reason", "descriptor_length mismatch", "splice_descriptor_tag", d.SpliceDescriptorTag, "left", dr.left())
+	}
+	return
+}
+
+func parseSegmentationDescriptor(r *bitReader) *SegmentationDescriptor {
+	sd := &SegmentationDescriptor{
+		SegmentationEventID:                    uint32(r.read(32)),
+		SegmentationEventCancelIndicator:       r.flag(),
+		SegmentationEventIDComplianceIndicator: r.flag(),
+	}
+	r.skip(6)
+	if sd.SegmentationEventCancelIndicator {
+		return sd
+	}
+
+	sd.ProgramSegmentationFlag = r.flag()
+	durationFlag := r.flag()
+	deliveryNotRestricted := r.flag()
+	if deliveryNotRestricted {
+		r.skip(5)
+	} else {
+		sd.DeliveryRestrictions = &DeliveryRestrictions{
+			WebDeliveryAllowedFlag: r.flag(),
+			NoRegionalBlackoutFlag: r.flag(),
+			ArchiveAllowedFlag:     r.flag(),
+			DeviceRestrictions:     DeviceRestrictions(r.read(2)),
+		}
+	}
+	if !sd.ProgramSegmentationFlag {
+		n := int(r.read(8))
+		for i := 0; i < n && r.err == nil; i++ {
+			c := SegmentationComponent{ComponentTag: uint8(r.read(8))}
+			r.skip(7)
+			c.PTSOffset = r.read(33)
+			sd.Components = append(sd.Components, c)
+		}
+	}
+	if durationFlag {
+		duration := r.read(40)
+		sd.SegmentationDuration = &duration
+	}
+
+	sd.SegmentationUPIDType = SegmentationUPIDType(r.read(8))
+	upidLength := int(r.read(8))
+	ur := r.sub(upidLength)
+	if sd.SegmentationUPIDType == UPIDMID {
+		for ur.err == nil && ur.left() > 0 {
+			t := SegmentationUPIDType(ur.read(8))
+			sd.SegmentationUPIDs = append(sd.SegmentationUPIDs, parseUPID(t, ur.sub(int(ur.read(8)))))
+		}
+	} else if upidLength > 0 {
+		sd.SegmentationUPIDs = append(sd.SegmentationUPIDs, parseUPID(sd.SegmentationUPIDType, ur))
+	}
+
+	sd.SegmentationTypeID = SegmentationType(r.read(8))
+	sd.SegmentNum = uint8(r.read(8))
+	sd.SegmentsExpected = uint8(r.read(8))
+	// Older encoders don't send the sub segment fields, even for the types that have them
+	if r.left() >= 2 {
+		num, expected := uint8(r.read(8)), uint8(r.read(8))
+		sd.SubSegmentNum = &num
+		sd.SubSegmentsExpected = &expected
+	}
+	return sd
+}
+
+func parseUPID(t SegmentationUPIDType, r *bitReader) SegmentationUPID {
+	u := SegmentationUPID{SegmentationUPIDType: t}
+	if t == UPIDMPU {
+		u.FormatIdentifier = uint32(r.read(32))
+	}
+	u.UPID = r.bytes(r.left())
+	return u
+}
@@ -0,0 +1,400 @@
+// Package scte35 parses SCTE-35 splice_info_section (ANSI/SCTE 35 2022).
+// The types are meant for JSON marshaling and use the field names of the spec.
+package scte35
+
+const (
+	TableID       = 0xfc
+	CUEIdentifier = 0x43554549 // "CUEI"
+	PTSMask       = (uint64(1) << 33) - 1
+)
+
+type SpliceCommandType uint8
+
+const (
+	SpliceNullType           SpliceCommandType = 0x00
+	SpliceScheduleType       SpliceCommandType = 0x04
+	SpliceInsertType         SpliceCommandType = 0x05
+	TimeSignalType           SpliceCommandType = 0x06
+	BandwidthReservationType SpliceCommandType = 0x07
+	PrivateCommandType       SpliceCommandType = 0xff
+)
+
+func (t SpliceCommandType) Name() string {
+	switch t {
+	case SpliceNullType:
+		return "splice_null"
+	case SpliceScheduleType:
+		return "splice_schedule"
+	case SpliceInsertType:
+		return "splice_insert"
+	case TimeSignalType:
+		return "time_signal"
+	case BandwidthReservationType:
+		return "bandwidth_reservation"
+	case PrivateCommandType:
+		return "private_command"
+	}
+	return "reserved"
+}
+
+type SpliceDescriptorTag uint8
+
+const (
+	AvailDescriptorTag        SpliceDescriptorTag = 0x00
+	DTMFDescriptorTag         SpliceDescriptorTag = 0x01
+	SegmentationDescriptorTag SpliceDescriptorTag = 0x02
+	TimeDescriptorTag         SpliceDescriptorTag = 0x03
+	AudioDescriptorTag        SpliceDescriptorTag = 0x04
+)
+
+func (t SpliceDescriptorTag) Name() string {
+	switch t {
+	case AvailDescriptorTag:
+		return "avail_descriptor"
+	case DTMFDescriptorTag:
+		return "DTMF_descriptor"
+	case SegmentationDescriptorTag:
+		return "segmentation_descriptor"
+	case TimeDescriptorTag:
+		return "time_descriptor"
+	case AudioDescriptorTag:
+		return "audio_descriptor"
+	}
+	return "reserved"
+}
+
+type SegmentationType uint8
+
+const (
+	NotIndicated                                SegmentationType = 0x00
+	ContentIdentification                       SegmentationType = 0x01
+	CallAdServer                                SegmentationType = 0x02
+	ProgramStart                                SegmentationType = 0x10
+	ProgramEnd                                  SegmentationType = 0x11
+	ProgramEarlyTermination                     SegmentationType = 0x12
+	ProgramBreakaway                            SegmentationType = 0x13
+	ProgramResumption                           SegmentationType = 0x14
+	ProgramRunoverPlanned                       SegmentationType = 0x15
+	ProgramRunoverUnplanned                     SegmentationType = 0x16
+	ProgramOverlapStart                         SegmentationType = 0x17
+	ProgramBlackoutOverride                     SegmentationType = 0x18
+	ProgramJoin                                 SegmentationType = 0x19
+	ChapterStart                                SegmentationType = 0x20
+	ChapterEnd                                  SegmentationType = 0x21
+	BreakStart                                  SegmentationType = 0x22
+	BreakEnd                                    SegmentationType = 0x23
+	OpeningCreditStart                          SegmentationType = 0x24
+	OpeningCreditEnd                            SegmentationType = 0x25
+	ClosingCreditStart                          SegmentationType = 0x26
+	ClosingCreditEnd                            SegmentationType = 0x27
+	ProviderAdvertisementStart                  SegmentationType = 0x30
+	ProviderAdvertisementEnd                    SegmentationType = 0x31
+	DistributorAdvertisementStart               SegmentationType = 0x32
+	DistributorAdvertisementEnd                 SegmentationType = 0x33
+	ProviderPlacementOpportunityStart           SegmentationType = 0x34
+	ProviderPlacementOpportunityEnd             SegmentationType = 0x35
+	DistributorPlacementOpportunityStart        SegmentationType = 0x36
+	DistributorPlacementOpportunityEnd          SegmentationType = 0x37
+	ProviderOverlayPlacementOpportunityStart    SegmentationType = 0x38
+	ProviderOverlayPlacementOpportunityEnd      SegmentationType = 0x39
+	DistributorOverlayPlacementOpportunityStart SegmentationType = 0x3a
+	DistributorOverlayPlacementOpportunityEnd   SegmentationType = 0x3b
+	ProviderPromoStart                          SegmentationType = 0x3c
+	ProviderPromoEnd                            SegmentationType = 0x3d
+	DistributorPromoStart                       SegmentationType = 0x3e
+	DistributorPromoEnd                         SegmentationType = 0x3f
+	UnscheduledEventStart                       SegmentationType = 0x40
+	UnscheduledEventEnd                         SegmentationType = 0x41
+	AlternateContentOpportunityStart            SegmentationType = 0x42
+	AlternateContentOpportunityEnd              SegmentationType = 0x43
+	ProviderAdBlockStart                        SegmentationType = 0x44
+	ProviderAdBlockEnd                          SegmentationType = 0x45
+	DistributorAdBlockStart                     SegmentationType = 0x46
+	DistributorAdBlockEnd                       SegmentationType = 0x47
+	NetworkStart                                SegmentationType = 0x50
+	NetworkEnd                                  SegmentationType = 0x51
+)
+
+var segmentationTypeNames = map[SegmentationType]string{
+	NotIndicated:                                "Not Indicated",
+	ContentIdentification:                       "Content Identification",
+	CallAdServer:                                "Call Ad Server",
+	ProgramStart:                                "Program Start",
+	ProgramEnd:                                  "Program End",
+	ProgramEarlyTermination:                     "Program Early Termination",
+	ProgramBreakaway:                            "Program Breakaway",
+	ProgramResumption:                           "Program Resumption",
+	ProgramRunoverPlanned:                       "Program Runover Planned",
+	ProgramRunoverUnplanned:                     "Program Runover Unplanned",
+	ProgramOverlapStart:                         "Program Overlap Start",
+	ProgramBlackoutOverride:                     "Program Blackout Override",
+	ProgramJoin:                                 "Program Join",
+	ChapterStart:                                "Chapter Start",
+	ChapterEnd:                                  "Chapter End",
+	BreakStart:                                  "Break Start",
+	BreakEnd:                                    "Break End",
+	OpeningCreditStart:                          "Opening Credit Start",
+	OpeningCreditEnd:                            "Opening Credit End",
+	ClosingCreditStart:                          "Closing Credit Start",
+	ClosingCreditEnd:                            "Closing Credit End",
+	ProviderAdvertisementStart:                  "Provider Advertisement Start",
+	ProviderAdvertisementEnd:                    "Provider Advertisement End",
+	DistributorAdvertisementStart:               "Distributor Advertisement Start",
+	DistributorAdvertisementEnd:                 "Distributor Advertisement End",
+	ProviderPlacementOpportunityStart:           "Provider Placement Opportunity Start",
+	ProviderPlacementOpportunityEnd:             "Provider Placement Opportunity End",
+	DistributorPlacementOpportunityStart:        "Distributor Placement Opportunity Start",
+	DistributorPlacementOpportunityEnd:          "Distributor Placement Opportunity End",
+	ProviderOverlayPlacementOpportunityStart:    "Provider Overlay Placement Opportunity Start",
+	ProviderOverlayPlacementOpportunityEnd:      "Provider Overlay Placement Opportunity End",
+	DistributorOverlayPlacementOpportunityStart: "Distributor Overlay Placement Opportunity Start",
+	DistributorOverlayPlacementOpportunityEnd:   "Distributor Overlay Placement Opportunity End",
+	ProviderPromoStart:                          "Provider Promo Start",
+	ProviderPromoEnd:                            "Provider Promo End",
+	DistributorPromoStart:                       "Distributor Promo Start",
+	DistributorPromoEnd:                         "Distributor Promo End",
+	UnscheduledEventStart:                       "Unscheduled Event Start",
+	UnscheduledEventEnd:                         "Unscheduled Event End",
+	AlternateContentOpportunityStart:            "Alternate Content Opportunity Start",
+	AlternateContentOpportunityEnd:              "Alternate Content Opportunity End",
+	ProviderAdBlockStart:                        "Provider Ad Block Start",
+	ProviderAdBlockEnd:                          "Provider Ad Block End",
+	DistributorAdBlockStart:                     "Distributor Ad Block Start",
+	DistributorAdBlockEnd:                       "Distributor Ad Block End",
+	NetworkStart:                                "Network Start",
+	NetworkEnd:                                  "Network End",
+}
+
+func (t SegmentationType) Name() string {
+	if name, ok := segmentationTypeNames[t]; ok {
+		return name
+	}
+	return "Reserved"
+}
+
+// HasSubSegments returns true if the segmentation type can carry sub_segment_num and sub_segments_expected
+func (t SegmentationType) HasSubSegments() bool {
+	switch t {
+	case ProviderAdvertisementStart, DistributorAdvertisementStart,
+		ProviderPlacementOpportunityStart, DistributorPlacementOpportunityStart,
+		ProviderOverlayPlacementOpportunityStart, DistributorOverlayPlacementOpportunityStart,
+		ProviderAdBlockStart, DistributorAdBlockStart:
+		return true
+	}
+	return false
+}
+
+type SegmentationUPIDType uint8
+
+const (
+	UPIDNotUsed        SegmentationUPIDType = 0x00
+	UPIDUserDefined    SegmentationUPIDType = 0x01 // Deprecated
+	UPIDISCI           SegmentationUPIDType = 0x02 // Deprecated
+	UPIDAdID           SegmentationUPIDType = 0x03
+	UPIDUMID           SegmentationUPIDType = 0x04
+	UPIDISANDeprecated SegmentationUPIDType = 0x05
+	UPIDISAN           SegmentationUPIDType = 0x06
+	UPIDTID            SegmentationUPIDType = 0x07
+	UPIDTI             SegmentationUPIDType = 0x08
+	UPIDADI            SegmentationUPIDType = 0x09
+	UPIDEIDR           SegmentationUPIDType = 0x0a
+	UPIDATSC           SegmentationUPIDType = 0x0b
+	UPIDMPU            SegmentationUPIDType = 0x0c
+	UPIDMID            SegmentationUPIDType = 0x0d
+	UPIDADS            SegmentationUPIDType = 0x0e
+	UPIDURI            SegmentationUPIDType = 0x0f
+	UPIDUUID           SegmentationUPIDType = 0x10
+	UPIDSCR            SegmentationUPIDType = 0x11
+)
+
+type DeviceRestrictions uint8
+
+const (
+	RestrictGroup0 DeviceRestrictions = 0x00
+	RestrictGroup1 DeviceRestrictions = 0x01
+	RestrictGroup2 DeviceRestrictions = 0x02
+	RestrictNone   DeviceRestrictions = 0x03
+)
+
+// SpliceInfoSection is a splice_info_section(). Exactly one of the splice command fields is set,
+// according to SpliceCommandType, unless the packet is encrypted. For encrypted packets the
+// encrypted part (splice command, descriptors, alignment stuffing and E_CRC_32) is in EncryptedData.
+type SpliceInfoSection struct {
+	SAPType             uint8             `json:"sap_type"`
+	ProtocolVersion     uint8             `json:"protocol_version"`
+	EncryptedPacket     bool              `json:"encrypted_packet"`
+	EncryptionAlgorithm uint8             `json:"encryption_algorithm"`
+	PTSAdjustment       uint64            `json:"pts_adjustment"`
+	CWIndex             uint8             `json:"cw_index"`
+	Tier                uint16            `json:"tier"`
+	SpliceCommandType   SpliceCommandType `json:"splice_command_type"`
+
+	SpliceNull           *SpliceNull           `json:"splice_null,omitempty"`
+	SpliceSchedule       *SpliceSchedule       `json:"splice_schedule,omitempty"`
+	SpliceInsert         *SpliceInsert         `json:"splice_insert,omitempty"`
+	TimeSignal           *TimeSignal           `json:"time_signal,omitempty"`
+	BandwidthReservation *BandwidthReservation `json:"bandwidth_reservation,omitempty"`
+	PrivateCommand       *PrivateCommand       `json:"private_command,omitempty"`
+
+	SpliceDescriptors []SpliceDescriptor `json:"splice_descriptors,omitempty"`
+	EncryptedData     []byte             `json:"encrypted_data,omitempty"`
+	CRC32             uint32             `json:"crc_32"`
+}
+
+// PTS returns the splice time of a time_signal or program splice_insert, with pts_adjustment applied.
+func (s *SpliceInfoSection) PTS() (pts uint64, ok bool) {
+	var st *SpliceTime
+	switch {
+	case s.TimeSignal != nil:
+		st = &s.TimeSignal.SpliceTime
+	case s.SpliceInsert != nil:
+		st = s.SpliceInsert.SpliceTime
+	}
+	if st == nil || !st.TimeSpecifiedFlag {
+		return 0, false
+	}
+	return (st.PTSTime + s.PTSAdjustment) & PTSMask, true
+}
+
+type SpliceTime struct {
+	TimeSpecifiedFlag bool   `json:"time_specified_flag"`
+	PTSTime           uint64 `json:"pts_time,omitempty"`
+}
+
+type BreakDuration struct {
+	AutoReturn bool   `json:"auto_return"`
+	Duration   uint64 `json:"duration"`
+}
+
+type SpliceNull struct {
+}
+
+type SpliceSchedule struct {
+	Events []SpliceScheduleEvent `json:"events"`
+}
+
+type SpliceScheduleEvent struct {
+	SpliceEventID              uint32                    `json:"splice_event_id"`
+	SpliceEventCancelIndicator bool                      `json:"splice_event_cancel_indicator"`
+	OutOfNetworkIndicator      bool                      `json:"out_of_network_indicator,omitempty"`
+	ProgramSpliceFlag          bool                      `json:"program_splice_flag,omitempty"`
+	UTCSpliceTime              uint32                    `json:"utc_splice_time,omitempty"`
+	Components                 []SpliceScheduleComponent `json:"components,omitempty"`
+	BreakDuration              *BreakDuration            `json:"break_duration,omitempty"`
+	UniqueProgramID            uint16                    `json:"unique_program_id,omitempty"`
+	AvailNum                   uint8                     `json:"avail_num,omitempty"`
+	AvailsExpected             uint8                     `json:"avails_expected,omitempty"`
+}
+
+type SpliceScheduleComponent struct {
+	ComponentTag  uint8  `json:"component_tag"`
+	UTCSpliceTime uint32 `json:"utc_splice_time"`
+}
+
+type SpliceInsert struct {
+	SpliceEventID              uint32                  `json:"splice_event_id"`
+	SpliceEventCancelIndicator bool                    `json:"splice_event_cancel_indicator"`
+	OutOfNetworkIndicator      bool                    `json:"out_of_network_indicator,omitempty"`
+	ProgramSpliceFlag          bool                    `json:"program_splice_flag,omitempty"`
+	SpliceImmediateFlag        bool                    `json:"splice_immediate_flag,omitempty"`
+	EventIDComplianceFlag      bool                    `json:"event_id_compliance_flag,omitempty"`
+	SpliceTime                 *SpliceTime             `json:"splice_time,omitempty"` // Program splice, not immediate
+	Components                 []SpliceInsertComponent `json:"components,omitempty"`
+	BreakDuration              *BreakDuration          `json:"break_duration,omitempty"`
+	UniqueProgramID            uint16                  `json:"unique_program_id,omitempty"`
+	AvailNum                   uint8                   `json:"avail_num,omitempty"`
+	AvailsExpected             uint8                   `json:"avails_expected,omitempty"`
+}
+
+type SpliceInsertComponent struct {
+	ComponentTag uint8       `json:"component_tag"`
+	SpliceTime   *SpliceTime `json:"splice_time,omitempty"` // Not immediate
+}
+
+type TimeSignal struct {
+	SpliceTime SpliceTime `json:"splice_time"`
+}
+
+type BandwidthReservation struct {
+}
+
+type PrivateCommand struct {
+	Identifier  uint32 `json:"identifier"`
+	PrivateByte []byte `json:"private_byte,omitempty"`
+}
+
+// SpliceDescriptor is a splice_descriptor(). The field matching the tag is set if the identifier is
+// "CUEI", otherwise (or for reserved tags) the descriptor content is in PrivateByte.
+type SpliceDescriptor struct {
+	SpliceDescriptorTag SpliceDescriptorTag `json:"splice_descriptor_tag"`
+	Identifier          uint32              `json:"identifier"`
+
+	AvailDescriptor        *AvailDescriptor        `json:"avail_descriptor,omitempty"`
+	DTMFDescriptor         *DTMFDescriptor         `json:"dtmf_descriptor,omitempty"`
+	SegmentationDescriptor *SegmentationDescriptor `json:"segmentation_descriptor,omitempty"`
+	TimeDescriptor         *TimeDescriptor         `json:"time_descriptor,omitempty"`
+	AudioDescriptor        *AudioDescriptor        `json:"audio_descriptor,omitempty"`
+	PrivateByte            []byte                  `json:"private_byte,omitempty"`
+}
+
+type AvailDescriptor struct {
+	ProviderAvailID uint32 `json:"provider_avail_id"`
+}
+
+type DTMFDescriptor struct {
+	Preroll  uint8  `json:"preroll"`
+	DTMFChar string `json:"dtmf_char"`
+}
+
+type SegmentationDescriptor struct {
+	SegmentationEventID                    uint32                  `json:"segmentation_event_id"`
+	SegmentationEventCancelIndicator       bool                    `json:"segmentation_event_cancel_indicator"`
+	SegmentationEventIDComplianceIndicator bool                    `json:"segmentation_event_id_compliance_indicator,omitempty"`
+	ProgramSegmentationFlag                bool                    `json:"program_segmentation_flag,omitempty"`
+	DeliveryRestrictions                   *DeliveryRestrictions   `json:"delivery_restrictions,omitempty"` // nil if delivery_not_restricted_flag
+	Components                             []SegmentationComponent `json:"components,omitempty"`
+	SegmentationDuration                   *uint64                 `json:"segmentation_duration,omitempty"` // nil if no segmentation_duration_flag
+	SegmentationUPIDType                   SegmentationUPIDType    `json:"segmentation_upid_type"`
+	SegmentationUPIDs                      []SegmentationUPID      `json:"segmentation_upids,omitempty"` // More than one for MID
+	SegmentationTypeID                     SegmentationType        `json:"segmentation_type_id"`
+	SegmentNum                             uint8                   `json:"segment_num"`
+	SegmentsExpected                       uint8                   `json:"segments_expected"`
+	SubSegmentNum                          *uint8                  `json:"sub_segment_num,omitempty"` // Only present for some types
+	SubSegmentsExpected                    *uint8                  `json:"sub_segments_expected,omitempty"`
+}
+
+type DeliveryRestrictions struct {
+	WebDeliveryAllowedFlag bool               `json:"web_delivery_allowed_flag"`
+	NoRegionalBlackoutFlag bool               `json:"no_regional_blackout_flag"`
+	ArchiveAllowedFlag     bool               `json:"archive_allowed_flag"`
+	DeviceRestrictions     DeviceRestrictions `json:"device_restrictions"`
+}
+
+type SegmentationComponent struct {
+	ComponentTag uint8  `json:"component_tag"`
+	PTSOffset    uint64 `json:"pts_offset"`
+}
+
+type SegmentationUPID struct {
+	SegmentationUPIDType SegmentationUPIDType `json:"segmentation_upid_type"`
+	FormatIdentifier     uint32               `json:"format_identifier,omitempty"` // MPU only
+	UPID                 []byte               `json:"upid,omitempty"`
+}
+
+type TimeDescriptor struct {
+	TAISeconds uint64 `json:"tai_seconds"`
+	TAINs      uint32 `json:"tai_ns"`
+	UTCOffset  uint16 `json:"utc_offset"`
+}
+
+type AudioDescriptor struct {
+	Components []AudioComponent `json:"components"`
+}
+
+type AudioComponent struct {
+	ComponentTag  uint8  `json:"component_tag"`
+	ISOCode       string `json:"iso_code"`
+	BitStreamMode uint8  `json:"bit_stream_mode"`
+	NumChannels   uint8  `json:"num_channels"`
+	FullSrvcAudio bool   `json:"full_srvc_audio"`
+}
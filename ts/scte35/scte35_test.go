@@ -0,0 +1,442 @@
+package scte35
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/eluv-io/avpipe/ts/mpegcrc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// section builds a splice_info_section with pts_adjustment 0, cw_index 0xff and tier 0xfff
+func section(cmdType byte, cmd []byte, desc []byte) []byte {
+	n := 1 + 5 + 1 + 3 + 1 + len(cmd) + 2 + len(desc) + 4
+	b := []byte{TableID, 0x30 | byte(n>>8), byte(n), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff,
+		0xff, 0xf0 | byte(len(cmd)>>8), byte(len(cmd)), cmdType}
+	b = append(b, cmd...)
+	b = append(b, byte(len(desc)>>8), byte(len(desc)))
+	b = append(b, desc...)
+	crc := mpegcrc.Checksum(b)
+	return append(b, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func descriptor(tag byte, body string) []byte {
+	b, err := hex.DecodeString("43554549" + body)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{tag, byte(len(b))}, b...)
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Examples from ANSI/SCTE 35 section 14
+func TestParseSpecExamples(t *testing.T) {
+	tests := []struct {
+		name     string
+		b64      string
+		cmdType  SpliceCommandType
+		pts      uint64
+		segTypes []SegmentationType
+		crc      uint32
+	}{
+		{
+			name:     "time_signal placement opportunity start",
+			b64:      "/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg==",
+			cmdType:  TimeSignalType,
+			pts:      0x072bd0050,
+			segTypes: []SegmentationType{ProviderPlacementOpportunityStart},
+			crc:      0x9ac9d17e,
+		},
+		{
+			name:    "splice_insert",
+			b64:     "/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo=",
+			cmdType: SpliceInsertType,
+			pts:     0x07369c02e,
+			crc:     0x62dba30a,
+		},
+		{
+			name:     "time_signal placement opportunity end",
+			b64:      "/DAvAAAAAAAA///wBQb+dGKQoAAZAhdDVUVJSAAAjn+fCAgAAAAALKChijUCAKnMZ1g=",
+			cmdType:  TimeSignalType,
+			pts:      0x0746290a0,
+			segTypes: []SegmentationType{ProviderPlacementOpportunityEnd},
+			crc:      0xa9cc6758,
+		},
+		{
+			name:     "time_signal program start/end",
+			b64:      "/DBIAAAAAAAA///wBQb+ek2ItgAyAhdDVUVJSAAAGH+fCAgAAAAALMvDRBEAAAIXQ1VFSUgAABl/nwgIAAAAACyk26AQAACZcuND",
+			cmdType:  TimeSignalType,
+			pts:      0x07a4d88b6,
+			segTypes: []SegmentationType{ProgramEnd, ProgramStart},
+			crc:      0x9972e343,
+		},
+		{
+			name:     "time_signal program overlap start",
+			b64:      "/DAvAAAAAAAA///wBQb+rr//ZAAZAhdDVUVJSAAACH+fCAgAAAAALKVs9RcAAJUdsKg=",
+			cmdType:  TimeSignalType,
+			pts:      0x0aebfff64,
+			segTypes: []SegmentationType{ProgramOverlapStart},
+			crc:      0x951db0a8,
+		},
+		{
+			name:     "time_signal program blackout override/program end",
+			b64:      "/DBIAAAAAAAA///wBQb+ky44CwAyAhdDVUVJSAAACn+fCAgAAAAALKCh4xgAAAIXQ1VFSUgAAAl/nwgIAAAAACygoYoRAAC0IX6w",
+			cmdType:  TimeSignalType,
+			pts:      0x0932e380b,
+			segTypes: []SegmentationType{ProgramBlackoutOverride, ProgramEnd},
+			crc:      0xb4217eb0,
+		},
+		{
+			name:     "time_signal program end",
+			b64:      "/DAvAAAAAAAA///wBQb+rvF8TAAZAhdDVUVJSAAAB3+fCAgAAAAALKVslxEAAMSHai4=",
+			cmdType:  TimeSignalType,
+			pts:      0x0aef17c4c,
+			segTypes: []SegmentationType{ProgramEnd},
+			crc:      0xc4876a2e,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := base64.StdEncoding.DecodeString(test.b64)
+			require.NoError(t, err)
+			s, err := Parse(b)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.cmdType, s.SpliceCommandType)
+			pts, ok := s.PTS()
+			assert.True(t, ok)
+			assert.Equal(t, test.pts, pts)
+			assert.Equal(t, uint16(0xfff), s.Tier)
+			assert.Equal(t, test.crc, s.CRC32)
+
+			var segTypes []SegmentationType
+			for _, d := range s.SpliceDescriptors {
+				assert.Equal(t, uint32(CUEIdentifier), d.Identifier)
+				if d.SegmentationDescriptor != nil {
+					segTypes = append(segTypes, d.SegmentationDescriptor.SegmentationTypeID)
+				}
+			}
+			assert.Equal(t, test.segTypes, segTypes)
+		})
+	}
+}
+
+func TestParseSpliceInsert(t *testing.T) {
+	b, _ := base64.StdEncoding.DecodeString("/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo=")
+	s, err := Parse(b)
+	require.NoError(t, err)
+
+	si := s.SpliceInsert
+	require.NotNil(t, si)
+	assert.Equal(t, uint32(0x4800008f), si.SpliceEventID)
+	assert.True(t, si.OutOfNetworkIndicator)
+	assert.True(t, si.ProgramSpliceFlag)
+	assert.False(t, si.SpliceImmediateFlag)
+	assert.Equal(t, &BreakDuration{AutoReturn: true, Duration: 0x00052ccf5}, si.BreakDuration)
+
+	require.Len(t, s.SpliceDescriptors, 1)
+	assert.Equal(t, AvailDescriptorTag, s.SpliceDescriptors[0].SpliceDescriptorTag)
+	assert.Equal(t, &AvailDescriptor{ProviderAvailID: 0x135}, s.SpliceDescriptors[0].AvailDescriptor)
+}
+
+func TestParseSegmentationDescriptor(t *testing.T) {
+	b, _ := base64.StdEncoding.DecodeString("/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg==")
+	s, err := Parse(b)
+	require.NoError(t, err)
+
+	sd := s.SpliceDescriptors[0].SegmentationDescriptor
+	require.NotNil(t, sd)
+	assert.Equal(t, uint32(0x4800008e), sd.SegmentationEventID)
+	assert.True(t, sd.ProgramSegmentationFlag)
+	require.NotNil(t, sd.SegmentationDuration)
+	assert.Equal(t, uint64(0x0001a599b0), *sd.SegmentationDuration)
+	assert.Equal(t, &DeliveryRestrictions{NoRegionalBlackoutFlag: true, ArchiveAllowedFlag: true, DeviceRestrictions: RestrictNone},
+		sd.DeliveryRestrictions)
+	assert.Equal(t, UPIDTI, sd.SegmentationUPIDType)
+	assert.Equal(t, []SegmentationUPID{{SegmentationUPIDType: UPIDTI, UPID: mustHex("000000002ca0a18a")}}, sd.SegmentationUPIDs)
+	assert.Equal(t, uint8(2), sd.SegmentNum)
+	// The example predates sub_segment_num
+	assert.Nil(t, sd.SubSegmentNum)
+
+	// Component mode, MID UPID with an MPU and sub segments
+	desc := descriptor(2, "00000001"+"7f"+"3f"+"02"+"01fe00000005"+"02fe0000000a"+
+		"0d"+"13"+"0303"+"414243"+"0c0c"+"12345678"+"0102030405060708"+
+		"36"+"01"+"02"+"03"+"04")
+	s, err = Parse(section(byte(TimeSignalType), mustHex("7f"), desc))
+	require.NoError(t, err)
+	pts, ok := s.PTS()
+	assert.False(t, ok)
+	assert.Equal(t, uint64(0), pts)
+	sd = s.SpliceDescriptors[0].SegmentationDescriptor
+	require.NotNil(t, sd)
+	assert.False(t, sd.ProgramSegmentationFlag)
+	assert.Nil(t, sd.SegmentationDuration)
+	assert.Nil(t, sd.DeliveryRestrictions)
+	assert.Equal(t, []SegmentationComponent{{ComponentTag: 1, PTSOffset: 5}, {ComponentTag: 2, PTSOffset: 10}}, sd.Components)
+	assert.Equal(t, UPIDMID, sd.SegmentationUPIDType)
+	assert.Equal(t, []SegmentationUPID{
+		{SegmentationUPIDType: UPIDAdID, UPID: []byte("ABC")},
+		{SegmentationUPIDType: UPIDMPU, FormatIdentifier: 0x12345678, UPID: mustHex("0102030405060708")},
+	}, sd.SegmentationUPIDs)
+	assert.Equal(t, DistributorPlacementOpportunityStart, sd.SegmentationTypeID)
+	assert.Equal(t, "Distributor Placement Opportunity Start", sd.SegmentationTypeID.Name())
+	require.NotNil(t, sd.SubSegmentNum)
+	assert.Equal(t, uint8(3), *sd.SubSegmentNum)
+	assert.Equal(t, uint8(4), *sd.SubSegmentsExpected)
+
+	// Cancel
+	s, err = Parse(section(byte(TimeSignalType), mustHex("7f"), descriptor(2, "00000002ff")))
+	require.NoError(t, err)
+	assert.Equal(t, &SegmentationDescriptor{
+		SegmentationEventID:                    2,
+		SegmentationEventCancelIndicator:       true,
+		SegmentationEventIDComplianceIndicator: true,
+	}, s.SpliceDescriptors[0].SegmentationDescriptor)
+}
+
+func TestParseDescriptors(t *testing.T) {
+	var desc []byte
+	desc = append(desc, descriptor(1, "0a"+"5f"+"3132")...)                           // DTMF "12"
+	desc = append(desc, descriptor(3, "000061234567"+"00001000"+"0025")...)           // Time
+	desc = append(desc, descriptor(4, "2f"+"01"+"656e67"+"55"+"02"+"737061"+"f1")...) // Audio
+	desc = append(desc, []byte{0xf0, 0x06, 'A', 'B', 'C', 'D', 0x01, 0x02}...)        // Private
+	desc = append(desc, descriptor(0x10, "aabb")...)                                  // Reserved tag
+
+	s, err := Parse(section(byte(SpliceNullType), nil, desc))
+	require.NoError(t, err)
+	assert.NotNil(t, s.SpliceNull)
+	require.Len(t, s.SpliceDescriptors, 5)
+
+	assert.Equal(t, &DTMFDescriptor{Preroll: 10, DTMFChar: "12"}, s.SpliceDescriptors[0].DTMFDescriptor)
+	assert.Equal(t, &TimeDescriptor{TAISeconds: 0x61234567, TAINs: 0x1000, UTCOffset: 37}, s.SpliceDescriptors[1].TimeDescriptor)
+	assert.Equal(t, &AudioDescriptor{Components: []AudioComponent{
+		{ComponentTag: 1, ISOCode: "eng", BitStreamMode: 2, NumChannels: 10, FullSrvcAudio: true},
+		{ComponentTag: 2, ISOCode: "spa", BitStreamMode: 7, NumChannels: 8, FullSrvcAudio: true},
+	}}, s.SpliceDescriptors[2].AudioDescriptor)
+	assert.Equal(t, SpliceDescriptor{SpliceDescriptorTag: 0xf0, Identifier: 0x41424344, PrivateByte: []byte{1, 2}},
+		s.SpliceDescriptors[3])
+	assert.Equal(t, []byte{0xaa, 0xbb}, s.SpliceDescriptors[4].PrivateByte)
+}
+
+func TestParseCommands(t *testing.T) {
+	// splice_schedule with a program and a component event
+	s, err := Parse(section(byte(SpliceScheduleType), mustHex("02"+
+		"00000001"+"7f"+"ff"+"5f000000"+"fe00002710"+"0001"+"01"+"02"+
+		"00000002"+"7f"+"1f"+"01"+"03"+"5f000010"+"0002"+"00"+"00"), nil))
+	require.NoError(t, err)
+	require.NotNil(t, s.SpliceSchedule)
+	assert.Equal(t, []SpliceScheduleEvent{
+		{
+			SpliceEventID:         1,
+			OutOfNetworkIndicator: true,
+			ProgramSpliceFlag:     true,
+			UTCSpliceTime:         0x5f000000,
+			BreakDuration:         &BreakDuration{AutoReturn: true, Duration: 10000},
+			UniqueProgramID:       1,
+			AvailNum:              1,
+			AvailsExpected:        2,
+		},
+		{
+			SpliceEventID:   2,
+			Components:      []SpliceScheduleComponent{{ComponentTag: 3, UTCSpliceTime: 0x5f000010}},
+			UniqueProgramID: 2,
+		},
+	}, s.SpliceSchedule.Events)
+
+	// splice_insert component mode
+	s, err = Parse(section(byte(SpliceInsertType), mustHex("00000003"+"7f"+"0f"+"02"+"01fe00000100"+"027f"+"0003"+"00"+"00"), nil))
+	require.NoError(t, err)
+	assert.Equal(t, []SpliceInsertComponent{
+		{ComponentTag: 1, SpliceTime: &SpliceTime{TimeSpecifiedFlag: true, PTSTime: 0x100}},
+		{ComponentTag: 2, SpliceTime: &SpliceTime{}},
+	}, s.SpliceInsert.Components)
+	_, ok := s.PTS()
+	assert.False(t, ok)
+
+	// splice_insert cancel
+	s, err = Parse(section(byte(SpliceInsertType), mustHex("00000004"+"ff"), nil))
+	require.NoError(t, err)
+	assert.Equal(t, &SpliceInsert{SpliceEventID: 4, SpliceEventCancelIndicator: true}, s.SpliceInsert)
+
+	s, err = Parse(section(byte(BandwidthReservationType), nil, nil))
+	require.NoError(t, err)
+	assert.NotNil(t, s.BandwidthReservation)
+
+	s, err = Parse(section(byte(PrivateCommandType), mustHex("41424344"+"010203"), nil))
+	require.NoError(t, err)
+	assert.Equal(t, &PrivateCommand{Identifier: 0x41424344, PrivateByte: []byte{1, 2, 3}}, s.PrivateCommand)
+}
+
+func TestParsePTSAdjustment(t *testing.T) {
+	b := section(byte(TimeSignalType), mustHex("ffffffffff"), nil)
+	b[4] = 0x01 // pts_adjustment = 1<<32 + 0x10
+	b[8] = 0x10
+	crc := mpegcrc.Checksum(b[:len(b)-4])
+	b[len(b)-4], b[len(b)-3], b[len(b)-2], b[len(b)-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+
+	s, err := Parse(b)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1)<<32+0x10, s.PTSAdjustment)
+	pts, ok := s.PTS()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1)<<32+0x10-1, pts) // Wraps around 33 bits
+}
+
+func TestParseEncrypted(t *testing.T) {
+	b := section(byte(TimeSignalType), mustHex("7f"), nil)
+	b[4] = 0x80 | 0x02<<1 // encrypted_packet, encryption_algorithm DES-CBC
+	crc := mpegcrc.Checksum(b[:len(b)-4])
+	b[len(b)-4], b[len(b)-3], b[len(b)-2], b[len(b)-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+
+	s, err := Parse(b)
+	require.NoError(t, err)
+	assert.True(t, s.EncryptedPacket)
+	assert.Equal(t, uint8(2), s.EncryptionAlgorithm)
+	assert.Nil(t, s.TimeSignal)
+	assert.Equal(t, []byte{0x06, 0x7f, 0x00, 0x00}, s.EncryptedData)
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := section(byte(TimeSignalType), mustHex("fe00000100"), descriptor(0, "00000001"))
+	_, err := Parse(valid)
+	require.NoError(t, err)
+
+	badCRC := append([]byte{}, valid...)
+	badCRC[len(badCRC)-1] ^= 0x01
+	badTable := append([]byte{}, valid...)
+	badTable[0] = 0x02
+
+	tests := map[string][]byte{
+		"empty":              nil,
+		"table_id":           badTable,
+		"CRC":                badCRC,
+		"truncated":          valid[:len(valid)-1],
+		"command length":     section(byte(TimeSignalType), mustHex("fe0000010000"), nil),
+		"command too short":  section(byte(SpliceInsertType), mustHex("000000017f"), nil),
+		"reserved command":   section(0x01, nil, nil),
+		"descriptor length":  section(byte(SpliceNullType), nil, descriptor(0, "0000000100")),
+		"descriptor overrun": section(byte(SpliceNullType), nil, []byte{0x00, 0x08, 'C', 'U', 'E', 'I'}),
+	}
+	for name, b := range tests {
+		_, err = Parse(b)
+		assert.Error(t, err, name)
+	}
+
+	// Stuffing after the section is ignored
+	_, err = Parse(append(append([]byte{}, valid...), 0xff, 0xff))
+	assert.NoError(t, err)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	sections := [][]byte{
+		section(byte(TimeSignalType), mustHex("7f"), descriptor(2, "00000001"+"7f"+"3f"+"01"+"01fe00000005"+
+			"0d"+"05"+"0303"+"414243"+"36"+"01"+"02"+"03"+"04")),
+		section(byte(SpliceNullType), nil, descriptor(4, "1f"+"01"+"656e67"+"55")),
+	}
+	b, _ := base64.StdEncoding.DecodeString("/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo=")
+	sections = append(sections, b)
+
+	for _, b := range sections {
+		s, err := Parse(b)
+		require.NoError(t, err)
+		j, err := json.Marshal(s)
+		require.NoError(t, err)
+		var s2 SpliceInfoSection
+		require.NoError(t, json.Unmarshal(j, &s2))
+		assert.Equal(t, s, &s2)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	var sections [][]byte
+	for _, b64 := range []string{
+		"/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg==",
+		"/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo=",
+		"/DBIAAAAAAAA///wBQb+ek2ItgAyAhdDVUVJSAAAGH+fCAgAAAAALMvDRBEAAAIXQ1VFSUgAABl/nwgIAAAAACyk26AQAACZcuND",
+	} {
+		b, err := base64.StdEncoding.DecodeString(b64)
+		require.NoError(t, err)
+		sections = append(sections, b)
+	}
+	var desc []byte
+	desc = append(desc, descriptor(1, "0a"+"5f"+"3132")...)
+	desc = append(desc, descriptor(3, "000061234567"+"00001000"+"0025")...)
+	desc = append(desc, descriptor(4, "2f"+"01"+"656e67"+"55"+"02"+"737061"+"f1")...)
+	desc = append(desc, []byte{0xf0, 0x06, 'A', 'B', 'C', 'D', 0x01, 0x02}...)
+	desc = append(desc, descriptor(0x10, "aabb")...)
+	sections = append(sections,
+		section(byte(SpliceNullType), nil, desc),
+		section(byte(TimeSignalType), mustHex("7f"), descriptor(2, "00000001"+"7f"+"3f"+"02"+"01fe00000005"+"02fe0000000a"+
+			"0d"+"13"+"0303"+"414243"+"0c0c"+"12345678"+"0102030405060708"+"36"+"01"+"02"+"03"+"04")),
+		section(byte(TimeSignalType), mustHex("7f"), descriptor(2, "00000002ff")),
+		section(byte(SpliceScheduleType), mustHex("02"+"00000001"+"7f"+"ff"+"5f000000"+"fe00002710"+"0001"+"01"+"02"+
+			"00000002"+"7f"+"1f"+"01"+"03"+"5f000010"+"0002"+"00"+"00"), nil),
+		section(byte(SpliceInsertType), mustHex("00000003"+"7f"+"0f"+"02"+"01fe00000100"+"027f"+"0003"+"00"+"00"), nil),
+		section(byte(SpliceInsertType), mustHex("00000004"+"ff"), nil),
+		section(byte(BandwidthReservationType), nil, nil),
+		section(byte(PrivateCommandType), mustHex("41424344"+"010203"), nil),
+	)
+
+	for i, b := range sections {
+		s, err := Parse(b)
+		require.NoError(t, err, i)
+		enc, err := s.Encode()
+		require.NoError(t, err, i)
+		assert.Equal(t, hex.EncodeToString(b), hex.EncodeToString(enc), i)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	duration := uint64(30 * 90000)
+	s := &SpliceInfoSection{
+		SAPType: 3,
+		Tier:    0xfff,
+		TimeSignal: &TimeSignal{
+			SpliceTime: SpliceTime{TimeSpecifiedFlag: true, PTSTime: 0x1_2345_6789},
+		},
+		SpliceDescriptors: []SpliceDescriptor{{
+			SpliceDescriptorTag: SegmentationDescriptorTag,
+			Identifier:          CUEIdentifier,
+			SegmentationDescriptor: &SegmentationDescriptor{
+				SegmentationEventID:     7,
+				ProgramSegmentationFlag: true,
+				SegmentationDuration:    &duration,
+				SegmentationUPIDType:    UPIDAdID,
+				SegmentationUPIDs:       []SegmentationUPID{{SegmentationUPIDType: UPIDAdID, UPID: []byte("ABCD01234567")}},
+				SegmentationTypeID:      ProviderAdvertisementStart,
+				SegmentNum:              1,
+				SegmentsExpected:        1,
+			},
+		}},
+	}
+	b, err := s.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), mpegcrc.Checksum(b))
+
+	s2, err := Parse(b)
+	require.NoError(t, err)
+	assert.Equal(t, TimeSignalType, s2.SpliceCommandType)
+	s2.CRC32 = 0
+	s.SpliceCommandType = TimeSignalType
+	assert.Equal(t, s, s2)
+
+	// Invalid
+	_, err = (&SpliceInfoSection{SpliceCommandType: TimeSignalType}).Encode()
+	assert.Error(t, err)
+	_, err = (&SpliceInfoSection{SpliceNull: &SpliceNull{}, SpliceDescriptors: []SpliceDescriptor{{
+		Identifier:     CUEIdentifier,
+		DTMFDescriptor: &DTMFDescriptor{DTMFChar: "12345678"},
+	}}}).Encode()
+	assert.Error(t, err)
+}
@@ -6,8 +6,9 @@ import (
 	"io/ioutil"
 	"testing"
 
-	"github.com/Comcast/gots/scte35"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/eluv-io/avpipe/ts/scte35"
 )
 
 // print byte array for use in declaring variables, e.g. var testVss = []byte{0x00, 0xfc, 0x30}
@@ -32,36 +33,36 @@ func TestScteHex(t *testing.T) {
 			t.Error(err)
 			return
 		}
-		gsi, err := scte35.NewSCTE35(buf)
+		// The messages are TS packet payloads, starting with the pointer_field
+		msg, err := scte35.Parse(buf[1+int(buf[0]):])
 		if err != nil {
 			t.Error(err)
 			return
 		}
-		assert.True(t, gsi.CommandInfo().CommandType() == 5 || gsi.CommandInfo().CommandType() == 6)
+		assert.True(t, msg.SpliceCommandType == scte35.SpliceInsertType || msg.SpliceCommandType == scte35.TimeSignalType)
 
-		if gsi.CommandInfo().CommandType() == 6 {
-			si, err := ConvertGots(0, gsi)
-			if err != nil {
-				t.Error(err)
-				return
-			}
-			assert.EqualValues(t, si.SpliceCommandType, 6)
+		si, err := Convert(0, msg)
+		if err != nil {
+			t.Error(err)
+			return
 		}
+		assert.Equal(t, msg.SpliceCommandType, si.SpliceCommandType)
 
-		if gsi.CommandInfo().CommandType() == 5 {
-			assert.True(t, gsi.PTS().GreaterOrEqual(1))
+		if msg.SpliceCommandType == scte35.SpliceInsertType {
+			assert.NotNil(t, si.SpliceInsert)
+			assert.True(t, si.PTS >= 1)
 		}
 	}
 }
 
 func TestConvert(t *testing.T) {
 
-	gsi, err := scte35.NewSCTE35(scteMsg)
+	msg, err := scte35.Parse(scteMsg[1+int(scteMsg[0]):])
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	si, err := ConvertGots(0, gsi)
+	si, err := Convert(0, msg)
 	if err != nil {
 		t.Error(err)
 		return
@@ -71,6 +72,8 @@ func TestConvert(t *testing.T) {
 	if found != expected {
 		t.Errorf("Expected Upid %s, got %s", expected, found)
 	}
+	assert.Equal(t, 3, len(si.SpliceDescriptors))
+	assert.Equal(t, scte35.ChapterStart, si.SpliceDescriptors[2].SegmentationTypeId)
 	_, err = json.MarshalIndent(si, "", "  ")
 	if err != nil {
 		t.Error(err)
@@ -1,14 +1,14 @@
 package ts
 
 import (
+	"bufio"
 	"errors"
 	"io"
 	"os"
 
-	"github.com/Comcast/gots/packet"
-	"github.com/Comcast/gots/psi"
-	"github.com/Comcast/gots/scte35"
 	elog "github.com/eluv-io/log-go"
+
+	"github.com/eluv-io/avpipe/ts/scte35"
 )
 
 var log = elog.Get("/eluvio/avpipe/ts")
@@ -23,6 +23,7 @@ type Pipe struct {
 	sctePID   int
 	tsReader  io.ReadCloser  // to TS parser
 	teeWriter io.WriteCloser // keep this reference to close
+	monitor   *Monitor       // optional TR 101 290 monitor
 }
 
 type ScteSignal struct {
@@ -33,15 +34,28 @@ type ScteSignal struct {
 func NewPipe(source io.Reader, sourceCloser io.Closer, sctePID int,
 	tsInfo chan<- ScteSignal) *Pipe {
 
+	return NewMonitoredPipe(source, sourceCloser, sctePID, tsInfo, nil)
+}
+
+// NewMonitoredPipe is like NewPipe, and also feeds the stream into the monitor (if not nil).
+// The monitor is closed when the pipe is closed.
+func NewMonitoredPipe(source io.Reader, sourceCloser io.Closer, sctePID int,
+	tsInfo chan<- ScteSignal, monitor *Monitor) *Pipe {
+
 	pipeReader, pipeWriter := io.Pipe()
+	var w io.Writer = pipeWriter
+	if monitor != nil {
+		w = io.MultiWriter(monitor, pipeWriter)
+	}
 	p := &Pipe{
 		channel:   tsInfo,
 		in:        source,
 		inCloser:  sourceCloser,
-		out:       io.TeeReader(source, pipeWriter),
+		out:       io.TeeReader(source, w),
 		sctePID:   sctePID,
 		tsReader:  pipeReader,
 		teeWriter: pipeWriter,
+		monitor:   monitor,
 	}
 	go func() {
 		p.readTS()
@@ -65,6 +79,9 @@ func (t *Pipe) Close() (err error) {
 		err = e
 		log.Error("Pipe.Close in", err)
 	}
+	if t.monitor != nil {
+		_ = t.monitor.Close()
+	}
 	if t.channel != nil {
 		close(t.channel)
 		t.channel = nil
@@ -81,46 +98,26 @@ func (t *Pipe) readTS() {
 		_ = t.Close()
 	}()
 
-	pat, err := psi.ReadPAT(t.tsReader)
-	if err != nil {
-		log.Error("Failed to read PAT", err)
-	} else {
-		log.Debug("PAT", "PMT PIDs", pat.ProgramMap(),
-			"Number of Programs", pat.NumPrograms())
-	}
-
-	var pmts []psi.PMT
-	if pat != nil {
-		pm := pat.ProgramMap()
-		for pn, pid := range pm {
-			pmt, err := psi.ReadPMT(t.tsReader, pid)
-			if err != nil {
-				log.Error("Failed to read PMT", err)
-			} else {
-				pmts = append(pmts, pmt)
-				printPMT(pn, pmt)
-			}
-		}
-	}
-
-	var pkt packet.Packet
+	var pkt [tsPacketSize]byte
 	var numPackets uint64
 	var sctePackets uint64
+	pmtPIDs := make(map[uint16]bool)
 	scte35PIDs := make(map[uint16]bool)
-	for _, pmt := range pmts {
-		for _, es := range pmt.ElementaryStreams() {
-			if es.StreamType() == psi.PmtStreamTypeScte35 {
-				scte35PIDs[es.ElementaryPid()] = true
-				break
-			}
+	assemblers := make(map[uint16]*sectionAssembler)
+	sections := func(pid uint16, pusi bool, payload []byte) [][]byte {
+		a := assemblers[pid]
+		if a == nil {
+			a = &sectionAssembler{}
+			assemblers[pid] = a
 		}
+		return a.push(payload, pusi)
 	}
 
 	for {
-		if _, err = io.ReadFull(t.tsReader, pkt[:]); err != nil {
+		if _, err := io.ReadFull(t.tsReader, pkt[:]); err != nil {
 			if err != io.EOF && err != io.ErrUnexpectedEOF && err != io.ErrClosedPipe {
 				log.Error("Read error", err)
-				sendError(t.channel, err)
+				t.sendError(err)
 			}
 			break
 		}
@@ -128,56 +125,104 @@ func (t *Pipe) readTS() {
 		if numPackets%1000000 == 0 {
 			log.Debug("Total TS packets read", "count", numPackets)
 		}
-		currPID := packet.Pid(&pkt)
-		if !scte35PIDs[currPID] || (t.sctePID >= 0 && int(currPID) != t.sctePID) {
-			continue
-		}
-		sctePackets++
-		pay, err := packet.Payload(&pkt)
-		if err != nil {
-			log.Error("Error getting packet payload", err, "packet number", numPackets, "PID", currPID)
-			sendError(t.channel, err)
-			continue
-		}
-		msg, err := scte35.NewSCTE35(pay)
-		if err != nil {
-			log.Error("Error parsing SCTE-35", err)
-			sendError(t.channel, err)
-			continue
-		}
-		if msg.CommandInfo().CommandType() == scte35.SpliceNull {
+		if pkt[0] != tsSyncByte {
 			continue
 		}
-		si, err := ConvertGots(currPID, msg)
-		if err != nil {
-			log.Error("Error converting SCTE data", err)
-			sendError(t.channel, err)
+		currPID, pusi, payload := packetHeader(pkt[:])
+		if payload == nil {
 			continue
 		}
-		s := ScteSignal{
-			SpliceInfo: si,
+
+		switch {
+		case currPID == patPID:
+			for _, s := range sections(currPID, pusi, payload) {
+				if s[0] != patTableID || !validSection(s) {
+					continue
+				}
+				pm := parsePat(s)
+				for _, pid := range pm {
+					pmtPIDs[pid] = true
+				}
+				log.Trace("PAT", "PMT PIDs", pm)
+			}
+		case pmtPIDs[currPID]:
+			for _, s := range sections(currPID, pusi, payload) {
+				if s[0] != pmtTableID || !validSection(s) {
+					continue
+				}
+				_, streams := parsePmt(s)
+				for _, es := range streams {
+					if es.streamType == StreamTypeScte35 && !scte35PIDs[es.pid] {
+						scte35PIDs[es.pid] = true
+						log.Debug("SCTE-35 stream", "PMT PID", currPID, "PID", es.pid)
+					}
+				}
+			}
+		case scte35PIDs[currPID] && (t.sctePID < 0 || int(currPID) == t.sctePID):
+			sctePackets++
+			for _, s := range sections(currPID, pusi, payload) {
+				msg, err := scte35.Parse(s)
+				if err != nil {
+					log.Error("Error parsing SCTE-35", err, "packet number", numPackets, "PID", currPID)
+					t.sendError(err)
+					continue
+				}
+				if msg.SpliceCommandType == scte35.SpliceNullType {
+					continue
+				}
+				si, err := Convert(currPID, msg)
+				if err != nil {
+					log.Error("Error converting SCTE data", err)
+					t.sendError(err)
+					continue
+				}
+				t.send(ScteSignal{
+					SpliceInfo: si,
+				})
+			}
 		}
-		t.channel <- s
 	}
 
 	log.Debug("SCTE35 packets read", "count", sctePackets)
 	log.Debug("Total packets read", "count", numPackets)
 }
 
-func printPMT(pn uint16, pmt psi.PMT) {
-	log.Debug("PMT", "program", pn, "PIDs", pmt.Pids())
-	for _, es := range pmt.ElementaryStreams() {
-		log.Debug("Elementary Stream", "PID", es.ElementaryPid(),
-			"StreamType", es.StreamType(), "description", es.StreamTypeDescription())
-		for _, d := range es.Descriptors() {
-			log.Debug("Descriptor", "tag", d)
-		}
+func (t *Pipe) send(s ScteSignal) {
+	if t.channel != nil {
+		t.channel <- s
 	}
 }
 
-func sendError(c chan<- ScteSignal, err error) {
-	s := ScteSignal{
+func (t *Pipe) sendError(err error) {
+	t.send(ScteSignal{
 		Err: err,
+	})
+}
+
+// Sync discards the bytes before the first sync byte followed by sync bytes at packet
+// intervals (up to 5 packets), and returns the number of bytes discarded.
+func Sync(r *bufio.Reader) (n int64, err error) {
+	for {
+		b, err := r.Peek(syncLock * tsPacketSize)
+		if len(b) < tsPacketSize {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		synced := true
+		for i := 0; i < len(b); i += tsPacketSize {
+			if b[i] != tsSyncByte {
+				synced = false
+				break
+			}
+		}
+		if synced {
+			return n, nil
+		}
+		if _, err = r.Discard(1); err != nil {
+			return n, err
+		}
+		n++
 	}
-	c <- s
 }